@@ -9,13 +9,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"io"
 	"net/http"
 	"path/filepath"
 
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
 )
 
 const assetStoreDBSuffix string = "assets"
@@ -54,11 +54,13 @@ func (s *store) Prepare() error {
 		return err
 	}
 	if !exists {
-		fmt.Printf("Creating database %q...", dbName)
 		if err := s.client.CreateDB(s.ctx, dbName); err != nil {
 			return err
 		}
-		fmt.Println("ok.")
+		logrus.WithFields(logrus.Fields{
+			"nspace": "couchdb",
+			"db":     dbName,
+		}).Info("Database created")
 	}
 
 	db := s.client.DB(s.ctx, dbName)
@@ -55,6 +55,7 @@ type (
 		name               string
 		editorSalt         []byte
 		masterSalt         []byte
+		publicKey          []byte
 		autoPublication    bool
 		revocationCounters map[string]int
 	}
@@ -176,6 +177,13 @@ func (r *EditorRegistry) RevokeEditorTokens(editor *Editor) error {
 	return r.UpdateEditor(editor)
 }
 
+// RevokeAppTokens revokes the editor tokens of an application, and the
+// scoped tokens for this application, by incrementing its revocation counter.
+func (r *EditorRegistry) RevokeAppTokens(editor *Editor, appName string) error {
+	editor.incrementRevocationCounter(appName)
+	return r.UpdateEditor(editor)
+}
+
 func DecryptMasterSecret(content, passphrase []byte) ([]byte, error) {
 	var encryptedSecret struct {
 		Salt   []byte
@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/mango"
+	"github.com/go-kivik/kivik/v3"
+)
+
+// DeviceLogins is the list of the logins in progress with the device-code
+// flow. Like Editors, it is a global variable initialized with the connection
+// to CouchDB.
+var DeviceLogins *DeviceLoginStore
+
+// States of a device login
+const (
+	DeviceLoginPending  = "pending"
+	DeviceLoginApproved = "approved"
+	DeviceLoginDenied   = "denied"
+)
+
+// userCodeAlphabet is the alphabet of the user codes, without the characters
+// that can be confused (0/O, 1/I, etc.).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+const userCodeLen = 8
+
+// userCodeIndex is the name of the mango index used to find a login by its
+// user code.
+const userCodeIndex = "by-user-code"
+
+var (
+	ErrDeviceLoginNotFound = errshttp.NewError(http.StatusNotFound, "Login not found or expired")
+	ErrDeviceLoginPending  = errshttp.NewError(http.StatusBadRequest, "Login is waiting for the validation")
+	ErrDeviceLoginDenied   = errshttp.NewError(http.StatusForbidden, "Login has been denied")
+)
+
+// DeviceLoginStore keeps the logins in progress with the device-code flow: the
+// CLI asks for a login and receives a device code (secret) and a user code
+// (short). The user code is validated in a browser, and the CLI polls with
+// the device code to receive its token.
+type DeviceLoginStore struct {
+	db  *kivik.DB
+	ctx context.Context
+}
+
+// DeviceLogin is a login in progress. The device code is stored by its hash.
+type DeviceLogin struct {
+	ID          string    `json:"_id,omitempty"`
+	Rev         string    `json:"_rev,omitempty"`
+	UserCode    string    `json:"user_code"`
+	Editor      string    `json:"editor"`
+	Scope       string    `json:"scope"`
+	State       string    `json:"state"`
+	Identity    string    `json:"identity,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	ValidatedAt time.Time `json:"validated_at,omitempty"`
+}
+
+func NewDeviceLoginStore(db *kivik.DB) *DeviceLoginStore {
+	return &DeviceLoginStore{db, context.Background()}
+}
+
+// CreateIndexes creates the mango index on the user codes, used when a login
+// is validated in the browser.
+func (s *DeviceLoginStore) CreateIndexes() error {
+	return s.db.CreateIndex(s.ctx, userCodeIndex, userCodeIndex, map[string]interface{}{
+		"fields": []string{"user_code"},
+	})
+}
+
+// Create starts a login for the editor, and returns it with its device code.
+func (s *DeviceLoginStore) Create(editor *Editor, scope string, ttl time.Duration) (*DeviceLogin, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(secret)
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now().UTC()
+	login := &DeviceLogin{
+		ID:        TokenHash([]byte(deviceCode)),
+		UserCode:  userCode,
+		Editor:    editor.Name(),
+		Scope:     scope,
+		State:     DeviceLoginPending,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	if login.Rev, err = s.db.Put(s.ctx, login.ID, login); err != nil {
+		return nil, "", err
+	}
+	return login, deviceCode, nil
+}
+
+// newUserCode returns a random code, like BCDF-GHJK, easy to type.
+func newUserCode() (string, error) {
+	b := make([]byte, userCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var code strings.Builder
+	for i, c := range b {
+		if i == userCodeLen/2 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+	}
+	return code.String(), nil
+}
+
+// NormalizeUserCode returns the user code as it is stored, to accept the codes
+// typed in lower case or without the dash.
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	if len(code) != userCodeLen {
+		return code
+	}
+	return code[:userCodeLen/2] + "-" + code[userCodeLen/2:]
+}
+
+// FindByUserCode returns the pending login with the given user code.
+func (s *DeviceLoginStore) FindByUserCode(userCode string) (*DeviceLogin, error) {
+	req, err := mango.New(userCodeIndex).
+		Where("user_code", mango.Eq, NormalizeUserCode(userCode)).
+		Limit(1).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Find(s.ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var login DeviceLogin
+		if err := rows.ScanDoc(&login); err != nil {
+			return nil, err
+		}
+		if login.State != DeviceLoginPending || time.Now().After(login.ExpiresAt) {
+			return nil, ErrDeviceLoginNotFound
+		}
+		return &login, nil
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrDeviceLoginNotFound
+}
+
+// Validate approves or denies a pending login, for the given identity.
+func (s *DeviceLoginStore) Validate(login *DeviceLogin, identity string, approved bool) error {
+	login.State = DeviceLoginDenied
+	if approved {
+		login.State = DeviceLoginApproved
+	}
+	login.Identity = identity
+	login.ValidatedAt = time.Now().UTC()
+	rev, err := s.db.Put(s.ctx, login.ID, login)
+	if err != nil {
+		return err
+	}
+	login.Rev = rev
+	return nil
+}
+
+// Consume returns the login for the device code if it has been approved, and
+// removes it, so that a device code can be exchanged for a token only once.
+func (s *DeviceLoginStore) Consume(deviceCode string) (*DeviceLogin, error) {
+	var login DeviceLogin
+	err := s.db.Get(s.ctx, TokenHash([]byte(deviceCode))).ScanDoc(&login)
+	if kivik.StatusCode(err) == http.StatusNotFound {
+		return nil, ErrDeviceLoginNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(login.ExpiresAt) {
+		_, _ = s.db.Delete(s.ctx, login.ID, login.Rev)
+		return nil, ErrDeviceLoginNotFound
+	}
+	switch login.State {
+	case DeviceLoginPending:
+		return nil, ErrDeviceLoginPending
+	case DeviceLoginDenied:
+		_, _ = s.db.Delete(s.ctx, login.ID, login.Rev)
+		return nil, ErrDeviceLoginDenied
+	}
+	if _, err := s.db.Delete(s.ctx, login.ID, login.Rev); err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil, ErrDeviceLoginNotFound // Already consumed
+		}
+		return nil, err
+	}
+	return &login, nil
+}
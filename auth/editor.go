@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path"
 	"strings"
 	"time"
 
@@ -14,12 +15,21 @@ import (
 
 type tokenData struct {
 	App string `json:"app"`
+	// Scope is a pattern for the slugs of the applications (like cozy-*),
+	// for the tokens that are not restricted to a single application.
+	Scope string `json:"scope,omitempty"`
+	// Counters are the revocation counters of the applications matching the
+	// scope when the token was generated: the token is no longer valid for an
+	// application whose counter has changed since.
+	Counters map[string]int `json:"counters,omitempty"`
 }
 
 func (t *tokenData) UnmarshalJSON(data []byte) error {
 	var v struct {
-		Apps []string `json:"apps"` // retro-compat
-		App  string   `json:"app"`
+		Apps     []string       `json:"apps"` // retro-compat
+		App      string         `json:"app"`
+		Scope    string         `json:"scope"`
+		Counters map[string]int `json:"counters"`
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
@@ -29,6 +39,8 @@ func (t *tokenData) UnmarshalJSON(data []byte) error {
 	} else {
 		t.App = v.App
 	}
+	t.Scope = v.Scope
+	t.Counters = v.Counters
 	return nil
 }
 
@@ -102,6 +114,42 @@ func (e *Editor) GenerateEditorToken(masterSecret []byte, maxAge time.Duration,
 	return generateToken(masterSecret, token, nil, maxAge)
 }
 
+// GenerateScopedEditorToken generates an editor token that can be used for
+// the applications of the editor with a slug matching the given pattern (with
+// the syntax of path.Match, like cozy-*). Like the tokens of an application,
+// it is revoked for an application when the revocation counter of this
+// application is incremented.
+func (e *Editor) GenerateScopedEditorToken(masterSecret []byte, maxAge time.Duration, pattern string) ([]byte, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("Could not generate editor token without scope")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid scope %q: %s", pattern, err)
+	}
+	sessionSecret, err := e.derivateSecret(masterSecret, e.editorSalt)
+	if err != nil {
+		return nil, err
+	}
+	var counters map[string]int
+	for appName, counter := range e.revocationCounters {
+		if matched, _ := path.Match(pattern, appName); matched && counter > 0 {
+			if counters == nil {
+				counters = make(map[string]int)
+			}
+			counters[appName] = counter
+		}
+	}
+	data, err := json.Marshal(tokenData{Scope: pattern, Counters: counters})
+	if err != nil {
+		return nil, err
+	}
+	token, err := generateToken(sessionSecret, data, e.scopedAdditionalData(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return generateToken(masterSecret, token, nil, maxAge)
+}
+
 func (e *Editor) VerifyEditorToken(masterSecret, token []byte, appName string) bool {
 	if appName == "" {
 		panic(errors.New("Could not verify token: empty application name"))
@@ -115,9 +163,16 @@ func (e *Editor) VerifyEditorToken(masterSecret, token []byte, appName string) b
 		return false
 	}
 	var data []byte
+	scoped := false
 	data, ok = verifyToken(sessionSecret, value, e.additionalData(appName))
 	if !ok {
-		return false
+		// The revocation counters of the applications are in the data of
+		// the scoped tokens
+		data, ok = verifyToken(sessionSecret, value, e.scopedAdditionalData())
+		if !ok {
+			return false
+		}
+		scoped = true
 	}
 	var v tokenData
 	if len(data) > 0 {
@@ -125,12 +180,43 @@ func (e *Editor) VerifyEditorToken(masterSecret, token []byte, appName string) b
 			return false
 		}
 	}
+	if v.Scope != "" {
+		matched, err := path.Match(v.Scope, appName)
+		if err != nil || !matched {
+			return false
+		}
+		// The tokens of the application have been revoked since the
+		// generation of the scoped token
+		return v.Counters[appName] == e.revocationCounters[appName]
+	}
+	if scoped {
+		return false
+	}
 	if v.App == "" {
 		return true
 	}
 	return appName == v.App
 }
 
+// VerifyScopedEditorToken returns true if the token is a scoped editor token
+// of the editor, whatever its scope.
+func (e *Editor) VerifyScopedEditorToken(masterSecret, token []byte) bool {
+	value, ok := verifyToken(masterSecret, token, nil)
+	if !ok {
+		return false
+	}
+	sessionSecret, err := e.derivateSecret(masterSecret, e.editorSalt)
+	if err != nil {
+		return false
+	}
+	data, ok := verifyToken(sessionSecret, value, e.scopedAdditionalData())
+	if !ok {
+		return false
+	}
+	var v tokenData
+	return json.Unmarshal(data, &v) == nil && v.Scope != ""
+}
+
 func (e *Editor) additionalData(appName string) []byte {
 	editorName := strings.ToLower(e.name)
 	if counter, ok := e.revocationCounters[appName]; ok && counter > 0 {
@@ -139,6 +225,19 @@ func (e *Editor) additionalData(appName string) []byte {
 	return []byte(editorName)
 }
 
+func (e *Editor) incrementRevocationCounter(appName string) {
+	counters := make(map[string]int, len(e.revocationCounters)+1)
+	for k, v := range e.revocationCounters {
+		counters[k] = v
+	}
+	counters[appName]++
+	e.revocationCounters = counters
+}
+
+func (e *Editor) scopedAdditionalData() []byte {
+	return []byte(strings.ToLower(e.name))
+}
+
 func (e *Editor) derivateSecret(masterSecret, salt []byte) ([]byte, error) {
 	if len(masterSecret) != secretLen {
 		panic("master secret has no correct length")
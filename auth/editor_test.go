@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryVault is a vault that keeps the editors in memory.
+type memoryVault struct {
+	editors map[string]*Editor
+}
+
+func (v *memoryVault) GetEditor(editorName string) (*Editor, error) {
+	e, ok := v.editors[editorName]
+	if !ok {
+		return nil, ErrEditorNotFound
+	}
+	return e, nil
+}
+
+func (v *memoryVault) CreateEditor(editor *Editor) error {
+	v.editors[editor.name] = editor
+	return nil
+}
+
+func (v *memoryVault) UpdateEditor(editor *Editor) error {
+	v.editors[editor.name] = editor
+	return nil
+}
+
+func (v *memoryVault) DeleteEditor(editor *Editor) error {
+	delete(v.editors, editor.name)
+	return nil
+}
+
+func (v *memoryVault) AllEditors() ([]*Editor, error) {
+	editors := make([]*Editor, 0, len(v.editors))
+	for _, e := range v.editors {
+		editors = append(editors, e)
+	}
+	return editors, nil
+}
+
+func newTestEditor(name string) *Editor {
+	return &Editor{
+		name:       name,
+		editorSalt: readRand(saltsLen),
+		masterSalt: readRand(saltsLen),
+	}
+}
+
+func TestScopedEditorToken(t *testing.T) {
+	secret := GenerateMasterSecret()
+	editor := newTestEditor("cozy")
+
+	_, err := editor.GenerateScopedEditorToken(secret, 0, "")
+	assert.Error(t, err)
+	_, err = editor.GenerateScopedEditorToken(secret, 0, "cozy-[")
+	assert.Error(t, err)
+
+	token, err := editor.GenerateScopedEditorToken(secret, 0, "cozy-*")
+	require.NoError(t, err)
+	assert.True(t, editor.VerifyEditorToken(secret, token, "cozy-drive"))
+	assert.True(t, editor.VerifyEditorToken(secret, token, "cozy-photos"))
+	assert.False(t, editor.VerifyEditorToken(secret, token, "drive"))
+	assert.True(t, editor.VerifyScopedEditorToken(secret, token))
+	assert.False(t, editor.VerifyMasterToken(secret, token))
+
+	// The token is not valid for another editor
+	other := newTestEditor("other")
+	assert.False(t, other.VerifyEditorToken(secret, token, "cozy-drive"))
+
+	// A token for an application is not a scoped token
+	appToken, err := editor.GenerateEditorToken(secret, 0, "cozy-drive")
+	require.NoError(t, err)
+	assert.True(t, editor.VerifyEditorToken(secret, appToken, "cozy-drive"))
+	assert.False(t, editor.VerifyEditorToken(secret, appToken, "cozy-photos"))
+	assert.False(t, editor.VerifyScopedEditorToken(secret, appToken))
+
+	// The expired tokens are refused
+	expired, err := editor.GenerateScopedEditorToken(secret, time.Nanosecond, "cozy-*")
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	assert.False(t, editor.VerifyEditorToken(secret, expired, "cozy-drive"))
+}
+
+func TestRevokeAppTokens(t *testing.T) {
+	secret := GenerateMasterSecret()
+	editor := newTestEditor("cozy")
+	registry := NewEditorRegistry(&memoryVault{editors: map[string]*Editor{"cozy": editor}})
+
+	appToken, err := editor.GenerateEditorToken(secret, 0, "cozy-drive")
+	require.NoError(t, err)
+	scoped, err := editor.GenerateScopedEditorToken(secret, 0, "cozy-*")
+	require.NoError(t, err)
+
+	require.NoError(t, registry.RevokeAppTokens(editor, "cozy-drive"))
+
+	// The tokens for the revoked application are no longer valid, but the
+	// scoped token is still valid for the other applications
+	assert.False(t, editor.VerifyEditorToken(secret, appToken, "cozy-drive"))
+	assert.False(t, editor.VerifyEditorToken(secret, scoped, "cozy-drive"))
+	assert.True(t, editor.VerifyEditorToken(secret, scoped, "cozy-photos"))
+
+	// The tokens generated after the revocation are valid
+	appToken, err = editor.GenerateEditorToken(secret, 0, "cozy-drive")
+	require.NoError(t, err)
+	assert.True(t, editor.VerifyEditorToken(secret, appToken, "cozy-drive"))
+	scoped, err = editor.GenerateScopedEditorToken(secret, 0, "cozy-*")
+	require.NoError(t, err)
+	assert.True(t, editor.VerifyEditorToken(secret, scoped, "cozy-drive"))
+	assert.True(t, editor.VerifyEditorToken(secret, scoped, "cozy-photos"))
+
+	// A new revocation revokes them again
+	require.NoError(t, registry.RevokeAppTokens(editor, "cozy-drive"))
+	assert.False(t, editor.VerifyEditorToken(secret, scoped, "cozy-drive"))
+	assert.True(t, editor.VerifyEditorToken(secret, scoped, "cozy-photos"))
+
+	// The rotation of the salt revokes all the editor tokens
+	require.NoError(t, registry.RevokeEditorTokens(editor))
+	assert.False(t, editor.VerifyEditorToken(secret, scoped, "cozy-photos"))
+}
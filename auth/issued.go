@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kivik/kivik/v3"
+)
+
+// IssuedTokens is the register of the tokens generated for the editors. Like
+// Revocations, it is a global variable initialized with the connection to
+// CouchDB.
+var IssuedTokens *TokenRegister
+
+// Kinds of tokens
+const (
+	MasterToken = "master"
+	EditorToken = "editor"
+	RoleToken   = "role"
+)
+
+// Status of the issued tokens
+const (
+	TokenActive  = "active"
+	TokenExpired = "expired"
+	TokenRevoked = "revoked"
+)
+
+// TokenRegister keeps the metadata of the tokens generated for the editors,
+// so that they can audit them. The tokens themselves are not stored, only
+// their hash (like in the revocation list). The tokens generated before the
+// register existed are not known.
+type TokenRegister struct {
+	db  *kivik.DB
+	ctx context.Context
+}
+
+// IssuedToken is a document of the register of the issued tokens.
+type IssuedToken struct {
+	ID        string     `json:"_id,omitempty"`
+	Rev       string     `json:"_rev,omitempty"`
+	Editor    string     `json:"editor"`
+	Kind      string     `json:"kind"`
+	App       string     `json:"app,omitempty"`
+	Scope     string     `json:"scope,omitempty"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func NewTokenRegister(db *kivik.DB) *TokenRegister {
+	return &TokenRegister{db, context.Background()}
+}
+
+// Record adds a token generated for the editor to the register. The app is
+// set for the tokens of a single application, and the scope for the scoped
+// editor tokens, or the role for the role tokens.
+func (r *TokenRegister) Record(editor *Editor, token []byte, kind, app, scope string, maxAge time.Duration) error {
+	now := time.Now().UTC()
+	doc := &IssuedToken{
+		ID:       TokenHash(token),
+		Editor:   editor.name,
+		Kind:     kind,
+		App:      app,
+		Scope:    scope,
+		IssuedAt: now,
+	}
+	if maxAge > 0 {
+		expiresAt := now.Add(maxAge)
+		doc.ExpiresAt = &expiresAt
+	}
+	_, err := r.db.Put(r.ctx, doc.ID, doc)
+	if kivik.StatusCode(err) == http.StatusConflict {
+		return nil // Already recorded
+	}
+	return err
+}
+
+// Find returns the metadata of a token, or nil if the token is not in the
+// register.
+func (r *TokenRegister) Find(token []byte) (*IssuedToken, error) {
+	var doc IssuedToken
+	err := r.db.Get(r.ctx, TokenHash(token)).ScanDoc(&doc)
+	if kivik.StatusCode(err) == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// ListByEditor returns the tokens issued for an editor, the most recent
+// first.
+func (r *TokenRegister) ListByEditor(editorName string) ([]*IssuedToken, error) {
+	rows, err := r.db.Find(r.ctx, map[string]interface{}{
+		"selector": map[string]interface{}{"editor": editorName},
+		"limit":    10000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []*IssuedToken{}
+	for rows.Next() {
+		var doc IssuedToken
+		if err := rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &doc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(tokens, func(i, j int) bool {
+		return tokens[i].IssuedAt.After(tokens[j].IssuedAt)
+	})
+	return tokens, nil
+}
+
+// Status returns if the token is active, expired or revoked, from the
+// revocation list and the rotations of the salts of the editor.
+func (t *IssuedToken) Status(revoked bool, rotations map[string]time.Time) string {
+	if revoked {
+		return TokenRevoked
+	}
+	kind := t.Kind
+	if kind == RoleToken {
+		// The role tokens are derived from the master salt
+		kind = MasterToken
+	}
+	if rotatedAt, ok := rotations[kind]; ok && !t.IssuedAt.After(rotatedAt) {
+		return TokenRevoked
+	}
+	if t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt) {
+		return TokenExpired
+	}
+	return TokenActive
+}
@@ -0,0 +1,328 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"golang.org/x/sync/singleflight"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const bearerScheme = "Bearer "
+
+// jwksRefreshInterval is the maximal age of the keys of the issuer. When a
+// token is signed by an unknown key, the keys are fetched again, but not more
+// than once per jwksMinRefreshInterval.
+const (
+	jwksRefreshInterval    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+var ErrOperatorNotAllowed = errshttp.NewError(http.StatusForbidden,
+	"The token is valid, but it is not allowed to use the admin endpoints")
+
+// OIDCConfig is the configuration of an OpenID Connect provider.
+type OIDCConfig struct {
+	// Issuer is the URL of the issuer of the tokens, as in their iss claim.
+	Issuer string
+	// Audience must be in the aud claim of the tokens.
+	Audience string
+	// JWKSURL is the URL of the public keys of the issuer. It is discovered
+	// from the OpenID configuration of the issuer when empty.
+	JWKSURL string
+	// Subjects are the sub claims of the operators.
+	Subjects []string
+	// GroupsClaim is the name of the claim with the groups of the user.
+	GroupsClaim string
+	// Groups are the groups of the operators.
+	Groups []string
+	// Leeway is the tolerance for the clock skew with the issuer.
+	Leeway time.Duration
+}
+
+// signingAlgs are the algorithms accepted for the signature of the tokens.
+// The none and HMAC algorithms are refused, as the registry only knows the
+// public keys of the issuer.
+var signingAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	string(jose.EdDSA),
+}
+
+// OIDCProvider authenticates the operators with the JWT bearer tokens issued
+// by an OpenID Connect provider, for the single sign-on. The tokens are
+// verified with go-oidc and the public keys of the issuer (JWKS), and the
+// operators are allowed by their subject or their groups.
+type OIDCProvider struct {
+	config   OIDCConfig
+	client   *http.Client
+	verifier *oidc.IDTokenVerifier
+
+	// The keys are fetched outside of the lock, and only once for the
+	// concurrent requests.
+	fetches   singleflight.Group
+	mu        sync.Mutex
+	keys      map[string]jose.JSONWebKey
+	fetchedAt time.Time
+}
+
+// NewOIDCProvider returns a provider for the given configuration. The keys
+// of the issuer are fetched with the first token.
+func NewOIDCProvider(config OIDCConfig) (*OIDCProvider, error) {
+	if config.Issuer == "" {
+		return nil, errors.New("The issuer is required for OIDC")
+	}
+	if config.Audience == "" {
+		return nil, errors.New("The audience is required for OIDC")
+	}
+	if len(config.Subjects) == 0 && len(config.Groups) == 0 {
+		return nil, errors.New("The subjects or the groups of the operators are required for OIDC")
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	p := &OIDCProvider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	// The expiration is checked by checkClaims, with the leeway
+	p.verifier = oidc.NewVerifier(config.Issuer, p, &oidc.Config{
+		ClientID:             config.Audience,
+		SupportedSigningAlgs: signingAlgs,
+		SkipExpiryCheck:      true,
+	})
+	return p, nil
+}
+
+func (p *OIDCProvider) Name() string {
+	return "oidc"
+}
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf"`
+}
+
+// Authenticate verifies the bearer token of the request.
+func (p *OIDCProvider) Authenticate(req *http.Request) (*Identity, error) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, bearerScheme) {
+		return nil, ErrNoCredentials
+	}
+	token := strings.TrimSpace(authHeader[len(bearerScheme):])
+
+	// go-oidc checks the signature, the issuer and the audience
+	idToken, err := p.verifier.Verify(req.Context(), token)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JWT: %s", err)
+	}
+	var claims jwtClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("Invalid JWT claims: %s", err)
+	}
+	if err := p.checkClaims(&claims); err != nil {
+		return nil, err
+	}
+	var all map[string]interface{}
+	if err := idToken.Claims(&all); err != nil {
+		return nil, fmt.Errorf("Invalid JWT claims: %s", err)
+	}
+	if !p.isOperator(claims.Subject, all[p.config.GroupsClaim]) {
+		return nil, ErrOperatorNotAllowed
+	}
+	return &Identity{Provider: p.Name(), Subject: claims.Subject}, nil
+}
+
+func (p *OIDCProvider) checkClaims(claims *jwtClaims) error {
+	now := time.Now()
+	if claims.ExpiresAt == 0 {
+		return errors.New("Invalid JWT: the exp claim is required")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(p.config.Leeway)) {
+		return errors.New("Invalid JWT: the token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(p.config.Leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("Invalid JWT: the token is not valid yet")
+	}
+	if claims.Subject == "" {
+		return errors.New("Invalid JWT: the sub claim is required")
+	}
+	return nil
+}
+
+// isOperator returns true if the subject, or one of the groups of the token,
+// is allowed to use the admin endpoints.
+func (p *OIDCProvider) isOperator(subject string, groups interface{}) bool {
+	for _, s := range p.config.Subjects {
+		if s == subject {
+			return true
+		}
+	}
+	var list []string
+	switch groups := groups.(type) {
+	case string:
+		list = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if g, ok := g.(string); ok {
+				list = append(list, g)
+			}
+		}
+	}
+	for _, g := range list {
+		for _, allowed := range p.config.Groups {
+			if g == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// VerifySignature checks the signature of a JWT with the key of the issuer
+// given in its header. It implements the oidc.KeySet interface.
+func (p *OIDCProvider) VerifySignature(ctx context.Context, token string) ([]byte, error) {
+	jws, err := jose.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("a single signature is expected")
+	}
+	header := jws.Signatures[0].Header
+	key, err := p.getKey(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if !algMatchesKey(header.Algorithm, key) {
+		return nil, fmt.Errorf("the algorithm %q can't be used with the key %q", header.Algorithm, header.KeyID)
+	}
+	return jws.Verify(&key)
+}
+
+// algMatchesKey returns true if the signature algorithm is the one of the key
+// type, and for ECDSA, of its curve: a key must not be used with another
+// algorithm than the one it has been made for.
+func algMatchesKey(alg string, key jose.JSONWebKey) bool {
+	if key.Algorithm != "" && key.Algorithm != alg {
+		return false
+	}
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		switch jose.SignatureAlgorithm(alg) {
+		case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		switch jose.SignatureAlgorithm(alg) {
+		case jose.ES256:
+			return k.Curve == elliptic.P256()
+		case jose.ES384:
+			return k.Curve == elliptic.P384()
+		case jose.ES512:
+			return k.Curve == elliptic.P521()
+		}
+	case ed25519.PublicKey:
+		return jose.SignatureAlgorithm(alg) == jose.EdDSA
+	}
+	return false
+}
+
+// getKey returns the public key of the issuer with the given identifier. The
+// keys are fetched again when they are too old, or when the key is unknown
+// (rotation of the keys by the issuer).
+func (p *OIDCProvider) getKey(kid string) (jose.JSONWebKey, error) {
+	p.mu.Lock()
+	age := time.Since(p.fetchedAt)
+	key, ok := p.keys[kid]
+	canFetch := p.keys == nil || age >= jwksMinRefreshInterval
+	p.mu.Unlock()
+	if ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+
+	if canFetch {
+		keys, err, _ := p.fetches.Do("jwks", func() (interface{}, error) {
+			keys, err := p.fetchKeys()
+			if err != nil {
+				return nil, err
+			}
+			p.mu.Lock()
+			p.keys = keys
+			p.fetchedAt = time.Now()
+			p.mu.Unlock()
+			return keys, nil
+		})
+		if err != nil {
+			return jose.JSONWebKey{}, fmt.Errorf("Cannot fetch the keys of the OIDC issuer: %s", err)
+		}
+		key, ok = keys.(map[string]jose.JSONWebKey)[kid]
+	}
+	if !ok {
+		return jose.JSONWebKey{}, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) fetchKeys() (map[string]jose.JSONWebKey, error) {
+	jwksURL := p.config.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		configURL := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := p.getJSON(configURL, &discovery); err != nil {
+			return nil, err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, errors.New("No jwks_uri in the OpenID configuration")
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]jose.JSONWebKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		// The keys of unsupported types are ignored
+		var key jose.JSONWebKey
+		if err := key.UnmarshalJSON(raw); err != nil || !key.Valid() || !key.IsPublic() {
+			continue
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		keys[key.KeyID] = key
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	res, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status code %d for %s", res.StatusCode, u)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,247 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type oidcTestIssuer struct {
+	server  *httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	fetches int
+}
+
+func newOIDCTestIssuer(t *testing.T) *oidcTestIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	issuer := &oidcTestIssuer{rsaKey: rsaKey, ecKey: ecKey}
+	issuer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   issuer.server.URL,
+				"jwks_uri": issuer.server.URL + "/keys",
+			})
+		case "/keys":
+			issuer.fetches++
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: rsaKey.Public(), KeyID: "rsa", Use: "sig"},
+				{Key: ecKey.Public(), KeyID: "ec", Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return issuer
+}
+
+func (i *oidcTestIssuer) provider(t *testing.T) *OIDCProvider {
+	p, err := NewOIDCProvider(OIDCConfig{
+		Issuer:   i.server.URL,
+		Audience: "registry",
+		Subjects: []string{"alice"},
+		Groups:   []string{"ops"},
+		Leeway:   time.Minute,
+	})
+	require.NoError(t, err)
+	return p
+}
+
+func (i *oidcTestIssuer) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss": i.server.URL,
+		"aud": "registry",
+		"sub": "alice",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func signJWT(t *testing.T, alg jose.SignatureAlgorithm, kid string, key interface{}, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: alg,
+		Key:       jose.JSONWebKey{Key: key, KeyID: kid},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	obj, err := signer.Sign(payload)
+	require.NoError(t, err)
+	token, err := obj.CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+func authenticateJWT(p *OIDCProvider, token string) (*Identity, error) {
+	req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return p.Authenticate(req)
+}
+
+func TestOIDCValidTokens(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+
+	token := signJWT(t, jose.RS256, "rsa", issuer.rsaKey, issuer.claims())
+	identity, err := authenticateJWT(p, token)
+	require.NoError(t, err)
+	assert.Equal(t, "oidc", identity.Provider)
+	assert.Equal(t, "alice", identity.Subject)
+
+	claims := issuer.claims()
+	claims["sub"] = "bob"
+	claims["groups"] = []string{"devs", "ops"}
+	claims["aud"] = []string{"other", "registry"}
+	token = signJWT(t, jose.ES256, "ec", issuer.ecKey, claims)
+	identity, err = authenticateJWT(p, token)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", identity.Subject)
+
+	// The keys are cached
+	assert.Equal(t, 1, issuer.fetches)
+}
+
+func TestOIDCNotOperator(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+
+	claims := issuer.claims()
+	claims["sub"] = "mallory"
+	claims["groups"] = []string{"devs"}
+	_, err := authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Equal(t, ErrOperatorNotAllowed, err)
+}
+
+func TestOIDCBadSignature(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+
+	// Signed by another key with the kid of the issuer key
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", other, issuer.claims()))
+	assert.Error(t, err)
+
+	// Unknown key
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "unknown", other, issuer.claims()))
+	assert.Error(t, err)
+
+	// Claims modified after the signature
+	token := signJWT(t, jose.RS256, "rsa", issuer.rsaKey, issuer.claims())
+	claims := issuer.claims()
+	claims["sub"] = "bob"
+	payload, _ := json.Marshal(claims)
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	_, err = authenticateJWT(p, forged)
+	assert.Error(t, err)
+}
+
+func TestOIDCAlgorithmKeyMismatch(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+
+	// HMAC with the public RSA key as the secret
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa", "typ": "JWT"})
+	payload, _ := json.Marshal(issuer.claims())
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	der, err := x509.MarshalPKIXPublicKey(issuer.rsaKey.Public())
+	require.NoError(t, err)
+	mac := hmac.New(sha256.New, der)
+	mac.Write([]byte(signed))
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	_, err = authenticateJWT(p, token)
+	assert.Error(t, err)
+
+	// RSA algorithm announced with the kid of the EC key
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "ec", issuer.rsaKey, issuer.claims()))
+	assert.Error(t, err)
+
+	rsaKey := jose.JSONWebKey{Key: issuer.rsaKey.Public()}
+	p256Key := jose.JSONWebKey{Key: issuer.ecKey.Public()}
+	assert.True(t, algMatchesKey("RS256", rsaKey))
+	assert.True(t, algMatchesKey("PS512", rsaKey))
+	assert.False(t, algMatchesKey("ES256", rsaKey))
+	assert.False(t, algMatchesKey("HS256", rsaKey))
+	assert.True(t, algMatchesKey("ES256", p256Key))
+	assert.False(t, algMatchesKey("ES384", p256Key))
+	assert.False(t, algMatchesKey("ES512", p256Key))
+	assert.False(t, algMatchesKey("RS256", p256Key))
+	rsaKey.Algorithm = "RS256"
+	assert.False(t, algMatchesKey("PS256", rsaKey))
+}
+
+func TestOIDCExpiration(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+	now := time.Now()
+
+	claims := issuer.claims()
+	claims["exp"] = now.Add(-2 * time.Minute).Unix()
+	_, err := authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+
+	// In the leeway
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.NoError(t, err)
+
+	delete(claims, "exp")
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+
+	claims = issuer.claims()
+	claims["nbf"] = now.Add(5 * time.Minute).Unix()
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+
+	claims["nbf"] = now.Add(30 * time.Second).Unix()
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.NoError(t, err)
+}
+
+func TestOIDCAudienceAndIssuer(t *testing.T) {
+	issuer := newOIDCTestIssuer(t)
+	defer issuer.server.Close()
+	p := issuer.provider(t)
+
+	claims := issuer.claims()
+	claims["aud"] = "another-service"
+	_, err := authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+
+	claims = issuer.claims()
+	delete(claims, "aud")
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+
+	claims = issuer.claims()
+	claims["iss"] = "https://evil.example.org"
+	_, err = authenticateJWT(p, signJWT(t, jose.RS256, "rsa", issuer.rsaKey, claims))
+	assert.Error(t, err)
+}
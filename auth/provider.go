@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AdminProviders are the authentication backends accepted for the admin
+// endpoints, in addition to the master tokens of the cozy editor. Like
+// Editors, it is a global variable initialized with the configuration.
+var AdminProviders []Provider
+
+// ErrNoCredentials is returned by a provider when the request has no
+// credentials for it, so that the next provider can be tried.
+var ErrNoCredentials = errors.New("No credentials for this authentication provider")
+
+// Identity is the identity of an operator authenticated by a provider.
+type Identity struct {
+	Provider string `json:"provider"`
+	Subject  string `json:"subject"`
+}
+
+func (i *Identity) String() string {
+	return i.Provider + ":" + i.Subject
+}
+
+// Provider is an authentication backend for the operators of the registry.
+type Provider interface {
+	// Name is the name of the provider, like oidc.
+	Name() string
+	// Authenticate returns the identity of the operator who has made the
+	// request, or ErrNoCredentials if the request has no credentials for this
+	// provider.
+	Authenticate(req *http.Request) (*Identity, error)
+}
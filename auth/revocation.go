@@ -0,0 +1,204 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik/v3"
+)
+
+// Revocations is the list of the revoked tokens. Like Editors, it is a global
+// variable initialized with the connection to CouchDB.
+var Revocations *RevocationList
+
+// Kinds of revocation
+const (
+	// RevokedToken is used when a single token has been revoked.
+	RevokedToken = "token"
+	// RevokedEditorTokens is used when the session salt of an editor has
+	// been rotated, which revokes all its editor tokens.
+	RevokedEditorTokens = "editor"
+	// RevokedMasterTokens is used when the master salt of an editor has been
+	// rotated, which revokes all its master tokens.
+	RevokedMasterTokens = "master"
+)
+
+// revocationsRefresh is the delay after which the revoked tokens are read
+// again from the changes of the database: a token revoked on another instance
+// of the registry is refused by this one after this delay at most.
+const revocationsRefresh = 10 * time.Second
+
+// RevocationList keeps track of the revoked tokens. A token is stored by its
+// hash, so that a leaked token can be cut off before its expiration without
+// revoking the other tokens of the editor. The rotations of the salts are
+// also recorded, for the audit.
+//
+// The hashes of the revoked tokens are kept in memory, as they are checked on
+// each authenticated request, and updated from the changes feed of the
+// database.
+type RevocationList struct {
+	db  *kivik.DB
+	ctx context.Context
+
+	mu        sync.Mutex
+	since     string
+	hashes    map[string]bool
+	refreshed time.Time
+}
+
+// Revocation is a document of the revocation list.
+type Revocation struct {
+	ID        string    `json:"_id,omitempty"`
+	Rev       string    `json:"_rev,omitempty"`
+	Kind      string    `json:"kind"`
+	Editor    string    `json:"editor"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+func NewRevocationList(db *kivik.DB) *RevocationList {
+	return &RevocationList{
+		db:     db,
+		ctx:    context.Background(),
+		hashes: make(map[string]bool),
+	}
+}
+
+// TokenHash returns the identifier used for a token in the revocation list.
+func TokenHash(token []byte) string {
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeToken adds a token of the editor to the revocation list.
+func (r *RevocationList) RevokeToken(editor *Editor, token []byte) error {
+	return r.add(TokenHash(token), RevokedToken, editor)
+}
+
+// RecordRotation records that the editor or master tokens of the editor have
+// been revoked by a rotation of the salt.
+func (r *RevocationList) RecordRotation(editor *Editor, master bool) error {
+	kind := RevokedEditorTokens
+	if master {
+		kind = RevokedMasterTokens
+	}
+	now := time.Now().UTC()
+	id := fmt.Sprintf("%s-%s-%d", kind, editor.name, now.UnixNano())
+	return r.add(id, kind, editor)
+}
+
+func (r *RevocationList) add(id, kind string, editor *Editor) error {
+	_, err := r.db.Put(r.ctx, id, &Revocation{
+		ID:        id,
+		Kind:      kind,
+		Editor:    editor.name,
+		RevokedAt: time.Now().UTC(),
+	})
+	if err != nil && kivik.StatusCode(err) != http.StatusConflict {
+		return err
+	}
+	// The revocation takes effect immediately on this instance, without
+	// waiting for the next refresh
+	if kind == RevokedToken {
+		r.mu.Lock()
+		r.hashes[id] = true
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+// IsRevoked returns true if the token is in the revocation list.
+func (r *RevocationList) IsRevoked(token []byte) (bool, error) {
+	return r.IsHashRevoked(TokenHash(token))
+}
+
+// IsHashRevoked returns true if the token with the given hash is in the
+// revocation list.
+func (r *RevocationList) IsHashRevoked(hash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.refreshed) > revocationsRefresh {
+		if err := r.refresh(); err != nil {
+			return false, err
+		}
+	}
+	return r.hashes[hash], nil
+}
+
+// refresh reads the revoked tokens from the changes of the database since the
+// last refresh.
+func (r *RevocationList) refresh() error {
+	opts := map[string]interface{}{"include_docs": true}
+	if r.since != "" {
+		opts["since"] = r.since
+	}
+	changes, err := r.db.Changes(r.ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer changes.Close()
+
+	revoked := make(map[string]bool)
+	for changes.Next() {
+		if changes.Deleted() {
+			revoked[changes.ID()] = false
+			continue
+		}
+		var doc Revocation
+		if err := changes.ScanDoc(&doc); err != nil {
+			continue
+		}
+		if doc.Kind == RevokedToken {
+			revoked[changes.ID()] = true
+		}
+	}
+	if err := changes.Err(); err != nil {
+		return err
+	}
+	if seq := changes.LastSeq(); seq != "" {
+		r.since = seq
+		for hash, ok := range revoked {
+			if ok {
+				r.hashes[hash] = true
+			} else {
+				delete(r.hashes, hash)
+			}
+		}
+	}
+	r.refreshed = time.Now()
+	return nil
+}
+
+// LastRotations returns the date of the last rotation of the salts of the
+// editor, by kind (editor or master): the tokens of this kind issued before
+// this date are revoked.
+func (r *RevocationList) LastRotations(editor *Editor) (map[string]time.Time, error) {
+	rows, err := r.db.Find(r.ctx, map[string]interface{}{
+		"selector": map[string]interface{}{
+			"editor": editor.name,
+			"kind": map[string]interface{}{
+				"$in": []string{RevokedEditorTokens, RevokedMasterTokens},
+			},
+		},
+		"limit": 10000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rotations := make(map[string]time.Time)
+	for rows.Next() {
+		var doc Revocation
+		if err := rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		if doc.RevokedAt.After(rotations[doc.Kind]) {
+			rotations[doc.Kind] = doc.RevokedAt
+		}
+	}
+	return rotations, rows.Err()
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Roles of the admin tokens. An admin token with a role gives only the rights
+// of this role, on the applications of all the editors, when a master token of
+// the admin editor gives all the rights.
+const (
+	// RolePublishAny allows to publish versions of any application.
+	RolePublishAny = "publish-any"
+	// RoleMaintenance allows to activate and deactivate the maintenance of
+	// any application.
+	RoleMaintenance = "maintenance-only"
+	// RoleReadAudit allows to read the administration endpoints, without
+	// modifying anything.
+	RoleReadAudit = "read-audit"
+)
+
+// Roles is the list of the roles of the admin tokens.
+var Roles = []string{RolePublishAny, RoleMaintenance, RoleReadAudit}
+
+// roleAdditionalData is used for the role tokens, so that they can't be
+// confused with the master tokens that are derived from the same salt.
+var roleAdditionalData = []byte("role")
+
+type roleData struct {
+	Role string `json:"role"`
+}
+
+// CheckRole returns an error if the role is not a known role.
+func CheckRole(role string) error {
+	for _, r := range Roles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown role %q (should be one of %v)", role, Roles)
+}
+
+// GenerateRoleToken generates an admin token restricted to a role. Like the
+// master tokens, the role tokens are revoked when the master tokens of the
+// editor are revoked.
+func (e *Editor) GenerateRoleToken(masterSecret []byte, maxAge time.Duration, role string) ([]byte, error) {
+	if err := CheckRole(role); err != nil {
+		return nil, err
+	}
+	sessionSecret, err := e.derivateSecret(masterSecret, e.masterSalt)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(roleData{Role: role})
+	if err != nil {
+		return nil, err
+	}
+	token, err := generateToken(sessionSecret, data, roleAdditionalData, 0)
+	if err != nil {
+		return nil, err
+	}
+	return generateToken(masterSecret, token, nil, maxAge)
+}
+
+// VerifyRoleToken checks that the token is a role token of the editor, and
+// returns its role.
+func (e *Editor) VerifyRoleToken(masterSecret, token []byte) (string, bool) {
+	value, ok := verifyToken(masterSecret, token, nil)
+	if !ok {
+		return "", false
+	}
+	sessionSecret, err := e.derivateSecret(masterSecret, e.masterSalt)
+	if err != nil {
+		return "", false
+	}
+	data, ok := verifyToken(sessionSecret, value, roleAdditionalData)
+	if !ok {
+		return "", false
+	}
+	var v roleData
+	if err := json.Unmarshal(data, &v); err != nil || CheckRole(v.Role) != nil {
+		return "", false
+	}
+	return v.Role, true
+}
@@ -0,0 +1,54 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoleToken(t *testing.T) {
+	secret := GenerateMasterSecret()
+	editor := newTestEditor("cozy")
+
+	_, err := editor.GenerateRoleToken(secret, 0, "superuser")
+	assert.Error(t, err)
+
+	token, err := editor.GenerateRoleToken(secret, 0, RolePublishAny)
+	require.NoError(t, err)
+	role, ok := editor.VerifyRoleToken(secret, token)
+	assert.True(t, ok)
+	assert.Equal(t, RolePublishAny, role)
+
+	// A role token is neither a master token nor an editor token
+	assert.False(t, editor.VerifyMasterToken(secret, token))
+	assert.False(t, editor.VerifyEditorToken(secret, token, "drive"))
+	assert.False(t, editor.VerifyScopedEditorToken(secret, token))
+
+	// And it is not valid for another editor, or with another secret
+	other := newTestEditor("other")
+	_, ok = other.VerifyRoleToken(secret, token)
+	assert.False(t, ok)
+	_, ok = editor.VerifyRoleToken(GenerateMasterSecret(), token)
+	assert.False(t, ok)
+}
+
+func TestTokensAreNotRoleTokens(t *testing.T) {
+	secret := GenerateMasterSecret()
+	editor := newTestEditor("cozy")
+
+	master, err := editor.GenerateMasterToken(secret, 0)
+	require.NoError(t, err)
+	_, ok := editor.VerifyRoleToken(secret, master)
+	assert.False(t, ok)
+
+	editorToken, err := editor.GenerateEditorToken(secret, 0, "drive")
+	require.NoError(t, err)
+	_, ok = editor.VerifyRoleToken(secret, editorToken)
+	assert.False(t, ok)
+
+	scoped, err := editor.GenerateScopedEditorToken(secret, 0, "cozy-*")
+	require.NoError(t, err)
+	_, ok = editor.VerifyRoleToken(secret, scoped)
+	assert.False(t, ok)
+}
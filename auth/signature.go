@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrNoPublicKey      = errors.New("The editor has no public key")
+	ErrInvalidSignature = errors.New("The signature could not be verified with the public key of the editor")
+)
+
+// ParsePublicKey parses a public key in the PEM format ("PUBLIC KEY" block)
+// and returns it in the DER format, as stored for the editors. The ed25519,
+// ECDSA and RSA keys are accepted.
+func ParsePublicKey(content []byte) ([]byte, error) {
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("Invalid public key: a PEM block of type PUBLIC KEY is expected")
+	}
+	if _, err := parsePublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	return block.Bytes, nil
+}
+
+func parsePublicKey(der []byte) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key: %s", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Invalid public key: unsupported type %T", key)
+	}
+}
+
+// HasPublicKey returns true if the editor has registered a public key for
+// the signatures of its versions.
+func (e *Editor) HasPublicKey() bool {
+	return len(e.publicKey) > 0
+}
+
+// PublicKeyPEM returns the public key of the editor in the PEM format, or nil
+// if it has none.
+func (e *Editor) PublicKeyPEM() []byte {
+	if !e.HasPublicKey() {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: e.publicKey})
+}
+
+// VerifySignature checks that the signature of the message has been made with
+// the private key of the editor. The message is signed as is with ed25519,
+// and its sha256 is signed with ECDSA (ASN.1 signature) and RSA (PKCS #1
+// v1.5).
+func (e *Editor) VerifySignature(message, signature []byte) error {
+	if !e.HasPublicKey() {
+		return ErrNoPublicKey
+	}
+	key, err := parsePublicKey(e.publicKey)
+	if err != nil {
+		return err
+	}
+	hashed := sha256.Sum256(message)
+	ok := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(key, message, signature)
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &sig); err == nil && len(rest) == 0 {
+			ok = ecdsa.Verify(key, hashed[:], sig.R, sig.S)
+		}
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature) == nil
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// SetPublicKey registers the public key of the editor, in the DER format as
+// returned by ParsePublicKey. An empty key removes it.
+func (r *EditorRegistry) SetPublicKey(editor *Editor, publicKey []byte) error {
+	if len(publicKey) > 0 {
+		if _, err := parsePublicKey(publicKey); err != nil {
+			return err
+		}
+	}
+	editor.publicKey = publicKey
+	return r.UpdateEditor(editor)
+}
@@ -41,6 +41,7 @@ func (r *couchdbVault) GetEditor(editorName string) (*Editor, error) {
 		name:               e.Name,
 		editorSalt:         e.EditorSalt,
 		masterSalt:         e.MasterSalt,
+		publicKey:          e.PublicKeyBytes,
 		autoPublication:    e.AutoPublication,
 		revocationCounters: e.RevocationCounters,
 	}
@@ -74,6 +75,7 @@ func (r *couchdbVault) CreateEditor(editor *Editor) error {
 		Name:               editor.name,
 		EditorSalt:         editor.editorSalt,
 		MasterSalt:         editor.masterSalt,
+		PublicKeyBytes:     editor.publicKey,
 		AutoPublication:    editor.autoPublication,
 		RevocationCounters: editor.revocationCounters,
 	})
@@ -91,6 +93,7 @@ func (r *couchdbVault) UpdateEditor(editor *Editor) error {
 		Name:               editor.name,
 		EditorSalt:         editor.editorSalt,
 		MasterSalt:         editor.masterSalt,
+		PublicKeyBytes:     editor.publicKey,
 		AutoPublication:    editor.autoPublication,
 		RevocationCounters: editor.revocationCounters,
 	})
@@ -127,6 +130,7 @@ func (r *couchdbVault) AllEditors() ([]*Editor, error) {
 			name:               e.Name,
 			editorSalt:         e.EditorSalt,
 			masterSalt:         e.MasterSalt,
+			publicKey:          e.PublicKeyBytes,
 			autoPublication:    e.AutoPublication,
 			revocationCounters: e.RevocationCounters,
 		})
@@ -2,6 +2,10 @@ package base
 
 import (
 	"context"
+	"crypto/ed25519"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/go-kivik/kivik/v3"
 )
@@ -17,6 +21,12 @@ type VirtualSpace struct {
 	Filter string
 	// Slugs is a list of webapp/connector slugs to filter
 	Slugs []string
+	// Select is the list of the slugs of the applications exposed by the
+	// virtual space (all the applications of the source space if empty), and
+	// Reject the list of the slugs that are hidden. They can be used together,
+	// and Reject can also be used with Filter and Slugs.
+	Select []string
+	Reject []string
 }
 
 // ConfigParameters is a list of parameters that can be configured.
@@ -25,6 +35,13 @@ type ConfigParameters struct {
 	CleanEnabled bool
 	// CleanParameters is the parameters list for the cleaning task.
 	CleanParameters CleanParameters
+	// SpacesCleaning overrides CleanEnabled and CleanParameters for some
+	// spaces, by space name (__default__ for the default space).
+	SpacesCleaning map[string]SpaceCleaning
+	// TrashRetention is the duration during which the unpublished versions
+	// are kept in the trash, and can be restored. They are deleted right away
+	// if it is 0.
+	TrashRetention time.Duration
 
 	// VirtualSpaces is the list of virtual spaces: name -> virtual space.
 	VirtualSpaces map[string]VirtualSpace
@@ -34,8 +51,194 @@ type ConfigParameters struct {
 	// TrustedDomains is used by the universal link to allow redirections on
 	// trusted domains.
 	TrustedDomains map[string][]string
+
+	// TrustedProxies are the IP ranges of the reverse proxies whose
+	// X-Forwarded-For header gives the IP address of the clients. Without
+	// them, the IP address of the connection is used.
+	TrustedProxies []*net.IPNet
+
+	// IndexStrategy tells if the missing CouchDB indexes are created
+	// ("create"), only logged ("verify") or not checked ("skip") when the
+	// spaces are initialized.
+	IndexStrategy string
+
+	// DocumentTimeout is the timeout of the requests to CouchDB for a single
+	// document, like the reads of an application or of its latest version, and
+	// QueryTimeout is the timeout of the heavy requests, like the queries of
+	// the views (that can be built on the first query) and the listings. No
+	// timeout is applied when it is 0.
+	DocumentTimeout time.Duration
+	QueryTimeout    time.Duration
+
+	// CompressionLevel is the gzip level used when the tarballs of the
+	// virtual spaces are regenerated.
+	CompressionLevel int
+
+	// IndexedSpaces tells, for a space name (__default__ for the default
+	// space), if the space can be indexed by the search engines. The spaces
+	// not listed are not indexed.
+	IndexedSpaces map[string]bool
+
+	// WellKnownFiles are the contents of the files served on /.well-known/
+	// (apple-app-site-association and assetlinks.json) for the universal
+	// links, by space name (__default__ for the default space) and filename.
+	// The files that are not configured are read from the storage.
+	WellKnownFiles map[string]map[string][]byte
+
+	// CORS is the configuration of the CORS headers of the API of the spaces,
+	// by space name (__default__ for the default space). The spaces that are
+	// not listed can't be called from the pages of the other domains.
+	CORS map[string]CORSParameters
+
+	// ProtectedSlugs links the slug of a flagship application to its home
+	// space (__default__ for the default space): an application with this
+	// slug can't be created in the other spaces.
+	ProtectedSlugs map[string]string
+
+	// ArchiveFormats is the list of the formats accepted for the tarballs of
+	// the versions (see the ArchiveFormats variable). They are detected from
+	// the first bytes of the archives, not from their Content-Type.
+	ArchiveFormats map[string]bool
+
+	// DownloadTimeout is the maximal duration of the download of a tarball
+	// when a version is published, and DownloadTimeouts can be used to
+	// override it for some spaces.
+	DownloadTimeout  time.Duration
+	DownloadTimeouts map[string]time.Duration
+
+	// DownloadRetries is the number of retries of a download of a tarball
+	// that has failed with a transient error, and DownloadBackoff the delay
+	// before the first retry, doubled for each retry.
+	DownloadRetries int
+	DownloadBackoff time.Duration
+
+	// MaxApplicationSize is the maximal size in bytes of the tarball of a
+	// version (DefaultMaxApplicationSize if 0), and MaxApplicationSizes can
+	// be used to override it for some spaces.
+	MaxApplicationSize  int64
+	MaxApplicationSizes map[string]int64
+
+	// DownloadDomains is the list of the domains (and their subdomains) from
+	// which the tarballs of a space can be downloaded, for the space name
+	// (__default__ for the default space). The spaces not listed accept any
+	// domain. DownloadPrivateNetworks allows the tarballs hosted on loopback
+	// and private addresses, which are refused by default.
+	DownloadDomains         map[string][]string
+	DownloadPrivateNetworks bool
+
+	// SignedSpaces are the names of the spaces (__default__ for the default
+	// space) where the versions must be signed by their editor.
+	SignedSpaces []string
+
+	// ReviewedSpaces are the names of the spaces where the stable versions
+	// that ask for new permissions must be reviewed before their release.
+	ReviewedSpaces []string
+	// ModeratedSpaces are the names of the spaces where all the versions
+	// must be approved by a reviewer before their release.
+	ModeratedSpaces []string
+
+	// Sandboxes is the configuration of the personal sandbox spaces of the
+	// editors.
+	Sandboxes SandboxParameters
+
+	// ConsistencyCheck is the configuration of the periodic check of the
+	// versions in the cache against the versions database.
+	ConsistencyCheck ConsistencyParameters
+
+	// RegenerationInterval is the delay between two checks of the overwritten
+	// tarballs of the virtual spaces, to regenerate the ones that are stale
+	// (0 to disable them).
+	RegenerationInterval time.Duration
+
+	// BundleSigningKey is the private key used to sign the bundles of the
+	// catalogs of the spaces (nil if they are not signed).
+	BundleSigningKey ed25519.PrivateKey
+
+	// Login is the configuration of the login of the editors from the CLI,
+	// with the device-code flow.
+	Login LoginParameters
+
+	// GraphQL is the configuration of the /graphql endpoint.
+	GraphQL GraphQLParameters
 }
 
+// GetDownloadTimeout returns the maximal duration of the download of a
+// tarball for the given space.
+func (p *ConfigParameters) GetDownloadTimeout(prefix Prefix) time.Duration {
+	if timeout, ok := p.DownloadTimeouts[prefix.String()]; ok {
+		return timeout
+	}
+	return p.DownloadTimeout
+}
+
+// GetDownloadDomains returns the domains from which the tarballs of the given
+// space can be downloaded, or nil if there is no restriction.
+func (p *ConfigParameters) GetDownloadDomains(prefix Prefix) []string {
+	return p.DownloadDomains[prefix.String()]
+}
+
+// IsSignatureRequired returns true if the versions published in the given
+// space must be signed.
+func (p *ConfigParameters) IsSignatureRequired(prefix Prefix) bool {
+	for _, name := range p.SignedSpaces {
+		if name == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPermissionsReviewRequired returns true if the stable versions published
+// in the given space that ask for new permissions must be reviewed by an
+// admin before their release.
+func (p *ConfigParameters) IsPermissionsReviewRequired(prefix Prefix) bool {
+	for _, name := range p.ReviewedSpaces {
+		if name == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsModerationEnabled returns true if all the versions published in the
+// given space must be approved by a reviewer.
+func (p *ConfigParameters) IsModerationEnabled(prefix Prefix) bool {
+	for _, name := range p.ModeratedSpaces {
+		if name == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultMaxApplicationSize is the maximal size of the tarball of a version,
+// when it is not configured.
+const DefaultMaxApplicationSize = 20 * 1024 * 1024 // 20 Mo
+
+// GetMaxApplicationSize returns the maximal size in bytes of the tarball of a
+// version for the given space.
+func (p *ConfigParameters) GetMaxApplicationSize(prefix Prefix) int64 {
+	if size, ok := p.MaxApplicationSizes[prefix.String()]; ok && size > 0 {
+		return size
+	}
+	if p.MaxApplicationSize > 0 {
+		return p.MaxApplicationSize
+	}
+	return DefaultMaxApplicationSize
+}
+
+// The known formats for the tarballs of the versions.
+const (
+	ArchiveGzip = "gzip"
+	ArchiveZstd = "zstd"
+	ArchiveTar  = "tar"
+	ArchiveZip  = "zip"
+)
+
+// ArchiveFormats is the list of the known formats for the tarballs of the
+// versions.
+var ArchiveFormats = []string{ArchiveGzip, ArchiveZstd, ArchiveTar, ArchiveZip}
+
 // CleanParameters regroups the parameters for cleaning the old versions.
 type CleanParameters struct {
 	// NbMajor specifies how many major versions should be kept for app
@@ -47,16 +250,148 @@ type CleanParameters struct {
 	// NbMonths specifies how many months to look up for app versions cleaning
 	// tasks.
 	NbMonths int
+	// NbDev specifies how many dev versions of an app are kept when a new
+	// dev version is published (0 disables this trimming).
+	NbDev int
+}
+
+// SpaceCleaning is the retention policy of a space, when it differs from the
+// global one.
+type SpaceCleaning struct {
+	Enabled    bool
+	Parameters CleanParameters
+}
+
+// IsCleanEnabled returns true if the old versions of the given space are
+// cleaned in the background.
+func (p *ConfigParameters) IsCleanEnabled(prefix Prefix) bool {
+	if cleaning, ok := p.SpacesCleaning[prefix.String()]; ok {
+		return cleaning.Enabled
+	}
+	return p.CleanEnabled
+}
+
+// GetCleanParameters returns the parameters for the cleaning of the old
+// versions of the given space.
+func (p *ConfigParameters) GetCleanParameters(prefix Prefix) CleanParameters {
+	if cleaning, ok := p.SpacesCleaning[prefix.String()]; ok {
+		return cleaning.Parameters
+	}
+	return p.CleanParameters
+}
+
+// SandboxParameters regroups the parameters for the sandbox spaces.
+type SandboxParameters struct {
+	// Enabled tells if the editors can request a sandbox.
+	Enabled bool
+	// MaxApps is the maximal number of applications in a sandbox.
+	MaxApps int
+	// MaxVersions is the maximal number of versions in a sandbox.
+	MaxVersions int
+	// IdleTTL is the duration after which a sandbox that has not been used
+	// is removed.
+	IdleTTL time.Duration
+}
+
+// ConsistencyParameters regroups the parameters for the periodic check of the
+// versions in the cache.
+type ConsistencyParameters struct {
+	// Interval is the delay between two checks (0 to disable them).
+	Interval time.Duration
+	// Repair tells if the versions that have drifted are evicted from the
+	// cache, or only logged.
+	Repair bool
+}
+
+// CORSParameters regroups the parameters of the CORS headers of a space.
+type CORSParameters struct {
+	// AllowedOrigins are the origins of the pages that can call the API
+	// (* for all of them).
+	AllowedOrigins []string
+	// AllowedMethods are the HTTP methods allowed for the cross-origin
+	// requests.
+	AllowedMethods []string
+	// MaxAge is how long the response to a preflight request can be cached
+	// by the browsers.
+	MaxAge time.Duration
+}
+
+// LoginParameters regroups the parameters for the device-code login flow.
+type LoginParameters struct {
+	// Enabled tells if the editors can login with the device-code flow.
+	Enabled bool
+	// IdentityHeader is the HTTP header with the identity of the user (like
+	// an email address) set by the authenticating proxy in front of the
+	// validation page.
+	IdentityHeader string
+	// Identities links an editor to the identities approved by the admins
+	// to validate its logins.
+	Identities map[string][]string
+	// CodeTTL is the duration after which a login that has not been
+	// validated expires.
+	CodeTTL time.Duration
+	// TokenTTL is the validity duration of the tokens given to the CLI.
+	TokenTTL time.Duration
+	// Interval is the minimal delay between two polls of the CLI.
+	Interval time.Duration
+	// ProxySecret is a secret shared with the authenticating proxy, sent in
+	// the X-Registry-Proxy-Secret header. The identity header is trusted only
+	// for the requests with this secret, or coming from a trusted proxy.
+	ProxySecret string
+}
+
+// GraphQLParameters regroups the parameters for the GraphQL endpoint.
+type GraphQLParameters struct {
+	// Enabled tells if the /graphql endpoint is served.
+	Enabled bool
+}
+
+// IsApprovedIdentity returns true if the identity has been approved by the
+// admins for the editor.
+func (p *LoginParameters) IsApprovedIdentity(editor, identity string) bool {
+	if identity == "" {
+		return false
+	}
+	for name, identities := range p.Identities {
+		if !strings.EqualFold(name, editor) {
+			continue
+		}
+		for _, id := range identities {
+			if strings.EqualFold(id, identity) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // AcceptApp returns if the configuration says that the app can be seen in this
 // virtual space.
 func (v VirtualSpace) AcceptApp(slug string) bool {
-	filtered := inList(slug, v.Slugs)
+	if selected := v.SelectedSlugs(); len(selected) > 0 && !inList(slug, selected) {
+		return false
+	}
+	return !inList(slug, v.RejectedSlugs())
+}
+
+// SelectedSlugs returns the slugs of the applications exposed by the virtual
+// space, or nil if all the applications of the source space can be exposed.
+func (v VirtualSpace) SelectedSlugs() []string {
 	if v.Filter == "select" {
-		return filtered
+		return v.Slugs
+	}
+	return v.Select
+}
+
+// RejectedSlugs returns the slugs of the applications hidden by the virtual
+// space.
+func (v VirtualSpace) RejectedSlugs() []string {
+	if v.Filter != "reject" {
+		return v.Reject
 	}
-	return !filtered
+	rejected := make([]string, 0, len(v.Slugs)+len(v.Reject))
+	rejected = append(rejected, v.Slugs...)
+	return append(rejected, v.Reject...)
 }
 
 func (v VirtualSpace) Init() error {
@@ -0,0 +1,26 @@
+package base
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualSpaceAcceptApp(t *testing.T) {
+	legacy := VirtualSpace{Filter: "select", Slugs: []string{"drive", "photos"}}
+	assert.True(t, legacy.AcceptApp("drive"))
+	assert.False(t, legacy.AcceptApp("banks"))
+
+	legacy = VirtualSpace{Filter: "reject", Slugs: []string{"drive"}, Reject: []string{"banks"}}
+	assert.False(t, legacy.AcceptApp("drive"))
+	assert.False(t, legacy.AcceptApp("banks"))
+	assert.True(t, legacy.AcceptApp("photos"))
+
+	curated := VirtualSpace{Select: []string{"drive", "photos", "banks"}, Reject: []string{"banks"}}
+	assert.True(t, curated.AcceptApp("drive"))
+	assert.False(t, curated.AcceptApp("banks"))
+	assert.False(t, curated.AcceptApp("notes"))
+
+	all := VirtualSpace{}
+	assert.True(t, all.AcceptApp("notes"))
+}
@@ -1,5 +1,10 @@
 package base
 
+import (
+	"context"
+	"time"
+)
+
 // DatabaseNamespace is a prefix used for naming the CouchDB databases.
 var DatabaseNamespace = "registry"
 
@@ -20,3 +25,24 @@ func VirtualDBName(virtualSpaceName string) string {
 func VirtualVersionsDBName(virtualSpaceName string) string {
 	return DBName(virtualSpaceName + "-" + virtualVersionSuffix)
 }
+
+// DocumentContext returns the context for a request to CouchDB on a single
+// document. The cancel function must be called when the response has been
+// read.
+func DocumentContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(Config.DocumentTimeout)
+}
+
+// QueryContext returns the context for a heavy request to CouchDB: a query of
+// a view, a mango query, or a listing of a database. The cancel function must
+// be called when all the rows have been read.
+func QueryContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(Config.QueryTimeout)
+}
+
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
@@ -29,6 +29,10 @@ var GlobalAssetStore AssetStore
 // DBClient is the kivik client to use to make requests to CouchDB.
 var DBClient *kivik.Client
 
+// PublishURLsDB is the database of the pre-signed publish URLs. It is created
+// when the registry starts.
+var PublishURLsDB *kivik.DB
+
 // Storage is the global variable that can be used to perform operations on
 // files.
 var Storage VirtualStorage
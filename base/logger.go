@@ -0,0 +1,27 @@
+package base
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of the context that carries the given logger. It
+// is used to propagate the fields of a request (like its ID) to the logs of
+// the work made for it.
+func WithLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// Logger returns the logger carried by the context, or a logger without
+// fields if there is none.
+func Logger(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if log, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+			return log
+		}
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
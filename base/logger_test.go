@@ -0,0 +1,18 @@
+package base
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	log := Logger(context.Background())
+	assert.NotNil(t, log)
+	assert.Empty(t, log.Data)
+
+	ctx := WithLogger(context.Background(), logrus.WithField("request_id", "abc"))
+	assert.Equal(t, "abc", Logger(ctx).Data["request_id"])
+}
@@ -3,6 +3,7 @@ package base
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 )
 
 // Prefix is a way to regroup apps. It can be related to a space, but there is
@@ -49,3 +50,24 @@ type VirtualStorage interface {
 // WalkFn is a function defined by the caller to iterate through all object
 // names with Walk.
 type WalkFn func(name, contentType string) error
+
+// StreamStorage is implemented by the storages that can stream the content of
+// a file, without loading it in memory.
+type StreamStorage interface {
+	// Open returns a reader on the content of a file. It must be closed by
+	// the caller.
+	Open(prefix Prefix, name string) (io.ReadCloser, map[string]string, error)
+}
+
+// OpenFile returns a reader on the content of a file. The file is streamed if
+// the storage allows it, or else loaded in memory.
+func OpenFile(s VirtualStorage, prefix Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	if stream, ok := s.(StreamStorage); ok {
+		return stream.Open(prefix, name)
+	}
+	buf, headers, err := s.Get(prefix, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ioutil.NopCloser(buf), headers, nil
+}
@@ -0,0 +1,287 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultFailoverRetry is the default interval between two checks of Redis
+// while a cache has failed over to memory.
+const DefaultFailoverRetry = 10 * time.Second
+
+// backend is the subset of the Redis cache used by the failover cache, with
+// the errors of Redis.
+type backend interface {
+	Status() error
+	add(key base.Key, value base.Value) error
+	get(key base.Key) (base.Value, bool, error)
+	mget(keys []base.Key) ([]interface{}, error)
+	remove(key base.Key) error
+	removeKeys(keys []base.Key) error
+}
+
+// removeBatchSize is the maximal number of keys removed from Redis in one
+// command.
+const removeBatchSize = 1000
+
+// removeKeys removes the given keys, and only them, as the Redis database can
+// be shared with the other caches and the counters.
+func (c *redisCache) removeKeys(keys []base.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > removeBatchSize {
+			n = removeBatchSize
+		}
+		strs := make([]string, n)
+		for i, k := range keys[:n] {
+			strs[i] = k.String()
+		}
+		if err := c.cache.Del(strs...).Err(); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// FailoverState is the state of a cache that can fail over to memory, for
+// the monitoring.
+type FailoverState struct {
+	Name       string    `json:"name"`
+	FailedOver bool      `json:"failed_over"`
+	Since      time.Time `json:"since"`
+	LastError  string    `json:"last_error,omitempty"`
+	Failovers  int       `json:"failovers"`
+	Recoveries int       `json:"recoveries"`
+}
+
+// failoverCache uses Redis, and switches to an in-memory LRU cache when
+// Redis can't be reached, so that the requests don't fail or wait for the
+// Redis timeouts. Redis is checked periodically, and used again when it is
+// back.
+type failoverCache struct {
+	redis  backend
+	newLRU func() base.Cache
+	retry  time.Duration
+
+	mu    sync.Mutex
+	lru   base.Cache
+	state FailoverState
+	// touched are the keys added or removed in memory during the failover:
+	// their entries in Redis may be stale.
+	touched map[base.Key]struct{}
+}
+
+var (
+	failoversMu sync.Mutex
+	failovers   []*failoverCache
+)
+
+// NewFailoverCache returns a cache that uses the given Redis client, and an
+// LRU cache while Redis is unavailable. The name is used in the logs and in
+// the monitoring.
+func NewFailoverCache(name string, redisCache base.Cache, maxEntries int, ttl, retry time.Duration) base.Cache {
+	newLRU := func() base.Cache { return NewLRUCache(maxEntries, ttl) }
+	c := newFailoverCache(name, redisCache.(backend), newLRU, retry)
+	failoversMu.Lock()
+	failovers = append(failovers, c)
+	failoversMu.Unlock()
+	return c
+}
+
+func newFailoverCache(name string, redis backend, newLRU func() base.Cache, retry time.Duration) *failoverCache {
+	if retry <= 0 {
+		retry = DefaultFailoverRetry
+	}
+	return &failoverCache{
+		redis:  redis,
+		newLRU: newLRU,
+		retry:  retry,
+		state:  FailoverState{Name: name},
+	}
+}
+
+// FailoverStates returns the state of the caches that can fail over to
+// memory.
+func FailoverStates() []FailoverState {
+	failoversMu.Lock()
+	defer failoversMu.Unlock()
+	states := make([]FailoverState, 0, len(failovers))
+	for _, c := range failovers {
+		states = append(states, c.State())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// ResetFailovers forgets the caches registered for the monitoring.
+func ResetFailovers() {
+	failoversMu.Lock()
+	failovers = nil
+	failoversMu.Unlock()
+}
+
+// State returns the failover state of the cache.
+func (c *failoverCache) State() FailoverState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// FailedOver returns true while the cache is in memory.
+func (c *failoverCache) FailedOver() bool {
+	return c.memory() != nil
+}
+
+// memory returns the in-memory cache while the cache has failed over, or nil.
+func (c *failoverCache) memory() base.Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.state.FailedOver {
+		return nil
+	}
+	return c.lru
+}
+
+func (c *failoverCache) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"nspace": "cache",
+		"cache":  c.state.Name,
+	})
+}
+
+// failover switches to memory after an error of Redis, and starts the
+// periodic checks of Redis. The memory starts empty, as the entries of a
+// previous failover may be stale.
+func (c *failoverCache) failover(err error) base.Cache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state.LastError = err.Error()
+	if c.state.FailedOver {
+		return c.lru
+	}
+	c.lru = c.newLRU()
+	c.touched = make(map[base.Key]struct{})
+	c.state.FailedOver = true
+	c.state.Since = time.Now().UTC()
+	c.state.Failovers++
+	c.log().WithField("error_msg", err).Warn("Redis is unavailable, failing over to memory")
+	go c.watch()
+	return c.lru
+}
+
+// touch records a key added or removed in memory during the failover.
+func (c *failoverCache) touch(key base.Key) {
+	c.mu.Lock()
+	if c.touched != nil {
+		c.touched[key] = struct{}{}
+	}
+	c.mu.Unlock()
+}
+
+// watch checks Redis until it is back. The keys added or removed in memory
+// during the failover are removed from Redis before it is used again, as
+// their entries in Redis may be stale.
+func (c *failoverCache) watch() {
+	for {
+		time.Sleep(c.retry)
+		err := c.redis.Status()
+		if err == nil {
+			c.mu.Lock()
+			keys := make([]base.Key, 0, len(c.touched))
+			for key := range c.touched {
+				keys = append(keys, key)
+			}
+			c.mu.Unlock()
+			if err = c.redis.removeKeys(keys); err == nil {
+				c.mu.Lock()
+				for _, key := range keys {
+					delete(c.touched, key)
+				}
+				// Some keys may have been touched while the others were
+				// removed
+				pending := len(c.touched) > 0
+				if !pending {
+					c.recover()
+				}
+				c.mu.Unlock()
+				if !pending {
+					return
+				}
+				continue
+			}
+		}
+		c.mu.Lock()
+		c.state.LastError = err.Error()
+		c.mu.Unlock()
+	}
+}
+
+// recover uses Redis again. It must be called with the lock.
+func (c *failoverCache) recover() {
+	c.state.FailedOver = false
+	c.lru = nil
+	c.touched = nil
+	c.state.Since = time.Now().UTC()
+	c.state.LastError = ""
+	c.state.Recoveries++
+	c.log().Info("Redis is back, the cache is no longer in memory")
+}
+
+func (c *failoverCache) Status() error {
+	return c.redis.Status()
+}
+
+func (c *failoverCache) Add(key base.Key, value base.Value) {
+	lru := c.memory()
+	if lru == nil {
+		err := c.redis.add(key, value)
+		if err == nil {
+			return
+		}
+		lru = c.failover(err)
+	}
+	c.touch(key)
+	lru.Add(key, value)
+}
+
+func (c *failoverCache) Get(key base.Key) (base.Value, bool) {
+	lru := c.memory()
+	if lru == nil {
+		value, ok, err := c.redis.get(key)
+		if err == nil {
+			return value, ok
+		}
+		lru = c.failover(err)
+	}
+	return lru.Get(key)
+}
+
+func (c *failoverCache) MGet(keys []base.Key) []interface{} {
+	lru := c.memory()
+	if lru == nil {
+		values, err := c.redis.mget(keys)
+		if err == nil {
+			return values
+		}
+		lru = c.failover(err)
+	}
+	return lru.MGet(keys)
+}
+
+func (c *failoverCache) Remove(key base.Key) {
+	lru := c.memory()
+	if lru == nil {
+		err := c.redis.remove(key)
+		if err == nil {
+			return
+		}
+		lru = c.failover(err)
+	}
+	c.touch(key)
+	lru.Remove(key)
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis is a backend that can be made unavailable.
+type fakeRedis struct {
+	mu      sync.Mutex
+	down    bool
+	values  map[base.Key]base.Value
+	removed []base.Key
+}
+
+var errDown = errors.New("connection refused")
+
+func (f *fakeRedis) err() error {
+	if f.down {
+		return errDown
+	}
+	return nil
+}
+
+func (f *fakeRedis) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) Status() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err()
+}
+
+func (f *fakeRedis) add(key base.Key, value base.Value) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errDown
+	}
+	f.values[key] = value
+	return nil
+}
+
+func (f *fakeRedis) get(key base.Key) (base.Value, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, false, errDown
+	}
+	value, ok := f.values[key]
+	return value, ok, nil
+}
+
+func (f *fakeRedis) mget(keys []base.Key) ([]interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, errDown
+	}
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, ok := f.values[key]; ok {
+			values[i] = []byte(value)
+		}
+	}
+	return values, nil
+}
+
+func (f *fakeRedis) remove(key base.Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errDown
+	}
+	delete(f.values, key)
+	return nil
+}
+
+func (f *fakeRedis) removeKeys(keys []base.Key) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errDown
+	}
+	for _, key := range keys {
+		delete(f.values, key)
+	}
+	f.removed = append(f.removed, keys...)
+	return nil
+}
+
+func TestFailover(t *testing.T) {
+	redis := &fakeRedis{values: make(map[base.Key]base.Value)}
+	newLRU := func() base.Cache { return NewLRUCache(32, time.Minute) }
+	c := newFailoverCache("test", redis, newLRU, 10*time.Millisecond)
+
+	key := base.Key("space/drive/stable")
+	other := base.Key("space/photos/stable")
+	c.Add(key, []byte("1.0.0"))
+	c.Add(other, []byte("2.0.0"))
+	value, ok := c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("1.0.0"), value)
+
+	// Redis goes down: the cache is in memory, and starts empty
+	redis.setDown(true)
+	_, ok = c.Get(key)
+	assert.False(t, ok)
+	assert.True(t, c.FailedOver())
+	c.Add(key, []byte("1.0.1"))
+	value, ok = c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("1.0.1"), value)
+	assert.Len(t, c.MGet([]base.Key{key, "other"}), 2)
+
+	state := c.State()
+	assert.Equal(t, 1, state.Failovers)
+	assert.Equal(t, errDown.Error(), state.LastError)
+
+	// Redis is back: the keys touched during the failover are removed, and
+	// Redis is used again, with the other keys kept
+	redis.setDown(false)
+	assert.Eventually(t, func() bool { return !c.FailedOver() }, time.Second, 5*time.Millisecond)
+	_, ok = c.Get(key)
+	assert.False(t, ok)
+	value, ok = c.Get(other)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("2.0.0"), value)
+	state = c.State()
+	assert.Equal(t, 1, state.Recoveries)
+	assert.Equal(t, "", state.LastError)
+	redis.mu.Lock()
+	assert.Equal(t, []base.Key{key}, redis.removed)
+	redis.mu.Unlock()
+}
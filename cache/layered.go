@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/go-redis/redis/v7"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLocalTTL is the default time-to-live of the entries of the local
+// cache in front of Redis. It is short, as the other instances of the
+// registry can't remove the entries from this cache without the pub/sub
+// invalidation.
+const DefaultLocalTTL = 5 * time.Second
+
+// Invalidator broadcasts the keys removed from a layered cache, so that the
+// other instances of the registry remove them from their local cache.
+type Invalidator interface {
+	// Publish tells the other instances that the key has been removed.
+	Publish(key base.Key)
+	// Subscribe calls fn for each key removed by an instance (including this
+	// one).
+	Subscribe(fn func(key base.Key))
+}
+
+// layeredCache checks an in-process LRU cache before the shared cache (Redis),
+// and fills it with the entries found in the shared cache. It saves the
+// round-trip to Redis for the hot entries, like the latest versions.
+type layeredCache struct {
+	local  base.Cache
+	remote base.Cache
+	inv    Invalidator
+}
+
+// NewLayeredCache returns a cache that keeps up to maxEntries entries of the
+// remote cache in memory, for the given TTL. The invalidator is optional:
+// without it, the entries removed by the other instances can be served by
+// this instance until they expire.
+func NewLayeredCache(remote base.Cache, maxEntries int, ttl time.Duration, inv Invalidator) base.Cache {
+	if ttl <= 0 {
+		ttl = DefaultLocalTTL
+	}
+	c := &layeredCache{
+		local:  NewLRUCache(maxEntries, ttl),
+		remote: remote,
+		inv:    inv,
+	}
+	if inv != nil {
+		inv.Subscribe(c.local.Remove)
+	}
+	return c
+}
+
+func (c *layeredCache) Status() error {
+	return c.remote.Status()
+}
+
+// FailedOver tells if the remote cache has failed over to memory, for the
+// health checks.
+func (c *layeredCache) FailedOver() bool {
+	f, ok := c.remote.(interface{ FailedOver() bool })
+	return ok && f.FailedOver()
+}
+
+func (c *layeredCache) Add(key base.Key, value base.Value) {
+	c.remote.Add(key, value)
+	c.local.Add(key, value)
+}
+
+func (c *layeredCache) Get(key base.Key) (base.Value, bool) {
+	if value, ok := c.local.Get(key); ok {
+		return value, true
+	}
+	value, ok := c.remote.Get(key)
+	if ok {
+		c.local.Add(key, value)
+	}
+	return value, ok
+}
+
+func (c *layeredCache) MGet(keys []base.Key) []interface{} {
+	values := c.local.MGet(keys)
+	var missing []base.Key
+	var indexes []int
+	for i, value := range values {
+		if value == nil {
+			missing = append(missing, keys[i])
+			indexes = append(indexes, i)
+		}
+	}
+	if len(missing) == 0 {
+		return values
+	}
+	for j, value := range c.remote.MGet(missing) {
+		if b, ok := value.([]byte); ok {
+			values[indexes[j]] = b
+			c.local.Add(missing[j], b)
+		}
+	}
+	return values
+}
+
+func (c *layeredCache) Remove(key base.Key) {
+	c.local.Remove(key)
+	c.remote.Remove(key)
+	if c.inv != nil {
+		c.inv.Publish(key)
+	}
+}
+
+// redisInvalidator uses a Redis pub/sub channel to broadcast the removed
+// keys.
+type redisInvalidator struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+// NewRedisInvalidator returns an invalidator that publishes the removed keys
+// on the given Redis channel.
+func NewRedisInvalidator(client redis.UniversalClient, channel string) Invalidator {
+	return &redisInvalidator{client: client, channel: channel}
+}
+
+func (r *redisInvalidator) Publish(key base.Key) {
+	if err := r.client.Publish(r.channel, key.String()).Err(); err != nil {
+		r.log().WithField("error_msg", err).Warn("Cannot publish the invalidation of a key")
+	}
+}
+
+// Subscribe listens to the channel in a goroutine. The subscription is
+// restored by the Redis client after a disconnection.
+func (r *redisInvalidator) Subscribe(fn func(key base.Key)) {
+	pubsub := r.client.Subscribe(r.channel)
+	go func() {
+		for msg := range pubsub.Channel() {
+			fn(base.Key(msg.Payload))
+		}
+	}()
+}
+
+func (r *redisInvalidator) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"nspace":  "cache",
+		"channel": r.channel,
+	})
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeInvalidator broadcasts the removed keys to the caches of the same test.
+type fakeInvalidator struct {
+	subscribers []func(key base.Key)
+}
+
+func (f *fakeInvalidator) Publish(key base.Key) {
+	for _, fn := range f.subscribers {
+		fn(key)
+	}
+}
+
+func (f *fakeInvalidator) Subscribe(fn func(key base.Key)) {
+	f.subscribers = append(f.subscribers, fn)
+}
+
+func TestLayeredCache(t *testing.T) {
+	remote := NewLRUCache(32, time.Minute)
+	c := NewLayeredCache(remote, 32, 100*time.Millisecond, nil)
+	key := base.Key("drive")
+
+	c.Add(key, []byte("1.0.0"))
+	value, ok := remote.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("1.0.0"), value)
+
+	// The local entry is served while it has not expired
+	remote.Add(key, []byte("1.0.1"))
+	value, ok = c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("1.0.0"), value)
+
+	time.Sleep(101 * time.Millisecond)
+	value, ok = c.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("1.0.1"), value)
+
+	c.Remove(key)
+	_, ok = c.Get(key)
+	assert.False(t, ok)
+	_, ok = remote.Get(key)
+	assert.False(t, ok)
+}
+
+func TestLayeredCacheMGet(t *testing.T) {
+	remote := NewLRUCache(32, time.Minute)
+	c := NewLayeredCache(remote, 32, time.Minute, nil)
+
+	c.Add("drive", []byte("1.0.0"))
+	remote.Add("photos", []byte("2.0.0"))
+	values := c.MGet([]base.Key{"drive", "photos", "notes"})
+	assert.Equal(t, []interface{}{[]byte("1.0.0"), []byte("2.0.0"), nil}, values)
+
+	// The entry found in the remote cache is now in the local cache
+	remote.Remove("photos")
+	value, ok := c.Get("photos")
+	assert.True(t, ok)
+	assert.Equal(t, base.Value("2.0.0"), value)
+}
+
+func TestLayeredCacheInvalidation(t *testing.T) {
+	remote := NewLRUCache(32, time.Minute)
+	inv := &fakeInvalidator{}
+	first := NewLayeredCache(remote, 32, time.Minute, inv)
+	second := NewLayeredCache(remote, 32, time.Minute, inv)
+
+	first.Add("drive", []byte("1.0.0"))
+	_, ok := second.Get("drive")
+	assert.True(t, ok)
+
+	first.Remove("drive")
+	_, ok = second.Get("drive")
+	assert.False(t, ok)
+}
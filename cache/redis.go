@@ -27,8 +27,12 @@ func (c *redisCache) Status() error {
 }
 
 func (c *redisCache) Add(key base.Key, value base.Value) {
+	_ = c.add(key, value)
+}
+
+func (c *redisCache) add(key base.Key, value base.Value) error {
 	ttl := durationFuzzing(c.TTL, 0.2)
-	c.cache.Set(key.String(), []byte(value), ttl)
+	return c.cache.Set(key.String(), []byte(value), ttl).Err()
 }
 
 // durationFuzzing returns a duration that is near the given duration, but
@@ -42,32 +46,56 @@ func durationFuzzing(d time.Duration, variation float64) time.Duration {
 }
 
 func (c *redisCache) Get(key base.Key) (value base.Value, ok bool) {
-	if val, err := c.cache.Get(key.String()).Result(); err == nil {
-		return []byte(val), true
+	value, ok, _ = c.get(key)
+	return value, ok
+}
+
+// get returns an error only when Redis can't be reached, not for a missing
+// key.
+func (c *redisCache) get(key base.Key) (base.Value, bool, error) {
+	val, err := c.cache.Get(key.String()).Result()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
 	}
-	return nil, false
+	return []byte(val), true, nil
 }
 
 func (c *redisCache) MGet(keys []base.Key) []interface{} {
+	values, err := c.mget(keys)
+	if err != nil {
+		return make([]interface{}, len(keys))
+	}
+	return values
+}
+
+func (c *redisCache) mget(keys []base.Key) ([]interface{}, error) {
 	strs := make([]string, len(keys))
 	for i, k := range keys {
 		strs[i] = k.String()
 	}
-	if values, err := c.cache.MGet(strs...).Result(); err == nil {
-		for i, v := range values {
-			if s, ok := v.(string); ok {
-				if s == "" {
-					values[i] = nil
-				} else {
-					values[i] = []byte(s)
-				}
+	values, err := c.cache.MGet(strs...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range values {
+		if s, ok := v.(string); ok {
+			if s == "" {
+				values[i] = nil
+			} else {
+				values[i] = []byte(s)
 			}
 		}
-		return values
 	}
-	return make([]interface{}, len(keys))
+	return values, nil
 }
 
 func (c *redisCache) Remove(key base.Key) {
-	c.cache.Del(key.String())
+	_ = c.remove(key)
+}
+
+func (c *redisCache) remove(key base.Key) error {
+	return c.cache.Del(key.String()).Err()
 }
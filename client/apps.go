@@ -0,0 +1,297 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Links are the URLs of the resources related to an application or a
+// version.
+type Links struct {
+	Self        string `json:"self"`
+	App         string `json:"app,omitempty"`
+	Versions    string `json:"versions"`
+	Latest      string `json:"latest"`
+	Icon        string `json:"icon"`
+	Screenshots string `json:"screenshots,omitempty"`
+}
+
+// Version is a version of an application.
+type Version struct {
+	Slug        string          `json:"slug"`
+	Editor      string          `json:"editor"`
+	Type        string          `json:"type"`
+	Version     string          `json:"version"`
+	Manifest    json.RawMessage `json:"manifest"`
+	CreatedAt   time.Time       `json:"created_at"`
+	URL         string          `json:"url"`
+	Size        int64           `json:"size,string"`
+	Sha256      string          `json:"sha256"`
+	TarPrefix   string          `json:"tar_prefix"`
+	KeepForever bool            `json:"keep_forever"`
+	Signature   string          `json:"signature,omitempty"`
+	Signed      bool            `json:"signed"`
+	Links       Links           `json:"links"`
+}
+
+// AppVersions are the versions of an application, by channel.
+type AppVersions struct {
+	HasVersions bool     `json:"has_versions"`
+	Stable      []string `json:"stable,omitempty"`
+	Beta        []string `json:"beta,omitempty"`
+	Dev         []string `json:"dev,omitempty"`
+}
+
+// App is an application of the registry.
+type App struct {
+	Slug                 string          `json:"slug"`
+	Type                 string          `json:"type"`
+	Editor               string          `json:"editor"`
+	Name                 string          `json:"name"`
+	CreatedAt            time.Time       `json:"created_at"`
+	MaintenanceActivated bool            `json:"maintenance_activated"`
+	MaintenanceOptions   json.RawMessage `json:"maintenance_options,omitempty"`
+	Versions             *AppVersions    `json:"versions,omitempty"`
+	Label                int             `json:"label"`
+	LatestVersion        *Version        `json:"latest_version,omitempty"`
+	Links                Links           `json:"links"`
+}
+
+// AppsList is a page of the list of the applications.
+type AppsList struct {
+	Apps []*App `json:"data"`
+	Meta struct {
+		Count      int    `json:"count"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	} `json:"meta"`
+}
+
+// ListOptions are the parameters of the list of the applications. The zero
+// value gives the first page, with the default values of the registry.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string
+	// Filter is indexed by field, like "type" or "editor".
+	Filter map[string]string
+	// LatestChannel is the channel of the latest version of the apps, and
+	// VersionsChannel the channel of their list of versions.
+	LatestChannel   string
+	VersionsChannel string
+}
+
+// PublishOptions describe a version to publish.
+type PublishOptions struct {
+	Version     string          `json:"version"`
+	URL         string          `json:"url"`
+	Sha256      string          `json:"sha256"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+	Icon        string          `json:"icon,omitempty"`
+	Screenshots []string        `json:"screenshots,omitempty"`
+	// Signature is the signature of the sha256 (in hexadecimal) by the
+	// private key of the editor, encoded in base64.
+	Signature string `json:"signature,omitempty"`
+}
+
+// Job is the asynchronous publication of a version, when the jobs are
+// enabled on the registry.
+type Job struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	State      string          `json:"state"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Links      struct {
+		Self string `json:"self"`
+	} `json:"links"`
+}
+
+// ErrNoToken is returned by the methods that need a token, when the client
+// has none.
+var ErrNoToken = errors.New("A token is needed for this request")
+
+// ListApps returns a page of the list of the applications.
+func (c *Client) ListApps(ctx context.Context, opts *ListOptions) (*AppsList, error) {
+	query := url.Values{}
+	if opts != nil {
+		if opts.Limit > 0 {
+			query.Set("limit", strconv.Itoa(opts.Limit))
+		}
+		if opts.Cursor != "" {
+			query.Set("cursor", opts.Cursor)
+		}
+		if opts.Sort != "" {
+			query.Set("sort", opts.Sort)
+		}
+		for field, value := range opts.Filter {
+			query.Set("filter["+field+"]", value)
+		}
+		if opts.LatestChannel != "" {
+			query.Set("latestChannelVersion", opts.LatestChannel)
+		}
+		if opts.VersionsChannel != "" {
+			query.Set("versionsChannel", opts.VersionsChannel)
+		}
+	}
+	var list AppsList
+	if _, err := c.request(ctx, http.MethodGet, c.registryURL(query), nil, &list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// GetApp returns an application.
+func (c *Client) GetApp(ctx context.Context, slug string) (*App, error) {
+	var app App
+	if _, err := c.request(ctx, http.MethodGet, c.registryURL(nil, slug), nil, &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// GetVersion returns a version of an application.
+func (c *Client) GetVersion(ctx context.Context, slug, version string) (*Version, error) {
+	var ver Version
+	if _, err := c.request(ctx, http.MethodGet, c.registryURL(nil, slug, version), nil, &ver); err != nil {
+		return nil, err
+	}
+	return &ver, nil
+}
+
+// GetVersionDocument returns the JSON document of a version, as it is sent by
+// the registry, for the tools that relay it.
+func (c *Client) GetVersionDocument(ctx context.Context, slug, version string) (json.RawMessage, error) {
+	var doc json.RawMessage
+	if _, err := c.request(ctx, http.MethodGet, c.registryURL(nil, slug, version), nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// GetLatestVersionDocument returns the JSON document of the latest version of
+// an application for a channel, as it is sent by the registry.
+func (c *Client) GetLatestVersionDocument(ctx context.Context, slug, channel string) (json.RawMessage, error) {
+	var doc json.RawMessage
+	u := c.registryURL(nil, slug, channel, "latest")
+	if _, err := c.request(ctx, http.MethodGet, u, nil, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// GetLatestVersion returns the latest version of an application for a
+// channel (stable, beta or dev).
+func (c *Client) GetLatestVersion(ctx context.Context, slug, channel string) (*Version, error) {
+	var ver Version
+	u := c.registryURL(nil, slug, channel, "latest")
+	if _, err := c.request(ctx, http.MethodGet, u, nil, &ver); err != nil {
+		return nil, err
+	}
+	return &ver, nil
+}
+
+// LatestQuery is an application and a channel for GetLatestVersions.
+type LatestQuery struct {
+	Slug    string `json:"slug"`
+	Channel string `json:"channel,omitempty"`
+}
+
+// LatestVersion is the latest version of an application for a channel, or
+// the error if the registry has none.
+type LatestVersion struct {
+	Slug    string   `json:"slug"`
+	Channel string   `json:"channel"`
+	Version *Version `json:"version,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Status  int      `json:"status,omitempty"`
+}
+
+// GetLatestVersions returns the latest versions of several applications in
+// a single request, in the order of the queries.
+func (c *Client) GetLatestVersions(ctx context.Context, queries []LatestQuery) ([]*LatestVersion, error) {
+	body := struct {
+		Apps []LatestQuery `json:"apps"`
+	}{Apps: queries}
+	var res struct {
+		Apps []*LatestVersion `json:"apps"`
+	}
+	if _, err := c.request(ctx, http.MethodPost, c.registryURL(nil, "_latest"), body, &res); err != nil {
+		return nil, err
+	}
+	return res.Apps, nil
+}
+
+// GetJob returns a job of publication.
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if _, err := c.request(ctx, http.MethodGet, c.registryURL(nil, "jobs", id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// PublishVersion publishes a new version of an application, with the token
+// of the client. The request is retried when the registry is unavailable.
+// When the registry publishes the versions asynchronously, the job is
+// followed until its end.
+func (c *Client) PublishVersion(ctx context.Context, slug string, opts *PublishOptions) (*Version, error) {
+	if c.Token == "" {
+		return nil, ErrNoToken
+	}
+	var raw json.RawMessage
+	res, err := c.request(ctx, http.MethodPost, c.registryURL(nil, slug), opts, &raw)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusAccepted {
+		var job Job
+		if err := json.Unmarshal(raw, &job); err != nil {
+			return nil, err
+		}
+		if raw, err = c.waitJob(ctx, &job); err != nil {
+			return nil, err
+		}
+	}
+	var ver Version
+	if err := json.Unmarshal(raw, &ver); err != nil {
+		return nil, err
+	}
+	return &ver, nil
+}
+
+// waitJob polls a job until its end, and returns its result.
+func (c *Client) waitJob(ctx context.Context, job *Job) (json.RawMessage, error) {
+	for {
+		switch job.State {
+		case "succeeded":
+			return job.Result, nil
+		case "failed":
+			e := &Error{StatusCode: job.StatusCode, Message: job.Error}
+			// The details of a failed publication are the violated rules of
+			// the manifest
+			_ = json.Unmarshal(job.Details, &e.Violations)
+			return nil, e
+		}
+		interval := c.Backoff
+		if interval <= 0 {
+			interval = DefaultBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		var err error
+		if job, err = c.GetJob(ctx, job.ID); err != nil {
+			return nil, err
+		}
+	}
+}
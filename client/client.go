@@ -0,0 +1,208 @@
+// Package client is a Go client for the API of the registry. It is used by
+// the tools that list, fetch or publish the applications, like cozy-stack,
+// so that they don't have to maintain their own HTTP client.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/manifest"
+)
+
+// Default values for the retries of the requests.
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 1 * time.Second
+	// DefaultTimeout is long enough for a publication without the jobs,
+	// where the registry downloads the tarball before responding.
+	DefaultTimeout = 5 * time.Minute
+)
+
+// maxRetryAfter caps the delays asked by the registry in the Retry-After
+// header.
+const maxRetryAfter = 2 * time.Minute
+
+// Client makes the requests to the registry API of a space.
+type Client struct {
+	// URL is the base URL of the registry, like
+	// https://apps-registry.cozycloud.cc/.
+	URL *url.URL
+	// Space is the name of the space (empty for the default space).
+	Space string
+	// Token is the token of an editor, encoded in base64 as printed by the
+	// gen-token and login commands. It is only needed to publish.
+	Token string
+	// HTTPClient is the client used for the requests.
+	HTTPClient *http.Client
+	// Retries is the number of retries of the requests that fail with a
+	// network error, a 429 or a 5xx status. The delay between the retries
+	// doubles each time, starting from Backoff, unless the registry tells
+	// how long to wait with a Retry-After header.
+	Retries int
+	Backoff time.Duration
+}
+
+// Error is an error response of the registry.
+type Error struct {
+	StatusCode int                  `json:"-"`
+	Message    string               `json:"error"`
+	Violations []manifest.Violation `json:"violations,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("registry error (status %d): %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns true if the error is a 404 Not Found response.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// New returns a client for the given space of the registry.
+func New(registryURL, spaceName, token string) (*Client, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid registry URL %q", registryURL)
+	}
+	return &Client{
+		URL:        u,
+		Space:      spaceName,
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+	}, nil
+}
+
+// registryURL returns the URL of a resource of the registry API of the
+// space.
+func (c *Client) registryURL(query url.Values, parts ...string) string {
+	prefix := "/registry"
+	if c.Space != "" {
+		prefix = "/" + c.Space + "/registry"
+	}
+	u := *c.URL
+	u.Path = path.Join(append([]string{u.Path, prefix}, parts...)...)
+	u.RawPath = ""
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// request makes a request to the registry, with the retries, and decodes the
+// JSON response in result (if not nil). It returns the response, with a
+// closed body.
+func (c *Client) request(ctx context.Context, method, u string, body, result interface{}) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		res, err := c.send(ctx, method, u, payload)
+		retry := err != nil || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+		if !retry || attempt >= c.Retries || ctx.Err() != nil {
+			if err != nil {
+				return nil, err
+			}
+			return res, c.decode(res, result)
+		}
+
+		delay := backoff
+		if res != nil {
+			if after := retryAfter(res); after > 0 {
+				delay = after
+			}
+			drain(res)
+		}
+		backoff *= 2
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, u string, payload []byte) (*http.Response, error) {
+	var reader io.Reader
+	if payload != nil {
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (c *Client) decode(res *http.Response, result interface{}) error {
+	defer drain(res)
+	if res.StatusCode >= 400 {
+		e := &Error{StatusCode: res.StatusCode}
+		content, _ := ioutil.ReadAll(res.Body)
+		if err := json.Unmarshal(content, e); err != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(content))
+		}
+		if e.Message == "" {
+			e.Message = http.StatusText(res.StatusCode)
+		}
+		return e
+	}
+	if result == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return fmt.Errorf("Invalid response from the registry (status %d): %s", res.StatusCode, err)
+	}
+	return nil
+}
+
+func drain(res *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+// retryAfter returns the delay given by the Retry-After header of the
+// response (only in seconds), or 0.
+func retryAfter(res *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(res.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	delay := time.Duration(seconds) * time.Second
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *httptest.Server) {
+	ts := httptest.NewServer(handler)
+	c, err := New(ts.URL, "myspace", "dG9rZW4=")
+	assert.NoError(t, err)
+	c.Backoff = time.Millisecond
+	return c, ts
+}
+
+func TestListApps(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/myspace/registry", r.URL.Path)
+		assert.Equal(t, "2", r.URL.Query().Get("limit"))
+		assert.Equal(t, "konnector", r.URL.Query().Get("filter[type]"))
+		_, _ = w.Write([]byte(`{"data": [{"slug": "orange", "type": "konnector"}], "meta": {"count": 1, "next_cursor": "abc"}}`))
+	})
+	defer ts.Close()
+	list, err := c.ListApps(context.Background(), &ListOptions{
+		Limit:  2,
+		Filter: map[string]string{"type": "konnector"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, list.Apps, 1)
+	assert.Equal(t, "orange", list.Apps[0].Slug)
+	assert.Equal(t, "abc", list.Meta.NextCursor)
+}
+
+func TestGetLatestVersionNotFound(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/myspace/registry/drive/stable/latest", r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error": "Version was not found"}`))
+	})
+	defer ts.Close()
+	_, err := c.GetLatestVersion(context.Background(), "drive", "stable")
+	assert.True(t, IsNotFound(err))
+	assert.Equal(t, "Version was not found", err.(*Error).Message)
+}
+
+func TestGetVersionDocument(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/myspace/registry/drive/1.2.3", r.URL.Path)
+		_, _ = w.Write([]byte(`{"slug": "drive", "version": "1.2.3", "runtime": {"node": ">=16"}}`))
+	})
+	defer ts.Close()
+	doc, err := c.GetVersionDocument(context.Background(), "drive", "1.2.3")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"slug": "drive", "version": "1.2.3", "runtime": {"node": ">=16"}}`, string(doc))
+}
+
+func TestGetLatestVersions(t *testing.T) {
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/myspace/registry/_latest", r.URL.Path)
+		var body struct {
+			Apps []LatestQuery `json:"apps"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, []LatestQuery{{Slug: "drive", Channel: "stable"}, {Slug: "photos"}}, body.Apps)
+		_, _ = w.Write([]byte(`{"apps": [
+			{"slug": "drive", "channel": "stable", "version": {"slug": "drive", "version": "1.2.3"}},
+			{"slug": "photos", "channel": "stable", "error": "Version was not found", "status": 404}
+		]}`))
+	})
+	defer ts.Close()
+	latest, err := c.GetLatestVersions(context.Background(), []LatestQuery{
+		{Slug: "drive", Channel: "stable"},
+		{Slug: "photos"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, latest, 2)
+	assert.Equal(t, "1.2.3", latest[0].Version.Version)
+	assert.Nil(t, latest[1].Version)
+	assert.Equal(t, http.StatusNotFound, latest[1].Status)
+}
+
+func TestPublishVersionRetries(t *testing.T) {
+	var calls int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Token dG9rZW4=", r.Header.Get("Authorization"))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var opts PublishOptions
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&opts))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"slug": "drive", "version": "` + opts.Version + `"}`))
+	})
+	defer ts.Close()
+	ver, err := c.PublishVersion(context.Background(), "drive", &PublishOptions{Version: "1.0.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", ver.Version)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	c.Token = ""
+	_, err = c.PublishVersion(context.Background(), "drive", &PublishOptions{Version: "1.0.0"})
+	assert.Equal(t, ErrNoToken, err)
+}
+
+func TestPublishVersionWithJob(t *testing.T) {
+	var polls int32
+	c, ts := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/myspace/registry/drive":
+			w.WriteHeader(http.StatusAccepted)
+			_, _ = w.Write([]byte(`{"id": "42", "state": "pending"}`))
+		case "/myspace/registry/jobs/42":
+			if atomic.AddInt32(&polls, 1) < 2 {
+				_, _ = w.Write([]byte(`{"id": "42", "state": "running"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"id": "42", "state": "failed", "error": "Invalid manifest", "status_code": 422,
+				"details": [{"field": "name", "rule": "required", "message": "\"name\" is required"}]}`))
+		}
+	})
+	defer ts.Close()
+	_, err := c.PublishVersion(context.Background(), "drive", &PublishOptions{Version: "1.0.0"})
+	e, ok := err.(*Error)
+	assert.True(t, ok)
+	assert.Equal(t, 422, e.StatusCode)
+	assert.Len(t, e.Violations, 1)
+	assert.Equal(t, "name", e.Violations[0].Field)
+}
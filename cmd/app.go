@@ -8,6 +8,7 @@ import (
 
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/config"
+	"github.com/cozy/cozy-apps-registry/mango"
 	"github.com/cozy/cozy-apps-registry/registry"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/spf13/cobra"
@@ -29,12 +30,12 @@ var lsAppsCmd = &cobra.Command{
 			return err
 		}
 
-		sel := map[string]interface{}{
-			"editor": editor.Name(),
-		}
-		search := map[string]interface{}{
-			"selector": sel,
-			"limit":    1000,
+		search, err := mango.New(space.AppIndexName("editor")).
+			Where("editor", mango.Eq, editor.Name()).
+			Limit(1000).
+			Build()
+		if err != nil {
+			return err
 		}
 
 		res, err := db.Find(context.Background(), search)
@@ -178,6 +179,60 @@ var overwriteAppNameCmd = &cobra.Command{
 	},
 }
 
+var overwriteAppLocaleCmd = &cobra.Command{
+	Use:     "overwrite-app-locale [slug] [locale] [field] [value]",
+	Short:   `Overwrite a localized field (name, short_description or long_description) of an application in a virtual space`,
+	Long:    `Overwrite a localized field (name, short_description or long_description) of an application in a virtual space. An empty value removes the overwrite.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 4 {
+			return cmd.Help()
+		}
+
+		if !config.IsVirtualSpace(appSpaceFlag) {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+
+		return registry.OverwriteAppLocale(appSpaceFlag, args[0], args[1], args[2], args[3])
+	},
+}
+
+var overwriteAppShortDescriptionCmd = &cobra.Command{
+	Use:     "overwrite-app-short-description [slug] [description]",
+	Short:   `Overwrite the short description of an application in a virtual space`,
+	Long:    `Overwrite the short description of an application in a virtual space. An empty description removes the overwrite.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+
+		if !config.IsVirtualSpace(appSpaceFlag) {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+
+		return registry.OverwriteAppShortDescription(appSpaceFlag, args[0], args[1])
+	},
+}
+
+var overwriteAppCategoriesCmd = &cobra.Command{
+	Use:     "overwrite-app-categories [slug] [categories...]",
+	Short:   `Overwrite the categories of an application in a virtual space`,
+	Long:    `Overwrite the categories of an application in a virtual space. Without categories, the overwrite is removed.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) < 1 {
+			return cmd.Help()
+		}
+
+		if !config.IsVirtualSpace(appSpaceFlag) {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+
+		return registry.OverwriteAppCategories(appSpaceFlag, args[0], args[1:])
+	},
+}
+
 var overwriteAppIconCmd = &cobra.Command{
 	Use:     "overwrite-app-icon [slug] [icon-path]",
 	Short:   `Overwrite the icon of an application in a virtual space`,
@@ -221,7 +276,7 @@ var maintenanceActivateAppCmd = &cobra.Command{
 			if locale == "" {
 				break
 			}
-			if len(locale) > 5 {
+			if !registry.IsValidLocale(locale) {
 				fmt.Printf("Invalid locale name: %q\n", locale)
 				continue
 			}
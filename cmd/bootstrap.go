@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// bootstrapAdminEditor is the editor of the admin token, as the
+// administration endpoints are restricted to the master tokens of the cozy
+// editor.
+const bootstrapAdminEditor = "cozy"
+
+var bootstrapOutputFlag string
+var bootstrapStorageFlag string
+var bootstrapEditorFlag string
+var bootstrapYesFlag bool
+
+// bootstrapConfig is the configuration file written by the bootstrap
+// command, with the values given by the self-hoster.
+var bootstrapConfig = template.Must(template.New("config").Funcs(template.FuncMap{
+	"quote": strconv.Quote,
+}).Parse(`# Generated by "cozy-apps-registry bootstrap". See cozy-registry.example.yml
+# for all the parameters.
+
+# server host (serve command) - flag --host
+host: {{quote .Host}}
+# server port (serve command) - flag --port
+port: {{.Port}}
+
+couchdb:
+  url: {{quote .CouchURL}}
+  user: {{quote .CouchUser}}
+  password: {{quote .CouchPassword}}
+  prefix: {{quote .CouchPrefix}}
+
+# Without Redis, the caches and the rate limits are kept in memory.
+# redis:
+#   addrs: localhost:6379
+#   databases:
+#     versionsList: 0
+#     versionsLatest: 1
+#     rateLimits: 2
+
+storage:
+  type: fs
+  fs: {{quote .StorageDir}}
+
+# Path to the session secret file containing the master secret to generate
+# session token.
+session-secret: {{quote .SessionSecret}}
+`))
+
+var bootstrapCmd = &cobra.Command{
+	Use:   "bootstrap",
+	Short: `Create the configuration, the default space and the first tokens of a new registry`,
+	Long: `Create the configuration, the default space and the first tokens of a new registry.
+
+The parameters are asked interactively, with the values of the flags as
+defaults, unless --yes is used. A configuration file is written, except when an
+existing one is given with --config. The session secret is generated if its
+file does not exist yet. Then, the connections to CouchDB and to the storage
+are checked, the default space is created, and the tokens of the admin (the
+cozy editor) and of the first editor are printed.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if cfgFileFlag == "" {
+			if err := writeBootstrapConfig(); err != nil {
+				return err
+			}
+		} else {
+			fmt.Printf("Using the configuration file %q\n", cfgFileFlag)
+		}
+
+		if err := ensureSessionSecret(); err != nil {
+			return err
+		}
+
+		fmt.Print("Checking CouchDB and the storage... ")
+		if err := config.SetupServices(); err != nil {
+			fmt.Println("failed")
+			return err
+		}
+		if err := base.Storage.Status(); err != nil {
+			fmt.Println("failed")
+			return fmt.Errorf("The storage is not available: %w", err)
+		}
+		fmt.Println("ok")
+
+		fmt.Print("Creating the spaces... ")
+		if err := config.PrepareSpaces(); err != nil {
+			fmt.Println("failed")
+			return err
+		}
+		fmt.Println("ok")
+
+		adminToken, err := bootstrapEditorToken(bootstrapAdminEditor, true)
+		if err != nil {
+			return err
+		}
+		editorName := bootstrapEditorFlag
+		if !bootstrapYesFlag {
+			editorName = askValue("Name of the first editor", editorName)
+		}
+		editorToken := adminToken
+		if editorName != "" && editorName != bootstrapAdminEditor {
+			if editorToken, err = bootstrapEditorToken(editorName, editorAutoPublicationFlag); err != nil {
+				return err
+			}
+		} else {
+			editorName = bootstrapAdminEditor
+		}
+
+		url := fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+		configFile := cfgFileFlag
+		if configFile == "" {
+			configFile = bootstrapOutputFlag
+		}
+		fmt.Printf(`
+The registry is ready. Keep these tokens in a safe place:
+
+  admin token (%s): %s
+  editor token (%s): %s
+
+Start the registry with:
+
+  cozy-apps-registry serve -c %s
+
+And create a first application with:
+
+  curl -X POST "%s/registry" \
+    -H "Authorization: Token %s" \
+    -H "Content-Type: application/json" \
+    -d '{"slug": "myapp", "type": "webapp", "editor": "%s"}'
+`, bootstrapAdminEditor, adminToken, editorName, editorToken, configFile, url, editorToken, editorName)
+		return nil
+	},
+}
+
+// askValue prompts for a value, with a default one.
+func askValue(text, defaultValue string) string {
+	if defaultValue != "" {
+		text = fmt.Sprintf("%s [%s]:", text, defaultValue)
+	} else {
+		text += ":"
+	}
+	if value := strings.TrimSpace(prompt(text)); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// writeBootstrapConfig asks the parameters of the registry, writes them in a
+// new configuration file, and loads them.
+func writeBootstrapConfig() error {
+	if _, err := os.Stat(bootstrapOutputFlag); err == nil {
+		return fmt.Errorf("The configuration file %q already exists, use --config to bootstrap the registry with it", bootstrapOutputFlag)
+	}
+
+	params := map[string]string{
+		"host":           viper.GetString("host"),
+		"port":           strconv.Itoa(viper.GetInt("port")),
+		"couchdb.url":    viper.GetString("couchdb.url"),
+		"couchdb.user":   viper.GetString("couchdb.user"),
+		"couchdb.prefix": viper.GetString("couchdb.prefix"),
+		"storage.fs":     bootstrapStorageFlag,
+		"session-secret": viper.GetString("session-secret"),
+	}
+	password := viper.GetString("couchdb.password")
+	if !bootstrapYesFlag {
+		params["host"] = askValue("Host to listen on", params["host"])
+		params["port"] = askValue("Port to listen on", params["port"])
+		params["couchdb.url"] = askValue("URL of CouchDB", params["couchdb.url"])
+		params["couchdb.user"] = askValue("User of CouchDB", params["couchdb.user"])
+		if params["couchdb.user"] != "" {
+			if pass := askPassword("Password of CouchDB (empty to keep the one of the flags): "); len(pass) > 0 {
+				password = string(pass)
+			}
+		}
+		params["couchdb.prefix"] = askValue("Prefix of the CouchDB databases", params["couchdb.prefix"])
+		params["storage.fs"] = askValue("Directory of the files (applications, icons...)", params["storage.fs"])
+		params["session-secret"] = askValue("Path to the session secret file", params["session-secret"])
+	}
+	port, err := strconv.Atoi(params["port"])
+	if err != nil {
+		return fmt.Errorf("Invalid port %q", params["port"])
+	}
+
+	file, err := os.OpenFile(bootstrapOutputFlag, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = bootstrapConfig.Execute(file, map[string]interface{}{
+		"Host":          params["host"],
+		"Port":          port,
+		"CouchURL":      params["couchdb.url"],
+		"CouchUser":     params["couchdb.user"],
+		"CouchPassword": password,
+		"CouchPrefix":   params["couchdb.prefix"],
+		"StorageDir":    params["storage.fs"],
+		"SessionSecret": params["session-secret"],
+	})
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Configuration written in %q\n", bootstrapOutputFlag)
+	return config.ReadFile(bootstrapOutputFlag, "cozy-registry")
+}
+
+// ensureSessionSecret loads the session secret, or generates it if its file
+// does not exist. The new secret is encrypted with the passphrase of the
+// REGISTRY_SESSION_PASS env variable, or with the one asked interactively.
+func ensureSessionSecret() error {
+	secretPath := viper.GetString("session-secret")
+	if secretPath == "" {
+		return fmt.Errorf("Missing path to session secret file")
+	}
+	if _, err := os.Stat(config.AbsPath(secretPath)); err == nil {
+		return loadSessionSecret(nil, nil)
+	}
+
+	secret := auth.GenerateMasterSecret()
+	passphrase := []byte(os.Getenv(envSessionPass))
+	if len(passphrase) == 0 && !bootstrapYesFlag {
+		passphrase = askPassword("Passphrase of the session secret (empty for no passphrase): ")
+	}
+	content := secret
+	if len(passphrase) > 0 {
+		var err error
+		if content, err = auth.EncryptMasterSecret(secret, passphrase); err != nil {
+			return fmt.Errorf("Failed to encrypt session secret: %s", err)
+		}
+	}
+
+	fmt.Printf("Creating the session secret %q... ", secretPath)
+	file, err := os.OpenFile(config.AbsPath(secretPath), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		fmt.Println("failed")
+		return err
+	}
+	_, err = fmt.Fprintln(file, base64.StdEncoding.EncodeToString(content))
+	if errc := file.Close(); err == nil {
+		err = errc
+	}
+	if err != nil {
+		fmt.Println("failed")
+		return err
+	}
+	fmt.Println("ok")
+	base.SessionSecret = secret
+	return nil
+}
+
+// bootstrapEditorToken creates the editor if it does not exist yet, and
+// returns a new master token for it.
+func bootstrapEditorToken(editorName string, autoPublication bool) (string, error) {
+	editor, err := auth.Editors.GetEditor(editorName)
+	if err != nil {
+		fmt.Printf("Creating the editor %q... ", editorName)
+		editor, err = auth.Editors.CreateEditorWithoutPublicKey(editorName, autoPublication)
+		if err != nil {
+			fmt.Println("failed")
+			return "", err
+		}
+		fmt.Println("ok")
+	}
+	token, err := editor.GenerateMasterToken(base.SessionSecret, 0)
+	if err != nil {
+		return "", fmt.Errorf("Could not generate a token for %q: %s", editorName, err)
+	}
+	if err = auth.IssuedTokens.Record(editor, token, auth.MasterToken, "", "", 0); err != nil {
+		return "", fmt.Errorf("Could not record the token for %q: %s", editorName, err)
+	}
+	return base64.StdEncoding.EncodeToString(token), nil
+}
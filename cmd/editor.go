@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 
 	"github.com/cozy/cozy-apps-registry/auth"
@@ -65,6 +66,46 @@ var rmEditorCmd = &cobra.Command{
 	},
 }
 
+var setEditorKeyCmd = &cobra.Command{
+	Use:     "set-editor-key [editor] <public-key.pem>",
+	Aliases: []string{"set-editor-public-key"},
+	Short:   `Register the public key used to verify the signatures of the versions of an editor`,
+	Long: `Register the public key used to verify the signatures of the versions of an
+editor. The key must be in the PEM format (PUBLIC KEY block), for an ed25519,
+ECDSA or RSA key. It replaces the previous key of the editor, and the
+--remove flag can be used to remove it.`,
+	PreRunE: prepareRegistry,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		editor, rest, err := fetchEditor(args)
+		if err != nil {
+			return err
+		}
+
+		var publicKey []byte
+		if !editorRemoveKeyFlag {
+			if len(rest) == 0 {
+				return cmd.Usage()
+			}
+			content, err := ioutil.ReadFile(rest[0])
+			if err != nil {
+				return err
+			}
+			if publicKey, err = auth.ParsePublicKey(content); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Updating the public key of editor %q...", editor.Name())
+		if err = auth.Editors.SetPublicKey(editor, publicKey); err != nil {
+			fmt.Println("failed")
+			return err
+		}
+
+		fmt.Println("ok")
+		return nil
+	},
+}
+
 var lsEditorsCmd = &cobra.Command{
 	Use:     "ls-editors",
 	Aliases: []string{"ls-editor", "list-editor", "list-editors"},
@@ -1,21 +1,40 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
+	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/export"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/spf13/cobra"
 )
 
 var exportCmd = &cobra.Command{
-	Use:     "export [file]",
-	Short:   `Export the entire registry into one tarball file`,
+	Use:   "export [space] [file]",
+	Short: `Export the entire registry, or a space, into one tarball file`,
+	Long: `Export the entire registry into one tarball file, or only a space if
+two arguments are given (use - for the standard output).`,
 	PreRunE: compose(prepareRegistry, prepareSpaces),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) > 2 {
+			return cmd.Usage()
+		}
+		var s *space.Space
+		if len(args) == 2 {
+			var ok bool
+			if s, ok = space.GetSpace(args[0]); !ok {
+				return fmt.Errorf("cannot find space %q", args[0])
+			}
+			args = args[1:]
+		}
+
 		var out io.Writer
-		if len(args) > 0 {
+		if len(args) > 0 && args[0] != "-" {
 			filename := args[0]
 			file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0600)
 			if err != nil {
@@ -30,17 +49,82 @@ var exportCmd = &cobra.Command{
 		} else {
 			out = os.Stdout
 		}
+		if s != nil {
+			return export.ExportSpace(out, s)
+		}
 		return export.Export(out)
 	},
 }
 
+var bundleCmd = &cobra.Command{
+	Use:   "bundle <space> [file]",
+	Short: `Generate the catalog of a space as a signed JSON document`,
+	Long: `Generate the catalog of a space, with the latest version of each
+application on each channel, as a JSON document signed with the key of the
+bundle.signing_key parameter. It is the same document as the one served on
+/:space/registry.json, to be hosted on a CDN or used to install the
+applications offline. The document is written to the standard output if no
+file is given (or -). The space can be a virtual space.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) < 1 || len(args) > 2 {
+			return cmd.Usage()
+		}
+		var v *base.VirtualSpace
+		spaceName := args[0]
+		if virtual, ok := base.Config.VirtualSpaces[spaceName]; ok {
+			v = &virtual
+			spaceName = virtual.Source
+		}
+		s, ok := space.GetSpace(spaceName)
+		if !ok {
+			return fmt.Errorf("cannot find space %q", args[0])
+		}
+		bundle, err := registry.BuildBundle(v, s)
+		if err != nil {
+			return err
+		}
+		signed, err := registry.SignBundle(bundle, base.Config.BundleSigningKey)
+		if err != nil {
+			return err
+		}
+		doc, err := json.Marshal(signed)
+		if err != nil {
+			return err
+		}
+		if len(args) == 2 && args[1] != "-" {
+			return ioutil.WriteFile(args[1], doc, 0644)
+		}
+		_, err = os.Stdout.Write(doc)
+		return err
+	},
+}
+
 var importCmd = &cobra.Command{
-	Use:     "import [file]",
-	Short:   `Import a registry from an export file.`,
+	Use:   "import [space] [file]",
+	Short: `Import a registry, or a space, from an export file.`,
+	Long: `Import a registry from an export file, or a space if two arguments are
+given (use - for the standard input). The space can have another name than the
+exported one, but it must be empty.`,
 	PreRunE: compose(prepareRegistry, prepareSpaces),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
+		if len(args) > 2 {
+			return cmd.Usage()
+		}
+		var s *space.Space
+		if len(args) == 2 {
+			var ok bool
+			if s, ok = space.GetSpace(args[0]); !ok {
+				return fmt.Errorf("cannot find space %q", args[0])
+			}
+			if importDropFlag {
+				return fmt.Errorf("the --drop flag can't be used to import a space, use rm-space before")
+			}
+			args = args[1:]
+		}
+
 		var in io.Reader
-		if len(args) > 0 {
+		if len(args) > 0 && args[0] != "-" {
 			filename := args[0]
 			file, e := os.Open(filename)
 			if e != nil {
@@ -56,6 +140,10 @@ var importCmd = &cobra.Command{
 			in = os.Stdin
 		}
 
+		if s != nil {
+			return export.ImportSpace(in, s)
+		}
+
 		if importDropFlag {
 			if err := export.Drop(); err != nil {
 				return err
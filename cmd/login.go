@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var loginCmd = &cobra.Command{
+	Use:   "login [editor]",
+	Short: `Get a token for the editor from a registry, after a validation in a browser`,
+	Long: `Get a token for the editor from a registry, with the device-code flow: the
+command prints a short code, that must be validated in a browser by a person
+approved by the admins of the registry for this editor. The token is then
+printed on the standard output.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		editorName, _, err := getEditorName(args)
+		if err != nil {
+			return err
+		}
+		registryURL := strings.TrimSuffix(loginRegistryFlag, "/")
+
+		var start struct {
+			DeviceCode      string `json:"device_code"`
+			UserCode        string `json:"user_code"`
+			VerificationURI string `json:"verification_uri"`
+			Complete        string `json:"verification_uri_complete"`
+			ExpiresIn       int    `json:"expires_in"`
+			Interval        int    `json:"interval"`
+		}
+		res, err := postLoginJSON(registryURL+"/login/device", map[string]string{
+			"editor": editorName,
+			"scope":  appScopeFlag,
+		}, &start)
+		if err != nil {
+			return err
+		}
+		if res != http.StatusOK {
+			return fmt.Errorf("Could not start the login: status %d", res)
+		}
+
+		fmt.Fprintf(os.Stderr, "Open %s in a browser and enter the code %s\n",
+			start.VerificationURI, start.UserCode)
+		fmt.Fprintf(os.Stderr, "(or open %s)\n", start.Complete)
+
+		interval := time.Duration(start.Interval) * time.Second
+		if interval <= 0 {
+			interval = 5 * time.Second
+		}
+		deadline := time.Now().Add(time.Duration(start.ExpiresIn) * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(interval)
+			var result struct {
+				Token     string    `json:"token"`
+				Scope     string    `json:"scope"`
+				ExpiresAt time.Time `json:"expires_at"`
+				Error     string    `json:"error"`
+			}
+			code, err := postLoginJSON(registryURL+"/login/token", map[string]string{
+				"device_code": start.DeviceCode,
+			}, &result)
+			if err != nil {
+				return err
+			}
+			switch code {
+			case http.StatusAccepted:
+				continue
+			case http.StatusOK:
+				fmt.Fprintf(os.Stderr, "Logged in as %s (scope %s) until %s\n",
+					editorName, result.Scope, result.ExpiresAt.Format(time.RFC3339))
+				fmt.Println(result.Token)
+				return nil
+			default:
+				return fmt.Errorf("Login failed: %s", result.Error)
+			}
+		}
+		return fmt.Errorf("The code has expired")
+	},
+}
+
+func postLoginJSON(u string, body interface{}, result interface{}) (int, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Post(u, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(result); err != nil {
+		return res.StatusCode, fmt.Errorf("Invalid response from the registry (status %d): %s", res.StatusCode, err)
+	}
+	return res.StatusCode, nil
+}
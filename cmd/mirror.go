@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/client"
+	"github.com/cozy/cozy-apps-registry/mirror"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var mirrorFromFlag string
+var mirrorFromSpaceFlag string
+var mirrorURLFlag string
+var mirrorSinceFlag string
+var mirrorDryRunFlag bool
+
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: `Replicate the applications and versions of an upstream registry`,
+	Long: `Replicate the applications and versions of a space of an upstream
+registry into a local space. Only the versions missing in the local space are
+downloaded, so the command can be run periodically. A report is printed in
+JSON at the end.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, ok := space.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+		upstream, err := client.New(mirrorFromFlag, mirrorFromSpaceFlag, "")
+		if err != nil {
+			return err
+		}
+		registryURL := mirrorURLFlag
+		if registryURL == "" {
+			registryURL = fmt.Sprintf("http://%s:%d", viper.GetString("host"), viper.GetInt("port"))
+		}
+		u, err := url.Parse(registryURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Invalid registry URL %q", registryURL)
+		}
+		opts := &mirror.Options{
+			Upstream:    upstream,
+			Space:       s,
+			RegistryURL: u,
+			DryRun:      mirrorDryRunFlag,
+		}
+		if mirrorSinceFlag != "" {
+			if opts.Since, err = parseMirrorSince(mirrorSinceFlag); err != nil {
+				return err
+			}
+		}
+		if opts.DryRun {
+			fmt.Fprintln(os.Stderr, "Info: This is a dry run, nothing will be mirrored")
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		defer signal.Stop(interrupt)
+		go func() {
+			select {
+			case <-interrupt:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		report, err := mirror.Sync(ctx, opts)
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if errj := encoder.Encode(report); err == nil {
+			err = errj
+		}
+		if err == nil && len(report.Errors) > 0 {
+			err = fmt.Errorf("%d errors while mirroring", len(report.Errors))
+		}
+		return err
+	},
+}
+
+// parseMirrorSince parses the --since flag, a day or a RFC 3339 timestamp.
+func parseMirrorSince(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid date %q for --since: expected 2006-01-02 or a RFC 3339 timestamp", value)
+	}
+	return t, nil
+}
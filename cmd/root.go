@@ -10,13 +10,21 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/config"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/cozy/cozy-apps-registry/web"
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/howeyc/gopass"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -26,11 +34,13 @@ const envSessionPass = "REGISTRY_SESSION_PASS"
 var cfgFileFlag string
 var tokenMaxAgeFlag string
 var tokenMasterFlag bool
+var tokenRoleFlag string
 var passphraseFlag *bool
 var appEditorFlag string
 var appTypeFlag string
 var appSpaceFlag string
 var appNameFlag string
+var appScopeFlag string
 var appDUCFlag string
 var appDUCByFlag string
 var minorFlag int
@@ -38,11 +48,15 @@ var majorFlag int
 var durationFlag int
 var forceFlag bool
 var noDryRunFlag bool
+var cleanDryRunFlag bool
+var migrateDryRunFlag bool
 var editorAutoPublicationFlag bool
+var editorRemoveKeyFlag bool
 var importDropFlag bool
 var infraMaintenanceFlag bool
 var shortMaintenanceFlag bool
 var disallowManualExecFlag bool
+var loginRegistryFlag string
 
 // Root returns the main command to execute, with all the subcommands and flags
 // ready to be used.
@@ -57,6 +71,12 @@ func Root() *cobra.Command {
 	flags.Int("port", 8080, "port to listen on")
 	checkNoErr(viper.BindPFlag("port", flags.Lookup("port")))
 
+	flags.String("tls-cert", "", "path to the TLS certificate file (PEM)")
+	checkNoErr(viper.BindPFlag("tls.cert_file", flags.Lookup("tls-cert")))
+
+	flags.String("tls-key", "", "path to the TLS key file (PEM)")
+	checkNoErr(viper.BindPFlag("tls.key_file", flags.Lookup("tls-key")))
+
 	flags.String("couchdb-url", "http://localhost:5984", "address of couchdb")
 	checkNoErr(viper.BindPFlag("couchdb.url", flags.Lookup("couchdb-url")))
 
@@ -81,13 +101,23 @@ func Root() *cobra.Command {
 	flags.Bool("syslog", false, "enable syslog logging")
 	checkNoErr(viper.BindPFlag("syslog", flags.Lookup("syslog")))
 
+	flags.String("log-level", "info", "minimal level of the logs (debug, info, warning, error)")
+	checkNoErr(viper.BindPFlag("log.level", flags.Lookup("log-level")))
+
+	flags.String("log-format", "text", "format of the logs (text or json)")
+	checkNoErr(viper.BindPFlag("log.format", flags.Lookup("log-format")))
+
 	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(bootstrapCmd)
 	rootCmd.AddCommand(genTokenCmd)
+	rootCmd.AddCommand(genRoleTokenCmd)
 	rootCmd.AddCommand(verifyTokenCmd)
 	rootCmd.AddCommand(revokeTokensCmd)
+	rootCmd.AddCommand(loginCmd)
 	rootCmd.AddCommand(genSessionSecret)
 	rootCmd.AddCommand(addEditorCmd)
 	rootCmd.AddCommand(rmEditorCmd)
+	rootCmd.AddCommand(setEditorKeyCmd)
 	rootCmd.AddCommand(lsEditorsCmd)
 	rootCmd.AddCommand(lsAppsCmd)
 	rootCmd.AddCommand(addAppCmd)
@@ -95,14 +125,22 @@ func Root() *cobra.Command {
 	rootCmd.AddCommand(rmAppCmd)
 	rootCmd.AddCommand(overwriteAppNameCmd)
 	rootCmd.AddCommand(overwriteAppIconCmd)
+	rootCmd.AddCommand(overwriteAppLocaleCmd)
+	rootCmd.AddCommand(overwriteAppShortDescriptionCmd)
+	rootCmd.AddCommand(overwriteAppCategoriesCmd)
 	rootCmd.AddCommand(maintenanceCmd)
 	rootCmd.AddCommand(rmAppVersionCmd)
+	rootCmd.AddCommand(restoreAppVersionCmd)
 	rootCmd.AddCommand(rmSpaceCmd)
+	rootCmd.AddCommand(migrateCmd)
 	maintenanceCmd.AddCommand(maintenanceActivateAppCmd)
 	maintenanceCmd.AddCommand(maintenanceDeactivateAppCmd)
 	rootCmd.AddCommand(exportCmd)
 	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(bundleCmd)
+	rootCmd.AddCommand(mirrorCmd)
 	rootCmd.AddCommand(oldVersionsCmd)
+	rootCmd.AddCommand(cleanCmd)
 	rootCmd.AddCommand(completionCmd)
 
 	passphraseFlag = genSessionSecret.Flags().Bool("passphrase", false, "enforce or dismiss the session secret encryption")
@@ -111,8 +149,17 @@ func Root() *cobra.Command {
 
 	genTokenCmd.Flags().BoolVar(&tokenMasterFlag, "master", false, "generate a master token to create applications")
 	genTokenCmd.Flags().StringVar(&appNameFlag, "app", "", "application name allowed for the generated token")
+	genTokenCmd.Flags().StringVar(&appScopeFlag, "scope", "", "pattern of the application slugs allowed for the generated token (like cozy-*)")
 	genTokenCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	genRoleTokenCmd.Flags().StringVar(&tokenMaxAgeFlag, "max-age", "", "validity duration of the token")
+	genRoleTokenCmd.Flags().StringVar(&tokenRoleFlag, "role", "", "role of the token: publish-any, maintenance-only or read-audit")
+	if err := genRoleTokenCmd.MarkFlagRequired("role"); err != nil {
+		fmt.Printf("Error on marking role flag as required: %s", err)
+	}
+	loginCmd.Flags().StringVar(&loginRegistryFlag, "registry", "https://apps-registry.cozycloud.cc", "URL of the registry")
+	loginCmd.Flags().StringVar(&appScopeFlag, "scope", "", "pattern of the application slugs allowed for the token (all the applications of the editor by default)")
 	revokeTokensCmd.Flags().BoolVar(&tokenMasterFlag, "master", false, "revoke a master tokens")
+	revokeTokensCmd.Flags().StringVar(&appNameFlag, "app", "", "revoke only the tokens of this application")
 	verifyTokenCmd.Flags().BoolVar(&tokenMasterFlag, "master", false, "verify a master tokens")
 	verifyTokenCmd.Flags().StringVar(&appNameFlag, "app", "", "application name allowed for the generated token")
 	verifyTokenCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
@@ -132,19 +179,29 @@ func Root() *cobra.Command {
 	rmAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 	overwriteAppNameCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 	overwriteAppIconCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	overwriteAppLocaleCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	overwriteAppShortDescriptionCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	overwriteAppCategoriesCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 	rmAppVersionCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	restoreAppVersionCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 
 	oldVersionsCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
-	oldVersionsCmd.Flags().IntVar(&minorFlag, "minor", 2, "specify the maximum number of major versions to keep")
-	oldVersionsCmd.Flags().IntVar(&majorFlag, "major", 2, "specify the maximum number of minor versions for each major version to keep")
-	oldVersionsCmd.Flags().IntVar(&durationFlag, "duration", 2, "number of months to check")
+	oldVersionsCmd.Flags().IntVar(&minorFlag, "minor", 0, "specify the maximum number of major versions to keep (from the conservation of the space by default)")
+	oldVersionsCmd.Flags().IntVar(&majorFlag, "major", 0, "specify the maximum number of minor versions for each major version to keep (from the conservation of the space by default)")
+	oldVersionsCmd.Flags().IntVar(&durationFlag, "duration", 0, "number of months to check (from the conservation of the space by default)")
 	oldVersionsCmd.Flags().BoolVar(&noDryRunFlag, "no-dry-run", false, "do no dry run and removes the apps")
 
+	cleanCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
+	cleanCmd.Flags().BoolVar(&cleanDryRunFlag, "dry-run", false, "only report the versions that would be removed")
+	cleanCmd.Flags().BoolVar(&forceFlag, "force", false, "clean the space even if its background cleaning is disabled")
+
 	modifyAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 	modifyAppCmd.Flags().StringVar(&appDUCFlag, "data-usage-commitment", "", "Specify the data usage commitment: user_ciphered, user_reserved or none")
 	modifyAppCmd.Flags().StringVar(&appDUCByFlag, "data-usage-commitment-by", "", "Specify the usage commitment author: cozy, editor or none")
 
 	rmSpaceCmd.Flags().BoolVar(&forceFlag, "force", false, "skip confirmation prompt")
+	migrateCmd.Flags().StringVar(&appSpaceFlag, "space", "", "only migrate this space")
+	migrateCmd.Flags().BoolVar(&migrateDryRunFlag, "dry-run", false, "only list the pending migrations")
 	maintenanceActivateAppCmd.Flags().BoolVar(&infraMaintenanceFlag, "infra", false, "specify a maintenance specific to our infra")
 	maintenanceActivateAppCmd.Flags().BoolVar(&shortMaintenanceFlag, "short", false, "specify a short maintenance")
 	maintenanceActivateAppCmd.Flags().BoolVar(&disallowManualExecFlag, "no-manual-exec", false, "specify a maintenance disallowing manual execution")
@@ -153,6 +210,23 @@ func Root() *cobra.Command {
 	maintenanceDeactivateAppCmd.Flags().StringVar(&appSpaceFlag, "space", "", "specify the application space")
 
 	addEditorCmd.Flags().BoolVar(&editorAutoPublicationFlag, "auto-publication", false, "activate auto-publication of version for this editor")
+	setEditorKeyCmd.Flags().BoolVar(&editorRemoveKeyFlag, "remove", false, "remove the public key of the editor")
+
+	bootstrapCmd.Flags().StringVarP(&bootstrapOutputFlag, "output", "o", "cozy-registry.yml", "path of the configuration file to create")
+	bootstrapCmd.Flags().StringVar(&bootstrapStorageFlag, "storage-dir", ".storage", "directory where the files are stored")
+	bootstrapCmd.Flags().StringVar(&bootstrapEditorFlag, "editor", "", "name of the first editor (the cozy editor if empty)")
+	bootstrapCmd.Flags().BoolVarP(&bootstrapYesFlag, "yes", "y", false, "use the values of the flags without asking")
+	bootstrapCmd.Flags().BoolVar(&editorAutoPublicationFlag, "auto-publication", false, "activate auto-publication of version for the first editor")
+
+	mirrorCmd.Flags().StringVar(&mirrorFromFlag, "from", "", "URL of the upstream registry")
+	mirrorCmd.Flags().StringVar(&mirrorFromSpaceFlag, "from-space", "", "space of the upstream registry (the default space if empty)")
+	mirrorCmd.Flags().StringVar(&appSpaceFlag, "space", "", "local space where the applications are mirrored")
+	mirrorCmd.Flags().StringVar(&mirrorURLFlag, "url", "", "public URL of this registry, for the URLs of the tarballs (http://host:port by default)")
+	mirrorCmd.Flags().StringVar(&mirrorSinceFlag, "since", "", "only mirror the versions created after this date (2006-01-02 or RFC 3339)")
+	mirrorCmd.Flags().BoolVar(&mirrorDryRunFlag, "dry-run", false, "only print what would be mirrored")
+	if err := mirrorCmd.MarkFlagRequired("from"); err != nil {
+		fmt.Printf("Error on marking from flag as required: %s", err)
+	}
 
 	importCmd.Flags().BoolVarP(&importDropFlag, "drop", "d", false, "drop couchdb database & swift container before import")
 
@@ -176,29 +250,105 @@ var rootCmd = &cobra.Command{
 var serveCmd = &cobra.Command{
 	Use:     "serve",
 	Short:   `Start the registry HTTP server`,
-	PreRunE: compose(loadSessionSecret, prepareRegistry, prepareSpaces),
+	PreRunE: compose(loadSessionSecret, prepareRegistry, prepareSpaces, runMigrations),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		config.SetupLogger(config.LoggerOptions{Syslog: viper.GetBool("syslog")})
+		err = config.SetupLogger(config.LoggerOptions{
+			Syslog: viper.GetBool("syslog"),
+			Level:  viper.GetString("log.level"),
+			Format: viper.GetString("log.format"),
+		})
+		if err != nil {
+			return err
+		}
+		tlsConfig, err := config.TLSConfig()
+		if err != nil {
+			return fmt.Errorf("Cannot configure TLS: %w", err)
+		}
 		address := fmt.Sprintf("%s:%d", viper.GetString("host"), viper.GetInt("port"))
 		fmt.Printf("Listening on %s...\n", address)
 		errc := make(chan error)
 		router := web.Router()
 		go func() {
-			errc <- router.Start(address)
+			if tlsConfig == nil {
+				errc <- router.Start(address)
+				return
+			}
+			router.TLSServer.Addr = address
+			router.TLSServer.TLSConfig = tlsConfig
+			errc <- router.StartServer(router.TLSServer)
 		}()
+		go registry.FillAllMissingAppNames()
+		if interval := viper.GetDuration("couchdb.health_check_interval"); interval > 0 {
+			go config.RunCouchDBHealthChecker(interval)
+		}
+		go registry.RunPopularityUpdater(24 * time.Hour)
+		go space.RunArchivedSpacesChecker(time.Minute)
+		go space.RunCreatedSpacesWatcher(context.Background(), web.ForgetMissingSpace)
+		if interval := viper.GetDuration("counters.flush_interval"); interval > 0 {
+			go registry.RunCountersFlusher(interval)
+		}
+		if base.Config.Sandboxes.Enabled {
+			go registry.RunSandboxesCleaner(time.Hour)
+		}
+		if base.Config.TrashRetention > 0 {
+			go registry.RunTrashPurger(time.Hour)
+		}
+		if check := base.Config.ConsistencyCheck; check.Interval > 0 {
+			go registry.RunVersionsConsistencyChecker(check.Interval, check.Repair)
+		}
+		if interval := base.Config.RegenerationInterval; interval > 0 {
+			go registry.RunOverwrittenTarballsRegenerator(interval)
+		}
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		select {
 		case err = <-errc:
 			return err
 		case <-c:
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown.grace_period"))
 			defer cancel()
-			return router.Shutdown(ctx)
+			return shutdown(ctx, router)
 		}
 	},
 }
 
+// shutdown stops the server gracefully: it stops accepting connections, waits
+// for the requests and the jobs in progress (like the publications of
+// versions) and for the tasks they have started in the background (like the
+// update of the search index), flushes the counters of downloads and the
+// webhooks, and closes the connections to the services. The whole shutdown
+// must fit in the grace period of the context.
+func shutdown(ctx context.Context, router *echo.Echo) error {
+	log := logrus.WithField("nspace", "shutdown")
+	log.Info("Shutting down the server")
+
+	var errm error
+	steps := []struct {
+		name string
+		fn   func(ctx context.Context) error
+	}{
+		{"requests", router.Shutdown},
+		{"jobs", jobs.Shutdown},
+		{"background", registry.WaitBackgroundTasks},
+		{"webhooks", webhooks.Shutdown},
+		{"counters", func(ctx context.Context) error { return registry.FlushCounters() }},
+		{"services", func(ctx context.Context) error { return config.CloseServices() }},
+	}
+	for _, step := range steps {
+		if err := step.fn(ctx); err != nil {
+			log.WithFields(logrus.Fields{
+				"step":      step.name,
+				"error_msg": err,
+			}).Error("Cannot shut down gracefully")
+			errm = multierror.Append(errm, err)
+		}
+	}
+	if errm == nil {
+		log.Info("Server stopped")
+	}
+	return errm
+}
+
 func prepareRegistry(cmd *cobra.Command, args []string) error {
 	return config.SetupServices()
 }
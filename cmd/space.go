@@ -1,13 +1,16 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"log"
 
 	"github.com/cozy/cozy-apps-registry/config"
+	"github.com/cozy/cozy-apps-registry/migrations"
 	"github.com/cozy/cozy-apps-registry/registry"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var rmSpaceCmd = &cobra.Command{
@@ -47,3 +50,55 @@ var rmSpaceCmd = &cobra.Command{
 		return registry.RemoveSpace(s)
 	},
 }
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: `Apply the pending migrations to the databases of the spaces`,
+	Long: `Apply the pending migrations to the CouchDB databases of the spaces, like
+the upgrades of the design documents. The migrations are also applied when the
+server starts, unless migrations.auto is false in the configuration file. All
+the spaces are migrated, unless --space is given. With --dry-run, the pending
+migrations are only listed.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		names := space.GetSpacesNames()
+		if cmd.Flags().Changed("space") {
+			names = []string{appSpaceFlag}
+		}
+		for _, name := range names {
+			s, ok := space.GetSpace(name)
+			if !ok {
+				return fmt.Errorf("Space %q does not exist", name)
+			}
+			var steps []migrations.Step
+			var err error
+			if migrateDryRunFlag {
+				steps, err = migrations.Pending(context.Background(), s)
+			} else {
+				steps, err = migrations.Run(context.Background(), s)
+			}
+			for _, step := range steps {
+				fmt.Println(step)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// runMigrations applies the pending migrations to all the spaces, when the
+// server starts.
+func runMigrations(cmd *cobra.Command, args []string) error {
+	if !viper.GetBool("migrations.auto") {
+		return nil
+	}
+	for _, name := range space.GetSpacesNames() {
+		s, _ := space.GetSpace(name)
+		if _, err := migrations.Run(context.Background(), s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -34,7 +34,9 @@ var genTokenCmd = &cobra.Command{
 		}
 
 		var token []byte
+		var kind, appSlug string
 		if tokenMasterFlag {
+			kind = auth.MasterToken
 			token, err = editor.GenerateMasterToken(base.SessionSecret, maxAge)
 		} else if appNameFlag != "" {
 			space, ok := space.GetSpace(appSpaceFlag)
@@ -44,16 +46,68 @@ var genTokenCmd = &cobra.Command{
 				var app *registry.App
 				app, err = registry.FindApp(nil, space, appNameFlag, registry.Stable)
 				if err == nil {
+					kind, appSlug = auth.EditorToken, app.Slug
 					token, err = editor.GenerateEditorToken(base.SessionSecret, maxAge, app.Slug)
 				}
 			}
+		} else if appScopeFlag != "" {
+			kind = auth.EditorToken
+			token, err = editor.GenerateScopedEditorToken(base.SessionSecret, maxAge, appScopeFlag)
 		} else {
-			err = fmt.Errorf("Should use either --app flag or --master flag")
+			err = fmt.Errorf("Should use either --app flag, --scope flag or --master flag")
 		}
 		if err != nil {
 			return fmt.Errorf("Could not generate editor token for %q: %s",
 				editor.Name(), err)
 		}
+		// The token can be used even if it has not been recorded, it is just
+		// missing in the audit of the editor
+		scope := ""
+		if appSlug == "" && !tokenMasterFlag {
+			scope = appScopeFlag
+		}
+		if err = auth.IssuedTokens.Record(editor, token, kind, appSlug, scope, maxAge); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record the token: %s\n", err)
+		}
+
+		fmt.Println(base64.StdEncoding.EncodeToString(token))
+		return nil
+	},
+}
+
+var genRoleTokenCmd = &cobra.Command{
+	Use:   "gen-role-token",
+	Short: `Generate an admin token restricted to a role`,
+	Long: `Generate an admin token restricted to a role, for the applications of
+all the editors:
+
+  - publish-any: publish versions of any application
+  - maintenance-only: activate and deactivate the maintenance of any application
+  - read-audit: read the administration endpoints, without modifying anything
+
+The role tokens are revoked with the master tokens of the cozy editor.`,
+	PreRunE: compose(loadSessionSecret, prepareRegistry),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := auth.CheckRole(tokenRoleFlag); err != nil {
+			return err
+		}
+		editor, err := auth.Editors.GetEditor(bootstrapAdminEditor)
+		if err != nil {
+			return fmt.Errorf("Could not find the %q editor: %s", bootstrapAdminEditor, err)
+		}
+
+		maxAge, err := extractMagAge()
+		if err != nil {
+			return err
+		}
+
+		token, err := editor.GenerateRoleToken(base.SessionSecret, maxAge, tokenRoleFlag)
+		if err != nil {
+			return fmt.Errorf("Could not generate role token: %s", err)
+		}
+		if err = auth.IssuedTokens.Record(editor, token, auth.RoleToken, "", tokenRoleFlag, maxAge); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not record the token: %s\n", err)
+		}
 
 		fmt.Println(base64.StdEncoding.EncodeToString(token))
 		return nil
@@ -150,14 +204,43 @@ var verifyTokenCmd = &cobra.Command{
 }
 
 var revokeTokensCmd = &cobra.Command{
-	Use:     "revoke-tokens [editor]",
-	Short:   `Revoke all tokens that have been generated for the specified editor`,
+	Use:   "revoke-tokens [editor] [token]",
+	Short: `Revoke all tokens that have been generated for the specified editor, or only the given token`,
+	Long: `Revoke all tokens that have been generated for the specified editor, or
+only the given token. With --app, only the tokens of this application are
+revoked, including the scoped tokens that cover it.`,
 	PreRunE: compose(loadSessionSecret, prepareRegistry),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		editor, _, err := fetchEditor(args)
+		editor, rest, err := fetchEditor(args)
 		if err != nil {
 			return err
 		}
+		if len(rest) > 0 {
+			token, err := base64.StdEncoding.DecodeString(rest[0])
+			if err != nil {
+				return fmt.Errorf("Token is not properly base64 encoded: %s", err)
+			}
+			if !auth.VerifyTokenAuthentication(base.SessionSecret, token) {
+				return fmt.Errorf("Token could not be verified (or is already expired)")
+			}
+			if err = auth.Revocations.RevokeToken(editor, token); err != nil {
+				return err
+			}
+			fmt.Println("Token has been revoked")
+			return nil
+		}
+
+		if appNameFlag != "" {
+			if !askQuestion(true, "Are you sure you want to revoke the tokens of %q from %q ?", appNameFlag, editor.Name()) {
+				return nil
+			}
+			if err = auth.Editors.RevokeAppTokens(editor, appNameFlag); err != nil {
+				return err
+			}
+			fmt.Println("Tokens have been revoked")
+			return nil
+		}
+
 		var question string
 		if tokenMasterFlag {
 			question = "Are you sure you want to revoke MASTER tokens from %q ?"
@@ -172,6 +255,9 @@ var revokeTokensCmd = &cobra.Command{
 		} else {
 			err = auth.Editors.RevokeEditorTokens(editor)
 		}
-		return err
+		if err != nil {
+			return err
+		}
+		return auth.Revocations.RecordRotation(editor, tokenMasterFlag)
 	},
 }
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/registry"
@@ -20,25 +22,83 @@ var oldVersionsCmd = &cobra.Command{
 
 		channel := args[0]
 		appSlug := args[1]
-		space, _ := space.GetSpace(appSpaceFlag)
+		space, ok := space.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
 		run := registry.DryRun
 		if noDryRunFlag {
 			run = registry.RealRun
 		} else {
 			fmt.Println("Info: This is a dry run, the apps will not be removed")
 		}
-		params := base.CleanParameters{
-			NbMajor:  majorFlag,
-			NbMinor:  minorFlag,
-			NbMonths: durationFlag,
+		// The retention policy of the space is used for the flags that are
+		// not given
+		params := base.Config.GetCleanParameters(space.GetPrefix())
+		if cmd.Flags().Changed("major") {
+			params.NbMajor = majorFlag
+		}
+		if cmd.Flags().Changed("minor") {
+			params.NbMinor = minorFlag
+		}
+		if cmd.Flags().Changed("duration") {
+			params.NbMonths = durationFlag
+		}
+		versions, err := registry.CleanOldVersions(space, appSlug, channel, params, run)
+		for _, v := range versions {
+			switch v.KeptBy {
+			case "":
+				fmt.Printf("Removing %s\n", v)
+			case "keep_forever":
+				fmt.Printf("Keeping %s (keep-forever)\n", v)
+			default:
+				fmt.Printf("Keeping %s (legal hold)\n", v)
+			}
+		}
+		return err
+	},
+}
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: `Remove the old versions of all the applications of a space`,
+	Long: `Remove the old versions of all the applications of a space, in all the
+channels, with the conservation parameters of the space. With --dry-run,
+nothing is removed, and the report tells which versions and which storage
+objects would be removed. A report is printed in JSON at the end.`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, ok := space.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+		run := registry.RealRun
+		if cleanDryRunFlag {
+			run = registry.DryRun
+			fmt.Fprintln(os.Stderr, "Info: This is a dry run, the versions will not be removed")
+		} else if !base.Config.IsCleanEnabled(s.GetPrefix()) && !forceFlag {
+			return fmt.Errorf("The background cleaning is disabled for space %q, use --force to clean it anyway", appSpaceFlag)
+		}
+
+		report, err := registry.CleanSpace(s, base.Config.GetCleanParameters(s.GetPrefix()), run)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(report); err != nil {
+			return err
+		}
+		if len(report.Errors) > 0 {
+			return fmt.Errorf("%d errors while cleaning", len(report.Errors))
 		}
-		return registry.CleanOldVersions(space, appSlug, channel, params, run)
+		return nil
 	},
 }
 
 var rmAppVersionCmd = &cobra.Command{
 	Use:     "rm-app-version <slug> <version>",
-	Short:   `Deletes an app version`,
+	Short:   `Deletes an app version (moved to the trash if it is enabled)`,
 	PreRunE: compose(prepareRegistry, prepareSpaces),
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
 		if len(args) != 2 {
@@ -56,6 +116,24 @@ var rmAppVersionCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		return ver.Delete(space)
+		return ver.Unpublish(space, "")
+	},
+}
+
+var restoreAppVersionCmd = &cobra.Command{
+	Use:     "restore-app-version <slug> <version>",
+	Short:   `Restores an app version from the trash`,
+	PreRunE: compose(prepareRegistry, prepareSpaces),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return cmd.Help()
+		}
+		space, ok := space.GetSpace(appSpaceFlag)
+		if !ok {
+			return fmt.Errorf("Space %q does not exist", appSpaceFlag)
+		}
+
+		_, err := registry.RestoreVersion(space, args[0], args[1])
+		return err
 	},
 }
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/spf13/viper"
+)
+
+// configureAuthProviders configures the authentication backends accepted for
+// the admin endpoints, in addition to the master tokens of the cozy editor.
+func configureAuthProviders() error {
+	auth.AdminProviders = nil
+	if viper.GetString("admin_auth.oidc.issuer") == "" {
+		return nil
+	}
+	provider, err := auth.NewOIDCProvider(auth.OIDCConfig{
+		Issuer:      viper.GetString("admin_auth.oidc.issuer"),
+		Audience:    viper.GetString("admin_auth.oidc.audience"),
+		JWKSURL:     viper.GetString("admin_auth.oidc.jwks_url"),
+		Subjects:    viper.GetStringSlice("admin_auth.oidc.subjects"),
+		GroupsClaim: viper.GetString("admin_auth.oidc.groups_claim"),
+		Groups:      viper.GetStringSlice("admin_auth.oidc.groups"),
+		Leeway:      viper.GetDuration("admin_auth.oidc.leeway"),
+	})
+	if err != nil {
+		return fmt.Errorf("Cannot configure the OIDC authentication: %w", err)
+	}
+	auth.AdminProviders = append(auth.AdminProviders, provider)
+	return nil
+}
@@ -2,12 +2,14 @@ package config
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"html/template"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/spf13/viper"
 )
 
@@ -20,12 +22,81 @@ func SetDefaults() {
 	viper.AutomaticEnv()
 	viper.SetDefault("port", 8080)
 	viper.SetDefault("host", "localhost")
+	viper.SetDefault("tls.http2", true)
 	viper.SetDefault("couchdb.url", "http://localhost:5984/")
 	viper.SetDefault("couchdb.prefix", "cozyregistry")
+	viper.SetDefault("couchdb.indexes", "create")
+	viper.SetDefault("couchdb.max_idle_conns", 100)
+	viper.SetDefault("couchdb.idle_conn_timeout", "90s")
+	viper.SetDefault("couchdb.dial_timeout", "5s")
+	viper.SetDefault("couchdb.response_header_timeout", 0)
+	viper.SetDefault("couchdb.max_retries", 2)
+	viper.SetDefault("couchdb.retry_backoff", "100ms")
+	viper.SetDefault("couchdb.health_check_interval", "10s")
+	viper.SetDefault("couchdb.document_timeout", "10s")
+	viper.SetDefault("couchdb.query_timeout", "2m")
 	viper.SetDefault("conservation.enable_background_cleaning", false)
 	viper.SetDefault("conservation.major", 2)
 	viper.SetDefault("conservation.minor", 2)
 	viper.SetDefault("conservation.month", 2)
+	viper.SetDefault("conservation.dev", 0)
+	viper.SetDefault("trash.retention", "720h")
+	viper.SetDefault("redis.failover_retry", "10s")
+	viper.SetDefault("redis.local_cache.enabled", false)
+	viper.SetDefault("redis.local_cache.ttl", "5s")
+	viper.SetDefault("redis.local_cache.max_entries", 1024)
+	viper.SetDefault("redis.local_cache.invalidation", true)
+	viper.SetDefault("slow_queries.size", 20)
+	viper.SetDefault("slow_queries.window", "1h")
+	viper.SetDefault("slow_queries.threshold", "500ms")
+	viper.SetDefault("regeneration.compression_level", gzip.DefaultCompression)
+	viper.SetDefault("storage.s3.bucket_prefix", "cozy-registry")
+	viper.SetDefault("storage.s3.use_ssl", true)
+	viper.SetDefault("storage.s3.part_size", "16MB")
+	viper.SetDefault("ipfs.timeout", "5m")
+	viper.SetDefault("webhooks.timeout", "10s")
+	viper.SetDefault("jobs.workers", 0)
+	viper.SetDefault("jobs.queue_size", 100)
+	viper.SetDefault("jobs.ttl", "168h")
+	viper.SetDefault("jobs.stale_after", "1h")
+	viper.SetDefault("webhooks.retries", 5)
+	viper.SetDefault("webhooks.backoff", "1s")
+	viper.SetDefault("archive_formats", base.ArchiveFormats)
+	viper.SetDefault("downloads.timeout", "30s")
+	viper.SetDefault("downloads.max_size", "20MB")
+	viper.SetDefault("downloads.retries", 3)
+	viper.SetDefault("downloads.backoff", "1s")
+	viper.SetDefault("rate_limits.publish.limit", 0)
+	viper.SetDefault("rate_limits.publish.window", "1m")
+	viper.SetDefault("rate_limits.list.limit", 0)
+	viper.SetDefault("rate_limits.list.window", "1m")
+	viper.SetDefault("auth_lockouts.ip.threshold", 0)
+	viper.SetDefault("auth_lockouts.ip.window", "15m")
+	viper.SetDefault("auth_lockouts.ip.lockout", "1m")
+	viper.SetDefault("auth_lockouts.ip.max_lockout", "1h")
+	viper.SetDefault("auth_lockouts.editor.threshold", 0)
+	viper.SetDefault("auth_lockouts.editor.window", "15m")
+	viper.SetDefault("auth_lockouts.editor.lockout", "1m")
+	viper.SetDefault("auth_lockouts.editor.max_lockout", "1h")
+	viper.SetDefault("sandboxes.enabled", false)
+	viper.SetDefault("sandboxes.max_apps", 10)
+	viper.SetDefault("sandboxes.max_versions", 100)
+	viper.SetDefault("sandboxes.idle_ttl", "720h")
+	viper.SetDefault("consistency.interval", 0)
+	viper.SetDefault("consistency.repair", false)
+	viper.SetDefault("regeneration.interval", 0)
+	viper.SetDefault("shutdown.grace_period", "30s")
+	viper.SetDefault("migrations.auto", true)
+	viper.SetDefault("login.enabled", false)
+	viper.SetDefault("login.identity_header", "X-Forwarded-Email")
+	viper.SetDefault("login.code_ttl", "10m")
+	viper.SetDefault("login.token_ttl", "2160h")
+	viper.SetDefault("login.interval", "5s")
+	viper.SetDefault("graphql.enabled", false)
+	viper.SetDefault("admin_auth.oidc.groups_claim", "groups")
+	viper.SetDefault("admin_auth.oidc.leeway", "1m")
+	viper.SetDefault("redis.databases.counters", 3)
+	viper.SetDefault("counters.flush_interval", "1m")
 }
 
 // ReadFile reads the config file, parses it, and loads the values in viper.
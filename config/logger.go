@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log/syslog"
 
@@ -11,10 +12,30 @@ import (
 // LoggerOptions is a struct with the options for initializing the logger.
 type LoggerOptions struct {
 	Syslog bool
+	// Level is the minimal level of the logs (debug, info, warning, error).
+	Level string
+	// Format is the format of the logs: text or json.
+	Format string
 }
 
 // SetupLogger configures the logger.
-func SetupLogger(opts LoggerOptions) {
+func SetupLogger(opts LoggerOptions) error {
+	if opts.Level != "" {
+		level, err := logrus.ParseLevel(opts.Level)
+		if err != nil {
+			return err
+		}
+		logrus.SetLevel(level)
+	}
+
+	switch opts.Format {
+	case "", "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("Invalid log format %q, expected text or json", opts.Format)
+	}
+
 	if opts.Syslog {
 		hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "cozy-apps-registry")
 		if err == nil {
@@ -22,4 +43,5 @@ func SetupLogger(opts LoggerOptions) {
 			logrus.SetOutput(ioutil.Discard)
 		}
 	}
+	return nil
 }
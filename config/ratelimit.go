@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/cozy/cozy-apps-registry/ratelimit"
+	"github.com/spf13/viper"
+)
+
+func configureRateLimits(counter ratelimit.Counter) error {
+	rules, err := getRateLimitRules()
+	if err != nil {
+		return err
+	}
+	ratelimit.Configure(ratelimit.NewLimiter(counter, rules))
+	lockoutRules, err := getLockoutRules()
+	if err != nil {
+		return err
+	}
+	ratelimit.ConfigureLockouts(ratelimit.NewLockouts(counter, lockoutRules))
+	return nil
+}
+
+func getRateLimitRules() (map[string]ratelimit.Rule, error) {
+	rules := make(map[string]ratelimit.Rule)
+	for _, class := range ratelimit.Classes {
+		rule := ratelimit.Rule{
+			Limit:  viper.GetInt("rate_limits." + class + ".limit"),
+			Window: viper.GetDuration("rate_limits." + class + ".window"),
+		}
+		if rule.Limit < 0 {
+			return nil, fmt.Errorf("Invalid rate limit for %s: %d", class, rule.Limit)
+		}
+		if rule.Limit > 0 && rule.Window <= 0 {
+			return nil, fmt.Errorf("Invalid rate limit window for %s", class)
+		}
+		rules[class] = rule
+	}
+	return rules, nil
+}
+
+func getLockoutRules() (map[string]ratelimit.LockoutRule, error) {
+	rules := make(map[string]ratelimit.LockoutRule)
+	for _, kind := range ratelimit.LockoutKinds {
+		prefix := "auth_lockouts." + kind + "."
+		rule := ratelimit.LockoutRule{
+			Threshold:  viper.GetInt(prefix + "threshold"),
+			Window:     viper.GetDuration(prefix + "window"),
+			Lockout:    viper.GetDuration(prefix + "lockout"),
+			MaxLockout: viper.GetDuration(prefix + "max_lockout"),
+		}
+		if rule.Threshold < 0 {
+			return nil, fmt.Errorf("Invalid lockout threshold for %s: %d", kind, rule.Threshold)
+		}
+		if rule.Threshold > 0 && (rule.Window <= 0 || rule.Lockout <= 0 || rule.MaxLockout < rule.Lockout) {
+			return nil, fmt.Errorf("Invalid lockout durations for %s", kind)
+		}
+		// Without trusted proxies, the IP address of the clients comes from
+		// headers that they can forge, to lock out the other clients.
+		if rule.Threshold > 0 && len(viper.GetStringSlice("trusted_proxies")) == 0 {
+			return nil, fmt.Errorf("The lockouts for %s need trusted_proxies", kind)
+		}
+		rules[kind] = rule
+	}
+	return rules, nil
+}
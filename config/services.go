@@ -1,25 +1,56 @@
 package config
 
 import (
+	"compress/gzip"
 	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-apps-registry/asset"
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/cache"
+	"github.com/cozy/cozy-apps-registry/couchclient"
+	"github.com/cozy/cozy-apps-registry/counters"
+	"github.com/cozy/cozy-apps-registry/ipfs"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/cozy/cozy-apps-registry/ratelimit"
+	"github.com/cozy/cozy-apps-registry/slowlog"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/cozy/cozy-apps-registry/storage"
+	"github.com/go-kivik/couchdb/v3"
 	"github.com/go-kivik/couchdb/v3/chttp"
 	"github.com/go-kivik/kivik/v3"
 	"github.com/go-redis/redis/v7"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/ncw/swift"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
-const editorsDBSuffix = "editors"
+const (
+	editorsDBSuffix      = "editors"
+	revocationsDBSuffix  = "revoked_tokens"
+	issuedDBSuffix       = "issued_tokens"
+	deviceLoginsDBSuffix = "device_logins"
+	jobsDBSuffix         = "jobs"
+	publishURLsDBSuffix  = "publish-urls"
+	removalsDBSuffix     = "app-removals"
+	spacesDBSuffix       = "spaces"
+)
 
 // SetupServices connects the cache, database and storage services.
 func SetupServices() error {
@@ -42,15 +73,94 @@ func SetupServices() error {
 		}
 	}
 
-	if dir := viper.GetString("fs"); dir != "" {
+	if err := configureStorage(); err != nil {
+		return err
+	}
+	if err := configureStorageMigration(); err != nil {
+		return fmt.Errorf("Cannot configure the storage migration: %w", err)
+	}
+	base.Storage = storage.NewTimed(base.Storage)
+	return nil
+}
+
+// configureStorage selects the storage backend with the storage.type
+// parameter. For compatibility, the top-level fs parameter still selects the
+// local file system when no type is given.
+func configureStorage() error {
+	kind := viper.GetString("storage.type")
+	dir := viper.GetString("storage.fs")
+	if dir == "" {
+		dir = viper.GetString("fs")
+	}
+	if kind == "" {
+		kind = "swift"
+		if dir != "" {
+			kind = "fs"
+		}
+	}
+
+	switch kind {
+	case "fs":
+		if dir == "" {
+			return fmt.Errorf("storage.fs is required for the fs storage")
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Cannot create the storage directory: %w", err)
+		}
 		base.Storage = storage.NewFS(dir)
-	} else {
+	case "swift":
 		sc, err := initSwiftConnection()
 		if err != nil {
 			return fmt.Errorf("Cannot access to swift: %s", err)
 		}
 		base.Storage = storage.NewSwift(sc)
+	case "s3":
+		s3, err := initS3Storage()
+		if err != nil {
+			return fmt.Errorf("Cannot access to S3: %s", err)
+		}
+		base.Storage = s3
+	default:
+		return fmt.Errorf("Unknown storage type: %q", kind)
+	}
+	return nil
+}
+
+// configureStorageMigration enables the dual-write mode, when the operators
+// are switching from a storage backend to another: the files of the prefixes
+// in migration are written to the new storage, and read from the new one and
+// then the old one.
+func configureStorageMigration() error {
+	prefixes := viper.GetStringSlice("storage_migration.prefixes")
+	if len(prefixes) == 0 {
+		return nil
 	}
+
+	var previous base.VirtualStorage
+	switch from := viper.GetString("storage_migration.from"); from {
+	case "fs":
+		dir := viper.GetString("storage_migration.fs")
+		if dir == "" {
+			return fmt.Errorf("storage_migration.fs is required to migrate from fs")
+		}
+		previous = storage.NewFS(dir)
+	case "swift":
+		sc, err := initSwiftConnection()
+		if err != nil {
+			return fmt.Errorf("Cannot access to swift: %s", err)
+		}
+		previous = storage.NewSwift(sc)
+	case "s3":
+		s3, err := initS3Storage()
+		if err != nil {
+			return fmt.Errorf("Cannot access to S3: %s", err)
+		}
+		previous = s3
+	default:
+		return fmt.Errorf("Unknown storage to migrate from: %q", from)
+	}
+
+	base.Storage = storage.NewMigration(base.Storage, previous, prefixes)
 	return nil
 }
 
@@ -61,6 +171,9 @@ func SetupForTests() error {
 		return err
 	}
 
+	// The tarballs of the tests are served on the loopback
+	base.Config.DownloadPrivateNetworks = true
+
 	base.DatabaseNamespace = "cozy-registry-test"
 	if err := configureCouch(true); err != nil {
 		return err
@@ -81,6 +194,17 @@ func SetupForTests() error {
 	return nil
 }
 
+// destroyDB destroys a database used for the tests, and logs the error if any.
+func destroyDB(ctx context.Context, dbName string) {
+	if err := base.DBClient.DestroyDB(ctx, dbName); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "couchdb",
+			"db":        dbName,
+			"error_msg": err,
+		}).Warn("Error while cleaning database")
+	}
+}
+
 // CleanupTests can be used to clean all the CouchDB databases used for tests.
 func CleanupTests() error {
 	base.LatestVersionsCache = nil
@@ -93,30 +217,41 @@ func CleanupTests() error {
 	}
 
 	for _, s := range space.Spaces {
-		if err := base.DBClient.DestroyDB(ctx, s.PendingVersDB().Name()); err != nil {
-			fmt.Printf("Error while cleaning database %q: %s\n", s.PendingVersDB().Name(), err)
-		}
-
-		if err := base.DBClient.DestroyDB(ctx, s.VersDB().Name()); err != nil {
-			fmt.Printf("Error while cleaning database %q: %s\n", s.VersDB().Name(), err)
-		}
-
-		if err := base.DBClient.DestroyDB(ctx, s.AppsDB().Name()); err != nil {
-			fmt.Printf("Error while cleaning database %q: %s\n", s.AppsDB().Name(), err)
-		}
+		destroyDB(ctx, s.PendingVersDB().Name())
+		destroyDB(ctx, s.TrashVersDB().Name())
+		destroyDB(ctx, s.StatsDB().Name())
+		destroyDB(ctx, s.VersDB().Name())
+		destroyDB(ctx, s.AppsDB().Name())
 	}
 	space.Spaces = make(map[string]*space.Space)
 
-	editorsDBName := base.DBName(editorsDBSuffix)
-	if err := base.DBClient.DestroyDB(ctx, editorsDBName); err != nil {
-		fmt.Printf("Error while cleaning database %q: %s\n", editorsDBName, err)
-	}
+	destroyDB(ctx, base.DBName(editorsDBSuffix))
 	auth.Editors = nil
 
+	destroyDB(ctx, base.DBName(revocationsDBSuffix))
+	auth.Revocations = nil
+
+	destroyDB(ctx, base.DBName(issuedDBSuffix))
+	auth.IssuedTokens = nil
+
+	destroyDB(ctx, base.DBName(deviceLoginsDBSuffix))
+	auth.DeviceLogins = nil
+
+	destroyDB(ctx, base.DBName(spacesDBSuffix))
+	space.CreatedDB = nil
+
+	destroyDB(ctx, base.DBName(publishURLsDBSuffix))
+	base.PublishURLsDB = nil
+
+	destroyDB(ctx, base.DBName(removalsDBSuffix))
+	space.RemovalsDB = nil
+
+	// The jobs database only exists when the jobs are enabled
+	_ = base.DBClient.DestroyDB(ctx, base.DBName(jobsDBSuffix))
+	jobs.Configure(nil)
+
 	if db := base.GlobalAssetStore.GetDB(); db != nil {
-		if err := base.DBClient.DestroyDB(ctx, db.Name()); err != nil {
-			fmt.Printf("Error while cleaning database %q: %s\n", db.Name(), err)
-		}
+		destroyDB(ctx, db.Name())
 	}
 	base.GlobalAssetStore = nil
 
@@ -129,21 +264,377 @@ func configureParameters() error {
 	if err != nil {
 		return err
 	}
+	indexed, err := getIndexedSpaces()
+	if err != nil {
+		return err
+	}
+	proxies, err := getTrustedProxies()
+	if err != nil {
+		return err
+	}
+	formats, err := getArchiveFormats()
+	if err != nil {
+		return err
+	}
+	downloadTimeouts, err := getDownloadTimeouts()
+	if err != nil {
+		return err
+	}
+	maxSizes, err := getMaxApplicationSizes()
+	if err != nil {
+		return err
+	}
+	wellKnown, err := getWellKnownFiles()
+	if err != nil {
+		return err
+	}
+	cors, err := getCORS()
+	if err != nil {
+		return err
+	}
+	bundleKey, err := getBundleSigningKey()
+	if err != nil {
+		return err
+	}
+	cleanEnabled := viper.GetBool("conservation.enable_background_cleaning")
+	cleanParams := base.CleanParameters{
+		NbMajor:  viper.GetInt("conservation.major"),
+		NbMinor:  viper.GetInt("conservation.minor"),
+		NbMonths: viper.GetInt("conservation.month"),
+		NbDev:    viper.GetInt("conservation.dev"),
+	}
+	spacesCleaning, err := getSpacesCleaning(cleanEnabled, cleanParams)
+	if err != nil {
+		return err
+	}
 	base.Config = base.ConfigParameters{
-		CleanEnabled: viper.GetBool("conservation.enable_background_cleaning"),
-		CleanParameters: base.CleanParameters{
-			NbMajor:  viper.GetInt("conservation.major"),
-			NbMinor:  viper.GetInt("conservation.minor"),
-			NbMonths: viper.GetInt("conservation.month"),
-		},
+		CleanEnabled:    cleanEnabled,
+		CleanParameters: cleanParams,
+		SpacesCleaning:  spacesCleaning,
+		TrashRetention:  viper.GetDuration("trash.retention"),
+
 		VirtualSpaces:  virtuals,
 		DomainSpaces:   viper.GetStringMapString("domain_space"),
 		TrustedDomains: viper.GetStringMapStringSlice("trusted_domains"),
+		TrustedProxies: proxies,
+		IndexStrategy:  viper.GetString("couchdb.indexes"),
+
+		DocumentTimeout: viper.GetDuration("couchdb.document_timeout"),
+		QueryTimeout:    viper.GetDuration("couchdb.query_timeout"),
+
+		CompressionLevel: viper.GetInt("regeneration.compression_level"),
+		IndexedSpaces:    indexed,
+		WellKnownFiles:   wellKnown,
+		CORS:             cors,
+		ProtectedSlugs:   viper.GetStringMapString("protected_slugs"),
+		ArchiveFormats:   formats,
+		DownloadTimeout:  viper.GetDuration("downloads.timeout"),
+		DownloadTimeouts: downloadTimeouts,
+		DownloadRetries:  viper.GetInt("downloads.retries"),
+		DownloadBackoff:  viper.GetDuration("downloads.backoff"),
+
+		MaxApplicationSize:  int64(viper.GetSizeInBytes("downloads.max_size")),
+		MaxApplicationSizes: maxSizes,
+
+		DownloadDomains:         viper.GetStringMapStringSlice("downloads.domains"),
+		DownloadPrivateNetworks: viper.GetBool("downloads.private_networks"),
+		SignedSpaces:            viper.GetStringSlice("signatures.required_spaces"),
+		ReviewedSpaces:          viper.GetStringSlice("permissions_review.spaces"),
+		ModeratedSpaces:         viper.GetStringSlice("moderation.spaces"),
+		Sandboxes: base.SandboxParameters{
+			Enabled:     viper.GetBool("sandboxes.enabled"),
+			MaxApps:     viper.GetInt("sandboxes.max_apps"),
+			MaxVersions: viper.GetInt("sandboxes.max_versions"),
+			IdleTTL:     viper.GetDuration("sandboxes.idle_ttl"),
+		},
+		ConsistencyCheck: base.ConsistencyParameters{
+			Interval: viper.GetDuration("consistency.interval"),
+			Repair:   viper.GetBool("consistency.repair"),
+		},
+		RegenerationInterval: viper.GetDuration("regeneration.interval"),
+		BundleSigningKey:     bundleKey,
+		Login: base.LoginParameters{
+			Enabled:        viper.GetBool("login.enabled"),
+			IdentityHeader: viper.GetString("login.identity_header"),
+			Identities:     viper.GetStringMapStringSlice("login.identities"),
+			CodeTTL:        viper.GetDuration("login.code_ttl"),
+			TokenTTL:       viper.GetDuration("login.token_ttl"),
+			Interval:       viper.GetDuration("login.interval"),
+			ProxySecret:    viper.GetString("login.proxy_secret"),
+		},
+		GraphQL: base.GraphQLParameters{
+			Enabled: viper.GetBool("graphql.enabled"),
+		},
+	}
+	level := base.Config.CompressionLevel
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("Invalid compression level %d", level)
+	}
+	login := base.Config.Login
+	if login.Enabled && len(proxies) == 0 && login.ProxySecret == "" {
+		return errors.New("The login needs trusted_proxies or login.proxy_secret to trust the identity header")
+	}
+
+	ipfs.Configure(
+		viper.GetString("ipfs.api_url"),
+		viper.GetDuration("ipfs.timeout"))
+
+	if err := configureWebhooks(); err != nil {
+		return err
 	}
 
+	if err := configureAuthProviders(); err != nil {
+		return err
+	}
+
+	slowlog.Configure(
+		viper.GetInt("slow_queries.size"),
+		viper.GetDuration("slow_queries.window"),
+		viper.GetDuration("slow_queries.threshold"))
+
 	return nil
 }
 
+func getIndexedSpaces() (map[string]bool, error) {
+	indexed := make(map[string]bool)
+	for name, policy := range viper.GetStringMapString("robots") {
+		switch policy {
+		case "index":
+			indexed[name] = true
+		case "noindex":
+			indexed[name] = false
+		default:
+			return nil, fmt.Errorf("Invalid robots policy %q for space %q", policy, name)
+		}
+	}
+	return indexed, nil
+}
+
+// getTrustedProxies parses the IP ranges of the trusted reverse proxies. A
+// single IP address is accepted for a range with only this address.
+func getTrustedProxies() ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, value := range viper.GetStringSlice("trusted_proxies") {
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil {
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					bits = 8 * net.IPv4len
+				}
+				value = fmt.Sprintf("%s/%d", value, bits)
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy %q: %w", value, err)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// wellKnownFiles are the files of /.well-known/ that can be configured for a
+// space, by their key in the configuration (without dots, for viper).
+var wellKnownFiles = map[string]string{
+	"apple_app_site_association": "apple-app-site-association",
+	"assetlinks":                 "assetlinks.json",
+}
+
+// getWellKnownFiles reads the files of /.well-known/ given in the
+// configuration for the spaces, and checks that they are valid JSON.
+func getWellKnownFiles() (map[string]map[string][]byte, error) {
+	files := make(map[string]map[string][]byte)
+	for spaceName := range viper.GetStringMap("well_known") {
+		for key, path := range viper.GetStringMapString("well_known." + spaceName) {
+			filename, ok := wellKnownFiles[key]
+			if !ok {
+				return nil, fmt.Errorf("Unknown well-known file %q for space %q", key, spaceName)
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("Cannot read the %s file for space %q: %s", filename, spaceName, err)
+			}
+			if !json.Valid(content) {
+				return nil, fmt.Errorf("The %s file for space %q is not valid JSON", filename, spaceName)
+			}
+			if files[spaceName] == nil {
+				files[spaceName] = make(map[string][]byte)
+			}
+			files[spaceName][filename] = content
+		}
+	}
+	return files, nil
+}
+
+// defaultCORSMethods are the methods allowed for the cross-origin requests
+// when a space does not list them: the read-only endpoints.
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead}
+
+// getBundleSigningKey reads the ed25519 private key used to sign the bundles,
+// from the PEM file (PKCS #8) given by bundle.signing_key.
+func getBundleSigningKey() (ed25519.PrivateKey, error) {
+	filename := viper.GetString("bundle.signing_key")
+	if filename == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(AbsPath(filename))
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read the signing key of the bundles: %w", err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("Invalid signing key for the bundles: a PEM block of type PRIVATE KEY is expected")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signing key for the bundles: %s", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Invalid signing key for the bundles: an ed25519 key is expected, not %T", key)
+	}
+	return privateKey, nil
+}
+
+// getCORS reads the CORS parameters of the spaces in the cors section of the
+// configuration.
+func getCORS() (map[string]base.CORSParameters, error) {
+	params := make(map[string]base.CORSParameters)
+	for spaceName := range viper.GetStringMap("cors") {
+		key := "cors." + spaceName
+		origins := viper.GetStringSlice(key + ".allowed_origins")
+		if len(origins) == 0 {
+			return nil, fmt.Errorf("Missing allowed_origins in the CORS parameters of space %q", spaceName)
+		}
+		methods := viper.GetStringSlice(key + ".allowed_methods")
+		for i, method := range methods {
+			methods[i] = strings.ToUpper(method)
+		}
+		if len(methods) == 0 {
+			methods = defaultCORSMethods
+		}
+		maxAge := viper.GetDuration(key + ".max_age")
+		if maxAge < 0 {
+			return nil, fmt.Errorf("Invalid max_age in the CORS parameters of space %q", spaceName)
+		}
+		params[spaceName] = base.CORSParameters{
+			AllowedOrigins: origins,
+			AllowedMethods: methods,
+			MaxAge:         maxAge,
+		}
+	}
+	return params, nil
+}
+
+func getDownloadTimeouts() (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration)
+	for name, value := range viper.GetStringMapString("downloads.spaces") {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid download timeout for space %q: %s", name, err)
+		}
+		timeouts[name] = timeout
+	}
+	return timeouts, nil
+}
+
+// getSpacesCleaning returns the retention policies of the spaces that
+// override the conservation section in their spaces_config section. The
+// parameters that are not overridden are the global ones.
+func getSpacesCleaning(enabled bool, params base.CleanParameters) (map[string]base.SpaceCleaning, error) {
+	spaces := make(map[string]base.SpaceCleaning)
+	for name := range viper.GetStringMap("spaces_config") {
+		key := "spaces_config." + name + ".conservation"
+		if !viper.IsSet(key) {
+			continue
+		}
+		cleaning := base.SpaceCleaning{Enabled: enabled, Parameters: params}
+		if viper.IsSet(key + ".enable_background_cleaning") {
+			cleaning.Enabled = viper.GetBool(key + ".enable_background_cleaning")
+		}
+		for field, value := range map[string]*int{
+			"major": &cleaning.Parameters.NbMajor,
+			"minor": &cleaning.Parameters.NbMinor,
+			"month": &cleaning.Parameters.NbMonths,
+			"dev":   &cleaning.Parameters.NbDev,
+		} {
+			if !viper.IsSet(key + "." + field) {
+				continue
+			}
+			*value = viper.GetInt(key + "." + field)
+			if *value < 0 {
+				return nil, fmt.Errorf("Invalid conservation %s for space %q: it must be positive", field, name)
+			}
+		}
+		spaces[name] = cleaning
+	}
+	return spaces, nil
+}
+
+func getMaxApplicationSizes() (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for name := range viper.GetStringMap("downloads.max_sizes") {
+		size := viper.GetSizeInBytes("downloads.max_sizes." + name)
+		if size == 0 {
+			return nil, fmt.Errorf("Invalid maximal application size for space %q", name)
+		}
+		sizes[name] = int64(size)
+	}
+	return sizes, nil
+}
+
+func getArchiveFormats() (map[string]bool, error) {
+	formats := make(map[string]bool)
+	for _, format := range viper.GetStringSlice("archive_formats") {
+		known := false
+		for _, f := range base.ArchiveFormats {
+			if f == format {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("Invalid archive format %q", format)
+		}
+		formats[format] = true
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("At least one archive format must be accepted")
+	}
+	return formats, nil
+}
+
+func initS3Storage() (base.VirtualStorage, error) {
+	endpoint := viper.GetString("storage.s3.endpoint")
+	if endpoint == "" {
+		return nil, fmt.Errorf("storage.s3.endpoint is required")
+	}
+	lookup := minio.BucketLookupAuto
+	if viper.GetBool("storage.s3.path_style") {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(
+			viper.GetString("storage.s3.access_key"),
+			viper.GetString("storage.s3.secret_key"),
+			""),
+		Secure:       viper.GetBool("storage.s3.use_ssl"),
+		Region:       viper.GetString("storage.s3.region"),
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s3 := storage.NewS3(client,
+		viper.GetString("storage.s3.bucket_prefix"),
+		viper.GetString("storage.s3.region"),
+		uint64(viper.GetSizeInBytes("storage.s3.part_size")))
+	if err := s3.Status(); err != nil {
+		return nil, err
+	}
+	return s3, nil
+}
+
 func initSwiftConnection() (*swift.Connection, error) {
 	endpointType := viper.GetString("swift.endpoint_type")
 
@@ -162,7 +653,7 @@ func initSwiftConnection() (*swift.Connection, error) {
 		return nil, err
 	}
 
-	// Prepare containers
+	swiftConnections = append(swiftConnections, &swiftConnection)
 	return &swiftConnection, nil
 }
 
@@ -170,34 +661,55 @@ func configureCache() error {
 	redisURL := viper.GetString("redis.addrs")
 	if redisURL == "" {
 		configureLRUCache()
-		return nil
+		counters.Configure(counters.NewMemoryStore())
+		return configureRateLimits(ratelimit.NewMemoryCounter())
 	}
 
-	optsLatest := &redis.UniversalOptions{
-		// Either a single address or a seed list of host:port addresses
-		// of cluster/sentinel nodes.
-		Addrs: viper.GetStringSlice("redis.addrs"),
+	redisCacheVersionsLatest := redis.NewUniversalClient(redisOptions("versionsLatest"))
+	redisCacheVersionsList := redis.NewUniversalClient(redisOptions("versionsList"))
+	redisRateLimits := redis.NewUniversalClient(redisOptions("rateLimits"))
+	redisCounters := redis.NewUniversalClient(redisOptions("counters"))
 
-		// The sentinel master name.
-		// Only failover clients.
-		MasterName: viper.GetString("redis.master"),
+	redisClients = []redis.UniversalClient{
+		redisCacheVersionsLatest, redisCacheVersionsList, redisRateLimits, redisCounters,
+	}
 
-		// Enables read only queries on slave nodes.
-		ReadOnly: viper.GetBool("redis.read_only_slave"),
+	res := redisCacheVersionsLatest.Ping()
+	if err := res.Err(); err != nil {
+		return err
+	}
+	// The caches fail over to memory while Redis is unavailable
+	retry := viper.GetDuration("redis.failover_retry")
+	cache.ResetFailovers()
+	base.LatestVersionsCache = cache.NewFailoverCache("versionsLatest",
+		cache.NewRedisCache(base.DefaultCacheTTL, redisCacheVersionsLatest), 256, base.DefaultCacheTTL, retry)
+	base.ListVersionsCache = cache.NewFailoverCache("versionsList",
+		cache.NewRedisCache(base.DefaultCacheTTL, redisCacheVersionsList), 256, base.DefaultCacheTTL, retry)
+	if viper.GetBool("redis.local_cache.enabled") {
+		base.LatestVersionsCache = newLayeredCache("versionsLatest", base.LatestVersionsCache, redisCacheVersionsLatest)
+		base.ListVersionsCache = newLayeredCache("versionsList", base.ListVersionsCache, redisCacheVersionsList)
+	}
+	counters.Configure(counters.NewRedisStore(redisCounters))
+	return configureRateLimits(ratelimit.NewRedisCounter(redisRateLimits))
+}
 
-		MaxRetries:         viper.GetInt("redis.max_retries"),
-		Password:           viper.GetString("redis.password"),
-		DialTimeout:        viper.GetDuration("redis.dial_timeout"),
-		ReadTimeout:        viper.GetDuration("redis.read_timeout"),
-		WriteTimeout:       viper.GetDuration("redis.write_timeout"),
-		PoolSize:           viper.GetInt("redis.pool_size"),
-		PoolTimeout:        viper.GetDuration("redis.pool_timeout"),
-		IdleTimeout:        viper.GetDuration("redis.idle_timeout"),
-		IdleCheckFrequency: viper.GetDuration("redis.idle_check_frequency"),
-		DB:                 viper.GetInt("redis.databases.versionsLatest"),
+// newLayeredCache puts an in-process cache in front of the Redis cache, with
+// the parameters of the redis.local_cache section.
+func newLayeredCache(name string, remote base.Cache, client redis.UniversalClient) base.Cache {
+	var inv cache.Invalidator
+	if viper.GetBool("redis.local_cache.invalidation") {
+		inv = cache.NewRedisInvalidator(client, "cozy-apps-registry:invalidation:"+name)
 	}
+	return cache.NewLayeredCache(remote,
+		viper.GetInt("redis.local_cache.max_entries"),
+		viper.GetDuration("redis.local_cache.ttl"),
+		inv)
+}
 
-	optsList := &redis.UniversalOptions{
+// redisOptions returns the options for a client of the given Redis database,
+// by its name in the redis.databases section.
+func redisOptions(database string) *redis.UniversalOptions {
+	return &redis.UniversalOptions{
 		// Either a single address or a seed list of host:port addresses
 		// of cluster/sentinel nodes.
 		Addrs: viper.GetStringSlice("redis.addrs"),
@@ -218,18 +730,8 @@ func configureCache() error {
 		PoolTimeout:        viper.GetDuration("redis.pool_timeout"),
 		IdleTimeout:        viper.GetDuration("redis.idle_timeout"),
 		IdleCheckFrequency: viper.GetDuration("redis.idle_check_frequency"),
-		DB:                 viper.GetInt("redis.databases.versionsList"),
+		DB:                 viper.GetInt("redis.databases." + database),
 	}
-	redisCacheVersionsLatest := redis.NewUniversalClient(optsLatest)
-	redisCacheVersionsList := redis.NewUniversalClient(optsList)
-
-	res := redisCacheVersionsLatest.Ping()
-	if err := res.Err(); err != nil {
-		return err
-	}
-	base.LatestVersionsCache = cache.NewRedisCache(base.DefaultCacheTTL, redisCacheVersionsLatest)
-	base.ListVersionsCache = cache.NewRedisCache(base.DefaultCacheTTL, redisCacheVersionsList)
-	return nil
 }
 
 func configureLRUCache() {
@@ -262,30 +764,104 @@ func configureCouch(purge bool) error {
 		}
 	}
 
-	editorsDBName := base.DBName(editorsDBSuffix)
-	exists, err := client.DBExists(context.Background(), editorsDBName)
+	editorsDB, err := ensureDB(client, base.DBName(editorsDBSuffix))
 	if err != nil {
 		return err
 	}
-	if !exists {
-		fmt.Printf("Creating database %q...", editorsDBName)
-		if err = client.CreateDB(context.Background(), editorsDBName); err != nil {
-			return err
-		}
-		fmt.Println("ok.")
+	vault := auth.NewCouchDBVault(editorsDB)
+	auth.Editors = auth.NewEditorRegistry(vault)
+
+	revocationsDB, err := ensureDB(client, base.DBName(revocationsDBSuffix))
+	if err != nil {
+		return err
 	}
+	auth.Revocations = auth.NewRevocationList(revocationsDB)
 
-	editorsDB := client.DB(context.Background(), editorsDBName)
-	if err = editorsDB.Err(); err != nil {
-		return fmt.Errorf("Could not reach CouchDB: %s", err)
+	issuedDB, err := ensureDB(client, base.DBName(issuedDBSuffix))
+	if err != nil {
+		return err
+	}
+	auth.IssuedTokens = auth.NewTokenRegister(issuedDB)
+
+	deviceLoginsDB, err := ensureDB(client, base.DBName(deviceLoginsDBSuffix))
+	if err != nil {
+		return err
+	}
+	auth.DeviceLogins = auth.NewDeviceLoginStore(deviceLoginsDB)
+	if err := auth.DeviceLogins.CreateIndexes(); err != nil {
+		return err
+	}
+
+	space.CreatedDB, err = ensureDB(client, base.DBName(spacesDBSuffix))
+	if err != nil {
+		return err
+	}
+
+	base.PublishURLsDB, err = ensureDB(client, base.DBName(publishURLsDBSuffix))
+	if err != nil {
+		return err
+	}
+
+	space.RemovalsDB, err = ensureDB(client, base.DBName(removalsDBSuffix))
+	if err != nil {
+		return err
+	}
+	if err := space.CreateRemovalsView(space.RemovalsDB); err != nil {
+		return err
+	}
+
+	if workers := viper.GetInt("jobs.workers"); workers > 0 {
+		jobsDB, err := ensureDB(client, base.DBName(jobsDBSuffix))
+		if err != nil {
+			return err
+		}
+		store := jobs.NewCouchStore(jobsDB)
+		queue := jobs.NewQueue(store, workers, viper.GetInt("jobs.queue_size"))
+		if n, err := queue.Recover(viper.GetDuration("jobs.stale_after")); err != nil {
+			return err
+		} else if n > 0 {
+			logrus.WithFields(logrus.Fields{
+				"nspace": "jobs",
+				"count":  n,
+			}).Warn("Stale jobs marked as failed")
+		}
+		queue.StartCleanup(viper.GetDuration("jobs.ttl"))
+		jobs.Configure(queue)
 	}
-	vault := auth.NewCouchDBVault(editorsDB)
-	auth.Editors = auth.NewEditorRegistry(vault)
 
 	base.GlobalAssetStore = asset.NewStore(client)
 	return nil
 }
 
+func ensureDB(client *kivik.Client, dbName string) (*kivik.DB, error) {
+	exists, err := client.DBExists(context.Background(), dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if err = client.CreateDB(context.Background(), dbName); err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"nspace": "couchdb",
+			"db":     dbName,
+		}).Info("Database created")
+	}
+
+	db := client.DB(context.Background(), dbName)
+	if err = db.Err(); err != nil {
+		return nil, fmt.Errorf("Could not reach CouchDB: %s", err)
+	}
+	return db, nil
+}
+
+// couchTransport is the HTTP transport of the CouchDB client, and couchURL is
+// the URL of CouchDB, without the credentials, for its health checks.
+var (
+	couchTransport *couchclient.Transport
+	couchURL       string
+)
+
 func newClient(addr, user, pass string) (*kivik.Client, error) {
 	u, err := url.Parse(addr)
 	if err != nil {
@@ -298,6 +874,20 @@ func newClient(addr, user, pass string) (*kivik.Client, error) {
 		return nil, err
 	}
 
+	transport := couchclient.NewTransport(couchclient.Options{
+		MaxIdleConns:          viper.GetInt("couchdb.max_idle_conns"),
+		IdleConnTimeout:       viper.GetDuration("couchdb.idle_conn_timeout"),
+		DialTimeout:           viper.GetDuration("couchdb.dial_timeout"),
+		ResponseHeaderTimeout: viper.GetDuration("couchdb.response_header_timeout"),
+		MaxRetries:            viper.GetInt("couchdb.max_retries"),
+		RetryBackoff:          viper.GetDuration("couchdb.retry_backoff"),
+	})
+	if err := client.Authenticate(context.Background(), couchdb.SetTransport(transport)); err != nil {
+		return nil, err
+	}
+	couchTransport = transport
+	couchURL = u.String()
+
 	if pass != "" {
 		auth := &chttp.BasicAuth{
 			Username: user,
@@ -311,6 +901,44 @@ func newClient(addr, user, pass string) (*kivik.Client, error) {
 	return client, nil
 }
 
+// redisClients are the clients of the Redis databases, and swiftConnections
+// the connections to Swift, closed by CloseServices.
+var (
+	redisClients     []redis.UniversalClient
+	swiftConnections []*swift.Connection
+)
+
+// CloseServices closes the connections to Redis and the idle connections to
+// CouchDB and Swift, when the server is stopped.
+func CloseServices() error {
+	var errm error
+	for _, client := range redisClients {
+		if err := client.Close(); err != nil {
+			errm = multierror.Append(errm, err)
+		}
+	}
+	redisClients = nil
+	if couchTransport != nil {
+		couchTransport.CloseIdleConnections()
+	}
+	for _, conn := range swiftConnections {
+		if t, ok := conn.Transport.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	swiftConnections = nil
+	return errm
+}
+
+// RunCouchDBHealthChecker checks CouchDB at the given interval, so that the
+// connections are reopened after a restart of CouchDB. It is meant to be run
+// in a goroutine by the server.
+func RunCouchDBHealthChecker(interval time.Duration) {
+	if couchTransport != nil {
+		couchTransport.RunHealthChecker(couchURL, interval)
+	}
+}
+
 // PrepareSpaces makes sure that the CouchDB databases and Swift containers for
 // the spaces exist and have their index/views.
 func PrepareSpaces() error {
@@ -342,5 +970,22 @@ func PrepareSpaces() error {
 		}
 	}
 
+	// The spaces created with the admin API
+	created, err := space.ListCreated()
+	if err != nil {
+		return fmt.Errorf("Cannot list the created spaces: %w", err)
+	}
+	for _, c := range created {
+		if c.Archived() {
+			continue
+		}
+		if _, ok := space.GetSpace(c.Name); ok {
+			continue
+		}
+		if err := space.Register(c.Name); err != nil {
+			return fmt.Errorf("Cannot register space %q: %w", c.Name, err)
+		}
+	}
+
 	return base.GlobalAssetStore.Prepare()
 }
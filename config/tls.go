@@ -0,0 +1,65 @@
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig returns the TLS configuration of the server, or nil if the
+// registry is served in plain HTTP (behind a reverse proxy for example). The
+// certificate is read from the files of the configuration, or obtained via
+// ACME (Let's Encrypt) for the configured hosts.
+func TLSConfig() (*tls.Config, error) {
+	certFile := viper.GetString("tls.cert_file")
+	keyFile := viper.GetString("tls.key_file")
+	hosts := viper.GetStringSlice("tls.acme.hosts")
+
+	var config *tls.Config
+	switch {
+	case len(hosts) > 0:
+		if certFile != "" || keyFile != "" {
+			return nil, errors.New("The TLS certificate files can't be used with ACME")
+		}
+		cacheDir := viper.GetString("tls.acme.cache_dir")
+		if cacheDir == "" {
+			return nil, errors.New("A cache directory is required for the ACME certificates")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(cacheDir),
+			Email:      viper.GetString("tls.acme.email"),
+		}
+		if url := viper.GetString("tls.acme.directory_url"); url != "" {
+			manager.Client = &acme.Client{DirectoryURL: url}
+		}
+		config = &tls.Config{
+			GetCertificate: manager.GetCertificate,
+			// The tls-alpn-01 challenges are answered on the same port
+			NextProtos: []string{acme.ALPNProto},
+		}
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("Both the TLS certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}}
+	default:
+		return nil, nil
+	}
+
+	config.MinVersion = tls.VersionTLS12
+	if viper.GetBool("tls.http2") {
+		config.NextProtos = append([]string{"h2", "http/1.1"}, config.NextProtos...)
+	} else {
+		config.NextProtos = append([]string{"http/1.1"}, config.NextProtos...)
+	}
+	return config, nil
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/spf13/viper"
@@ -50,28 +51,56 @@ func getVirtualSpaces() (map[string]base.VirtualSpace, error) {
 		if !ok || source == "" {
 			return nil, errors.New("Invalid source for a virtual space")
 		}
-		filter, ok := virtual["filter"].(string)
-		if !ok || (filter != "select" && filter != "reject") {
-			return nil, errors.New("Invalid filter for a virtual space")
+		vspace := base.VirtualSpace{Name: name, Source: source}
+		var err error
+		if vspace.Select, err = getVirtualSpaceSlugs(virtual, "select"); err != nil {
+			return nil, err
 		}
-		list, ok := virtual["slugs"].([]interface{})
-		if !ok {
-			return nil, errors.New("Invalid slugs for a virtual space")
+		if vspace.Reject, err = getVirtualSpaceSlugs(virtual, "reject"); err != nil {
+			return nil, err
 		}
-		slugs := make([]string, len(list))
-		for i, slug := range list {
-			s, ok := slug.(string)
-			if !ok || s == "" {
-				return nil, errors.New("Invalid slug for a virtual space")
+		// The filter and slugs are the legacy way to configure a select or a
+		// reject list
+		if filter, ok := virtual["filter"]; ok {
+			vspace.Filter, ok = filter.(string)
+			if !ok || (vspace.Filter != "select" && vspace.Filter != "reject") {
+				return nil, errors.New("Invalid filter for a virtual space")
 			}
-			slugs[i] = s
-		}
-		virtuals[name] = base.VirtualSpace{
-			Name:   name,
-			Source: source,
-			Filter: filter,
-			Slugs:  slugs,
+			if vspace.Filter == "select" && len(vspace.Select) > 0 {
+				return nil, errors.New("The filter and select of a virtual space can't be used together")
+			}
+			if vspace.Slugs, err = getVirtualSpaceSlugs(virtual, "slugs"); err != nil {
+				return nil, err
+			}
+			if vspace.Slugs == nil {
+				return nil, errors.New("Invalid slugs for a virtual space")
+			}
+		} else if len(vspace.Select) == 0 && len(vspace.Reject) == 0 {
+			return nil, errors.New("Invalid filter for a virtual space: select or reject is required")
 		}
+		virtuals[name] = vspace
 	}
 	return virtuals, nil
 }
+
+// getVirtualSpaceSlugs returns the list of slugs of the given key of the
+// configuration of a virtual space, or nil if it is missing.
+func getVirtualSpaceSlugs(virtual map[string]interface{}, key string) ([]string, error) {
+	value, ok := virtual[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s for a virtual space", key)
+	}
+	slugs := make([]string, len(list))
+	for i, slug := range list {
+		s, ok := slug.(string)
+		if !ok || s == "" {
+			return nil, errors.New("Invalid slug for a virtual space")
+		}
+		slugs[i] = s
+	}
+	return slugs, nil
+}
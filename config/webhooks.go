@@ -0,0 +1,90 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	"github.com/spf13/viper"
+)
+
+func configureWebhooks() error {
+	hooks, err := getWebhooks()
+	if err != nil {
+		return err
+	}
+	webhooks.Configure(webhooks.NewDispatcher(
+		hooks,
+		viper.GetDuration("webhooks.timeout"),
+		viper.GetInt("webhooks.retries"),
+		viper.GetDuration("webhooks.backoff")))
+	return nil
+}
+
+func getWebhooks() (map[string][]webhooks.Webhook, error) {
+	hooks := make(map[string][]webhooks.Webhook)
+	for spaceName, value := range viper.GetStringMap("webhooks.spaces") {
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Invalid webhooks configuration for space %q", spaceName)
+		}
+		for _, item := range list {
+			hook, err := parseWebhook(item)
+			if err != nil {
+				return nil, err
+			}
+			hooks[spaceName] = append(hooks[spaceName], hook)
+		}
+	}
+	return hooks, nil
+}
+
+func parseWebhook(item interface{}) (webhooks.Webhook, error) {
+	var hook webhooks.Webhook
+	conf, ok := item.(map[interface{}]interface{})
+	if !ok {
+		m, isMap := item.(map[string]interface{})
+		if !isMap {
+			return hook, errors.New("Invalid webhook configuration")
+		}
+		conf = make(map[interface{}]interface{}, len(m))
+		for k, v := range m {
+			conf[k] = v
+		}
+	}
+	u, ok := conf["url"].(string)
+	if !ok || u == "" {
+		return hook, errors.New("Invalid url for a webhook")
+	}
+	hook.URL = u
+	if secret, ok := conf["secret"]; ok {
+		s, ok := secret.(string)
+		if !ok {
+			return hook, errors.New("Invalid secret for a webhook")
+		}
+		hook.Secret = s
+	}
+	if events, ok := conf["events"]; ok {
+		list, ok := events.([]interface{})
+		if !ok {
+			return hook, errors.New("Invalid events for a webhook")
+		}
+		for _, event := range list {
+			e, ok := event.(string)
+			if !ok || !isWebhookEvent(e) {
+				return hook, fmt.Errorf("Invalid event for a webhook: %v", event)
+			}
+			hook.Events = append(hook.Events, e)
+		}
+	}
+	return hook, nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhooks.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
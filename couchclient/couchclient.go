@@ -0,0 +1,226 @@
+// Package couchclient builds the HTTP transport used to talk to CouchDB: a
+// pool of connections with configurable limits and timeouts, retries with
+// jitter on the transient errors, and a health check that drops the pooled
+// connections when CouchDB restarts.
+package couchclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Options are the parameters of the transport.
+type Options struct {
+	// MaxIdleConns is the maximal number of idle connections kept in the
+	// pool.
+	MaxIdleConns int
+	// IdleConnTimeout is how long an idle connection is kept in the pool.
+	IdleConnTimeout time.Duration
+	// DialTimeout is the maximal duration of the connection to CouchDB.
+	DialTimeout time.Duration
+	// ResponseHeaderTimeout is the maximal duration to wait for the headers
+	// of a response (0 for no limit, as some requests can be long, like the
+	// build of a view).
+	ResponseHeaderTimeout time.Duration
+	// MaxRetries is the number of retries of a request that has failed with
+	// a transient error (0 to disable them).
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry. It is doubled for
+	// each retry, with some jitter.
+	RetryBackoff time.Duration
+}
+
+// Transport is an http.RoundTripper for CouchDB.
+type Transport struct {
+	opts Options
+	pool *http.Transport
+
+	mu        sync.Mutex
+	unhealthy bool
+}
+
+// NewTransport returns a transport for CouchDB with the given options.
+func NewTransport(opts Options) *Transport {
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	pool := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConns,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &Transport{opts: opts, pool: pool}
+}
+
+// RoundTrip sends the request to CouchDB, and retries it when it fails with
+// a transient error and it can be sent again safely.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := t.pool.RoundTrip(req)
+		if attempt >= t.opts.MaxRetries || !shouldRetry(req, res, err) {
+			return res, err
+		}
+		if err != nil {
+			// The pooled connections may be dead after a restart of CouchDB
+			t.pool.CloseIdleConnections()
+		} else {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		if req, err = rewind(req); err != nil {
+			return nil, err
+		}
+
+		delay := backoff(t.opts.RetryBackoff, attempt)
+		logrus.WithFields(logrus.Fields{
+			"nspace":  "couchdb",
+			"method":  req.Method,
+			"path":    req.URL.Path,
+			"attempt": attempt + 1,
+			"delay":   delay.String(),
+		}).Warn("Request to CouchDB failed, retrying")
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// readOnlyPosts are the endpoints of CouchDB that are called with POST but
+// don't modify the databases.
+var readOnlyPosts = []string{"/_find", "/_all_docs", "/_bulk_get", "/_explain"}
+
+// isIdempotent returns true if the request can be sent twice without side
+// effects. The PUT of a document has a revision, and the second one fails
+// with a conflict instead of creating a new revision.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		for _, suffix := range readOnlyPosts {
+			if strings.HasSuffix(req.URL.Path, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shouldRetry tells if the request has failed with a transient error, and if
+// it can be sent again.
+func shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	if err != nil {
+		// A request that could not be sent can always be retried
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return isIdempotent(req)
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return isIdempotent(req)
+	}
+	return false
+}
+
+// rewind returns a copy of the request with a fresh body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, nil
+}
+
+// backoff returns the delay before a retry: the base delay doubled for each
+// attempt, with a jitter of +/- 50% to avoid the retries of all the requests
+// at the same time.
+func backoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		base = 100 * time.Millisecond
+	}
+	d := base << uint(attempt)
+	return time.Duration(float64(d) * (0.5 + rand.Float64()))
+}
+
+// CloseIdleConnections closes the connections of the pool that are not used.
+func (t *Transport) CloseIdleConnections() {
+	t.pool.CloseIdleConnections()
+}
+
+// CheckHealth calls the /_up endpoint of CouchDB. When it fails, the idle
+// connections are closed, so that the next requests open new connections
+// instead of failing on the dead ones.
+func (t *Transport) CheckHealth(ctx context.Context, couchURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(couchURL, "/")+"/_up", nil)
+	if err != nil {
+		return err
+	}
+	res, err := t.pool.RoundTrip(req)
+	if err == nil {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			err = errors.New(res.Status)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	log := logrus.WithField("nspace", "couchdb")
+	if err != nil {
+		t.pool.CloseIdleConnections()
+		if !t.unhealthy {
+			log.WithField("error_msg", err).Warn("CouchDB is unavailable, the connections will be reopened")
+		}
+		t.unhealthy = true
+		return err
+	}
+	if t.unhealthy {
+		log.Info("CouchDB is back")
+	}
+	t.unhealthy = false
+	return nil
+}
+
+// RunHealthChecker checks the health of CouchDB at the given interval. It is
+// meant to be run in a goroutine by the server.
+func (t *Transport) RunHealthChecker(couchURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		_ = t.CheckHealth(ctx, couchURL)
+		cancel()
+	}
+}
@@ -0,0 +1,98 @@
+package couchclient
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer responds with a 503 to the first requests, and then with the
+// body of the request.
+func flakyServer(failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	return ts, &calls
+}
+
+func newTestClient(retries int) *http.Client {
+	return &http.Client{Transport: NewTransport(Options{
+		MaxIdleConns: 10,
+		MaxRetries:   retries,
+		RetryBackoff: time.Millisecond,
+	})}
+}
+
+func TestRetryIdempotentRequests(t *testing.T) {
+	ts, calls := flakyServer(2)
+	defer ts.Close()
+
+	res, err := newTestClient(2).Get(ts.URL + "/registry-apps/drive")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.EqualValues(t, 3, atomic.LoadInt32(calls))
+}
+
+func TestRetryReadOnlyPostWithBody(t *testing.T) {
+	ts, calls := flakyServer(1)
+	defer ts.Close()
+
+	res, err := newTestClient(2).Post(ts.URL+"/registry-apps/_find", "application/json",
+		strings.NewReader(`{"selector":{}}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Equal(t, `{"selector":{}}`, string(body))
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+}
+
+func TestNoRetryForWrites(t *testing.T) {
+	ts, calls := flakyServer(1)
+	defer ts.Close()
+
+	res, err := newTestClient(2).Post(ts.URL+"/registry-apps", "application/json",
+		strings.NewReader(`{"slug":"drive"}`))
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.EqualValues(t, 1, atomic.LoadInt32(calls))
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	ts, calls := flakyServer(10)
+	defer ts.Close()
+
+	res, err := newTestClient(2).Get(ts.URL + "/registry-apps/drive")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.EqualValues(t, 3, atomic.LoadInt32(calls))
+}
+
+func TestCheckHealth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_up", r.URL.Path)
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	}))
+	transport := NewTransport(Options{})
+	assert.NoError(t, transport.CheckHealth(context.Background(), ts.URL+"/"))
+
+	ts.Close()
+	assert.Error(t, transport.CheckHealth(context.Background(), ts.URL))
+	assert.True(t, transport.unhealthy)
+}
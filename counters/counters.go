@@ -0,0 +1,116 @@
+// Package counters counts the downloads of the applications (fetches of the
+// tarballs and of the latest versions) per day. The hits are counted in Redis,
+// to be shared by the instances of the registry, or in memory, and they are
+// regularly drained to be added to the statistics in CouchDB.
+package counters
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of hits
+const (
+	// Tarball is for the downloads of the tarballs of the versions.
+	Tarball = "tarball"
+	// Latest is for the fetches of the latest version of an application.
+	Latest = "latest"
+)
+
+// dateFormat is the format of the days of the hits.
+const dateFormat = "2006-01-02"
+
+// Key identifies a counter: the hits of a kind, for an application of a
+// space, on a day.
+type Key struct {
+	Space string
+	Slug  string
+	Date  string
+	Kind  string
+}
+
+func (k Key) String() string {
+	return strings.Join([]string{k.Space, k.Slug, k.Date, k.Kind}, "|")
+}
+
+// ParseKey parses a key serialized with String.
+func ParseKey(s string) (Key, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 4 {
+		return Key{}, fmt.Errorf("Invalid counter key %q", s)
+	}
+	return Key{Space: parts[0], Slug: parts[1], Date: parts[2], Kind: parts[3]}, nil
+}
+
+// Store keeps the counters until they are drained.
+type Store interface {
+	// Add adds n hits to the counter of the key.
+	Add(key string, n int64) error
+	// Drain returns the counters, and resets them.
+	Drain() (map[string]int64, error)
+}
+
+var store Store
+
+// Configure sets the store used to count the hits.
+func Configure(s Store) {
+	store = s
+}
+
+// Hit counts a hit of the given kind for an application of a space. The
+// errors are logged, as the statistics must not break the downloads.
+func Hit(space, slug, kind string) {
+	if store == nil {
+		return
+	}
+	key := Key{
+		Space: space,
+		Slug:  slug,
+		Date:  time.Now().UTC().Format(dateFormat),
+		Kind:  kind,
+	}
+	if err := store.Add(key.String(), 1); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "counters",
+			"key":       key.String(),
+			"error_msg": err,
+		}).Warn("Cannot count a hit")
+	}
+}
+
+// Drain returns the counters by key, and resets them. If the flush of the
+// counters fails, they can be given back with Restore.
+func Drain() (map[Key]int64, error) {
+	if store == nil {
+		return nil, nil
+	}
+	raw, err := store.Drain()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[Key]int64, len(raw))
+	for k, n := range raw {
+		key, err := ParseKey(k)
+		if err != nil {
+			continue
+		}
+		counts[key] += n
+	}
+	return counts, nil
+}
+
+// Restore adds back the counters that could not be flushed.
+func Restore(counts map[Key]int64) error {
+	if store == nil {
+		return nil
+	}
+	for key, n := range counts {
+		if err := store.Add(key.String(), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package counters
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	key := Key{Space: "", Slug: "drive", Date: "2021-05-12", Kind: Tarball}
+	parsed, err := ParseKey(key.String())
+	assert.NoError(t, err)
+	assert.Equal(t, key, parsed)
+
+	_, err = ParseKey("drive|2021-05-12")
+	assert.Error(t, err)
+}
+
+func TestDrainAndRestore(t *testing.T) {
+	Configure(NewMemoryStore())
+	defer Configure(nil)
+
+	Hit("", "drive", Tarball)
+	Hit("", "drive", Tarball)
+	Hit("", "drive", Latest)
+	Hit("partners", "drive", Tarball)
+
+	counts, err := Drain()
+	require.NoError(t, err)
+	assert.Len(t, counts, 3)
+	for key, n := range counts {
+		if key.Space == "" && key.Kind == Tarball {
+			assert.EqualValues(t, 2, n)
+		} else {
+			assert.EqualValues(t, 1, n)
+		}
+	}
+
+	// The counters are reset by the drain, and restored after a failure
+	again, err := Drain()
+	require.NoError(t, err)
+	assert.Empty(t, again)
+	require.NoError(t, Restore(counts))
+	again, err = Drain()
+	require.NoError(t, err)
+	assert.Equal(t, counts, again)
+}
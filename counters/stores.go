@@ -0,0 +1,82 @@
+package counters
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// memoryStore is a store for a single instance of the registry.
+type memoryStore struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// NewMemoryStore returns a store that keeps the counters in memory. It is used
+// when Redis is not configured.
+func NewMemoryStore() Store {
+	return &memoryStore{counts: make(map[string]int64)}
+}
+
+func (m *memoryStore) Add(key string, n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[key] += n
+	return nil
+}
+
+func (m *memoryStore) Drain() (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts := m.counts
+	m.counts = make(map[string]int64)
+	return counts, nil
+}
+
+// redisKey is the Redis hash of the counters. When they are drained, the hash
+// is renamed atomically, so that the hits counted during the flush are not
+// lost, and that two instances can't flush the same hits.
+const redisKey = "counters:hits"
+
+// redisStore is a store shared by all the instances of the registry.
+type redisStore struct {
+	client redis.UniversalClient
+}
+
+// NewRedisStore returns a store that keeps the counters in Redis.
+func NewRedisStore(client redis.UniversalClient) Store {
+	return &redisStore{client: client}
+}
+
+func (r *redisStore) Add(key string, n int64) error {
+	return r.client.HIncrBy(redisKey, key, n).Err()
+}
+
+func (r *redisStore) Drain() (map[string]int64, error) {
+	draining := redisKey + ":draining:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	renamed, err := r.client.RenameNX(redisKey, draining).Result()
+	if err != nil {
+		// The hash doesn't exist when there have been no hits
+		if err.Error() == "ERR no such key" {
+			return map[string]int64{}, nil
+		}
+		return nil, err
+	}
+	if !renamed {
+		return map[string]int64{}, nil
+	}
+	values, err := r.client.HGetAll(draining).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(values))
+	for k, v := range values {
+		counts[k], _ = strconv.ParseInt(v, 10, 64)
+	}
+	if err := r.client.Del(draining).Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -70,7 +71,7 @@ func exportSingleCouchDb(writer *tar.Writer, prefix string, db *kivik.DB) error
 	clean := strings.Replace(name, base.DatabaseNamespace, "__prefix__", 1)
 
 	prefix = path.Join(prefix, clean)
-	fmt.Printf("  Exporting database %s\n", name)
+	logrus.WithFields(logrus.Fields{"nspace": "export", "db": name}).Info("Exporting database")
 
 	startKey, perPage := "", 1000
 	for {
@@ -112,7 +113,7 @@ func couchDatabases() []*kivik.DB {
 }
 
 func exportAllCouchDbs(writer *tar.Writer, prefix string) error {
-	fmt.Printf("  Exporting CouchDB\n")
+	logrus.WithField("nspace", "export").Info("Exporting CouchDB")
 	prefix = path.Join(prefix, couchPrefix)
 
 	dbs := couchDatabases()
@@ -126,7 +127,7 @@ func exportAllCouchDbs(writer *tar.Writer, prefix string) error {
 }
 
 func exportSwiftContainer(writer *tar.Writer, prefix string, container base.Prefix) error {
-	fmt.Printf("    Exporting container %s\n", container)
+	logrus.WithFields(logrus.Fields{"nspace": "export", "container": container}).Info("Exporting container")
 	dir := path.Join(prefix, container.String())
 	g, ctx := errgroup.WithContext(context.Background())
 
@@ -192,7 +193,7 @@ func swiftContainers() []base.Prefix {
 }
 
 func exportSwift(writer *tar.Writer, prefix string) error {
-	fmt.Printf("  Exporting Swift\n")
+	logrus.WithField("nspace", "export").Info("Exporting Swift")
 	prefix = path.Join(prefix, swiftPrefix)
 	containers := swiftContainers()
 
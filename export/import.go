@@ -6,7 +6,6 @@ import (
 	"compress/gzip"
 	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"path"
@@ -15,6 +14,7 @@ import (
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/config"
 	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -29,7 +29,11 @@ func (db *couchDb) bulkImport() error {
 	if len(docs) == 0 {
 		return nil
 	}
-	fmt.Printf("Bulk import %d CouchDB documents into %s\n", len(docs), db.db)
+	logrus.WithFields(logrus.Fields{
+		"nspace": "import",
+		"db":     db.db,
+		"count":  len(docs),
+	}).Info("Bulk import of CouchDB documents")
 
 	ctx := context.Background()
 	c := base.DBClient.DB(ctx, db.db)
@@ -70,10 +74,10 @@ func (dbs couchDbs) flush() error {
 }
 
 func cleanCouch() error {
-	fmt.Printf("Clean CouchDB\n")
+	logrus.WithField("nspace", "import").Info("Cleaning CouchDB")
 	for _, db := range couchDatabases() {
 		name := db.Name()
-		fmt.Printf("  Clean CouchDB %s\n", name)
+		logrus.WithFields(logrus.Fields{"nspace": "import", "db": name}).Info("Cleaning database")
 		if err := base.DBClient.DestroyDB(context.Background(), name); err != nil {
 			return err
 		}
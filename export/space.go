@@ -0,0 +1,391 @@
+package export
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/asset"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// The archive of a space is independent of the name of the space and of the
+// CouchDB prefix, so that it can be imported in another environment, or under
+// another name:
+//
+//   - `space/space.json`: the format and the name of the exported space
+//   - `space/couchdb/{apps,versions,pending}/{id}.json`: the CouchDB documents
+//   - `space/storage/{file/path}`: the files of the space (tarballs)
+//   - `space/assets/{shasum}`: the assets (icons, screenshots) used by the
+//     versions of the space
+//
+// The files have the COZY.content-type tar custom metadata.
+const (
+	spaceRootPrefix    = "space"
+	spaceInfoFile      = "space.json"
+	spaceStoragePrefix = "storage"
+	spaceAssetsPrefix  = "assets"
+	spaceFormat        = 1
+)
+
+type spaceInfo struct {
+	Format     int       `json:"format"`
+	Space      string    `json:"space"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type exportedVersion struct {
+	Slug        string            `json:"slug"`
+	Version     string            `json:"version"`
+	Attachments map[string]string `json:"attachments"`
+}
+
+func spaceDatabases(s *space.Space) map[string]*kivik.DB {
+	return map[string]*kivik.DB{
+		"apps":     s.AppsDB(),
+		"versions": s.VersDB(),
+		"pending":  s.PendingVersDB(),
+		"trash":    s.TrashVersDB(),
+		"stats":    s.StatsDB(),
+	}
+}
+
+// ExportSpace creates a tarball with the applications, versions, files and
+// assets of a space.
+func ExportSpace(writer io.Writer, s *space.Space) (err error) {
+	zw := gzip.NewWriter(writer)
+	defer func() {
+		if e := zw.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	tw := tar.NewWriter(zw)
+	defer func() {
+		if e := tw.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+
+	info, err := json.Marshal(spaceInfo{
+		Format:     spaceFormat,
+		Space:      s.GetPrefix().String(),
+		ExportedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(tw, path.Join(spaceRootPrefix, spaceInfoFile), info, nil); err != nil {
+		return err
+	}
+
+	// The CouchDB documents are written before the assets, so that the import
+	// knows which versions use an asset when it is read.
+	shasums := make(map[string]struct{})
+	for _, name := range []string{"apps", "versions", "pending", "trash", "stats"} {
+		db := spaceDatabases(s)[name]
+		prefix := path.Join(spaceRootPrefix, couchPrefix, name)
+		logrus.WithFields(logrus.Fields{"nspace": "export", "space": s.Name, "db": db.Name()}).Info("Exporting database")
+		err := forEachDocument(db, func(id string, doc map[string]interface{}) error {
+			if name != "apps" && name != "stats" {
+				var ver exportedVersion
+				if err := remarshal(doc, &ver); err != nil {
+					return err
+				}
+				for _, shasum := range ver.Attachments {
+					shasums[shasum] = struct{}{}
+				}
+			}
+			delete(doc, "_rev")
+			delete(doc, "_attachments")
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			return writeFile(tw, path.Join(prefix, id+documentSuffix), data, nil)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{"nspace": "export", "space": s.Name}).Info("Exporting the files of the space")
+	prefix := s.GetPrefix()
+	err = base.Storage.Walk(prefix, func(name, contentType string) error {
+		content, _, err := base.Storage.Get(prefix, name)
+		if err != nil {
+			return err
+		}
+		file := path.Join(spaceRootPrefix, spaceStoragePrefix, name)
+		return writeFile(tw, file, content.Bytes(), map[string]string{
+			contentTypeAttr: contentType,
+		})
+	})
+	if err != nil && !errors.Is(err, base.ErrFileNotFound) {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"nspace": "export", "space": s.Name, "count": len(shasums)}).Info("Exporting the assets")
+	for shasum := range shasums {
+		content, headers, err := base.Storage.Get(asset.AssetContainerName, shasum)
+		if err != nil {
+			return err
+		}
+		file := path.Join(spaceRootPrefix, spaceAssetsPrefix, shasum)
+		if err := writeFile(tw, file, content.Bytes(), map[string]string{
+			contentTypeAttr: headers["Content-Type"],
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachDocument(db *kivik.DB, fn func(id string, doc map[string]interface{}) error) error {
+	startKey, perPage := "", 1000
+	for {
+		rows, err := db.AllDocs(context.Background(), map[string]interface{}{
+			"include_docs": true,
+			"limit":        perPage + 1,
+			"start_key":    startKey,
+		})
+		if err != nil {
+			return err
+		}
+
+		startKey = ""
+		i := 0
+		for rows.Next() {
+			if i == perPage {
+				startKey = rows.ID()
+				break
+			}
+			i++
+			if strings.HasPrefix(rows.ID(), "_design") {
+				continue
+			}
+			var doc map[string]interface{}
+			if err := rows.ScanDoc(&doc); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(rows.ID(), doc); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		if startKey == "" {
+			return nil
+		}
+	}
+}
+
+func remarshal(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// registryPath returns the path of the registry API for the space.
+func registryPath(spaceName string) string {
+	if spaceName == "" || spaceName == base.DefaultSpacePrefix.String() {
+		return "/registry/"
+	}
+	return "/" + url.PathEscape(spaceName) + "/registry/"
+}
+
+// rewriteVersionURL changes the URL of the tarball of a version when the
+// space is imported under another name.
+func rewriteVersionURL(doc map[string]interface{}, from, to string) {
+	if from == to {
+		return
+	}
+	raw, ok := doc["url"].(string)
+	if !ok {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || !strings.HasPrefix(u.Path, registryPath(from)) {
+		return
+	}
+	u.Path = registryPath(to) + strings.TrimPrefix(u.Path, registryPath(from))
+	doc["url"] = u.String()
+}
+
+func isSpaceEmpty(s *space.Space) (bool, error) {
+	for _, db := range s.DBs() {
+		empty := true
+		err := forEachDocument(db, func(id string, doc map[string]interface{}) error {
+			empty = false
+			return io.EOF
+		})
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		if !empty {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ImportSpace restores a space exported with ExportSpace in the given space,
+// which can have another name than the exported one. The space must be empty.
+func ImportSpace(reader io.Reader, s *space.Space) (err error) {
+	empty, err := isSpaceEmpty(s)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("Space %q is not empty", s.GetPrefix())
+	}
+
+	zr, err := gzip.NewReader(reader)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := zr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}()
+	tr := tar.NewReader(zr)
+
+	var info *spaceInfo
+	dbs := couchDbs{}
+	names := make(map[string]string)
+	for name, db := range spaceDatabases(s) {
+		names[name] = db.Name()
+	}
+	// sources links the shasum of an asset to the versions that use it
+	sources := make(map[string][]*exportedVersion)
+	assetsStarted := false
+	imported := 0
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		parts := strings.Split(header.Name, "/")
+		if len(parts) < 2 || parts[0] != spaceRootPrefix {
+			continue
+		}
+		if parts[1] == spaceInfoFile {
+			info = &spaceInfo{}
+			if err := json.NewDecoder(tr).Decode(info); err != nil {
+				return err
+			}
+			if info.Format != spaceFormat {
+				return fmt.Errorf("Unsupported archive format %d", info.Format)
+			}
+			continue
+		}
+		if info == nil {
+			return fmt.Errorf("Invalid archive: %s is missing", spaceInfoFile)
+		}
+
+		switch parts[1] {
+		case couchPrefix:
+			if len(parts) != 4 {
+				continue
+			}
+			dbName, ok := names[parts[2]]
+			if !ok {
+				continue
+			}
+			var doc map[string]interface{}
+			if err := json.NewDecoder(tr).Decode(&doc); err != nil {
+				return err
+			}
+			if parts[2] != "apps" && parts[2] != "stats" {
+				rewriteVersionURL(doc, info.Space, s.GetPrefix().String())
+				var ver exportedVersion
+				if err := remarshal(doc, &ver); err != nil {
+					return err
+				}
+				for _, shasum := range ver.Attachments {
+					sources[shasum] = append(sources[shasum], &ver)
+				}
+			}
+			if err := dbs.add(dbName, doc); err != nil {
+				return err
+			}
+
+		case spaceStoragePrefix:
+			name := path.Join(parts[2:]...)
+			contentType := header.PAXRecords[contentTypeAttr]
+			if err := base.Storage.Create(s.GetPrefix(), name, contentType, tr); err != nil {
+				return err
+			}
+
+		case spaceAssetsPrefix:
+			if !assetsStarted {
+				// The versions must be saved before their assets
+				if err := dbs.flush(); err != nil {
+					return err
+				}
+				assetsStarted = true
+			}
+			if len(parts) != 3 {
+				continue
+			}
+			shasum := parts[2]
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			contentType := header.PAXRecords[contentTypeAttr]
+			for _, ver := range sources[shasum] {
+				a := &base.Asset{ContentType: contentType, AppSlug: ver.Slug}
+				for filename, sum := range ver.Attachments {
+					if sum == shasum {
+						a.Name = filename
+						break
+					}
+				}
+				source := asset.ComputeSource(s.GetPrefix(), ver.Slug, ver.Version)
+				if err := base.GlobalAssetStore.Add(a, bytes.NewReader(content), source); err != nil {
+					return err
+				}
+			}
+			imported++
+		}
+	}
+
+	if info == nil {
+		return fmt.Errorf("Invalid archive: %s is missing", spaceInfoFile)
+	}
+	if err := dbs.flush(); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"nspace": "import",
+		"space":  info.Space,
+		"prefix": s.GetPrefix(),
+		"assets": imported,
+	}).Info("Space imported")
+	return nil
+}
@@ -0,0 +1,603 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// MaxDepth is the maximal depth of the selection sets of a query, to protect
+// the registry from the queries too expensive to resolve.
+const MaxDepth = 10
+
+// MaxCost is the maximal cost of a query. Each field costs 1, multiplied by
+// the sizes of the lists above it.
+const MaxCost = 10000
+
+// Type is the type of the result of a field: an *Object, a *List or a
+// Scalar.
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type, whose values are returned as JSON.
+type Scalar string
+
+func (s Scalar) String() string { return string(s) }
+
+// The scalars of the schema
+const (
+	String  Scalar = "String"
+	Int     Scalar = "Int"
+	Float   Scalar = "Float"
+	Boolean Scalar = "Boolean"
+	// JSON is for the values returned as is, like the manifests.
+	JSON Scalar = "JSON"
+)
+
+// List is a list of values of a type.
+type List struct {
+	Of Type
+}
+
+func (l *List) String() string { return "[" + l.Of.String() + "]" }
+
+// Object is a type with fields.
+type Object struct {
+	Name        string
+	Description string
+	Fields      map[string]*FieldDef
+}
+
+func (o *Object) String() string { return o.Name }
+
+// Argument is an argument of a field.
+type Argument struct {
+	Type        Scalar
+	Required    bool
+	Description string
+}
+
+// FieldDef is a field of an object type.
+type FieldDef struct {
+	Type        Type
+	Description string
+	Args        map[string]*Argument
+	// Resolve returns the value of the field for its parent. When it is nil,
+	// the value is taken from a map[string]interface{} parent.
+	Resolve func(p *ResolveParams) (interface{}, error)
+	// Size is the maximal number of items of the list returned by the field
+	// (or by its sub-fields), for the cost of the queries. The limit argument
+	// of the field is used instead when it is lower. It is 1 when not set.
+	Size int
+}
+
+// ResolveParams are the parameters of a resolver.
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+	// Field is the field of the request, to know its sub-fields.
+	Field *Field
+}
+
+// Schema is the root of the types of a GraphQL API. Only the queries are
+// supported.
+type Schema struct {
+	Query *Object
+}
+
+// Request is the body of a GraphQL request.
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Error is an error of the response, with the path of the field that has
+// failed.
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Response is the result of a request. The data are partial when some fields
+// have failed.
+type Response struct {
+	Data   *OrderedMap `json:"data"`
+	Errors []*Error    `json:"errors,omitempty"`
+}
+
+// OrderedMap is a JSON object whose keys are kept in the order of the
+// request.
+type OrderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedMap() *OrderedMap {
+	return &OrderedMap{values: make(map[string]interface{})}
+}
+
+func (m *OrderedMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value of a key.
+func (m *OrderedMap) Get(key string) interface{} {
+	return m.values[key]
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m *OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type executor struct {
+	ctx       context.Context
+	schema    *Schema
+	doc       *Document
+	variables map[string]interface{}
+	errors    []*Error
+}
+
+// Execute parses and executes a request on the schema.
+func (s *Schema) Execute(ctx context.Context, req *Request) *Response {
+	doc, err := Parse(req.Query)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	op, err := doc.operation(req.OperationName)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	variables, err := op.variables(req.Variables)
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	e := &executor{ctx: ctx, schema: s, doc: doc, variables: variables}
+	cost, err := e.validate(s.Query, op.SelectionSet, 1, make(map[string]bool))
+	if err != nil {
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	if cost > MaxCost {
+		err = fmt.Errorf("The query is too expensive (a cost of %d at most)", MaxCost)
+		return &Response{Errors: []*Error{{Message: err.Error()}}}
+	}
+	data := e.executeSelectionSet(s.Query, nil, op.SelectionSet, nil)
+	return &Response{Data: data, Errors: e.errors}
+}
+
+func (d *Document) operation(name string) (*Operation, error) {
+	if name == "" {
+		if len(d.Operations) > 1 {
+			return nil, fmt.Errorf("The operationName is required for a document with several operations")
+		}
+		return d.Operations[0], nil
+	}
+	for _, op := range d.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown operation %q", name)
+}
+
+func (op *Operation) variables(values map[string]interface{}) (map[string]interface{}, error) {
+	variables := make(map[string]interface{})
+	for _, def := range op.Variables {
+		value, ok := values[def.Name]
+		if !ok && def.Default != nil {
+			value, ok = literal(def.Default, nil), true
+		}
+		if (!ok || value == nil) && def.Required {
+			return nil, fmt.Errorf("Variable $%s of type %s is required", def.Name, def.Type)
+		}
+		if ok {
+			variables[def.Name] = value
+		}
+	}
+	return variables, nil
+}
+
+// literal converts a value of the request to a Go value, with the values of
+// the variables.
+func literal(v Value, variables map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case Variable:
+		return variables[string(v)]
+	case Enum:
+		return string(v)
+	case []Value:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = literal(item, variables)
+		}
+		return list
+	case map[string]Value:
+		obj := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			obj[k] = literal(item, variables)
+		}
+		return obj
+	default:
+		return v
+	}
+}
+
+// validate checks the fields and the depth of a selection set before its
+// execution, so that an invalid query doesn't make any call to the database.
+// It returns the cost of the selection set.
+func (e *executor) validate(obj *Object, selections []Selection, depth int, visiting map[string]bool) (int, error) {
+	if depth > MaxDepth {
+		return 0, fmt.Errorf("The query is too deep (%d levels at most)", MaxDepth)
+	}
+	cost := 0
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *Field:
+			if sel.Name == "__typename" {
+				continue
+			}
+			def, ok := obj.Fields[sel.Name]
+			if !ok {
+				return 0, fmt.Errorf("Cannot query field %q on type %s", sel.Name, obj.Name)
+			}
+			for name := range sel.Arguments {
+				if _, ok := def.Args[name]; !ok {
+					return 0, fmt.Errorf("Unknown argument %q on field %s.%s", name, obj.Name, sel.Name)
+				}
+			}
+			for name, arg := range def.Args {
+				if _, ok := sel.Arguments[name]; arg.Required && !ok {
+					return 0, fmt.Errorf("Argument %q of field %s.%s is required", name, obj.Name, sel.Name)
+				}
+			}
+			cost++
+			child := namedObject(def.Type)
+			switch {
+			case child != nil && sel.SelectionSet == nil:
+				return 0, fmt.Errorf("Field %s.%s of type %s must have a selection of subfields", obj.Name, sel.Name, def.Type)
+			case child == nil && sel.SelectionSet != nil:
+				return 0, fmt.Errorf("Field %s.%s of type %s can't have a selection of subfields", obj.Name, sel.Name, def.Type)
+			case child != nil:
+				childCost, err := e.validate(child, sel.SelectionSet, depth+1, visiting)
+				if err != nil {
+					return 0, err
+				}
+				cost += e.size(def, sel) * childCost
+			}
+		case *FragmentSpread:
+			f, ok := e.doc.Fragments[sel.Name]
+			if !ok {
+				return 0, fmt.Errorf("Unknown fragment %q", sel.Name)
+			}
+			if visiting[f.Name] {
+				return 0, fmt.Errorf("Fragment %q can't spread itself", f.Name)
+			}
+			if f.On != obj.Name {
+				return 0, fmt.Errorf("Fragment %q on %s can't be spread on %s", f.Name, f.On, obj.Name)
+			}
+			visiting[f.Name] = true
+			fragmentCost, err := e.validate(obj, f.SelectionSet, depth, visiting)
+			delete(visiting, f.Name)
+			if err != nil {
+				return 0, err
+			}
+			cost += fragmentCost
+		case *InlineFragment:
+			if sel.On != "" && sel.On != obj.Name {
+				return 0, fmt.Errorf("Fragment on %s can't be spread on %s", sel.On, obj.Name)
+			}
+			fragmentCost, err := e.validate(obj, sel.SelectionSet, depth, visiting)
+			if err != nil {
+				return 0, err
+			}
+			cost += fragmentCost
+		}
+	}
+	// The cost is capped, as the sizes are multiplied at each level
+	if cost > MaxCost {
+		cost = MaxCost + 1
+	}
+	return cost, nil
+}
+
+// size returns the number of items expected for a field, from its limit
+// argument and the size of its definition.
+func (e *executor) size(def *FieldDef, field *Field) int {
+	size := def.Size
+	if size < 1 {
+		return 1
+	}
+	if value, ok := field.Arguments["limit"]; ok {
+		if limit, err := coerceArgument(Int, literal(value, e.variables)); err == nil {
+			if l := limit.(int); l > 0 && l < size {
+				size = l
+			}
+		}
+	}
+	return size
+}
+
+// namedObject returns the object type of a type, or of the items of a list.
+func namedObject(t Type) *Object {
+	switch t := t.(type) {
+	case *Object:
+		return t
+	case *List:
+		return namedObject(t.Of)
+	default:
+		return nil
+	}
+}
+
+// collectFields returns the fields of a selection set, with the fragments
+// expanded and the @skip and @include directives applied.
+func (e *executor) collectFields(selections []Selection, fields []*Field) []*Field {
+	for _, sel := range selections {
+		switch sel := sel.(type) {
+		case *Field:
+			if e.included(sel.Directives) {
+				fields = append(fields, sel)
+			}
+		case *FragmentSpread:
+			if e.included(sel.Directives) {
+				fields = e.collectFields(e.doc.Fragments[sel.Name].SelectionSet, fields)
+			}
+		case *InlineFragment:
+			if e.included(sel.Directives) {
+				fields = e.collectFields(sel.SelectionSet, fields)
+			}
+		}
+	}
+	return fields
+}
+
+func (e *executor) included(directives []*Directive) bool {
+	for _, d := range directives {
+		cond, _ := literal(d.Arguments["if"], e.variables).(bool)
+		switch d.Name {
+		case "skip":
+			if cond {
+				return false
+			}
+		case "include":
+			if !cond {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (e *executor) executeSelectionSet(obj *Object, source interface{}, selections []Selection, path []interface{}) *OrderedMap {
+	result := newOrderedMap()
+	for _, field := range e.collectFields(selections, nil) {
+		key := field.ResponseKey()
+		fieldPath := append(append([]interface{}{}, path...), key)
+		if field.Name == "__typename" {
+			result.set(key, obj.Name)
+			continue
+		}
+		def := obj.Fields[field.Name]
+		value, err := e.resolve(def, source, field)
+		if err != nil {
+			e.errors = append(e.errors, &Error{Message: err.Error(), Path: fieldPath})
+			result.set(key, nil)
+			continue
+		}
+		if existing, ok := result.values[key].(*OrderedMap); ok {
+			// The same field selected twice: the sub-fields are merged
+			if child, ok := e.complete(def.Type, value, field, fieldPath).(*OrderedMap); ok {
+				for _, k := range child.keys {
+					existing.set(k, child.values[k])
+				}
+			}
+			continue
+		}
+		result.set(key, e.complete(def.Type, value, field, fieldPath))
+	}
+	return result
+}
+
+func (e *executor) resolve(def *FieldDef, source interface{}, field *Field) (interface{}, error) {
+	args := make(map[string]interface{}, len(field.Arguments))
+	for name, value := range field.Arguments {
+		if v := literal(value, e.variables); v != nil {
+			args[name] = v
+		}
+	}
+	for name, arg := range def.Args {
+		value, ok := args[name]
+		if !ok {
+			if arg.Required {
+				return nil, fmt.Errorf("Argument %q is required", name)
+			}
+			continue
+		}
+		converted, err := coerceArgument(arg.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("Argument %q: %s", name, err)
+		}
+		args[name] = converted
+	}
+	if def.Resolve == nil {
+		if m, ok := source.(map[string]interface{}); ok {
+			return m[field.Name], nil
+		}
+		return nil, nil
+	}
+	return def.Resolve(&ResolveParams{
+		Context: e.ctx,
+		Source:  source,
+		Args:    args,
+		Field:   field,
+	})
+}
+
+func coerceArgument(t Scalar, value interface{}) (interface{}, error) {
+	switch t {
+	case String:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case Int:
+		switch n := value.(type) {
+		case int64:
+			return int(n), nil
+		case float64: // from the JSON variables
+			if n == float64(int(n)) {
+				return int(n), nil
+			}
+		}
+	case Float:
+		switch n := value.(type) {
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case Boolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	case JSON:
+		return value, nil
+	}
+	return nil, fmt.Errorf("expected a value of type %s", t)
+}
+
+// complete converts the value of a field to the JSON of the response, with
+// the selection set of the field for the objects.
+func (e *executor) complete(t Type, value interface{}, field *Field, path []interface{}) interface{} {
+	if isNil(value) {
+		return nil
+	}
+	switch t := t.(type) {
+	case *Object:
+		return e.executeSelectionSet(t, value, field.SelectionSet, path)
+	case *List:
+		rv := reflect.ValueOf(value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.errors = append(e.errors, &Error{Message: "Expected a list", Path: path})
+			return nil
+		}
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			itemPath := append(append([]interface{}{}, path...), i)
+			list[i] = e.complete(t.Of, rv.Index(i).Interface(), field, itemPath)
+		}
+		return list
+	default:
+		return value
+	}
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// Describe returns the schema in the GraphQL schema definition language, for
+// the documentation, as the introspection is not supported.
+func (s *Schema) Describe() string {
+	objects := make(map[string]*Object)
+	var walk func(obj *Object)
+	walk = func(obj *Object) {
+		if _, ok := objects[obj.Name]; ok {
+			return
+		}
+		objects[obj.Name] = obj
+		for _, def := range obj.Fields {
+			if child := namedObject(def.Type); child != nil {
+				walk(child)
+			}
+		}
+	}
+	walk(s.Query)
+
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		if name != s.Query.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{s.Query.Name}, names...)
+
+	var sb strings.Builder
+	for i, name := range names {
+		obj := objects[name]
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		if obj.Description != "" {
+			fmt.Fprintf(&sb, "# %s\n", obj.Description)
+		}
+		fmt.Fprintf(&sb, "type %s {\n", obj.Name)
+		fields := make([]string, 0, len(obj.Fields))
+		for field := range obj.Fields {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			def := obj.Fields[field]
+			if def.Description != "" {
+				fmt.Fprintf(&sb, "  # %s\n", def.Description)
+			}
+			fmt.Fprintf(&sb, "  %s%s: %s\n", field, describeArgs(def.Args), def.Type)
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+func describeArgs(args map[string]*Argument) string {
+	if len(args) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + ": " + args[name].Type.String()
+		if args[name].Required {
+			parts[i] += "!"
+		}
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
@@ -0,0 +1,158 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testApp struct {
+	Slug     string
+	Versions []string
+}
+
+var testVersionType = &Object{
+	Name: "Version",
+	Fields: map[string]*FieldDef{
+		"version": {Type: String},
+	},
+}
+
+var testAppType = &Object{
+	Name: "App",
+	Fields: map[string]*FieldDef{
+		"slug": {Type: String, Resolve: func(p *ResolveParams) (interface{}, error) {
+			return p.Source.(*testApp).Slug, nil
+		}},
+		"versions": {
+			Type: &List{Of: testVersionType},
+			Args: map[string]*Argument{"limit": {Type: Int}},
+			Size: 100,
+			Resolve: func(p *ResolveParams) (interface{}, error) {
+				versions := p.Source.(*testApp).Versions
+				if limit, ok := p.Args["limit"].(int); ok && limit < len(versions) {
+					versions = versions[:limit]
+				}
+				list := make([]map[string]interface{}, len(versions))
+				for i, v := range versions {
+					list[i] = map[string]interface{}{"version": v}
+				}
+				return list, nil
+			},
+		},
+		"broken": {Type: String, Resolve: func(p *ResolveParams) (interface{}, error) {
+			return nil, errors.New("broken field")
+		}},
+	},
+}
+
+var testSchema = &Schema{
+	Query: &Object{
+		Name: "Query",
+		Fields: map[string]*FieldDef{
+			"apps": {
+				Type: &List{Of: testAppType},
+				Args: map[string]*Argument{"limit": {Type: Int}},
+				Size: 100,
+				Resolve: func(p *ResolveParams) (interface{}, error) {
+					return []*testApp{{Slug: "drive", Versions: []string{"1.0.0"}}}, nil
+				},
+			},
+			"app": {
+				Type: testAppType,
+				Args: map[string]*Argument{"slug": {Type: String, Required: true}},
+				Resolve: func(p *ResolveParams) (interface{}, error) {
+					if p.Args["slug"] != "drive" {
+						return nil, nil
+					}
+					return &testApp{Slug: "drive", Versions: []string{"1.0.0", "1.1.0", "1.2.0"}}, nil
+				},
+			},
+		},
+	},
+}
+
+func execute(t *testing.T, req *Request) (string, []*Error) {
+	res := testSchema.Execute(context.Background(), req)
+	if res.Data == nil {
+		return "", res.Errors
+	}
+	data, err := json.Marshal(res.Data)
+	require.NoError(t, err)
+	return string(data), res.Errors
+}
+
+func TestExecute(t *testing.T) {
+	data, errs := execute(t, &Request{
+		Query: `query ($n: Int) {
+			app(slug: "drive") { __typename slug all: versions { version } last: versions(limit: $n) { version } }
+			missing: app(slug: "photos") { slug }
+		}`,
+		Variables: map[string]interface{}{"n": float64(1)},
+	})
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"app":{"__typename":"App","slug":"drive","all":[{"version":"1.0.0"},{"version":"1.1.0"},{"version":"1.2.0"}],"last":[{"version":"1.0.0"}]},"missing":null}`, data)
+}
+
+func TestExecuteFragmentsAndDirectives(t *testing.T) {
+	data, errs := execute(t, &Request{
+		Query: `query ($full: Boolean!) {
+			app(slug: "drive") { ...Fields versions @skip(if: $full) { version } }
+		}
+		fragment Fields on App { slug versions(limit: 1) @include(if: $full) { version } }`,
+		Variables: map[string]interface{}{"full": true},
+	})
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"app":{"slug":"drive","versions":[{"version":"1.0.0"}]}}`, data)
+}
+
+func TestExecuteErrors(t *testing.T) {
+	data, errs := execute(t, &Request{Query: `{ app(slug: "drive") { slug broken } }`})
+	assert.Equal(t, `{"app":{"slug":"drive","broken":null}}`, data)
+	require.Len(t, errs, 1)
+	assert.Equal(t, "broken field", errs[0].Message)
+	assert.Equal(t, []interface{}{"app", "broken"}, errs[0].Path)
+
+	for _, query := range []string{
+		`{ app(slug: "drive") { unknown } }`,
+		`{ app { slug } }`,
+		`{ app(slug: "drive", foo: 1) { slug } }`,
+		`{ app(slug: "drive") }`,
+		`{ app(slug: "drive") { slug { version } } }`,
+		`{ app(slug: "drive") { ...Loop } } fragment Loop on App { ...Loop }`,
+		`query ($slug: String!) { app(slug: $slug) { slug } }`,
+	} {
+		data, errs := execute(t, &Request{Query: query})
+		assert.Empty(t, data, query)
+		assert.Len(t, errs, 1, query)
+	}
+}
+
+func TestExecuteCost(t *testing.T) {
+	// 1 + 100 * (1 + 1 + 100 * 1) = 10201
+	_, errs := execute(t, &Request{Query: `{ apps { slug versions { version } } }`})
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Message, "too expensive")
+
+	// The limits are taken into account, with the variables
+	data, errs := execute(t, &Request{
+		Query:     `query ($n: Int) { apps(limit: $n) { slug versions { version } } }`,
+		Variables: map[string]interface{}{"n": float64(10)},
+	})
+	assert.Empty(t, errs)
+	assert.Equal(t, `{"apps":[{"slug":"drive","versions":[{"version":"1.0.0"}]}]}`, data)
+
+	// And the fragments
+	_, errs = execute(t, &Request{
+		Query: `{ apps { ...Fields } } fragment Fields on App { versions { version } }`,
+	})
+	require.Len(t, errs, 1)
+
+	// The costs of the fields are summed
+	_, errs = execute(t, &Request{Query: `{ apps { versions { version } } a: apps { versions { version } } }`})
+	require.Len(t, errs, 1)
+}
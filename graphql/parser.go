@@ -0,0 +1,536 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document is a parsed GraphQL request, with its operations and fragments.
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+// Operation is a query of a document. The mutations and the subscriptions are
+// not supported.
+type Operation struct {
+	Name         string
+	Variables    []*VariableDefinition
+	SelectionSet []Selection
+}
+
+// VariableDefinition is a variable of an operation, with its default value.
+type VariableDefinition struct {
+	Name     string
+	Type     string
+	Default  Value
+	Required bool
+}
+
+// Fragment is a named set of fields, for a type.
+type Fragment struct {
+	Name         string
+	On           string
+	SelectionSet []Selection
+}
+
+// Selection is a Field, a FragmentSpread or an InlineFragment.
+type Selection interface{}
+
+// Field is a field to resolve, with its arguments and its sub-fields.
+type Field struct {
+	Alias        string
+	Name         string
+	Arguments    map[string]Value
+	Directives   []*Directive
+	SelectionSet []Selection
+}
+
+// ResponseKey is the key of the field in the response: its alias, or its
+// name.
+func (f *Field) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// FragmentSpread includes a named fragment.
+type FragmentSpread struct {
+	Name       string
+	Directives []*Directive
+}
+
+// InlineFragment includes a set of fields, for a type if On is not empty.
+type InlineFragment struct {
+	On           string
+	Directives   []*Directive
+	SelectionSet []Selection
+}
+
+// Directive is a directive on a selection, like @include(if: $flag).
+type Directive struct {
+	Name      string
+	Arguments map[string]Value
+}
+
+// Value is a literal value of the request: a Variable, nil, a bool, an int64,
+// a float64, a string, an Enum, a []Value or a map[string]Value.
+type Value interface{}
+
+// Variable is a reference to a variable of the operation.
+type Variable string
+
+// Enum is an enum value, like STABLE.
+type Enum string
+
+// SyntaxError is returned when a request can't be parsed.
+type SyntaxError struct {
+	Message string
+	Line    int
+	Column  int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at %d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+type parser struct {
+	source string
+	pos    int
+	tok    token
+}
+
+// Parse parses a GraphQL request.
+func Parse(source string) (doc *Document, err error) {
+	p := &parser{source: source}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(*SyntaxError); ok {
+				doc, err = nil, e
+				return
+			}
+			panic(r)
+		}
+	}()
+	p.next()
+	doc = &Document{Fragments: make(map[string]*Fragment)}
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunctuator, "{"):
+			doc.Operations = append(doc.Operations, &Operation{SelectionSet: p.parseSelectionSet()})
+		case p.peek(tokenName, "query"):
+			doc.Operations = append(doc.Operations, p.parseOperation())
+		case p.peek(tokenName, "fragment"):
+			f := p.parseFragment()
+			if _, ok := doc.Fragments[f.Name]; ok {
+				p.fail("There can be only one fragment named %q", f.Name)
+			}
+			doc.Fragments[f.Name] = f
+		case p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			p.fail("Only the queries are supported")
+		default:
+			p.unexpected()
+		}
+	}
+	if len(doc.Operations) == 0 {
+		p.fail("The document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	line, col := 1, 1
+	for _, r := range p.source[:p.tok.pos] {
+		if r == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	panic(&SyntaxError{Message: fmt.Sprintf(format, args...), Line: line, Column: col})
+}
+
+func (p *parser) unexpected() {
+	if p.tok.kind == tokenEOF {
+		p.fail("Unexpected end of the document")
+	}
+	p.fail("Unexpected %q", p.tok.value)
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) skip(kind tokenKind, value string) bool {
+	if p.peek(kind, value) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(value string) {
+	if !p.skip(tokenPunctuator, value) {
+		p.unexpected()
+	}
+}
+
+func (p *parser) expectName() string {
+	if p.tok.kind != tokenName {
+		p.unexpected()
+	}
+	name := p.tok.value
+	p.next()
+	return name
+}
+
+func (p *parser) parseOperation() *Operation {
+	p.next() // query
+	op := &Operation{}
+	if p.tok.kind == tokenName {
+		op.Name = p.expectName()
+	}
+	if p.skip(tokenPunctuator, "(") {
+		for !p.skip(tokenPunctuator, ")") {
+			p.expect("$")
+			def := &VariableDefinition{Name: p.expectName()}
+			p.expect(":")
+			def.Type, def.Required = p.parseType()
+			if p.skip(tokenPunctuator, "=") {
+				def.Default = p.parseValue(true)
+			}
+			op.Variables = append(op.Variables, def)
+		}
+	}
+	p.parseDirectives()
+	op.SelectionSet = p.parseSelectionSet()
+	return op
+}
+
+// parseType parses the type of a variable, like [String!]!, and returns it
+// as a string, with true if the variable is required.
+func (p *parser) parseType() (string, bool) {
+	var typ string
+	if p.skip(tokenPunctuator, "[") {
+		inner, _ := p.parseType()
+		p.expect("]")
+		typ = "[" + inner + "]"
+	} else {
+		typ = p.expectName()
+	}
+	if p.skip(tokenPunctuator, "!") {
+		return typ + "!", true
+	}
+	return typ, false
+}
+
+func (p *parser) parseFragment() *Fragment {
+	p.next() // fragment
+	f := &Fragment{Name: p.expectName()}
+	if f.Name == "on" {
+		p.fail("A fragment can't be named on")
+	}
+	if !p.skip(tokenName, "on") {
+		p.unexpected()
+	}
+	f.On = p.expectName()
+	p.parseDirectives()
+	f.SelectionSet = p.parseSelectionSet()
+	return f
+}
+
+func (p *parser) parseSelectionSet() []Selection {
+	p.expect("{")
+	var selections []Selection
+	for !p.skip(tokenPunctuator, "}") {
+		selections = append(selections, p.parseSelection())
+	}
+	if len(selections) == 0 {
+		p.fail("A selection set can't be empty")
+	}
+	return selections
+}
+
+func (p *parser) parseSelection() Selection {
+	if p.skip(tokenPunctuator, "...") {
+		if p.tok.kind == tokenName && p.tok.value != "on" {
+			return &FragmentSpread{Name: p.expectName(), Directives: p.parseDirectives()}
+		}
+		inline := &InlineFragment{}
+		if p.skip(tokenName, "on") {
+			inline.On = p.expectName()
+		}
+		inline.Directives = p.parseDirectives()
+		inline.SelectionSet = p.parseSelectionSet()
+		return inline
+	}
+
+	field := &Field{Name: p.expectName()}
+	if p.skip(tokenPunctuator, ":") {
+		field.Alias = field.Name
+		field.Name = p.expectName()
+	}
+	field.Arguments = p.parseArguments()
+	field.Directives = p.parseDirectives()
+	if p.peek(tokenPunctuator, "{") {
+		field.SelectionSet = p.parseSelectionSet()
+	}
+	return field
+}
+
+func (p *parser) parseArguments() map[string]Value {
+	args := make(map[string]Value)
+	if !p.skip(tokenPunctuator, "(") {
+		return args
+	}
+	for !p.skip(tokenPunctuator, ")") {
+		name := p.expectName()
+		p.expect(":")
+		if _, ok := args[name]; ok {
+			p.fail("There can be only one argument named %q", name)
+		}
+		args[name] = p.parseValue(false)
+	}
+	return args
+}
+
+func (p *parser) parseDirectives() []*Directive {
+	var directives []*Directive
+	for p.skip(tokenPunctuator, "@") {
+		directives = append(directives, &Directive{
+			Name:      p.expectName(),
+			Arguments: p.parseArguments(),
+		})
+	}
+	return directives
+}
+
+func (p *parser) parseValue(constant bool) Value {
+	tok := p.tok
+	switch tok.kind {
+	case tokenPunctuator:
+		switch tok.value {
+		case "$":
+			if constant {
+				p.fail("A default value can't be a variable")
+			}
+			p.next()
+			return Variable(p.expectName())
+		case "[":
+			p.next()
+			list := make([]Value, 0)
+			for !p.skip(tokenPunctuator, "]") {
+				list = append(list, p.parseValue(constant))
+			}
+			return list
+		case "{":
+			p.next()
+			obj := make(map[string]Value)
+			for !p.skip(tokenPunctuator, "}") {
+				name := p.expectName()
+				p.expect(":")
+				obj[name] = p.parseValue(constant)
+			}
+			return obj
+		}
+	case tokenInt:
+		p.next()
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			p.fail("Invalid integer %s", tok.value)
+		}
+		return n
+	case tokenFloat:
+		p.next()
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			p.fail("Invalid float %s", tok.value)
+		}
+		return f
+	case tokenString:
+		p.next()
+		return tok.value
+	case tokenName:
+		p.next()
+		switch tok.value {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		default:
+			return Enum(tok.value)
+		}
+	}
+	p.unexpected()
+	return nil
+}
+
+// next reads the next token of the source.
+func (p *parser) next() {
+	src := p.source
+	// Ignored tokens: white spaces, line terminators, commas and comments
+	for p.pos < len(src) {
+		c := src[p.pos]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.pos++
+		} else if c == '#' {
+			for p.pos < len(src) && src[p.pos] != '\n' && src[p.pos] != '\r' {
+				p.pos++
+			}
+		} else if strings.HasPrefix(src[p.pos:], "\ufeff") {
+			// Unicode BOM
+			p.pos += len("\ufeff")
+		} else {
+			break
+		}
+	}
+	start := p.pos
+	p.tok = token{pos: start}
+	if p.pos >= len(src) {
+		p.tok.kind = tokenEOF
+		return
+	}
+
+	c := src[p.pos]
+	switch {
+	case strings.HasPrefix(src[p.pos:], "..."):
+		p.pos += 3
+		p.tok.kind, p.tok.value = tokenPunctuator, "..."
+	case strings.IndexByte("!$():=@[]{}|&", c) >= 0:
+		p.pos++
+		p.tok.kind, p.tok.value = tokenPunctuator, string(c)
+	case c == '_' || isLetter(c):
+		for p.pos < len(src) && (src[p.pos] == '_' || isLetter(src[p.pos]) || isDigit(src[p.pos])) {
+			p.pos++
+		}
+		p.tok.kind, p.tok.value = tokenName, src[start:p.pos]
+	case c == '-' || isDigit(c):
+		p.readNumber()
+	case c == '"':
+		p.readString()
+	default:
+		r, _ := utf8.DecodeRuneInString(src[p.pos:])
+		p.fail("Unexpected character %q", r)
+	}
+}
+
+func (p *parser) readNumber() {
+	src := p.source
+	start := p.pos
+	kind := tokenInt
+	if src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() {
+		begin := p.pos
+		for p.pos < len(src) && isDigit(src[p.pos]) {
+			p.pos++
+		}
+		if p.pos == begin {
+			p.tok.pos = p.pos
+			p.fail("Invalid number")
+		}
+	}
+	digits()
+	if p.pos < len(src) && src[p.pos] == '.' {
+		kind = tokenFloat
+		p.pos++
+		digits()
+	}
+	if p.pos < len(src) && (src[p.pos] == 'e' || src[p.pos] == 'E') {
+		kind = tokenFloat
+		p.pos++
+		if p.pos < len(src) && (src[p.pos] == '+' || src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+	p.tok.kind, p.tok.value = kind, src[start:p.pos]
+}
+
+func (p *parser) readString() {
+	src := p.source
+	if strings.HasPrefix(src[p.pos:], `"""`) {
+		p.fail("The block strings are not supported")
+	}
+	p.pos++ // opening quote
+	var sb strings.Builder
+	for {
+		if p.pos >= len(src) || src[p.pos] == '\n' || src[p.pos] == '\r' {
+			p.fail("Unterminated string")
+		}
+		c := src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(src) {
+			p.fail("Unterminated string")
+		}
+		esc := src[p.pos+1]
+		p.pos += 2
+		switch esc {
+		case '"', '\\', '/':
+			sb.WriteByte(esc)
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(src) {
+				p.fail("Invalid unicode escape")
+			}
+			code, err := strconv.ParseUint(src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				p.fail("Invalid unicode escape")
+			}
+			sb.WriteRune(rune(code))
+			p.pos += 4
+		default:
+			p.fail("Invalid escape \\%c", esc)
+		}
+	}
+	p.tok.kind, p.tok.value = tokenString, sb.String()
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,72 @@
+package graphql
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseShorthand(t *testing.T) {
+	doc, err := Parse(`{ apps(limit: 2, type: "webapp") { slug, latest: latestVersion { version } } }`)
+	require.NoError(t, err)
+	require.Len(t, doc.Operations, 1)
+	op := doc.Operations[0]
+	require.Len(t, op.SelectionSet, 1)
+	apps := op.SelectionSet[0].(*Field)
+	assert.Equal(t, "apps", apps.Name)
+	assert.Equal(t, int64(2), apps.Arguments["limit"])
+	assert.Equal(t, "webapp", apps.Arguments["type"])
+	require.Len(t, apps.SelectionSet, 2)
+	latest := apps.SelectionSet[1].(*Field)
+	assert.Equal(t, "latestVersion", latest.Name)
+	assert.Equal(t, "latest", latest.ResponseKey())
+}
+
+func TestParseOperation(t *testing.T) {
+	doc, err := Parse(`
+# The store home page
+query Home($limit: Int = 10, $slug: String!) {
+  app(slug: $slug) { ...AppFields @include(if: true) }
+  apps(limit: $limit) { apps { ... on App { slug } } }
+}
+
+fragment AppFields on App { slug name }
+`)
+	require.NoError(t, err)
+	op := doc.Operations[0]
+	assert.Equal(t, "Home", op.Name)
+	require.Len(t, op.Variables, 2)
+	assert.Equal(t, "limit", op.Variables[0].Name)
+	assert.Equal(t, int64(10), op.Variables[0].Default)
+	assert.False(t, op.Variables[0].Required)
+	assert.True(t, op.Variables[1].Required)
+
+	app := op.SelectionSet[0].(*Field)
+	assert.Equal(t, Variable("slug"), app.Arguments["slug"])
+	spread := app.SelectionSet[0].(*FragmentSpread)
+	assert.Equal(t, "AppFields", spread.Name)
+	require.Len(t, spread.Directives, 1)
+	assert.Equal(t, "include", spread.Directives[0].Name)
+
+	fragment := doc.Fragments["AppFields"]
+	require.NotNil(t, fragment)
+	assert.Equal(t, "App", fragment.On)
+	assert.Len(t, fragment.SelectionSet, 2)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, source := range []string{
+		``,
+		`{ apps `,
+		`mutation { deleteApp(slug: "drive") }`,
+		`{ app(slug: "drive) { slug } }`,
+		`{ app(slug: ) { slug } }`,
+	} {
+		_, err := Parse(source)
+		assert.Error(t, err, source)
+		if err != nil {
+			assert.IsType(t, &SyntaxError{}, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Package imaging resizes and converts the icons of the applications, as the
+// store frontends display them at a small size and don't need to download the
+// full-size images. It only relies on the decoders and encoders of the
+// standard library.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"  // for decoding the gif icons
+	_ "image/jpeg" // for decoding the jpeg icons
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Limits of the size of the thumbnails, in pixels.
+const (
+	MinSize = 16
+	MaxSize = 512
+)
+
+// maxPixels is the maximal number of pixels of an image that can be resized,
+// to avoid decoding huge images in memory.
+const maxPixels = 4096 * 4096
+
+var (
+	// ErrInvalidSize is returned when the size of a thumbnail is out of the
+	// limits.
+	ErrInvalidSize = errors.New("The size must be between 16 and 512 pixels")
+	// ErrUnsupportedFormat is returned when the image can't be decoded or
+	// encoded in the requested format.
+	ErrUnsupportedFormat = errors.New("The image format is not supported")
+	// ErrImageTooLarge is returned when the image has too many pixels to be
+	// resized.
+	ErrImageTooLarge = errors.New("The image is too large to be resized")
+)
+
+// Formats are the content types in which the images can be encoded. WebP is
+// not in the list, as there is no encoder for it in the standard library.
+var Formats = []string{"image/png"}
+
+// Extensions are the file extensions for the formats.
+var Extensions = map[string]string{
+	"image/png": "png",
+}
+
+// CanDecode returns true if an image with the given content type can be
+// resized. It is not the case for SVG images, but they can be displayed at
+// any size by the browsers.
+func CanDecode(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// CheckSize returns an error if the size is out of the limits.
+func CheckSize(size int) error {
+	if size < MinSize || size > MaxSize {
+		return ErrInvalidSize
+	}
+	return nil
+}
+
+// Thumbnail decodes an image and resizes it to fit in a square of the given
+// size, while keeping its aspect ratio. The images smaller than the square
+// are not enlarged, and the image is only decoded if size is 0.
+func Thumbnail(content []byte, size int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+	if config.Width*config.Height > maxPixels {
+		return nil, ErrImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, ErrUnsupportedFormat
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if size == 0 || (w <= size && h <= size) {
+		return src, nil
+	}
+	if w >= h {
+		h = max(1, int(math.Round(float64(h)*float64(size)/float64(w))))
+		w = size
+	} else {
+		w = max(1, int(math.Round(float64(w)*float64(size)/float64(h))))
+		h = size
+	}
+	return Resize(src, w, h), nil
+}
+
+// Resize scales down an image to the given dimensions. Each pixel of the
+// result is the average of the source pixels it covers, weighted by their
+// covered area, which gives sharp results for the downscaling of icons. The
+// average is made on the premultiplied colors, to avoid dark halos around
+// the transparent areas.
+func Resize(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xs := weights(bounds.Dx(), width)
+	ys := weights(bounds.Dy(), height)
+	for y, wy := range ys {
+		for x, wx := range xs {
+			var r, g, b, a, total float64
+			for _, cy := range wy {
+				for _, cx := range wx {
+					weight := cx.weight * cy.weight
+					i := rgba.PixOffset(cx.index, cy.index)
+					r += float64(rgba.Pix[i]) * weight
+					g += float64(rgba.Pix[i+1]) * weight
+					b += float64(rgba.Pix[i+2]) * weight
+					a += float64(rgba.Pix[i+3]) * weight
+					total += weight
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = clamp(r / total)
+			dst.Pix[i+1] = clamp(g / total)
+			dst.Pix[i+2] = clamp(b / total)
+			dst.Pix[i+3] = clamp(a / total)
+		}
+	}
+	return dst
+}
+
+// contribution is the weight of a source pixel (on one axis) in a pixel of
+// the result.
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// weights returns, for each pixel of the result on one axis, the source
+// pixels that it covers.
+func weights(srcLen, dstLen int) [][]contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	list := make([][]contribution, dstLen)
+	for i := range list {
+		start := float64(i) * scale
+		end := start + scale
+		for j := int(start); j < srcLen && float64(j) < end; j++ {
+			weight := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if weight > 0 {
+				list[i] = append(list[i], contribution{index: j, weight: weight})
+			}
+		}
+	}
+	return list
+}
+
+func clamp(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Encode writes the image in the given format.
+func Encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/png":
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		return encoder.Encode(w, img)
+	}
+	return ErrUnsupportedFormat
+}
+
+// Negotiate returns the content type preferred by the client among the
+// candidates, according to the Accept header. When several candidates have
+// the same quality, the first one wins. It returns an empty string if none of
+// the candidates is acceptable.
+func Negotiate(accept string, candidates []string) string {
+	if strings.TrimSpace(accept) == "" {
+		if len(candidates) == 0 {
+			return ""
+		}
+		return candidates[0]
+	}
+
+	best, bestQuality := "", 0.0
+	for _, candidate := range candidates {
+		if q := quality(accept, candidate); q > bestQuality {
+			best, bestQuality = candidate, q
+		}
+	}
+	return best
+}
+
+// quality returns the quality of a content type in an Accept header. The most
+// specific media range matching the content type is used.
+func quality(accept, contentType string) float64 {
+	q, specificity := 0.0, -1
+	typ := strings.SplitN(contentType, "/", 2)[0]
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		var s int
+		switch mediaRange {
+		case contentType:
+			s = 2
+		case typ + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s < specificity {
+			continue
+		}
+		value := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && strings.TrimSpace(kv[0]) == "q" {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64); err == nil {
+					value = f
+				}
+			}
+		}
+		q, specificity = value, s
+	}
+	return q
+}
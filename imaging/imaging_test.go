@@ -0,0 +1,70 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encodedSquare(t *testing.T, width, height int, c color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestThumbnail(t *testing.T) {
+	content := encodedSquare(t, 200, 100, color.NRGBA{R: 200, G: 100, B: 50, A: 255})
+	img, err := Thumbnail(content, 64)
+	require.NoError(t, err)
+	assert.Equal(t, 64, img.Bounds().Dx())
+	assert.Equal(t, 32, img.Bounds().Dy())
+	r, g, b, a := img.At(10, 10).RGBA()
+	assert.Equal(t, []uint32{200, 100, 50, 255}, []uint32{r >> 8, g >> 8, b >> 8, a >> 8})
+
+	// Small images are not enlarged
+	content = encodedSquare(t, 20, 20, color.White)
+	img, err = Thumbnail(content, 64)
+	require.NoError(t, err)
+	assert.Equal(t, 20, img.Bounds().Dx())
+
+	_, err = Thumbnail([]byte("<svg></svg>"), 64)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
+
+func TestResizeAveragesPixels(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	src.Set(1, 0, color.NRGBA{A: 0})
+	dst := Resize(src, 1, 1)
+	// The transparent pixel doesn't darken the red one
+	c := color.NRGBAModel.Convert(dst.At(0, 0)).(color.NRGBA)
+	assert.Equal(t, uint8(255), c.R)
+	assert.Equal(t, uint8(128), c.A)
+}
+
+func TestCheckSize(t *testing.T) {
+	assert.NoError(t, CheckSize(64))
+	assert.Equal(t, ErrInvalidSize, CheckSize(8))
+	assert.Equal(t, ErrInvalidSize, CheckSize(1024))
+}
+
+func TestNegotiate(t *testing.T) {
+	candidates := []string{"image/jpeg", "image/png"}
+	assert.Equal(t, "image/jpeg", Negotiate("", candidates))
+	assert.Equal(t, "image/jpeg", Negotiate("*/*", candidates))
+	assert.Equal(t, "image/png", Negotiate("image/webp,image/png,*/*;q=0.8", candidates))
+	assert.Equal(t, "image/png", Negotiate("image/png;q=0.9, image/*;q=0.5", candidates))
+	assert.Equal(t, "", Negotiate("image/webp", candidates))
+	assert.Equal(t, "", Negotiate("image/*;q=0, text/html", candidates))
+}
@@ -0,0 +1,99 @@
+// Package ipfs is a minimal client for the HTTP API of an IPFS node. It is
+// used to pin the tarballs of the stable versions, so that the public catalog
+// can be mirrored by the community.
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client can add files to an IPFS node.
+type Client struct {
+	apiURL string
+	http   *http.Client
+}
+
+var client *Client
+
+// Configure enables the pinning of the tarballs on the IPFS node with the
+// given API URL (http://localhost:5001 for example). An empty URL disables it.
+func Configure(apiURL string, timeout time.Duration) {
+	if apiURL == "" {
+		client = nil
+		return
+	}
+	client = NewClient(apiURL, timeout)
+}
+
+// GetClient returns the configured client, or nil if IPFS is disabled.
+func GetClient() *Client {
+	return client
+}
+
+// NewClient returns a client for the IPFS node with the given API URL.
+func NewClient(apiURL string, timeout time.Duration) *Client {
+	return &Client{
+		apiURL: strings.TrimSuffix(apiURL, "/"),
+		http:   &http.Client{Timeout: timeout},
+	}
+}
+
+// URL returns the ipfs:// URL for the given CID.
+func URL(cid string) string {
+	return "ipfs://" + cid
+}
+
+// Add uploads the content to the IPFS node, pins it, and returns its CID.
+func (c *Client) Add(name string, content io.Reader) (string, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, content)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	params := url.Values{}
+	params.Set("pin", "true")
+	params.Set("cid-version", "1")
+	u := c.apiURL + "/api/v0/add?" + params.Encode()
+	req, err := http.NewRequest(http.MethodPost, u, pr)
+	if err != nil {
+		pr.Close()
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err := c.http.Do(req)
+	if err != nil {
+		pr.Close()
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IPFS node responded with status %d", res.StatusCode)
+	}
+
+	var added struct {
+		Name string `json:"Name"`
+		Hash string `json:"Hash"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&added); err != nil {
+		return "", err
+	}
+	if added.Hash == "" {
+		return "", fmt.Errorf("IPFS node did not return a CID")
+	}
+	return added.Hash, nil
+}
@@ -0,0 +1,44 @@
+package ipfs
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdd(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v0/add", r.URL.Path)
+		assert.Equal(t, "true", r.URL.Query().Get("pin"))
+		f, header, err := r.FormFile("file")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "drive-1.0.0.tar.gz", header.Filename)
+			content, _ := ioutil.ReadAll(f)
+			assert.Equal(t, "tarball content", string(content))
+		}
+		_, _ = w.Write([]byte(`{"Name":"drive-1.0.0.tar.gz","Hash":"bafybeigdyrzt","Size":"23"}`))
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL+"/", time.Second)
+	cid, err := c.Add("drive-1.0.0.tar.gz", strings.NewReader("tarball content"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bafybeigdyrzt", cid)
+	assert.Equal(t, "ipfs://bafybeigdyrzt", URL(cid))
+}
+
+func TestAddError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	c := NewClient(ts.URL, time.Second)
+	_, err := c.Add("drive-1.0.0.tar.gz", strings.NewReader("tarball content"))
+	assert.Error(t, err)
+}
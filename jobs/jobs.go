@@ -0,0 +1,407 @@
+// Package jobs runs the long tasks, like the publication of a version with
+// the download of its tarball, in a pool of workers. The HTTP request returns
+// as soon as the job is queued, and the state of the job can be followed
+// with its identifier.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// States of a job
+const (
+	Pending   = "pending"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+)
+
+// ErrQueueFull is returned when a job can't be queued because the queue has
+// reached its maximal size.
+var ErrQueueFull = errors.New("The queue of jobs is full")
+
+// ErrQueueClosed is returned when a job can't be queued because the server is
+// shutting down.
+var ErrQueueClosed = errors.New("The queue of jobs is closed")
+
+// ErrJobNotFound is returned by the stores for an unknown job.
+var ErrJobNotFound = errors.New("Job not found")
+
+// ErrJobInterrupted is the error of the jobs left pending or running by an
+// instance of the registry that has been stopped.
+var ErrJobInterrupted = errors.New("The job has been interrupted")
+
+// cleanupInterval is the delay between two cleanups of the finished jobs.
+const cleanupInterval = time.Hour
+
+// progressInterval is the minimal delay between two saves of the progress of
+// a running job in the store.
+const progressInterval = 2 * time.Second
+
+// Job is a task executed by the workers.
+type Job struct {
+	ID    string `json:"_id,omitempty"`
+	Rev   string `json:"_rev,omitempty"`
+	Kind  string `json:"kind"`
+	Space string `json:"space"`
+	State string `json:"state"`
+	// Result is set when the job has succeeded, and Error and Details when
+	// it has failed.
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+	// Progress is reported by the job while it runs, like the bytes of the
+	// tarball already downloaded for a publication.
+	Progress   *Progress  `json:"progress,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Progress tells how much of its work a job has done.
+type Progress struct {
+	Done int64 `json:"done"`
+	// Total is -1 if it is unknown.
+	Total int64 `json:"total"`
+}
+
+// Func is the work of a job. It returns the result of the job, or an error.
+type Func func(ctx context.Context) (interface{}, error)
+
+// DetailedError can be implemented by the errors returned by the jobs, to
+// give more details than the message (like the violated rules of a
+// manifest).
+type DetailedError interface {
+	error
+	Details() interface{}
+}
+
+// Store keeps the state of the jobs, so that they can be followed from all
+// the instances of the registry.
+type Store interface {
+	Save(job *Job) error
+	Get(id string) (*Job, error)
+	// CreatedBefore returns the jobs created before the given date.
+	CreatedBefore(date time.Time) ([]*Job, error)
+	Delete(job *Job) error
+}
+
+type task struct {
+	job *Job
+	fn  Func
+}
+
+type jobKey struct{}
+
+// running is the job given in the context of its function, to report its
+// progress.
+type running struct {
+	q     *Queue
+	job   *Job
+	saved time.Time
+}
+
+// IDFromContext returns the identifier of the job executed with the given
+// context, or an empty string outside of the jobs.
+func IDFromContext(ctx context.Context) string {
+	if r, ok := ctx.Value(jobKey{}).(*running); ok {
+		return r.job.ID
+	}
+	return ""
+}
+
+// ReportProgress updates the progress of the job executed with the given
+// context, and does nothing outside of the jobs. It must be called from the
+// function of the job, not from another goroutine. The progress is saved in
+// the store at most every progressInterval, so that it can be followed from
+// all the instances without writing the job on each call.
+func ReportProgress(ctx context.Context, done, total int64) {
+	r, ok := ctx.Value(jobKey{}).(*running)
+	if !ok {
+		return
+	}
+	// The stores may keep the pointer, so a new progress is allocated
+	r.job.Progress = &Progress{Done: done, Total: total}
+	if done != total && time.Since(r.saved) < progressInterval {
+		return
+	}
+	r.saved = time.Now()
+	if err := r.q.store.Save(r.job); err != nil {
+		r.q.log(r.job).WithField("error_msg", err).Warn("Cannot save the progress of the job")
+	}
+}
+
+// Queue dispatches the jobs to a pool of workers.
+type Queue struct {
+	store   Store
+	tasks   chan task
+	workers sync.WaitGroup
+
+	// mu protects closed, and the sends on tasks from its closing
+	mu     sync.RWMutex
+	closed bool
+	stop   chan struct{}
+}
+
+var queue *Queue
+
+// NewQueue returns a queue with the given number of workers, that accepts at
+// most size jobs waiting for a worker. The workers are started.
+func NewQueue(store Store, workers, size int) *Queue {
+	q := &Queue{store: store, tasks: make(chan task, size), stop: make(chan struct{})}
+	q.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Configure sets the queue used by Enqueue and Get. A nil queue disables the
+// jobs: the tasks are executed in the HTTP requests.
+func Configure(q *Queue) {
+	queue = q
+}
+
+// Enabled returns true if a queue has been configured.
+func Enabled() bool {
+	return queue != nil
+}
+
+// Enqueue adds a job to the configured queue.
+func Enqueue(kind, spaceName string, fn Func) (*Job, error) {
+	if queue == nil {
+		return nil, errors.New("The jobs are not enabled")
+	}
+	return queue.Enqueue(kind, spaceName, fn)
+}
+
+// Get returns the job with the given identifier from the configured queue.
+func Get(id string) (*Job, error) {
+	if queue == nil {
+		return nil, ErrJobNotFound
+	}
+	return queue.store.Get(id)
+}
+
+// Depth returns the number of jobs waiting for a worker in the configured
+// queue.
+func Depth() int {
+	if queue == nil {
+		return 0
+	}
+	return len(queue.tasks)
+}
+
+// Shutdown stops the configured queue, and waits for its jobs to finish.
+func Shutdown(ctx context.Context) error {
+	if queue == nil {
+		return nil
+	}
+	return queue.Shutdown(ctx)
+}
+
+// Enqueue adds a job to the queue, in the pending state.
+func (q *Queue) Enqueue(kind, spaceName string, fn Func) (*Job, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+	if len(q.tasks) == cap(q.tasks) {
+		return nil, ErrQueueFull
+	}
+	job := &Job{
+		ID:        newJobID(),
+		Kind:      kind,
+		Space:     spaceName,
+		State:     Pending,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := q.store.Save(job); err != nil {
+		return nil, err
+	}
+	// The workers update the job, so the caller gets a copy
+	queued := *job
+	select {
+	case q.tasks <- task{job: job, fn: fn}:
+		return &queued, nil
+	default:
+		q.finish(job, nil, ErrQueueFull)
+		return nil, ErrQueueFull
+	}
+}
+
+// Shutdown stops accepting new jobs, and waits until the workers have
+// finished the running and pending jobs, or the context is done. A
+// publication can be long, as it downloads the tarball, and it would be left
+// half-done if the server was stopped in the middle of it.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Recover marks as failed the jobs that have been left pending or running
+// for more than staleAfter. The function of a job is not kept in the store,
+// so a job from an instance that has been stopped can't be executed again,
+// but the client following it should not wait for it forever. It is called
+// when the registry starts, before any job is queued: the jobs more recent
+// than staleAfter can still be running on the other instances. It returns
+// the number of jobs marked as failed.
+func (q *Queue) Recover(staleAfter time.Duration) (int, error) {
+	jobs, err := q.store.CreatedBefore(time.Now().UTC().Add(-staleAfter))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, job := range jobs {
+		if job.State != Pending && job.State != Running {
+			continue
+		}
+		q.log(job).WithField("state", job.State).Warn("Stale job marked as failed")
+		q.finish(job, nil, ErrJobInterrupted)
+		count++
+	}
+	return count, nil
+}
+
+// Cleanup deletes the finished jobs that are older than ttl, and returns
+// the number of deleted jobs.
+func (q *Queue) Cleanup(ttl time.Duration) (int, error) {
+	limit := time.Now().UTC().Add(-ttl)
+	jobs, err := q.store.CreatedBefore(limit)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, job := range jobs {
+		if job.FinishedAt == nil || job.FinishedAt.After(limit) {
+			continue
+		}
+		if err := q.store.Delete(job); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// StartCleanup deletes the finished jobs older than ttl now, and then
+// every hour, until the queue is shut down.
+func (q *Queue) StartCleanup(ttl time.Duration) {
+	go func() {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := q.Cleanup(ttl); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"nspace":    "jobs",
+					"error_msg": err,
+				}).Error("Cannot clean the finished jobs")
+			} else if n > 0 {
+				logrus.WithFields(logrus.Fields{
+					"nspace": "jobs",
+					"count":  n,
+				}).Info("Finished jobs deleted")
+			}
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (q *Queue) work() {
+	defer q.workers.Done()
+	for t := range q.tasks {
+		q.run(t)
+	}
+}
+
+func (q *Queue) run(t task) {
+	job := t.job
+	now := time.Now().UTC()
+	job.State = Running
+	job.StartedAt = &now
+	if err := q.store.Save(job); err != nil {
+		q.log(job).WithField("error_msg", err).Error("Cannot save the job")
+	}
+
+	var result interface{}
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = errors.New("The job has panicked")
+				q.log(job).WithField("panic", r).Error()
+			}
+		}()
+		ctx := context.WithValue(context.Background(), jobKey{}, &running{q: q, job: job, saved: now})
+		result, err = t.fn(ctx)
+	}()
+	q.finish(job, result, err)
+}
+
+func (q *Queue) finish(job *Job, result interface{}, err error) {
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	if err != nil {
+		job.State = Failed
+		job.Error = err.Error()
+		if coder, ok := err.(interface{ StatusCode() int }); ok {
+			job.StatusCode = coder.StatusCode()
+		}
+		if detailed, ok := err.(DetailedError); ok {
+			job.Details = detailed.Details()
+		}
+	} else {
+		job.State = Succeeded
+		job.Result = result
+	}
+	if err := q.store.Save(job); err != nil {
+		q.log(job).WithField("error_msg", err).Error("Cannot save the job")
+	}
+}
+
+func (q *Queue) log(job *Job) *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{
+		"nspace": "jobs",
+		"job_id": job.ID,
+		"kind":   job.Kind,
+		"space":  job.Space,
+	})
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type violationsError struct{}
+
+func (violationsError) Error() string        { return "Invalid manifest" }
+func (violationsError) StatusCode() int      { return 422 }
+func (violationsError) Details() interface{} { return []string{"name is required"} }
+
+func waitJob(t *testing.T, q *Queue, id string) *Job {
+	for i := 0; i < 100; i++ {
+		job, err := q.store.Get(id)
+		assert.NoError(t, err)
+		if job.State == Succeeded || job.State == Failed {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s is not finished", id)
+	return nil
+}
+
+func TestQueue(t *testing.T) {
+	q := NewQueue(NewMemoryStore(), 2, 10)
+
+	job, err := q.Enqueue("publish", "myspace", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Pending, job.State)
+	assert.Len(t, job.ID, 32)
+	job = waitJob(t, q, job.ID)
+	assert.Equal(t, Succeeded, job.State)
+	assert.Equal(t, "ok", job.Result)
+	assert.NotNil(t, job.StartedAt)
+	assert.NotNil(t, job.FinishedAt)
+
+	job, err = q.Enqueue("publish", "myspace", func(ctx context.Context) (interface{}, error) {
+		return nil, violationsError{}
+	})
+	assert.NoError(t, err)
+	job = waitJob(t, q, job.ID)
+	assert.Equal(t, Failed, job.State)
+	assert.Equal(t, "Invalid manifest", job.Error)
+	assert.Equal(t, 422, job.StatusCode)
+	assert.Equal(t, []string{"name is required"}, job.Details)
+
+	job, err = q.Enqueue("publish", "myspace", func(ctx context.Context) (interface{}, error) {
+		panic(errors.New("boom"))
+	})
+	assert.NoError(t, err)
+	job = waitJob(t, q, job.ID)
+	assert.Equal(t, Failed, job.State)
+
+	_, err = q.store.Get("unknown")
+	assert.Equal(t, ErrJobNotFound, err)
+}
+
+func TestReportProgress(t *testing.T) {
+	q := NewQueue(NewMemoryStore(), 1, 10)
+	release := make(chan struct{})
+	reported := make(chan struct{})
+	job, err := q.Enqueue("publish", "", func(ctx context.Context) (interface{}, error) {
+		assert.NotEmpty(t, IDFromContext(ctx))
+		// The first reports are throttled, but not the last one
+		ReportProgress(ctx, 10, 100)
+		ReportProgress(ctx, 100, 100)
+		close(reported)
+		<-release
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	<-reported
+	running, err := q.store.Get(job.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Running, running.State)
+	assert.Equal(t, &Progress{Done: 100, Total: 100}, running.Progress)
+	close(release)
+	waitJob(t, q, job.ID)
+
+	// Outside of a job, the progress is ignored
+	assert.Empty(t, IDFromContext(context.Background()))
+	ReportProgress(context.Background(), 10, 100)
+}
+
+func TestQueueFull(t *testing.T) {
+	// Without workers, the jobs stay in the queue
+	q := NewQueue(NewMemoryStore(), 0, 1)
+	noop := func(ctx context.Context) (interface{}, error) { return nil, nil }
+	_, err := q.Enqueue("publish", "", noop)
+	assert.NoError(t, err)
+	_, err = q.Enqueue("publish", "", noop)
+	assert.Equal(t, ErrQueueFull, err)
+}
+
+func TestQueueShutdown(t *testing.T) {
+	q := NewQueue(NewMemoryStore(), 1, 10)
+	release := make(chan struct{})
+	running, err := q.Enqueue("publish", "", func(ctx context.Context) (interface{}, error) {
+		<-release
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	pending, err := q.Enqueue("publish", "", func(ctx context.Context) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+
+	// The shutdown waits for the running job
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, q.Shutdown(ctx))
+	_, err = q.Enqueue("publish", "", func(ctx context.Context) (interface{}, error) {
+		return nil, nil
+	})
+	assert.Equal(t, ErrQueueClosed, err)
+
+	// The pending jobs are executed before the workers stop
+	close(release)
+	assert.NoError(t, q.Shutdown(context.Background()))
+	job, err := q.store.Get(running.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Succeeded, job.State)
+	job, err = q.store.Get(pending.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, Succeeded, job.State)
+}
+
+func TestQueueRecover(t *testing.T) {
+	store := NewMemoryStore()
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	finished := old.Add(time.Minute)
+	assert.NoError(t, store.Save(&Job{ID: "stale-pending", State: Pending, CreatedAt: old}))
+	assert.NoError(t, store.Save(&Job{ID: "stale-running", State: Running, CreatedAt: old, StartedAt: &old}))
+	assert.NoError(t, store.Save(&Job{ID: "succeeded", State: Succeeded, CreatedAt: old, FinishedAt: &finished}))
+	assert.NoError(t, store.Save(&Job{ID: "recent", State: Running, CreatedAt: time.Now().UTC()}))
+
+	q := NewQueue(store, 0, 1)
+	n, err := q.Recover(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, id := range []string{"stale-pending", "stale-running"} {
+		job, err := store.Get(id)
+		assert.NoError(t, err)
+		assert.Equal(t, Failed, job.State)
+		assert.Equal(t, ErrJobInterrupted.Error(), job.Error)
+		assert.NotNil(t, job.FinishedAt)
+	}
+	job, err := store.Get("succeeded")
+	assert.NoError(t, err)
+	assert.Equal(t, Succeeded, job.State)
+	job, err = store.Get("recent")
+	assert.NoError(t, err)
+	assert.Equal(t, Running, job.State)
+}
+
+func TestQueueCleanup(t *testing.T) {
+	store := NewMemoryStore()
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	recent := time.Now().UTC()
+	assert.NoError(t, store.Save(&Job{ID: "old-succeeded", State: Succeeded, CreatedAt: old, FinishedAt: &old}))
+	assert.NoError(t, store.Save(&Job{ID: "old-failed", State: Failed, CreatedAt: old, FinishedAt: &old}))
+	assert.NoError(t, store.Save(&Job{ID: "old-running", State: Running, CreatedAt: old}))
+	assert.NoError(t, store.Save(&Job{ID: "finished-recently", State: Succeeded, CreatedAt: old, FinishedAt: &recent}))
+	assert.NoError(t, store.Save(&Job{ID: "recent", State: Succeeded, CreatedAt: recent, FinishedAt: &recent}))
+
+	q := NewQueue(store, 0, 1)
+	n, err := q.Cleanup(24 * time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	for _, id := range []string{"old-succeeded", "old-failed"} {
+		_, err := store.Get(id)
+		assert.Equal(t, ErrJobNotFound, err)
+	}
+	for _, id := range []string{"old-running", "finished-recently", "recent"} {
+		_, err := store.Get(id)
+		assert.NoError(t, err)
+	}
+}
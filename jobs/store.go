@@ -0,0 +1,127 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kivik/kivik/v3"
+)
+
+type memoryStore struct {
+	mu   sync.Mutex
+	jobs map[string]Job
+}
+
+// NewMemoryStore returns a store that keeps the jobs in memory, for a single
+// instance of the registry.
+func NewMemoryStore() Store {
+	return &memoryStore{jobs: make(map[string]Job)}
+}
+
+func (s *memoryStore) Save(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = *job
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return &job, nil
+}
+
+func (s *memoryStore) CreatedBefore(date time.Time) ([]*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := []*Job{}
+	for _, job := range s.jobs {
+		if job.CreatedAt.Before(date) {
+			job := job
+			jobs = append(jobs, &job)
+		}
+	}
+	return jobs, nil
+}
+
+func (s *memoryStore) Delete(job *Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.jobs, job.ID)
+	return nil
+}
+
+type couchStore struct {
+	db *kivik.DB
+}
+
+// NewCouchStore returns a store that keeps the jobs in a CouchDB database.
+func NewCouchStore(db *kivik.DB) Store {
+	return &couchStore{db: db}
+}
+
+func (s *couchStore) Save(job *Job) error {
+	rev, err := s.db.Put(context.Background(), job.ID, job)
+	if err != nil {
+		return err
+	}
+	job.Rev = rev
+	return nil
+}
+
+func (s *couchStore) Get(id string) (*Job, error) {
+	var job Job
+	err := s.db.Get(context.Background(), id).ScanDoc(&job)
+	if kivik.StatusCode(err) == http.StatusNotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *couchStore) CreatedBefore(date time.Time) ([]*Job, error) {
+	// The dates are saved in UTC, with the RFC 3339 format, so they can be
+	// compared as strings
+	rows, err := s.db.Find(context.Background(), map[string]interface{}{
+		"selector": map[string]interface{}{
+			"created_at": map[string]interface{}{
+				"$lt": date.UTC().Format(time.RFC3339Nano),
+			},
+		},
+		"limit": 10000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []*Job{}
+	for rows.Next() {
+		var job Job
+		if err := rows.ScanDoc(&job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, &job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+func (s *couchStore) Delete(job *Job) error {
+	_, err := s.db.Delete(context.Background(), job.ID, job.Rev)
+	switch kivik.StatusCode(err) {
+	case http.StatusNotFound, http.StatusConflict:
+		// Already deleted, or updated, by another instance
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,295 @@
+// Package mango is a small builder for the CouchDB mango queries. The field
+// names and the values are validated before being serialized, so that the
+// parameters coming from the HTTP requests can't change the structure of the
+// query.
+package mango
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Operator is a condition operator of a mango selector.
+type Operator string
+
+// Operators that can be used in a selector.
+const (
+	Eq     Operator = "$eq"
+	Ne     Operator = "$ne"
+	Gt     Operator = "$gt"
+	Gte    Operator = "$gte"
+	Lt     Operator = "$lt"
+	Lte    Operator = "$lte"
+	In     Operator = "$in"
+	Nin    Operator = "$nin"
+	Exists Operator = "$exists"
+)
+
+// MaxInValues is the maximal number of values for the $in and $nin operators.
+const MaxInValues = 1000
+
+var validFieldReg = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z0-9_]+)*$`)
+
+type condition struct {
+	field string
+	op    Operator
+	value interface{}
+}
+
+// Cond is a condition on a field, used for the alternatives of WhereAny.
+type Cond struct {
+	Field string
+	Op    Operator
+	Value interface{}
+}
+
+type sortField struct {
+	field string
+	desc  bool
+}
+
+// Query is a mango query. The methods can be chained, and the first error is
+// returned by Build.
+type Query struct {
+	index  string
+	conds  []condition
+	any    [][]condition
+	fields []string
+	sort   []sortField
+	skip   int
+	limit  int
+	err    error
+}
+
+// New returns a query that will use the given index.
+func New(index string) *Query {
+	return &Query{index: index}
+}
+
+// Where adds a condition on a field to the selector.
+func (q *Query) Where(field string, op Operator, value interface{}) *Query {
+	if q.err != nil {
+		return q
+	}
+	if err := checkField(field); err != nil {
+		q.err = err
+		return q
+	}
+	if err := checkValue(op, value); err != nil {
+		q.err = fmt.Errorf("Invalid value for %q: %w", field, err)
+		return q
+	}
+	q.conds = append(q.conds, condition{field, op, value})
+	return q
+}
+
+// WhereAny adds a disjunction to the selector: a document is selected if it
+// matches all the conditions of at least one of the alternatives. It can be
+// used only once per query.
+func (q *Query) WhereAny(alternatives ...[]Cond) *Query {
+	if q.err != nil {
+		return q
+	}
+	if q.any != nil {
+		q.err = fmt.Errorf("Only one disjunction is allowed")
+		return q
+	}
+	if len(alternatives) == 0 {
+		q.err = fmt.Errorf("A disjunction needs at least one alternative")
+		return q
+	}
+	for _, alternative := range alternatives {
+		conds := make([]condition, 0, len(alternative))
+		for _, c := range alternative {
+			if err := checkField(c.Field); err != nil {
+				q.err = err
+				return q
+			}
+			if err := checkValue(c.Op, c.Value); err != nil {
+				q.err = fmt.Errorf("Invalid value for %q: %w", c.Field, err)
+				return q
+			}
+			conds = append(conds, condition{c.Field, c.Op, c.Value})
+		}
+		q.any = append(q.any, conds)
+	}
+	return q
+}
+
+// Fields restricts the fields of the returned documents.
+func (q *Query) Fields(fields ...string) *Query {
+	if q.err != nil {
+		return q
+	}
+	for _, field := range fields {
+		if err := checkField(field); err != nil {
+			q.err = err
+			return q
+		}
+	}
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+// Sort adds a field to the sort of the query.
+func (q *Query) Sort(field string, desc bool) *Query {
+	if q.err != nil {
+		return q
+	}
+	if err := checkField(field); err != nil {
+		q.err = err
+		return q
+	}
+	q.sort = append(q.sort, sortField{field, desc})
+	return q
+}
+
+// Skip sets the number of documents to skip.
+func (q *Query) Skip(skip int) *Query {
+	if q.err == nil && skip < 0 {
+		q.err = fmt.Errorf("Invalid skip: %d", skip)
+	}
+	q.skip = skip
+	return q
+}
+
+// Limit sets the maximal number of documents to return.
+func (q *Query) Limit(limit int) *Query {
+	if q.err == nil && limit <= 0 {
+		q.err = fmt.Errorf("Invalid limit: %d", limit)
+	}
+	q.limit = limit
+	return q
+}
+
+// Build returns the JSON of the query, to be sent to CouchDB.
+func (q *Query) Build() (json.RawMessage, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	if len(q.conds) == 0 && len(q.any) == 0 {
+		return nil, fmt.Errorf("A selector is required")
+	}
+
+	selector, err := buildSelector(q.conds)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{"selector": selector}
+	if len(q.any) > 0 {
+		full := make(map[string]interface{}, len(selector)+1)
+		for field, ops := range selector {
+			full[field] = ops
+		}
+		alternatives := make([]interface{}, len(q.any))
+		for i, conds := range q.any {
+			if alternatives[i], err = buildSelector(conds); err != nil {
+				return nil, err
+			}
+		}
+		full["$or"] = alternatives
+		doc["selector"] = full
+	}
+	if q.index != "" {
+		doc["use_index"] = q.index
+	}
+	if len(q.fields) > 0 {
+		doc["fields"] = q.fields
+	}
+	if len(q.sort) > 0 {
+		sort := make([]map[string]string, len(q.sort))
+		for i, s := range q.sort {
+			order := "asc"
+			if s.desc {
+				order = "desc"
+			}
+			sort[i] = map[string]string{s.field: order}
+		}
+		doc["sort"] = sort
+	}
+	if q.skip > 0 {
+		doc["skip"] = q.skip
+	}
+	if q.limit > 0 {
+		doc["limit"] = q.limit
+	}
+	return json.Marshal(doc)
+}
+
+func buildSelector(conds []condition) (map[string]map[Operator]interface{}, error) {
+	selector := make(map[string]map[Operator]interface{})
+	for _, cond := range conds {
+		ops, ok := selector[cond.field]
+		if !ok {
+			ops = make(map[Operator]interface{})
+			selector[cond.field] = ops
+		}
+		if _, ok := ops[cond.op]; ok {
+			return nil, fmt.Errorf("Duplicate condition %s on %q", cond.op, cond.field)
+		}
+		ops[cond.op] = cond.value
+	}
+	return selector, nil
+}
+
+// String returns the JSON of the query, or the error, for the logs.
+func (q *Query) String() string {
+	b, err := q.Build()
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+func checkField(field string) error {
+	if !validFieldReg.MatchString(field) {
+		return fmt.Errorf("Invalid field name: %q", field)
+	}
+	return nil
+}
+
+func checkValue(op Operator, value interface{}) error {
+	switch op {
+	case Eq, Ne, Gt, Gte, Lt, Lte:
+		return checkScalar(value)
+	case In, Nin:
+		var values []interface{}
+		switch v := value.(type) {
+		case []string:
+			for _, s := range v {
+				values = append(values, s)
+			}
+		case []interface{}:
+			values = v
+		default:
+			return fmt.Errorf("%s expects a list of values", op)
+		}
+		if len(values) == 0 || len(values) > MaxInValues {
+			return fmt.Errorf("%s expects between 1 and %d values", op, MaxInValues)
+		}
+		for _, v := range values {
+			if err := checkScalar(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case Exists:
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s expects a boolean", op)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown operator %q", op)
+	}
+}
+
+func checkScalar(value interface{}) error {
+	switch value.(type) {
+	case nil, string, bool, int, int64, float64, time.Time:
+		return nil
+	default:
+		return fmt.Errorf("Unexpected type %T", value)
+	}
+}
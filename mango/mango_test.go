@@ -0,0 +1,104 @@
+package mango
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild(t *testing.T) {
+	q := New("apps-index-by-slug-v2").
+		Where("type", Eq, "webapp").
+		Where("slug", In, []string{"drive", "photos"}).
+		Sort("slug", false).
+		Sort("editor", false).
+		Skip(10).
+		Limit(51)
+	b, err := q.Build()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "use_index": "apps-index-by-slug-v2",
+  "selector": {"type": {"$eq": "webapp"}, "slug": {"$in": ["drive", "photos"]}},
+  "sort": [{"slug": "asc"}, {"editor": "asc"}],
+  "skip": 10,
+  "limit": 51
+}`, string(b))
+
+	b, err = New("").Where("created_at", Gt, nil).Fields("slug").Sort("created_at", true).Build()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "selector": {"created_at": {"$gt": null}},
+  "fields": ["slug"],
+  "sort": [{"created_at": "desc"}]
+}`, string(b))
+}
+
+func TestBuildInvalid(t *testing.T) {
+	_, err := New("").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where(`slug": {"$gt": null}, "foo`, Eq, "bar").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("$or", Eq, "bar").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("type", Eq, map[string]interface{}{"$gt": nil}).Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", In, []string{}).Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", In, "drive").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", Exists, "yes").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", Operator("$regex"), ".*").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", Eq, "drive").Where("slug", Eq, "photos").Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", Eq, "drive").Sort("-slug", false).Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("slug", Eq, "drive").Limit(0).Build()
+	assert.Error(t, err)
+}
+
+func TestBuildWhereAny(t *testing.T) {
+	b, err := New("apps-index-by-type-v2").
+		Where("type", Gt, nil).
+		WhereAny(
+			[]Cond{{"type", Gt, "konnector"}},
+			[]Cond{{"type", Eq, "konnector"}, {"slug", Gt, "drive"}},
+		).
+		Sort("type", false).
+		Build()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "use_index": "apps-index-by-type-v2",
+  "selector": {
+    "type": {"$gt": null},
+    "$or": [
+      {"type": {"$gt": "konnector"}},
+      {"type": {"$eq": "konnector"}, "slug": {"$gt": "drive"}}
+    ]
+  },
+  "sort": [{"type": "asc"}]
+}`, string(b))
+
+	_, err = New("").Where("type", Gt, nil).WhereAny().Build()
+	assert.Error(t, err)
+
+	_, err = New("").Where("type", Gt, nil).
+		WhereAny([]Cond{{"slug", Gt, "a"}}).
+		WhereAny([]Cond{{"slug", Lt, "z"}}).
+		Build()
+	assert.Error(t, err)
+
+	_, err = New("").WhereAny([]Cond{{"$and", Eq, "a"}}).Build()
+	assert.Error(t, err)
+}
@@ -0,0 +1,97 @@
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The revisions of the schema of the manifests. The registry stores and
+// serves the manifests in the current revision, and can downgrade them for
+// the old stacks that expect the fields of a previous revision.
+const (
+	MinRevision     = 1
+	CurrentRevision = 2
+)
+
+// rename is a field renamed by a revision of the schema. Parent is the path of
+// the object with the field, with * for any key, or empty for the root of the
+// manifest.
+type rename struct {
+	Parent string
+	From   string
+	To     string
+}
+
+// revisionRenames are the fields renamed by each revision, from the previous
+// one.
+var revisionRenames = map[int][]rename{
+	2: {
+		{Parent: "", From: "short_desc", To: "short_description"},
+		{Parent: "", From: "long_desc", To: "long_description"},
+		{Parent: "locales.*", From: "short_desc", To: "short_description"},
+		{Parent: "locales.*", From: "long_desc", To: "long_description"},
+	},
+}
+
+// ParseRevision parses a revision of the schema of the manifests, as asked by
+// a client.
+func ParseRevision(value string) (int, error) {
+	revision, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || revision < MinRevision || revision > CurrentRevision {
+		return 0, fmt.Errorf("Invalid manifest version %q: it must be between %d and %d",
+			value, MinRevision, CurrentRevision)
+	}
+	return revision, nil
+}
+
+// Downgrade returns the manifest in a previous revision of the schema, with
+// the renamed fields back to their old names. The manifest is returned as is
+// for the current revision.
+func Downgrade(content json.RawMessage, revision int) (json.RawMessage, error) {
+	if revision >= CurrentRevision || len(content) == 0 {
+		return content, nil
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	for rev := CurrentRevision; rev > revision; rev-- {
+		for _, r := range revisionRenames[rev] {
+			var path []string
+			if r.Parent != "" {
+				path = strings.Split(r.Parent, ".")
+			}
+			renameField(doc, path, r.To, r.From)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// renameField renames a field in the objects found at the given path. The
+// field with the new name is kept if the object already has it.
+func renameField(obj map[string]interface{}, path []string, from, to string) {
+	if len(path) == 0 {
+		value, ok := obj[from]
+		if !ok {
+			return
+		}
+		delete(obj, from)
+		if _, exists := obj[to]; !exists {
+			obj[to] = value
+		}
+		return
+	}
+	if path[0] == "*" {
+		for _, child := range obj {
+			if child, ok := child.(map[string]interface{}); ok {
+				renameField(child, path[1:], from, to)
+			}
+		}
+		return
+	}
+	if child, ok := obj[path[0]].(map[string]interface{}); ok {
+		renameField(child, path[1:], from, to)
+	}
+}
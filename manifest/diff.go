@@ -0,0 +1,194 @@
+package manifest
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// Permission is a permission asked by an application in its manifest.
+type Permission struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Verbs       []string `json:"verbs,omitempty"`
+	Selector    string   `json:"selector,omitempty"`
+	Values      []string `json:"values,omitempty"`
+}
+
+// sameRights returns true if the two permissions give the same rights, even
+// if their descriptions are not the same.
+func (p Permission) sameRights(other Permission) bool {
+	return p.Type == other.Type &&
+		p.Selector == other.Selector &&
+		reflect.DeepEqual(sortedCopy(p.Verbs), sortedCopy(other.Verbs)) &&
+		reflect.DeepEqual(sortedCopy(p.Values), sortedCopy(other.Values))
+}
+
+// PermissionChange is a permission that has been modified between two
+// versions.
+type PermissionChange struct {
+	From Permission `json:"from"`
+	To   Permission `json:"to"`
+}
+
+// Route is a route of a webapp.
+type Route struct {
+	Folder string `json:"folder,omitempty"`
+	Index  string `json:"index,omitempty"`
+	Public bool   `json:"public"`
+}
+
+// RouteChange is a route that has been modified between two versions.
+type RouteChange struct {
+	From Route `json:"from"`
+	To   Route `json:"to"`
+}
+
+// Intent is an intent declared by a webapp.
+type Intent struct {
+	Action string   `json:"action"`
+	Type   []string `json:"type,omitempty"`
+	Href   string   `json:"href,omitempty"`
+}
+
+// Diff is the list of the changes between the manifests of two versions of
+// an application, for the fields that matter to the users before an upgrade.
+type Diff struct {
+	Permissions struct {
+		Added   map[string]Permission       `json:"added"`
+		Removed map[string]Permission       `json:"removed"`
+		Changed map[string]PermissionChange `json:"changed"`
+	} `json:"permissions"`
+	Locales struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+		Changed []string `json:"changed"`
+	} `json:"locales"`
+	Routes struct {
+		Added   map[string]Route       `json:"added"`
+		Removed map[string]Route       `json:"removed"`
+		Changed map[string]RouteChange `json:"changed"`
+	} `json:"routes"`
+	Intents struct {
+		Added   []Intent `json:"added"`
+		Removed []Intent `json:"removed"`
+	} `json:"intents"`
+}
+
+// diffFields are the fields of the manifests compared by Compare.
+type diffFields struct {
+	Permissions map[string]Permission      `json:"permissions"`
+	Locales     map[string]json.RawMessage `json:"locales"`
+	Routes      map[string]Route           `json:"routes"`
+	Intents     []Intent                   `json:"intents"`
+}
+
+// Compare returns the changes between two manifests: the permissions, the
+// locales, the routes and the intents that have been added, removed or
+// modified.
+func Compare(from, to json.RawMessage) (*Diff, error) {
+	var a, b diffFields
+	if len(from) > 0 {
+		if err := json.Unmarshal(from, &a); err != nil {
+			return nil, err
+		}
+	}
+	if len(to) > 0 {
+		if err := json.Unmarshal(to, &b); err != nil {
+			return nil, err
+		}
+	}
+
+	diff := &Diff{}
+	diff.Permissions.Added = make(map[string]Permission)
+	diff.Permissions.Removed = make(map[string]Permission)
+	diff.Permissions.Changed = make(map[string]PermissionChange)
+	for name, perm := range b.Permissions {
+		old, ok := a.Permissions[name]
+		if !ok {
+			diff.Permissions.Added[name] = perm
+		} else if !old.sameRights(perm) {
+			diff.Permissions.Changed[name] = PermissionChange{From: old, To: perm}
+		}
+	}
+	for name, perm := range a.Permissions {
+		if _, ok := b.Permissions[name]; !ok {
+			diff.Permissions.Removed[name] = perm
+		}
+	}
+
+	diff.Locales.Added = []string{}
+	diff.Locales.Removed = []string{}
+	diff.Locales.Changed = []string{}
+	for locale, content := range b.Locales {
+		old, ok := a.Locales[locale]
+		if !ok {
+			diff.Locales.Added = append(diff.Locales.Added, locale)
+		} else if !sameJSON(old, content) {
+			diff.Locales.Changed = append(diff.Locales.Changed, locale)
+		}
+	}
+	for locale := range a.Locales {
+		if _, ok := b.Locales[locale]; !ok {
+			diff.Locales.Removed = append(diff.Locales.Removed, locale)
+		}
+	}
+	sort.Strings(diff.Locales.Added)
+	sort.Strings(diff.Locales.Removed)
+	sort.Strings(diff.Locales.Changed)
+
+	diff.Routes.Added = make(map[string]Route)
+	diff.Routes.Removed = make(map[string]Route)
+	diff.Routes.Changed = make(map[string]RouteChange)
+	for path, route := range b.Routes {
+		old, ok := a.Routes[path]
+		if !ok {
+			diff.Routes.Added[path] = route
+		} else if old != route {
+			diff.Routes.Changed[path] = RouteChange{From: old, To: route}
+		}
+	}
+	for path, route := range a.Routes {
+		if _, ok := b.Routes[path]; !ok {
+			diff.Routes.Removed[path] = route
+		}
+	}
+
+	diff.Intents.Added = missingIntents(b.Intents, a.Intents)
+	diff.Intents.Removed = missingIntents(a.Intents, b.Intents)
+	return diff, nil
+}
+
+// missingIntents returns the intents of the list that are not in the other
+// list.
+func missingIntents(list, other []Intent) []Intent {
+	missing := []Intent{}
+	for _, intent := range list {
+		found := false
+		for _, o := range other {
+			if intent.Action == o.Action && intent.Href == o.Href &&
+				reflect.DeepEqual(sortedCopy(intent.Type), sortedCopy(o.Type)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, intent)
+		}
+	}
+	return missing
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return string(a) == string(b)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func sortedCopy(list []string) []string {
+	sorted := append([]string{}, list...)
+	sort.Strings(sorted)
+	return sorted
+}
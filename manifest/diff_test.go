@@ -0,0 +1,73 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	from := `{
+  "version": "1.2.0",
+  "locales": { "en": { "short_description": "Files" }, "de": { "short_description": "Dateien" } },
+  "permissions": {
+    "files": { "type": "io.cozy.files", "verbs": ["GET", "POST"], "description": "Read the files" },
+    "contacts": { "type": "io.cozy.contacts" },
+    "settings": { "type": "io.cozy.settings", "verbs": ["GET"] }
+  },
+  "routes": { "/": { "folder": "/", "index": "index.html" }, "/old": { "folder": "/old" } },
+  "intents": [{ "action": "OPEN", "type": ["io.cozy.files"], "href": "/" }]
+}`
+	to := `{
+  "version": "1.3.0",
+  "locales": { "en": { "short_description": "My files" }, "fr": { "short_description": "Fichiers" } },
+  "permissions": {
+    "files": { "type": "io.cozy.files", "verbs": ["POST", "GET"], "description": "Read and write the files" },
+    "settings": { "type": "io.cozy.settings", "verbs": ["ALL"] },
+    "jobs": { "type": "io.cozy.jobs" }
+  },
+  "routes": { "/": { "folder": "/", "index": "index.html", "public": true }, "/new": { "folder": "/new" } },
+  "intents": [
+    { "action": "OPEN", "type": ["io.cozy.files"], "href": "/" },
+    { "action": "PICK", "type": ["io.cozy.files"], "href": "/pick" }
+  ]
+}`
+	diff, err := Compare([]byte(from), []byte(to))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]Permission{"jobs": {Type: "io.cozy.jobs"}}, diff.Permissions.Added)
+	assert.Equal(t, map[string]Permission{"contacts": {Type: "io.cozy.contacts"}}, diff.Permissions.Removed)
+	// The description and the order of the verbs don't matter
+	assert.Equal(t, map[string]PermissionChange{
+		"settings": {
+			From: Permission{Type: "io.cozy.settings", Verbs: []string{"GET"}},
+			To:   Permission{Type: "io.cozy.settings", Verbs: []string{"ALL"}},
+		},
+	}, diff.Permissions.Changed)
+
+	assert.Equal(t, []string{"fr"}, diff.Locales.Added)
+	assert.Equal(t, []string{"de"}, diff.Locales.Removed)
+	assert.Equal(t, []string{"en"}, diff.Locales.Changed)
+
+	assert.Equal(t, map[string]Route{"/new": {Folder: "/new"}}, diff.Routes.Added)
+	assert.Equal(t, map[string]Route{"/old": {Folder: "/old"}}, diff.Routes.Removed)
+	assert.Contains(t, diff.Routes.Changed, "/")
+	assert.True(t, diff.Routes.Changed["/"].To.Public)
+
+	assert.Equal(t, []Intent{{Action: "PICK", Type: []string{"io.cozy.files"}, Href: "/pick"}}, diff.Intents.Added)
+	assert.Empty(t, diff.Intents.Removed)
+}
+
+func TestCompareSameManifest(t *testing.T) {
+	content := []byte(`{ "permissions": { "files": { "type": "io.cozy.files" } } }`)
+	diff, err := Compare(content, content)
+	require.NoError(t, err)
+	assert.Empty(t, diff.Permissions.Added)
+	assert.Empty(t, diff.Permissions.Removed)
+	assert.Empty(t, diff.Permissions.Changed)
+	assert.Empty(t, diff.Intents.Added)
+
+	_, err = Compare([]byte(`{ "permissions": [] }`), content)
+	assert.Error(t, err)
+}
@@ -0,0 +1,57 @@
+package manifest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ValidationError is returned when a manifest does not respect its schema.
+// It lists all the violated rules.
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Message
+	}
+	return "Invalid manifest: " + strings.Join(msgs, "; ")
+}
+
+// StatusCode returns the HTTP status code for the error.
+func (e *ValidationError) StatusCode() int {
+	return http.StatusUnprocessableEntity
+}
+
+// Details returns the violated rules, for the jobs of publication.
+func (e *ValidationError) Details() interface{} {
+	return e.Violations
+}
+
+// SchemaFor returns the schema of the manifests for the given type of
+// application (webapp or konnector), or nil if the type is unknown.
+func SchemaFor(appType string) *Schema {
+	switch appType {
+	case "webapp":
+		return webappSchema
+	case "konnector":
+		return konnectorSchema
+	}
+	return nil
+}
+
+// Validate checks the content of a manifest against the schema for the type
+// of application, and returns the violated rules.
+func Validate(appType string, content []byte) []Violation {
+	schema := SchemaFor(appType)
+	if schema == nil {
+		return []Violation{{Field: "type", Rule: "enum", Message: `"type" must be webapp or konnector`}}
+	}
+	var doc interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return []Violation{{Rule: "json", Message: "The manifest is not valid JSON: " + err.Error()}}
+	}
+	return schema.Validate(doc)
+}
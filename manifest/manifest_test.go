@@ -0,0 +1,151 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateWebapp(t *testing.T) {
+	valid := `{
+  "name": "Drive",
+  "slug": "drive",
+  "editor": "Cozy",
+  "version": "1.2.3",
+  "type": "webapp",
+  "locales": { "en": { "short_description": "Files" } },
+  "permissions": { "files": { "type": "io.cozy.files", "verbs": ["GET", "POST"] } },
+  "routes": { "/": { "folder": "/", "index": "index.html", "public": false } },
+  "categories": ["productivity"]
+}`
+	assert.Empty(t, Validate("webapp", []byte(valid)))
+
+	invalid := `{
+  "slug": "drive",
+  "editor": "Cozy",
+  "version": 123,
+  "type": "konnector",
+  "locales": { "en": "Files" },
+  "permissions": { "files": { "verbs": ["READ"] } },
+  "categories": ["productivity", "games"]
+}`
+	violations := Validate("webapp", []byte(invalid))
+	rules := make(map[string]string)
+	for _, v := range violations {
+		rules[v.Field] = v.Rule
+	}
+	assert.Equal(t, map[string]string{
+		"name":                       "required",
+		"version":                    "type",
+		"type":                       "enum",
+		"locales.en":                 "type",
+		"permissions.files.type":     "required",
+		"permissions.files.verbs[0]": "enum",
+	}, rules)
+}
+
+func TestValidateKonnector(t *testing.T) {
+	valid := `{
+  "name": "Orange",
+  "slug": "orange",
+  "editor": "Cozy",
+  "version": "1.0.0",
+  "data_types": ["bill"],
+  "fields": { "login": { "type": "text" } },
+  "folders": [{ "defaultDir": "$administrative" }],
+  "time_interval": [15, 21]
+}`
+	assert.Empty(t, Validate("konnector", []byte(valid)))
+
+	invalid := `{
+  "name": "Orange",
+  "slug": "orange",
+  "editor": "Cozy",
+  "version": "1.0.0",
+  "frequency": "yearly",
+  "folders": [{}],
+  "time_interval": [15.5, 21]
+}`
+	violations := Validate("konnector", []byte(invalid))
+	assert.Len(t, violations, 3)
+	err := &ValidationError{Violations: violations}
+	assert.Contains(t, err.Error(), `"frequency" must be one of monthly, weekly, daily, hourly`)
+	assert.Contains(t, err.Error(), `"folders[0].defaultDir" is required`)
+	assert.Equal(t, 422, err.StatusCode())
+}
+
+func TestValidateUnknownType(t *testing.T) {
+	assert.Len(t, Validate("foobar", []byte(`{}`)), 1)
+	assert.Len(t, Validate("webapp", []byte(`{`)), 1)
+}
+
+func TestValidateScreenshots(t *testing.T) {
+	valid := `{
+  "name": "Drive",
+  "slug": "drive",
+  "editor": "Cozy",
+  "version": "1.2.3",
+  "screenshots": [
+    "screenshots/home.png",
+    { "src": "screenshots/files.png", "caption": { "en": "Your files", "fr": "Vos fichiers" } }
+  ],
+  "locales": { "fr": { "screenshots": [{ "src": "screenshots/fr.png" }] } }
+}`
+	assert.Empty(t, Validate("webapp", []byte(valid)))
+
+	invalid := `{
+  "name": "Drive",
+  "slug": "drive",
+  "editor": "Cozy",
+  "version": "1.2.3",
+  "screenshots": [42, { "caption": { "en": "Your files" } }, { "src": "a.png", "caption": "Home" }]
+}`
+	rules := make(map[string]string)
+	for _, v := range Validate("webapp", []byte(invalid)) {
+		rules[v.Field] = v.Rule
+	}
+	assert.Equal(t, map[string]string{
+		"screenshots[0]":         "type",
+		"screenshots[1].src":     "required",
+		"screenshots[2].caption": "type",
+	}, rules)
+}
+
+func TestDowngrade(t *testing.T) {
+	content := []byte(`{
+  "slug": "drive",
+  "short_description": "Files",
+  "locales": {
+    "en": { "short_description": "Files", "long_description": "Your files" },
+    "fr": { "short_description": "Fichiers", "short_desc": "Mes fichiers" }
+  }
+}`)
+
+	same, err := Downgrade(content, CurrentRevision)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), string(same))
+
+	old, err := Downgrade(content, 1)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+  "slug": "drive",
+  "short_desc": "Files",
+  "locales": {
+    "en": { "short_desc": "Files", "long_desc": "Your files" },
+    "fr": { "short_desc": "Mes fichiers" }
+  }
+}`, string(old))
+}
+
+func TestParseRevision(t *testing.T) {
+	revision, err := ParseRevision("1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, revision)
+
+	_, err = ParseRevision("0")
+	assert.Error(t, err)
+	_, err = ParseRevision(" 3")
+	assert.Error(t, err)
+	_, err = ParseRevision("latest")
+	assert.Error(t, err)
+}
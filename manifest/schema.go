@@ -0,0 +1,196 @@
+// Package manifest validates the manifests of the applications with JSON
+// schemas. Only the subset of JSON schema needed for the manifests is
+// supported: type, required, properties, additionalProperties, items, enum,
+// minLength and pattern.
+package manifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Schema is a JSON schema, or a sub-schema of a property.
+type Schema struct {
+	Type                 types              `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*Schema `json:"properties"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	Enum                 []string           `json:"enum"`
+	MinLength            int                `json:"minLength"`
+	Pattern              string             `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+// types is the type keyword of a schema, which can be a string or a list of
+// strings.
+type types []string
+
+func (t *types) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = types{one}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*t = list
+	return nil
+}
+
+// MustParseSchema parses a JSON schema, and panics if it is invalid. It is
+// meant to be used for the schemas defined in the code.
+func MustParseSchema(content string) *Schema {
+	var s Schema
+	if err := json.Unmarshal([]byte(content), &s); err != nil {
+		panic(fmt.Sprintf("manifest: invalid schema: %s", err))
+	}
+	s.compile()
+	return &s
+}
+
+func (s *Schema) compile() {
+	if s.Pattern != "" {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	for _, prop := range s.Properties {
+		prop.compile()
+	}
+	if s.AdditionalProperties != nil {
+		s.AdditionalProperties.compile()
+	}
+	if s.Items != nil {
+		s.Items.compile()
+	}
+}
+
+// Violation is a rule of the schema that is not respected by a manifest.
+type Violation struct {
+	// Field is the path of the value in the manifest, like
+	// "permissions.files.verbs[0]", or an empty string for the root.
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Validate returns the violations of the schema by the given value, decoded
+// from JSON.
+func (s *Schema) Validate(value interface{}) []Violation {
+	var violations []Violation
+	s.validate("", value, &violations)
+	return violations
+}
+
+func (s *Schema) validate(field string, value interface{}, violations *[]Violation) {
+	add := func(rule, format string, a ...interface{}) {
+		msg := fmt.Sprintf(format, a...)
+		if field != "" {
+			msg = fmt.Sprintf("%q %s", field, msg)
+		}
+		*violations = append(*violations, Violation{Field: field, Rule: rule, Message: msg})
+	}
+
+	if len(s.Type) > 0 && !s.Type.match(value) {
+		add("type", "must be of type %s", strings.Join(s.Type, " or "))
+		return
+	}
+
+	switch v := value.(type) {
+	case string:
+		if len(s.Enum) > 0 && !inList(v, s.Enum) {
+			add("enum", "must be one of %s", strings.Join(s.Enum, ", "))
+		}
+		if len(v) < s.MinLength {
+			add("minLength", "must have at least %d characters", s.MinLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			add("pattern", "must match %s", s.Pattern)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(fmt.Sprintf("%s[%d]", field, i), item, violations)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*violations = append(*violations, Violation{
+					Field:   join(field, name),
+					Rule:    "required",
+					Message: fmt.Sprintf("%q is required", join(field, name)),
+				})
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if prop, ok := s.Properties[key]; ok {
+				prop.validate(join(field, key), v[key], violations)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(join(field, key), v[key], violations)
+			}
+		}
+	}
+}
+
+func (t types) match(value interface{}) bool {
+	for _, typ := range t {
+		switch value.(type) {
+		case nil:
+			if typ == "null" {
+				return true
+			}
+		case bool:
+			if typ == "boolean" {
+				return true
+			}
+		case float64:
+			if typ == "number" || (typ == "integer" && isInteger(value.(float64))) {
+				return true
+			}
+		case string:
+			if typ == "string" {
+				return true
+			}
+		case []interface{}:
+			if typ == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if typ == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isInteger(f float64) bool {
+	return f == float64(int64(f))
+}
+
+func join(field, key string) string {
+	if field == "" {
+		return key
+	}
+	return field + "." + key
+}
+
+func inList(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
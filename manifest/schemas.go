@@ -0,0 +1,186 @@
+package manifest
+
+// screenshotSchema is the schema of an entry of the screenshots: a path, or an
+// object with the path and the captions indexed by locale.
+const screenshotSchema = `{
+      "type": ["string", "object"],
+      "required": ["src"],
+      "properties": {
+        "src": { "type": "string", "minLength": 1 },
+        "caption": { "type": "object", "additionalProperties": { "type": "string" } }
+      }
+    }`
+
+// Categories is the list of the known categories of the applications. It is
+// given to the editors as a recommendation, but the manifests can have other
+// categories.
+var Categories = []string{
+	"energy",
+	"insurance",
+	"isp",
+	"shopping",
+	"telecom",
+	"transport",
+	"banking",
+	"health",
+	"host_provider",
+	"online_services",
+	"partners",
+	"press",
+	"productivity",
+	"public_service",
+	"social",
+	"others",
+}
+
+// commonProperties are the properties shared by the manifests of the webapps
+// and of the konnectors.
+const commonProperties = `
+    "name": { "type": "string" },
+    "name_prefix": { "type": "string" },
+    "slug": { "type": "string" },
+    "editor": { "type": "string" },
+    "version": { "type": "string" },
+    "icon": { "type": "string" },
+    "license": { "type": "string" },
+    "source": { "type": "string" },
+    "manifest_version": { "type": ["string", "number"] },
+    "categories": { "type": ["array", "null"], "items": { "type": "string" } },
+    "tags": { "type": ["array", "null"], "items": { "type": "string" } },
+    "langs": { "type": ["array", "null"], "items": { "type": "string" } },
+    "screenshots": { "type": ["array", "null"], "items": ` + screenshotSchema + ` },
+    "developer": {
+      "type": "object",
+      "properties": {
+        "name": { "type": "string" },
+        "url": { "type": "string" }
+      }
+    },
+    "partnership": {
+      "type": ["object", "null"],
+      "properties": {
+        "icon": { "type": "string" },
+        "description": { "type": "string" },
+        "name": { "type": "string" },
+        "domain": { "type": "string" }
+      }
+    },
+    "terms": {
+      "type": "object",
+      "required": ["url", "version", "id"],
+      "properties": {
+        "url": { "type": "string", "minLength": 1 },
+        "version": { "type": "string", "pattern": "^[^*+~.()'\"!:@]+$" },
+        "id": { "type": "string", "pattern": "^[^*+~.()'\"!:@]+$" }
+      }
+    },
+    "locales": {
+      "type": ["object", "null"],
+      "additionalProperties": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string" },
+          "short_description": { "type": "string" },
+          "long_description": { "type": "string" },
+          "changes": { "type": "string" },
+          "screenshots": { "type": ["array", "null"], "items": ` + screenshotSchema + ` }
+        }
+      }
+    },
+    "permissions": {
+      "type": ["object", "null"],
+      "additionalProperties": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "type": { "type": "string", "minLength": 1 },
+          "description": { "type": "string" },
+          "verbs": {
+            "type": "array",
+            "items": { "type": "string", "enum": ["ALL", "GET", "POST", "PUT", "PATCH", "DELETE"] }
+          },
+          "selector": { "type": "string" },
+          "values": { "type": "array", "items": { "type": "string" } }
+        }
+      }
+    }`
+
+// webappSchema is the schema of the manifest.webapp files.
+var webappSchema = MustParseSchema(`{
+  "type": "object",
+  "required": ["name", "slug", "editor", "version"],
+  "properties": {` + commonProperties + `,
+    "type": { "type": "string", "enum": ["webapp"] },
+    "routes": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "properties": {
+          "folder": { "type": "string" },
+          "index": { "type": "string" },
+          "public": { "type": "boolean" }
+        }
+      }
+    },
+    "services": {
+      "type": "object",
+      "additionalProperties": {
+        "type": "object",
+        "properties": {
+          "type": { "type": "string" },
+          "file": { "type": "string" }
+        }
+      }
+    },
+    "intents": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["action"],
+        "properties": {
+          "action": { "type": "string", "minLength": 1 },
+          "type": { "type": "array", "items": { "type": "string" } },
+          "href": { "type": "string" }
+        }
+      }
+    },
+    "platforms": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["type"],
+        "properties": {
+          "type": { "type": "string" },
+          "url": { "type": "string" }
+        }
+      }
+    }
+  }
+}`)
+
+// konnectorSchema is the schema of the manifest.konnector files.
+var konnectorSchema = MustParseSchema(`{
+  "type": "object",
+  "required": ["name", "slug", "editor", "version"],
+  "properties": {` + commonProperties + `,
+    "type": { "type": "string", "enum": ["konnector"] },
+    "language": { "type": "string" },
+    "vendor_link": { "type": "string" },
+    "frequency": { "type": "string", "enum": ["monthly", "weekly", "daily", "hourly"] },
+    "data_types": { "type": ["array", "null"], "items": { "type": "string" } },
+    "messages": { "type": "array", "items": { "type": "string" } },
+    "fields": { "type": "object", "additionalProperties": { "type": "object" } },
+    "folders": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["defaultDir"],
+        "properties": {
+          "defaultDir": { "type": "string", "minLength": 1 }
+        }
+      }
+    },
+    "time_interval": { "type": "array", "items": { "type": "integer" } },
+    "oauth": { "type": ["object", "null"] }
+  }
+}`)
@@ -0,0 +1,195 @@
+// Package migrations upgrades the CouchDB databases of the spaces when the
+// format of their documents, views or indexes changes. The migrations are
+// numbered, and the last one applied to a database is recorded in its
+// _local/migrations document. They are run at the start of the server, or
+// with the migrate command.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// The databases of a space that can be migrated.
+const (
+	AppsDB     = "apps"
+	VersionsDB = "versions"
+	PendingDB  = "pending"
+	TrashDB    = "trash"
+	StatsDB    = "stats"
+)
+
+// recordID is the identifier of the document where the migrations applied to
+// a database are recorded. It is a local document, as the migrations of a
+// replicated database must be run on each side.
+const recordID = "_local/migrations"
+
+// Migration is a step of the upgrade of a database. It can be run twice (if
+// two instances of the registry start at the same time, or if the recording
+// of the migration has failed), so it must be idempotent.
+type Migration struct {
+	// Version is the number of the migration. The migrations are applied by
+	// increasing version, and a new migration must have a greater version
+	// than the existing ones.
+	Version     int
+	DB          string
+	Description string
+	Up          func(ctx context.Context, db *kivik.DB) error
+}
+
+// Migrations is the list of the migrations, by increasing version.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		DB:          VersionsDB,
+		Description: "Replace the versions views of each application by a shared view",
+		Up: func(ctx context.Context, db *kivik.DB) error {
+			_, err := space.MigrateVersionsViews(ctx, db)
+			return err
+		},
+	},
+}
+
+// Applied is an entry of the record of the migrations of a database.
+type Applied struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// Record is the document where the migrations applied to a database are
+// recorded.
+type Record struct {
+	ID      string    `json:"_id"`
+	Rev     string    `json:"_rev,omitempty"`
+	Version int       `json:"version"`
+	Applied []Applied `json:"applied"`
+}
+
+// Step is a migration to apply to a database of a space.
+type Step struct {
+	Space string
+	Migration
+}
+
+func (s Step) String() string {
+	name := s.Space
+	if name == "" {
+		name = "__default__"
+	}
+	return fmt.Sprintf("%s/%s #%d: %s", name, s.DB, s.Version, s.Description)
+}
+
+// pending returns the migrations of the list for the given database that have
+// a greater version than the last applied one.
+func pending(list []Migration, dbName string, version int) []Migration {
+	var migrations []Migration
+	for _, m := range list {
+		if m.DB == dbName && m.Version > version {
+			migrations = append(migrations, m)
+		}
+	}
+	return migrations
+}
+
+func databases(s *space.Space) map[string]*kivik.DB {
+	return map[string]*kivik.DB{
+		AppsDB:     s.AppsDB(),
+		VersionsDB: s.VersDB(),
+		PendingDB:  s.PendingVersDB(),
+		TrashDB:    s.TrashVersDB(),
+		StatsDB:    s.StatsDB(),
+	}
+}
+
+// getRecord returns the record of the migrations of a database, or an empty
+// record if no migration has been applied.
+func getRecord(ctx context.Context, db *kivik.DB) (*Record, error) {
+	var record Record
+	if err := db.Get(ctx, recordID).ScanDoc(&record); err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return &Record{ID: recordID}, nil
+		}
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Pending returns the migrations that have not been applied to the databases
+// of the space.
+func Pending(ctx context.Context, s *space.Space) ([]Step, error) {
+	var steps []Step
+	for dbName, db := range databases(s) {
+		record, err := getRecord(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range pending(Migrations, dbName, record.Version) {
+			steps = append(steps, Step{Space: s.Name, Migration: m})
+		}
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		return steps[i].Version < steps[j].Version
+	})
+	return steps, nil
+}
+
+// Run applies the pending migrations to the databases of the space, and
+// returns the applied steps. It stops at the first migration that fails.
+func Run(ctx context.Context, s *space.Space) ([]Step, error) {
+	steps, err := Pending(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	dbs := databases(s)
+	for i, step := range steps {
+		log := logrus.WithFields(logrus.Fields{
+			"nspace":  "migrations",
+			"space":   step.Space,
+			"db":      step.DB,
+			"version": step.Version,
+		})
+		log.Infof("Running migration: %s", step.Description)
+		start := time.Now()
+		db := dbs[step.DB]
+		if err := step.Up(ctx, db); err != nil {
+			return steps[:i], fmt.Errorf("Migration %s has failed: %s", step, err)
+		}
+		if err := record(ctx, db, step.Migration); err != nil {
+			return steps[:i], fmt.Errorf("Cannot record the migration %s: %s", step, err)
+		}
+		log.WithField("duration", time.Since(start).String()).Info("Migration applied")
+	}
+	return steps, nil
+}
+
+// record adds the migration to the record of the database. When another
+// instance has recorded a migration at the same time, the record is reloaded.
+func record(ctx context.Context, db *kivik.DB, m Migration) error {
+	for {
+		r, err := getRecord(ctx, db)
+		if err != nil {
+			return err
+		}
+		if r.Version >= m.Version {
+			return nil
+		}
+		r.Version = m.Version
+		r.Applied = append(r.Applied, Applied{
+			Version:     m.Version,
+			Description: m.Description,
+			AppliedAt:   time.Now().UTC(),
+		})
+		_, err = db.Put(ctx, recordID, r)
+		if kivik.StatusCode(err) != http.StatusConflict {
+			return err
+		}
+	}
+}
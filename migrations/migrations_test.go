@@ -0,0 +1,32 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsOrder(t *testing.T) {
+	dbs := map[string]bool{AppsDB: true, VersionsDB: true, PendingDB: true, TrashDB: true, StatsDB: true}
+	last := 0
+	for _, m := range Migrations {
+		assert.True(t, m.Version > last, "the versions of the migrations must be increasing")
+		assert.True(t, dbs[m.DB], "unknown database %q", m.DB)
+		assert.NotEmpty(t, m.Description)
+		assert.NotNil(t, m.Up)
+		last = m.Version
+	}
+}
+
+func TestPending(t *testing.T) {
+	list := []Migration{
+		{Version: 1, DB: VersionsDB},
+		{Version: 2, DB: AppsDB},
+		{Version: 3, DB: VersionsDB},
+	}
+	assert.Len(t, pending(list, VersionsDB, 0), 2)
+	assert.Equal(t, 3, pending(list, VersionsDB, 1)[0].Version)
+	assert.Empty(t, pending(list, VersionsDB, 3))
+	assert.Len(t, pending(list, AppsDB, 1), 1)
+	assert.Empty(t, pending(list, StatsDB, 0))
+}
@@ -0,0 +1,212 @@
+// Package mirror replicates the applications and the versions of an upstream
+// registry into a space of this registry, for the air-gapped and the regional
+// deployments. The tarballs are downloaded and checked like for a
+// publication, and the icons and screenshots are extracted from them.
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/client"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// pageSize is the number of applications asked to the upstream registry per
+// request.
+const pageSize = 200
+
+// Options are the parameters of a synchronization.
+type Options struct {
+	// Upstream is the client for the space of the upstream registry.
+	Upstream *client.Client
+	// Space is the local space where the applications are mirrored.
+	Space *space.Space
+	// RegistryURL is the public URL of this registry, for the URLs of the
+	// tarballs of the mirrored versions.
+	RegistryURL *url.URL
+	// Since skips the versions created before this date on the upstream
+	// registry (none if zero).
+	Since time.Time
+	// DryRun only reports what would be mirrored.
+	DryRun bool
+}
+
+// Report is the summary of a synchronization.
+type Report struct {
+	Apps        int      `json:"apps"`
+	CreatedApps []string `json:"created_apps,omitempty"`
+	Versions    []string `json:"versions,omitempty"`
+	UpToDate    int      `json:"up_to_date"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+func (r *Report) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	r.Errors = append(r.Errors, msg)
+	logrus.WithField("nspace", "mirror").Warn(msg)
+}
+
+// Sync mirrors the applications of the upstream registry, and their versions
+// that are missing in the local space. It can be run periodically: only the
+// new versions are downloaded, the oldest first, with their upstream
+// created_at. The versions removed upstream are kept. An error for an
+// application or a version is added to the report, and the synchronization
+// goes on with the next one.
+func Sync(ctx context.Context, opts *Options) (*Report, error) {
+	report := &Report{}
+	list := &client.ListOptions{
+		Limit:           pageSize,
+		LatestChannel:   "dev",
+		VersionsChannel: "dev",
+	}
+	for {
+		page, err := opts.Upstream.ListApps(ctx, list)
+		if err != nil {
+			return report, fmt.Errorf("Cannot list the upstream applications: %s", err)
+		}
+		for _, app := range page.Apps {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			report.Apps++
+			syncApp(ctx, opts, report, app)
+		}
+		if page.Meta.NextCursor == "" {
+			return report, nil
+		}
+		list.Cursor = page.Meta.NextCursor
+	}
+}
+
+func syncApp(ctx context.Context, opts *Options, report *Report, upstream *client.App) {
+	s := opts.Space
+	app, err := registry.FindApp(nil, s, upstream.Slug, registry.Dev)
+	if err == registry.ErrAppNotFound {
+		if app, err = createApp(opts, upstream); err != nil {
+			report.fail("Cannot create the application %s: %s", upstream.Slug, err)
+			return
+		}
+		report.CreatedApps = append(report.CreatedApps, upstream.Slug)
+	} else if err != nil {
+		report.fail("Cannot find the application %s: %s", upstream.Slug, err)
+		return
+	}
+
+	local := make(map[string]bool)
+	if app != nil {
+		versions, err := registry.FindAppVersionsCacheMiss(s, upstream.Slug, registry.Dev, registry.NotConcatenated)
+		if err != nil {
+			report.fail("Cannot list the versions of %s: %s", upstream.Slug, err)
+			return
+		}
+		for _, v := range versions.GetAll() {
+			local[v] = true
+		}
+	}
+
+	var missing []*client.Version
+	if upstream.Versions != nil {
+		var all []string
+		all = append(all, upstream.Versions.Stable...)
+		all = append(all, upstream.Versions.Beta...)
+		all = append(all, upstream.Versions.Dev...)
+		for _, v := range all {
+			if local[v] {
+				continue
+			}
+			ver, err := opts.Upstream.GetVersion(ctx, upstream.Slug, v)
+			if err != nil {
+				report.fail("Cannot fetch the version %s/%s: %s", upstream.Slug, v, err)
+				continue
+			}
+			if ver.CreatedAt.Before(opts.Since) {
+				continue
+			}
+			missing = append(missing, ver)
+		}
+	}
+	if len(missing) == 0 {
+		report.UpToDate++
+		return
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].CreatedAt.Before(missing[j].CreatedAt)
+	})
+
+	for _, ver := range missing {
+		name := upstream.Slug + "/" + ver.Version
+		if !opts.DryRun {
+			if err := mirrorVersion(ctx, opts, app, ver); err != nil {
+				report.fail("Cannot mirror the version %s: %s", name, err)
+				continue
+			}
+		}
+		report.Versions = append(report.Versions, name)
+	}
+}
+
+// createApp creates the application in the local space, with its editor if
+// needed. Nothing is created for a dry run.
+func createApp(opts *Options, upstream *client.App) (*registry.App, error) {
+	if opts.DryRun {
+		return nil, nil
+	}
+	editor, err := auth.Editors.GetEditor(upstream.Editor)
+	if err != nil {
+		editor, err = auth.Editors.CreateEditorWithoutPublicKey(upstream.Editor, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry.CreateApp(opts.Space, &registry.AppOptions{
+		Slug:   upstream.Slug,
+		Editor: upstream.Editor,
+		Type:   upstream.Type,
+	}, editor)
+}
+
+// mirrorVersion downloads the tarball of an upstream version, and adds the
+// version to the local space, as a release.
+func mirrorVersion(ctx context.Context, opts *Options, app *registry.App, upstream *client.Version) error {
+	tarballURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		return err
+	}
+	registryURL := *opts.RegistryURL
+	registryURL.Path = path.Join(registryURL.Path, registryPath(opts.Space.Name),
+		app.Slug, upstream.Version, "tarball", path.Base(tarballURL.Path))
+
+	ver, attachments, err := registry.DownloadVersion(&registry.VersionOptions{
+		Version:     upstream.Version,
+		URL:         upstream.URL,
+		Sha256:      upstream.Sha256,
+		SpacePrefix: opts.Space.GetPrefix(),
+		RegistryURL: &registryURL,
+		Context:     ctx,
+		Provenance:  &registry.Provenance{Method: registry.PublishMethodMirror},
+	})
+	if err != nil {
+		return err
+	}
+	if !upstream.CreatedAt.IsZero() {
+		ver.CreatedAt = upstream.CreatedAt.UTC()
+	}
+	return registry.CreateReleaseVersion(opts.Space, ver, attachments, app, true)
+}
+
+// registryPath returns the path of the registry API for the space.
+func registryPath(spaceName string) string {
+	if spaceName == "" || spaceName == base.DefaultSpacePrefix.String() {
+		return "/registry"
+	}
+	return "/" + spaceName + "/registry"
+}
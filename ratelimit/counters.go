@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+)
+
+// memoryCounter is a counter for a single instance of the registry.
+type memoryCounter struct {
+	mu        sync.Mutex
+	hits      map[string]*memoryHits
+	nextPurge time.Time
+}
+
+type memoryHits struct {
+	count     int64
+	expiresAt time.Time
+}
+
+// NewMemoryCounter returns a counter that keeps the hits in memory. It is used
+// when Redis is not configured.
+func NewMemoryCounter() Counter {
+	return &memoryCounter{hits: make(map[string]*memoryHits)}
+}
+
+func (m *memoryCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.After(m.nextPurge) {
+		for k, h := range m.hits {
+			if now.After(h.expiresAt) {
+				delete(m.hits, k)
+			}
+		}
+		m.nextPurge = now.Add(ttl)
+	}
+	h, ok := m.hits[key]
+	if !ok || now.After(h.expiresAt) {
+		h = &memoryHits{}
+		m.hits[key] = h
+	}
+	if expiresAt := now.Add(ttl); expiresAt.After(h.expiresAt) {
+		h.expiresAt = expiresAt
+	}
+	h.count++
+	return h.count, nil
+}
+
+func (m *memoryCounter) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.hits[key]; ok {
+		h.expiresAt = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+func (m *memoryCounter) TTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.hits[key]
+	if !ok {
+		return 0, nil
+	}
+	if ttl := time.Until(h.expiresAt); ttl > 0 {
+		return ttl, nil
+	}
+	return 0, nil
+}
+
+// redisCounter is a counter shared by all the instances of the registry.
+type redisCounter struct {
+	client redis.UniversalClient
+}
+
+// NewRedisCounter returns a counter that keeps the hits in Redis.
+func NewRedisCounter(client redis.UniversalClient) Counter {
+	return &redisCounter{client: client}
+}
+
+func (r *redisCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	pipe := r.client.TxPipeline()
+	incr := pipe.Incr(key)
+	pipe.Expire(key, ttl)
+	if _, err := pipe.Exec(); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (r *redisCounter) Expire(key string, ttl time.Duration) error {
+	return r.client.Expire(key, ttl).Err()
+}
+
+func (r *redisCounter) TTL(key string) (time.Duration, error) {
+	ttl, err := r.client.PTTL(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// PTTL returns a negative duration for the unknown keys and the keys
+	// without expiration
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kinds of clients for the lockouts after the failed authentications.
+const (
+	// LockoutIP is for the failed authentications from an IP address.
+	LockoutIP = "ip"
+	// LockoutEditor is for the failed authentications from an IP address
+	// with a token for the applications of an editor.
+	LockoutEditor = "editor"
+)
+
+// LockoutKinds is the list of all the kinds of clients for the lockouts.
+var LockoutKinds = []string{LockoutIP, LockoutEditor}
+
+// LockoutRule tells when a client is locked out after some failed
+// authentications. A rule with a threshold of 0 means no lockout.
+type LockoutRule struct {
+	// Threshold is the number of failures before the first lockout.
+	Threshold int
+	// Window is the period, after the last failure, during which the
+	// failures are counted.
+	Window time.Duration
+	// Lockout is the duration of the first lockout. It is doubled for each
+	// new failure, up to MaxLockout.
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// duration returns the duration of the lockout after the given number of
+// failures, or 0 if the threshold has not been reached.
+func (r LockoutRule) duration(failures int64) time.Duration {
+	if failures < int64(r.Threshold) {
+		return 0
+	}
+	d := r.Lockout
+	for i := int64(r.Threshold); i < failures && d < r.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > r.MaxLockout {
+		d = r.MaxLockout
+	}
+	return d
+}
+
+// Lockouts counts the failed authentications of the clients, and locks them
+// out when there are too many.
+type Lockouts struct {
+	counter Counter
+	rules   map[string]LockoutRule
+}
+
+var lockouts *Lockouts
+
+// NewLockouts returns the lockouts for the given rules, by kind of clients.
+func NewLockouts(counter Counter, rules map[string]LockoutRule) *Lockouts {
+	return &Lockouts{counter: counter, rules: rules}
+}
+
+// ConfigureLockouts sets the lockouts used by Locked and Failure.
+func ConfigureLockouts(l *Lockouts) {
+	lockouts = l
+}
+
+// Locked returns the remaining duration of the lockout of the client, or 0 if
+// it is not locked out.
+func Locked(kind, client string) (time.Duration, error) {
+	if lockouts == nil {
+		return 0, nil
+	}
+	return lockouts.Locked(kind, client)
+}
+
+// Failure records a failed authentication of the client. It returns the
+// duration of the lockout if this failure has locked out the client.
+func Failure(kind, client string) (time.Duration, error) {
+	if lockouts == nil {
+		return 0, nil
+	}
+	return lockouts.Failure(kind, client)
+}
+
+// Locked returns the remaining duration of the lockout of the client, or 0 if
+// it is not locked out.
+func (l *Lockouts) Locked(kind, client string) (time.Duration, error) {
+	rule, ok := l.rules[kind]
+	if !ok || rule.Threshold <= 0 {
+		return 0, nil
+	}
+	return l.counter.TTL(lockoutKey("lock", kind, client))
+}
+
+// Failure records a failed authentication of the client. It returns the
+// duration of the lockout if this failure has locked out the client.
+func (l *Lockouts) Failure(kind, client string) (time.Duration, error) {
+	rule, ok := l.rules[kind]
+	if !ok || rule.Threshold <= 0 {
+		return 0, nil
+	}
+	failuresKey := lockoutKey("failures", kind, client)
+	failures, err := l.counter.Increment(failuresKey, rule.Window)
+	if err != nil {
+		return 0, err
+	}
+	d := rule.duration(failures)
+	if d == 0 {
+		return 0, nil
+	}
+	if _, err := l.counter.Increment(lockoutKey("lock", kind, client), d); err != nil {
+		return 0, err
+	}
+	// The failures are kept during the lockout, so that the next failure
+	// after it gives a longer lockout
+	if err := l.counter.Expire(failuresKey, d+rule.Window); err != nil {
+		return 0, err
+	}
+	return d, nil
+}
+
+func lockoutKey(prefix, kind, client string) string {
+	return fmt.Sprintf("auth:%s:%s:%s", prefix, kind, client)
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockoutRuleDuration(t *testing.T) {
+	rule := LockoutRule{Threshold: 3, Window: time.Hour, Lockout: time.Minute, MaxLockout: 5 * time.Minute}
+	assert.Equal(t, time.Duration(0), rule.duration(2))
+	assert.Equal(t, time.Minute, rule.duration(3))
+	assert.Equal(t, 2*time.Minute, rule.duration(4))
+	assert.Equal(t, 4*time.Minute, rule.duration(5))
+	assert.Equal(t, 5*time.Minute, rule.duration(6))
+	assert.Equal(t, 5*time.Minute, rule.duration(100))
+}
+
+func TestLockouts(t *testing.T) {
+	l := NewLockouts(NewMemoryCounter(), map[string]LockoutRule{
+		LockoutIP: {Threshold: 2, Window: time.Hour, Lockout: time.Minute, MaxLockout: time.Hour},
+	})
+
+	d, err := l.Failure(LockoutIP, "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+	locked, err := l.Locked(LockoutIP, "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), locked)
+
+	d, err = l.Failure(LockoutIP, "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, d)
+	locked, err = l.Locked(LockoutIP, "127.0.0.1")
+	require.NoError(t, err)
+	assert.True(t, locked > 59*time.Second && locked <= time.Minute)
+
+	// The other clients and the kinds without rule are not locked out
+	locked, _ = l.Locked(LockoutIP, "10.0.0.1")
+	assert.Equal(t, time.Duration(0), locked)
+	d, _ = l.Failure(LockoutEditor, "cozy")
+	assert.Equal(t, time.Duration(0), d)
+	d, _ = l.Failure(LockoutEditor, "cozy")
+	assert.Equal(t, time.Duration(0), d)
+}
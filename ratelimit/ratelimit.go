@@ -0,0 +1,90 @@
+// Package ratelimit limits the number of requests that a client (identified by
+// its token or its IP address) can make on some endpoints of the registry, to
+// protect it from the runaway clients, like a CI stuck in a loop that
+// publishes the same version again and again. It also locks out the clients
+// that fail to authenticate too many times.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Classes of endpoints, each one with its own limit.
+const (
+	// Publish is for the creation of the applications and of the versions.
+	Publish = "publish"
+	// List is for the listing and the search of the applications.
+	List = "list"
+)
+
+// Classes is the list of all the classes of endpoints.
+var Classes = []string{Publish, List}
+
+// Rule is the maximal number of requests for a class of endpoints in a window
+// of time. A rule with a limit of 0 means no limit.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Counter counts the hits for a key. The key includes the window, so that
+// the counter can forget it when the window is over.
+type Counter interface {
+	// Increment adds a hit for the key and returns the number of hits for
+	// this key. The key is kept at least for the given TTL.
+	Increment(key string, ttl time.Duration) (int64, error)
+	// Expire keeps the key for the given TTL, from now.
+	Expire(key string, ttl time.Duration) error
+	// TTL returns the remaining time before the key is forgotten, or 0 if
+	// the key is unknown.
+	TTL(key string) (time.Duration, error)
+}
+
+// Limiter checks the requests against the rules.
+type Limiter struct {
+	counter Counter
+	rules   map[string]Rule
+}
+
+var limiter *Limiter
+
+// NewLimiter returns a limiter for the given rules, by class of endpoints.
+func NewLimiter(counter Counter, rules map[string]Rule) *Limiter {
+	return &Limiter{counter: counter, rules: rules}
+}
+
+// Configure sets the limiter used by Check.
+func Configure(l *Limiter) {
+	limiter = l
+}
+
+// Check counts a request of the client for the class of endpoints. If the
+// limit has been reached, it returns the delay before the client can retry.
+func Check(class, client string) (time.Duration, error) {
+	if limiter == nil {
+		return 0, nil
+	}
+	return limiter.Check(class, client, time.Now())
+}
+
+// Check counts a request of the client for the class of endpoints, made at
+// the given time. It uses fixed windows: if the limit has been reached, it
+// returns the delay before the start of the next window.
+func (l *Limiter) Check(class, client string, now time.Time) (time.Duration, error) {
+	rule, ok := l.rules[class]
+	if !ok || rule.Limit <= 0 || rule.Window <= 0 {
+		return 0, nil
+	}
+	start := now.Truncate(rule.Window)
+	key := fmt.Sprintf("ratelimit:%s:%s:%s", class, client, strconv.FormatInt(start.Unix(), 10))
+	count, err := l.counter.Increment(key, rule.Window)
+	if err != nil {
+		return 0, err
+	}
+	if count <= int64(rule.Limit) {
+		return 0, nil
+	}
+	return start.Add(rule.Window).Sub(now), nil
+}
@@ -0,0 +1,47 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterCheck(t *testing.T) {
+	l := NewLimiter(NewMemoryCounter(), map[string]Rule{
+		Publish: {Limit: 2, Window: time.Minute},
+	})
+	now := time.Date(2021, 3, 12, 10, 21, 15, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		retry, err := l.Check(Publish, "token:abc", now)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), retry)
+	}
+	retry, err := l.Check(Publish, "token:abc", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 45*time.Second, retry)
+
+	// The other clients and the other classes are not limited
+	retry, _ = l.Check(Publish, "ip:127.0.0.1", now)
+	assert.Equal(t, time.Duration(0), retry)
+	for i := 0; i < 5; i++ {
+		retry, _ = l.Check(List, "token:abc", now)
+		assert.Equal(t, time.Duration(0), retry)
+	}
+
+	// The counter is reset in the next window
+	retry, _ = l.Check(Publish, "token:abc", now.Add(time.Minute))
+	assert.Equal(t, time.Duration(0), retry)
+}
+
+func TestMemoryCounterPurge(t *testing.T) {
+	c := NewMemoryCounter().(*memoryCounter)
+	count, err := c.Increment("foo", time.Millisecond)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, count)
+	time.Sleep(2 * time.Millisecond)
+	count, _ = c.Increment("bar", time.Millisecond)
+	assert.EqualValues(t, 1, count)
+	assert.Len(t, c.hits, 1)
+}
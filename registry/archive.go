@@ -0,0 +1,182 @@
+package registry
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+	tarMagic      = []byte("ustar")
+)
+
+// archiveContentTypes are the Content-Types used for the archives of each
+// format, the first one being the canonical one.
+var archiveContentTypes = map[string][]string{
+	base.ArchiveGzip: {"application/gzip", "application/x-gzip", "application/x-compressed-tar", "application/x-tgz"},
+	base.ArchiveZstd: {"application/zstd"},
+	base.ArchiveTar:  {"application/x-tar"},
+	base.ArchiveZip:  {"application/zip", "application/x-zip-compressed", "application/x-zip"},
+}
+
+// tarMagicOffset is the position of the magic field in the header of a tar
+// file (the POSIX and GNU formats).
+const tarMagicOffset = 257
+
+// detectArchiveFormat guesses the format of an archive from its first bytes.
+// It returns an empty string if the format is unknown.
+func detectArchiveFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return base.ArchiveGzip
+	case bytes.HasPrefix(header, zstdMagic):
+		return base.ArchiveZstd
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmptyMagic):
+		return base.ArchiveZip
+	case len(header) >= tarMagicOffset+len(tarMagic) &&
+		bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return base.ArchiveTar
+	}
+	return ""
+}
+
+// archiveFormatFromContentType returns the archive format for a
+// Content-Type, or an empty string if it is not the type of a known archive.
+func archiveFormatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	for format, types := range archiveContentTypes {
+		for _, typ := range types {
+			if mediaType == typ {
+				return format
+			}
+		}
+	}
+	return ""
+}
+
+// archiveContentType returns the Content-Type to store with an archive. The
+// given Content-Type is kept if it matches the format, else the canonical
+// one of the format is used, as the servers often send the archives as
+// application/octet-stream.
+func archiveContentType(format, contentType string) string {
+	if format == "" || archiveFormatFromContentType(contentType) == format {
+		return contentType
+	}
+	return archiveContentTypes[format][0]
+}
+
+func isArchiveFormatAccepted(format string) bool {
+	if base.Config.ArchiveFormats == nil {
+		return true
+	}
+	return base.Config.ArchiveFormats[format]
+}
+
+// tarReader returns a tar reader for the archive of a version, and the format
+// of this archive. The format is detected with the magic bytes, as the
+// Content-Type sent by the servers hosting the tarballs is not reliable. The
+// Content-Type is only used when the magic bytes are not recognized, like for
+// the zip archives with a stub before their first entry.
+func tarReader(reader io.Reader, contentType string) (*tar.Reader, string, error) {
+	br := bufio.NewReaderSize(reader, 1024)
+	header, _ := br.Peek(tarMagicOffset + len(tarMagic))
+	format := detectArchiveFormat(header)
+	if format == "" {
+		format = archiveFormatFromContentType(contentType)
+	}
+	if format == "" {
+		return nil, "", fmt.Errorf("unknown archive format")
+	}
+	if !isArchiveFormatAccepted(format) {
+		return nil, "", fmt.Errorf("archive format %s is not accepted", format)
+	}
+
+	switch format {
+	case base.ArchiveGzip:
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", err
+		}
+		return tar.NewReader(gr), format, nil
+	case base.ArchiveZstd:
+		content, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, "", err
+		}
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, "", err
+		}
+		defer dec.Close()
+		decoded, err := dec.DecodeAll(content, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		return tar.NewReader(bytes.NewReader(decoded)), format, nil
+	case base.ArchiveZip:
+		content, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, "", err
+		}
+		converted, err := zipToTar(content)
+		if err != nil {
+			return nil, "", err
+		}
+		return tar.NewReader(converted), format, nil
+	default:
+		return tar.NewReader(br), format, nil
+	}
+}
+
+// zipToTar converts a zip archive to a tar, so that the versions can be read
+// the same way whatever the format of their archive.
+func zipToTar(content []byte) (io.Reader, error) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, file := range zr.File {
+		hdr, err := tar.FileInfoHeader(file.FileInfo(), "")
+		if err != nil {
+			return nil, err
+		}
+		hdr.Name = file.Name
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
@@ -0,0 +1,37 @@
+package registry
+
+import (
+	"context"
+	"sync"
+)
+
+// background counts the tasks that are executed after a version has been
+// published, like the update of the search index, the pin to IPFS or the
+// cleaning of the old versions.
+var background sync.WaitGroup
+
+// Background runs a task in a goroutine, that is waited by
+// WaitBackgroundTasks when the server is stopped.
+func Background(fn func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// WaitBackgroundTasks blocks until the background tasks are finished, or the
+// context is done.
+func WaitBackgroundTasks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// BundleAlgorithm is the algorithm of the signatures of the bundles.
+const BundleAlgorithm = "ed25519"
+
+// ErrBundleSignature is returned when the signature of a bundle can't be
+// verified.
+var ErrBundleSignature = errors.New("The signature of the bundle is invalid")
+
+// Bundle is the catalog of a space in a single document: all its applications
+// with their latest version on each channel. It can be hosted on a CDN, or
+// used to install the applications offline.
+type Bundle struct {
+	Space       string       `json:"space"`
+	GeneratedAt time.Time    `json:"generated_at"`
+	Apps        []*BundleApp `json:"apps"`
+}
+
+// BundleApp is an application of a bundle.
+type BundleApp struct {
+	Slug                 string              `json:"slug"`
+	Type                 string              `json:"type"`
+	Editor               string              `json:"editor"`
+	Name                 string              `json:"name"`
+	MaintenanceActivated bool                `json:"maintenance_activated"`
+	LatestVersions       map[string]*Version `json:"latest_versions"`
+}
+
+// SignedBundle is the document of a bundle, with the signature of its catalog.
+// The signature is made on the bytes of the catalog field, as they are
+// written in the document.
+type SignedBundle struct {
+	Catalog   json.RawMessage  `json:"catalog"`
+	Signature *BundleSignature `json:"signature,omitempty"`
+}
+
+// BundleSignature is the signature of a bundle. The key ID is the beginning of
+// the sha256 of the public key, to know which key has been used after a
+// rotation.
+type BundleSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"key_id"`
+	Value     string `json:"value"`
+}
+
+// BuildBundle returns the bundle of the space, or of the virtual space if v is
+// not nil.
+func BuildBundle(v *base.VirtualSpace, c *space.Space) (*Bundle, error) {
+	name := c.Name
+	if v != nil {
+		name = v.Name
+	}
+	if name == "" {
+		name = base.DefaultSpacePrefix.String()
+	}
+	bundle := &Bundle{
+		Space:       name,
+		GeneratedAt: time.Now().UTC(),
+		Apps:        []*BundleApp{},
+	}
+
+	rows, err := c.AppsDB().AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var app App
+		if err := rows.ScanDoc(&app); err != nil {
+			return nil, err
+		}
+		if v != nil && !v.AcceptApp(app.Slug) {
+			continue
+		}
+		entry, err := newBundleApp(v, c, &app)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry.LatestVersions) > 0 {
+			bundle.Apps = append(bundle.Apps, entry)
+		}
+	}
+	return bundle, rows.Err()
+}
+
+func newBundleApp(v *base.VirtualSpace, c *space.Space, app *App) (*BundleApp, error) {
+	latest := make(map[string]*Version)
+	for _, channel := range Channels {
+		version, err := FindLatestVersionWithOverride(v, c, app.Slug, channel)
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		version.ID = ""
+		version.Rev = ""
+		version.LegalHold = nil
+		version.Provenance = nil
+		version.Changelog = ""
+		latest[ChannelToStr(channel)] = version
+	}
+	app.LatestVersion = latest[ChannelToStr(Stable)]
+	if err := applyManifestOverwrite(v, app); err != nil {
+		return nil, err
+	}
+	return &BundleApp{
+		Slug:                 app.Slug,
+		Type:                 app.Type,
+		Editor:               app.Editor,
+		Name:                 app.Name,
+		MaintenanceActivated: app.MaintenanceActivated,
+		LatestVersions:       latest,
+	}, nil
+}
+
+// BundleKeyID returns the identifier of a public key for the signatures of
+// the bundles.
+func BundleKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// SignBundle serializes the bundle and signs it with the private key. The
+// bundle is not signed if the key is nil.
+func SignBundle(bundle *Bundle, key ed25519.PrivateKey) (*SignedBundle, error) {
+	catalog, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, err
+	}
+	signed := &SignedBundle{Catalog: catalog}
+	if key != nil {
+		signed.Signature = &BundleSignature{
+			Algorithm: BundleAlgorithm,
+			KeyID:     BundleKeyID(key.Public().(ed25519.PublicKey)),
+			Value:     base64.StdEncoding.EncodeToString(ed25519.Sign(key, catalog)),
+		}
+	}
+	return signed, nil
+}
+
+// VerifyBundle checks the signature of a bundle document with the public key,
+// and returns its catalog.
+func VerifyBundle(data []byte, pub ed25519.PublicKey) (*Bundle, error) {
+	var signed SignedBundle
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, err
+	}
+	if signed.Signature == nil || signed.Signature.Algorithm != BundleAlgorithm {
+		return nil, ErrBundleSignature
+	}
+	signature, err := base64.StdEncoding.DecodeString(signed.Signature.Value)
+	if err != nil || !ed25519.Verify(pub, signed.Catalog, signature) {
+		return nil, ErrBundleSignature
+	}
+	var bundle Bundle
+	if err := json.Unmarshal(signed.Catalog, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignBundle(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	bundle := &Bundle{
+		Space:       "__default__",
+		GeneratedAt: time.Now().UTC(),
+		Apps: []*BundleApp{{
+			Slug: "drive",
+			Type: "webapp",
+			Name: "Drive <Cozy>",
+			LatestVersions: map[string]*Version{
+				"stable": {Slug: "drive", Version: "1.2.3"},
+			},
+		}},
+	}
+
+	signed, err := SignBundle(bundle, key)
+	require.NoError(t, err)
+	assert.Equal(t, BundleKeyID(pub), signed.Signature.KeyID)
+	doc, err := json.Marshal(signed)
+	require.NoError(t, err)
+
+	verified, err := VerifyBundle(doc, pub)
+	require.NoError(t, err)
+	assert.Equal(t, "Drive <Cozy>", verified.Apps[0].Name)
+	assert.Equal(t, "1.2.3", verified.Apps[0].LatestVersions["stable"].Version)
+
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = VerifyBundle(doc, other)
+	assert.Equal(t, ErrBundleSignature, err)
+
+	unsigned, err := SignBundle(bundle, nil)
+	require.NoError(t, err)
+	assert.Nil(t, unsigned.Signature)
+	doc, err = json.Marshal(unsigned)
+	require.NoError(t, err)
+	_, err = VerifyBundle(doc, pub)
+	assert.Equal(t, ErrBundleSignature, err)
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// cacheNames returns the names used in the keys of the caches for the space:
+// its own name, and the names of the virtual spaces built on it, as they
+// cache the latest versions under their name.
+func cacheNames(c *space.Space) []string {
+	names := []string{c.Name}
+	for name, v := range base.Config.VirtualSpaces {
+		source := v.Source
+		if source == base.DefaultSpacePrefix.String() {
+			source = ""
+		}
+		if source == c.Name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// purgeChannelCaches removes the latest versions and the lists of versions of
+// the application from the caches, for the given channel and the less stable
+// ones (a stable version is also the latest beta and dev version).
+func purgeChannelCaches(c *space.Space, appSlug string, from Channel) {
+	names := cacheNames(c)
+	for _, channel := range Channels {
+		if channel < from {
+			continue
+		}
+		for _, name := range names {
+			key := base.NewKey(name, appSlug, ChannelToStr(channel))
+			base.LatestVersionsCache.Remove(key)
+			base.ListVersionsCache.Remove(key)
+		}
+	}
+}
+
+func purgeVirtualChannelCaches(virtualSpaceName, appSlug string) {
+	for _, channel := range Channels {
+		key := base.NewKey(virtualSpaceName, appSlug, ChannelToStr(channel))
+		base.LatestVersionsCache.Remove(key)
+	}
+}
+
+// PurgeAppCaches removes all the versions of the application from the caches,
+// for the space and its virtual spaces.
+func PurgeAppCaches(c *space.Space, appSlug string) error {
+	if !validSlugReg.MatchString(appSlug) {
+		return ErrAppSlugInvalid
+	}
+	purgeChannelCaches(c, appSlug, Stable)
+	return nil
+}
+
+// PurgeVirtualAppCaches removes the latest versions of the application from
+// the caches of the virtual space.
+func PurgeVirtualAppCaches(v *base.VirtualSpace, appSlug string) error {
+	if !validSlugReg.MatchString(appSlug) {
+		return ErrAppSlugInvalid
+	}
+	purgeVirtualChannelCaches(v.Name, appSlug)
+	return nil
+}
@@ -0,0 +1,150 @@
+package registry
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// maxChangelogSize is the maximal size of the changelog of a version, the
+// longer ones are truncated.
+const maxChangelogSize = 32 * 1024
+
+// maxChangelogEntries is the maximal number of versions in an aggregated
+// changelog.
+const maxChangelogEntries = 50
+
+// changelogHeadingReg matches the markdown headings, like "## [1.2.3] - 2024-01-01".
+var changelogHeadingReg = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+
+// changelogVersionReg matches the words of a heading that can be a version.
+var changelogVersionReg = regexp.MustCompile(`v?[0-9]+\.[0-9]+\.[0-9]+[0-9A-Za-z.+-]*`)
+
+// ChangelogEntry is the changelog of a version.
+type ChangelogEntry struct {
+	Version   string    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Changelog string    `json:"changelog"`
+}
+
+// isChangelogFile returns true for the CHANGELOG.md at the root of the
+// application.
+func isChangelogFile(basename, dirname string) bool {
+	return strings.EqualFold(basename, "CHANGELOG.md") && strings.Count(dirname, "/") <= 1
+}
+
+// versionChangelog returns the changelog of a version: the changes field of
+// its manifest, or else its section in the CHANGELOG.md of the tarball.
+func versionChangelog(manifest map[string]interface{}, changelogFile []byte, version string) string {
+	if changes, ok := manifest["changes"].(string); ok && strings.TrimSpace(changes) != "" {
+		return truncateChangelog(strings.TrimSpace(changes))
+	}
+	return truncateChangelog(changelogSection(string(changelogFile), version))
+}
+
+// changelogSection returns the section of a markdown changelog for a version:
+// the lines after the heading with the version, until the next heading of
+// the same level or higher.
+func changelogSection(content, version string) string {
+	version = strings.TrimPrefix(version, "v")
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	start, level := -1, 0
+	for i, line := range lines {
+		m := changelogHeadingReg.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil {
+			continue
+		}
+		if start >= 0 {
+			if len(m[1]) <= level {
+				return strings.TrimSpace(strings.Join(lines[start:i], "\n"))
+			}
+			continue
+		}
+		for _, v := range changelogVersionReg.FindAllString(m[2], -1) {
+			if strings.TrimPrefix(v, "v") == version {
+				start, level = i+1, len(m[1])
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.Join(lines[start:], "\n"))
+}
+
+func truncateChangelog(changelog string) string {
+	if len(changelog) <= maxChangelogSize {
+		return changelog
+	}
+	// Do not keep the end of a cut multi-bytes character
+	changelog = strings.ToValidUTF8(changelog[:maxChangelogSize], "")
+	return changelog + "\n…"
+}
+
+// GetChangelog returns the changelogs of the versions of an application
+// published after the since version (all of them if empty), in the given
+// channel or a more stable one, the most recent first.
+func GetChangelog(c *space.Space, appSlug, since string, channel Channel) ([]*ChangelogEntry, error) {
+	var sinceVersion *semver.Version
+	if since != "" {
+		var err error
+		if sinceVersion, err = semver.NewVersion(since); err != nil {
+			return nil, errshttp.NewError(http.StatusBadRequest,
+				"Invalid since version %q: %s", since, err)
+		}
+	}
+
+	versions, err := FindAppVersions(c, appSlug, channel, NotConcatenated)
+	if err != nil {
+		return nil, err
+	}
+	candidates := versions.Stable
+	if channel == Beta || channel == Dev {
+		candidates = append(candidates, versions.Beta...)
+	}
+	if channel == Dev {
+		candidates = append(candidates, versions.Dev...)
+	}
+
+	var newer []*semver.Version
+	for _, v := range candidates {
+		sv, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		if sinceVersion == nil || sv.GreaterThan(sinceVersion) {
+			newer = append(newer, sv)
+		}
+	}
+	sort.Slice(newer, func(i, j int) bool { return newer[i].GreaterThan(newer[j]) })
+	if len(newer) > maxChangelogEntries {
+		newer = newer[:maxChangelogEntries]
+	}
+
+	entries := make([]*ChangelogEntry, 0, len(newer))
+	for _, sv := range newer {
+		version, err := FindPublishedVersion(c, appSlug, sv.Original())
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if version.Changelog == "" {
+			continue
+		}
+		entries = append(entries, &ChangelogEntry{
+			Version:   version.Version,
+			CreatedAt: version.CreatedAt,
+			Changelog: version.Changelog,
+		})
+	}
+	return entries, nil
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// VersionsDrift is a difference between the list of the versions of an
+// application kept in the cache and the list computed from the versions
+// database.
+type VersionsDrift struct {
+	Space    string       `json:"space"`
+	Slug     string       `json:"slug"`
+	Channel  string       `json:"channel"`
+	Cached   *AppVersions `json:"cached"`
+	Expected *AppVersions `json:"expected"`
+	// Repaired is true if the cached list has been evicted, so that it will
+	// be computed again on the next request.
+	Repaired bool `json:"repaired"`
+}
+
+// CheckAppVersions recomputes the lists of the versions (stable, beta and
+// dev) of the applications of the space from the versions database, and
+// compares them with the lists in the cache. If repair is true, the lists
+// that have drifted are evicted from the cache.
+func CheckAppVersions(s *space.Space, repair bool) ([]*VersionsDrift, error) {
+	slugs, err := listAppSlugs(s)
+	if err != nil {
+		return nil, err
+	}
+	drifts := make([]*VersionsDrift, 0)
+	for _, slug := range slugs {
+		for _, channel := range Channels {
+			drift, err := checkCachedAppVersions(s, slug, channel)
+			if err != nil {
+				return nil, err
+			}
+			if drift == nil {
+				continue
+			}
+			if repair {
+				key := base.NewKey(s.Name, slug, ChannelToStr(channel))
+				base.ListVersionsCache.Remove(key)
+				drift.Repaired = true
+			}
+			drifts = append(drifts, drift)
+		}
+	}
+	return drifts, nil
+}
+
+// checkCachedAppVersions returns the drift for the versions of an application
+// in a channel, or nil if the cache is consistent with the database (or if
+// there is nothing in the cache).
+func checkCachedAppVersions(s *space.Space, slug string, channel Channel) (*VersionsDrift, error) {
+	key := base.NewKey(s.Name, slug, ChannelToStr(channel))
+	data, ok := base.ListVersionsCache.Get(key)
+	if !ok {
+		return nil, nil
+	}
+	var cached *AppVersions
+	if err := json.Unmarshal(data, &cached); err != nil {
+		cached = nil
+	}
+
+	expected, err := computeAppVersions(s, slug, channel, Concatenated)
+	if err != nil {
+		return nil, err
+	}
+	if sameAppVersions(cached, expected) {
+		return nil, nil
+	}
+	// The same cache key is used for the concatenated and not concatenated
+	// lists, so both are valid.
+	split, err := computeAppVersions(s, slug, channel, NotConcatenated)
+	if err != nil {
+		return nil, err
+	}
+	if sameAppVersions(cached, split) {
+		return nil, nil
+	}
+	return &VersionsDrift{
+		Space:    s.GetPrefix().String(),
+		Slug:     slug,
+		Channel:  ChannelToStr(channel),
+		Cached:   cached,
+		Expected: expected,
+	}, nil
+}
+
+func sameAppVersions(a, b *AppVersions) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.HasVersions == b.HasVersions &&
+		sameStrings(a.Stable, b.Stable) &&
+		sameStrings(a.Beta, b.Beta) &&
+		sameStrings(a.Dev, b.Dev)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// listAppSlugs returns the slugs of all the applications of a space,
+// including the deleted ones.
+func listAppSlugs(s *space.Space) ([]string, error) {
+	rows, err := s.AppsDB().AllDocs(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slugs := make([]string, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		slugs = append(slugs, rows.ID())
+	}
+	return slugs, rows.Err()
+}
+
+// RunVersionsConsistencyChecker checks the versions in the cache of all the
+// spaces at the given interval, and logs the drifts. It is meant to be run in
+// a goroutine by the server.
+func RunVersionsConsistencyChecker(interval time.Duration, repair bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, name := range space.GetSpacesNames() {
+			s, ok := space.GetSpace(name)
+			if !ok {
+				continue
+			}
+			log := logrus.WithFields(logrus.Fields{
+				"nspace": "consistency",
+				"space":  s.GetPrefix().String(),
+			})
+			drifts, err := CheckAppVersions(s, repair)
+			if err != nil {
+				log.WithField("error_msg", err).Error("Cannot check the versions")
+				continue
+			}
+			for _, drift := range drifts {
+				log.WithFields(logrus.Fields{
+					"slug":     drift.Slug,
+					"channel":  drift.Channel,
+					"repaired": drift.Repaired,
+				}).Warn("Versions in the cache are not consistent with the database")
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/mango"
+)
+
+// appsCursor is the position in the list of the applications, after the last
+// application of a page. It is sent to the clients as an opaque string. As
+// the slug is unique, the position is given by the value of the sort field
+// and the slug of the last application, which doesn't move when applications
+// are added or removed between two pages (unlike a number of documents to
+// skip).
+type appsCursor struct {
+	Sort  string   `json:"s"`
+	Desc  bool     `json:"d,omitempty"`
+	After []string `json:"a"`
+}
+
+// ErrInvalidCursor is used when the cursor of a list can't be decoded, or
+// doesn't match the sort of the request.
+var ErrInvalidCursor = errshttp.NewError(http.StatusBadRequest, "Invalid cursor")
+
+// parseAppsCursor decodes a cursor for a list sorted on the given field. The
+// legacy cursors, with the number of applications to skip, are still accepted
+// and returned as the skip value.
+func parseAppsCursor(cursor, sortField string, desc bool) (*appsCursor, int, error) {
+	if cursor == "" {
+		return nil, 0, nil
+	}
+	if skip, err := strconv.Atoi(cursor); err == nil {
+		if skip < 0 {
+			return nil, 0, ErrInvalidCursor
+		}
+		return nil, skip, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	var c appsCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, 0, ErrInvalidCursor
+	}
+	if c.Sort != sortField || c.Desc != desc || len(c.After) != len(cursorFields(sortField)) {
+		return nil, 0, ErrInvalidCursor
+	}
+	return &c, 0, nil
+}
+
+// newAppsCursor returns the cursor for the page after the given application.
+func newAppsCursor(app *App, sortField string, desc bool) string {
+	fields := cursorFields(sortField)
+	c := appsCursor{Sort: sortField, Desc: desc, After: make([]string, len(fields))}
+	for i, field := range fields {
+		c.After[i] = appSortValue(app, field)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// cursorFields returns the fields used to locate an application in a list
+// sorted on the given field: the sort field, and the slug to break the ties.
+func cursorFields(sortField string) []string {
+	if sortField == "slug" {
+		return []string{"slug"}
+	}
+	return []string{sortField, "slug"}
+}
+
+func appSortValue(app *App, field string) string {
+	switch field {
+	case "type":
+		return app.Type
+	case "editor":
+		return app.Editor
+	case "name":
+		return app.Name
+	case "created_at":
+		// Same format as in the JSON documents, to keep the order of CouchDB
+		return app.CreatedAt.Format(time.RFC3339Nano)
+	case "popularity":
+		return strconv.FormatInt(app.Popularity, 10)
+	default:
+		return app.Slug
+	}
+}
+
+// cursorValue returns the value of a field in the cursor, with the type of
+// the field in the JSON documents, for the comparisons of CouchDB.
+func cursorValue(field, value string) interface{} {
+	if field == "popularity" {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+// where adds the conditions to the query to select the applications after
+// the cursor.
+func (c *appsCursor) where(query *mango.Query) {
+	op := mango.Gt
+	if c.Desc {
+		op = mango.Lt
+	}
+	fields := cursorFields(c.Sort)
+	first := cursorValue(fields[0], c.After[0])
+	if len(fields) == 1 {
+		query.WhereAny([]mango.Cond{{Field: fields[0], Op: op, Value: first}})
+		return
+	}
+	query.WhereAny(
+		[]mango.Cond{{Field: fields[0], Op: op, Value: first}},
+		[]mango.Cond{
+			{Field: fields[0], Op: mango.Eq, Value: first},
+			{Field: fields[1], Op: op, Value: c.After[1]},
+		},
+	)
+}
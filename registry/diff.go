@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/mango"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// ListingDiff summarizes the changes in the list of the applications of a
+// space between two dates.
+type ListingDiff struct {
+	From             time.Time          `json:"from"`
+	To               time.Time          `json:"to"`
+	AppsAdded        []string           `json:"apps_added"`
+	AppsRemoved      []string           `json:"apps_removed"`
+	VersionsReleased []*ReleasedVersion `json:"versions_released"`
+}
+
+// ReleasedVersion is a version that has been released in the window of a
+// listing diff.
+type ReleasedVersion struct {
+	Slug      string    `json:"slug"`
+	Version   string    `json:"version"`
+	Channel   string    `json:"channel"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetListingDiff returns the applications added and removed, and the versions
+// released in the given space between from (included) and to (excluded). The
+// added applications are looked for in the apps database, so an application
+// created and then removed in the window is only in the removed ones.
+func GetListingDiff(c *space.Space, from, to time.Time) (*ListingDiff, error) {
+	diff := &ListingDiff{
+		From:             from,
+		To:               to,
+		AppsAdded:        []string{},
+		AppsRemoved:      []string{},
+		VersionsReleased: []*ReleasedVersion{},
+	}
+
+	var err error
+	if diff.AppsAdded, err = findAppsCreatedBetween(c, from, to); err != nil {
+		return nil, err
+	}
+	if diff.AppsRemoved, err = space.FindRemovalsBetween(c, from, to); err != nil {
+		return nil, err
+	}
+	if diff.VersionsReleased, err = findVersionsReleasedBetween(c, from, to); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+func findAppsCreatedBetween(c *space.Space, from, to time.Time) ([]string, error) {
+	useIndex, err := space.RequireAppsIndex("created_at", "listing diff", space.AppsIndexes["created_at"]...)
+	if err != nil {
+		return nil, err
+	}
+	slugs := []string{}
+	skip := 0
+	for {
+		req, err := mango.New(useIndex).
+			Where("created_at", mango.Gte, from).
+			Where("created_at", mango.Lt, to).
+			Fields("slug").
+			Sort("created_at", false).
+			Sort("slug", false).
+			Sort("editor", false).
+			Sort("type", false).
+			Skip(skip).
+			Limit(maxLimit).
+			Build()
+		if err != nil {
+			return nil, err
+		}
+		rows, err := c.AppsDB().Find(context.Background(), req)
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for rows.Next() {
+			var doc struct {
+				Slug string `json:"slug"`
+			}
+			if err := rows.ScanDoc(&doc); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			slugs = append(slugs, doc.Slug)
+			count++
+		}
+		space.CheckIndexWarning(c, "listing diff", rows)
+		rows.Close()
+		if count < maxLimit {
+			return slugs, nil
+		}
+		skip += count
+	}
+}
+
+func findVersionsReleasedBetween(c *space.Space, from, to time.Time) ([]*ReleasedVersion, error) {
+	db := c.VersDB()
+	versions := []*ReleasedVersion{}
+	for _, channel := range Channels {
+		channelStr := ChannelToStr(channel)
+		rows, err := db.Query(context.Background(), "by-date", channelStr, map[string]interface{}{
+			"startkey":      from.Format(time.RFC3339Nano),
+			"endkey":        to.Format(time.RFC3339Nano),
+			"inclusive_end": false,
+			"include_docs":  true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var version *Version
+			if err := rows.ScanDoc(&version); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			versions = append(versions, &ReleasedVersion{
+				Slug:      version.Slug,
+				Version:   version.Version,
+				Channel:   channelStr,
+				CreatedAt: version.CreatedAt,
+			})
+		}
+		rows.Close()
+	}
+	return versions, nil
+}
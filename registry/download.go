@@ -0,0 +1,459 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/h2non/filetype"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRetryAfter caps the delays asked by the servers hosting the tarballs in
+// their Retry-After headers.
+const maxRetryAfter = 2 * time.Minute
+
+// DownloadProgress tells how much of a tarball has been downloaded, for the
+// downloads in progress.
+type DownloadProgress struct {
+	Space   string `json:"space"`
+	Version string `json:"version"`
+	URL     string `json:"url"`
+	// Read is the number of bytes already downloaded.
+	Read int64 `json:"read"`
+	// Total is the size announced by the server, or -1 if it is unknown.
+	Total     int64     `json:"total"`
+	StartedAt time.Time `json:"started_at"`
+	// Job is the identifier of the job of the publication, if it is
+	// asynchronous.
+	Job string `json:"job,omitempty"`
+}
+
+type trackedDownload struct {
+	progress DownloadProgress
+	read     int64 // accessed atomically
+	// ctx is the context of the publication, where the progress of its job
+	// is reported.
+	ctx context.Context
+}
+
+func (t *trackedDownload) Write(p []byte) (int, error) {
+	read := atomic.AddInt64(&t.read, int64(len(p)))
+	if t.progress.Job != "" {
+		downloads.Lock()
+		total := t.progress.Total
+		downloads.Unlock()
+		jobs.ReportProgress(t.ctx, read, total)
+	}
+	return len(p), nil
+}
+
+var downloads struct {
+	sync.Mutex
+	tracked map[*trackedDownload]struct{}
+}
+
+// trackDownload registers a download in progress. The returned function must
+// be called when the download is finished. When the publication runs in a
+// job, the download is linked to it, and its progress is reported on the
+// job.
+func trackDownload(ctx context.Context, progress DownloadProgress) (*trackedDownload, func()) {
+	t := &trackedDownload{progress: progress, ctx: ctx}
+	t.progress.StartedAt = time.Now().UTC()
+	t.progress.Job = jobs.IDFromContext(ctx)
+	downloads.Lock()
+	if downloads.tracked == nil {
+		downloads.tracked = make(map[*trackedDownload]struct{})
+	}
+	downloads.tracked[t] = struct{}{}
+	downloads.Unlock()
+	return t, func() {
+		downloads.Lock()
+		delete(downloads.tracked, t)
+		downloads.Unlock()
+	}
+}
+
+// progressReader returns a reader that reports the bytes read on the tracked
+// download. The offset is the number of bytes already downloaded, when the
+// download is resumed.
+func (t *trackedDownload) progressReader(r io.Reader, offset, length int64) io.Reader {
+	total := int64(-1)
+	if length >= 0 {
+		total = offset + length
+	}
+	downloads.Lock()
+	t.progress.Total = total
+	downloads.Unlock()
+	atomic.StoreInt64(&t.read, offset)
+	return io.TeeReader(r, t)
+}
+
+// GetDownloads returns the progress of the downloads of tarballs in progress,
+// the oldest first.
+func GetDownloads() []DownloadProgress {
+	downloads.Lock()
+	defer downloads.Unlock()
+	list := make([]DownloadProgress, 0, len(downloads.tracked))
+	for t := range downloads.tracked {
+		p := t.progress
+		p.Read = atomic.LoadInt64(&t.read)
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].StartedAt.Before(list[j].StartedAt)
+	})
+	return list
+}
+
+// GetJobDownload returns the progress of the download in progress on this
+// instance for the given job, if any. It is more recent than the progress
+// saved on the job.
+func GetJobDownload(jobID string) (DownloadProgress, bool) {
+	downloads.Lock()
+	defer downloads.Unlock()
+	for t := range downloads.tracked {
+		if t.progress.Job == jobID {
+			p := t.progress
+			p.Read = atomic.LoadInt64(&t.read)
+			return p, true
+		}
+	}
+	return DownloadProgress{}, false
+}
+
+// errTooBig is returned when a tarball is bigger than the maximal size of the
+// applications of its space.
+func errTooBig(url string, maxSize int64) error {
+	return errshttp.NewError(http.StatusRequestEntityTooLarge,
+		"The tarball of %s is bigger than the maximal size of %d bytes", url, maxSize)
+}
+
+// spool copies a tarball to a temporary file, computing its sha256 on the
+// way, so that the big applications are not kept in memory. The copy fails
+// with errTooBig after maxSize bytes (no limit if maxSize <= 0). The returned
+// file is at its beginning, and must be released with removeTempFile.
+func spool(r io.Reader, url string, maxSize int64) (file *os.File, size int64, sum []byte, err error) {
+	file, err = ioutil.TempFile("", "cozy-registry-tarball-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+	h := sha256.New()
+	size, err = io.Copy(io.MultiWriter(file, h), r)
+	if err == nil && maxSize > 0 && size > maxSize {
+		err = errTooBig(url, maxSize)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTempFile(file)
+		return nil, 0, nil, err
+	}
+	return file, size, h.Sum(nil), nil
+}
+
+// removeTempFile closes and removes a temporary file.
+func removeTempFile(file *os.File) {
+	if file == nil {
+		return
+	}
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// downloadRequest fetches a tarball and checks its checksum. The tarball is
+// streamed to a temporary file, that the caller must release with
+// removeTempFile, and the download is aborted if it is bigger than maxSize.
+//
+// The failed attempts are retried for the network errors and the 408, 429
+// and 5xx responses, after the delay of the Retry-After header or with an
+// exponential backoff (see the downloads section of the configuration). When
+// the server supports the ranges, the download is resumed where it stopped.
+// Each attempt is aborted after the timeout (if positive), and the download
+// is aborted when the context is canceled. The progress is reported on
+// tracked, if not nil.
+func downloadRequest(ctx context.Context, timeout time.Duration, rawURL string, shasum string, maxSize int64, tracked *trackedDownload) (file *os.File, contentType string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if u.Scheme == "file" {
+		f, err := os.Open(u.EscapedPath())
+		if err != nil {
+			return nil, "", err
+		}
+		defer f.Close()
+		if file, _, _, err = spool(f, rawURL, maxSize); err != nil {
+			return nil, "", err
+		}
+		// Find the mimetype
+		head := make([]byte, 262)
+		n, _ := file.ReadAt(head, 0)
+		kind, _ := filetype.Match(head[:n])
+		contentType = kind.MIME.Value
+	} else {
+		d := &download{url: rawURL, maxSize: maxSize, tracked: tracked}
+		if err = d.run(ctx, timeout); err != nil {
+			removeTempFile(d.file)
+			return nil, "", err
+		}
+		file, contentType = d.file, d.contentType
+	}
+
+	if err = checkShasum(file, shasum); err != nil {
+		removeTempFile(file)
+		return nil, "", err
+	}
+	return file, contentType, nil
+}
+
+// checkShasum compares the sha256 of a file with the expected one, and puts
+// the file back at its beginning.
+func checkShasum(file *os.File, shasum string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	e, _ := hex.DecodeString(shasum)
+	if !bytes.Equal(e, h.Sum(nil)) {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Checksum does not match the calculated one (expecting %q, got %q)", shasum, hex.EncodeToString(h.Sum(nil)))
+	}
+	return nil
+}
+
+// download is a download of a tarball over HTTP, in several attempts if
+// needed. The downloaded bytes are kept in a temporary file between the
+// attempts.
+type download struct {
+	url         string
+	maxSize     int64
+	tracked     *trackedDownload
+	file        *os.File
+	written     int64
+	contentType string
+	// validator is the ETag or the Last-Modified date of the tarball, used
+	// to check that it has not changed when the download is resumed.
+	validator string
+}
+
+// retryableError is a failed attempt of download that can be retried, after
+// the delay asked by the server if any.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// run makes the attempts of the download, until one succeeds or fails with an
+// error that can't be retried.
+func (d *download) run(ctx context.Context, timeout time.Duration) error {
+	backoff := base.Config.DownloadBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 1; ; attempt++ {
+		resumeFrom := d.written
+		err := d.fetch(ctx, timeout)
+		if err == nil {
+			_, err = d.file.Seek(0, io.SeekStart)
+			return err
+		}
+		retryable, ok := err.(*retryableError)
+		if !ok {
+			return err
+		}
+		if ctx.Err() != nil || attempt > base.Config.DownloadRetries {
+			return retryable.err
+		}
+
+		delay := backoff
+		if retryable.retryAfter > 0 {
+			delay = retryable.retryAfter
+		}
+		base.Logger(ctx).WithFields(logrus.Fields{
+			"nspace":      "download",
+			"url":         d.url,
+			"attempt":     attempt,
+			"resume_from": resumeFrom,
+			"downloaded":  d.written,
+			"delay":       delay.String(),
+			"error_msg":   retryable.err,
+		}).Warn("Download of a tarball failed, retrying")
+		select {
+		case <-ctx.Done():
+			return retryable.err
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+// fetch makes an attempt of download. It asks for the bytes after the ones
+// already downloaded, and starts from the beginning when the server does not
+// support the ranges or when the tarball has changed.
+func (d *download) fetch(ctx context.Context, timeout time.Duration) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: %s", d.url, err)
+	}
+	resuming := d.written > 0
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+
+	resp, err := versionClient.Do(req)
+	if err != nil && isPrivateAddressError(err) {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: %s", d.url, errPrivateAddress)
+	}
+	if err != nil {
+		return &retryableError{err: errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: %s", d.url, err)}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && resuming && rangeStart(resp) == d.written:
+		// The download continues where it stopped
+	case resp.StatusCode == http.StatusOK:
+		if err := d.restart(resp); err != nil {
+			return err
+		}
+	default:
+		err := errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: server responded with code %d",
+			d.url, resp.StatusCode)
+		switch {
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+			// The tarball has changed, the next attempt starts again
+			d.written = 0
+			return &retryableError{err: err}
+		case resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests ||
+			resp.StatusCode >= 500:
+			return &retryableError{err: err, retryAfter: retryAfter(resp)}
+		}
+		return err
+	}
+
+	var body io.Reader = resp.Body
+	if d.maxSize > 0 {
+		body = io.LimitReader(body, d.maxSize+1-d.written)
+	}
+	if d.tracked != nil {
+		body = d.tracked.progressReader(body, d.written, resp.ContentLength)
+	}
+	n, err := io.Copy(d.file, body)
+	d.written += n
+	if d.maxSize > 0 && d.written > d.maxSize {
+		return errTooBig(d.url, d.maxSize)
+	}
+	if err != nil {
+		return &retryableError{err: errshttp.NewError(http.StatusUnprocessableEntity,
+			"Could not reach version on specified url %s: %s", d.url, err)}
+	}
+	return nil
+}
+
+// restart prepares the temporary file for a download from the beginning.
+func (d *download) restart(resp *http.Response) error {
+	// No need to download a tarball that is announced as too big
+	if d.maxSize > 0 && resp.ContentLength > d.maxSize {
+		return errTooBig(d.url, d.maxSize)
+	}
+	if d.file == nil {
+		file, err := ioutil.TempFile("", "cozy-registry-tarball-")
+		if err != nil {
+			return err
+		}
+		d.file = file
+	} else {
+		if err := d.file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := d.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	d.written = 0
+	d.contentType = resp.Header.Get("Content-Type")
+	d.validator = ""
+	// Only a strong ETag can be used to resume a download
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		d.validator = etag
+	} else if resp.Header.Get("Accept-Ranges") == "bytes" {
+		d.validator = resp.Header.Get("Last-Modified")
+	}
+	return nil
+}
+
+// rangeStart returns the first byte of a 206 Partial Content response, or -1.
+func rangeStart(resp *http.Response) int64 {
+	var start, end, size int64
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		if _, err := fmt.Sscanf(cr, "bytes %d-%d/*", &start, &end); err != nil {
+			return -1
+		}
+	}
+	return start
+}
+
+// retryAfter returns the delay given by the Retry-After header of the
+// response (in seconds or as a date), or 0.
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(header); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		delay = time.Until(date)
+	}
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay
+}
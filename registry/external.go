@@ -0,0 +1,153 @@
+package registry
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/client"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// externalTimeout is the timeout of the requests to the registries of the
+// external applications.
+const externalTimeout = 10 * time.Second
+
+// ExternalSource is the registry where the versions of an external
+// application are hosted. The versions are not published on this registry:
+// they are fetched from the other registry when they are asked, and cached
+// for a few minutes.
+type ExternalSource struct {
+	// URL is the base URL of the other registry, like
+	// https://registry.example.org/.
+	URL string `json:"url"`
+	// Space is the space of the application on the other registry (the
+	// default space if empty).
+	Space string `json:"space,omitempty"`
+	// Slug is the slug of the application on the other registry, if it is
+	// not the same.
+	Slug string `json:"slug,omitempty"`
+}
+
+// ErrExternalSourceInvalid is returned when the URL of an external source is
+// not a valid HTTP(S) URL.
+var ErrExternalSourceInvalid = errshttp.NewError(http.StatusBadRequest,
+	"The URL of the external source must be an absolute http or https URL")
+
+func (s *ExternalSource) client() (*client.Client, error) {
+	cl, err := client.New(s.URL, s.Space, "")
+	if err != nil {
+		return nil, err
+	}
+	cl.HTTPClient = &http.Client{Timeout: externalTimeout}
+	cl.Retries = 1
+	return cl, nil
+}
+
+func (s *ExternalSource) slug(app *App) string {
+	if s.Slug != "" {
+		return s.Slug
+	}
+	return app.Slug
+}
+
+// SetAppExternalSource makes an application external, with the registry where
+// its versions are hosted, or a normal application again if source is nil.
+func SetAppExternalSource(c *space.Space, appSlug string, source *ExternalSource) (*App, error) {
+	if source != nil {
+		u, err := url.Parse(source.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, ErrExternalSourceInvalid
+		}
+		if source.Slug != "" && !validSlugReg.MatchString(source.Slug) {
+			return nil, ErrAppSlugInvalid
+		}
+	}
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	app.External = source
+	if _, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return nil, err
+	}
+	purgeChannelCaches(c, app.Slug, Stable)
+	for _, channel := range Channels {
+		key := base.NewKey(c.Name, app.Slug, "external/"+ChannelToStr(channel)+"/latest")
+		base.LatestVersionsCache.Remove(key)
+	}
+	return app, nil
+}
+
+// FindExternalVersion returns a version of an external application, fetched
+// from the registry where it is hosted.
+func FindExternalVersion(c *space.Space, app *App, version string) (*Version, error) {
+	source := app.External
+	key := base.NewKey(c.Name, app.Slug, "external/"+version)
+	return fetchExternalVersion(c, app, key, func(ctx context.Context, cl *client.Client) (json.RawMessage, error) {
+		return cl.GetVersionDocument(ctx, source.slug(app), version)
+	})
+}
+
+// FindExternalLatestVersion returns the latest version of an external
+// application for a channel, fetched from the registry where it is hosted.
+func FindExternalLatestVersion(c *space.Space, app *App, channel Channel) (*Version, error) {
+	source := app.External
+	channelStr := ChannelToStr(channel)
+	key := base.NewKey(c.Name, app.Slug, "external/"+channelStr+"/latest")
+	return fetchExternalVersion(c, app, key, func(ctx context.Context, cl *client.Client) (json.RawMessage, error) {
+		return cl.GetLatestVersionDocument(ctx, source.slug(app), channelStr)
+	})
+}
+
+// fetchExternalVersion returns the version document from the cache, or from
+// the other registry. The document is kept as it has been sent by the other
+// registry, except for the slug and the editor that are the ones of the local
+// application.
+func fetchExternalVersion(c *space.Space, app *App, key base.Key, fetch func(context.Context, *client.Client) (json.RawMessage, error)) (*Version, error) {
+	doc, ok := base.LatestVersionsCache.Get(key)
+	if !ok {
+		cl, err := app.External.client()
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), externalTimeout)
+		defer cancel()
+		raw, err := fetch(ctx, cl)
+		if client.IsNotFound(err) {
+			return nil, ErrVersionNotFound
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"nspace":    "external",
+				"space":     c.Name,
+				"slug":      app.Slug,
+				"source":    app.External.URL,
+				"error_msg": err,
+			}).Warn("Cannot fetch the version from the external source")
+			return nil, errshttp.NewError(http.StatusBadGateway,
+				"Cannot fetch the version from the external source of the application")
+		}
+		doc = base.Value(raw)
+		base.LatestVersionsCache.Add(key, doc)
+	}
+
+	var ver Version
+	if err := json.Unmarshal(doc, &ver); err != nil {
+		return nil, errshttp.NewError(http.StatusBadGateway,
+			"Invalid version from the external source of the application")
+	}
+	sum := sha256.Sum256(doc)
+	ver.ID = ""
+	ver.Rev = "external-" + hex.EncodeToString(sum[:8])
+	ver.Slug = app.Slug
+	ver.Editor = app.Editor
+	return &ver, nil
+}
@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// facetsTTL is the duration after which the facets of a space are computed
+// again, like the search index.
+const facetsTTL = 10 * time.Minute
+
+// Facet is a value found in the manifests of the applications, with the
+// number of applications that have it.
+type Facet struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// appFacets are the values of the latest stable version of an application
+// that are aggregated.
+type appFacets struct {
+	Type       string
+	Categories []string
+	DataTypes  []string
+}
+
+type spaceFacets struct {
+	apps    map[string]appFacets
+	builtAt time.Time
+}
+
+var (
+	facetsMu sync.Mutex
+	facets   = make(map[string]*spaceFacets)
+)
+
+// facetsManifest is the subset of the manifest used for the facets.
+type facetsManifest struct {
+	Categories []string `json:"categories"`
+	DataTypes  []string `json:"data_types"`
+}
+
+func newAppFacets(app *App, version *Version) appFacets {
+	f := appFacets{Type: app.Type}
+	if version == nil {
+		return f
+	}
+	var manifest facetsManifest
+	if err := json.Unmarshal(version.Manifest, &manifest); err == nil {
+		f.Categories = manifest.Categories
+		f.DataTypes = manifest.DataTypes
+	}
+	return f
+}
+
+func buildFacets(c *space.Space) (map[string]appFacets, error) {
+	apps := make(map[string]appFacets)
+	cursor := ""
+	for {
+		next, list, err := GetAppsList(nil, c, &AppsListOptions{
+			Limit:                maxLimit,
+			Cursor:               cursor,
+			LatestVersionChannel: Stable,
+			VersionsChannel:      Stable,
+			ExcludeUnlisted:      true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range list {
+			apps[app.Slug] = newAppFacets(app, app.LatestVersion)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return apps, nil
+}
+
+func getFacets(c *space.Space) (map[string]appFacets, error) {
+	facetsMu.Lock()
+	defer facetsMu.Unlock()
+	if f, ok := facets[c.Name]; ok && time.Since(f.builtAt) < facetsTTL {
+		return f.apps, nil
+	}
+	apps, err := buildFacets(c)
+	if err != nil {
+		return nil, err
+	}
+	facets[c.Name] = &spaceFacets{apps: apps, builtAt: time.Now()}
+	return apps, nil
+}
+
+// updateFacets updates the facets of the space for the given app, if they
+// have already been computed.
+func updateFacets(c *space.Space, appSlug string) {
+	facetsMu.Lock()
+	_, ok := facets[c.Name]
+	facetsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	app, err := findApp(c, appSlug)
+	if err == ErrAppNotFound || (err == nil && app.IsUnlisted()) {
+		facetsMu.Lock()
+		if f, ok := facets[c.Name]; ok {
+			delete(f.apps, appSlug)
+		}
+		facetsMu.Unlock()
+		return
+	}
+	var version *Version
+	if err == nil {
+		version, err = FindLatestVersion(c, appSlug, Stable)
+		if err == ErrVersionNotFound {
+			err = nil
+		}
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "facets",
+			"space":     c.Name,
+			"slug":      appSlug,
+			"error_msg": err,
+		}).Warn()
+		return
+	}
+	facetsMu.Lock()
+	if f, ok := facets[c.Name]; ok {
+		f.apps[appSlug] = newAppFacets(app, version)
+	}
+	facetsMu.Unlock()
+}
+
+// countFacets aggregates the values returned by pick for the applications of
+// the space accepted by the virtual space (if any), sorted by name.
+func countFacets(v *base.VirtualSpace, c *space.Space, pick func(appFacets) []string) ([]Facet, error) {
+	apps, err := getFacets(c)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	facetsMu.Lock()
+	for slug, app := range apps {
+		if v != nil && !v.AcceptApp(slug) {
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, name := range pick(app) {
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			counts[name]++
+		}
+	}
+	facetsMu.Unlock()
+
+	list := make([]Facet, 0, len(counts))
+	for name, count := range counts {
+		list = append(list, Facet{Name: name, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// GetCategories returns the categories found in the latest stable versions of
+// the applications, with the number of applications in each category.
+func GetCategories(v *base.VirtualSpace, c *space.Space) ([]Facet, error) {
+	return countFacets(v, c, func(app appFacets) []string {
+		return app.Categories
+	})
+}
+
+// GetKonnectorsDataTypes returns the data types found in the latest stable
+// versions of the konnectors, with the number of konnectors for each type.
+func GetKonnectorsDataTypes(v *base.VirtualSpace, c *space.Space) ([]Facet, error) {
+	return countFacets(v, c, func(app appFacets) []string {
+		if app.Type != "konnector" {
+			return nil
+		}
+		return app.DataTypes
+	})
+}
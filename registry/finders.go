@@ -7,14 +7,21 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/asset"
 	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/mango"
+	"github.com/cozy/cozy-apps-registry/slowlog"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/go-kivik/kivik/v3"
 	"github.com/ncw/swift"
@@ -28,13 +35,6 @@ var validFilters = []string{
 	"reject",
 }
 
-var validSorts = []string{
-	"slug",
-	"type",
-	"editor",
-	"created_at",
-}
-
 // ConcatChannels type
 type ConcatChannels bool
 
@@ -61,8 +61,10 @@ func findApp(c *space.Space, appSlug string) (*App, error) {
 	var doc *App
 	var err error
 
+	ctx, cancel := base.DocumentContext()
+	defer cancel()
 	db := c.AppsDB()
-	row := db.Get(context.Background(), getAppID(appSlug))
+	row := db.Get(ctx, getAppID(appSlug))
 	if err = row.ScanDoc(&doc); err != nil {
 		if kivik.StatusCode(err) == http.StatusNotFound {
 			return nil, ErrAppNotFound
@@ -89,6 +91,12 @@ func FindApp(v *base.VirtualSpace, c *space.Space, appSlug string, channel Chann
 	}
 	doc.LatestVersion = version
 	doc.Label = calculateAppLabel(doc, doc.LatestVersion)
+	if err = applyMaintenanceOverwrites(v, []*App{doc}); err != nil {
+		return nil, err
+	}
+	if err = applyManifestOverwrite(v, doc); err != nil {
+		return nil, err
+	}
 
 	return doc, nil
 }
@@ -100,6 +108,40 @@ type Attachment struct {
 	ContentLength string
 }
 
+// OpenVersionTarball returns the tarball archived by the registry when the
+// version was published. The content is streamed from the storage when it is
+// possible, and it is an io.ReadCloser that must be closed by the caller.
+func OpenVersionTarball(c *space.Space, version *Version) (*Attachment, error) {
+	u, err := url.Parse(version.URL)
+	if err != nil {
+		return nil, err
+	}
+	filename := path.Base(u.Path)
+
+	var content io.ReadCloser
+	var headers map[string]string
+	if shasum, ok := version.AttachmentReferences[filename]; ok {
+		content, headers, err = base.OpenFile(base.Storage, asset.AssetContainerName, shasum)
+	} else {
+		fp := path.Join(version.Slug, version.Version, filename)
+		content, headers, err = base.OpenFile(base.Storage, c.GetPrefix(), fp)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	etag := headers["Etag"]
+	if version.Sha256 != "" {
+		etag = `"` + version.Sha256 + `"`
+	}
+	return &Attachment{
+		ContentType:   headers["Content-Type"],
+		Content:       content,
+		Etag:          etag,
+		ContentLength: headers["Content-Length"],
+	}, nil
+}
+
 func FindAppAttachment(c *space.Space, appSlug, filename string, channel Channel) (*Attachment, error) {
 	if !validSlugReg.MatchString(appSlug) {
 		return nil, ErrAppSlugInvalid
@@ -113,6 +155,18 @@ func FindAppAttachment(c *space.Space, appSlug, filename string, channel Channel
 	return FindVersionAttachment(c, ver, filename)
 }
 
+// FindAppAttachmentInChannels returns the attachment of the latest version of
+// the application in the first of the channels that has a version.
+func FindAppAttachmentInChannels(c *space.Space, appSlug, filename string, channels []Channel) (*Attachment, error) {
+	for _, ch := range channels {
+		att, err := FindAppAttachment(c, appSlug, filename, ch)
+		if err != ErrVersionNotFound {
+			return att, err
+		}
+	}
+	return nil, ErrVersionNotFound
+}
+
 func FindVersionAttachment(c *space.Space, version *Version, filename string) (*Attachment, error) {
 	var headers swift.Headers
 	var shasum, contentType string
@@ -147,7 +201,7 @@ func FindVersionAttachment(c *space.Space, version *Version, filename string) (*
 	// time (except when the ID is missing on the version, which is the case
 	// when the version was loaded via FindLatestVersion).
 	if !ok && version.ID != "" {
-		go func() {
+		Background(func() {
 			err := MoveAssetToGlobalDatabase(c, version, fileContent, filename, contentType)
 			if err != nil {
 				log := logrus.WithFields(logrus.Fields{
@@ -160,7 +214,7 @@ func FindVersionAttachment(c *space.Space, version *Version, filename string) (*
 				})
 				log.Error()
 			}
-		}()
+		})
 	}
 
 	content := bytes.NewReader(fileContent)
@@ -220,8 +274,10 @@ func findVersion(appSlug, version string, dbs ...*kivik.DB) (*Version, error) {
 		return nil, ErrVersionInvalid
 	}
 
+	ctx, cancel := base.DocumentContext()
+	defer cancel()
 	for _, db := range dbs {
-		row := db.Get(context.Background(), getVersionID(appSlug, version))
+		row := db.Get(ctx, getVersionID(appSlug, version))
 
 		var doc *Version
 		err := row.ScanDoc(&doc)
@@ -255,14 +311,23 @@ func FindVersion(c *space.Space, appSlug, version string) (*Version, error) {
 	return findVersion(appSlug, version, c.VersDB(), c.PendingVersDB())
 }
 
-func versionViewQuery(c *space.Space, db *kivik.DB, appSlug, channel string, opts map[string]interface{}) (*kivik.Rows, error) {
-	rows, err := db.Query(context.Background(), space.VersViewDocName(appSlug), channel, opts)
+// versionViewQuery queries the versions of an application on a channel, in
+// the versions view shared by all the applications. The context must not be
+// canceled before the rows have been read.
+func versionViewQuery(ctx context.Context, c *space.Space, db *kivik.DB, appSlug, channel string, opts map[string]interface{}) (*kivik.Rows, error) {
+	descending, _ := opts["descending"].(bool)
+	for k, v := range space.VersionsRange(appSlug, channel, descending) {
+		opts[k] = v
+	}
+	finished := slowlog.Start(slowlog.CouchDB, "query", c.Name, space.VersionsViewDoc+"/"+appSlug+"/"+channel)
+	rows, err := db.Query(ctx, space.VersionsViewDoc, space.VersionsView, opts)
+	finished()
 	if err != nil {
 		if kivik.StatusCode(err) == http.StatusNotFound {
-			if err = space.CreateVersionsViews(c, db, appSlug); err != nil {
+			if err = space.CreateVersionsView(db); err != nil {
 				return nil, err
 			}
-			return versionViewQuery(c, db, appSlug, channel, opts)
+			return db.Query(ctx, space.VersionsViewDoc, space.VersionsView, opts)
 		}
 		return nil, err
 	}
@@ -282,7 +347,11 @@ func FindLastsVersionsSince(c *space.Space, appSlug, channel string, date time.T
 		"include_docs": true,
 	}
 
-	rows, err := db.Query(context.Background(), "by-date", channel, options)
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	finished := slowlog.Start(slowlog.CouchDB, "query", c.Name, "by-date/"+channel)
+	rows, err := db.Query(ctx, "by-date", channel, options)
+	finished()
 	if err != nil {
 		return nil, err
 	}
@@ -439,6 +508,72 @@ func FindLatestVersion(c *space.Space, appSlug string, channel Channel) (*Versio
 	return FindLatestVersionWithOverride(nil, c, appSlug, channel)
 }
 
+// MaxLatestVersions is the maximal number of applications that can be asked
+// in a single request for their latest versions.
+const MaxLatestVersions = 200
+
+// LatestVersionQuery is an application and a channel, for FindLatestVersions.
+type LatestVersionQuery struct {
+	Slug    string `json:"slug"`
+	Channel string `json:"channel"`
+}
+
+// LatestVersionResult is the latest version for a LatestVersionQuery, or the
+// error if there is no such version.
+type LatestVersionResult struct {
+	Slug    string
+	Channel string
+	Version *Version
+	Err     error
+}
+
+// FindLatestVersions returns the latest versions of several applications, in
+// the order of the queries. The versions are looked up in parallel, and an
+// error for an application doesn't stop the others.
+func FindLatestVersions(v *base.VirtualSpace, c *space.Space, queries []LatestVersionQuery) []*LatestVersionResult {
+	const parallelLatestFinder = 8
+	results := make([]*LatestVersionResult, len(queries))
+	sem := make(chan struct{}, parallelLatestFinder)
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		result := &LatestVersionResult{Slug: query.Slug, Channel: query.Channel}
+		if result.Channel == "" {
+			result.Channel = ChannelToStr(Stable)
+		}
+		results[i] = result
+		channel, err := StrToChannel(result.Channel)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		if !validSlugReg.MatchString(query.Slug) {
+			result.Err = ErrAppSlugInvalid
+			continue
+		}
+		if v != nil && !v.AcceptApp(query.Slug) {
+			result.Err = ErrAppNotFound
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// The views of the versions are created on the fly, so the
+			// application must exist before querying them
+			if _, err := findApp(c, result.Slug); err != nil {
+				result.Err = err
+				return
+			}
+			result.Version, result.Err = FindLatestVersionWithOverride(v, c, result.Slug, channel)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
 func FindLatestVersionWithOverride(v *base.VirtualSpace, c *space.Space, appSlug string, channel Channel) (*Version, error) {
 	// Try to get the latest version from the cache
 	name := c.Name
@@ -463,8 +598,10 @@ func FindLatestVersionCacheMiss(v *base.VirtualSpace, c *space.Space, appSlug st
 
 	channelStr := ChannelToStr(channel)
 
+	ctx, cancel := base.DocumentContext()
+	defer cancel()
 	db := c.VersDB()
-	rows, err := versionViewQuery(c, db, appSlug, channelStr, map[string]interface{}{
+	rows, err := versionViewQuery(ctx, c, db, appSlug, channelStr, map[string]interface{}{
 		"limit":        1,
 		"descending":   true,
 		"include_docs": true,
@@ -532,9 +669,29 @@ func FindAppVersions(c *space.Space, appSlug string, channel Channel, concat Con
 }
 
 func FindAppVersionsCacheMiss(c *space.Space, appSlug string, channel Channel, concat ConcatChannels) (*AppVersions, error) {
+	versions, err := computeAppVersions(c, appSlug, channel, concat)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the cache by using a goroutine to avoid waiting for the latency
+	// between the app server and redis.
+	if data, err := json.Marshal(versions); err == nil {
+		key := base.NewKey(c.Name, appSlug, ChannelToStr(channel))
+		go base.ListVersionsCache.Add(key, data)
+	}
+
+	return versions, nil
+}
+
+// computeAppVersions returns the versions of an application from the
+// versions database, without using the cache.
+func computeAppVersions(c *space.Space, appSlug string, channel Channel, concat ConcatChannels) (*AppVersions, error) {
+	ctx, cancel := base.QueryContext()
+	defer cancel()
 	db := c.VersDB()
 
-	rows, err := versionViewQuery(c, db, appSlug, "dev", map[string]interface{}{
+	rows, err := versionViewQuery(ctx, c, db, appSlug, "dev", map[string]interface{}{
 		"limit":      2000,
 		"descending": false,
 	})
@@ -543,7 +700,7 @@ func FindAppVersionsCacheMiss(c *space.Space, appSlug string, channel Channel, c
 	}
 	defer rows.Close()
 
-	allVersions := make([]string, int(rows.TotalRows()))
+	allVersions := []string{}
 	for rows.Next() {
 		var version string
 		if err = rows.ScanValue(&version); err != nil {
@@ -594,31 +751,29 @@ func FindAppVersionsCacheMiss(c *space.Space, appSlug string, channel Channel, c
 		Beta:        beta,
 		Dev:         dev,
 	}
-
-	// Update the cache by using a goroutine to avoid waiting for the latency
-	// between the app server and redis.
-	if data, err := json.Marshal(versions); err == nil {
-		key := base.NewKey(c.Name, appSlug, ChannelToStr(channel))
-		go base.ListVersionsCache.Add(key, data)
-	}
-
 	return versions, nil
 }
 
 type AppsListOptions struct {
 	Limit                int
-	Cursor               int
+	Cursor               string // Opaque cursor of the page, or a legacy number of apps to skip
 	Sort                 string
 	Filters              map[string]string
 	LatestVersionChannel Channel
 	VersionsChannel      Channel
+	// ExcludeUnlisted hides the applications unlisted by the moderators
+	ExcludeUnlisted bool
 }
 
 func GetPendingVersions(c *space.Space) ([]*Version, error) {
 	db := c.PendingVersDB()
-	rows, err := db.AllDocs(context.Background(), map[string]interface{}{
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	finished := slowlog.Start(slowlog.CouchDB, "all_docs", c.Name, db.Name())
+	rows, err := db.AllDocs(ctx, map[string]interface{}{
 		"include_docs": true,
 	})
+	finished()
 	if err != nil {
 		return nil, err
 	}
@@ -668,7 +823,55 @@ func GetAppChannelVersions(c *space.Space, appSlug string, channel Channel) ([]*
 	return resultVersions, nil
 }
 
-func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (int, []*App, error) {
+// filterCondition returns the mango condition for the value of a filter. The
+// value can be a list of comma-separated values (any of them), and be negated
+// with a leading "!" (none of them): "!cozy,partner" rejects both editors.
+func filterCondition(val string) (mango.Operator, interface{}) {
+	negated := strings.HasPrefix(val, "!")
+	val = strings.TrimPrefix(val, "!")
+	var values []string
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 1 {
+		val = values[0]
+	}
+	switch {
+	case len(values) <= 1 && negated:
+		return mango.Ne, val
+	case len(values) <= 1:
+		return mango.Eq, val
+	case negated:
+		return mango.Nin, values
+	default:
+		return mango.In, values
+	}
+}
+
+// isSortIndexed returns true if a mango index can be used to sort the
+// applications on the given field, ie an index starting with this field.
+func isSortIndexed(field string) bool {
+	fields, ok := space.AppsIndexes[field]
+	return ok && len(fields) > 0 && fields[0] == field
+}
+
+// AppsSorts returns the fields that can be used to sort the applications.
+func AppsSorts() []string {
+	sorts := make([]string, 0, len(space.AppsIndexes))
+	for field := range space.AppsIndexes {
+		if isSortIndexed(field) {
+			sorts = append(sorts, field)
+		}
+	}
+	sort.Strings(sorts)
+	return sorts
+}
+
+// GetAppsList returns a page of the applications of a space, and the cursor
+// for the next page (empty for the last page).
+func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (string, []*App, error) {
 	db := c.AppsDB()
 	order := "asc"
 
@@ -677,42 +880,57 @@ func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (i
 		order = "desc"
 		sortField = sortField[1:]
 	}
-	if sortField == "" || !stringInArray(sortField, validSorts) {
+	if sortField == "" {
 		sortField = "slug"
 	}
+	if !isSortIndexed(sortField) {
+		return "", nil, errshttp.NewError(http.StatusBadRequest,
+			"The apps list can't be sorted by %q, the available sorts are: %s",
+			sortField, strings.Join(AppsSorts(), ", "))
+	}
 
-	useIndex := space.AppIndexName(sortField)
-	sortFields := space.AppsIndexes[sortField]
-	sort := ""
-	for _, field := range sortFields {
-		if sort != "" {
-			sort += ","
-		}
-		sort += fmt.Sprintf(`{"%s": "%s"}`, field, order)
+	query := mango.New(space.AppIndexName(sortField))
+	for _, field := range space.AppsIndexes[sortField] {
+		query.Sort(field, order == "desc")
+	}
+
+	after, skip, err := parseAppsCursor(opts.Cursor, sortField, order == "desc")
+	if err != nil {
+		return "", nil, err
+	}
+	if after != nil {
+		after.where(query)
 	}
 
-	selector := ``
+	// The index can be used only if the selector has a condition on its
+	// first field, the sort field.
+	sortFieldFiltered := false
 	for name, val := range opts.Filters {
 		if !stringInArray(name, validFilters) {
 			continue
 		}
-		if selector != "" {
-			selector += ","
-		}
 
+		field := name
 		switch name {
 		case "select":
-			slugs := strings.Split(val, ",")
-			selector += string(base.SprintfJSON(`"slug": {"$in": %s}`, slugs))
+			field = "slug"
+			query.Where(field, mango.In, strings.Split(val, ","))
 		case "reject":
-			slugs := strings.Split(val, ",")
-			selector += string(base.SprintfJSON(`"slug": {"$nin": %s}`, slugs))
+			field = "slug"
+			query.Where(field, mango.Nin, strings.Split(val, ","))
 		default:
-			selector += string(base.SprintfJSON("%s: %s", name, val))
+			op, value := filterCondition(val)
+			query.Where(field, op, value)
 		}
+		if field == sortField {
+			sortFieldFiltered = true
+		}
+	}
+	if !sortFieldFiltered {
+		query.Where(sortField, mango.Gt, nil)
 	}
-	if selector == "" {
-		selector = string(base.SprintfJSON(`%s: {"$gt": null}`, sortField))
+	if opts.ExcludeUnlisted {
+		query.Where("moderation.unlisted", mango.Exists, false)
 	}
 
 	// Note: we can ignore design docs below as we always have a selector that
@@ -725,18 +943,18 @@ func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (i
 	}
 
 	limit := opts.Limit + 1
-	cursor := opts.Cursor
-	req := base.SprintfJSON(`{
-  "use_index": %s,
-  "selector": {`+selector+`},
-  "skip": %s,
-  "sort": [`+sort+`],
-  "limit": %s
-}`, useIndex, cursor, limit)
-
-	rows, err := db.Find(context.Background(), req)
+	req, err := query.Skip(skip).Limit(limit).Build()
 	if err != nil {
-		return 0, nil, err
+		return "", nil, errshttp.NewError(http.StatusBadRequest, "Invalid query: %s", err)
+	}
+
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	finished := slowlog.Start(slowlog.CouchDB, "find", c.Name, string(req))
+	rows, err := db.Find(ctx, req)
+	finished()
+	if err != nil {
+		return "", nil, err
 	}
 	defer rows.Close()
 
@@ -744,21 +962,21 @@ func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (i
 	for rows.Next() {
 		var doc *App
 		if err = rows.ScanDoc(&doc); err != nil {
-			return 0, nil, err
+			return "", nil, err
 		}
 		res = append(res, doc)
 	}
+	space.CheckIndexWarning(c, "apps list", rows)
 	if len(res) == 0 {
-		return -1, res, nil
+		return "", res, nil
 	}
 
+	// we fetch one more element so we know when the end of the list has been
+	// reached.
+	var cursor string
 	if len(res) > opts.Limit {
 		res = res[:opts.Limit]
-		cursor += len(res)
-	} else {
-		// we fetch one more element so we know in this case the end of the list
-		// has been reached.
-		cursor = -1
+		cursor = newAppsCursor(res[len(res)-1], sortField, order == "desc")
 	}
 
 	// We are doing a lot of requests to cache or couchdb to fetch the data
@@ -806,7 +1024,10 @@ func GetAppsList(v *base.VirtualSpace, c *space.Space, opts *AppsListOptions) (i
 	}
 
 	if err != nil {
-		return 0, nil, err
+		return "", nil, err
+	}
+	if err = applyMaintenanceOverwrites(v, res); err != nil {
+		return "", nil, err
 	}
 
 	return cursor, res, nil
@@ -886,13 +1107,18 @@ func GetVersionsLatestFromCache(c *space.Space, channelStr string, apps []*App)
 }
 
 func GetMaintainanceApps(c *space.Space) ([]*App, error) {
-	useIndex := space.AppIndexName("maintenance")
-	req := base.SprintfJSON(`{
-  "use_index": %s,
-  "selector": {"maintenance_activated": true},
-  "limit": 1000
-}`, useIndex)
-	rows, err := c.AppsDB().Find(context.Background(), req)
+	req, err := mango.New(space.AppIndexName("maintenance")).
+		Where("maintenance_activated", mango.Eq, true).
+		Limit(1000).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	finished := slowlog.Start(slowlog.CouchDB, "find", c.Name, string(req))
+	rows, err := c.AppsDB().Find(ctx, req)
+	finished()
 	if err != nil {
 		return nil, err
 	}
@@ -909,6 +1135,56 @@ func GetMaintainanceApps(c *space.Space) ([]*App, error) {
 		}
 		apps = append(apps, &app)
 	}
+	space.CheckIndexWarning(c, "apps in maintenance", rows)
 
 	return apps, nil
 }
+
+// FindEditorApps returns the applications of an editor in the space, sorted
+// by slug. The documents are returned as they are stored, without their
+// versions.
+func FindEditorApps(c *space.Space, editorName string) ([]*App, error) {
+	useIndex, err := space.RequireAppsIndex("editor", "apps list sorted by editor", space.AppsIndexes["editor"]...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	apps := make([]*App, 0)
+	skip := 0
+	for {
+		req, err := mango.New(useIndex).
+			Where("editor", mango.Eq, editorName).
+			Sort("editor", false).
+			Sort("slug", false).
+			Sort("type", false).
+			Skip(skip).
+			Limit(maxLimit).
+			Build()
+		if err != nil {
+			return nil, err
+		}
+		finished := slowlog.Start(slowlog.CouchDB, "find", c.Name, string(req))
+		rows, err := c.AppsDB().Find(ctx, req)
+		finished()
+		if err != nil {
+			return nil, err
+		}
+		count := 0
+		for rows.Next() {
+			var app App
+			if err := rows.ScanDoc(&app); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			apps = append(apps, &app)
+			count++
+		}
+		space.CheckIndexWarning(c, "apps list sorted by editor", rows)
+		rows.Close()
+		if count < maxLimit {
+			return apps, nil
+		}
+		skip += count
+	}
+}
@@ -0,0 +1,218 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const flagsDBSuffix = "flags"
+
+// flagsRefreshInterval is the maximal delay before a change of the flags of a
+// space made by another instance of the registry is seen.
+const flagsRefreshInterval = time.Minute
+
+// maxFlags is the maximal number of flags of a space or an application.
+const maxFlags = 64
+
+var validFlagReg = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// ErrFlagsInvalid is returned when the flags have too many keys, or a key that
+// is not valid.
+var ErrFlagsInvalid = errshttp.NewError(http.StatusBadRequest,
+	"The flags must be an object with at most %d keys made of lowercase letters, digits, dots, dashes and underscores", maxFlags)
+
+// Flags are the feature flags of a space or an application: arbitrary values
+// set by the operators, and sent in the responses with the applications, so
+// that the stacks can enable some features for some applications only.
+type Flags map[string]interface{}
+
+// SpaceFlags are the flags of a space (or virtual space), set via the admin
+// API.
+type SpaceFlags struct {
+	Space     string     `json:"space"`
+	Flags     Flags      `json:"flags"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type spaceFlagsDoc struct {
+	ID        string    `json:"_id,omitempty"`
+	Rev       string    `json:"_rev,omitempty"`
+	Flags     Flags     `json:"flags"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var spaceFlags struct {
+	sync.Mutex
+	docs     map[string]spaceFlagsDoc
+	loadedAt time.Time
+}
+
+// CheckFlags returns ErrFlagsInvalid if the flags can't be set.
+func CheckFlags(flags Flags) error {
+	if len(flags) > maxFlags {
+		return ErrFlagsInvalid
+	}
+	for key := range flags {
+		if !validFlagReg.MatchString(key) {
+			return ErrFlagsInvalid
+		}
+	}
+	return nil
+}
+
+func getFlagsDB() (*kivik.DB, error) {
+	dbName := base.DBName(flagsDBSuffix)
+	ok, err := base.DBClient.DBExists(context.Background(), dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
+			if kivik.StatusCode(err) != http.StatusPreconditionFailed {
+				return nil, err
+			}
+		}
+	}
+	db := base.DBClient.DB(context.Background(), dbName)
+	return db, db.Err()
+}
+
+// loadSpaceFlags returns the flags of the spaces. They are kept in memory for
+// a short time, as they are used for the responses with the applications.
+func loadSpaceFlags(force bool) (map[string]spaceFlagsDoc, error) {
+	spaceFlags.Lock()
+	defer spaceFlags.Unlock()
+	if !force && spaceFlags.docs != nil && time.Since(spaceFlags.loadedAt) < flagsRefreshInterval {
+		return spaceFlags.docs, nil
+	}
+
+	db, err := getFlagsDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := make(map[string]spaceFlagsDoc)
+	for rows.Next() {
+		var doc spaceFlagsDoc
+		if err := rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		docs[doc.ID] = doc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	spaceFlags.docs = docs
+	spaceFlags.loadedAt = time.Now()
+	return docs, nil
+}
+
+// GetSpaceFlags returns the flags of a space (or virtual space).
+func GetSpaceFlags(spaceName string) (*SpaceFlags, error) {
+	name := spaceDocName(spaceName)
+	docs, err := loadSpaceFlags(false)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := docs[name]
+	if !ok {
+		return &SpaceFlags{Space: name, Flags: Flags{}}, nil
+	}
+	updatedAt := doc.UpdatedAt
+	return &SpaceFlags{Space: name, Flags: doc.Flags, UpdatedAt: &updatedAt}, nil
+}
+
+// SetSpaceFlags replaces the flags of a space (or virtual space). The flags
+// are removed if flags is empty.
+func SetSpaceFlags(spaceName string, flags Flags) (*SpaceFlags, error) {
+	if err := CheckFlags(flags); err != nil {
+		return nil, err
+	}
+	name := spaceDocName(spaceName)
+	db, err := getFlagsDB()
+	if err != nil {
+		return nil, err
+	}
+	doc := spaceFlagsDoc{ID: name}
+	if err := db.Get(context.Background(), name).ScanDoc(&doc); err != nil {
+		if kivik.StatusCode(err) != http.StatusNotFound {
+			return nil, err
+		}
+	}
+	if len(flags) == 0 {
+		if doc.Rev != "" {
+			if _, err := db.Delete(context.Background(), doc.ID, doc.Rev); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		doc.Flags = flags
+		doc.UpdatedAt = time.Now().UTC()
+		if _, err := db.Put(context.Background(), doc.ID, doc); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := loadSpaceFlags(true); err != nil {
+		return nil, err
+	}
+	return GetSpaceFlags(spaceName)
+}
+
+// SetAppFlags replaces the flags of an application, or removes them if flags
+// is empty.
+func SetAppFlags(c *space.Space, appSlug string, flags Flags) (*App, error) {
+	if err := CheckFlags(flags); err != nil {
+		return nil, err
+	}
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) == 0 {
+		flags = nil
+	}
+	app.Flags = flags
+	if app.Rev, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+// EffectiveFlags returns the flags of an application for the responses: the
+// flags of the spaces, in the given order, overridden by the flags of the
+// application. If the flags of the spaces can't be loaded, only the flags of
+// the application are returned.
+func EffectiveFlags(app *App, spaceNames ...string) Flags {
+	flags := make(Flags)
+	if docs, err := loadSpaceFlags(false); err == nil {
+		for _, name := range spaceNames {
+			for k, v := range docs[spaceDocName(name)].Flags {
+				flags[k] = v
+			}
+		}
+	} else {
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "flags",
+			"error_msg": err,
+		}).Warn("Cannot load the flags of the spaces")
+	}
+	for k, v := range app.Flags {
+		flags[k] = v
+	}
+	return flags
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/cozy/cozy-apps-registry/asset"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/imaging"
+	"github.com/sirupsen/logrus"
+)
+
+// IconRendition returns the icon resized to the given size (or with its
+// original size if size is 0) and encoded in the given format. The renditions
+// are cached in the storage of the assets, with a name computed from the
+// content of the icon, so they are shared by all the versions and spaces that
+// use the same icon.
+func IconRendition(icon *Attachment, size int, contentType string) (*Attachment, error) {
+	content, err := ioutil.ReadAll(icon.Content)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	shasum := hex.EncodeToString(sum[:])
+	name := fmt.Sprintf("renditions/%s-%d.%s", shasum, size, imaging.Extensions[contentType])
+	etag := fmt.Sprintf("%s-%d-%s", shasum[:16], size, imaging.Extensions[contentType])
+
+	buf, _, err := base.Storage.Get(asset.AssetContainerName, name)
+	if err == nil {
+		return newRendition(buf.Bytes(), contentType, etag), nil
+	}
+	if !errors.Is(err, base.ErrFileNotFound) {
+		return nil, err
+	}
+
+	img, err := imaging.Thumbnail(content, size)
+	if err != nil {
+		return nil, err
+	}
+	var rendition bytes.Buffer
+	if err := imaging.Encode(&rendition, img, contentType); err != nil {
+		return nil, err
+	}
+	data := rendition.Bytes()
+	if err := base.Storage.Create(asset.AssetContainerName, name, contentType, bytes.NewReader(data)); err != nil {
+		// The rendition can still be sent, it will be computed again next
+		// time.
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "icons",
+			"name":      name,
+			"error_msg": err,
+		}).Warn("Cannot cache the icon rendition")
+	}
+	return newRendition(data, contentType, etag), nil
+}
+
+func newRendition(data []byte, contentType, etag string) *Attachment {
+	return &Attachment{
+		ContentType:   contentType,
+		Content:       bytes.NewReader(data),
+		Etag:          etag,
+		ContentLength: strconv.Itoa(len(data)),
+	}
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+)
+
+const incidentsDBSuffix = "incidents"
+
+// incidentsDocID is the identifier of the single document with the flags.
+const incidentsDocID = "flags"
+
+// incidentsRefreshInterval is the maximal delay before a change of the flags
+// made by another instance of the registry is seen.
+const incidentsRefreshInterval = time.Minute
+
+// IncidentFlags are set by the administrators when the registry is degraded,
+// to inform the editors via their status pages.
+type IncidentFlags struct {
+	// ReadOnlySpaces are the spaces where the publication is suspended.
+	ReadOnlySpaces []string `json:"read_only_spaces"`
+	// PublishQueueDepth and PublishDelay tell how many publications are
+	// waiting and how long they take to be processed.
+	PublishQueueDepth int `json:"publish_queue_depth"`
+	PublishDelay      int `json:"publish_delay_seconds"`
+	// StorageDegraded is set when the storage of the tarballs and assets is
+	// slow or partially unavailable.
+	StorageDegraded bool       `json:"storage_degraded"`
+	Message         string     `json:"message,omitempty"`
+	UpdatedAt       *time.Time `json:"updated_at,omitempty"`
+}
+
+// Degraded returns true if at least one incident flag is set.
+func (f IncidentFlags) Degraded() bool {
+	return len(f.ReadOnlySpaces) > 0 || f.PublishQueueDepth > 0 ||
+		f.PublishDelay > 0 || f.StorageDegraded || f.Message != ""
+}
+
+type incidentsDoc struct {
+	ID  string `json:"_id,omitempty"`
+	Rev string `json:"_rev,omitempty"`
+	IncidentFlags
+}
+
+var incidents struct {
+	sync.Mutex
+	flags    *IncidentFlags
+	loadedAt time.Time
+}
+
+func getIncidentsDB() (*kivik.DB, error) {
+	dbName := base.DBName(incidentsDBSuffix)
+	ok, err := base.DBClient.DBExists(context.Background(), dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
+			if kivik.StatusCode(err) != http.StatusPreconditionFailed {
+				return nil, err
+			}
+		}
+	}
+	db := base.DBClient.DB(context.Background(), dbName)
+	return db, db.Err()
+}
+
+func getIncidentsDoc(db *kivik.DB) (incidentsDoc, error) {
+	doc := incidentsDoc{ID: incidentsDocID}
+	err := db.Get(context.Background(), incidentsDocID).ScanDoc(&doc)
+	if kivik.StatusCode(err) == http.StatusNotFound {
+		err = nil
+	}
+	if doc.ReadOnlySpaces == nil {
+		doc.ReadOnlySpaces = []string{}
+	}
+	return doc, err
+}
+
+// GetIncidentFlags returns the current incident flags. They are kept in
+// memory for a short time, as they are served on a public endpoint.
+func GetIncidentFlags() (IncidentFlags, error) {
+	incidents.Lock()
+	defer incidents.Unlock()
+	if incidents.flags != nil && time.Since(incidents.loadedAt) < incidentsRefreshInterval {
+		return *incidents.flags, nil
+	}
+	db, err := getIncidentsDB()
+	if err != nil {
+		return IncidentFlags{}, err
+	}
+	doc, err := getIncidentsDoc(db)
+	if err != nil {
+		return IncidentFlags{}, err
+	}
+	incidents.flags = &doc.IncidentFlags
+	incidents.loadedAt = time.Now()
+	return doc.IncidentFlags, nil
+}
+
+// SetIncidentFlags replaces the incident flags.
+func SetIncidentFlags(flags IncidentFlags) (IncidentFlags, error) {
+	if flags.PublishQueueDepth < 0 || flags.PublishDelay < 0 {
+		return IncidentFlags{}, errshttp.NewError(http.StatusBadRequest,
+			"The depth and the delay of the publish queue can't be negative")
+	}
+	readOnly := make([]string, 0, len(flags.ReadOnlySpaces))
+	for _, name := range flags.ReadOnlySpaces {
+		if name == "" {
+			name = base.DefaultSpacePrefix.String()
+		}
+		if _, ok := space.GetSpace(name); !ok {
+			return IncidentFlags{}, errshttp.NewError(http.StatusBadRequest, "Unknown space %q", name)
+		}
+		if !stringInArray(name, readOnly) {
+			readOnly = append(readOnly, name)
+		}
+	}
+	sort.Strings(readOnly)
+	flags.ReadOnlySpaces = readOnly
+	now := time.Now().UTC()
+	flags.UpdatedAt = &now
+	return saveIncidentFlags(flags)
+}
+
+// IsSpaceReadOnly returns true if the publication is suspended in the given
+// space. If the flags can't be loaded, the space is considered writable.
+func IsSpaceReadOnly(spaceName string) bool {
+	if spaceName == "" {
+		spaceName = base.DefaultSpacePrefix.String()
+	}
+	flags, err := GetIncidentFlags()
+	if err != nil {
+		return false
+	}
+	return stringInArray(spaceName, flags.ReadOnlySpaces)
+}
+
+// ClearIncidentFlags resets all the incident flags.
+func ClearIncidentFlags() (IncidentFlags, error) {
+	now := time.Now().UTC()
+	return saveIncidentFlags(IncidentFlags{ReadOnlySpaces: []string{}, UpdatedAt: &now})
+}
+
+func saveIncidentFlags(flags IncidentFlags) (IncidentFlags, error) {
+	db, err := getIncidentsDB()
+	if err != nil {
+		return IncidentFlags{}, err
+	}
+	doc, err := getIncidentsDoc(db)
+	if err != nil {
+		return IncidentFlags{}, err
+	}
+	doc.IncidentFlags = flags
+	if _, err := db.Put(context.Background(), doc.ID, doc); err != nil {
+		return IncidentFlags{}, err
+	}
+	incidents.Lock()
+	incidents.flags = &flags
+	incidents.loadedAt = time.Now()
+	incidents.Unlock()
+	return flags, nil
+}
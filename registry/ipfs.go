@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/cozy/cozy-apps-registry/ipfs"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// pinVersionToIPFS adds the tarball of a version to the IPFS node, if it is
+// configured, and records the CID on the version document. It is
+// experimental, and the errors are only logged.
+func pinVersionToIPFS(c *space.Space, ver *Version) {
+	client := ipfs.GetClient()
+	if client == nil {
+		return
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"nspace":  "ipfs",
+		"space":   c.Name,
+		"slug":    ver.Slug,
+		"version": ver.Version,
+	})
+	if err := PinVersionToIPFS(c, client, ver); err != nil {
+		log.Warnf("Cannot pin the tarball: %s", err)
+		return
+	}
+	log.Info("Tarball pinned")
+}
+
+// PinVersionToIPFS adds the tarball of a version to the IPFS node and records
+// the CID on the version document.
+func PinVersionToIPFS(c *space.Space, client *ipfs.Client, ver *Version) error {
+	att, err := OpenVersionTarball(c, ver)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.tar.gz", ver.Slug, ver.Version)
+	cid, err := client.Add(name, att.Content)
+	if closer, ok := att.Content.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The document is fetched again, as it may have been modified since the
+	// version was published.
+	doc, err := FindPublishedVersion(c, ver.Slug, ver.Version)
+	if err != nil {
+		return err
+	}
+	doc.IPFSCID = cid
+	doc.IPFSURL = ipfs.URL(cid)
+	if doc.Rev, err = c.VersDB().Put(context.Background(), doc.ID, doc); err != nil {
+		return err
+	}
+	doc.purgeCaches(c)
+	return nil
+}
@@ -1,11 +1,17 @@
 package registry
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"path"
+	"sort"
 	"time"
 
+	"github.com/cozy/cozy-apps-registry/asset"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
 )
 
 // RunType is the type for telling if it's a dry run or a real one.
@@ -19,27 +25,146 @@ const (
 	RealRun RunType = false
 )
 
-// CleanOldVersions removes a specific app version of a space
-func CleanOldVersions(space *space.Space, appSlug, channel string, params base.CleanParameters, run RunType) error {
+// CleanedVersion is a version removed by the cleaning of the old versions, or
+// that would be removed for a dry run, with the storage objects deleted with
+// it. KeptBy is set for the expired versions that are kept, with the reason
+// (keep_forever or legal_hold).
+type CleanedVersion struct {
+	Slug    string   `json:"slug"`
+	Version string   `json:"version"`
+	Channel string   `json:"channel"`
+	Size    int64    `json:"size"`
+	Objects []string `json:"objects,omitempty"`
+	KeptBy  string   `json:"kept_by,omitempty"`
+}
+
+// String returns the slug and the version, like myapp/1.2.3.
+func (v *CleanedVersion) String() string {
+	return v.Slug + "/" + v.Version
+}
+
+// CleanReport is the result of the cleaning of the old versions of a space.
+type CleanReport struct {
+	Space     string            `json:"space"`
+	DryRun    bool              `json:"dry_run"`
+	Enabled   bool              `json:"background_cleaning"`
+	NbMajor   int               `json:"major"`
+	NbMinor   int               `json:"minor"`
+	NbMonths  int               `json:"month"`
+	Removed   []*CleanedVersion `json:"removed"`
+	Kept      []*CleanedVersion `json:"kept"`
+	Purged    []*CleanedVersion `json:"purged_from_trash"`
+	TotalSize int64             `json:"total_size"`
+	NbObjects int               `json:"total_objects"`
+	Errors    []string          `json:"errors,omitempty"`
+}
+
+// CleanSpace removes the old versions of all the applications of a space,
+// in all the channels, with the given retention parameters, and purges the
+// expired versions of the trash. For a dry run,
+// nothing is removed, and the report tells what would be removed. An error
+// for an application is added to the report, and the cleaning goes on with
+// the next one.
+func CleanSpace(s *space.Space, params base.CleanParameters, run RunType) (*CleanReport, error) {
+	report := &CleanReport{
+		Space:    s.Name,
+		DryRun:   run == DryRun,
+		Enabled:  base.Config.IsCleanEnabled(s.GetPrefix()),
+		NbMajor:  params.NbMajor,
+		NbMinor:  params.NbMinor,
+		NbMonths: params.NbMonths,
+		Removed:  make([]*CleanedVersion, 0),
+		Kept:     make([]*CleanedVersion, 0),
+		Purged:   make([]*CleanedVersion, 0),
+	}
+	slugs, err := listAppSlugs(s)
+	if err != nil {
+		return nil, err
+	}
+	cleaner := newCleaner(s, run)
+	for _, slug := range slugs {
+		for _, channel := range Channels {
+			channelStr := ChannelToStr(channel)
+			versions, err := cleaner.clean(slug, channelStr, params)
+			if err != nil {
+				report.Errors = append(report.Errors,
+					fmt.Sprintf("Cannot clean %s (%s): %s", slug, channelStr, err))
+				continue
+			}
+			for _, v := range versions {
+				if v.KeptBy != "" {
+					report.Kept = append(report.Kept, v)
+					continue
+				}
+				report.Removed = append(report.Removed, v)
+				report.TotalSize += v.Size
+				report.NbObjects += len(v.Objects)
+			}
+		}
+	}
+
+	// The versions trashed for longer than the retention are purged too
+	if retention := base.Config.TrashRetention; retention > 0 {
+		purged, err := cleaner.purgeTrash(time.Now().Add(-retention))
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Cannot purge the trash: %s", err))
+		}
+		for _, v := range purged {
+			if v.KeptBy != "" {
+				report.Kept = append(report.Kept, v)
+				continue
+			}
+			report.Purged = append(report.Purged, v)
+			report.TotalSize += v.Size
+			report.NbObjects += len(v.Objects)
+		}
+	}
+	return report, nil
+}
+
+// CleanOldVersions removes the old versions of an application in a channel,
+// except the ones to keep with the retention parameters. It returns the
+// expired versions, removed or kept.
+func CleanOldVersions(space *space.Space, appSlug, channel string, params base.CleanParameters, run RunType) ([]*CleanedVersion, error) {
+	return newCleaner(space, run).clean(appSlug, channel, params)
+}
+
+// cleaner removes the old versions of a space. It keeps track of the usages of
+// the assets, to know which ones are deleted from the storage, as they are
+// shared by the versions.
+type cleaner struct {
+	space  *space.Space
+	run    RunType
+	usages map[string]map[string]bool
+}
+
+func newCleaner(s *space.Space, run RunType) *cleaner {
+	return &cleaner{
+		space:  s,
+		run:    run,
+		usages: make(map[string]map[string]bool),
+	}
+}
+
+func (cl *cleaner) clean(appSlug, channel string, params base.CleanParameters) ([]*CleanedVersion, error) {
+	space := cl.space
 	// Finding last versions of the app
 	versionsToKeepFromN, err := FindLastNVersions(space, appSlug, channel, params.NbMajor, params.NbMinor)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	d := time.Now().AddDate(0, -params.NbMonths, 0)
 
 	// Finding all the versions of apps from a date
 	versionsToKeepFromDate, err := FindLastsVersionsSince(space, appSlug, channel, d)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Concat the two lists without duplicates
 	versionsToKeep := versionsToKeepFromDate
-
-	var found bool
-
 	for _, y := range versionsToKeepFromN {
+		found := false
 		for _, v := range versionsToKeepFromDate {
 			if v.ID == y.ID {
 				found = true
@@ -52,14 +177,16 @@ func CleanOldVersions(space *space.Space, appSlug, channel string, params base.C
 	}
 	c, err := StrToChannel(channel)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Get versions and filter ones to expire
 	versions, err := GetAppChannelVersions(space, appSlug, c)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var appHeld *bool
+	expired := make([]*CleanedVersion, 0)
 	for _, v := range versions {
 		toExpire := true
 		for _, vk := range versionsToKeep {
@@ -68,18 +195,146 @@ func CleanOldVersions(space *space.Space, appSlug, channel string, params base.C
 				break
 			}
 		}
+		if !toExpire {
+			continue
+		}
 
-		if toExpire {
-			fmt.Printf("Removing %s\n", v.Slug+"/"+v.Version)
-			if run == DryRun {
-				continue
+		cleaned := &CleanedVersion{
+			Slug:    v.Slug,
+			Version: v.Version,
+			Channel: channel,
+			Size:    v.Size,
+		}
+		expired = append(expired, cleaned)
+		if v.KeepForever {
+			cleaned.KeptBy = "keep_forever"
+			continue
+		}
+		if appHeld == nil {
+			app, err := findApp(space, appSlug)
+			if err != nil && err != ErrAppNotFound {
+				return nil, err
 			}
-			err := v.Delete(space)
-			if err != nil {
-				return err
+			held := app != nil && app.LegalHold != nil
+			appHeld = &held
+		}
+		if v.LegalHold != nil || *appHeld {
+			cleaned.KeptBy = "legal_hold"
+			continue
+		}
+
+		if cleaned.Objects, err = cl.deletedObjects(v); err != nil {
+			return nil, err
+		}
+		if cl.run == DryRun {
+			continue
+		}
+		err := v.Delete(space)
+		if err == ErrLegalHold {
+			cleaned.KeptBy = "legal_hold"
+			cleaned.Objects = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// deletedObjects returns the storage objects deleted with a version: its
+// assets that are not used by another version, the legacy attachments, and
+// the regenerated tarballs of the virtual spaces.
+func (cl *cleaner) deletedObjects(v *Version) ([]string, error) {
+	prefix := cl.space.GetPrefix()
+	source := asset.ComputeSource(prefix, v.Slug, v.Version)
+	objects := make([]string, 0)
+
+	shasums := make([]string, 0, len(v.AttachmentReferences))
+	for _, shasum := range v.AttachmentReferences {
+		shasums = append(shasums, shasum)
+	}
+	sort.Strings(shasums)
+	for _, shasum := range shasums {
+		usages, ok := cl.usages[shasum]
+		if !ok {
+			var doc base.Asset
+			row := base.GlobalAssetStore.GetDB().Get(context.Background(), shasum)
+			if err := row.ScanDoc(&doc); err != nil {
+				if kivik.StatusCode(err) == http.StatusNotFound {
+					continue
+				}
+				return nil, err
 			}
+			usages = make(map[string]bool)
+			for _, usedBy := range doc.UsedBy {
+				usages[usedBy] = true
+			}
+			cl.usages[shasum] = usages
+		}
+		if !usages[source] {
+			continue
+		}
+		delete(usages, source)
+		if len(usages) == 0 {
+			objects = append(objects, path.Join(asset.AssetContainerName.String(), shasum))
 		}
 	}
 
-	return nil
+	// XXX: legacy
+	names, err := base.Storage.FindByPrefix(prefix, path.Join(v.Slug, v.Version)+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		objects = append(objects, path.Join(prefix.String(), name))
+	}
+
+	for _, vs := range base.Config.VirtualSpaces {
+		overwritten, ok, err := findOverwrittenVersion(vs, v)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if h, ok := overwritten.AttachmentReferences["tarball"]; ok {
+			objects = append(objects, path.Join(vs.Name, h))
+		}
+	}
+	return objects, nil
+}
+
+// TrimDevVersions removes the oldest dev versions of an application, to keep
+// only the given number of the most recent ones. The versions labelled
+// keep-forever are never removed, and they are not counted in the kept
+// versions. It returns the removed versions.
+func TrimDevVersions(space *space.Space, appSlug string, keep int) ([]string, error) {
+	versions, err := GetAppChannelVersions(space, appSlug, Dev)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
+	})
+
+	removed := []string{}
+	kept := 0
+	for _, v := range versions {
+		if GetVersionChannel(v.Version) != Dev || v.KeepForever {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		if err := v.Delete(space); err == ErrLegalHold {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		removed = append(removed, v.Version)
+	}
+	return removed, nil
 }
@@ -0,0 +1,125 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLegalHold is returned when the deletion of an application or a version
+// is blocked by a legal hold.
+var ErrLegalHold = errshttp.NewError(http.StatusLocked, "The application or the version is under legal hold")
+
+// LegalHold is set by the admins on an application or a version that must be
+// kept for a compliance investigation. While it is set, the application and
+// its versions (or the version) can't be deleted by any way: cleaning of the
+// old versions, unpublication, deletion of the application or of the space.
+type LegalHold struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by"`
+	At     time.Time `json:"at"`
+}
+
+// SetAppLegalHold sets the legal hold of an application, or removes it if
+// hold is nil.
+func SetAppLegalHold(c *space.Space, appSlug string, hold *LegalHold) (*App, error) {
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	app.LegalHold = hold
+	if app.Rev, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return nil, err
+	}
+	logLegalHoldChange(c, app.Slug, "", hold)
+	return app, nil
+}
+
+// SetLegalHold sets the legal hold of a version, or removes it if hold is
+// nil.
+func (v *Version) SetLegalHold(c *space.Space, hold *LegalHold) error {
+	v.LegalHold = hold
+	rev, err := c.VersDB().Put(context.Background(), v.ID, v)
+	if err != nil {
+		return err
+	}
+	v.Rev = rev
+	v.purgeCaches(c)
+	logLegalHoldChange(c, v.Slug, v.Version, hold)
+	return nil
+}
+
+func logLegalHoldChange(c *space.Space, slug, version string, hold *LegalHold) {
+	log := logrus.WithFields(logrus.Fields{
+		"nspace":  "audit",
+		"space":   c.Name,
+		"slug":    slug,
+		"version": version,
+	})
+	if hold != nil {
+		log.WithFields(logrus.Fields{
+			"by":     hold.By,
+			"reason": hold.Reason,
+		}).Info("Legal hold set")
+	} else {
+		log.Info("Legal hold removed")
+	}
+}
+
+// logBlockedDeletion records in the audit log an attempt to delete an
+// application or a version under legal hold.
+func logBlockedDeletion(c *space.Space, slug, version, operation string) {
+	logrus.WithFields(logrus.Fields{
+		"nspace":    "audit",
+		"space":     c.Name,
+		"slug":      slug,
+		"version":   version,
+		"operation": operation,
+	}).Warn("Deletion blocked by a legal hold")
+}
+
+// checkVersionLegalHold returns ErrLegalHold if the version, or its
+// application, is under legal hold.
+func checkVersionLegalHold(c *space.Space, v *Version, operation string) error {
+	held := v.LegalHold != nil
+	if !held {
+		app, err := findApp(c, v.Slug)
+		if err != nil && err != ErrAppNotFound {
+			return err
+		}
+		held = app != nil && app.LegalHold != nil
+	}
+	if held {
+		logBlockedDeletion(c, v.Slug, v.Version, operation)
+		return ErrLegalHold
+	}
+	return nil
+}
+
+// checkAppLegalHold returns ErrLegalHold if the application, or one of its
+// versions, is under legal hold. The versions of the application must have
+// been loaded.
+func checkAppLegalHold(c *space.Space, app *App, operation string) error {
+	if app.LegalHold != nil {
+		logBlockedDeletion(c, app.Slug, "", operation)
+		return ErrLegalHold
+	}
+	if app.Versions == nil || !app.Versions.HasVersions {
+		return nil
+	}
+	for _, version := range app.Versions.GetAll() {
+		v, err := FindVersion(c, app.Slug, version)
+		if err != nil {
+			continue
+		}
+		if v.LegalHold != nil {
+			logBlockedDeletion(c, app.Slug, v.Version, operation)
+			return ErrLegalHold
+		}
+	}
+	return nil
+}
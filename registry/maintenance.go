@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// maintenanceTTL is the duration during which the apps in maintenance of a
+// space are kept in memory for the aggregated endpoint. The changes made on
+// this instance invalidate the cache, the ones made on the other instances
+// are seen after this delay.
+const maintenanceTTL = 1 * time.Minute
+
+// MaxMaintenanceSlugs is the maximal number of slugs that can be asked in a
+// single request for the maintenance status of the konnectors.
+const MaxMaintenanceSlugs = 200
+
+// KonnectorMaintenance is the maintenance status of a konnector.
+type KonnectorMaintenance struct {
+	Slug                 string              `json:"slug"`
+	MaintenanceActivated bool                `json:"maintenance_activated"`
+	MaintenanceOptions   *MaintenanceOptions `json:"maintenance_options,omitempty"`
+}
+
+type cachedMaintenance struct {
+	apps     map[string]*App
+	cachedAt time.Time
+}
+
+var (
+	maintenanceMu    sync.Mutex
+	maintenanceCache = make(map[string]cachedMaintenance)
+)
+
+// invalidateMaintenance forgets the apps in maintenance of all the spaces, as
+// a change in a space can also change the status in its virtual spaces.
+func invalidateMaintenance() {
+	maintenanceMu.Lock()
+	maintenanceCache = make(map[string]cachedMaintenance)
+	maintenanceMu.Unlock()
+}
+
+// maintenanceApps returns the apps in maintenance of the space (or of the
+// virtual space if v is not nil), indexed by slug.
+func maintenanceApps(v *base.VirtualSpace, c *space.Space) (map[string]*App, error) {
+	key := c.Name
+	if v != nil {
+		key = "virtual:" + v.Name
+	}
+
+	maintenanceMu.Lock()
+	cached, ok := maintenanceCache[key]
+	maintenanceMu.Unlock()
+	if ok && time.Since(cached.cachedAt) < maintenanceTTL {
+		return cached.apps, nil
+	}
+
+	var list []*App
+	var err error
+	if v != nil {
+		list, err = GetMaintainanceAppsInVirtualSpace(v, c)
+	} else {
+		list, err = GetMaintainanceApps(c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	apps := make(map[string]*App, len(list))
+	for _, app := range list {
+		apps[app.Slug] = app
+	}
+
+	maintenanceMu.Lock()
+	maintenanceCache[key] = cachedMaintenance{apps: apps, cachedAt: time.Now()}
+	maintenanceMu.Unlock()
+	return apps, nil
+}
+
+// GetKonnectorsMaintenance returns the maintenance status of the konnectors
+// with the given slugs, in the same order. The slugs of the konnectors that
+// are not in maintenance (or that don't exist) have a status with
+// maintenance_activated to false.
+func GetKonnectorsMaintenance(v *base.VirtualSpace, c *space.Space, slugs []string) ([]*KonnectorMaintenance, error) {
+	apps, err := maintenanceApps(v, c)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]*KonnectorMaintenance, 0, len(slugs))
+	for _, slug := range slugs {
+		status := &KonnectorMaintenance{Slug: slug}
+		if app, ok := apps[slug]; ok && app.Type == "konnector" {
+			status.MaintenanceActivated = true
+			status.MaintenanceOptions = app.MaintenanceOptions
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
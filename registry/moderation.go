@@ -0,0 +1,200 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	"github.com/sirupsen/logrus"
+)
+
+// Moderation actions that can be set on an application.
+const (
+	// ModerationFlag marks the application for a review by the trust and
+	// safety team. It has no effect on the application.
+	ModerationFlag = "flag"
+	// ModerationUnlist hides the application from the lists and the search,
+	// but it can still be installed and updated.
+	ModerationUnlist = "unlist"
+	// ModerationTakedown records a takedown notice filed against the
+	// application. The operators decide what to do with it (unlist the
+	// application, delete it, etc.).
+	ModerationTakedown = "takedown"
+)
+
+// ModerationActions is the list of the moderation actions.
+var ModerationActions = []string{ModerationFlag, ModerationUnlist, ModerationTakedown}
+
+// AdvisorySeverities is the list of the severities of the advisories.
+var AdvisorySeverities = []string{"low", "moderate", "high", "critical"}
+
+// Moderation is the state of an application set by the moderators. It is only
+// visible with the admin API.
+type Moderation struct {
+	Flagged  *ModerationAction `json:"flagged,omitempty"`
+	Unlisted *ModerationAction `json:"unlisted,omitempty"`
+	Takedown *ModerationAction `json:"takedown,omitempty"`
+}
+
+// ModerationAction is a moderation action set on an application.
+type ModerationAction struct {
+	Reason string `json:"reason"`
+	// Reference is the identifier of the takedown notice, or of the ticket of
+	// the trust and safety team.
+	Reference string    `json:"reference,omitempty"`
+	By        string    `json:"by"`
+	At        time.Time `json:"at"`
+}
+
+// Advisory is published by the moderators on an application to warn its
+// users, for a security issue for example. The advisories are public.
+type Advisory struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Summary  string `json:"summary"`
+	// Versions is the semver constraint of the affected versions (all the
+	// versions if empty).
+	Versions    string    `json:"versions,omitempty"`
+	URL         string    `json:"url,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+	UpdatedAt   time.Time `json:"updated_at,omitempty"`
+}
+
+var moderationEvents = map[string]string{
+	ModerationFlag:     webhooks.ModerationFlagged,
+	ModerationUnlist:   webhooks.ModerationUnlisted,
+	ModerationTakedown: webhooks.ModerationTakedown,
+}
+
+// IsUnlisted returns true if the application has been unlisted by the
+// moderators.
+func (app *App) IsUnlisted() bool {
+	return app.Moderation != nil && app.Moderation.Unlisted != nil
+}
+
+// SetAppModeration sets a moderation action on an application, or lifts it
+// if action is nil. The by parameter tells who has made the change.
+func SetAppModeration(c *space.Space, appSlug, kind string, action *ModerationAction, by string) (*App, error) {
+	event, ok := moderationEvents[kind]
+	if !ok {
+		return nil, errshttp.NewError(http.StatusBadRequest, "Unknown moderation action %q", kind)
+	}
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	moderation := Moderation{}
+	if app.Moderation != nil {
+		moderation = *app.Moderation
+	}
+	switch kind {
+	case ModerationFlag:
+		moderation.Flagged = action
+	case ModerationUnlist:
+		moderation.Unlisted = action
+	case ModerationTakedown:
+		moderation.Takedown = action
+	}
+	app.Moderation = &moderation
+	if moderation == (Moderation{}) {
+		app.Moderation = nil
+	}
+	if app.Rev, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return nil, err
+	}
+	if kind == ModerationUnlist {
+		updateSearchIndex(c, app.Slug)
+		updateFacets(c, app.Slug)
+	}
+
+	data := webhooks.ModerationData{Slug: app.Slug, By: by, At: time.Now().UTC()}
+	if action != nil {
+		data.Active = true
+		data.Reason = action.Reason
+		data.Reference = action.Reference
+		data.At = action.At
+	}
+	logrus.WithFields(logrus.Fields{
+		"nspace":    "audit",
+		"space":     c.Name,
+		"slug":      app.Slug,
+		"action":    kind,
+		"active":    data.Active,
+		"by":        by,
+		"reason":    data.Reason,
+		"reference": data.Reference,
+	}).Info("Moderation action changed")
+	webhooks.Send(c.Name, event, data)
+	return app, nil
+}
+
+// PublishAdvisory adds an advisory to an application, or replaces the
+// advisory with the same identifier.
+func PublishAdvisory(c *space.Space, appSlug string, advisory *Advisory, by string) (*App, error) {
+	if err := checkAdvisory(advisory); err != nil {
+		return nil, err
+	}
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	advisory.PublishedAt = now
+	advisory.UpdatedAt = time.Time{}
+	advisories := make([]*Advisory, 0, len(app.Advisories)+1)
+	for _, a := range app.Advisories {
+		if a.ID == advisory.ID {
+			advisory.PublishedAt = a.PublishedAt
+			advisory.UpdatedAt = now
+			continue
+		}
+		advisories = append(advisories, a)
+	}
+	app.Advisories = append(advisories, advisory)
+	if app.Rev, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"nspace":   "audit",
+		"space":    c.Name,
+		"slug":     app.Slug,
+		"advisory": advisory.ID,
+		"severity": advisory.Severity,
+		"by":       by,
+	}).Info("Advisory published")
+	webhooks.Send(c.Name, webhooks.ModerationAdvisory, webhooks.ModerationData{
+		Slug:     app.Slug,
+		Active:   true,
+		Reason:   advisory.Summary,
+		By:       by,
+		At:       now,
+		Advisory: advisory,
+	})
+	return app, nil
+}
+
+func checkAdvisory(advisory *Advisory) error {
+	if advisory.ID == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing id field")
+	}
+	if advisory.Summary == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing summary field")
+	}
+	if !stringInArray(advisory.Severity, AdvisorySeverities) {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Invalid severity %q, the severities are: %v", advisory.Severity, AdvisorySeverities)
+	}
+	if advisory.Versions != "" {
+		if _, err := semver.NewConstraint(advisory.Versions); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid versions constraint: %s", err)
+		}
+	}
+	return nil
+}
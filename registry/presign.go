@@ -0,0 +1,111 @@
+package registry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+)
+
+// MaxPublishURLAge is the maximal duration of validity of a pre-signed
+// publish URL.
+const MaxPublishURLAge = 24 * time.Hour
+
+// DefaultPublishURLAge is the duration of validity of a pre-signed publish
+// URL when the editor has not asked for a specific one.
+const DefaultPublishURLAge = 15 * time.Minute
+
+var (
+	ErrPublishURLInvalid = errshttp.NewError(http.StatusUnauthorized, "Publish URL is invalid or has already been used")
+	ErrPublishURLExpired = errshttp.NewError(http.StatusUnauthorized, "Publish URL has expired")
+)
+
+// PublishURL is a one-time and short-lived authorization to publish a given
+// version of an application, that can be given to a third-party build system
+// instead of the editor token.
+type PublishURL struct {
+	ID        string    `json:"_id,omitempty"`
+	Rev       string    `json:"_rev,omitempty"`
+	Space     string    `json:"space"`
+	Slug      string    `json:"slug"`
+	Version   string    `json:"version"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreatePublishURL creates a pre-signed publish URL for the given version of
+// an application. The returned token is the secret part of the URL.
+func CreatePublishURL(c *space.Space, app *App, version string, maxAge time.Duration) (*PublishURL, error) {
+	if !validVersionReg.MatchString(version) {
+		return nil, ErrVersionInvalid
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultPublishURLAge
+	} else if maxAge > MaxPublishURLAge {
+		maxAge = MaxPublishURLAge
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	doc := &PublishURL{
+		ID:        hex.EncodeToString(token),
+		Space:     c.Name,
+		Slug:      app.Slug,
+		Version:   version,
+		ExpiresAt: time.Now().UTC().Add(maxAge),
+	}
+	var err error
+	if doc.Rev, err = base.PublishURLsDB.Put(context.Background(), doc.ID, doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// ConsumePublishURL checks that the token is a valid pre-signed publish URL
+// for the given version of an application in the space, and marks it as used.
+// The version is checked before, so that a request for another version does
+// not consume the token, but a token can be consumed only once, even if the
+// publication fails after that.
+func ConsumePublishURL(c *space.Space, appSlug, version, token string) (*PublishURL, error) {
+	if _, err := hex.DecodeString(token); err != nil || len(token) != 64 {
+		return nil, ErrPublishURLInvalid
+	}
+
+	db := base.PublishURLsDB
+	var doc PublishURL
+	if err := db.Get(context.Background(), token).ScanDoc(&doc); err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return nil, ErrPublishURLInvalid
+		}
+		return nil, err
+	}
+	if doc.Space != c.Name || doc.Slug != appSlug {
+		return nil, ErrPublishURLInvalid
+	}
+	if doc.Version != version {
+		return nil, errshttp.NewError(http.StatusBadRequest,
+			"The publish URL is for the version %s", doc.Version)
+	}
+
+	// Deleting the document ensures that the token is used only once: if two
+	// requests are made concurrently, one of them will have a conflict.
+	if _, err := db.Delete(context.Background(), doc.ID, doc.Rev); err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict || kivik.StatusCode(err) == http.StatusNotFound {
+			return nil, ErrPublishURLInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().After(doc.ExpiresAt) {
+		return nil, ErrPublishURLExpired
+	}
+	return &doc, nil
+}
@@ -0,0 +1,36 @@
+package registry
+
+// The methods of publication of a version.
+const (
+	// PublishMethodAPI is used for POST /registry/:app, with a token.
+	PublishMethodAPI = "api"
+	// PublishMethodBulk is used for POST /registry/_bulk, with a token.
+	PublishMethodBulk = "bulk"
+	// PublishMethodPublishURL is used for the pre-signed publish URLs,
+	// without a token.
+	PublishMethodPublishURL = "publish_url"
+	// PublishMethodMirror is used for the versions copied from an upstream
+	// registry by the mirror command.
+	PublishMethodMirror = "mirror"
+)
+
+// Provenance tells who has published a version, and from where, for the
+// investigations after an incident. It is only visible to the admins and to
+// the editor of the application.
+type Provenance struct {
+	// Method is how the version has been published (see the PublishMethod
+	// constants).
+	Method string `json:"method"`
+	// TokenID identifies the token used for the publication, like in the
+	// revocation list. It is empty for the publish URLs.
+	TokenID string `json:"token_id,omitempty"`
+	// Editor is the editor of the token, which is not the editor of the
+	// application when a master token is used.
+	Editor string `json:"editor,omitempty"`
+	// SourceIP and UserAgent are the ones of the publication request.
+	SourceIP  string `json:"source_ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// TarballURL is the URL where the tarball has been downloaded, as the URL
+	// of the version is replaced by the one of the registry.
+	TarballURL string `json:"tarball_url"`
+}
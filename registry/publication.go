@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+)
+
+// CheckPublication makes the checks on the history of the application before
+// a version is published: a stable version can't be lower than the latest
+// stable version (unless force is true), and the same tarball can't be
+// published under two version numbers.
+func CheckPublication(c *space.Space, appSlug string, opts *VersionOptions, force bool) error {
+	if !force && GetVersionChannel(opts.Version) == Stable {
+		if err := checkDowngrade(c, appSlug, opts.Version); err != nil {
+			return err
+		}
+	}
+	return checkDuplicateContent(c, appSlug, opts.Version, opts.Sha256)
+}
+
+func checkDowngrade(c *space.Space, appSlug, version string) error {
+	latest, err := FindLatestVersion(c, appSlug, Stable)
+	if err == ErrVersionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	current, err := semver.NewVersion(latest.Version)
+	if err != nil {
+		return nil
+	}
+	next, err := semver.NewVersion(version)
+	if err != nil {
+		return ErrVersionInvalid
+	}
+	if next.LessThan(current) {
+		return errshttp.NewError(http.StatusConflict,
+			"Version %s is lower than the latest stable version %s: the downgrades are refused",
+			version, latest.Version)
+	}
+	return nil
+}
+
+// checkDuplicateContent looks for a released or pending version of the
+// application with the same sha256.
+func checkDuplicateContent(c *space.Space, appSlug, version, sha256 string) error {
+	for _, db := range []*kivik.DB{c.VersDB(), c.PendingVersDB()} {
+		duplicate, err := findVersionWithSha256(db, appSlug, sha256)
+		if err != nil {
+			return err
+		}
+		if duplicate != nil && duplicate.Version != version {
+			return errshttp.NewError(http.StatusConflict,
+				"The same tarball has already been published as the version %s", duplicate.Version)
+		}
+	}
+	return nil
+}
+
+func findVersionWithSha256(db *kivik.DB, appSlug, sha256 string) (*Version, error) {
+	key := []string{appSlug, strings.ToLower(sha256)}
+	rows, err := db.Query(context.Background(), space.Sha256View, space.Sha256View, map[string]interface{}{
+		"key":          key,
+		"limit":        1,
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var doc *Version
+		if err := rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	}
+	return nil, rows.Err()
+}
@@ -3,9 +3,7 @@ package registry
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -25,19 +23,22 @@ import (
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/mango"
+	"github.com/cozy/cozy-apps-registry/manifest"
 	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
 	_ "github.com/go-kivik/couchdb/v3" // for couchdb
 	"github.com/go-kivik/kivik/v3"
-	"github.com/h2non/filetype"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
 )
 
-const maxApplicationSize = 20 * 1024 * 1024 // 20 Mo
-
 var (
 	validSlugReg    = regexp.MustCompile(`^[a-z0-9\-]*$`)
 	validVersionReg = regexp.MustCompile(`^(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})\.(0|[1-9][0-9]{0,4})(-dev\.[a-f0-9]{1,40}|-beta.(0|[1-9][0-9]{0,4}))?$`)
+	// validLocaleReg accepts a language (ISO 639), with an optional region
+	// (ISO 3166), like the locales of the manifests: fr, en_US, pt-BR
+	validLocaleReg = regexp.MustCompile(`^[a-z]{2,3}([_-][A-Z]{2})?$`)
 
 	validAppTypes = []string{"webapp", "konnector"}
 )
@@ -48,6 +49,7 @@ var (
 	ErrAppSlugMismatch   = errshttp.NewError(http.StatusBadRequest, "Application slug does not match the one specified in the body")
 	ErrAppSlugInvalid    = errshttp.NewError(http.StatusBadRequest, "Invalid application slug: should contain only lowercase alphanumeric characters and dashes")
 	ErrAppEditorMismatch = errshttp.NewError(http.StatusBadRequest, "Application can not be updated: editor can not change")
+	ErrAppSlugProtected  = errshttp.NewError(http.StatusForbidden, "Application slug is reserved to another space")
 
 	ErrVersionAlreadyExists = errshttp.NewError(http.StatusConflict, "Version already exists")
 	ErrVersionSlugMismatch  = errshttp.NewError(http.StatusBadRequest, "Version slug does not match the application")
@@ -56,9 +58,9 @@ var (
 	ErrChannelInvalid       = errshttp.NewError(http.StatusBadRequest, `Invalid version channel: should be "stable", "beta" or "dev"`)
 )
 
-var versionClient = http.Client{
-	Timeout: 30 * time.Second,
-}
+// versionClient is used to download the tarballs. The timeout is set on the
+// context of each request, as it depends on the space.
+var versionClient = http.Client{Transport: newVersionTransport()}
 
 type AppOptions struct {
 	Slug   string `json:"slug"`
@@ -77,13 +79,35 @@ type App struct {
 	Type      string    `json:"type"`
 	Editor    string    `json:"editor"`
 	CreatedAt time.Time `json:"created_at"`
+	// Name is the name of the latest stable version (or the slug if the
+	// application has no stable version), to sort the list of applications.
+	Name string `json:"name"`
+	// Popularity is the number of installs during the popularity window, from
+	// the statistics pushed by the cozy stacks.
+	Popularity int64 `json:"popularity"`
 
-	MaintenanceActivated bool                `json:"maintenance_activated,omitempty"`
+	MaintenanceActivated bool                `json:"maintenance_activated"`
 	MaintenanceOptions   *MaintenanceOptions `json:"maintenance_options,omitempty"`
 
+	// LegalHold blocks the deletion of the application and of its versions.
+	LegalHold *LegalHold `json:"legal_hold,omitempty"`
+
 	DataUsageCommitment   string `json:"data_usage_commitment"`
 	DataUsageCommitmentBy string `json:"data_usage_commitment_by"`
 
+	// External is set for the applications whose versions are hosted on
+	// another registry.
+	External *ExternalSource `json:"external,omitempty"`
+
+	// Flags are the feature flags set by the operators for this application.
+	// In the responses, they are merged with the flags of the space.
+	Flags Flags `json:"flags,omitempty"`
+
+	// Moderation is the state set by the moderators, and Advisories are the
+	// warnings they have published for the users of the application.
+	Moderation *Moderation `json:"moderation,omitempty"`
+	Advisories []*Advisory `json:"advisories,omitempty"`
+
 	// Calculated fields, not present in the database
 	Versions      *AppVersions `json:"versions,omitempty"`
 	Label         Label        `json:"label"`
@@ -129,8 +153,16 @@ type VersionOptions struct {
 	Icon        string          `json:"icon"`
 	Partnership Partnership     `json:"partnership"`
 	Screenshots []string        `json:"screenshots"`
+	// Signature is the signature of the sha256 of the tarball by the editor,
+	// encoded in base64 (see CheckVersionSignature).
+	Signature   string `json:"signature"`
 	SpacePrefix base.Prefix
 	RegistryURL *url.URL
+	// Context can be used to cancel the download of the tarball, when the
+	// publisher disconnects for example.
+	Context context.Context `json:"-"`
+	// Provenance is recorded on the version.
+	Provenance *Provenance `json:"-"`
 }
 
 type Version struct {
@@ -148,6 +180,49 @@ type Version struct {
 	Size                 int64             `json:"size,string"`
 	Sha256               string            `json:"sha256"`
 	TarPrefix            string            `json:"tar_prefix"`
+	// RegeneratedAt is only set for the versions with a regenerated tarball
+	// in a virtual space.
+	RegeneratedAt *time.Time `json:"regenerated_at,omitempty"`
+	// IPFSCID and IPFSURL are set when the tarball has been pinned to IPFS.
+	IPFSCID string `json:"ipfs_cid,omitempty"`
+	IPFSURL string `json:"ipfs_url,omitempty"`
+	// KeepForever exempts the version from the cleaning of the old versions.
+	KeepForever        bool              `json:"keep_forever"`
+	KeepForeverChanges []RetentionChange `json:"keep_forever_changes,omitempty"`
+	// LegalHold blocks the deletion of the version.
+	LegalHold *LegalHold `json:"legal_hold,omitempty"`
+	// Provenance tells who has published the version, and from where.
+	Provenance *Provenance `json:"provenance,omitempty"`
+	// Runtime is extracted from the manifest and the package.json when the
+	// version is published.
+	Runtime *Runtime `json:"runtime,omitempty"`
+	// ArchiveFormat is the format of the tarball (gzip, zstd, tar or zip),
+	// detected when the version is published.
+	ArchiveFormat string `json:"archive_format,omitempty"`
+	// Screenshots is the gallery of the version, in the order of the
+	// manifest, with the captions and the dimensions of the screenshots.
+	Screenshots []VersionScreenshot `json:"screenshots,omitempty"`
+	// Changelog is the "what's new" of the version, from the changes field of
+	// its manifest or from the CHANGELOG.md of its tarball.
+	Changelog string `json:"changelog,omitempty"`
+	// Signature is the signature of the sha256 of the tarball by the editor,
+	// and Signed is true when it has been verified at the publication.
+	Signature string `json:"signature,omitempty"`
+	Signed    bool   `json:"signed"`
+	// TrashedAt and TrashedBy are set for the unpublished versions that are
+	// in the trash.
+	TrashedAt *time.Time `json:"trashed_at,omitempty"`
+	TrashedBy string     `json:"trashed_by,omitempty"`
+	// PendingReview is set on the pending versions that wait for a review.
+	PendingReview *PendingReview `json:"pending_review,omitempty"`
+}
+
+// RetentionChange is an entry of the audit trail of the keep-forever label of
+// a version.
+type RetentionChange struct {
+	KeepForever bool      `json:"keep_forever"`
+	By          string    `json:"by"`
+	At          time.Time `json:"at"`
 }
 
 type Partnership struct {
@@ -159,15 +234,15 @@ type Partnership struct {
 // of applications. It is only here to help us reading some informations from
 // the manifest that are useful to us, without manipulating maps.
 type Manifest struct {
-	Editor      string      `json:"editor"`
-	Name        string      `json:"name"`
-	Slug        string      `json:"slug"`
-	Version     string      `json:"version"`
-	Icon        string      `json:"icon"`
-	Partnership Partnership `json:"partnership"`
-	Screenshots []string    `json:"screenshots"`
+	Editor      string       `json:"editor"`
+	Name        string       `json:"name"`
+	Slug        string       `json:"slug"`
+	Version     string       `json:"version"`
+	Icon        string       `json:"icon"`
+	Partnership Partnership  `json:"partnership"`
+	Screenshots []Screenshot `json:"screenshots"`
 	Locales     map[string]struct {
-		Screenshots []string `json:"screenshots"`
+		Screenshots []Screenshot `json:"screenshots"`
 	} `json:"locales"`
 }
 
@@ -177,13 +252,20 @@ type Tarball struct {
 	ManifestContent []byte
 	ManifestMap     map[string]interface{}
 	PackageVersion  string
+	PackageRuntime  *Runtime
+	ArchiveFormat   string
 	HasPrefix       bool
 	TarPrefix       string
 	ContentType     string
 	AppType         string
-	Content         []byte
-	URL             string
-	Size            int64
+	// Content is the temporary file of the tarball, released by Close
+	Content *os.File
+	URL     string
+	Size    int64
+	// Screenshots is set by HandleAssets
+	Screenshots []VersionScreenshot
+	// ChangelogContent is the CHANGELOG.md at the root of the application
+	ChangelogContent []byte
 }
 
 func IsValidApp(app *AppOptions) error {
@@ -209,6 +291,12 @@ func IsValidApp(app *AppOptions) error {
 	return nil
 }
 
+// IsValidLocale returns true if the locale is a language, with an optional
+// region, like fr or en_US.
+func IsValidLocale(locale string) bool {
+	return validLocaleReg.MatchString(locale)
+}
+
 func IsValidVersion(ver *VersionOptions) error {
 	var fields []string
 	if !validVersionReg.MatchString(ver.Version) {
@@ -226,7 +314,7 @@ func IsValidVersion(ver *VersionOptions) error {
 		return fmt.Errorf("Invalid version: "+
 			"the following fields are missing or erroneous: %s", strings.Join(fields, ", "))
 	}
-	return nil
+	return CheckVersionURL(ver.SpacePrefix, ver.URL)
 }
 
 func (av *AppVersions) GetAll() []string {
@@ -241,6 +329,9 @@ func CreateApp(c *space.Space, opts *AppOptions, editor *auth.Editor) (*App, err
 	if err := IsValidApp(opts); err != nil {
 		return nil, err
 	}
+	if err := checkProtectedSlug(c, opts.Slug); err != nil {
+		return nil, err
+	}
 
 	_, err := findApp(c, opts.Slug)
 	if err == nil {
@@ -256,6 +347,7 @@ func CreateApp(c *space.Space, opts *AppOptions, editor *auth.Editor) (*App, err
 	app.ID = getAppID(opts.Slug)
 	app.Rev = ""
 	app.Slug = app.ID
+	app.Name = app.Slug
 	app.Type = opts.Type
 	app.Editor = editor.Name()
 	app.CreatedAt = now
@@ -270,9 +362,27 @@ func CreateApp(c *space.Space, opts *AppOptions, editor *auth.Editor) (*App, err
 		Dev:    make([]string, 0),
 	}
 	app.Label = calculateAppLabel(app, nil)
+	webhooks.Send(c.Name, webhooks.AppCreated, app)
 	return app, nil
 }
 
+// checkProtectedSlug returns an error if the slug is protected and the space
+// is not its home space.
+func checkProtectedSlug(c *space.Space, appSlug string) error {
+	home, ok := base.Config.ProtectedSlugs[appSlug]
+	if !ok {
+		return nil
+	}
+	spaceName := c.Name
+	if spaceName == "" {
+		spaceName = base.DefaultSpacePrefix.String()
+	}
+	if home != spaceName {
+		return ErrAppSlugProtected
+	}
+	return nil
+}
+
 func ModifyApp(c *space.Space, appSlug string, opts AppOptions) (*App, error) {
 	app, err := findApp(c, appSlug)
 	if err != nil {
@@ -301,8 +411,16 @@ func ActivateMaintenanceApp(c *space.Space, appSlug string, opts MaintenanceOpti
 	}
 	app.MaintenanceActivated = true
 	app.MaintenanceOptions = &opts
-	_, err = c.AppsDB().Put(context.Background(), app.ID, app)
-	return err
+	if _, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return err
+	}
+	invalidateMaintenance()
+	purgeChannelCaches(c, app.Slug, Stable)
+	webhooks.Send(c.Name, webhooks.MaintenanceActivated, map[string]interface{}{
+		"slug":                app.Slug,
+		"maintenance_options": opts,
+	})
+	return nil
 }
 
 func DeactivateMaintenanceApp(c *space.Space, appSlug string) error {
@@ -312,10 +430,106 @@ func DeactivateMaintenanceApp(c *space.Space, appSlug string) error {
 	}
 	app.MaintenanceActivated = false
 	app.MaintenanceOptions = nil
+	if _, err = c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+		return err
+	}
+	invalidateMaintenance()
+	purgeChannelCaches(c, app.Slug, Stable)
+	return nil
+}
+
+// updateAppName copies the name from the manifest of a new stable version to
+// the application document, where it is used to sort the applications.
+func updateAppName(c *space.Space, ver *Version) error {
+	var manifest Manifest
+	if err := json.Unmarshal(ver.Manifest, &manifest); err != nil || manifest.Name == "" {
+		return nil
+	}
+	app, err := findApp(c, ver.Slug)
+	if err != nil {
+		return err
+	}
+	if app.Name == manifest.Name {
+		return nil
+	}
+	app.Name = manifest.Name
 	_, err = c.AppsDB().Put(context.Background(), app.ID, app)
 	return err
 }
 
+// FillMissingAppNames sets the name of the applications created before the
+// name was stored in their document. It returns the number of applications
+// updated.
+func FillMissingAppNames(c *space.Space) (int, error) {
+	// The documents without the field are not in the mango indexes, so this
+	// query is a full scan, but it is only made once per space.
+	query, err := mango.New("").
+		Where("name", mango.Exists, false).
+		Limit(maxLimit).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for {
+		rows, err := c.AppsDB().Find(context.Background(), query)
+		if err != nil {
+			return updated, err
+		}
+		apps := make([]*App, 0)
+		for rows.Next() {
+			var app App
+			if err := rows.ScanDoc(&app); err != nil {
+				rows.Close()
+				return updated, err
+			}
+			apps = append(apps, &app)
+		}
+		if err := rows.Err(); err != nil {
+			return updated, err
+		}
+		if len(apps) == 0 {
+			return updated, nil
+		}
+		for _, app := range apps {
+			app.Name = app.Slug
+			if version, err := FindLatestVersion(c, app.Slug, Stable); err == nil {
+				var manifest Manifest
+				if json.Unmarshal(version.Manifest, &manifest) == nil && manifest.Name != "" {
+					app.Name = manifest.Name
+				}
+			} else if err != ErrVersionNotFound {
+				return updated, err
+			}
+			if _, err := c.AppsDB().Put(context.Background(), app.ID, app); err != nil {
+				return updated, err
+			}
+			updated++
+		}
+	}
+}
+
+// FillAllMissingAppNames calls FillMissingAppNames on all the spaces. It is
+// meant to be run in a goroutine when the server starts.
+func FillAllMissingAppNames() {
+	for _, name := range space.GetSpacesNames() {
+		s, ok := space.GetSpace(name)
+		if !ok {
+			continue
+		}
+		log := logrus.WithFields(logrus.Fields{
+			"nspace": "apps_names",
+			"space":  s.GetPrefix().String(),
+		})
+		updated, err := FillMissingAppNames(s)
+		if err != nil {
+			log.WithField("error_msg", err).Error("Cannot fill the names of the applications")
+		} else if updated > 0 {
+			log.WithField("updated", updated).Info("Names of the applications filled")
+		}
+	}
+}
+
 func DownloadVersion(opts *VersionOptions) (*Version, []*kivik.Attachment, error) {
 	return downloadVersion(opts)
 }
@@ -345,46 +559,54 @@ func createVersion(c *space.Space, db *kivik.DB, ver *Version, attachments []*ki
 		return err
 	}
 
-	versionChannel := GetVersionChannel(ver.Version)
-	for _, channel := range Channels {
-		if channel >= versionChannel {
-			key := base.NewKey(c.Name, ver.Slug, ChannelToStr(channel))
-			base.LatestVersionsCache.Remove(key)
-			base.ListVersionsCache.Remove(key)
-		}
-	}
+	purgeChannelCaches(c, ver.Slug, GetVersionChannel(ver.Version))
 
 	// Storing the attachments to swift (screenshots, icon, partnership_icon)
+	atts, err := storeAttachments(c, ver, attachments)
+	if err != nil {
+		return err
+	}
+
+	// Update the version document to add an attachment that references global
+	// database
+	if len(atts) > 0 {
+		ver.AttachmentReferences = atts
+	}
+	_, err = db.Put(context.Background(), verID, ver, nil)
+	return err
+}
+
+// storeAttachments adds the attachments of a version to the global asset
+// store, and returns the references to them, indexed by filename.
+func storeAttachments(c *space.Space, ver *Version, attachments []*kivik.Attachment) (map[string]string, error) {
 	source := asset.ComputeSource(c.GetPrefix(), ver.Slug, ver.Version)
 	atts := map[string]string{}
 	for _, att := range attachments {
 		// Adding asset to the global asset store
 		a := &base.Asset{
 			Name:        att.Filename,
-			AppSlug:     app.Slug,
+			AppSlug:     ver.Slug,
 			ContentType: att.ContentType,
 		}
-		err = base.GlobalAssetStore.Add(a, att.Content, source)
-		if err != nil {
-			return err
+		if err := base.GlobalAssetStore.Add(a, att.Content, source); err != nil {
+			return nil, err
 		}
 
 		// We are going to use the attachment field to store a link to the
 		// global asset
 		atts[att.Filename] = a.Shasum
 	}
-
-	// Update the version document to add an attachment that references global
-	// database
-	if len(atts) > 0 {
-		ver.AttachmentReferences = atts
-	}
-	_, err = db.Put(context.Background(), verID, ver, nil)
-	return err
+	return atts, nil
 }
 
 func CreatePendingVersion(c *space.Space, ver *Version, attachments []*kivik.Attachment, app *App) error {
-	return createVersion(c, c.PendingVersDB(), ver, attachments, app, true)
+	if err := createVersion(c, c.PendingVersDB(), ver, attachments, app, true); err != nil {
+		return err
+	}
+	if ver.PendingReview != nil {
+		notifyPendingReview(c, ver)
+	}
+	return nil
 }
 
 func CreateReleaseVersion(c *space.Space, ver *Version, attachments []*kivik.Attachment, app *App, ensureVersion bool) (err error) {
@@ -403,9 +625,40 @@ func CreateReleaseVersion(c *space.Space, ver *Version, attachments []*kivik.Att
 			}
 		}
 	}
+
+	if GetVersionChannel(ver.Version) == Stable {
+		if err := updateAppName(c, ver); err != nil {
+			return err
+		}
+		Background(func() { updateSearchIndex(c, ver.Slug) })
+		Background(func() { updateFacets(c, ver.Slug) })
+		Background(func() { pinVersionToIPFS(c, ver) })
+	}
+	if GetVersionChannel(ver.Version) == Dev && base.Config.GetCleanParameters(c.GetPrefix()).NbDev > 0 {
+		Background(func() { trimDevVersions(c, ver) })
+	}
+	webhooks.Send(c.Name, webhooks.VersionCreated, ver)
 	return err
 }
 
+// trimDevVersions removes the dev versions of the application beyond the
+// retention policy, when a new dev version is published.
+func trimDevVersions(c *space.Space, ver *Version) {
+	removed, err := TrimDevVersions(c, ver.Slug, base.Config.GetCleanParameters(c.GetPrefix()).NbDev)
+	log := logrus.WithFields(logrus.Fields{
+		"nspace":  "clean_version",
+		"space":   c.Name,
+		"slug":    ver.Slug,
+		"version": ver.Version,
+		"removed": removed,
+	})
+	if err != nil {
+		log.WithField("error_msg", err).Error("Cannot trim the dev versions")
+	} else if len(removed) > 0 {
+		log.Info("Dev versions trimmed")
+	}
+}
+
 func (version *Version) Clone() *Version {
 	clone := *version
 	clone.AttachmentReferences = make(map[string]string)
@@ -419,6 +672,7 @@ func ApprovePendingVersion(c *space.Space, pending *Version, app *App) (*Version
 	db := c.PendingVersDB()
 	release := pending.Clone()
 	release.Rev = ""
+	release.PendingReview = nil
 
 	// Attachments are already created, skipping them
 	var attachments = []*kivik.Attachment{}
@@ -440,10 +694,10 @@ func ApprovePendingVersion(c *space.Space, pending *Version, app *App) (*Version
 
 	channelString := ChannelToStr(channel)
 
-	if base.Config.CleanEnabled {
+	if base.Config.IsCleanEnabled(c.GetPrefix()) {
 		// Cleaning the old versions
-		go func() {
-			err := CleanOldVersions(c, release.Slug, channelString, base.Config.CleanParameters, RealRun)
+		Background(func() {
+			_, err := CleanOldVersions(c, release.Slug, channelString, base.Config.GetCleanParameters(c.GetPrefix()), RealRun)
 			if err != nil {
 				log := logrus.WithFields(logrus.Fields{
 					"nspace":    "clean_version",
@@ -455,99 +709,16 @@ func ApprovePendingVersion(c *space.Space, pending *Version, app *App) (*Version
 				})
 				log.Error()
 			}
-		}()
+		})
 	}
 
 	return release, nil
 }
 
-func downloadRequest(rawURL string, shasum string) (reader *bytes.Reader, contentType string, err error) {
-	url, err := url.Parse(rawURL)
-	if err != nil {
-		return nil, "", err
-	}
-
-	buf := new(bytes.Buffer)
-
-	if url.Scheme == "file" {
-		f, err := os.Open(url.EscapedPath())
-		if err != nil {
-			return nil, "", err
-		}
-		_, err = io.Copy(buf, io.LimitReader(f, maxApplicationSize))
-		if err != nil {
-			return nil, "", err
-		}
-
-		// Find the mimetype
-		kind, _ := filetype.Match(buf.Bytes())
-		contentType = kind.MIME.Value
-	} else {
-		req, err := http.NewRequest(http.MethodGet, rawURL, nil)
-		if err != nil {
-			err = errshttp.NewError(http.StatusUnprocessableEntity,
-				"Could not reach version on specified url %s: %s", rawURL, err)
-			return nil, "", err
-		}
-
-		resp, err := versionClient.Do(req)
-		if err != nil {
-			err = errshttp.NewError(http.StatusUnprocessableEntity,
-				"Could not reach version on specified url %s: %s", rawURL, err)
-			return nil, "", err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			err = errshttp.NewError(http.StatusUnprocessableEntity,
-				"Could not reach version on specified url %s: server responded with code %d",
-				rawURL, resp.StatusCode)
-			return nil, "", err
-		}
-
-		_, err = io.Copy(buf, io.LimitReader(resp.Body, maxApplicationSize))
-		if err != nil {
-			err = errshttp.NewError(http.StatusUnprocessableEntity,
-				"Could not reach version on specified url %s: %s",
-				rawURL, err)
-			return nil, "", err
-		}
-
-		contentType = resp.Header.Get("content-type")
-	}
-	h := sha256.New()
-	if _, err = h.Write(buf.Bytes()); err != nil {
-		return
-	}
-	e, _ := hex.DecodeString(shasum)
-	if !bytes.Equal(e, h.Sum(nil)) {
-		err = errshttp.NewError(http.StatusUnprocessableEntity,
-			"Checksum does not match the calculated one (expecting %q, got %q)", shasum, hex.EncodeToString(h.Sum(nil)))
-		return
-	}
-
-	return bytes.NewReader(buf.Bytes()), contentType, nil
-}
-
-func tarReader(reader io.Reader, contentType string) (*tar.Reader, error) {
-	var err error
-	switch contentType {
-	case
-		"application/gzip",
-		"application/x-gzip",
-		"application/x-tgz",
-		"application/tar+gzip":
-		reader, err = gzip.NewReader(reader)
-		if err != nil {
-			return nil, err
-		}
-	case "application/octet-stream":
-		var r io.Reader
-		if r, err = gzip.NewReader(reader); err == nil {
-			reader = r
-		}
-	}
-	return tar.NewReader(reader), nil
+// Close releases the temporary file of the tarball content.
+func (t *Tarball) Close() {
+	removeTempFile(t.Content)
+	t.Content = nil
 }
 
 // CheckVersion controls the matching versions between retrieved tarball and
@@ -609,39 +780,39 @@ func (t *Tarball) CheckSlug() (bool, error) {
 }
 
 func downloadTarball(opts *VersionOptions, url string) (*Tarball, error) {
-	var buf *bytes.Reader
+	var file *os.File
 	var err error
 	var contentType string
 
-	// Downloading the file
-	tryCount := 0
-	for {
-		tryCount++
-		buf, contentType, err = downloadRequest(url, opts.Sha256)
-		if err == nil {
-			break
-		} else if tryCount <= 3 {
-			continue
-		} else {
-			return nil, err
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := base.Config.GetDownloadTimeout(opts.SpacePrefix)
+	maxSize := base.Config.GetMaxApplicationSize(opts.SpacePrefix)
+	tracked, done := trackDownload(ctx, DownloadProgress{
+		Space:   opts.SpacePrefix.String(),
+		Version: opts.Version,
+		URL:     url,
+	})
+	defer done()
+
+	// Downloading the file, with the retries
+	file, contentType, err = downloadRequest(ctx, timeout, url, opts.Sha256, maxSize, tracked)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The publisher has gone
+			return nil, errshttp.NewError(http.StatusUnprocessableEntity,
+				"The download of %s has been canceled", url)
 		}
+		return nil, err
 	}
 
-	// Reader for filesize
-	counter := &bytesCounter{}
-	var reader io.Reader = buf
-	reader = io.TeeReader(reader, counter)
-
 	// Reading the tarball content
-	tarball, err := ReadTarballVersion(reader, contentType, url)
+	tarball, err := readTarballFile(file, url, contentType)
 	if err != nil {
 		return nil, err
 	}
-
-	// Adding metadata to the tarball struct
-	tarball.ContentType = contentType
-	tarball.Size = counter.Written()
-
 	if !tarball.HasPrefix {
 		tarball.TarPrefix = ""
 	}
@@ -649,6 +820,27 @@ func downloadTarball(opts *VersionOptions, url string) (*Tarball, error) {
 	return tarball, nil
 }
 
+// readTarballFile reads a tarball from a temporary file, that is kept as the
+// content of the tarball. The file is removed on error.
+func readTarballFile(file *os.File, url, contentType string) (*Tarball, error) {
+	info, err := file.Stat()
+	if err != nil {
+		removeTempFile(file)
+		return nil, err
+	}
+	tarball, err := ReadTarballVersion(file, url, contentType)
+	if err != nil {
+		removeTempFile(file)
+		return nil, err
+	}
+
+	// Adding metadata to the tarball struct
+	tarball.Content = file
+	tarball.ContentType = archiveContentType(tarball.ArchiveFormat, contentType)
+	tarball.Size = info.Size()
+	return tarball, nil
+}
+
 func downloadVersion(opts *VersionOptions) (*Version, []*kivik.Attachment, error) {
 	var err *multierror.Error
 	url := opts.URL
@@ -657,16 +849,21 @@ func downloadVersion(opts *VersionOptions) (*Version, []*kivik.Attachment, error
 	if errd != nil {
 		return nil, nil, errd
 	}
+	defer tarball.Close()
 
 	// Checks
+	violations := manifest.Validate(tarball.AppType, tarball.ManifestContent)
 	if _, erre := tarball.CheckEditor(); erre != nil {
-		err = multierror.Append(err, erre)
+		violations = append(violations, manifest.Violation{Field: "editor", Rule: "editor", Message: erre.Error()})
 	}
 	if _, errs := tarball.CheckSlug(); errs != nil {
-		err = multierror.Append(err, errs)
+		violations = append(violations, manifest.Violation{Field: "slug", Rule: "slug", Message: errs.Error()})
 	}
 	if _, errv := tarball.CheckVersion(opts.Version); errv != nil {
-		err = multierror.Append(err, errv)
+		violations = append(violations, manifest.Violation{Field: "version", Rule: "version", Message: errv.Error()})
+	}
+	if len(violations) > 0 {
+		return nil, nil, &manifest.ValidationError{Violations: violations}
 	}
 
 	// Handling tarball assets
@@ -719,6 +916,18 @@ func downloadVersion(opts *VersionOptions) (*Version, []*kivik.Attachment, error
 	ver.Manifest = manifestContent
 	ver.Size = tarball.Size
 	ver.TarPrefix = tarball.TarPrefix
+	ver.Runtime = newRuntime(manifest, tarball.PackageRuntime)
+	ver.ArchiveFormat = tarball.ArchiveFormat
+	ver.Screenshots = tarball.Screenshots
+	ver.Changelog = versionChangelog(manifest, tarball.ChangelogContent, opts.Version)
+	if opts.Signature != "" {
+		ver.Signature = opts.Signature
+		ver.Signed = true
+	}
+	ver.Provenance = opts.Provenance
+	if ver.Provenance != nil {
+		ver.Provenance.TarballURL = url
+	}
 	ver.CreatedAt = time.Now().UTC()
 	return ver, attachments, nil
 }
@@ -749,27 +958,11 @@ func getPartnershipIconPath(parsedManifest *Manifest, opts *VersionOptions) stri
 	return partnershipIconPath
 }
 
-func getScreenshotPaths(parsedManifest *Manifest, opts *VersionOptions) []string {
+func getScreenshotPaths(shots []VersionScreenshot) []string {
 	var screenshotPaths []string
-	if opts.Screenshots != nil {
-		screenshotPaths = opts.Screenshots
-		for i, shot := range screenshotPaths {
-			screenshotPaths[i] = path.Join("/", shot)
-		}
-	} else {
-		for _, shot := range parsedManifest.Screenshots {
-			screenshotPaths = append(screenshotPaths, path.Join("/", shot))
-		}
-		for _, locale := range parsedManifest.Locales {
-			for _, shot := range locale.Screenshots {
-				shot = path.Join("/", shot)
-				if !stringInArray(shot, screenshotPaths) {
-					screenshotPaths = append(screenshotPaths, shot)
-				}
-			}
-		}
+	for _, shot := range shots {
+		screenshotPaths = append(screenshotPaths, shot.Path)
 	}
-
 	return screenshotPaths
 }
 
@@ -800,22 +993,27 @@ func getAssetFilename(iconPath, partnershipIconPath, name string, screenshotPath
 }
 
 // HandleAssets handles all the assets of the app tarball (icon, partnership
-// icon, screenshots). Appened to attachments
+// icon, screenshots). Appened to attachments. The gallery of the screenshots
+// found in the tarball is set on the tarball.
 func HandleAssets(tarball *Tarball, opts *VersionOptions) ([]*kivik.Attachment, error) {
 	var attachments = []*kivik.Attachment{}
 	parsedManifest := tarball.Manifest
 
 	iconPath := getIconPath(parsedManifest, opts)
 	partnershipIconPath := getPartnershipIconPath(parsedManifest, opts)
-	screenshotPaths := getScreenshotPaths(parsedManifest, opts)
+	shots := getScreenshots(parsedManifest, opts)
+	screenshotPaths := getScreenshotPaths(shots)
+	tarball.Screenshots = []VersionScreenshot{}
 
 	// Re-reading tarball content for assets
 	if len(screenshotPaths) == 0 && iconPath == "" && partnershipIconPath == "" {
 		return attachments, nil
 	}
 
-	var buf io.Reader = bytes.NewReader(tarball.Content)
-	tr, err := tarReader(buf, tarball.ContentType)
+	if _, err := tarball.Content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr, _, err := tarReader(tarball.Content, tarball.ContentType)
 	if err != nil {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Could not reach version on specified url %s: %s", tarball.URL, err)
@@ -869,35 +1067,126 @@ func HandleAssets(tarball *Tarball, opts *VersionOptions) ([]*kivik.Attachment,
 			Filename:    filename,
 			ContentType: mime,
 		})
+		for i := range shots {
+			if filename == path.Join("screenshots", shots[i].Path) {
+				shots[i].Filename = path.Base(shots[i].Path)
+				shots[i].ContentType = mime
+				shots[i].Width, shots[i].Height = imageDimensions(mime, data)
+			}
+		}
+	}
+
+	// Keeps the order of the manifest, not the one of the tarball, for the
+	// screenshots that have been found
+	for _, shot := range shots {
+		for _, att := range attachments {
+			if att.Filename == path.Join("screenshots", shot.Path) {
+				tarball.Screenshots = append(tarball.Screenshots, shot)
+				break
+			}
+		}
 	}
 
 	return attachments, nil
 }
 
+// ExtractVersionAttachments re-runs the extraction of the attachments (icon,
+// partnership icon, screenshots) of an existing version, from its stored
+// tarball. It can be used when the assets paths of the manifest were wrong,
+// the opts can be used to give the correct paths. The attachments references
+// of the version document are updated.
+func ExtractVersionAttachments(c *space.Space, ver *Version, opts *VersionOptions) (*Version, error) {
+	prefix := c.GetPrefix()
+	filename := path.Base(ver.URL)
+	content, headers, err := base.Storage.Get(prefix, filepath.Join(ver.Slug, ver.Version, filename))
+	var file *os.File
+	var contentType string
+	if err == nil {
+		file, _, _, err = spool(content, ver.URL, 0)
+		if err != nil {
+			return nil, err
+		}
+		contentType = headers["Content-Type"]
+	} else {
+		// Fallback on the version URL for the versions without a stored tarball
+		file, contentType, err = downloadRequest(context.Background(),
+			base.Config.GetDownloadTimeout(prefix), ver.URL, ver.Sha256,
+			base.Config.GetMaxApplicationSize(prefix), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tarball, err := readTarballFile(file, ver.URL, contentType)
+	if err != nil {
+		return nil, err
+	}
+	defer tarball.Close()
+	if !tarball.HasPrefix {
+		tarball.TarPrefix = ""
+	}
+
+	attachments, err := HandleAssets(tarball, opts)
+	if err != nil {
+		return nil, err
+	}
+	atts, err := storeAttachments(c, ver, attachments)
+	if err != nil {
+		return nil, err
+	}
+
+	// Dereferences the assets that are no longer used by this version
+	source := asset.ComputeSource(prefix, ver.Slug, ver.Version)
+	kept := make(map[string]bool, len(atts))
+	for _, shasum := range atts {
+		kept[shasum] = true
+	}
+	for _, shasum := range ver.AttachmentReferences {
+		if kept[shasum] {
+			continue
+		}
+		if err := base.GlobalAssetStore.Remove(shasum, source); err != nil {
+			return nil, err
+		}
+		kept[shasum] = true
+	}
+
+	ver.AttachmentReferences = atts
+	ver.Screenshots = tarball.Screenshots
+	ver.Rev, err = c.VersDB().Put(context.Background(), ver.ID, ver)
+	if err != nil {
+		return nil, err
+	}
+
+	purgeChannelCaches(c, ver.Slug, GetVersionChannel(ver.Version))
+	return ver, nil
+}
+
 func saveTarball(prefix base.Prefix, filepath string, tarball *Tarball) error {
-	var content = bytes.NewReader(tarball.Content)
-	return base.Storage.Create(prefix, filepath, tarball.ContentType, content)
+	if _, err := tarball.Content.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return base.Storage.Create(prefix, filepath, tarball.ContentType, tarball.Content)
 }
 
 // ReadTarballVersion reads the content of the version tarball which has been
 // downloaded. It reads the tarball to check if an app prefix exists, ensure
 // that the manifest and the package.json (if exists) files are correct, and
 // eventually returns a Tarball struct that holds these informations for the
-// next steps
-func ReadTarballVersion(reader io.Reader, contentType, url string) (*Tarball, error) {
+// next steps. The archive can be a tar (compressed or not) or a zip, and the
+// Content-Type is used when its format can't be detected from its content.
+func ReadTarballVersion(reader io.Reader, url, contentType string) (*Tarball, error) {
 	var appType, tarPrefix string
 	var packVersion string
+	var packRuntime *Runtime
 	var manifestContent []byte
 	var manifest *Manifest
 	var manifestmap map[string]interface{}
-
-	var content = new(bytes.Buffer)
-
-	reader = io.TeeReader(reader, content)
+	var changelogContent []byte
 
 	hasPrefix := true
 
-	tr, err := tarReader(reader, contentType)
+	tr, format, err := tarReader(reader, contentType)
 	if err != nil {
 		err = errshttp.NewError(http.StatusUnprocessableEntity,
 			"Cannot read tarball for url %s: %s", url, err)
@@ -952,6 +1241,15 @@ func ReadTarballVersion(reader io.Reader, contentType, url string) (*Tarball, er
 			}
 		}
 
+		if changelogContent == nil && isChangelogFile(basename, dirname) {
+			changelogContent, err = ioutil.ReadAll(io.LimitReader(tr, 4*maxChangelogSize))
+			if err != nil {
+				err = errshttp.NewError(http.StatusUnprocessableEntity,
+					"Could not reach version on specified url %s: %s", url, err)
+				return nil, err
+			}
+		}
+
 		if basename == "package.json" {
 			var packageContent []byte
 			packageContent, err = ioutil.ReadAll(tr)
@@ -969,6 +1267,11 @@ func ReadTarballVersion(reader io.Reader, contentType, url string) (*Tarball, er
 				return nil, err
 			}
 			packVersion = pack.Version
+			// Only the package.json at the root of the app tells its runtime,
+			// not the ones of its dependencies.
+			if packRuntime == nil && strings.Count(dirname, "/") <= 1 {
+				packRuntime = readPackageRuntime(packageContent)
+			}
 		}
 	}
 
@@ -977,15 +1280,17 @@ func ReadTarballVersion(reader io.Reader, contentType, url string) (*Tarball, er
 	}
 
 	return &Tarball{
-		Manifest:        manifest,
-		ManifestMap:     manifestmap,
-		ManifestContent: manifestContent,
-		AppType:         appType,
-		PackageVersion:  packVersion,
-		HasPrefix:       hasPrefix,
-		TarPrefix:       tarPrefix,
-		Content:         content.Bytes(),
-		URL:             url,
+		Manifest:         manifest,
+		ManifestMap:      manifestmap,
+		ManifestContent:  manifestContent,
+		AppType:          appType,
+		PackageVersion:   packVersion,
+		PackageRuntime:   packRuntime,
+		ArchiveFormat:    format,
+		HasPrefix:        hasPrefix,
+		TarPrefix:        tarPrefix,
+		URL:              url,
+		ChangelogContent: changelogContent,
 	}, nil
 }
 
@@ -1024,6 +1329,10 @@ func ReadTarballManifest(tr io.Reader, url string) (*Manifest, []byte, map[strin
 
 // Expire function deletes a version from the database
 func (v *Version) Delete(c *space.Space) error {
+	if err := checkVersionLegalHold(c, v, "delete version"); err != nil {
+		return err
+	}
+
 	// Purge overwritten versions if any
 	for _, vs := range base.Config.VirtualSpaces {
 		if err := DeleteOverwrittenVersion(vs, v); err != nil {
@@ -1039,9 +1348,83 @@ func (v *Version) Delete(c *space.Space) error {
 
 	// Removing the CouchDB document
 	db := c.VersDB()
-	_, err = db.Delete(context.Background(), v.ID, v.Rev)
+	if _, err = db.Delete(context.Background(), v.ID, v.Rev); err != nil {
+		return err
+	}
 
-	return err
+	v.purgeCaches(c)
+	webhooks.Send(c.Name, webhooks.VersionDeleted, map[string]interface{}{
+		"slug":    v.Slug,
+		"version": v.Version,
+		"type":    v.Type,
+	})
+	return nil
+}
+
+func (v *Version) purgeCaches(c *space.Space) {
+	purgeChannelCaches(c, v.Slug, GetVersionChannel(v.Version))
+}
+
+// SetKeepForever sets or removes the keep-forever label of a version. The
+// change is logged and kept in the audit trail of the version.
+func (v *Version) SetKeepForever(c *space.Space, keep bool, by string) error {
+	if v.KeepForever == keep {
+		return nil
+	}
+	v.KeepForever = keep
+	v.KeepForeverChanges = append(v.KeepForeverChanges, RetentionChange{
+		KeepForever: keep,
+		By:          by,
+		At:          time.Now().UTC(),
+	})
+	rev, err := c.VersDB().Put(context.Background(), v.ID, v)
+	if err != nil {
+		return err
+	}
+	v.Rev = rev
+	v.purgeCaches(c)
+
+	logrus.WithFields(logrus.Fields{
+		"nspace":       "audit",
+		"space":        c.Name,
+		"slug":         v.Slug,
+		"version":      v.Version,
+		"keep_forever": keep,
+		"by":           by,
+	}).Info("Keep-forever label changed")
+	return nil
+}
+
+// Unpublish moves a released version to the trash, or deletes it with its
+// attachments if the trash is disabled, and refreshes the versions views of
+// the app, so that the next requests don't have to wait for the views to be
+// updated.
+func (v *Version) Unpublish(c *space.Space, by string) error {
+	var err error
+	if base.Config.TrashRetention > 0 {
+		err = v.Trash(c, by)
+	} else {
+		err = v.Delete(c)
+	}
+	if err != nil {
+		return err
+	}
+	return refreshVersionsViews(c, v.Slug)
+}
+
+// refreshVersionsViews queries the versions view for the application, so
+// that CouchDB updates it.
+func refreshVersionsViews(c *space.Space, appSlug string) error {
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	rows, err := versionViewQuery(ctx, c, c.VersDB(), appSlug, ChannelToStr(Dev), map[string]interface{}{
+		"limit": 0,
+	})
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	return nil
 }
 
 // RemoveAllAttachments removes all the attachments of a version
@@ -1081,12 +1464,18 @@ func deleteAllVersionsOfAnApp(s *space.Space, app *App) error {
 	}
 
 	for _, version := range app.Versions.GetAll() {
+		log := logrus.WithFields(logrus.Fields{
+			"nspace":  "delete_app",
+			"space":   s.Name,
+			"slug":    app.Slug,
+			"version": version,
+		})
 		v, err := FindVersion(s, app.Slug, version)
 		if err != nil {
-			fmt.Printf("Version not found: %s/%s\n", app.Slug, version)
+			log.WithField("error_msg", err).Warn("Version not found")
 			continue
 		}
-		fmt.Printf("Removing %s/%s\n", v.Slug, v.Version)
+		log.Info("Removing the version")
 		err = v.Delete(s)
 		if err != nil {
 			return err
@@ -1096,7 +1485,27 @@ func deleteAllVersionsOfAnApp(s *space.Space, app *App) error {
 	return nil
 }
 
-// RemoveAppFromSpace deletes an application and all its versions from a space.
+func deletePendingVersionsOfAnApp(s *space.Space, app *App) error {
+	pending, err := GetPendingVersions(s)
+	if err != nil {
+		return err
+	}
+	for _, v := range pending {
+		if v.Slug != app.Slug {
+			continue
+		}
+		if err := v.RemoveAllAttachments(s); err != nil {
+			return err
+		}
+		if _, err := s.PendingVersDB().Delete(context.Background(), v.ID, v.Rev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAppFromSpace deletes an application, all its versions (including the
+// pending and trashed ones) and their attachments from a space.
 func RemoveAppFromSpace(s *space.Space, appSlug string) error {
 	app, err := findApp(s, appSlug)
 	if err != nil {
@@ -1108,38 +1517,76 @@ func RemoveAppFromSpace(s *space.Space, appSlug string) error {
 		return err
 	}
 
+	if err := checkAppLegalHold(s, app, "delete app"); err != nil {
+		return err
+	}
 	if err := deleteAllVersionsOfAnApp(s, app); err != nil {
 		return err
 	}
+	if err := deletePendingVersionsOfAnApp(s, app); err != nil {
+		return err
+	}
+	if err := deleteTrashedVersionsOfAnApp(s, app); err != nil {
+		return err
+	}
+	purgeChannelCaches(s, app.Slug, Stable)
 
 	db := s.AppsDB()
-	_, err = db.Delete(context.Background(), app.ID, app.Rev)
-	return err
+	if _, err = db.Delete(context.Background(), app.ID, app.Rev); err != nil {
+		return err
+	}
+	if err := space.RecordRemoval(s, app.Slug); err != nil {
+		return err
+	}
+	updateSearchIndex(s, app.Slug)
+	updateFacets(s, app.Slug)
+	return nil
 }
 
-// RemoveSpace deletes CouchDB databases and Swift container for this space.
-func RemoveSpace(s *space.Space) error {
-	// Removing the applications versions, to clean the assets in the
-	// __assets__ container.
-	var cursor int = 0
-	for cursor != -1 {
+// forEachAppOfSpace calls fn for all the applications of a space, with their
+// versions.
+func forEachAppOfSpace(s *space.Space, fn func(app *App) error) error {
+	cursor := ""
+	for {
 		next, apps, err := GetAppsList(nil, s, &AppsListOptions{
 			Limit:                200,
 			Cursor:               cursor,
 			LatestVersionChannel: Stable,
 			VersionsChannel:      Dev,
 		})
-
 		if err != nil {
 			return err
 		}
-		cursor = next
 
 		for _, app := range apps { // Iterate over 200 apps
-			if err := deleteAllVersionsOfAnApp(s, app); err != nil {
+			if err := fn(app); err != nil {
 				return err
 			}
 		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// RemoveSpace deletes CouchDB databases and Swift container for this space.
+func RemoveSpace(s *space.Space) error {
+	// Nothing is removed if an application of the space is under legal hold
+	err := forEachAppOfSpace(s, func(app *App) error {
+		return checkAppLegalHold(s, app, "delete space")
+	})
+	if err != nil {
+		return err
+	}
+
+	// Removing the applications versions, to clean the assets in the
+	// __assets__ container.
+	err = forEachAppOfSpace(s, func(app *App) error {
+		return deleteAllVersionsOfAnApp(s, app)
+	})
+	if err != nil {
+		return err
 	}
 
 	// Removing swift container
@@ -1153,6 +1600,14 @@ func RemoveSpace(s *space.Space) error {
 		return err
 	}
 
+	if err := base.DBClient.DestroyDB(context.Background(), s.TrashVersDB().Name()); err != nil {
+		return err
+	}
+
+	if err := base.DBClient.DestroyDB(context.Background(), s.StatsDB().Name()); err != nil {
+		return err
+	}
+
 	if err := base.DBClient.DestroyDB(context.Background(), s.VersDB().Name()); err != nil {
 		return err
 	}
@@ -319,7 +319,7 @@ func TestGetAppsList(t *testing.T) {
 		VersionsChannel:      Dev,
 	})
 	assert.NoError(t, err)
-	assert.Equal(t, -1, cursor) // No error if the cursor == -1
+	assert.Equal(t, "", cursor) // No error if the cursor is empty
 	assert.Equal(t, 2, len(apps))
 }
 
@@ -535,6 +535,34 @@ func TestRemoveSpace(t *testing.T) {
 	assert.False(t, ok)
 }
 
+func TestListingDiffRemovedApps(t *testing.T) {
+	s, _ := space.GetSpace(testSpaceName)
+	before := time.Now().UTC()
+	for _, slug := range []string{"diff-removed", "diff-kept"} {
+		_, err := CreateApp(s, &AppOptions{Editor: "cozy", Slug: slug, Type: "webapp"}, editor)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, RemoveAppFromSpace(s, "diff-removed"))
+	after := time.Now().UTC().Add(time.Second)
+
+	diff, err := GetListingDiff(s, before, after)
+	assert.NoError(t, err)
+	assert.NotContains(t, diff.AppsAdded, "diff-removed")
+	assert.Contains(t, diff.AppsAdded, "diff-kept")
+	assert.Equal(t, []string{"diff-removed"}, diff.AppsRemoved)
+
+	// The removals are outside of the window
+	diff, err = GetListingDiff(s, before.Add(-time.Hour), before)
+	assert.NoError(t, err)
+	assert.Empty(t, diff.AppsRemoved)
+
+	// The removals are recorded for each space
+	other, _ := space.GetSpace("__default__")
+	diff, err = GetListingDiff(other, before, after)
+	assert.NoError(t, err)
+	assert.Empty(t, diff.AppsRemoved)
+}
+
 func TestMain(m *testing.M) {
 	config.SetDefaults()
 	viper.Set("spaces", []string{"__default__", testSpaceName})
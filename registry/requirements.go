@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/manifest"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// requiredManifestFields returns the fields that must be present in the
+// manifest of an application for a version to be accepted, from the schemas
+// of the manifests.
+func requiredManifestFields() []string {
+	var fields []string
+	for _, appType := range validAppTypes {
+		schema := manifest.SchemaFor(appType)
+		if schema == nil {
+			continue
+		}
+		for _, field := range schema.Required {
+			if !stringInArray(field, fields) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// PublishRequirements describes the validation policy applied by the registry
+// when a new version is published in a space. It can be used by the editor
+// tooling to validate a version before sending it.
+type PublishRequirements struct {
+	Space                  string   `json:"space"`
+	MaxApplicationSize     int64    `json:"max_application_size"`
+	RequiredManifestFields []string `json:"required_manifest_fields"`
+	SignatureRequired      bool     `json:"signature_required"`
+	AllowedCategories      []string `json:"allowed_categories"`
+	AppTypes               []string `json:"app_types"`
+	Channels               []string `json:"channels"`
+	VersionFormat          string   `json:"version_format"`
+	SlugFormat             string   `json:"slug_format"`
+	ArchiveFormats         []string `json:"archive_formats"`
+}
+
+// GetPublishRequirements returns the current publish requirements for the
+// given space.
+func GetPublishRequirements(c *space.Space) *PublishRequirements {
+	channels := make([]string, len(Channels))
+	for i, channel := range Channels {
+		channels[i] = ChannelToStr(channel)
+	}
+	formats := make([]string, 0, len(base.ArchiveFormats))
+	for _, format := range base.ArchiveFormats {
+		if isArchiveFormatAccepted(format) {
+			formats = append(formats, format)
+		}
+	}
+	return &PublishRequirements{
+		Space:                  c.Name,
+		MaxApplicationSize:     base.Config.GetMaxApplicationSize(c.GetPrefix()),
+		RequiredManifestFields: requiredManifestFields(),
+		SignatureRequired:      base.Config.IsSignatureRequired(c.GetPrefix()),
+		AllowedCategories:      manifest.Categories,
+		AppTypes:               validAppTypes,
+		Channels:               channels,
+		VersionFormat:          validVersionReg.String(),
+		SlugFormat:             validSlugReg.String(),
+		ArchiveFormats:         formats,
+	}
+}
@@ -0,0 +1,70 @@
+package registry
+
+import (
+	"net/http"
+
+	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// ResolveVersion returns the highest version of the application published in
+// the given channel (or a more stable one) that satisfies the semver
+// constraint, like "^1.2.0" or ">= 2.0, < 3".
+//
+// The beta and dev versions are compared on their release part: for example,
+// 1.3.0-beta.2 satisfies ^1.2.0 when the channel is beta or dev.
+func ResolveVersion(c *space.Space, appSlug, constraint string, channel Channel) (*Version, error) {
+	constraints, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, errshttp.NewError(http.StatusBadRequest,
+			"Invalid version constraint %q: %s", constraint, err)
+	}
+
+	versions, err := FindAppVersions(c, appSlug, channel, NotConcatenated)
+	if err != nil {
+		return nil, err
+	}
+	candidates := versions.Stable
+	if channel == Beta || channel == Dev {
+		candidates = append(candidates, versions.Beta...)
+	}
+	if channel == Dev {
+		candidates = append(candidates, versions.Dev...)
+	}
+
+	best, ok := matchVersion(constraints, candidates)
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+	return FindPublishedVersion(c, appSlug, best)
+}
+
+// matchVersion returns the highest version of the list that satisfies the
+// constraints.
+func matchVersion(constraints *semver.Constraints, versions []string) (string, bool) {
+	var best *semver.Version
+	var bestStr string
+	for _, v := range versions {
+		sv, err := semver.NewVersion(v)
+		if err != nil {
+			continue
+		}
+		release := sv
+		if sv.Prerelease() != "" {
+			r, err := sv.SetPrerelease("")
+			if err != nil {
+				continue
+			}
+			release = &r
+		}
+		if !constraints.Check(release) {
+			continue
+		}
+		if best == nil || sv.GreaterThan(best) {
+			best = sv
+			bestStr = v
+		}
+	}
+	return bestStr, best != nil
+}
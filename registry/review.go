@@ -0,0 +1,205 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/manifest"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons of the reviews of the versions.
+const (
+	// ReviewPermissions is for the stable versions that ask for new
+	// permissions, in the spaces where they must be reviewed.
+	ReviewPermissions = "permissions"
+	// ReviewModeration is for all the versions published in the moderated
+	// spaces.
+	ReviewModeration = "moderation"
+)
+
+// Decisions of the reviewers.
+const (
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// ErrReviewCommentMissing is returned when a version is rejected without a
+// comment for its editor.
+var ErrReviewCommentMissing = errshttp.NewError(http.StatusBadRequest,
+	"A comment is required to reject a version")
+
+// ErrVersionPending is returned when a version is published again while it
+// waits for a review or an approval.
+var ErrVersionPending = errshttp.NewError(http.StatusConflict,
+	"Version is waiting for an approval")
+
+// PendingReview is set on the versions that must be reviewed by an admin
+// before their release. These versions are kept with the pending versions, and
+// are not visible until they have been approved.
+type PendingReview struct {
+	// Reason tells why the version must be reviewed (permissions or
+	// moderation).
+	Reason string `json:"reason"`
+	// PreviousVersion is the stable version with which the permissions have
+	// been compared.
+	PreviousVersion string `json:"previous_version,omitempty"`
+	// Permissions are the names of the permissions that have been added or
+	// that give more rights than in the previous version.
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// ReviewDecision is the approval or the rejection of a version by a
+// reviewer.
+type ReviewDecision struct {
+	Status  string    `json:"status"`
+	Comment string    `json:"comment,omitempty"`
+	By      string    `json:"by"`
+	At      time.Time `json:"at"`
+}
+
+// CheckReview returns the review needed by a new version, or nil if it can be
+// released right away. In the moderated spaces, all the versions must be
+// reviewed. In the spaces where the permissions are reviewed, only the stable
+// versions that ask for new permissions, compared to the previous stable
+// version, must be reviewed.
+func CheckReview(c *space.Space, ver *Version) (*PendingReview, error) {
+	moderated := base.Config.IsModerationEnabled(c.GetPrefix())
+	if !moderated && !base.Config.IsPermissionsReviewRequired(c.GetPrefix()) {
+		return nil, nil
+	}
+	review, err := checkPermissionsReview(c, ver)
+	if err != nil {
+		return nil, err
+	}
+	if moderated {
+		if review == nil {
+			review = &PendingReview{}
+		}
+		review.Reason = ReviewModeration
+	}
+	return review, nil
+}
+
+// checkPermissionsReview compares the permissions of a stable version with
+// the ones of the previous stable version.
+func checkPermissionsReview(c *space.Space, ver *Version) (*PendingReview, error) {
+	if GetVersionChannel(ver.Version) != Stable {
+		return nil, nil
+	}
+	previous, err := FindLatestVersion(c, ver.Slug, Stable)
+	if err == ErrVersionNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	diff, err := manifest.Compare(previous.Manifest, ver.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	var permissions []string
+	for name := range diff.Permissions.Added {
+		permissions = append(permissions, name)
+	}
+	for name := range diff.Permissions.Changed {
+		permissions = append(permissions, name)
+	}
+	if len(permissions) == 0 {
+		return nil, nil
+	}
+	sort.Strings(permissions)
+	return &PendingReview{
+		Reason:          ReviewPermissions,
+		PreviousVersion: previous.Version,
+		Permissions:     permissions,
+	}, nil
+}
+
+// GetPendingReviews returns the versions of a space that wait for a review.
+func GetPendingReviews(c *space.Space) ([]*Version, error) {
+	pending, err := GetPendingVersions(c)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*Version, 0)
+	for _, ver := range pending {
+		if ver.PendingReview != nil {
+			versions = append(versions, ver)
+		}
+	}
+	return versions, nil
+}
+
+// ApproveReview releases a version that was waiting for a review.
+func ApproveReview(c *space.Space, pending *Version, app *App, decision *ReviewDecision) (*Version, error) {
+	decision.Status = ReviewApproved
+	release, err := ApprovePendingVersion(c, pending, app)
+	if err != nil {
+		return nil, err
+	}
+	notifyReviewDecision(c, pending, decision)
+	return release, nil
+}
+
+// RejectReview removes a version that was waiting for a review. The comment
+// of the decision is sent to the webhooks, so that the editor can be told why
+// the version has been rejected.
+func RejectReview(c *space.Space, pending *Version, decision *ReviewDecision) error {
+	if decision.Comment == "" {
+		return ErrReviewCommentMissing
+	}
+	decision.Status = ReviewRejected
+	if err := pending.RemoveAllAttachments(c); err != nil {
+		return err
+	}
+	if _, err := c.PendingVersDB().Delete(context.Background(), pending.ID, pending.Rev); err != nil {
+		return err
+	}
+	notifyReviewDecision(c, pending, decision)
+	return nil
+}
+
+// notifyPendingReview tells the webhooks that a version waits for a review.
+func notifyPendingReview(c *space.Space, ver *Version) {
+	webhooks.Send(c.Name, webhooks.VersionPendingReview, map[string]interface{}{
+		"slug":           ver.Slug,
+		"version":        ver.Version,
+		"type":           ver.Type,
+		"editor":         ver.Editor,
+		"pending_review": ver.PendingReview,
+	})
+}
+
+func notifyReviewDecision(c *space.Space, ver *Version, decision *ReviewDecision) {
+	event := webhooks.VersionApproved
+	if decision.Status == ReviewRejected {
+		event = webhooks.VersionRejected
+	}
+	webhooks.Send(c.Name, event, map[string]interface{}{
+		"slug":     ver.Slug,
+		"version":  ver.Version,
+		"type":     ver.Type,
+		"editor":   ver.Editor,
+		"decision": decision,
+	})
+	reason := ""
+	if ver.PendingReview != nil {
+		reason = ver.PendingReview.Reason
+	}
+	logrus.WithFields(logrus.Fields{
+		"nspace":  "audit",
+		"space":   c.Name,
+		"slug":    ver.Slug,
+		"version": ver.Version,
+		"reason":  reason,
+		"by":      decision.By,
+		"comment": decision.Comment,
+	}).Infof("Version %s after review", decision.Status)
+}
@@ -0,0 +1,178 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+)
+
+const robotsDBSuffix = "robots"
+
+// robotsRefreshInterval is the maximal delay before a change of the robots
+// policies made by another instance of the registry is seen.
+const robotsRefreshInterval = time.Minute
+
+// RobotsPolicy tells if a space can be indexed by the search engines.
+type RobotsPolicy struct {
+	Space string `json:"space"`
+	Index bool   `json:"index"`
+	// Source is "config" when the policy comes from the configuration file,
+	// and "admin" when it has been set via the admin API.
+	Source    string     `json:"source"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+type robotsOverride struct {
+	ID        string    `json:"_id,omitempty"`
+	Rev       string    `json:"_rev,omitempty"`
+	Index     bool      `json:"index"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var robotsOverrides struct {
+	sync.Mutex
+	docs     map[string]robotsOverride
+	loadedAt time.Time
+}
+
+func getRobotsDB() (*kivik.DB, error) {
+	dbName := base.DBName(robotsDBSuffix)
+	ok, err := base.DBClient.DBExists(context.Background(), dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
+			if kivik.StatusCode(err) != http.StatusPreconditionFailed {
+				return nil, err
+			}
+		}
+	}
+	db := base.DBClient.DB(context.Background(), dbName)
+	return db, db.Err()
+}
+
+func spaceDocName(spaceName string) string {
+	if spaceName == "" {
+		return base.DefaultSpacePrefix.String()
+	}
+	return spaceName
+}
+
+// loadRobotsOverrides returns the policies set via the admin API. They are
+// kept in memory for a short time, as they are checked on every request.
+func loadRobotsOverrides(force bool) (map[string]robotsOverride, error) {
+	robotsOverrides.Lock()
+	defer robotsOverrides.Unlock()
+	if !force && robotsOverrides.docs != nil && time.Since(robotsOverrides.loadedAt) < robotsRefreshInterval {
+		return robotsOverrides.docs, nil
+	}
+
+	db, err := getRobotsDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := make(map[string]robotsOverride)
+	for rows.Next() {
+		var doc robotsOverride
+		if err := rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		docs[doc.ID] = doc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	robotsOverrides.docs = docs
+	robotsOverrides.loadedAt = time.Now()
+	return docs, nil
+}
+
+// GetRobotsPolicy returns the robots policy for the given space (or virtual
+// space). If the overrides can't be loaded, the configuration file is used.
+func GetRobotsPolicy(spaceName string) RobotsPolicy {
+	name := spaceDocName(spaceName)
+	if docs, err := loadRobotsOverrides(false); err == nil {
+		if doc, ok := docs[name]; ok {
+			updatedAt := doc.UpdatedAt
+			return RobotsPolicy{Space: name, Index: doc.Index, Source: "admin", UpdatedAt: &updatedAt}
+		}
+	}
+	return RobotsPolicy{Space: name, Index: base.Config.IndexedSpaces[name], Source: "config"}
+}
+
+// ListRobotsPolicies returns the robots policies of all the spaces and
+// virtual spaces.
+func ListRobotsPolicies() []RobotsPolicy {
+	names := space.GetSpacesNames()
+	for name := range base.Config.VirtualSpaces {
+		names = append(names, name)
+	}
+	policies := make([]RobotsPolicy, len(names))
+	for i, name := range names {
+		policies[i] = GetRobotsPolicy(name)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Space < policies[j].Space
+	})
+	return policies
+}
+
+// SetRobotsPolicy overrides the configuration file for the given space.
+func SetRobotsPolicy(spaceName string, index bool) (RobotsPolicy, error) {
+	name := spaceDocName(spaceName)
+	db, err := getRobotsDB()
+	if err != nil {
+		return RobotsPolicy{}, err
+	}
+	doc := robotsOverride{ID: name}
+	if err := db.Get(context.Background(), name).ScanDoc(&doc); err != nil {
+		if kivik.StatusCode(err) != http.StatusNotFound {
+			return RobotsPolicy{}, err
+		}
+	}
+	doc.Index = index
+	doc.UpdatedAt = time.Now().UTC()
+	if _, err := db.Put(context.Background(), doc.ID, doc); err != nil {
+		return RobotsPolicy{}, err
+	}
+	if _, err := loadRobotsOverrides(true); err != nil {
+		return RobotsPolicy{}, err
+	}
+	return GetRobotsPolicy(spaceName), nil
+}
+
+// ResetRobotsPolicy removes the override of the admin API for the given
+// space, and the policy of the configuration file applies again.
+func ResetRobotsPolicy(spaceName string) (RobotsPolicy, error) {
+	name := spaceDocName(spaceName)
+	db, err := getRobotsDB()
+	if err != nil {
+		return RobotsPolicy{}, err
+	}
+	var doc robotsOverride
+	if err := db.Get(context.Background(), name).ScanDoc(&doc); err != nil {
+		if kivik.StatusCode(err) != http.StatusNotFound {
+			return RobotsPolicy{}, err
+		}
+	} else if _, err := db.Delete(context.Background(), doc.ID, doc.Rev); err != nil {
+		return RobotsPolicy{}, err
+	}
+	if _, err := loadRobotsOverrides(true); err != nil {
+		return RobotsPolicy{}, err
+	}
+	return GetRobotsPolicy(spaceName), nil
+}
@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/cozy/cozy-apps-registry/space"
+)
+
+// trackedFrameworks is the list of the dependencies for which the version is
+// kept in the runtime of the versions.
+var trackedFrameworks = []string{
+	"cozy-konnector-libs",
+	"cozy-client",
+	"cozy-ui",
+	"cozy-bar",
+}
+
+// Runtime tells which language, runtime and frameworks are declared by a
+// version of an application. It is used to plan the deprecations of the
+// platform.
+type Runtime struct {
+	// Language is the language field of the manifest (konnectors only).
+	Language string `json:"language,omitempty"`
+	// Node is the engines.node field of the package.json.
+	Node string `json:"node,omitempty"`
+	// Frameworks are the versions of the tracked dependencies, as declared
+	// in the package.json.
+	Frameworks map[string]string `json:"frameworks,omitempty"`
+}
+
+// readPackageRuntime extracts the runtime from the content of a package.json.
+// It never fails, as a package.json with unexpected fields must not prevent
+// the publication of a version.
+func readPackageRuntime(content []byte) *Runtime {
+	var pack struct {
+		Engines         map[string]interface{} `json:"engines"`
+		Dependencies    map[string]interface{} `json:"dependencies"`
+		DevDependencies map[string]interface{} `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(content, &pack); err != nil {
+		return nil
+	}
+
+	runtime := &Runtime{}
+	runtime.Node, _ = pack.Engines["node"].(string)
+	for _, name := range trackedFrameworks {
+		version, ok := pack.Dependencies[name].(string)
+		if !ok {
+			version, ok = pack.DevDependencies[name].(string)
+		}
+		if ok && version != "" {
+			if runtime.Frameworks == nil {
+				runtime.Frameworks = make(map[string]string)
+			}
+			runtime.Frameworks[name] = version
+		}
+	}
+	return runtime
+}
+
+// newRuntime merges the informations of the manifest and of the package.json
+// on the runtime of a version. It returns nil if nothing is known.
+func newRuntime(manifest map[string]interface{}, pack *Runtime) *Runtime {
+	runtime := &Runtime{}
+	if pack != nil {
+		*runtime = *pack
+	}
+	runtime.Language, _ = manifest["language"].(string)
+	if runtime.Language == "" && runtime.Node == "" && len(runtime.Frameworks) == 0 {
+		return nil
+	}
+	return runtime
+}
+
+// RuntimeReport aggregates the runtimes of the latest stable versions of the
+// applications of a space. The values are the slugs of the applications.
+type RuntimeReport struct {
+	Space      string                         `json:"space"`
+	Type       string                         `json:"type,omitempty"`
+	Total      int                            `json:"total"`
+	Languages  map[string][]string            `json:"languages"`
+	Node       map[string][]string            `json:"node"`
+	Frameworks map[string]map[string][]string `json:"frameworks"`
+	// Unknown is the list of the applications for which the runtime has not
+	// been extracted (the versions published before it was done).
+	Unknown []string `json:"unknown"`
+}
+
+// GetRuntimeReport returns the runtimes of the latest stable versions of the
+// applications of the space, optionally filtered on the type of the
+// applications (webapp or konnector).
+func GetRuntimeReport(c *space.Space, appType string) (*RuntimeReport, error) {
+	report := &RuntimeReport{
+		Space:      c.Name,
+		Type:       appType,
+		Languages:  make(map[string][]string),
+		Node:       make(map[string][]string),
+		Frameworks: make(map[string]map[string][]string),
+		Unknown:    make([]string, 0),
+	}
+
+	opts := &AppsListOptions{
+		Limit:                maxLimit,
+		LatestVersionChannel: Stable,
+		VersionsChannel:      Stable,
+	}
+	if appType != "" {
+		opts.Filters = map[string]string{"type": appType}
+	}
+	for {
+		next, apps, err := GetAppsList(nil, c, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			if app.LatestVersion == nil {
+				continue
+			}
+			report.add(app.Slug, app.LatestVersion.Runtime)
+		}
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+
+	for _, slugs := range report.Languages {
+		sort.Strings(slugs)
+	}
+	for _, slugs := range report.Node {
+		sort.Strings(slugs)
+	}
+	for _, versions := range report.Frameworks {
+		for _, slugs := range versions {
+			sort.Strings(slugs)
+		}
+	}
+	sort.Strings(report.Unknown)
+	return report, nil
+}
+
+func (r *RuntimeReport) add(slug string, runtime *Runtime) {
+	r.Total++
+	if runtime == nil {
+		r.Unknown = append(r.Unknown, slug)
+		return
+	}
+	if runtime.Language != "" {
+		r.Languages[runtime.Language] = append(r.Languages[runtime.Language], slug)
+	}
+	if runtime.Node != "" {
+		r.Node[runtime.Node] = append(r.Node[runtime.Node], slug)
+	}
+	for name, version := range runtime.Frameworks {
+		if r.Frameworks[name] == nil {
+			r.Frameworks[name] = make(map[string][]string)
+		}
+		r.Frameworks[name][version] = append(r.Frameworks[name][version], slug)
+	}
+}
@@ -0,0 +1,321 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+const sandboxesDBSuffix = "sandboxes"
+
+// sandboxSpacePrefix is the prefix of the name of the spaces used for the
+// sandboxes (for the CouchDB databases and the storage).
+const sandboxSpacePrefix = "sandbox-"
+
+// sandboxTouchInterval is the minimal delay between two updates of the last
+// usage of a sandbox, to avoid writing in CouchDB on every request.
+const sandboxTouchInterval = time.Hour
+
+var (
+	ErrSandboxDisabled = errshttp.NewError(http.StatusForbidden, "Sandboxes are not enabled on this registry")
+	ErrSandboxNotFound = errshttp.NewError(http.StatusNotFound, "Sandbox not found")
+)
+
+// Sandbox is a personal space of an editor, where they can test the
+// publication of their applications without polluting the shared spaces. It
+// is removed when it has not been used for some time.
+type Sandbox struct {
+	ID          string    `json:"_id,omitempty"`
+	Rev         string    `json:"_rev,omitempty"`
+	Editor      string    `json:"editor"`
+	Space       string    `json:"space"`
+	MaxApps     int       `json:"max_apps"`
+	MaxVersions int       `json:"max_versions"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// sandboxSpaces keeps the spaces of the sandboxes already opened.
+var sandboxSpaces struct {
+	sync.Mutex
+	spaces map[string]*space.Space
+}
+
+func getSandboxesDB() (*kivik.DB, error) {
+	dbName := base.DBName(sandboxesDBSuffix)
+	ok, err := base.DBClient.DBExists(context.Background(), dbName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
+			if kivik.StatusCode(err) != http.StatusPreconditionFailed {
+				return nil, err
+			}
+		}
+	}
+	db := base.DBClient.DB(context.Background(), dbName)
+	return db, db.Err()
+}
+
+func sandboxID(editorName string) string {
+	return strings.ToLower(editorName)
+}
+
+// GetSandbox returns the sandbox of the given editor.
+func GetSandbox(editorName string) (*Sandbox, error) {
+	if !base.Config.Sandboxes.Enabled {
+		return nil, ErrSandboxDisabled
+	}
+	db, err := getSandboxesDB()
+	if err != nil {
+		return nil, err
+	}
+	var sandbox Sandbox
+	err = db.Get(context.Background(), sandboxID(editorName)).ScanDoc(&sandbox)
+	if kivik.StatusCode(err) == http.StatusNotFound {
+		return nil, ErrSandboxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sandbox, nil
+}
+
+// ListSandboxes returns all the sandboxes, sorted by editor.
+func ListSandboxes() ([]*Sandbox, error) {
+	db, err := getSandboxesDB()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sandboxes := make([]*Sandbox, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var sandbox Sandbox
+		if err := rows.ScanDoc(&sandbox); err != nil {
+			return nil, err
+		}
+		sandboxes = append(sandboxes, &sandbox)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(sandboxes, func(i, j int) bool {
+		return sandboxes[i].Editor < sandboxes[j].Editor
+	})
+	return sandboxes, nil
+}
+
+// CreateSandbox provisions the sandbox of an editor: its CouchDB databases
+// and its storage prefix. If the editor already has a sandbox, it is returned.
+func CreateSandbox(editorName string) (*Sandbox, error) {
+	sandbox, err := GetSandbox(editorName)
+	if err == nil {
+		return sandbox, TouchSandbox(sandbox)
+	}
+	if err != ErrSandboxNotFound {
+		return nil, err
+	}
+
+	id := sandboxID(editorName)
+	spaceName := sandboxSpacePrefix + id
+	if _, ok := space.GetSpace(spaceName); ok {
+		return nil, errshttp.NewError(http.StatusConflict,
+			"A space named %q already exists", spaceName)
+	}
+	if _, err := SandboxSpace(&Sandbox{Space: spaceName}); err != nil {
+		return nil, err
+	}
+
+	db, err := getSandboxesDB()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	sandbox = &Sandbox{
+		ID:          id,
+		Editor:      editorName,
+		Space:       spaceName,
+		MaxApps:     base.Config.Sandboxes.MaxApps,
+		MaxVersions: base.Config.Sandboxes.MaxVersions,
+		CreatedAt:   now,
+		LastUsedAt:  now,
+		ExpiresAt:   now.Add(base.Config.Sandboxes.IdleTTL),
+	}
+	rev, err := db.Put(context.Background(), sandbox.ID, sandbox)
+	if err != nil {
+		return nil, err
+	}
+	sandbox.Rev = rev
+	return sandbox, nil
+}
+
+// SandboxSpace returns the space of a sandbox, and creates its databases and
+// storage prefix if needed.
+func SandboxSpace(sandbox *Sandbox) (*space.Space, error) {
+	sandboxSpaces.Lock()
+	defer sandboxSpaces.Unlock()
+	if s, ok := sandboxSpaces.spaces[sandbox.Space]; ok {
+		return s, nil
+	}
+	s, err := space.Open(sandbox.Space)
+	if err != nil {
+		return nil, err
+	}
+	if err := base.Storage.EnsureExists(s.GetPrefix()); err != nil {
+		return nil, err
+	}
+	if sandboxSpaces.spaces == nil {
+		sandboxSpaces.spaces = make(map[string]*space.Space)
+	}
+	sandboxSpaces.spaces[sandbox.Space] = s
+	return s, nil
+}
+
+// TouchSandbox updates the last usage of the sandbox, which postpones its
+// expiration.
+func TouchSandbox(sandbox *Sandbox) error {
+	if time.Since(sandbox.LastUsedAt) < sandboxTouchInterval {
+		return nil
+	}
+	db, err := getSandboxesDB()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	sandbox.LastUsedAt = now
+	sandbox.ExpiresAt = now.Add(base.Config.Sandboxes.IdleTTL)
+	rev, err := db.Put(context.Background(), sandbox.ID, sandbox)
+	if err != nil {
+		return err
+	}
+	sandbox.Rev = rev
+	return nil
+}
+
+// CheckSandboxQuota returns an error if a new application (or a new version
+// if newApp is false) can't be added to the sandbox.
+func CheckSandboxQuota(sandbox *Sandbox, s *space.Space, newApp bool) error {
+	if newApp {
+		count, err := countDocuments(s.AppsDB())
+		if err != nil {
+			return err
+		}
+		if count >= sandbox.MaxApps {
+			return errshttp.NewError(http.StatusForbidden,
+				"The sandbox can't have more than %d applications", sandbox.MaxApps)
+		}
+		return nil
+	}
+
+	count := 0
+	for _, db := range []*kivik.DB{s.VersDB(), s.PendingVersDB()} {
+		n, err := countDocuments(db)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+	if count >= sandbox.MaxVersions {
+		return errshttp.NewError(http.StatusForbidden,
+			"The sandbox can't have more than %d versions", sandbox.MaxVersions)
+	}
+	return nil
+}
+
+// countDocuments returns the number of documents in a database, without the
+// design documents.
+func countDocuments(db *kivik.DB) (int, error) {
+	rows, err := db.AllDocs(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		if !strings.HasPrefix(rows.ID(), "_design") {
+			count++
+		}
+	}
+	return count, rows.Err()
+}
+
+// DeleteSandbox removes a sandbox, with its applications, versions and files.
+func DeleteSandbox(sandbox *Sandbox) error {
+	s, err := SandboxSpace(sandbox)
+	if err != nil {
+		return err
+	}
+	if err := RemoveSpace(s); err != nil {
+		return err
+	}
+	sandboxSpaces.Lock()
+	delete(sandboxSpaces.spaces, sandbox.Space)
+	sandboxSpaces.Unlock()
+
+	db, err := getSandboxesDB()
+	if err != nil {
+		return err
+	}
+	_, err = db.Delete(context.Background(), sandbox.ID, sandbox.Rev)
+	return err
+}
+
+// ExpireSandboxes removes the sandboxes that have not been used for longer
+// than the idle TTL, and returns the editors of the removed sandboxes.
+func ExpireSandboxes() ([]string, error) {
+	sandboxes, err := ListSandboxes()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expired := make([]string, 0)
+	for _, sandbox := range sandboxes {
+		if now.Before(sandbox.ExpiresAt) {
+			continue
+		}
+		if err := DeleteSandbox(sandbox); err != nil {
+			return expired, err
+		}
+		expired = append(expired, sandbox.Editor)
+	}
+	return expired, nil
+}
+
+// RunSandboxesCleaner removes the expired sandboxes at the given interval. It
+// is meant to be run in a goroutine by the server.
+func RunSandboxesCleaner(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		expired, err := ExpireSandboxes()
+		log := logrus.WithFields(logrus.Fields{
+			"nspace":  "sandboxes",
+			"expired": expired,
+		})
+		if err != nil {
+			log.WithField("error_msg", err).Error("Cannot expire the sandboxes")
+		} else if len(expired) > 0 {
+			log.Info("Sandboxes expired")
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"image"
+	_ "image/gif"  // for the dimensions of the gif screenshots
+	_ "image/jpeg" // for the dimensions of the jpeg screenshots
+	_ "image/png"  // for the dimensions of the png screenshots
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Screenshot is an entry of the screenshots of a manifest. It can be written
+// as a simple path, or as an object with the path and the captions indexed by
+// locale:
+//
+//	"screenshots": [
+//	  "screenshots/home.png",
+//	  { "src": "screenshots/files.png", "caption": { "en": "Your files" } }
+//	]
+type Screenshot struct {
+	Src     string            `json:"src"`
+	Caption map[string]string `json:"caption,omitempty"`
+}
+
+// UnmarshalJSON accepts both the string and the object forms.
+func (s *Screenshot) UnmarshalJSON(data []byte) error {
+	var src string
+	if err := json.Unmarshal(data, &src); err == nil {
+		*s = Screenshot{Src: src}
+		return nil
+	}
+	type plain Screenshot
+	var shot plain
+	if err := json.Unmarshal(data, &shot); err != nil {
+		return err
+	}
+	*s = Screenshot(shot)
+	return nil
+}
+
+// VersionScreenshot is an entry of the gallery of a version, in the order of
+// the manifest.
+type VersionScreenshot struct {
+	// Path is the path of the screenshot in the tarball, and in the URL of
+	// the screenshot (after /screenshots).
+	Path        string            `json:"path"`
+	Filename    string            `json:"filename,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Caption     map[string]string `json:"caption,omitempty"`
+	// Locales is only set for the screenshots declared in some locales of
+	// the manifest, and not for all of them.
+	Locales []string `json:"locales,omitempty"`
+}
+
+// getScreenshots returns the screenshots of a version, in order: the
+// screenshots of the manifest come first, followed by the screenshots that
+// are only declared in the locales (sorted by locale). The paths given in
+// the options replace the screenshots of the manifest.
+func getScreenshots(parsedManifest *Manifest, opts *VersionOptions) []VersionScreenshot {
+	var shots []VersionScreenshot
+	if opts != nil && opts.Screenshots != nil {
+		for _, src := range opts.Screenshots {
+			shots = appendScreenshot(shots, Screenshot{Src: src}, "")
+		}
+		return shots
+	}
+
+	for _, shot := range parsedManifest.Screenshots {
+		shots = appendScreenshot(shots, shot, "")
+	}
+	locales := make([]string, 0, len(parsedManifest.Locales))
+	for locale := range parsedManifest.Locales {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	for _, locale := range locales {
+		for _, shot := range parsedManifest.Locales[locale].Screenshots {
+			shots = appendScreenshot(shots, shot, locale)
+		}
+	}
+	return shots
+}
+
+// appendScreenshot adds a screenshot to the gallery, or merges its captions
+// if it is already here. The locale is empty for the screenshots shared by
+// all the locales.
+func appendScreenshot(shots []VersionScreenshot, shot Screenshot, locale string) []VersionScreenshot {
+	if shot.Src == "" {
+		return shots
+	}
+	p := path.Join("/", shot.Src)
+	for i := range shots {
+		if shots[i].Path != p {
+			continue
+		}
+		shots[i].Caption = mergeCaptions(shots[i].Caption, shot.Caption)
+		if locale != "" && len(shots[i].Locales) > 0 && !stringInArray(locale, shots[i].Locales) {
+			shots[i].Locales = append(shots[i].Locales, locale)
+		}
+		return shots
+	}
+	entry := VersionScreenshot{Path: p, Caption: mergeCaptions(nil, shot.Caption)}
+	if locale != "" {
+		entry.Locales = []string{locale}
+	}
+	return append(shots, entry)
+}
+
+func mergeCaptions(captions, others map[string]string) map[string]string {
+	for locale, caption := range others {
+		if caption == "" {
+			continue
+		}
+		if captions == nil {
+			captions = make(map[string]string)
+		}
+		if _, ok := captions[locale]; !ok {
+			captions[locale] = caption
+		}
+	}
+	return captions
+}
+
+// imageDimensions returns the width and height of an image, or zeros if they
+// can't be read. The SVG images are supported when they have the width and
+// height attributes (or a viewBox).
+func imageDimensions(mime string, data []byte) (int, int) {
+	if mime == "image/svg+xml" {
+		return svgDimensions(data)
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+func svgDimensions(data []byte) (int, int) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0
+		}
+		elem, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var width, height int
+		var viewBox string
+		for _, attr := range elem.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				viewBox = attr.Value
+			}
+		}
+		if width > 0 && height > 0 {
+			return width, height
+		}
+		fields := strings.Fields(strings.Replace(viewBox, ",", " ", -1))
+		if len(fields) == 4 {
+			return svgLength(fields[2]), svgLength(fields[3])
+		}
+		return 0, 0
+	}
+}
+
+func svgLength(value string) int {
+	f, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "px"), 64)
+	if err != nil || f < 0 {
+		return 0
+	}
+	return int(f + 0.5)
+}
+
+// VersionScreenshots returns the gallery of a version. The versions
+// published before the gallery was stored have it computed from their
+// manifest, without the dimensions. The filenames and content types missing
+// on the old versions are guessed from the paths.
+func VersionScreenshots(ver *Version) []VersionScreenshot {
+	shots := ver.Screenshots
+	if shots == nil {
+		shots = []VersionScreenshot{}
+		var parsedManifest Manifest
+		if err := json.Unmarshal(ver.Manifest, &parsedManifest); err == nil {
+			for _, shot := range getScreenshots(&parsedManifest, nil) {
+				if _, ok := ver.AttachmentReferences[path.Join("screenshots", shot.Path)]; ok {
+					shots = append(shots, shot)
+				}
+			}
+		}
+	}
+	for i := range shots {
+		if shots[i].Filename == "" {
+			shots[i].Filename = path.Base(shots[i].Path)
+		}
+		if shots[i].ContentType == "" {
+			shots[i].ContentType = getMIMEType(shots[i].Path, nil)
+		}
+	}
+	return shots
+}
+
+// ScreenshotsByLocale returns the paths of the screenshots to display for
+// each locale of the manifest of a version, in the order of the gallery: the
+// common screenshots, and the screenshots declared for this locale. The
+// locales that are not in the map must use the common screenshots.
+func ScreenshotsByLocale(ver *Version, shots []VersionScreenshot) map[string][]string {
+	locales := make(map[string]bool)
+	var parsedManifest Manifest
+	if err := json.Unmarshal(ver.Manifest, &parsedManifest); err == nil {
+		for locale := range parsedManifest.Locales {
+			locales[locale] = true
+		}
+	}
+	for _, shot := range shots {
+		for _, locale := range shot.Locales {
+			locales[locale] = true
+		}
+	}
+
+	byLocale := make(map[string][]string, len(locales))
+	for locale := range locales {
+		paths := []string{}
+		for _, shot := range shots {
+			if len(shot.Locales) == 0 || stringInArray(locale, shot.Locales) {
+				paths = append(paths, shot.Path)
+			}
+		}
+		byLocale[locale] = paths
+	}
+	return byLocale
+}
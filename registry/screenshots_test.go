@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScreenshotsByLocale(t *testing.T) {
+	ver := &Version{
+		Manifest: json.RawMessage(`{"locales": {"en": {}, "fr": {}}}`),
+		Screenshots: []VersionScreenshot{
+			{Path: "/screenshots/home.png"},
+			{Path: "/screenshots/fr/sharing.png", Locales: []string{"fr"}},
+			{Path: "/screenshots/de/sharing.png", Locales: []string{"de"}},
+		},
+	}
+	shots := VersionScreenshots(ver)
+	assert.Equal(t, "home.png", shots[0].Filename)
+	assert.Equal(t, "image/png", shots[0].ContentType)
+
+	byLocale := ScreenshotsByLocale(ver, shots)
+	assert.Equal(t, map[string][]string{
+		"en": {"/screenshots/home.png"},
+		"fr": {"/screenshots/home.png", "/screenshots/fr/sharing.png"},
+		"de": {"/screenshots/home.png", "/screenshots/de/sharing.png"},
+	}, byLocale)
+}
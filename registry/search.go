@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/search"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// searchIndexTTL is the duration after which the search index of a space is
+// rebuilt, to take into account the changes made by the other instances of
+// the registry.
+const searchIndexTTL = 10 * time.Minute
+
+type spaceSearchIndex struct {
+	index   *search.Index
+	builtAt time.Time
+}
+
+// The lock protects only the map: the indexes are built outside of it, once
+// per space even for concurrent searches, and swapped in once built.
+var (
+	searchIndexesMu     sync.Mutex
+	searchIndexes       = make(map[string]*spaceSearchIndex)
+	searchIndexesBuilds singleflight.Group
+)
+
+// searchManifest is the subset of the manifest that is indexed for the
+// search.
+type searchManifest struct {
+	Name       string   `json:"name"`
+	NamePrefix string   `json:"name_prefix"`
+	Categories []string `json:"categories"`
+	Keywords   []string `json:"keywords"`
+	Tags       []string `json:"tags"`
+	Locales    map[string]struct {
+		Name             string `json:"name"`
+		ShortDescription string `json:"short_description"`
+		LongDescription  string `json:"long_description"`
+	} `json:"locales"`
+}
+
+func appSearchDocument(slug string, version *Version) search.Document {
+	doc := search.Document{
+		ID:     slug,
+		Fields: []search.Field{{Text: strings.Replace(slug, "-", " ", -1), Weight: 4}},
+	}
+	if version == nil {
+		return doc
+	}
+	var manifest searchManifest
+	if err := json.Unmarshal(version.Manifest, &manifest); err != nil {
+		return doc
+	}
+	doc.Fields = append(doc.Fields,
+		search.Field{Text: manifest.Name, Weight: 3},
+		search.Field{Text: manifest.NamePrefix, Weight: 1},
+		search.Field{Text: strings.Join(manifest.Categories, " "), Weight: 2},
+		search.Field{Text: strings.Join(manifest.Keywords, " "), Weight: 2},
+		search.Field{Text: strings.Join(manifest.Tags, " "), Weight: 2},
+	)
+	for _, locale := range manifest.Locales {
+		doc.Fields = append(doc.Fields,
+			search.Field{Text: locale.Name, Weight: 3},
+			search.Field{Text: locale.ShortDescription, Weight: 1},
+			search.Field{Text: locale.LongDescription, Weight: 0.5},
+		)
+	}
+	return doc
+}
+
+func buildSearchIndex(c *space.Space) (*search.Index, error) {
+	index := search.NewIndex()
+	cursor := ""
+	for {
+		next, apps, err := GetAppsList(nil, c, &AppsListOptions{
+			Limit:                maxLimit,
+			Cursor:               cursor,
+			LatestVersionChannel: Stable,
+			VersionsChannel:      Stable,
+			ExcludeUnlisted:      true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			index.Add(appSearchDocument(app.Slug, app.LatestVersion))
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	return index, nil
+}
+
+func getSearchIndex(c *space.Space) (*search.Index, error) {
+	searchIndexesMu.Lock()
+	idx, ok := searchIndexes[c.Name]
+	searchIndexesMu.Unlock()
+	if ok && time.Since(idx.builtAt) < searchIndexTTL {
+		return idx.index, nil
+	}
+
+	index, err, _ := searchIndexesBuilds.Do(c.Name, func() (interface{}, error) {
+		index, err := buildSearchIndex(c)
+		if err != nil {
+			return nil, err
+		}
+		searchIndexesMu.Lock()
+		searchIndexes[c.Name] = &spaceSearchIndex{index: index, builtAt: time.Now()}
+		searchIndexesMu.Unlock()
+		return index, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index.(*search.Index), nil
+}
+
+// updateSearchIndex updates the search index of the space for the given app,
+// if the index has already been built.
+func updateSearchIndex(c *space.Space, appSlug string) {
+	searchIndexesMu.Lock()
+	idx, ok := searchIndexes[c.Name]
+	searchIndexesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	app, err := findApp(c, appSlug)
+	if err == ErrAppNotFound || (err == nil && app.IsUnlisted()) {
+		idx.index.Remove(appSlug)
+		return
+	}
+	version, err := FindLatestVersion(c, appSlug, Stable)
+	if err != nil && err != ErrVersionNotFound {
+		logrus.WithFields(logrus.Fields{
+			"nspace":    "search",
+			"space":     c.Name,
+			"slug":      appSlug,
+			"error_msg": err,
+		}).Warn()
+		return
+	}
+	idx.index.Add(appSearchDocument(appSlug, version))
+}
+
+// SearchApps returns the slugs of the applications of the space that match
+// the query, sorted by relevance.
+func SearchApps(c *space.Space, query string) ([]search.Result, error) {
+	index, err := getSearchIndex(c)
+	if err != nil {
+		return nil, err
+	}
+	return index.Search(query), nil
+}
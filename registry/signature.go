@@ -0,0 +1,40 @@
+package registry
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+// CheckVersionSignature verifies the signature of a version before its
+// publication. The signature is made on the sha256 of the tarball (in
+// hexadecimal) with the private key of the editor, and it is sent encoded in
+// base64. A version without signature is accepted, unless the space requires
+// them.
+func CheckVersionSignature(editor *auth.Editor, opts *VersionOptions) error {
+	if opts.Signature == "" {
+		if base.Config.IsSignatureRequired(opts.SpacePrefix) {
+			return errshttp.NewError(http.StatusUnprocessableEntity,
+				"The versions published in this space must be signed")
+		}
+		return nil
+	}
+	if opts.Sha256 == "" {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"The sha256 of the tarball is required to verify the signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(opts.Signature)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid signature: it must be encoded in base64")
+	}
+	message := []byte(strings.ToLower(opts.Sha256))
+	if err := editor.VerifySignature(message, signature); err != nil {
+		return errshttp.NewError(http.StatusUnprocessableEntity, "Invalid signature: %s", err)
+	}
+	return nil
+}
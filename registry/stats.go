@@ -0,0 +1,447 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/counters"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+)
+
+// PopularityWindow is the period on which the installs are counted for the
+// popularity of the applications.
+const PopularityWindow = 30 * 24 * time.Hour
+
+// statsDateFormat is the format of the days of the statistics.
+const statsDateFormat = "2006-01-02"
+
+// maxRating is the best rating that can be given to an application.
+const maxRating = 5
+
+// AppStats are the statistics of an application for a day, aggregated from
+// the pushes of the cozy stacks.
+type AppStats struct {
+	ID  string `json:"_id,omitempty"`
+	Rev string `json:"_rev,omitempty"`
+
+	Slug         string `json:"slug"`
+	Date         string `json:"date"`
+	Installs     int64  `json:"installs"`
+	Uninstalls   int64  `json:"uninstalls"`
+	RatingsCount int64  `json:"ratings_count"`
+	RatingsSum   int64  `json:"ratings_sum"`
+	// Downloads and LatestFetches are counted by the registry.
+	Downloads     int64 `json:"downloads"`
+	LatestFetches int64 `json:"latest_fetches"`
+}
+
+func (s *AppStats) add(other *AppStats) {
+	s.Installs += other.Installs
+	s.Uninstalls += other.Uninstalls
+	s.RatingsCount += other.RatingsCount
+	s.RatingsSum += other.RatingsSum
+	s.Downloads += other.Downloads
+	s.LatestFetches += other.LatestFetches
+}
+
+// StatsOptions are the statistics pushed by a cozy stack for an application.
+// The date is the day of the statistics (today by default), and the ratings
+// are given by their count and the sum of their values (from 1 to 5).
+type StatsOptions struct {
+	Date         string `json:"date"`
+	Installs     int64  `json:"installs"`
+	Uninstalls   int64  `json:"uninstalls"`
+	RatingsCount int64  `json:"ratings_count"`
+	RatingsSum   int64  `json:"ratings_sum"`
+}
+
+func (opts *StatsOptions) validate(now time.Time) error {
+	if opts.Date == "" {
+		opts.Date = now.Format(statsDateFormat)
+	}
+	day, err := time.Parse(statsDateFormat, opts.Date)
+	if err != nil {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Invalid date %q: the format is YYYY-MM-DD", opts.Date)
+	}
+	// A day of margin for the time zones of the stacks
+	if day.After(now.Add(24 * time.Hour)) {
+		return errshttp.NewError(http.StatusBadRequest, "The date %q is in the future", opts.Date)
+	}
+	if opts.Installs < 0 || opts.Uninstalls < 0 || opts.RatingsCount < 0 {
+		return errshttp.NewError(http.StatusBadRequest, "The counts can't be negative")
+	}
+	if opts.RatingsSum < opts.RatingsCount || opts.RatingsSum > maxRating*opts.RatingsCount {
+		return errshttp.NewError(http.StatusBadRequest,
+			"The sum of the ratings must be between 1 and %d times their count", maxRating)
+	}
+	if opts.Installs == 0 && opts.Uninstalls == 0 && opts.RatingsCount == 0 {
+		return errshttp.NewError(http.StatusBadRequest, "No statistics")
+	}
+	return nil
+}
+
+func getAppStatsID(appSlug, date string) string {
+	return getAppID(appSlug) + "-" + date
+}
+
+// AddAppStats adds the statistics pushed by a cozy stack to the ones of the
+// day for the application, and updates its popularity.
+func AddAppStats(c *space.Space, app *App, opts *StatsOptions) (*AppStats, error) {
+	if err := opts.validate(time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	stats, err := incrementAppStats(c, app.Slug, opts.Date, &AppStats{
+		Installs:     opts.Installs,
+		Uninstalls:   opts.Uninstalls,
+		RatingsCount: opts.RatingsCount,
+		RatingsSum:   opts.RatingsSum,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := updateAppPopularity(c, app.Slug); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// incrementAppStats adds the counts to the statistics of the application for
+// the day.
+func incrementAppStats(c *space.Space, appSlug, date string, counts *AppStats) (*AppStats, error) {
+	db := c.StatsDB()
+	ctx := context.Background()
+	id := getAppStatsID(appSlug, date)
+	// The stacks and the instances of the registry can update the statistics
+	// of the same day concurrently, so the conflicts are retried a few times.
+	for attempt := 0; ; attempt++ {
+		stats := &AppStats{ID: id, Slug: appSlug, Date: date}
+		err := db.Get(ctx, id).ScanDoc(stats)
+		if err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+			return nil, err
+		}
+		stats.add(counts)
+		rev, err := db.Put(ctx, id, stats)
+		if err == nil {
+			stats.Rev = rev
+			return stats, nil
+		}
+		if kivik.StatusCode(err) != http.StatusConflict || attempt >= 3 {
+			return nil, err
+		}
+	}
+}
+
+// GetAppStats returns the daily statistics of an application between the
+// two dates (included), the oldest day first.
+func GetAppStats(c *space.Space, appSlug string, from, to time.Time) ([]*AppStats, error) {
+	rows, err := c.StatsDB().AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+		"startkey":     getAppStatsID(appSlug, from.UTC().Format(statsDateFormat)),
+		"endkey":       getAppStatsID(appSlug, to.UTC().Format(statsDateFormat)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*AppStats, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var stats AppStats
+		if err := rows.ScanDoc(&stats); err != nil {
+			return nil, err
+		}
+		// The ID prefix can match another application, like foo and foo-bar
+		if stats.Slug != appSlug {
+			continue
+		}
+		list = append(list, &stats)
+	}
+	return list, rows.Err()
+}
+
+// popularitySince returns the first day counted for the popularity.
+func popularitySince() time.Time {
+	return time.Now().UTC().Add(-PopularityWindow)
+}
+
+// updateAppPopularity computes the popularity of an application, ie its
+// number of installs during the popularity window, and saves it in the
+// application document, where it is used to sort the applications.
+func updateAppPopularity(c *space.Space, appSlug string) error {
+	list, err := GetAppStats(c, appSlug, popularitySince(), time.Now().Add(24*time.Hour))
+	if err != nil {
+		return err
+	}
+	var popularity int64
+	for _, stats := range list {
+		popularity += stats.Installs
+	}
+	app, err := findApp(c, appSlug)
+	if err != nil {
+		return err
+	}
+	if app.Popularity == popularity {
+		return nil
+	}
+	app.Popularity = popularity
+	_, err = c.AppsDB().Put(context.Background(), app.ID, app)
+	return err
+}
+
+// RefreshPopularities computes again the popularity of all the applications
+// of a space, as the old days leave the popularity window. It also sets the
+// popularity of the applications created before it was stored in their
+// document. It returns the number of applications updated.
+func RefreshPopularities(c *space.Space) (int, error) {
+	ctx := context.Background()
+	since := popularitySince().Format(statsDateFormat)
+	popularities := make(map[string]int64)
+	rows, err := c.StatsDB().AllDocs(ctx, map[string]interface{}{"include_docs": true})
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var stats AppStats
+		if err := rows.ScanDoc(&stats); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if stats.Date >= since {
+			popularities[stats.Slug] += stats.Installs
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rows, err = c.AppsDB().AllDocs(ctx, map[string]interface{}{"include_docs": true})
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	updated := 0
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var raw json.RawMessage
+		if err := rows.ScanDoc(&raw); err != nil {
+			return updated, err
+		}
+		// The documents without the field are not in the popularity index
+		var current struct {
+			Popularity *int64 `json:"popularity"`
+		}
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return updated, err
+		}
+		var app App
+		if err := json.Unmarshal(raw, &app); err != nil {
+			return updated, err
+		}
+		popularity := popularities[app.Slug]
+		if current.Popularity != nil && *current.Popularity == popularity {
+			continue
+		}
+		app.Popularity = popularity
+		if _, err := c.AppsDB().Put(ctx, app.ID, &app); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, rows.Err()
+}
+
+// RunPopularityUpdater refreshes the popularity of the applications of all
+// the spaces when the server starts, and then at the given interval. It is
+// meant to be run in a goroutine by the server.
+func RunPopularityUpdater(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, name := range space.GetSpacesNames() {
+			s, ok := space.GetSpace(name)
+			if !ok {
+				continue
+			}
+			log := logrus.WithFields(logrus.Fields{
+				"nspace": "popularity",
+				"space":  s.GetPrefix().String(),
+			})
+			updated, err := RefreshPopularities(s)
+			if err != nil {
+				log.WithField("error_msg", err).Error("Cannot refresh the popularity of the applications")
+			} else if updated > 0 {
+				log.WithField("updated", updated).Info("Popularity of the applications refreshed")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// LeaderboardEntry is the total of the statistics of an application on a
+// period, for the leaderboard of a space.
+type LeaderboardEntry struct {
+	Slug          string `json:"slug"`
+	Installs      int64  `json:"installs"`
+	Uninstalls    int64  `json:"uninstalls"`
+	RatingsCount  int64  `json:"ratings_count"`
+	RatingsSum    int64  `json:"ratings_sum"`
+	Downloads     int64  `json:"downloads"`
+	LatestFetches int64  `json:"latest_fetches"`
+}
+
+// LeaderboardSorts are the statistics that can be used to rank the
+// applications.
+var LeaderboardSorts = []string{"downloads", "installs", "latest_fetches", "ratings_count"}
+
+func (e *LeaderboardEntry) value(sortBy string) int64 {
+	switch sortBy {
+	case "installs":
+		return e.Installs
+	case "latest_fetches":
+		return e.LatestFetches
+	case "ratings_count":
+		return e.RatingsCount
+	default:
+		return e.Downloads
+	}
+}
+
+// GetStatsLeaderboard returns the applications of a space with the best
+// statistics between the two dates (included), for the given sort.
+func GetStatsLeaderboard(c *space.Space, from, to time.Time, sortBy string, limit int) ([]*LeaderboardEntry, error) {
+	if !stringInArray(sortBy, LeaderboardSorts) {
+		return nil, errshttp.NewError(http.StatusBadRequest,
+			"The leaderboard can't be sorted by %q, the available sorts are: %s",
+			sortBy, strings.Join(LeaderboardSorts, ", "))
+	}
+	rows, err := c.StatsDB().Query(context.Background(), space.StatsDateView, space.StatsDateView, map[string]interface{}{
+		"include_docs": true,
+		"startkey":     from.UTC().Format(statsDateFormat),
+		"endkey":       to.UTC().Format(statsDateFormat),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]*LeaderboardEntry)
+	for rows.Next() {
+		var stats AppStats
+		if err := rows.ScanDoc(&stats); err != nil {
+			return nil, err
+		}
+		entry, ok := totals[stats.Slug]
+		if !ok {
+			entry = &LeaderboardEntry{Slug: stats.Slug}
+			totals[stats.Slug] = entry
+		}
+		entry.Installs += stats.Installs
+		entry.Uninstalls += stats.Uninstalls
+		entry.RatingsCount += stats.RatingsCount
+		entry.RatingsSum += stats.RatingsSum
+		entry.Downloads += stats.Downloads
+		entry.LatestFetches += stats.LatestFetches
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	list := make([]*LeaderboardEntry, 0, len(totals))
+	for _, entry := range totals {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		vi, vj := list[i].value(sortBy), list[j].value(sortBy)
+		if vi != vj {
+			return vi > vj
+		}
+		return list[i].Slug < list[j].Slug
+	})
+	if limit > 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	return list, nil
+}
+
+// FlushCounters adds the downloads counted since the last flush to the
+// statistics of the applications. The counters that can't be saved are given
+// back, to be flushed the next time.
+func FlushCounters() error {
+	counts, err := counters.Drain()
+	if err != nil || len(counts) == 0 {
+		return err
+	}
+
+	type day struct{ space, slug, date string }
+	days := make(map[day]*AppStats)
+	for key, n := range counts {
+		d := day{key.Space, key.Slug, key.Date}
+		stats, ok := days[d]
+		if !ok {
+			stats = &AppStats{}
+			days[d] = stats
+		}
+		switch key.Kind {
+		case counters.Tarball:
+			stats.Downloads += n
+		case counters.Latest:
+			stats.LatestFetches += n
+		}
+	}
+
+	var errm error
+	for d, stats := range days {
+		// The sandboxes are not registered spaces, and their downloads are
+		// not kept.
+		s, ok := space.GetSpace(d.space)
+		if !ok {
+			continue
+		}
+		if _, err := incrementAppStats(s, d.slug, d.date, stats); err != nil {
+			errm = multierror.Append(errm, err)
+			failed := make(map[counters.Key]int64)
+			for key, n := range counts {
+				if key.Space == d.space && key.Slug == d.slug && key.Date == d.date {
+					failed[key] = n
+				}
+			}
+			if err := counters.Restore(failed); err != nil {
+				errm = multierror.Append(errm, err)
+			}
+		}
+	}
+	return errm
+}
+
+// RunCountersFlusher flushes the counters of the downloads at the given
+// interval. It is meant to be run in a goroutine by the server.
+func RunCountersFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := FlushCounters(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"nspace":    "counters",
+				"error_msg": err,
+			}).Error("Cannot flush the counters of the downloads")
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrVersionInTrash is returned when a version is published again while its
+// unpublished copy is still in the trash.
+var ErrVersionInTrash = errshttp.NewError(http.StatusConflict,
+	"Version is in the trash: it can be restored, or published again after its purge")
+
+// Trash moves a released version to the trash of the space. It is hidden from
+// the lists and the latest versions, but its attachments are kept, and it can
+// be restored until the trash is purged.
+func (v *Version) Trash(c *space.Space, by string) error {
+	if err := checkVersionLegalHold(c, v, "delete version"); err != nil {
+		return err
+	}
+
+	trashed := v.Clone()
+	trashed.Rev = ""
+	now := time.Now().UTC()
+	trashed.TrashedAt = &now
+	trashed.TrashedBy = by
+	ctx := context.Background()
+	if _, err := c.TrashVersDB().Put(ctx, trashed.ID, trashed); err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return ErrVersionInTrash
+		}
+		return err
+	}
+	if _, err := c.VersDB().Delete(ctx, v.ID, v.Rev); err != nil {
+		return err
+	}
+
+	v.purgeCaches(c)
+	webhooks.Send(c.Name, webhooks.VersionTrashed, map[string]interface{}{
+		"slug":       v.Slug,
+		"version":    v.Version,
+		"type":       v.Type,
+		"trashed_at": now,
+	})
+	return nil
+}
+
+// FindTrashedVersion returns a version of the trash of the space.
+func FindTrashedVersion(c *space.Space, appSlug, version string) (*Version, error) {
+	return findVersion(appSlug, version, c.TrashVersDB())
+}
+
+// GetTrashedVersions returns the versions in the trash of the space, for an
+// application or for all of them if the slug is empty, the most recently
+// trashed first.
+func GetTrashedVersions(c *space.Space, appSlug string) ([]*Version, error) {
+	opts := map[string]interface{}{"include_docs": true}
+	if appSlug != "" {
+		opts["startkey"] = getAppID(appSlug) + "-"
+		opts["endkey"] = getAppID(appSlug) + "-\ufff0"
+	}
+	rows, err := c.TrashVersDB().AllDocs(context.Background(), opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]*Version, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var version *Version
+		if err := rows.ScanDoc(&version); err != nil {
+			return nil, err
+		}
+		// The ID prefix can match another application, like foo and foo-bar
+		if appSlug != "" && version.Slug != appSlug {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].TrashedAt.After(*versions[j].TrashedAt)
+	})
+	return versions, nil
+}
+
+// RestoreVersion moves a version from the trash back to the released versions
+// of the space.
+func RestoreVersion(c *space.Space, appSlug, version string) (*Version, error) {
+	trashed, err := FindTrashedVersion(c, appSlug, version)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = FindVersion(c, appSlug, version); err == nil {
+		return nil, ErrVersionAlreadyExists
+	} else if err != ErrVersionNotFound {
+		return nil, err
+	}
+
+	restored := trashed.Clone()
+	restored.Rev = ""
+	restored.TrashedAt = nil
+	restored.TrashedBy = ""
+	ctx := context.Background()
+	rev, err := c.VersDB().Put(ctx, restored.ID, restored)
+	if err != nil {
+		return nil, err
+	}
+	restored.Rev = rev
+	if _, err = c.TrashVersDB().Delete(ctx, trashed.ID, trashed.Rev); err != nil {
+		return nil, err
+	}
+
+	restored.purgeCaches(c)
+	if err = refreshVersionsViews(c, appSlug); err != nil {
+		return nil, err
+	}
+	webhooks.Send(c.Name, webhooks.VersionRestored, restored)
+	return restored, nil
+}
+
+// PurgeTrash deletes the versions of the trash of the space that have been
+// trashed before the given date, with their attachments. The versions under a
+// legal hold are kept. For a dry run, nothing is deleted, and the versions
+// that would be deleted are returned.
+func PurgeTrash(c *space.Space, before time.Time, run RunType) ([]*CleanedVersion, error) {
+	return newCleaner(c, run).purgeTrash(before)
+}
+
+func (cl *cleaner) purgeTrash(before time.Time) ([]*CleanedVersion, error) {
+	c := cl.space
+	versions, err := GetTrashedVersions(c, "")
+	if err != nil {
+		return nil, err
+	}
+	purged := make([]*CleanedVersion, 0)
+	for _, v := range versions {
+		if !v.TrashedAt.Before(before) {
+			continue
+		}
+		cleaned := &CleanedVersion{
+			Slug:    v.Slug,
+			Version: v.Version,
+			Channel: ChannelToStr(GetVersionChannel(v.Version)),
+			Size:    v.Size,
+		}
+		purged = append(purged, cleaned)
+		held, err := isVersionHeld(c, v)
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			cleaned.KeptBy = "legal_hold"
+			continue
+		}
+		if cleaned.Objects, err = cl.deletedObjects(v); err != nil {
+			return nil, err
+		}
+		if cl.run == DryRun {
+			continue
+		}
+		if err := deleteTrashedVersion(c, v); err != nil {
+			return nil, err
+		}
+	}
+	return purged, nil
+}
+
+// isVersionHeld returns true if the version, or its application, is under a
+// legal hold.
+func isVersionHeld(c *space.Space, v *Version) (bool, error) {
+	if v.LegalHold != nil {
+		return true, nil
+	}
+	app, err := findApp(c, v.Slug)
+	if err != nil && err != ErrAppNotFound {
+		return false, err
+	}
+	return app != nil && app.LegalHold != nil, nil
+}
+
+// deleteTrashedVersion deletes a version of the trash, with its attachments.
+func deleteTrashedVersion(c *space.Space, v *Version) error {
+	for _, vs := range base.Config.VirtualSpaces {
+		if err := DeleteOverwrittenVersion(vs, v); err != nil {
+			return err
+		}
+	}
+	if err := v.RemoveAllAttachments(c); err != nil {
+		return err
+	}
+	if _, err := c.TrashVersDB().Delete(context.Background(), v.ID, v.Rev); err != nil {
+		return err
+	}
+	webhooks.Send(c.Name, webhooks.VersionDeleted, map[string]interface{}{
+		"slug":    v.Slug,
+		"version": v.Version,
+		"type":    v.Type,
+	})
+	return nil
+}
+
+func deleteTrashedVersionsOfAnApp(s *space.Space, app *App) error {
+	versions, err := GetTrashedVersions(s, app.Slug)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := deleteTrashedVersion(s, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunTrashPurger deletes the versions trashed for longer than the retention of
+// the trash, in all the spaces, at the given interval. It is meant to be run
+// in a goroutine by the server.
+func RunTrashPurger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		before := time.Now().Add(-base.Config.TrashRetention)
+		for _, name := range space.GetSpacesNames() {
+			s, ok := space.GetSpace(name)
+			if !ok {
+				continue
+			}
+			purged, err := PurgeTrash(s, before, RealRun)
+			log := logrus.WithFields(logrus.Fields{
+				"nspace": "trash",
+				"space":  name,
+			})
+			if err != nil {
+				log.WithField("error_msg", err).Error("Cannot purge the trash")
+				continue
+			}
+			for _, v := range purged {
+				if v.KeptBy == "" {
+					log.WithField("version", v.String()).Info("Version purged from the trash")
+				}
+			}
+		}
+	}
+}
@@ -31,17 +31,3 @@ func stringInArray(a string, list []string) bool {
 	}
 	return false
 }
-
-type bytesCounter struct {
-	total int64
-}
-
-func (c *bytesCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	c.total += int64(n)
-	return n, nil
-}
-
-func (c *bytesCounter) Written() int64 {
-	return c.total
-}
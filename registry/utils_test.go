@@ -1,8 +1,31 @@
 package registry
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/Masterminds/semver"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/mango"
+	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -10,3 +33,467 @@ func TestGetMIMEType(t *testing.T) {
 	mime := getMIMEType("icon.svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 32 32"></svg>`))
 	assert.Equal(t, "image/svg+xml", mime)
 }
+
+func TestIsValidLocale(t *testing.T) {
+	for _, locale := range []string{"fr", "en", "en_US", "pt-BR", "ast"} {
+		assert.True(t, IsValidLocale(locale), locale)
+	}
+	for _, locale := range []string{"", "f", "FR", "fr_", "en_us", "../..", "fr/x", "en_US_POSIX"} {
+		assert.False(t, IsValidLocale(locale), locale)
+	}
+}
+
+func TestReadPackageRuntime(t *testing.T) {
+	runtime := readPackageRuntime([]byte(`{
+		"name": "cozy-konnector-foo",
+		"engines": {"node": ">=12"},
+		"dependencies": {"cozy-konnector-libs": "4.34.0", "lodash": "4.17.20"},
+		"devDependencies": {"cozy-client": "^13.8.0"}
+	}`))
+	assert.Equal(t, ">=12", runtime.Node)
+	assert.Equal(t, map[string]string{
+		"cozy-konnector-libs": "4.34.0",
+		"cozy-client":         "^13.8.0",
+	}, runtime.Frameworks)
+
+	runtime = newRuntime(map[string]interface{}{"language": "node"}, runtime)
+	assert.Equal(t, "node", runtime.Language)
+
+	assert.Nil(t, readPackageRuntime([]byte(`not json`)))
+	assert.Nil(t, newRuntime(map[string]interface{}{}, readPackageRuntime([]byte(`{"engines": ["node"]}`))))
+}
+
+func TestMatchVersion(t *testing.T) {
+	versions := []string{"1.1.0", "1.2.0", "1.2.5", "1.3.0-beta.1", "2.0.0", ""}
+
+	constraints, err := semver.NewConstraint("^1.2.0")
+	assert.NoError(t, err)
+	v, ok := matchVersion(constraints, versions[:3])
+	assert.True(t, ok)
+	assert.Equal(t, "1.2.5", v)
+	v, ok = matchVersion(constraints, versions)
+	assert.True(t, ok)
+	assert.Equal(t, "1.3.0-beta.1", v)
+
+	constraints, err = semver.NewConstraint(">= 3")
+	assert.NoError(t, err)
+	_, ok = matchVersion(constraints, versions)
+	assert.False(t, ok)
+}
+
+func TestTarReaderDetectsFormat(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, err := zw.Create("foo/manifest.webapp")
+	assert.NoError(t, err)
+	_, err = w.Write([]byte(`{"slug": "foo"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, zw.Close())
+
+	tr, format, err := tarReader(bytes.NewReader(zipped.Bytes()), "")
+	assert.NoError(t, err)
+	assert.Equal(t, base.ArchiveZip, format)
+	hdr, err := tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/manifest.webapp", hdr.Name)
+	assert.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+	content, err := ioutil.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"slug": "foo"}`, string(content))
+
+	var tarred bytes.Buffer
+	tw := tar.NewWriter(&tarred)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "manifest.webapp", Mode: 0644, Typeflag: tar.TypeReg}))
+	assert.NoError(t, tw.Close())
+	_, format, err = tarReader(bytes.NewReader(tarred.Bytes()), "")
+	assert.NoError(t, err)
+	assert.Equal(t, base.ArchiveTar, format)
+
+	_, _, err = tarReader(bytes.NewReader([]byte("this is not an archive")), "")
+	assert.Error(t, err)
+
+	// A zip with a stub before its first entry is only detected with its
+	// Content-Type
+	stubbed := append([]byte("#!/bin/sh\nexit 0\n"), zipped.Bytes()...)
+	_, _, err = tarReader(bytes.NewReader(stubbed), "application/octet-stream")
+	assert.Error(t, err)
+	tr, format, err = tarReader(bytes.NewReader(stubbed), "application/zip")
+	assert.NoError(t, err)
+	assert.Equal(t, base.ArchiveZip, format)
+	hdr, err = tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "foo/manifest.webapp", hdr.Name)
+
+	assert.Equal(t, "application/zip", archiveContentType(base.ArchiveZip, "application/octet-stream"))
+	assert.Equal(t, "application/x-zip-compressed", archiveContentType(base.ArchiveZip, "application/x-zip-compressed"))
+	assert.Equal(t, "application/gzip", archiveContentType(base.ArchiveGzip, "application/zip"))
+	assert.Equal(t, base.ArchiveGzip, detectArchiveFormat([]byte{0x1f, 0x8b, 0x08}))
+	assert.Equal(t, base.ArchiveZstd, detectArchiveFormat([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}))
+}
+
+func TestDownloadRequestMaxSize(t *testing.T) {
+	private := base.Config.DownloadPrivateNetworks
+	base.Config.DownloadPrivateNetworks = true
+	defer func() { base.Config.DownloadPrivateNetworks = private }()
+
+	content := bytes.Repeat([]byte("cozy"), 1024)
+	sum := sha256.Sum256(content)
+	shasum := hex.EncodeToString(sum[:])
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// Without Content-Length, the limit is checked while streaming
+			w.(http.Flusher).Flush()
+		}
+		_, _ = w.Write(content)
+	}))
+	defer ts.Close()
+
+	file, _, err := downloadRequest(context.Background(), 0, ts.URL+"/tarball", shasum, 8192, nil)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	removeTempFile(file)
+	_, err = os.Stat(file.Name())
+	assert.True(t, os.IsNotExist(err))
+
+	for _, p := range []string{"/tarball", "/chunked"} {
+		_, _, err = downloadRequest(context.Background(), 0, ts.URL+p, shasum, 1000, nil)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, err.(*errshttp.Error).StatusCode())
+	}
+
+	_, _, err = downloadRequest(context.Background(), 0, ts.URL+"/tarball", "bad", 8192, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Checksum does not match")
+}
+
+func TestDownloadRequestResumes(t *testing.T) {
+	retries, backoff := base.Config.DownloadRetries, base.Config.DownloadBackoff
+	private := base.Config.DownloadPrivateNetworks
+	base.Config.DownloadRetries, base.Config.DownloadBackoff = 3, time.Millisecond
+	base.Config.DownloadPrivateNetworks = true
+	defer func() {
+		base.Config.DownloadRetries, base.Config.DownloadBackoff = retries, backoff
+		base.Config.DownloadPrivateNetworks = private
+	}()
+
+	content := bytes.Repeat([]byte("cozy"), 4096)
+	sum := sha256.Sum256(content)
+	shasum := hex.EncodeToString(sum[:])
+	var ranges []string
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			// The connection is cut in the middle of the tarball
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:5000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			assert.Equal(t, `"v1"`, r.Header.Get("If-Range"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes 5000-%d/%d", len(content)-1, len(content)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(content[5000:])
+		}
+	}))
+	defer ts.Close()
+
+	file, _, err := downloadRequest(context.Background(), 0, ts.URL, shasum, 0, nil)
+	assert.NoError(t, err)
+	defer removeTempFile(file)
+	data, err := ioutil.ReadAll(file)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, []string{"", "", "bytes=5000-"}, ranges)
+
+	// The client errors are not retried
+	calls = 0
+	ts404 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts404.Close()
+	_, _, err = downloadRequest(context.Background(), 0, ts404.URL, shasum, 0, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestCheckVersionURL(t *testing.T) {
+	domains, private := base.Config.DownloadDomains, base.Config.DownloadPrivateNetworks
+	base.Config.DownloadDomains = map[string][]string{"partners": {"github.com", "partner.example"}}
+	base.Config.DownloadPrivateNetworks = false
+	defer func() {
+		base.Config.DownloadDomains, base.Config.DownloadPrivateNetworks = domains, private
+	}()
+
+	assert.NoError(t, CheckVersionURL("", "https://example.org/app.tar.gz"))
+	assert.NoError(t, CheckVersionURL("partners", "https://github.com/cozy/app.tar.gz"))
+	assert.NoError(t, CheckVersionURL("partners", "https://cdn.Partner.example/app.tar.gz"))
+
+	for _, u := range []string{
+		"file:///etc/passwd",
+		"ftp://example.org/app.tar.gz",
+		"http://127.0.0.1:5984/_all_dbs",
+		"http://localhost/app.tar.gz",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.1.2.3/app.tar.gz",
+		"http://[::1]/app.tar.gz",
+	} {
+		err := CheckVersionURL("", u)
+		if assert.Error(t, err, u) {
+			assert.Equal(t, http.StatusUnprocessableEntity, err.(*errshttp.Error).StatusCode())
+		}
+	}
+
+	err := CheckVersionURL("partners", "https://notgithub.com/app.tar.gz")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, err.(*errshttp.Error).StatusCode())
+	assert.Contains(t, err.Error(), "github.com, partner.example")
+
+	// The private addresses are also refused after the DNS resolution
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("tarball"))
+	}))
+	defer ts.Close()
+	_, _, err = downloadRequest(context.Background(), 0, ts.URL, "", 8192, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusUnprocessableEntity, err.(*errshttp.Error).StatusCode())
+	assert.Contains(t, err.Error(), "private address")
+}
+
+func TestChangelogSection(t *testing.T) {
+	changelog := `# Changelog
+
+## [Unreleased]
+
+- Work in progress
+
+## [1.2.3] - 2024-02-01
+
+### Added
+
+- Dark mode
+
+## v1.2.2
+
+- Fix the login
+`
+	assert.Equal(t, "### Added\n\n- Dark mode", changelogSection(changelog, "1.2.3"))
+	assert.Equal(t, "- Fix the login", changelogSection(changelog, "1.2.2"))
+	assert.Equal(t, "", changelogSection(changelog, "1.2.1"))
+	assert.Equal(t, "", changelogSection(changelog, "1.2"))
+
+	manifest := map[string]interface{}{"changes": "  New icons  "}
+	assert.Equal(t, "New icons", versionChangelog(manifest, []byte(changelog), "1.2.3"))
+	assert.Equal(t, "- Fix the login", versionChangelog(nil, []byte(changelog), "1.2.2"))
+
+	long := strings.Repeat("é", maxChangelogSize)
+	truncated := versionChangelog(map[string]interface{}{"changes": long}, nil, "1.0.0")
+	assert.True(t, utf8.ValidString(truncated))
+	assert.True(t, strings.HasSuffix(truncated, "…"))
+	assert.True(t, len(truncated) <= maxChangelogSize+len("\n…"))
+}
+
+func TestAppsCursor(t *testing.T) {
+	app := &App{
+		Slug:      "drive",
+		Type:      "webapp",
+		CreatedAt: time.Date(2021, 3, 12, 10, 21, 46, 618000000, time.UTC),
+	}
+	cursor := newAppsCursor(app, "created_at", true)
+	after, skip, err := parseAppsCursor(cursor, "created_at", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, skip)
+	assert.Equal(t, []string{"2021-03-12T10:21:46.618Z", "drive"}, after.After)
+
+	_, _, err = parseAppsCursor(cursor, "created_at", false)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, _, err = parseAppsCursor(cursor, "slug", true)
+	assert.Equal(t, ErrInvalidCursor, err)
+	_, _, err = parseAppsCursor("not a cursor", "slug", false)
+	assert.Equal(t, ErrInvalidCursor, err)
+
+	// Legacy cursors
+	after, skip, err = parseAppsCursor("150", "slug", false)
+	assert.NoError(t, err)
+	assert.Nil(t, after)
+	assert.Equal(t, 150, skip)
+	_, _, err = parseAppsCursor("-1", "slug", false)
+	assert.Equal(t, ErrInvalidCursor, err)
+
+	// The popularity is compared as a number by CouchDB
+	app.Popularity = 42
+	after, _, err = parseAppsCursor(newAppsCursor(app, "popularity", true), "popularity", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"42", "drive"}, after.After)
+	assert.Equal(t, int64(42), cursorValue("popularity", after.After[0]))
+	assert.Equal(t, "drive", cursorValue("slug", "drive"))
+}
+
+func TestFilterCondition(t *testing.T) {
+	op, value := filterCondition("webapp")
+	assert.Equal(t, mango.Eq, op)
+	assert.Equal(t, "webapp", value)
+
+	op, value = filterCondition("!cozy")
+	assert.Equal(t, mango.Ne, op)
+	assert.Equal(t, "cozy", value)
+
+	op, value = filterCondition("cozy,partner")
+	assert.Equal(t, mango.In, op)
+	assert.Equal(t, []string{"cozy", "partner"}, value)
+
+	op, value = filterCondition("!cozy, partner,")
+	assert.Equal(t, mango.Nin, op)
+	assert.Equal(t, []string{"cozy", "partner"}, value)
+}
+
+func TestAppsSorts(t *testing.T) {
+	assert.Equal(t, []string{"created_at", "editor", "name", "popularity", "slug", "type"}, AppsSorts())
+	assert.True(t, isSortIndexed("name"))
+	assert.False(t, isSortIndexed("maintenance"))
+	assert.False(t, isSortIndexed("version"))
+}
+
+func TestCountFacets(t *testing.T) {
+	s := &space.Space{Name: "test-facets"}
+	facets[s.Name] = &spaceFacets{
+		apps: map[string]appFacets{
+			"bank1": {Type: "konnector", Categories: []string{"banking"}, DataTypes: []string{"bankAccounts", "bankTransactions"}},
+			"bank2": {Type: "konnector", Categories: []string{"banking", "banking"}, DataTypes: []string{"bankAccounts"}},
+			"notes": {Type: "webapp", Categories: []string{"cozy"}, DataTypes: []string{"notes"}},
+		},
+		builtAt: time.Now(),
+	}
+	defer delete(facets, s.Name)
+
+	categories, err := GetCategories(nil, s)
+	assert.NoError(t, err)
+	assert.Equal(t, []Facet{{"banking", 2}, {"cozy", 1}}, categories)
+
+	dataTypes, err := GetKonnectorsDataTypes(nil, s)
+	assert.NoError(t, err)
+	assert.Equal(t, []Facet{{"bankAccounts", 2}, {"bankTransactions", 1}}, dataTypes)
+
+	virtual := &base.VirtualSpace{Filter: "select", Slugs: []string{"bank1", "notes"}}
+	categories, err = GetCategories(virtual, s)
+	assert.NoError(t, err)
+	assert.Equal(t, []Facet{{"banking", 1}, {"cozy", 1}}, categories)
+}
+
+func TestGetScreenshots(t *testing.T) {
+	var parsed Manifest
+	err := json.Unmarshal([]byte(`{
+		"screenshots": [
+			"screenshots/b.png",
+			{ "src": "screenshots/a.png", "caption": { "en": "Home" } }
+		],
+		"locales": {
+			"fr": { "screenshots": [
+				{ "src": "screenshots/a.png", "caption": { "fr": "Accueil" } },
+				"screenshots/fr.png"
+			] },
+			"en": { "screenshots": ["screenshots/en.png"] }
+		}
+	}`), &parsed)
+	assert.NoError(t, err)
+
+	shots := getScreenshots(&parsed, &VersionOptions{})
+	assert.Equal(t, []VersionScreenshot{
+		{Path: "/screenshots/b.png"},
+		{Path: "/screenshots/a.png", Caption: map[string]string{"en": "Home", "fr": "Accueil"}},
+		{Path: "/screenshots/en.png", Locales: []string{"en"}},
+		{Path: "/screenshots/fr.png", Locales: []string{"fr"}},
+	}, shots)
+
+	shots = getScreenshots(&parsed, &VersionOptions{Screenshots: []string{"c.png"}})
+	assert.Equal(t, []VersionScreenshot{{Path: "/c.png"}}, shots)
+}
+
+func TestImageDimensions(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.NoError(t, png.Encode(buf, image.NewRGBA(image.Rect(0, 0, 64, 48))))
+	width, height := imageDimensions("image/png", buf.Bytes())
+	assert.Equal(t, 64, width)
+	assert.Equal(t, 48, height)
+
+	width, height = imageDimensions("image/svg+xml", []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 320 240.4"></svg>`))
+	assert.Equal(t, 320, width)
+	assert.Equal(t, 240, height)
+
+	width, height = imageDimensions("image/jpeg", []byte("not an image"))
+	assert.Equal(t, 0, width)
+	assert.Equal(t, 0, height)
+}
+
+func TestGetKonnectorsMaintenance(t *testing.T) {
+	s := &space.Space{Name: "test-maintenance"}
+	opts := &MaintenanceOptions{FlagShortMaintenance: true}
+	maintenanceMu.Lock()
+	maintenanceCache[s.Name] = cachedMaintenance{
+		apps: map[string]*App{
+			"bank1": {Slug: "bank1", Type: "konnector", MaintenanceActivated: true, MaintenanceOptions: opts},
+			"notes": {Slug: "notes", Type: "webapp", MaintenanceActivated: true},
+		},
+		cachedAt: time.Now(),
+	}
+	maintenanceMu.Unlock()
+	defer invalidateMaintenance()
+
+	statuses, err := GetKonnectorsMaintenance(nil, s, []string{"orange", "bank1", "notes"})
+	assert.NoError(t, err)
+	assert.Equal(t, []*KonnectorMaintenance{
+		{Slug: "orange"},
+		{Slug: "bank1", MaintenanceActivated: true, MaintenanceOptions: opts},
+		{Slug: "notes"},
+	}, statuses)
+}
+
+func TestCheckAppLegalHold(t *testing.T) {
+	s := &space.Space{Name: "test-legal-hold"}
+	app := &App{Slug: "drive", Versions: &AppVersions{}}
+	assert.NoError(t, checkAppLegalHold(s, app, "delete app"))
+
+	app.LegalHold = &LegalHold{Reason: "Investigation", By: "cozy", At: time.Now()}
+	assert.Equal(t, ErrLegalHold, checkAppLegalHold(s, app, "delete app"))
+
+	v := &Version{Slug: "drive", Version: "1.0.0", LegalHold: app.LegalHold}
+	assert.Equal(t, ErrLegalHold, checkVersionLegalHold(s, v, "delete version"))
+}
+
+func TestCheckAdvisory(t *testing.T) {
+	valid := Advisory{ID: "CRA-1", Severity: "high", Summary: "XSS", Versions: "< 1.2.4"}
+	assert.NoError(t, checkAdvisory(&valid))
+
+	noID := valid
+	noID.ID = ""
+	assert.Error(t, checkAdvisory(&noID))
+	noSummary := valid
+	noSummary.Summary = ""
+	assert.Error(t, checkAdvisory(&noSummary))
+	badSeverity := valid
+	badSeverity.Severity = "urgent"
+	assert.Error(t, checkAdvisory(&badSeverity))
+	badVersions := valid
+	badVersions.Versions = "not a constraint"
+	assert.Error(t, checkAdvisory(&badVersions))
+
+	app := &App{Slug: "drive"}
+	assert.False(t, app.IsUnlisted())
+	app.Moderation = &Moderation{Flagged: &ModerationAction{Reason: "Spam"}}
+	assert.False(t, app.IsUnlisted())
+	app.Moderation.Unlisted = &ModerationAction{Reason: "Spam"}
+	assert.True(t, app.IsUnlisted())
+}
+
+func TestRequiredManifestFields(t *testing.T) {
+	assert.ElementsMatch(t, []string{"name", "slug", "editor", "version"}, requiredManifestFields())
+}
@@ -0,0 +1,131 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+)
+
+// errPrivateAddress is returned when a tarball is hosted on a loopback or
+// private address, to protect the services of the internal network of the
+// registry (SSRF).
+var errPrivateAddress = errors.New("the tarballs can't be downloaded from a private address")
+
+// privateNetworks are the networks refused for the downloads of the tarballs,
+// in addition to the loopback, link-local and unspecified addresses.
+var privateNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// isPrivateIP returns true for the addresses that are not reachable from the
+// internet.
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDialAddress refuses the connections to the private addresses, after
+// the resolution of the host names and for the redirections too.
+func checkDialAddress(network, address string, _ syscall.RawConn) error {
+	if base.Config.DownloadPrivateNetworks {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// newVersionTransport returns the transport used to download the tarballs,
+// which can't connect to the private addresses.
+func newVersionTransport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialAddress,
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// matchDomain returns true if the host is one of the domains, or one of their
+// subdomains.
+func matchDomain(host string, domains []string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range domains {
+		domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVersionURL checks that the tarball of a version can be downloaded from
+// the given URL in the space: it must use http or https, be on one of the
+// allowed domains of the space, and not target a private address.
+func CheckVersionURL(prefix base.Prefix, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnprocessableEntity, "Invalid version URL: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid version URL %s: only http and https are allowed", rawURL)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"Invalid version URL %s: missing host", rawURL)
+	}
+	if !base.Config.DownloadPrivateNetworks {
+		if ip := net.ParseIP(host); (ip != nil && isPrivateIP(ip)) || strings.EqualFold(host, "localhost") {
+			return errshttp.NewError(http.StatusUnprocessableEntity,
+				"Invalid version URL %s: %s", rawURL, errPrivateAddress)
+		}
+	}
+	if domains := base.Config.GetDownloadDomains(prefix); len(domains) > 0 && !matchDomain(host, domains) {
+		return errshttp.NewError(http.StatusUnprocessableEntity,
+			"The domain %s is not allowed for the tarballs of this space, the allowed domains are: %s",
+			host, strings.Join(domains, ", "))
+	}
+	return nil
+}
+
+// isPrivateAddressError returns true if the download has been refused as the
+// tarball is hosted on a private address.
+func isPrivateAddressError(err error) bool {
+	return errors.Is(err, errPrivateAddress)
+}
@@ -3,7 +3,6 @@ package registry
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -16,14 +15,40 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cozy/cozy-apps-registry/asset"
 	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/manifest"
 	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
 	"github.com/go-kivik/kivik/v3"
+	"github.com/klauspost/pgzip"
+	"github.com/sirupsen/logrus"
 )
 
+// regenerationBlockSize is the size of the blocks compressed in parallel when
+// a tarball is regenerated.
+const regenerationBlockSize = 1 << 20
+
+// copyBuffers is a pool of buffers used for copying the files of the tarballs
+// when they are regenerated.
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 128*1024)
+		return &buf
+	},
+}
+
+func pooledCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
 func findOverwrittenVersion(s base.VirtualSpace, version *Version) (*Version, bool, error) {
 	db := s.VersionDB()
 	ctx := context.Background()
@@ -74,7 +99,7 @@ func storeOverwrittenTarball(s base.VirtualSpace, tarball string) (hash string,
 	length = stats.Size()
 
 	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
+	if _, err := pooledCopy(hasher, file); err != nil {
 		return "", 0, err
 	}
 	h := hasher.Sum(nil)
@@ -138,19 +163,26 @@ func generateOverwrittenTarball(version *Version, overwrite map[string]interface
 			return nil, "", err
 		}
 	}
-	name, nameOverwritten := overwrite["name"].(string)
 
-	inputGzip, err := gzip.NewReader(input)
-	if err != nil {
+	var inputTar *tar.Reader
+	if version.ArchiveFormat == "" || version.ArchiveFormat == base.ArchiveGzip {
+		inputGzip, err := pgzip.NewReader(input)
+		if err != nil {
+			return nil, "", err
+		}
+		defer inputGzip.Close()
+		inputTar = tar.NewReader(inputGzip)
+	} else if inputTar, _, err = tarReader(input, archiveContentType(version.ArchiveFormat, "")); err != nil {
 		return nil, "", err
 	}
-	defer inputGzip.Close()
-	inputTar := tar.NewReader(inputGzip)
 
-	outputGzip := gzip.NewWriter(output)
+	outputGzip, err := pgzip.NewWriterLevel(output, base.Config.CompressionLevel)
 	if err != nil {
 		return nil, "", err
 	}
+	if err = outputGzip.SetConcurrency(regenerationBlockSize, runtime.GOMAXPROCS(0)); err != nil {
+		return nil, "", err
+	}
 	defer func() {
 		cerr := outputGzip.Close()
 		if err == nil {
@@ -189,14 +221,14 @@ func generateOverwrittenTarball(version *Version, overwrite map[string]interface
 					return nil, "", err
 				}
 			case manifestFilename:
-				if newManifest, err = overwriteManifest(inputTar, outputTar, header, nameOverwritten, name); err != nil {
+				if newManifest, err = overwriteManifest(inputTar, outputTar, header, overwrite); err != nil {
 					return nil, "", err
 				}
 			default:
 				if err = outputTar.WriteHeader(header); err != nil {
 					return nil, "", err
 				}
-				if _, err = io.Copy(outputTar, inputTar); err != nil {
+				if _, err = pooledCopy(outputTar, inputTar); err != nil {
 					return nil, "", err
 				}
 			}
@@ -204,15 +236,13 @@ func generateOverwrittenTarball(version *Version, overwrite map[string]interface
 	}
 }
 
-func overwriteManifest(inputTar *tar.Reader, outputTar *tar.Writer, header *tar.Header, nameOverwritten bool, name string) (map[string]interface{}, error) {
+func overwriteManifest(inputTar *tar.Reader, outputTar *tar.Writer, header *tar.Header, overwrite map[string]interface{}) (map[string]interface{}, error) {
 	var manifest map[string]interface{}
 	decoder := json.NewDecoder(inputTar)
 	if err := decoder.Decode(&manifest); err != nil {
 		return nil, err
 	}
-	if nameOverwritten {
-		manifest["name"] = name
-	}
+	mergeOverwrite(manifest, overwrite)
 	j, err := json.Marshal(manifest)
 	if err != nil {
 		return nil, err
@@ -227,20 +257,64 @@ func overwriteManifest(inputTar *tar.Reader, outputTar *tar.Writer, header *tar.
 	return manifest, nil
 }
 
+// mergeOverwrite applies the fields of the manifest overwritten in the
+// virtual space: the name, the short description, the categories and the
+// localized fields.
+func mergeOverwrite(manifest map[string]interface{}, overwrite map[string]interface{}) {
+	if name, ok := overwrite["name"].(string); ok {
+		manifest["name"] = name
+	}
+	if description, ok := overwrite["short_description"].(string); ok {
+		manifest["short_description"] = description
+	}
+	if categories, ok := overwrite["categories"].([]interface{}); ok {
+		manifest["categories"] = categories
+	}
+	locales, _ := overwrite["locales"].(map[string]interface{})
+	mergeLocales(manifest, locales)
+}
+
+// mergeLocales merges the localized fields overwritten in the virtual space
+// into the locales map of the manifest.
+func mergeLocales(manifest map[string]interface{}, locales map[string]interface{}) {
+	if len(locales) == 0 {
+		return
+	}
+	manifestLocales, ok := manifest["locales"].(map[string]interface{})
+	if !ok {
+		manifestLocales = make(map[string]interface{})
+		manifest["locales"] = manifestLocales
+	}
+	for locale, fields := range locales {
+		fields, ok := fields.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		translated, ok := manifestLocales[locale].(map[string]interface{})
+		if !ok {
+			translated = make(map[string]interface{})
+			manifestLocales[locale] = translated
+		}
+		for field, value := range fields {
+			translated[field] = value
+		}
+	}
+}
+
 func overwriteIcon(inputTar *tar.Reader, outputTar *tar.Writer, header *tar.Header, iconOverwritten bool, iconContent *bytes.Buffer) error {
 	if iconOverwritten {
 		header.Size = int64(iconContent.Len())
 		if err := outputTar.WriteHeader(header); err != nil {
 			return err
 		}
-		if _, err := io.Copy(outputTar, iconContent); err != nil {
+		if _, err := pooledCopy(outputTar, iconContent); err != nil {
 			return err
 		}
 	} else {
 		if err := outputTar.WriteHeader(header); err != nil {
 			return err
 		}
-		if _, err := io.Copy(outputTar, inputTar); err != nil {
+		if _, err := pooledCopy(outputTar, inputTar); err != nil {
 			return err
 		}
 	}
@@ -330,6 +404,11 @@ func RegenerateOverwrittenTarballs(virtualSpaceName string, appSlug string) (err
 		newVersion.AttachmentReferences = map[string]string{"tarball": hash}
 		newVersion.Size = size
 		newVersion.Sha256 = hash
+		// The signature of the editor was made for the original tarball
+		newVersion.Signature = ""
+		newVersion.Signed = false
+		regeneratedAt := time.Now().UTC()
+		newVersion.RegeneratedAt = &regeneratedAt
 
 		u, err := url.Parse(newVersion.URL)
 		if err != nil {
@@ -381,9 +460,226 @@ func RegenerateOverwrittenTarballs(virtualSpaceName string, appSlug string) (err
 		regenerated = append(regenerated, lastVersion)
 	}
 
+	purgeVirtualChannelCaches(virtualSpace.Name, appSlug)
 	return nil
 }
 
+// tarballOverwriteFields are the fields of an overwrite that are applied to
+// the regenerated tarballs.
+var tarballOverwriteFields = []string{"name", "icon", "locales", "short_description", "categories"}
+
+func hasTarballOverwrite(overwrite map[string]interface{}) bool {
+	for _, field := range tarballOverwriteFields {
+		if _, ok := overwrite[field]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FindStaleOverwrittenTarballs returns the slugs of the applications
+// overwritten in the virtual space for which the latest version of a channel
+// in the source space has not been regenerated yet.
+func FindStaleOverwrittenTarballs(v *base.VirtualSpace) ([]string, error) {
+	s, ok := space.GetSpace(v.Source)
+	if !ok {
+		return nil, fmt.Errorf("unable to find %s space", v.Source)
+	}
+
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	rows, err := v.OverrideDb().AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []string
+	for rows.Next() {
+		slug := rows.ID()
+		if strings.HasPrefix(slug, "_design") || !v.AcceptApp(slug) {
+			continue
+		}
+		overwrite := map[string]interface{}{}
+		if err = rows.ScanDoc(&overwrite); err != nil {
+			return nil, err
+		}
+		if !hasTarballOverwrite(overwrite) {
+			continue
+		}
+		for _, channel := range Channels {
+			latest, err := FindLatestVersion(s, slug, channel)
+			if err == ErrVersionNotFound {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			_, err = FindOverwrittenVersion(v, latest)
+			if err == ErrVersionNotFound {
+				stale = append(stale, slug)
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err = rows.Err(); err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+		return nil, err
+	}
+	return stale, nil
+}
+
+// RegenerateStaleOverwrittenTarballs regenerates the tarballs of the
+// applications overwritten in the virtual space when a new latest version has
+// landed in the source space, and returns their slugs.
+func RegenerateStaleOverwrittenTarballs(v *base.VirtualSpace) ([]string, error) {
+	stale, err := FindStaleOverwrittenTarballs(v)
+	if err != nil {
+		return nil, err
+	}
+	regenerated := make([]string, 0, len(stale))
+	for _, slug := range stale {
+		if err := RegenerateOverwrittenTarballs(v.Name, slug); err != nil {
+			return regenerated, err
+		}
+		regenerated = append(regenerated, slug)
+	}
+	return regenerated, nil
+}
+
+// RunOverwrittenTarballsRegenerator looks for the stale overwritten tarballs
+// of all the virtual spaces at the given interval, and regenerates them. It
+// is meant to be run in a goroutine by the server, as a safety net for the
+// regenerations made at publication.
+func RunOverwrittenTarballsRegenerator(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for name := range base.Config.VirtualSpaces {
+			v := base.Config.VirtualSpaces[name]
+			log := logrus.WithFields(logrus.Fields{
+				"nspace":        "regeneration",
+				"virtual_space": name,
+			})
+			regenerated, err := RegenerateStaleOverwrittenTarballs(&v)
+			for _, slug := range regenerated {
+				log.WithField("slug", slug).Info("Overwritten tarballs regenerated")
+			}
+			if err != nil {
+				log.WithField("error_msg", err).Error("Cannot regenerate the overwritten tarballs")
+			}
+		}
+	}
+}
+
+// OverriddenVersion describes a version of an app that is served with a
+// regenerated tarball in a virtual space.
+type OverriddenVersion struct {
+	Slug          string     `json:"slug"`
+	Version       string     `json:"version"`
+	Type          string     `json:"type"`
+	Editor        string     `json:"editor"`
+	URL           string     `json:"url"`
+	Tarball       string     `json:"tarball"`
+	Size          int64      `json:"size,string"`
+	Sha256        string     `json:"sha256"`
+	RegeneratedAt *time.Time `json:"regenerated_at,omitempty"`
+}
+
+// OverriddenVersionDetails is an overridden version, with its manifest and
+// the overrides of the app that have been applied.
+type OverriddenVersionDetails struct {
+	*OverriddenVersion
+	Attachments map[string]string      `json:"attachments"`
+	Manifest    json.RawMessage        `json:"manifest"`
+	Overrides   map[string]interface{} `json:"overrides"`
+}
+
+func newOverriddenVersion(version *Version) *OverriddenVersion {
+	return &OverriddenVersion{
+		Slug:          version.Slug,
+		Version:       version.Version,
+		Type:          version.Type,
+		Editor:        version.Editor,
+		URL:           version.URL,
+		Tarball:       version.AttachmentReferences["tarball"],
+		Size:          version.Size,
+		Sha256:        version.Sha256,
+		RegeneratedAt: version.RegeneratedAt,
+	}
+}
+
+// ListOverriddenVersions returns the list of the versions that have a
+// regenerated tarball in the virtual space.
+func ListOverriddenVersions(virtualSpace base.VirtualSpace) ([]*OverriddenVersion, error) {
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	db := virtualSpace.VersionDB()
+	rows, err := db.AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*OverriddenVersion, 0)
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var version Version
+		if err = rows.ScanDoc(&version); err != nil {
+			return nil, err
+		}
+		list = append(list, newOverriddenVersion(&version))
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// FindOverriddenVersion returns the details of a version with a regenerated
+// tarball in the virtual space.
+func FindOverriddenVersion(virtualSpace base.VirtualSpace, appSlug, version string) (*OverriddenVersionDetails, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return nil, ErrAppSlugInvalid
+	}
+	overwritten, ok, err := findOverwrittenVersion(virtualSpace, &Version{Slug: appSlug, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	db, err := getDBForVirtualSpace(virtualSpace.Name)
+	if err != nil {
+		return nil, err
+	}
+	overrides, _, err := findOverwrite(db, appSlug)
+	if err != nil {
+		return nil, err
+	}
+	delete(overrides, "_id")
+	delete(overrides, "_rev")
+
+	return &OverriddenVersionDetails{
+		OverriddenVersion: newOverriddenVersion(overwritten),
+		Attachments:       overwritten.AttachmentReferences,
+		Manifest:          overwritten.Manifest,
+		Overrides:         overrides,
+	}, nil
+}
+
 // FindAppOverride finds if the app have overwritten value in the virtual space
 func FindAppOverride(virtualSpace *base.VirtualSpace, appSlug string, name string) (string, error) {
 	db, err := getDBForVirtualSpace(virtualSpace.Name)
@@ -430,11 +726,56 @@ func FindAttachmentFromOverwrite(space *base.VirtualSpace, appSlug, filename str
 	}, true, nil
 }
 
+// FindVirtualAppAttachment looks for an attachment of an application in a
+// virtual space. The overrides of the virtual space are used first. Else, the
+// latest version is looked up in the channels, in order, and the attachment
+// is taken from the overwritten version if it has one, or from the original
+// version. The attachments are still served when the application is in
+// maintenance: the overwrite with the maintenance status of the virtual space
+// has no attachments, and the lookup goes on with the versions.
+func FindVirtualAppAttachment(v *base.VirtualSpace, c *space.Space, appSlug, filename string, channels []Channel) (*Attachment, error) {
+	if !validSlugReg.MatchString(appSlug) {
+		return nil, ErrAppSlugInvalid
+	}
+	att, found, err := FindAttachmentFromOverwrite(v, appSlug, filename)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return att, nil
+	}
+
+	for _, ch := range channels {
+		version, err := FindLatestVersion(c, appSlug, ch)
+		if err == ErrVersionNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		overwritten, err := FindOverwrittenVersion(v, version)
+		if err != nil && err != ErrVersionNotFound {
+			return nil, err
+		}
+		if err == nil {
+			if _, ok := overwritten.AttachmentReferences[filename]; ok {
+				return FindVersionAttachment(c, overwritten, filename)
+			}
+		}
+		return FindVersionAttachment(c, version, filename)
+	}
+
+	return nil, ErrVersionNotFound
+}
+
 func FindOverwrittenVersion(space *base.VirtualSpace, version *Version) (*Version, error) {
 	db := space.VersionDB()
 	// Sometime version is already cleared and so `.ID` is empty…
 	id := getVersionID(version.Slug, version.Version)
-	row := db.Get(context.Background(), id)
+	ctx, cancel := base.DocumentContext()
+	defer cancel()
+	row := db.Get(ctx, id)
 
 	var doc Version
 	err := row.ScanDoc(&doc)
@@ -497,6 +838,118 @@ func OverwriteAppName(virtualSpaceName, appSlug, newName string) error {
 	return RegenerateOverwrittenTarballs(virtualSpaceName, appSlug)
 }
 
+// OverwriteAppShortDescription tells that an app will have a different short
+// description in the virtual space. An empty description removes the
+// overwrite.
+func OverwriteAppShortDescription(virtualSpaceName, appSlug, description string) error {
+	db, err := getDBForVirtualSpace(virtualSpaceName)
+	if err != nil {
+		return err
+	}
+
+	overwrite, _, err := findOverwrite(db, appSlug)
+	if err != nil {
+		return err
+	}
+	if description == "" {
+		delete(overwrite, "short_description")
+	} else {
+		overwrite["short_description"] = description
+	}
+
+	id := getAppID(appSlug)
+	if _, err = db.Put(context.Background(), id, overwrite); err != nil {
+		return err
+	}
+
+	return RegenerateOverwrittenTarballs(virtualSpaceName, appSlug)
+}
+
+// OverwriteAppCategories tells that an app will have different categories in
+// the virtual space. No categories removes the overwrite.
+func OverwriteAppCategories(virtualSpaceName, appSlug string, categories []string) error {
+	for _, category := range categories {
+		if !stringInArray(category, manifest.Categories) {
+			return fmt.Errorf("Invalid category %q, expected one of %s",
+				category, strings.Join(manifest.Categories, ", "))
+		}
+	}
+
+	db, err := getDBForVirtualSpace(virtualSpaceName)
+	if err != nil {
+		return err
+	}
+
+	overwrite, _, err := findOverwrite(db, appSlug)
+	if err != nil {
+		return err
+	}
+	if len(categories) == 0 {
+		delete(overwrite, "categories")
+	} else {
+		overwrite["categories"] = categories
+	}
+
+	id := getAppID(appSlug)
+	if _, err = db.Put(context.Background(), id, overwrite); err != nil {
+		return err
+	}
+
+	return RegenerateOverwrittenTarballs(virtualSpaceName, appSlug)
+}
+
+// overwritableLocaleFields are the localized fields of the manifest that can
+// be overwritten in a virtual space.
+var overwritableLocaleFields = []string{"name", "short_description", "long_description"}
+
+// OverwriteAppLocale tells that an app will have a different value for a
+// localized field of its manifest in the virtual space. An empty value removes
+// the overwrite for this field.
+func OverwriteAppLocale(virtualSpaceName, appSlug, locale, field, value string) error {
+	if !IsValidLocale(locale) {
+		return fmt.Errorf("Invalid locale name: %q", locale)
+	}
+	if !stringInArray(field, overwritableLocaleFields) {
+		return fmt.Errorf("Field %q cannot be overwritten, expected one of %s",
+			field, strings.Join(overwritableLocaleFields, ", "))
+	}
+
+	db, err := getDBForVirtualSpace(virtualSpaceName)
+	if err != nil {
+		return err
+	}
+
+	overwrite, _, err := findOverwrite(db, appSlug)
+	if err != nil {
+		return err
+	}
+	locales, ok := overwrite["locales"].(map[string]interface{})
+	if !ok {
+		locales = make(map[string]interface{})
+		overwrite["locales"] = locales
+	}
+	fields, ok := locales[locale].(map[string]interface{})
+	if !ok {
+		fields = make(map[string]interface{})
+		locales[locale] = fields
+	}
+	if value == "" {
+		delete(fields, field)
+		if len(fields) == 0 {
+			delete(locales, locale)
+		}
+	} else {
+		fields[field] = value
+	}
+
+	id := getAppID(appSlug)
+	if _, err = db.Put(context.Background(), id, overwrite); err != nil {
+		return err
+	}
+
+	return RegenerateOverwrittenTarballs(virtualSpaceName, appSlug)
+}
+
 // OverwriteAppIcon tells that an app will have a different icon in the virtual
 // space.
 func OverwriteAppIcon(virtualSpaceName, appSlug, file string) error {
@@ -556,8 +1009,167 @@ func ActivateMaintenanceVirtualSpace(virtualSpaceName, appSlug string, opts Main
 	overwrite["maintenance_options"] = opts
 
 	id := getAppID(appSlug)
-	_, err = db.Put(context.Background(), id, overwrite)
-	return err
+	if _, err = db.Put(context.Background(), id, overwrite); err != nil {
+		return err
+	}
+	invalidateMaintenance()
+	purgeVirtualChannelCaches(virtualSpaceName, appSlug)
+	webhooks.Send(virtualSpaceName, webhooks.MaintenanceActivated, map[string]interface{}{
+		"slug":                appSlug,
+		"maintenance_options": opts,
+	})
+	return nil
+}
+
+// applyManifestOverwrite replaces the name of the app and the fields of the
+// manifest of its latest version by the ones overwritten in the virtual space,
+// if any. The regenerated tarballs already have them, but the latest version
+// may be served from the source space if it was not regenerated yet.
+func applyManifestOverwrite(v *base.VirtualSpace, app *App) error {
+	if v == nil {
+		return nil
+	}
+	overwrite, found, err := findOverwrite(v.OverrideDb(), app.Slug)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	if !found {
+		return nil
+	}
+
+	if name, ok := overwrite["name"].(string); ok {
+		app.Name = name
+	}
+	if app.LatestVersion == nil || len(app.LatestVersion.Manifest) == 0 {
+		return nil
+	}
+	var manifest map[string]interface{}
+	if err = json.Unmarshal(app.LatestVersion.Manifest, &manifest); err != nil {
+		return err
+	}
+	mergeOverwrite(manifest, overwrite)
+	j, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	app.LatestVersion.Manifest = j
+	return nil
+}
+
+// findMaintenanceOverwrites returns the overwrites of a virtual space with a
+// maintenance status, indexed by app ID.
+func findMaintenanceOverwrites(v *base.VirtualSpace) (map[string]map[string]interface{}, error) {
+	overwrites := make(map[string]map[string]interface{})
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	rows, err := v.OverrideDb().AllDocs(ctx, map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return overwrites, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		doc := map[string]interface{}{}
+		if err = rows.ScanDoc(&doc); err != nil {
+			return nil, err
+		}
+		if _, ok := doc["maintenance_activated"]; ok {
+			overwrites[rows.ID()] = doc
+		}
+	}
+	if err = rows.Err(); err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+		return nil, err
+	}
+	return overwrites, nil
+}
+
+func applyMaintenanceOverwrite(app *App, overwrite map[string]interface{}) {
+	app.MaintenanceActivated, _ = overwrite["maintenance_activated"].(bool)
+	app.MaintenanceOptions = nil
+	if opts, ok := overwrite["maintenance_options"]; ok {
+		var options MaintenanceOptions
+		if b, err := json.Marshal(opts); err == nil && json.Unmarshal(b, &options) == nil {
+			app.MaintenanceOptions = &options
+		}
+	}
+}
+
+// applyMaintenanceOverwrites replaces the maintenance status of the apps by
+// the one set in the virtual space, if any.
+func applyMaintenanceOverwrites(v *base.VirtualSpace, apps []*App) error {
+	if v == nil || len(apps) == 0 {
+		return nil
+	}
+	overwrites, err := findMaintenanceOverwrites(v)
+	if err != nil {
+		return err
+	}
+	for _, app := range apps {
+		if overwrite, ok := overwrites[getAppID(app.Slug)]; ok {
+			applyMaintenanceOverwrite(app, overwrite)
+		}
+	}
+	return nil
+}
+
+// GetMaintainanceAppsInVirtualSpace returns the apps in maintenance in the
+// virtual space: the apps in maintenance in the source space, unless their
+// status has been overwritten, and the apps put in maintenance only in the
+// virtual space.
+func GetMaintainanceAppsInVirtualSpace(v *base.VirtualSpace, c *space.Space) ([]*App, error) {
+	apps, err := GetMaintainanceApps(c)
+	if err != nil {
+		return nil, err
+	}
+	overwrites, err := findMaintenanceOverwrites(v)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]*App, 0, len(apps))
+	for _, app := range apps {
+		if !v.AcceptApp(app.Slug) {
+			continue
+		}
+		if overwrite, ok := overwrites[getAppID(app.Slug)]; ok {
+			applyMaintenanceOverwrite(app, overwrite)
+			delete(overwrites, getAppID(app.Slug))
+		}
+		if app.MaintenanceActivated {
+			filtered = append(filtered, app)
+		}
+	}
+
+	for _, overwrite := range overwrites {
+		if activated, _ := overwrite["maintenance_activated"].(bool); !activated {
+			continue
+		}
+		id, _ := overwrite["_id"].(string)
+		app, err := findApp(c, id)
+		if err != nil {
+			if err == ErrAppNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if !v.AcceptApp(app.Slug) {
+			continue
+		}
+		applyMaintenanceOverwrite(app, overwrite)
+		filtered = append(filtered, app)
+	}
+	return filtered, nil
 }
 
 // DeactivateMaintenanceVirtualSpace tells that an app is no longer in
@@ -572,12 +1184,18 @@ func DeactivateMaintenanceVirtualSpace(virtualSpaceName, appSlug string) error {
 	if err != nil {
 		return err
 	}
-	delete(overwrite, "maintenance_activated")
+	// The status is kept in the overwrite, so that an app in maintenance in
+	// the source space can be available in the virtual space.
+	overwrite["maintenance_activated"] = false
 	delete(overwrite, "maintenance_options")
 
 	id := getAppID(appSlug)
-	_, err = db.Put(context.Background(), id, overwrite)
-	return err
+	if _, err = db.Put(context.Background(), id, overwrite); err != nil {
+		return err
+	}
+	invalidateMaintenance()
+	purgeVirtualChannelCaches(virtualSpaceName, appSlug)
+	return nil
 }
 
 func getDBForVirtualSpace(virtualSpaceName string) (*kivik.DB, error) {
@@ -587,12 +1205,13 @@ func getDBForVirtualSpace(virtualSpaceName string) (*kivik.DB, error) {
 		return nil, err
 	}
 	if !ok {
-		fmt.Printf("Creating database %q...", dbName)
 		if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
-			fmt.Println("failed")
 			return nil, err
 		}
-		fmt.Println("ok.")
+		logrus.WithFields(logrus.Fields{
+			"nspace": "couchdb",
+			"db":     dbName,
+		}).Info("Database created")
 	}
 	db := base.DBClient.DB(context.Background(), dbName)
 	if err = db.Err(); err != nil {
@@ -606,8 +1225,10 @@ func findOverwrite(db *kivik.DB, appSlug string) (map[string]interface{}, bool,
 		return nil, false, ErrAppSlugInvalid
 	}
 
+	ctx, cancel := base.DocumentContext()
+	defer cancel()
 	doc := map[string]interface{}{}
-	row := db.Get(context.Background(), getAppID(appSlug))
+	row := db.Get(ctx, getAppID(appSlug))
 	err := row.ScanDoc(&doc)
 	if err != nil {
 		if kivik.StatusCode(err) == http.StatusNotFound {
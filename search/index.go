@@ -0,0 +1,172 @@
+// Package search is a small full-text search engine, with an in-memory
+// inverted index. It is used to find the applications of a space from their
+// name, slug, categories, descriptions and keywords, with a relevance ranking.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Field is a part of a document that can be searched, with a weight to
+// compute the relevance.
+type Field struct {
+	Text   string
+	Weight float64
+}
+
+// Document is something that can be indexed.
+type Document struct {
+	ID     string
+	Fields []Field
+}
+
+// Result is a document that matches a query, with its score.
+type Result struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+type posting struct {
+	id     string
+	weight float64
+}
+
+// Index is an inverted index of documents. It is safe for concurrent use.
+type Index struct {
+	mu       sync.RWMutex
+	postings map[string][]posting
+	terms    map[string][]string // document id -> terms, for removal
+}
+
+// NewIndex returns a new empty index.
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string][]posting),
+		terms:    make(map[string][]string),
+	}
+}
+
+// Tokenize splits a text in lowercase terms.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Add indexes a document, replacing the previous one with the same ID.
+func (idx *Index) Add(doc Document) {
+	weights := make(map[string]float64)
+	for _, field := range doc.Fields {
+		for _, term := range Tokenize(field.Text) {
+			weights[term] += field.Weight
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(doc.ID)
+	terms := make([]string, 0, len(weights))
+	for term, weight := range weights {
+		idx.postings[term] = append(idx.postings[term], posting{doc.ID, weight})
+		terms = append(terms, term)
+	}
+	idx.terms[doc.ID] = terms
+}
+
+// Remove deletes a document from the index.
+func (idx *Index) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.remove(id)
+}
+
+func (idx *Index) remove(id string) {
+	for _, term := range idx.terms[id] {
+		list := idx.postings[term]
+		kept := list[:0]
+		for _, p := range list {
+			if p.id != id {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.postings, term)
+		} else {
+			idx.postings[term] = kept
+		}
+	}
+	delete(idx.terms, id)
+}
+
+// Len returns the number of indexed documents.
+func (idx *Index) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.terms)
+}
+
+// Search returns the documents matching all the terms of the query, sorted by
+// relevance. The last term of the query is also used as a prefix, to allow
+// search-as-you-type.
+func (idx *Index) Search(query string) []Result {
+	terms := Tokenize(query)
+	if len(terms) == 0 {
+		return []Result{}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	total := float64(len(idx.terms))
+	var scores map[string]float64
+	for i, term := range terms {
+		matches := make(map[string]float64)
+		idx.score(matches, term, term, total, 1)
+		if i == len(terms)-1 {
+			for indexed := range idx.postings {
+				if indexed != term && strings.HasPrefix(indexed, term) {
+					idx.score(matches, indexed, term, total, 0.5)
+				}
+			}
+		}
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id, score := range scores {
+			if m, ok := matches[id]; ok {
+				scores[id] = score + m
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, Result{ID: id, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+func (idx *Index) score(matches map[string]float64, indexed, term string, total, factor float64) {
+	list := idx.postings[indexed]
+	if len(list) == 0 {
+		return
+	}
+	idf := math.Log(1 + total/float64(len(list)))
+	for _, p := range list {
+		if s := p.weight * idf * factor; s > matches[p.id] {
+			matches[p.id] = s
+		}
+	}
+}
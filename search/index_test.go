@@ -0,0 +1,46 @@
+package search
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearch(t *testing.T) {
+	idx := NewIndex()
+	idx.Add(Document{ID: "drive", Fields: []Field{
+		{Text: "drive", Weight: 4},
+		{Text: "Cozy Drive", Weight: 3},
+		{Text: "Store and share your files", Weight: 1},
+	}})
+	idx.Add(Document{ID: "photos", Fields: []Field{
+		{Text: "photos", Weight: 4},
+		{Text: "Cozy Photos", Weight: 3},
+		{Text: "Your photos and albums, stored in your drive", Weight: 1},
+	}})
+	idx.Add(Document{ID: "banks", Fields: []Field{
+		{Text: "banks", Weight: 4},
+		{Text: "Cozy Banks", Weight: 3},
+	}})
+	assert.Equal(t, 3, idx.Len())
+
+	results := idx.Search("drive")
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "drive", results[0].ID)
+		assert.Equal(t, "photos", results[1].ID)
+	}
+
+	results = idx.Search("cozy pho")
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "photos", results[0].ID)
+	}
+
+	assert.Empty(t, idx.Search("unknown"))
+	assert.Empty(t, idx.Search("  "))
+
+	idx.Remove("drive")
+	results = idx.Search("drive")
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "photos", results[0].ID)
+	}
+}
@@ -0,0 +1,260 @@
+// Package slowlog keeps track of the slowest CouchDB queries and storage
+// operations over a sliding window. It is useful to know which indexes should
+// be added, without having to enable the verbose logs in production.
+package slowlog
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of operations
+const (
+	CouchDB = "couchdb"
+	Storage = "storage"
+)
+
+// Operation is a CouchDB query or a storage operation that has been recorded.
+type Operation struct {
+	Kind       string    `json:"kind"`
+	Name       string    `json:"name"`
+	Space      string    `json:"space,omitempty"`
+	Params     string    `json:"params,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+	At         time.Time `json:"at"`
+
+	duration time.Duration
+}
+
+// Report is a summary of the recorded operations.
+type Report struct {
+	Window      string         `json:"window"`
+	ThresholdMs float64        `json:"threshold_ms"`
+	Counts      map[string]int `json:"counts"`
+	SlowCounts  map[string]int `json:"slow_counts"`
+	Slowest     []Operation    `json:"slowest"`
+}
+
+// nbBuckets is the number of slices of the sliding window in which the
+// operations are counted.
+const nbBuckets = 60
+
+// bucket counts the operations of a slice of the sliding window.
+type bucket struct {
+	start  time.Time
+	counts map[string]int
+	slow   map[string]int
+}
+
+type tracker struct {
+	mu        sync.Mutex
+	size      int
+	window    time.Duration
+	threshold time.Duration
+	slowest   []Operation
+	// buckets are sorted by their start, the oldest first
+	buckets []*bucket
+}
+
+var global = newTracker(20, time.Hour, 500*time.Millisecond)
+
+func newTracker(size int, window, threshold time.Duration) *tracker {
+	return &tracker{
+		size:      size,
+		window:    window,
+		threshold: threshold,
+	}
+}
+
+// Configure sets the number of operations to keep, the duration of the
+// sliding window, and the threshold above which an operation is logged.
+func Configure(size int, window, threshold time.Duration) {
+	global = newTracker(size, window, threshold)
+}
+
+// Start starts the timer for an operation. The returned function must be
+// called when the operation has finished.
+func Start(kind, name, space, params string) func() {
+	start := time.Now()
+	return func() {
+		global.record(Operation{
+			Kind:     kind,
+			Name:     name,
+			Space:    space,
+			Params:   params,
+			At:       start,
+			duration: time.Since(start),
+		})
+	}
+}
+
+// GetReport returns the slowest operations of the current window, from the
+// slowest to the fastest.
+func GetReport() *Report {
+	return global.report()
+}
+
+func (t *tracker) record(op Operation) {
+	op.DurationMs = float64(op.duration) / float64(time.Millisecond)
+	if t.threshold > 0 && op.duration >= t.threshold {
+		logrus.WithFields(logrus.Fields{
+			"nspace":      "slow_query",
+			"kind":        op.Kind,
+			"name":        op.Name,
+			"space":       op.Space,
+			"params":      op.Params,
+			"duration_ms": op.DurationMs,
+		}).Warn()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	if !op.At.After(time.Now().Add(-t.window)) {
+		return
+	}
+	b := t.bucket(op.At)
+	b.counts[op.Kind]++
+	if t.threshold > 0 && op.duration >= t.threshold {
+		b.slow[op.Kind]++
+	}
+	if t.size <= 0 {
+		return
+	}
+	if len(t.slowest) < t.size {
+		t.slowest = append(t.slowest, op)
+		return
+	}
+	fastest := 0
+	for i, o := range t.slowest {
+		if o.duration < t.slowest[fastest].duration {
+			fastest = i
+		}
+	}
+	if t.slowest[fastest].duration < op.duration {
+		t.slowest[fastest] = op
+	}
+}
+
+// bucketDuration is the duration of a slice of the sliding window.
+func (t *tracker) bucketDuration() time.Duration {
+	d := t.window / nbBuckets
+	if d <= 0 {
+		d = time.Second
+	}
+	return d
+}
+
+// bucket returns the bucket of the sliding window for the given date, and
+// creates it if needed.
+func (t *tracker) bucket(at time.Time) *bucket {
+	start := at.Truncate(t.bucketDuration())
+	i := sort.Search(len(t.buckets), func(i int) bool {
+		return !t.buckets[i].start.Before(start)
+	})
+	if i < len(t.buckets) && t.buckets[i].start.Equal(start) {
+		return t.buckets[i]
+	}
+	b := &bucket{
+		start:  start,
+		counts: make(map[string]int),
+		slow:   make(map[string]int),
+	}
+	t.buckets = append(t.buckets, nil)
+	copy(t.buckets[i+1:], t.buckets[i:])
+	t.buckets[i] = b
+	return b
+}
+
+// expire removes the operations and the buckets that are out of the sliding
+// window.
+func (t *tracker) expire(now time.Time) {
+	limit := now.Add(-t.window)
+	kept := t.slowest[:0]
+	for _, o := range t.slowest {
+		if o.At.After(limit) {
+			kept = append(kept, o)
+		}
+	}
+	t.slowest = kept
+
+	first := 0
+	for first < len(t.buckets) && !t.buckets[first].start.Add(t.bucketDuration()).After(limit) {
+		first++
+	}
+	t.buckets = t.buckets[first:]
+}
+
+func (t *tracker) report() *Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+
+	slowest := make([]Operation, len(t.slowest))
+	copy(slowest, t.slowest)
+	sort.Slice(slowest, func(i, j int) bool {
+		return slowest[i].duration > slowest[j].duration
+	})
+	counts := make(map[string]int)
+	slow := make(map[string]int)
+	for _, b := range t.buckets {
+		for k, v := range b.counts {
+			counts[k] += v
+		}
+		for k, v := range b.slow {
+			slow[k] += v
+		}
+	}
+	return &Report{
+		Window:      t.window.String(),
+		ThresholdMs: float64(t.threshold) / float64(time.Millisecond),
+		Counts:      counts,
+		SlowCounts:  slow,
+		Slowest:     slowest,
+	}
+}
+
+// WriteMetrics writes the counts of the operations of the current window, and
+// the duration of the slowest ones, in the text format of Prometheus.
+func WriteMetrics(w io.Writer) error {
+	return global.report().WriteMetrics(w)
+}
+
+// WriteMetrics writes the report in the text format of Prometheus. The
+// counts are for the sliding window, so they are gauges, not counters.
+func (r *Report) WriteMetrics(w io.Writer) error {
+	slowest := make(map[string]float64)
+	for _, op := range r.Slowest {
+		if d := op.DurationMs / 1000; d > slowest[op.Kind] {
+			slowest[op.Kind] = d
+		}
+	}
+	metrics := []struct {
+		name   string
+		help   string
+		values func(kind string) float64
+	}{
+		{"registry_operations", "Number of operations in the sliding window.",
+			func(kind string) float64 { return float64(r.Counts[kind]) }},
+		{"registry_slow_operations", "Number of operations longer than the threshold in the sliding window.",
+			func(kind string) float64 { return float64(r.SlowCounts[kind]) }},
+		{"registry_slowest_operation_seconds", "Duration of the slowest operation in the sliding window.",
+			func(kind string) float64 { return slowest[kind] }},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name); err != nil {
+			return err
+		}
+		for _, kind := range []string{CouchDB, Storage} {
+			if _, err := fmt.Fprintf(w, "%s{kind=%q} %g\n", m.name, kind, m.values(kind)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package slowlog
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepSlowest(t *testing.T) {
+	tr := newTracker(2, time.Hour, 0)
+	now := time.Now()
+	for i, d := range []time.Duration{3, 1, 5, 2} {
+		tr.record(Operation{Kind: CouchDB, Name: string(rune('a' + i)), At: now, duration: d * time.Millisecond})
+	}
+	report := tr.report()
+	assert.Equal(t, 4, report.Counts[CouchDB])
+	if assert.Len(t, report.Slowest, 2) {
+		assert.Equal(t, "c", report.Slowest[0].Name)
+		assert.Equal(t, "a", report.Slowest[1].Name)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	tr := newTracker(5, time.Minute, 0)
+	tr.record(Operation{Kind: Storage, Name: "old", At: time.Now().Add(-2 * time.Minute), duration: time.Second})
+	tr.record(Operation{Kind: Storage, Name: "new", At: time.Now(), duration: time.Millisecond})
+	report := tr.report()
+	if assert.Len(t, report.Slowest, 1) {
+		assert.Equal(t, "new", report.Slowest[0].Name)
+	}
+}
+
+func TestRollingCounts(t *testing.T) {
+	tr := newTracker(5, 100*time.Millisecond, time.Millisecond)
+	tr.record(Operation{Kind: CouchDB, Name: "fast", At: time.Now(), duration: time.Microsecond})
+	tr.record(Operation{Kind: CouchDB, Name: "slow", At: time.Now(), duration: 2 * time.Millisecond})
+	tr.record(Operation{Kind: Storage, Name: "expired", At: time.Now().Add(-time.Second), duration: time.Second})
+	report := tr.report()
+	assert.Equal(t, 2, report.Counts[CouchDB])
+	assert.Equal(t, 1, report.SlowCounts[CouchDB])
+	assert.Equal(t, 0, report.Counts[Storage])
+
+	// The counts are not cumulative: they are forgotten with the window
+	time.Sleep(150 * time.Millisecond)
+	report = tr.report()
+	assert.Equal(t, 0, report.Counts[CouchDB])
+	assert.Equal(t, 0, report.SlowCounts[CouchDB])
+	assert.Len(t, report.Slowest, 0)
+}
+
+func TestWriteMetrics(t *testing.T) {
+	tr := newTracker(5, time.Hour, time.Second)
+	tr.record(Operation{Kind: CouchDB, Name: "query", At: time.Now(), duration: 1500 * time.Millisecond})
+	tr.record(Operation{Kind: CouchDB, Name: "query", At: time.Now(), duration: 10 * time.Millisecond})
+	var buf bytes.Buffer
+	assert.NoError(t, tr.report().WriteMetrics(&buf))
+	metrics := buf.String()
+	assert.Contains(t, metrics, "# TYPE registry_operations gauge\n")
+	assert.Contains(t, metrics, `registry_operations{kind="couchdb"} 2`+"\n")
+	assert.Contains(t, metrics, `registry_operations{kind="storage"} 0`+"\n")
+	assert.Contains(t, metrics, `registry_slow_operations{kind="couchdb"} 1`+"\n")
+	assert.Contains(t, metrics, `registry_slowest_operation_seconds{kind="couchdb"} 1.5`+"\n")
+}
@@ -0,0 +1,242 @@
+package space
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Strategies for the creation of the indexes when a space is initialized.
+const (
+	// IndexCreate creates the missing indexes (default).
+	IndexCreate = "create"
+	// IndexVerify only logs the missing indexes, for the operators who prefer
+	// to create them manually.
+	IndexVerify = "verify"
+	// IndexSkip does not check the indexes.
+	IndexSkip = "skip"
+)
+
+// RequiredIndex is a mango index on the apps databases, with the queries that
+// need it.
+type RequiredIndex struct {
+	Name    string   `json:"name"`
+	Fields  []string `json:"fields"`
+	Queries []string `json:"queries"`
+}
+
+// IndexStatus tells if a required index exists in the apps database of a
+// space. An outdated index exists with other fields, and is recreated when the
+// space is initialized.
+type IndexStatus struct {
+	RequiredIndex
+	Present  bool `json:"present"`
+	Outdated bool `json:"outdated,omitempty"`
+}
+
+// existingIndex is a mango index found in a database.
+type existingIndex struct {
+	ddoc   string
+	fields []string
+}
+
+var (
+	requiredIndexesMu sync.Mutex
+	requiredIndexes   = make(map[string]*RequiredIndex)
+
+	missingIndexWarnings   = make(map[string]int)
+	missingIndexWarningsMu sync.Mutex
+)
+
+func init() {
+	queries := map[string]string{
+		"slug":        "apps list sorted by slug",
+		"type":        "apps list sorted by type",
+		"editor":      "apps list sorted by editor",
+		"created_at":  "apps list sorted by creation date",
+		"name":        "apps list sorted by name",
+		"maintenance": "apps in maintenance",
+	}
+	for name, fields := range AppsIndexes {
+		// The names are distinct, there can't be a conflict
+		_, _ = RequireAppsIndex(name, queries[name], fields...)
+	}
+}
+
+// RequireAppsIndex declares that a query on the apps databases needs a mango
+// index on the given fields. The index is created or verified when the spaces
+// are initialized. It returns the full name of the index, to be used in the
+// use_index field of the query, or an error if the index has already been
+// required with other fields.
+func RequireAppsIndex(name, query string, fields ...string) (string, error) {
+	requiredIndexesMu.Lock()
+	defer requiredIndexesMu.Unlock()
+	idx, ok := requiredIndexes[name]
+	if !ok {
+		idx = &RequiredIndex{Name: AppIndexName(name), Fields: fields}
+		requiredIndexes[name] = idx
+	} else if !reflect.DeepEqual(idx.Fields, fields) {
+		return "", fmt.Errorf("Index %q is required with different fields", name)
+	}
+	for _, q := range idx.Queries {
+		if q == query {
+			return idx.Name, nil
+		}
+	}
+	idx.Queries = append(idx.Queries, query)
+	return idx.Name, nil
+}
+
+// RequiredIndexes returns the list of the indexes required by the queries on
+// the apps databases.
+func RequiredIndexes() []RequiredIndex {
+	requiredIndexesMu.Lock()
+	defer requiredIndexesMu.Unlock()
+	list := make([]RequiredIndex, 0, len(requiredIndexes))
+	for _, idx := range requiredIndexes {
+		list = append(list, *idx)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// IndexesStatus returns the status of the required indexes for the apps
+// database of the space.
+func (s *Space) IndexesStatus() ([]IndexStatus, error) {
+	existing, err := existingIndexes(s.AppsDB())
+	if err != nil {
+		return nil, err
+	}
+	required := RequiredIndexes()
+	status := make([]IndexStatus, len(required))
+	for i, idx := range required {
+		found, ok := existing[idx.Name]
+		outdated := ok && !reflect.DeepEqual(found.fields, idx.Fields)
+		status[i] = IndexStatus{RequiredIndex: idx, Present: ok && !outdated, Outdated: outdated}
+	}
+	return status, nil
+}
+
+func existingIndexes(db *kivik.DB) (map[string]existingIndex, error) {
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	indexes, err := db.GetIndexes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]existingIndex, len(indexes))
+	for _, idx := range indexes {
+		existing[idx.Name] = existingIndex{
+			ddoc:   strings.TrimPrefix(idx.DesignDoc, "_design/"),
+			fields: indexFields(idx.Definition),
+		}
+	}
+	return existing, nil
+}
+
+// indexFields returns the names of the fields of a mango index, from its
+// definition: {"fields": [{"slug": "asc"}, {"editor": "asc"}]}.
+func indexFields(definition interface{}) []string {
+	def, _ := definition.(map[string]interface{})
+	list, _ := def["fields"].([]interface{})
+	fields := make([]string, 0, len(list))
+	for _, item := range list {
+		switch f := item.(type) {
+		case string:
+			fields = append(fields, f)
+		case map[string]interface{}:
+			for name := range f {
+				fields = append(fields, name)
+			}
+		}
+	}
+	return fields
+}
+
+// ensureIndexes verifies that the required indexes exist in the apps
+// database, and creates them depending on the configured strategy.
+func (s *Space) ensureIndexes() error {
+	strategy := base.Config.IndexStrategy
+	if strategy == IndexSkip {
+		return nil
+	}
+	existing, err := existingIndexes(s.AppsDB())
+	if err != nil {
+		return err
+	}
+	for _, idx := range RequiredIndexes() {
+		found, ok := existing[idx.Name]
+		if ok && reflect.DeepEqual(found.fields, idx.Fields) {
+			continue
+		}
+		log := logrus.WithFields(logrus.Fields{
+			"nspace":  "indexes",
+			"space":   s.Name,
+			"index":   idx.Name,
+			"queries": idx.Queries,
+		})
+		if strategy == IndexVerify {
+			if ok {
+				log.WithField("fields", found.fields).Warn("Index with different fields")
+			} else {
+				log.Warn("Missing index")
+			}
+			continue
+		}
+		ctx, cancel := base.QueryContext()
+		if ok {
+			// CouchDB keeps the old index when an index with the same name is
+			// created with other fields
+			err = s.AppsDB().DeleteIndex(ctx, found.ddoc, idx.Name)
+			if err != nil {
+				cancel()
+				return fmt.Errorf("Error while deleting index %q: %w", idx.Name, err)
+			}
+		}
+		err = s.AppsDB().CreateIndex(ctx, idx.Name, idx.Name, echo.Map{"fields": idx.Fields})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("Error while creating index %q: %w", idx.Name, err)
+		}
+		log.Info("Index created")
+	}
+	return nil
+}
+
+// CheckIndexWarning logs the warning sent by CouchDB when no index matches a
+// mango query, which means that the query has fallen back to a full scan. It
+// must be called after the rows have been iterated.
+func CheckIndexWarning(s *Space, query string, rows *kivik.Rows) {
+	warning := rows.Warning()
+	if warning == "" {
+		return
+	}
+	missingIndexWarningsMu.Lock()
+	missingIndexWarnings[query]++
+	missingIndexWarningsMu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"nspace":  "indexes",
+		"space":   s.Name,
+		"query":   query,
+		"warning": warning,
+	}).Warn("Query without a matching index")
+}
+
+// MissingIndexWarnings returns the number of CouchDB warnings about a missing
+// index, by query.
+func MissingIndexWarnings() map[string]int {
+	missingIndexWarningsMu.Lock()
+	defer missingIndexWarningsMu.Unlock()
+	counts := make(map[string]int, len(missingIndexWarnings))
+	for k, v := range missingIndexWarnings {
+		counts[k] = v
+	}
+	return counts
+}
@@ -0,0 +1,25 @@
+package space
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAppsIndex(t *testing.T) {
+	name, err := RequireAppsIndex("slug", "another query", AppsIndexes["slug"]...)
+	assert.NoError(t, err)
+	assert.Equal(t, AppIndexName("slug"), name)
+
+	_, err = RequireAppsIndex("slug", "another query", "slug", "type")
+	assert.Error(t, err)
+}
+
+func TestIndexFields(t *testing.T) {
+	var def interface{}
+	err := json.Unmarshal([]byte(`{"fields": [{"slug": "asc"}, {"editor": "asc"}, "type"]}`), &def)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"slug", "editor", "type"}, indexFields(def))
+	assert.Empty(t, indexFields(nil))
+}
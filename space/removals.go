@@ -0,0 +1,90 @@
+package space
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/go-kivik/kivik/v3"
+)
+
+// RemovalsDB is the database where the removals of the applications from the
+// spaces are recorded, for the listing diffs.
+var RemovalsDB *kivik.DB
+
+// RemovalsView is the view of the removals database, by space and date.
+const RemovalsView = "by-space-and-date"
+
+// Removal is the record of an application removed from a space.
+type Removal struct {
+	ID        string    `json:"_id,omitempty"`
+	Rev       string    `json:"_rev,omitempty"`
+	Space     string    `json:"space"`
+	Slug      string    `json:"slug"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// RecordRemoval records that the application has been removed from the
+// space.
+func RecordRemoval(s *Space, slug string) error {
+	now := time.Now().UTC()
+	removal := &Removal{
+		ID:        fmt.Sprintf("%s-%s-%d", s.Name, slug, now.UnixNano()),
+		Space:     s.Name,
+		Slug:      slug,
+		DeletedAt: now,
+	}
+	_, err := RemovalsDB.Put(context.Background(), removal.ID, removal)
+	return err
+}
+
+// FindRemovalsBetween returns the slugs of the applications removed from the
+// space between from (included) and to (excluded).
+func FindRemovalsBetween(s *Space, from, to time.Time) ([]string, error) {
+	ctx, cancel := base.QueryContext()
+	defer cancel()
+	rows, err := RemovalsDB.Query(ctx, RemovalsView, RemovalsView, map[string]interface{}{
+		"startkey":      []string{s.Name, from.UTC().Format(time.RFC3339Nano)},
+		"endkey":        []string{s.Name, to.UTC().Format(time.RFC3339Nano)},
+		"inclusive_end": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	slugs := []string{}
+	for rows.Next() {
+		var slug string
+		if err := rows.ScanValue(&slug); err != nil {
+			return nil, err
+		}
+		slugs = append(slugs, slug)
+	}
+	return slugs, rows.Err()
+}
+
+// CreateRemovalsView creates the view used to list the applications removed
+// from a space on a period of time.
+func CreateRemovalsView(db *kivik.DB) error {
+	doc := struct {
+		ID       string          `json:"_id"`
+		Views    json.RawMessage `json:"views"`
+		Language string          `json:"language"`
+	}{
+		ID: "_design/" + RemovalsView,
+		Views: base.SprintfJSON(`{%s: {"map": %s}}`, RemovalsView,
+			`function (doc) { if (doc.space && doc.deleted_at) { emit([doc.space, doc.deleted_at], doc.slug); } }`),
+		Language: "javascript",
+	}
+	_, _, err := db.CreateDoc(context.Background(), doc)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("Could not create the removals view: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package space
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrSpaceExists is returned when a space is created with the name of an
+// existing space.
+var ErrSpaceExists = errors.New("The space already exists")
+
+// ErrSpaceNameInvalid is returned when a space is created with a name that
+// contains invalid characters.
+var ErrSpaceNameInvalid = errors.New("The space name contains invalid characters")
+
+// ErrNotCreatedSpace is returned when a space that has not been created with
+// the admin API is archived: the spaces of the configuration file must be
+// removed from this file.
+var ErrNotCreatedSpace = errors.New("The space has not been created with the admin API")
+
+// CreatedDB is the database where the spaces created at runtime are recorded,
+// so that they are registered again when the server restarts.
+var CreatedDB *kivik.DB
+
+// Created is the record of a space created at runtime.
+type Created struct {
+	Name       string     `json:"_id"`
+	Rev        string     `json:"_rev,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// Archived returns true if the space has been archived.
+func (c *Created) Archived() bool {
+	return c.ArchivedAt != nil
+}
+
+// FindCreated returns the record of a space created at runtime.
+func FindCreated(name string) (*Created, error) {
+	var created Created
+	if err := CreatedDB.Get(context.Background(), name).ScanDoc(&created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListCreated returns the records of the spaces created at runtime, including
+// the archived ones.
+func ListCreated() ([]*Created, error) {
+	rows, err := CreatedDB.AllDocs(context.Background(), map[string]interface{}{
+		"include_docs": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Created{}
+	for rows.Next() {
+		if strings.HasPrefix(rows.ID(), "_design") {
+			continue
+		}
+		var created Created
+		if err := rows.ScanDoc(&created); err != nil {
+			return nil, err
+		}
+		list = append(list, &created)
+	}
+	return list, rows.Err()
+}
+
+// Create creates a new space, with its databases and storage container, and
+// records it so that it is registered again when the server restarts.
+func Create(name string) (*Space, error) {
+	if !validSpaceReg.MatchString(name) {
+		return nil, ErrSpaceNameInvalid
+	}
+	if _, ok := GetSpace(name); ok {
+		return nil, ErrSpaceExists
+	}
+
+	created, err := FindCreated(name)
+	switch {
+	case err == nil && !created.Archived():
+		return nil, ErrSpaceExists
+	case err == nil:
+		// An archived space can be created again, with its data
+		created.ArchivedAt = nil
+	case kivik.StatusCode(err) == http.StatusNotFound:
+		created = &Created{Name: name}
+	default:
+		return nil, err
+	}
+	created.CreatedAt = time.Now().UTC()
+	if _, err := CreatedDB.Put(context.Background(), name, created); err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil, ErrSpaceExists
+		}
+		return nil, err
+	}
+
+	s := NewSpace(name)
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	if err := base.Storage.EnsureExists(s.GetPrefix()); err != nil {
+		return nil, fmt.Errorf("Cannot create storage container %q: %w", s.GetPrefix(), err)
+	}
+	spacesMu.Lock()
+	Spaces[name] = s
+	spacesMu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"nspace": "spaces",
+		"space":  name,
+	}).Info("Space created")
+	return s, nil
+}
+
+// Archive stops serving a space created at runtime. Its databases and storage
+// container are kept, and it can be created again.
+func Archive(name string) error {
+	created, err := FindCreated(name)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusNotFound {
+			return ErrNotCreatedSpace
+		}
+		return err
+	}
+	if !created.Archived() {
+		now := time.Now().UTC()
+		created.ArchivedAt = &now
+		if _, err := CreatedDB.Put(context.Background(), name, created); err != nil {
+			return err
+		}
+	}
+
+	spacesMu.Lock()
+	delete(Spaces, name)
+	spacesMu.Unlock()
+	logrus.WithFields(logrus.Fields{
+		"nspace": "spaces",
+		"space":  name,
+	}).Info("Space archived")
+	return nil
+}
+
+// unregisterArchived stops serving the spaces archived by the other
+// instances of the registry, and returns their names.
+func unregisterArchived() ([]string, error) {
+	records, err := ListCreated()
+	if err != nil {
+		return nil, err
+	}
+	archived := []string{}
+	spacesMu.Lock()
+	defer spacesMu.Unlock()
+	for _, record := range records {
+		if _, ok := Spaces[record.Name]; ok && record.Archived() {
+			delete(Spaces, record.Name)
+			archived = append(archived, record.Name)
+		}
+	}
+	return archived, nil
+}
+
+// RunArchivedSpacesChecker looks at the given interval for the spaces that
+// have been archived by the other instances of the registry, and stops
+// serving them. It is meant to be run in a goroutine by the server.
+func RunArchivedSpacesChecker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		archived, err := unregisterArchived()
+		log := logrus.WithField("nspace", "spaces")
+		if err != nil {
+			log.WithField("error_msg", err).Error("Cannot check the archived spaces")
+			continue
+		}
+		for _, name := range archived {
+			log.WithField("space", name).Info("Space archived by another instance")
+		}
+	}
+}
+
+// createdWatcherRetry is the delay before following again the changes of the
+// created spaces, when the feed has been interrupted.
+const createdWatcherRetry = 5 * time.Second
+
+// RunCreatedSpacesWatcher follows the changes of the records of the created
+// spaces, and calls onChange with the name of each space created or archived
+// by any instance of the registry, as soon as it is recorded. It returns when
+// the context is done.
+func RunCreatedSpacesWatcher(ctx context.Context, onChange func(name string)) {
+	since := "now"
+	for {
+		var err error
+		since, err = watchCreated(ctx, since, onChange)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"nspace":    "spaces",
+				"error_msg": err,
+			}).Warn("Cannot follow the changes of the created spaces")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(createdWatcherRetry):
+		}
+	}
+}
+
+// watchCreated follows the continuous changes feed of the created spaces
+// until it is interrupted, and returns the last sequence seen.
+func watchCreated(ctx context.Context, since string, onChange func(name string)) (string, error) {
+	rows, err := CreatedDB.Changes(ctx, map[string]interface{}{
+		"feed":      "continuous",
+		"since":     since,
+		"heartbeat": 30000,
+	})
+	if err != nil {
+		return since, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if !strings.HasPrefix(rows.ID(), "_design") {
+			onChange(rows.ID())
+		}
+		if seq := rows.Seq(); seq != "" {
+			since = seq
+		}
+	}
+	return since, rows.Err()
+}
+
+// Usage is the number of applications and versions of a space, and the size
+// of the tarballs of its versions.
+type Usage struct {
+	Apps         int64 `json:"apps"`
+	Versions     int64 `json:"versions"`
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// Usage returns the number of applications and versions of the space, and
+// the size of their tarballs.
+func (s *Space) Usage() (*Usage, error) {
+	ctx := context.Background()
+	stats, err := s.AppsDB().Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.AppsDB().DesignDocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	designDocs := int64(0)
+	for rows.Next() {
+		designDocs++
+	}
+	rows.Close()
+
+	usage := &Usage{Apps: stats.DocCount - designDocs}
+	rows, err = s.VersDB().Query(ctx, UsageView, UsageView, map[string]interface{}{
+		"reduce": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var value struct {
+			Sum   float64 `json:"sum"`
+			Count int64   `json:"count"`
+		}
+		if err := rows.ScanValue(&value); err != nil {
+			return nil, err
+		}
+		usage.Versions = value.Count
+		usage.StorageBytes = int64(value.Sum)
+	}
+	return usage, rows.Err()
+}
@@ -4,16 +4,19 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sync"
 
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/go-kivik/kivik/v3"
-	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
 )
 
 const (
 	appsDBSuffix        = "apps"
 	versDBSuffix        = "versions"
 	pendingVersDBSuffix = "pending"
+	trashVersDBSuffix   = "trash"
+	statsDBSuffix       = "stats"
 )
 
 var validSpaceReg = regexp.MustCompile(`^[a-z]+[a-z0-9\_\-]*$`)
@@ -24,6 +27,8 @@ var AppsIndexes = map[string][]string{
 	"type":        {"type", "slug", "editor"},
 	"editor":      {"editor", "slug", "type"},
 	"created_at":  {"created_at", "slug", "editor", "type"},
+	"name":        {"name", "slug", "editor", "type"},
+	"popularity":  {"popularity", "slug", "editor", "type"},
 	"maintenance": {"maintenance_activated"},
 }
 
@@ -40,6 +45,8 @@ type Space struct {
 	dbApps        *kivik.DB
 	dbVers        *kivik.DB
 	dbPendingVers *kivik.DB
+	dbTrashVers   *kivik.DB
+	dbStats       *kivik.DB
 }
 
 // NewSpace returns a space with the given name.
@@ -48,7 +55,7 @@ func NewSpace(name string) *Space {
 }
 
 func (s *Space) init() (err error) {
-	for _, suffix := range []string{appsDBSuffix, versDBSuffix, pendingVersDBSuffix} {
+	for _, suffix := range []string{appsDBSuffix, versDBSuffix, pendingVersDBSuffix, trashVersDBSuffix, statsDBSuffix} {
 		var ok bool
 		dbName := s.dbName(suffix)
 		ok, err = base.DBClient.DBExists(context.Background(), dbName)
@@ -56,12 +63,13 @@ func (s *Space) init() (err error) {
 			return
 		}
 		if !ok {
-			fmt.Printf("Creating database %q...", dbName)
 			if err = base.DBClient.CreateDB(context.Background(), dbName); err != nil {
-				fmt.Println("failed")
 				return err
 			}
-			fmt.Println("ok.")
+			logrus.WithFields(logrus.Fields{
+				"nspace": "couchdb",
+				"db":     dbName,
+			}).Info("Database created")
 		}
 		db := base.DBClient.DB(context.Background(), dbName)
 		if err = db.Err(); err != nil {
@@ -74,16 +82,33 @@ func (s *Space) init() (err error) {
 			s.dbVers = db
 		case pendingVersDBSuffix:
 			s.dbPendingVers = db
+		case trashVersDBSuffix:
+			s.dbTrashVers = db
+		case statsDBSuffix:
+			s.dbStats = db
 		default:
 			panic("unreachable")
 		}
 	}
 
-	for name, fields := range AppsIndexes {
-		idx := AppIndexName(name)
-		err = s.AppsDB().CreateIndex(context.Background(), idx, idx, echo.Map{"fields": fields})
-		if err != nil {
-			err = fmt.Errorf("Error while creating index %q: %w", idx, err)
+	if err = s.ensureIndexes(); err != nil {
+		return
+	}
+
+	if err = CreateStatsDateView(s.StatsDB()); err != nil {
+		return
+	}
+
+	if err = CreateVersionsView(s.VersDB()); err != nil {
+		return
+	}
+
+	if err = CreateUsageView(s.VersDB()); err != nil {
+		return
+	}
+
+	for _, db := range []*kivik.DB{s.VersDB(), s.PendingVersDB()} {
+		if err = CreateSha256View(db); err != nil {
 			return
 		}
 	}
@@ -102,6 +127,8 @@ func (s *Space) Clone(name string) Space {
 		dbApps:        s.dbApps,
 		dbVers:        s.dbVers,
 		dbPendingVers: s.dbPendingVers,
+		dbTrashVers:   s.dbTrashVers,
+		dbStats:       s.dbStats,
 	}
 }
 
@@ -120,9 +147,21 @@ func (s *Space) PendingVersDB() *kivik.DB {
 	return s.dbPendingVers
 }
 
-// DBs returns the three databases used by this space.
+// TrashVersDB returns the database used for storing the versions in the trash
+// of this space.
+func (s *Space) TrashVersDB() *kivik.DB {
+	return s.dbTrashVers
+}
+
+// StatsDB returns the database used for storing the daily statistics of the
+// applications (installs and ratings) of this space.
+func (s *Space) StatsDB() *kivik.DB {
+	return s.dbStats
+}
+
+// DBs returns the five databases used by this space.
 func (s *Space) DBs() []*kivik.DB {
-	return []*kivik.DB{s.AppsDB(), s.VersDB(), s.PendingVersDB()}
+	return []*kivik.DB{s.AppsDB(), s.VersDB(), s.PendingVersDB(), s.TrashVersDB(), s.StatsDB()}
 }
 
 func (s *Space) dbName(suffix string) string {
@@ -136,19 +175,39 @@ func (s *Space) dbName(suffix string) string {
 // Spaces is a global map of name -> space.
 var Spaces map[string]*Space
 
+// spacesMu protects the Spaces map, as spaces can be created and archived
+// while the server is running.
+var spacesMu sync.RWMutex
+
 // Register adds a space to the Spaces map, and initializes it.
 func Register(name string) error {
 	if name != "" && !validSpaceReg.MatchString(name) {
 		return fmt.Errorf("Space named %q contains invalid characters", name)
 	}
+	spacesMu.Lock()
 	if _, ok := Spaces[name]; ok {
+		spacesMu.Unlock()
 		return fmt.Errorf("Space %q already registered", name)
 	}
 	c := NewSpace(name)
 	Spaces[name] = c
+	spacesMu.Unlock()
 	return c.init()
 }
 
+// Open initializes a space that is not registered in the Spaces map, like the
+// sandboxes of the editors.
+func Open(name string) (*Space, error) {
+	if !validSpaceReg.MatchString(name) {
+		return nil, fmt.Errorf("Space named %q contains invalid characters", name)
+	}
+	c := NewSpace(name)
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // InitializeSpaces can be used to initialize again the spaces (ie check that
 // the databases exist, have their indexes, etc.)
 func InitializeSpaces() error {
@@ -163,6 +222,8 @@ func InitializeSpaces() error {
 
 // GetSpacesNames returns the list of the space names.
 func GetSpacesNames() []string {
+	spacesMu.RLock()
+	defer spacesMu.RUnlock()
 	names := make([]string, 0, len(Spaces))
 	for name := range Spaces {
 		names = append(names, name)
@@ -175,6 +236,8 @@ func GetSpace(name string) (*Space, bool) {
 	if name == "__default__" {
 		name = ""
 	}
+	spacesMu.RLock()
+	defer spacesMu.RUnlock()
 	s, ok := Spaces[name]
 	return s, ok
 }
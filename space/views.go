@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
 	"strings"
 
 	"github.com/cozy/cozy-apps-registry/base"
@@ -53,82 +52,63 @@ function expandVersion(doc) {
   };
 }`
 
-	devView = `
+	versionsView = `
 function(doc) {
   ` + viewsHelpers + `
-  if (doc.slug != %q) {
-    return
-  }
-  var version = expandVersion(doc);
-  var key = version.v.concat(version.code, +new Date(version.date))
-  emit(key, doc.version);
-}`
-
-	betaView = `
-function(doc) {
-  ` + viewsHelpers + `
-  if (doc.slug != %q) {
+  if (!doc.slug || !doc.version) {
     return
   }
   var version = expandVersion(doc);
   var channel = version.channel;
+  emit([doc.slug, "dev"].concat(version.v, version.code, +new Date(version.date)), doc.version);
   if (channel == "beta" || channel == "stable") {
-    var key = version.v.concat(version.code, version.exp)
-    emit(key, doc.version);
-  }
-}`
-
-	stableView = `
-function(doc) {
-  ` + viewsHelpers + `
-  if (doc.slug != %q) {
-    return
+    emit([doc.slug, "beta"].concat(version.v, version.code, version.exp), doc.version);
   }
-  var version = expandVersion(doc);
-  var channel = version.channel;
   if (channel == "stable") {
-    var key = version.v;
-    emit(key, doc.version);
+    emit([doc.slug, "stable"].concat(version.v), doc.version);
   }
 }`
 )
 
-type view struct {
-	Map string `json:"map"`
-}
-
-var versionsViews = map[string]view{
-	"dev":    {Map: devView},
-	"beta":   {Map: betaView},
-	"stable": {Map: stableView},
-}
+// channels are the names of the channels, used by the by-date views.
+var channels = []string{"dev", "beta", "stable"}
 
-func VersViewDocName(appSlug string) string {
-	return "versions-" + appSlug + "-v2"
-}
+// VersionsViewDoc is the design document of the view of the versions, shared
+// by all the applications of a space.
+const VersionsViewDoc = "versions"
 
-func CreateVersionsViews(c *Space, db *kivik.DB, appSlug string) error {
-	docID := fmt.Sprintf("_design/%s", url.PathEscape(VersViewDocName(appSlug)))
+// VersionsView is the view of the versions, with [slug, channel, version...]
+// keys. A version is in its channel and in the less stable ones (a stable
+// version is also a beta and a dev version), and the keys sort the versions
+// of a channel from the oldest to the latest.
+const VersionsView = "by-channel"
 
-	var viewsBodies []string
-	for name, view := range versionsViews {
-		code := fmt.Sprintf(view.Map, appSlug)
-		viewsBodies = append(viewsBodies,
-			string(base.SprintfJSON(`%s: {"map": %s}`, name, code)))
+// VersionsRange returns the options to query the versions of an application
+// on a channel in the versions view.
+func VersionsRange(appSlug, channel string, descending bool) map[string]interface{} {
+	first := []interface{}{appSlug, channel}
+	last := []interface{}{appSlug, channel, map[string]interface{}{}}
+	if descending {
+		first, last = last, first
 	}
+	return map[string]interface{}{
+		"startkey":   first,
+		"endkey":     last,
+		"descending": descending,
+	}
+}
 
-	viewsBody := json.RawMessage(`{` + strings.Join(viewsBodies, ",") + `}`)
-
+// CreateVersionsView creates the design document of the versions view.
+func CreateVersionsView(db *kivik.DB) error {
 	doc := struct {
 		ID       string          `json:"_id"`
 		Views    json.RawMessage `json:"views"`
 		Language string          `json:"language"`
 	}{
-		ID:       docID,
-		Views:    viewsBody,
+		ID:       "_design/" + VersionsViewDoc,
+		Views:    base.SprintfJSON(`{%s: {"map": %s}}`, VersionsView, versionsView),
 		Language: "javascript",
 	}
-
 	_, _, err := db.CreateDoc(context.Background(), doc)
 	if err != nil {
 		if kivik.StatusCode(err) == http.StatusConflict {
@@ -139,10 +119,68 @@ func CreateVersionsViews(c *Space, db *kivik.DB, appSlug string) error {
 	return nil
 }
 
+// isLegacyVersionsViewDoc returns true for the design documents of the views
+// of the versions that were created for each application, before the shared
+// versions view.
+func isLegacyVersionsViewDoc(id string) bool {
+	return strings.HasPrefix(id, "_design/versions-") && strings.HasSuffix(id, "-v2")
+}
+
+// MigrateVersionsViews replaces the design documents of the versions views of
+// each application by the shared versions view, in the versions database of a
+// space. The index of the shared view is built before the old design
+// documents are removed. It returns the number of removed design documents.
+func MigrateVersionsViews(ctx context.Context, db *kivik.DB) (int, error) {
+	if err := CreateVersionsView(db); err != nil {
+		return 0, err
+	}
+	rows, err := db.Query(ctx, VersionsViewDoc, VersionsView, map[string]interface{}{
+		"limit": 0,
+	})
+	if err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	rows, err = db.DesignDocs(ctx, map[string]interface{}{
+		"startkey": "_design/versions-",
+		"endkey":   "_design/versions-\ufff0",
+	})
+	if err != nil {
+		return 0, err
+	}
+	type legacyDoc struct{ id, rev string }
+	var legacy []legacyDoc
+	for rows.Next() {
+		if !isLegacyVersionsViewDoc(rows.ID()) {
+			continue
+		}
+		var value struct {
+			Rev string `json:"rev"`
+		}
+		if err := rows.ScanValue(&value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		legacy = append(legacy, legacyDoc{rows.ID(), value.Rev})
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for i, doc := range legacy {
+		if _, err := db.Delete(ctx, doc.id, doc.rev); err != nil {
+			return i, err
+		}
+	}
+	return len(legacy), nil
+}
+
 func CreateVersionsDateView(db *kivik.DB) error {
 	var viewsBodies []string
 
-	for channel := range versionsViews {
+	for _, channel := range channels {
 		code := fmt.Sprintf(`
 		function (doc) {
 			`+viewsHelpers+`
@@ -175,3 +213,81 @@ func CreateVersionsDateView(db *kivik.DB) error {
 
 	return nil
 }
+
+// UsageView is the view of the versions databases that counts the versions
+// and sums the sizes of their tarballs.
+const UsageView = "usage"
+
+// CreateUsageView creates the view used to compute the usage of a space.
+func CreateUsageView(db *kivik.DB) error {
+	doc := struct {
+		ID       string          `json:"_id"`
+		Views    json.RawMessage `json:"views"`
+		Language string          `json:"language"`
+	}{
+		ID: "_design/" + UsageView,
+		Views: base.SprintfJSON(`{%s: {"map": %s, "reduce": "_stats"}}`, UsageView,
+			`function (doc) { if (doc.slug && doc.version) { emit(doc.slug, parseInt(doc.size, 10) || 0); } }`),
+		Language: "javascript",
+	}
+	_, _, err := db.CreateDoc(context.Background(), doc)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("Could not create the usage view: %s", err)
+	}
+	return nil
+}
+
+// Sha256View is the view of the versions and pending versions databases,
+// with [slug, sha256] keys, to find the versions of an application with the
+// same tarball.
+const Sha256View = "by-sha256"
+
+// CreateSha256View creates the view of the versions by their sha256.
+func CreateSha256View(db *kivik.DB) error {
+	doc := struct {
+		ID       string          `json:"_id"`
+		Views    json.RawMessage `json:"views"`
+		Language string          `json:"language"`
+	}{
+		ID: "_design/" + Sha256View,
+		Views: base.SprintfJSON(`{%s: {"map": %s}}`, Sha256View,
+			`function (doc) { if (doc.slug && doc.version && doc.sha256) { emit([doc.slug, doc.sha256.toLowerCase()], doc.version); } }`),
+		Language: "javascript",
+	}
+	_, _, err := db.CreateDoc(context.Background(), doc)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("Could not create the sha256 view: %s", err)
+	}
+	return nil
+}
+
+// StatsDateView is the view of the statistics databases, by date.
+const StatsDateView = "by-date"
+
+// CreateStatsDateView creates the view used to list the statistics of all the
+// applications of a space on a period of time.
+func CreateStatsDateView(db *kivik.DB) error {
+	doc := struct {
+		ID       string          `json:"_id"`
+		Views    json.RawMessage `json:"views"`
+		Language string          `json:"language"`
+	}{
+		ID:       "_design/" + StatsDateView,
+		Views:    base.SprintfJSON(`{%s: {"map": %s}}`, StatsDateView, `function (doc) { if (doc.date) { emit(doc.date); } }`),
+		Language: "javascript",
+	}
+	_, _, err := db.CreateDoc(context.Background(), doc)
+	if err != nil {
+		if kivik.StatusCode(err) == http.StatusConflict {
+			return nil
+		}
+		return fmt.Errorf("Could not create the statistics view: %s", err)
+	}
+	return nil
+}
@@ -16,7 +16,9 @@ import (
 const xattrMime = "user.mime_type"
 
 // NewFS returns a VirtualStorage where the files are persisted in the given
-// directory of the local file system.
+// directory of the local file system. It can be used instead of Swift for the
+// small deployments and the CI. The content types are kept in the extended
+// attributes of the files.
 func NewFS(baseDir string) base.VirtualStorage {
 	return &localFS{baseDir: baseDir}
 }
@@ -76,15 +78,31 @@ func (m *localFS) Create(prefix base.Prefix, name, contentType string, content i
 	if err := os.MkdirAll(parent, os.ModePerm); err != nil {
 		return err
 	}
-	f, err := os.Create(path)
+	// The content is written to a temporary file that is renamed once
+	// complete, so that a failed upload never leaves a truncated file.
+	f, err := ioutil.TempFile(parent, ".tmp-"+filepath.Base(path))
 	if err != nil {
 		return base.NewInternalError(err)
 	}
-	defer f.Close()
+	tmp := f.Name()
 	if _, err = io.Copy(f, content); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return base.NewInternalError(err)
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(tmp)
+		return base.NewInternalError(err)
+	}
+	if err = os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return base.NewInternalError(err)
+	}
+	_ = xattr.Set(tmp, xattrMime, []byte(contentType))
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
 		return base.NewInternalError(err)
 	}
-	_ = xattr.Set(path, xattrMime, []byte(contentType))
 	return nil
 }
 
@@ -109,6 +127,30 @@ func (m *localFS) Get(prefix base.Prefix, name string) (*bytes.Buffer, map[strin
 	return buf, headers, nil
 }
 
+func (m *localFS) Open(prefix base.Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	path, err := m.getPath(prefix, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, base.NewFileNotFoundError(err)
+		}
+		return nil, nil, base.NewInternalError(err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, base.NewInternalError(err)
+	}
+	headers := map[string]string{"Content-Length": fmt.Sprintf("%d", stat.Size())}
+	if mime, err := xattr.Get(path, xattrMime); err == nil {
+		headers["Content-Type"] = string(mime)
+	}
+	return f, headers, nil
+}
+
 func (m *localFS) Remove(prefix base.Prefix, name string) error {
 	path, err := m.getPath(prefix, name)
 	if err != nil {
@@ -126,17 +168,20 @@ func (m *localFS) Remove(prefix base.Prefix, name string) error {
 func (m *localFS) Walk(prefix base.Prefix, fn base.WalkFn) error {
 	dir := filepath.Join(m.baseDir, string(prefix))
 
-	return filepath.Walk(dir, func(path string, _ os.FileInfo, err error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return base.NewFileNotFoundError(err)
+			}
 			return err
 		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
 		name, err := filepath.Rel(dir, path)
 		if err != nil {
 			return err
 		}
-		if name == "." {
-			return nil
-		}
 		contentType := "application/octet-stream"
 		if mime, err := xattr.Get(path, xattrMime); err == nil {
 			contentType = string(mime)
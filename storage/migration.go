@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/cozy/cozy-apps-registry/base"
+)
+
+// AllPrefixes can be used in the list of prefixes of a migration to migrate
+// all of them.
+const AllPrefixes = "*"
+
+// NewMigration returns a storage to use while switching from a storage
+// backend to another. For the prefixes in migration, the files are written to
+// the new storage and read from the new storage, with a fallback on the old
+// one (read-through). The files are removed from both. The other prefixes
+// are only on the new storage.
+func NewMigration(newStorage, oldStorage base.VirtualStorage, prefixes []string) base.VirtualStorage {
+	inMigration := make(map[base.Prefix]bool, len(prefixes))
+	all := false
+	for _, p := range prefixes {
+		if p == AllPrefixes {
+			all = true
+		}
+		inMigration[base.Prefix(p)] = true
+	}
+	return &migration{
+		next:        newStorage,
+		previous:    oldStorage,
+		all:         all,
+		inMigration: inMigration,
+	}
+}
+
+type migration struct {
+	next        base.VirtualStorage
+	previous    base.VirtualStorage
+	all         bool
+	inMigration map[base.Prefix]bool
+}
+
+func (m *migration) migrating(prefix base.Prefix) bool {
+	return m.all || m.inMigration[prefix]
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, base.ErrFileNotFound)
+}
+
+func (m *migration) Status() error {
+	if err := m.next.Status(); err != nil {
+		return err
+	}
+	return m.previous.Status()
+}
+
+func (m *migration) EnsureExists(prefix base.Prefix) error {
+	return m.next.EnsureExists(prefix)
+}
+
+func (m *migration) EnsureEmpty(prefix base.Prefix) error {
+	if m.migrating(prefix) {
+		if err := m.previous.EnsureDeleted(prefix); err != nil {
+			return err
+		}
+	}
+	return m.next.EnsureEmpty(prefix)
+}
+
+func (m *migration) EnsureDeleted(prefix base.Prefix) error {
+	if m.migrating(prefix) {
+		if err := m.previous.EnsureDeleted(prefix); err != nil {
+			return err
+		}
+	}
+	return m.next.EnsureDeleted(prefix)
+}
+
+func (m *migration) Create(prefix base.Prefix, name, contentType string, content io.Reader) error {
+	return m.next.Create(prefix, name, contentType, content)
+}
+
+func (m *migration) Get(prefix base.Prefix, name string) (*bytes.Buffer, map[string]string, error) {
+	content, headers, err := m.next.Get(prefix, name)
+	if err != nil && isNotFound(err) && m.migrating(prefix) {
+		return m.previous.Get(prefix, name)
+	}
+	return content, headers, err
+}
+
+func (m *migration) Open(prefix base.Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	f, headers, err := base.OpenFile(m.next, prefix, name)
+	if err != nil && isNotFound(err) && m.migrating(prefix) {
+		return base.OpenFile(m.previous, prefix, name)
+	}
+	return f, headers, err
+}
+
+func (m *migration) Remove(prefix base.Prefix, name string) error {
+	err := m.next.Remove(prefix, name)
+	if !m.migrating(prefix) {
+		return err
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	errPrevious := m.previous.Remove(prefix, name)
+	if errPrevious != nil && !isNotFound(errPrevious) {
+		return errPrevious
+	}
+	if err != nil && errPrevious != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *migration) Walk(prefix base.Prefix, fn base.WalkFn) error {
+	seen := make(map[string]bool)
+	err := m.next.Walk(prefix, func(name, contentType string) error {
+		seen[name] = true
+		return fn(name, contentType)
+	})
+	if !m.migrating(prefix) {
+		return err
+	}
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	errPrevious := m.previous.Walk(prefix, func(name, contentType string) error {
+		if seen[name] {
+			return nil
+		}
+		return fn(name, contentType)
+	})
+	if errPrevious != nil && !isNotFound(errPrevious) {
+		return errPrevious
+	}
+	if err != nil && errPrevious != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *migration) FindByPrefix(prefix base.Prefix, namePrefix string) ([]string, error) {
+	names, err := m.next.FindByPrefix(prefix, namePrefix)
+	if !m.migrating(prefix) {
+		return names, err
+	}
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	previous, errPrevious := m.previous.FindByPrefix(prefix, namePrefix)
+	if errPrevious != nil && !isNotFound(errPrevious) {
+		return nil, errPrevious
+	}
+	for _, name := range previous {
+		if !stringInSlice(name, names) {
+			names = append(names, name)
+		}
+	}
+	if err != nil && errPrevious != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
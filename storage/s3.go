@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// DefaultS3PartSize is the size of the parts for the multipart uploads of the
+// large files (the tarballs).
+const DefaultS3PartSize = 16 * 1024 * 1024
+
+// NewS3 returns a VirtualStorage where the files are persisted in a S3
+// compatible object storage (AWS, MinIO, etc.). Each prefix has its own
+// bucket, named with the bucket prefix and the prefix.
+func NewS3(client *minio.Client, bucketPrefix, region string, partSize uint64) base.VirtualStorage {
+	if partSize == 0 {
+		partSize = DefaultS3PartSize
+	}
+	return &s3FS{
+		client:       client,
+		bucketPrefix: bucketPrefix,
+		region:       region,
+		partSize:     partSize,
+		buckets:      make(map[string]base.Prefix),
+	}
+}
+
+type s3FS struct {
+	client       *minio.Client
+	bucketPrefix string
+	region       string
+	partSize     uint64
+
+	// buckets are the prefixes by their bucket name, to detect the prefixes
+	// that would share a bucket.
+	bucketsMu sync.Mutex
+	buckets   map[string]base.Prefix
+}
+
+// bucket returns the name of the bucket for the given prefix. The bucket names
+// can't have underscores, so they are replaced by dashes, and the trailing
+// dashes are removed. The special prefixes like __default__ and __assets__ are
+// mapped to bucket names with a dot (sys.default), as the space names can't
+// have dots. Two spaces can still have the same bucket (my_apps and my-apps):
+// claimBucket refuses the second one.
+func (s *s3FS) bucket(prefix base.Prefix) string {
+	name := strings.ToLower(string(prefix))
+	if strings.HasPrefix(name, "__") {
+		name = "sys." + strings.Trim(name, "_")
+	}
+	name = strings.ReplaceAll(name, "_", "-")
+	return strings.TrimRight(s.bucketPrefix+"."+name, "-")
+}
+
+// claimBucket checks that the bucket of the prefix is a valid bucket name (at
+// most 63 characters, etc.), and that it is not used by another prefix.
+func (s *s3FS) claimBucket(prefix base.Prefix) (string, error) {
+	bucket := s.bucket(prefix)
+	if err := s3utils.CheckValidBucketNameStrict(bucket); err != nil {
+		return "", fmt.Errorf("Invalid bucket name %q for %s: %w", bucket, prefix, err)
+	}
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+	if other, ok := s.buckets[bucket]; ok && other != prefix {
+		return "", fmt.Errorf("The bucket %q of %s is already used by %s", bucket, prefix, other)
+	}
+	s.buckets[bucket] = prefix
+	return bucket, nil
+}
+
+func (s *s3FS) wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchBucket":
+		return base.NewFileNotFoundError(err)
+	case "EntityTooLarge":
+		return base.NewTooLargeError(err)
+	default:
+		return base.NewInternalError(err)
+	}
+}
+
+func (s *s3FS) Status() error {
+	_, err := s.client.ListBuckets(context.Background())
+	return err
+}
+
+func (s *s3FS) EnsureExists(prefix base.Prefix) error {
+	ctx := context.Background()
+	bucket, err := s.claimBucket(prefix)
+	if err != nil {
+		return err
+	}
+	exists, err := s.client.BucketExists(ctx, bucket)
+	if err != nil {
+		return s.wrapError(err)
+	}
+	if exists {
+		return nil
+	}
+	err = s.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: s.region})
+	if minio.ToErrorResponse(err).Code == "BucketAlreadyOwnedByYou" {
+		err = nil
+	}
+	return s.wrapError(err)
+}
+
+func (s *s3FS) EnsureEmpty(prefix base.Prefix) error {
+	if err := s.EnsureDeleted(prefix); err != nil {
+		return err
+	}
+	return s.EnsureExists(prefix)
+}
+
+func (s *s3FS) EnsureDeleted(prefix base.Prefix) error {
+	ctx := context.Background()
+	// The bucket of another prefix must not be emptied
+	bucket, err := s.claimBucket(prefix)
+	if err != nil {
+		return err
+	}
+	exists, err := s.client.BucketExists(ctx, bucket)
+	if err != nil {
+		return s.wrapError(err)
+	}
+	if !exists {
+		return nil
+	}
+
+	objects := s.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true})
+	for res := range s.client.RemoveObjects(ctx, bucket, objects, minio.RemoveObjectsOptions{}) {
+		if res.Err != nil {
+			return s.wrapError(res.Err)
+		}
+	}
+	return s.wrapError(s.client.RemoveBucket(ctx, bucket))
+}
+
+func (s *s3FS) Create(prefix base.Prefix, name, contentType string, content io.Reader) error {
+	// The size is unknown, so the client will use a multipart upload for the
+	// files larger than a part.
+	opts := minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    s.partSize,
+	}
+	_, err := s.client.PutObject(context.Background(), s.bucket(prefix), name, content, -1, opts)
+	return s.wrapError(err)
+}
+
+func (s *s3FS) Get(prefix base.Prefix, name string) (*bytes.Buffer, map[string]string, error) {
+	obj, headers, err := s.Open(prefix, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+	buf := new(bytes.Buffer)
+	if _, err = io.Copy(buf, obj); err != nil {
+		return nil, nil, s.wrapError(err)
+	}
+	return buf, headers, nil
+}
+
+func (s *s3FS) Open(prefix base.Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket(prefix), name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, nil, s.wrapError(err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, nil, s.wrapError(err)
+	}
+	headers := map[string]string{
+		"Content-Length": fmt.Sprintf("%d", info.Size),
+		"Content-Type":   info.ContentType,
+	}
+	if info.ETag != "" {
+		headers["Etag"] = info.ETag
+	}
+	return obj, headers, nil
+}
+
+func (s *s3FS) Remove(prefix base.Prefix, name string) error {
+	err := s.client.RemoveObject(context.Background(), s.bucket(prefix), name, minio.RemoveObjectOptions{})
+	// If the object is not found, it's OK.
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		err = nil
+	}
+	return s.wrapError(err)
+}
+
+func (s *s3FS) Walk(prefix base.Prefix, fn base.WalkFn) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bucket := s.bucket(prefix)
+	opts := minio.ListObjectsOptions{Recursive: true, WithMetadata: true}
+	for object := range s.client.ListObjects(ctx, bucket, opts) {
+		if object.Err != nil {
+			return s.wrapError(object.Err)
+		}
+		// The metadata are only listed by MinIO, so we need to ask them for
+		// each object on other providers.
+		contentType := object.ContentType
+		if contentType == "" {
+			info, err := s.client.StatObject(ctx, bucket, object.Key, minio.StatObjectOptions{})
+			if err != nil {
+				return s.wrapError(err)
+			}
+			contentType = info.ContentType
+		}
+		if err := fn(object.Key, contentType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3FS) FindByPrefix(prefix base.Prefix, namePrefix string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := minio.ListObjectsOptions{Prefix: namePrefix, Recursive: true}
+	var names []string
+	for object := range s.client.ListObjects(ctx, s.bucket(prefix), opts) {
+		if object.Err != nil {
+			return nil, s.wrapError(object.Err)
+		}
+		names = append(names, object.Key)
+	}
+	return names, nil
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -38,11 +39,92 @@ func TestLocal(t *testing.T) {
 	testStorage(t, local)
 }
 
+func TestLocalWalk(t *testing.T) {
+	tmp, err := ioutil.TempDir(os.TempDir(), "local")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmp)
+	local := NewFS(tmp)
+	prefix := base.Prefix("walk-prefix")
+
+	err = local.Walk(prefix, func(_, _ string) error { return nil })
+	assert.True(t, errors.Is(err, base.ErrFileNotFound))
+
+	assert.NoError(t, local.EnsureExists(prefix))
+	content := strings.NewReader("some bytes")
+	assert.NoError(t, local.Create(prefix, "app/1.0.0/app.tar.gz", "application/gzip", content))
+
+	var names []string
+	err = local.Walk(prefix, func(name, _ string) error {
+		names = append(names, name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app/1.0.0/app.tar.gz"}, names)
+}
+
+func TestS3BucketNames(t *testing.T) {
+	s3 := NewS3(nil, "cozy-registry", "", 0).(*s3FS)
+	assert.Equal(t, "cozy-registry.sys.default", s3.bucket(base.DefaultSpacePrefix))
+	assert.Equal(t, "cozy-registry.sys.assets", s3.bucket(base.Prefix("__assets__")))
+	assert.Equal(t, "cozy-registry.my-space", s3.bucket(base.Prefix("my_space")))
+	assert.Equal(t, "cozy-registry.default", s3.bucket(base.Prefix("default")))
+
+	// Two spaces can't share a bucket
+	bucket, err := s3.claimBucket("my_apps")
+	assert.NoError(t, err)
+	assert.Equal(t, "cozy-registry.my-apps", bucket)
+	_, err = s3.claimBucket("my_apps")
+	assert.NoError(t, err)
+	_, err = s3.claimBucket("my-apps")
+	assert.Error(t, err)
+
+	// The bucket names must be valid, with at most 63 characters
+	_, err = s3.claimBucket("my-apps-")
+	assert.Error(t, err)
+	_, err = s3.claimBucket(base.Prefix(strings.Repeat("a", 49)))
+	assert.NoError(t, err)
+	_, err = s3.claimBucket(base.Prefix(strings.Repeat("b", 50)))
+	assert.Error(t, err)
+}
+
 func TestMem(t *testing.T) {
 	mem := NewMemFS()
 	testStorage(t, mem)
 }
 
+func TestMigration(t *testing.T) {
+	migration := NewMigration(NewMemFS(), NewMemFS(), []string{AllPrefixes})
+	testStorage(t, migration)
+}
+
+func TestMigrationReadThrough(t *testing.T) {
+	prefix := base.Prefix("migrated")
+	next := NewMemFS()
+	previous := NewMemFS()
+	assert.NoError(t, previous.EnsureExists(prefix))
+	content := strings.NewReader("old bytes")
+	assert.NoError(t, previous.Create(prefix, "old-file", "text/plain", content))
+
+	migration := NewMigration(next, previous, []string{prefix.String()})
+	assert.NoError(t, migration.EnsureExists(prefix))
+	content = strings.NewReader("new bytes")
+	assert.NoError(t, migration.Create(prefix, "new-file", "text/plain", content))
+
+	_, _, err := previous.Get(prefix, "new-file")
+	assert.Error(t, err)
+	buf, _, err := migration.Get(prefix, "old-file")
+	assert.NoError(t, err)
+	assert.Equal(t, "old bytes", buf.String())
+
+	names, err := migration.FindByPrefix(prefix, "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"new-file", "old-file"}, names)
+
+	assert.NoError(t, migration.Remove(prefix, "old-file"))
+	_, _, err = previous.Get(prefix, "old-file")
+	assert.Error(t, err)
+}
+
 func testStorage(t *testing.T, storage base.VirtualStorage) {
 	fooPrefix := base.Prefix("foo-prefix")
 	barPrefix := base.Prefix("bar-prefix")
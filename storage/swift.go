@@ -1,7 +1,7 @@
 // Package storage can be used to persist files in a storage. It is Open-Stack
-// Swift in production, but having a Swift server in local for development can
-// be difficult, so this package can also used a local file system for the
-// storage.
+// Swift or a S3 compatible object storage in production, but having such a
+// server in local for development can be difficult, so this package can also
+// used a local file system for the storage.
 package storage
 
 import (
@@ -86,6 +86,14 @@ func (s *swiftFS) Get(prefix base.Prefix, name string) (*bytes.Buffer, map[strin
 	return buf, headers, nil
 }
 
+func (s *swiftFS) Open(prefix base.Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	f, headers, err := s.conn.ObjectOpen(string(prefix), name, false, nil)
+	if err != nil {
+		return nil, nil, s.wrapError(err)
+	}
+	return f, headers, nil
+}
+
 func (s *swiftFS) Remove(prefix base.Prefix, name string) error {
 	err := s.conn.ObjectDelete(string(prefix), name)
 	// If the object is not found, it's OK.
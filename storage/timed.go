@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/slowlog"
+)
+
+// timed is a wrapper around a storage that records the duration of the
+// operations in the slow log.
+type timed struct {
+	base.VirtualStorage
+}
+
+// NewTimed returns a storage that records the duration of the operations of
+// the given storage in the slow log.
+func NewTimed(s base.VirtualStorage) base.VirtualStorage {
+	return &timed{s}
+}
+
+func (t *timed) Create(prefix base.Prefix, name, contentType string, content io.Reader) error {
+	defer slowlog.Start(slowlog.Storage, "create", prefix.String(), name)()
+	return t.VirtualStorage.Create(prefix, name, contentType, content)
+}
+
+func (t *timed) Get(prefix base.Prefix, name string) (*bytes.Buffer, map[string]string, error) {
+	defer slowlog.Start(slowlog.Storage, "get", prefix.String(), name)()
+	return t.VirtualStorage.Get(prefix, name)
+}
+
+func (t *timed) Open(prefix base.Prefix, name string) (io.ReadCloser, map[string]string, error) {
+	defer slowlog.Start(slowlog.Storage, "open", prefix.String(), name)()
+	return base.OpenFile(t.VirtualStorage, prefix, name)
+}
+
+func (t *timed) Remove(prefix base.Prefix, name string) error {
+	defer slowlog.Start(slowlog.Storage, "remove", prefix.String(), name)()
+	return t.VirtualStorage.Remove(prefix, name)
+}
+
+func (t *timed) FindByPrefix(prefix base.Prefix, namePrefix string) ([]string, error) {
+	defer slowlog.Start(slowlog.Storage, "find_by_prefix", prefix.String(), namePrefix)()
+	return t.VirtualStorage.FindByPrefix(prefix, namePrefix)
+}
@@ -0,0 +1,613 @@
+package web
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/cache"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/manifest"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/slowlog"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/cozy/cozy-apps-registry/webhooks"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// adminEndpoint middleware checks that the request has been made with an admin
+// token. The read-audit role tokens are accepted for the read-only requests.
+func adminEndpoint(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead:
+			if checkRole(c, auth.RoleReadAudit) {
+				return next(c)
+			}
+		}
+		if err := checkAdmin(c); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
+
+func getSlowQueries(c echo.Context) error {
+	return writeJSON(c, slowlog.GetReport())
+}
+
+// getSlowQueriesMetrics returns the counts of the slow queries in the text
+// format of Prometheus.
+func getSlowQueriesMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return slowlog.WriteMetrics(c.Response())
+}
+
+func getWebhooksDeadLetters(c echo.Context) error {
+	return writeJSON(c, webhooks.GetDeadLetters())
+}
+
+func getCacheFailovers(c echo.Context) error {
+	return writeJSON(c, cache.FailoverStates())
+}
+
+func getDownloads(c echo.Context) error {
+	return writeJSON(c, registry.GetDownloads())
+}
+
+func getIndexes(c echo.Context) error {
+	spaces := make(map[string][]space.IndexStatus)
+	for _, name := range space.GetSpacesNames() {
+		s, _ := space.GetSpace(name)
+		status, err := s.IndexesStatus()
+		if err != nil {
+			return errshttp.NewError(http.StatusInternalServerError,
+				"Cannot list the indexes of space %q: %s", name, err)
+		}
+		spaces[name] = status
+	}
+	return writeJSON(c, echo.Map{
+		"spaces":   spaces,
+		"warnings": space.MissingIndexWarnings(),
+	})
+}
+
+func getAdminVirtualSpace(c echo.Context) (base.VirtualSpace, error) {
+	name := c.Param("name")
+	virtual, ok := base.Config.VirtualSpaces[name]
+	if !ok {
+		return virtual, errshttp.NewError(http.StatusNotFound,
+			"Virtual space %q not found", name)
+	}
+	return virtual, nil
+}
+
+func getOverriddenVersions(c echo.Context) error {
+	virtual, err := getAdminVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	list, err := registry.ListOverriddenVersions(virtual)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, list)
+}
+
+func getOverriddenVersion(c echo.Context) error {
+	virtual, err := getAdminVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	details, err := registry.FindOverriddenVersion(virtual, c.Param("slug"), c.Param("version"))
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, details)
+}
+
+func getRuntimeReport(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	appType := c.QueryParam("type")
+	if appType != "" && appType != "webapp" && appType != "konnector" {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Invalid type %q", appType)
+	}
+	report, err := registry.GetRuntimeReport(s, appType)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, report)
+}
+
+func getAdminSpace(c echo.Context) (*space.Space, error) {
+	name := c.Param("space")
+	if name == base.DefaultSpacePrefix.String() {
+		name = ""
+	}
+	s, ok := space.GetSpace(name)
+	if !ok {
+		return nil, errshttp.NewError(http.StatusNotFound,
+			"Space %q not found", c.Param("space"))
+	}
+	return s, nil
+}
+
+func checkVersionsConsistency(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	drifts, err := registry.CheckAppVersions(s, false)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, drifts)
+}
+
+func repairVersionsConsistency(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	drifts, err := registry.CheckAppVersions(s, true)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, drifts)
+}
+
+// getCleanReport tells which versions and storage objects would be removed
+// by the cleaning of the old versions of a space, with its conservation
+// parameters. Nothing is removed.
+func getCleanReport(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	params := base.Config.GetCleanParameters(s.GetPrefix())
+	report, err := registry.CleanSpace(s, params, registry.DryRun)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, report)
+}
+
+func getAdminSpaceName(c echo.Context) (string, error) {
+	name := c.Param("space")
+	if name == base.DefaultSpacePrefix.String() {
+		name = ""
+	}
+	if _, ok := space.GetSpace(name); ok {
+		return name, nil
+	}
+	if _, ok := base.Config.VirtualSpaces[name]; ok {
+		return name, nil
+	}
+	return "", errshttp.NewError(http.StatusNotFound,
+		"Space %q not found", c.Param("space"))
+}
+
+func getRobotsPolicies(c echo.Context) error {
+	return writeJSON(c, registry.ListRobotsPolicies())
+}
+
+func setRobotsPolicy(c echo.Context) error {
+	name, err := getAdminSpaceName(c)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Index *bool `json:"index"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if body.Index == nil {
+		return errshttp.NewError(http.StatusBadRequest, "Missing index field")
+	}
+	policy, err := registry.SetRobotsPolicy(name, *body.Index)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+func resetRobotsPolicy(c echo.Context) error {
+	name, err := getAdminSpaceName(c)
+	if err != nil {
+		return err
+	}
+	policy, err := registry.ResetRobotsPolicy(name)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+func getIncidentFlags(c echo.Context) error {
+	flags, err := registry.GetIncidentFlags()
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, flags)
+}
+
+func setIncidentFlags(c echo.Context) error {
+	var flags registry.IncidentFlags
+	if err := c.Bind(&flags); err != nil {
+		return err
+	}
+	flags, err := registry.SetIncidentFlags(flags)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, flags)
+}
+
+func clearIncidentFlags(c echo.Context) error {
+	flags, err := registry.ClearIncidentFlags()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, flags)
+}
+
+func getSpaceFlags(c echo.Context) error {
+	name, err := getAdminSpaceName(c)
+	if err != nil {
+		return err
+	}
+	flags, err := registry.GetSpaceFlags(name)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, flags)
+}
+
+// bindFlags reads the flags in the body of a PUT request. They are removed
+// with a DELETE request.
+func bindFlags(c echo.Context) (registry.Flags, error) {
+	if c.Request().Method != http.MethodPut {
+		return nil, nil
+	}
+	var flags registry.Flags
+	if err := c.Bind(&flags); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// setSpaceFlags replaces (PUT) or removes (DELETE) the flags of a space or
+// virtual space.
+func setSpaceFlags(c echo.Context) error {
+	name, err := getAdminSpaceName(c)
+	if err != nil {
+		return err
+	}
+	flags, err := bindFlags(c)
+	if err != nil {
+		return err
+	}
+	res, err := registry.SetSpaceFlags(name, flags)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// setAppFlags replaces (PUT) or removes (DELETE) the flags of an
+// application.
+func setAppFlags(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	flags, err := bindFlags(c)
+	if err != nil {
+		return err
+	}
+	app, err := registry.SetAppFlags(s, c.Param("app"), flags)
+	if err != nil {
+		return err
+	}
+	if app.Flags == nil {
+		app.Flags = registry.Flags{}
+	}
+	return c.JSON(http.StatusOK, echo.Map{"slug": app.Slug, "flags": app.Flags})
+}
+
+// setLegalHold sets (PUT) or removes (DELETE) the legal hold of an
+// application, or of a version if the version is in the URL.
+func setLegalHold(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+
+	var hold *registry.LegalHold
+	if c.Request().Method == http.MethodPut {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		if body.Reason == "" {
+			return errshttp.NewError(http.StatusBadRequest, "Missing reason field")
+		}
+		hold = &registry.LegalHold{
+			Reason: body.Reason,
+			By:     adminEditor,
+			At:     time.Now().UTC(),
+		}
+	}
+
+	appSlug := c.Param("app")
+	version := c.Param("version")
+	if version == "" {
+		app, err := registry.SetAppLegalHold(s, appSlug, hold)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, echo.Map{"slug": app.Slug, "legal_hold": app.LegalHold})
+	}
+
+	ver, err := registry.FindVersion(s, appSlug, stripVersion(version))
+	if err != nil {
+		return err
+	}
+	if err = ver.SetLegalHold(s, hold); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"slug":       ver.Slug,
+		"version":    ver.Version,
+		"legal_hold": ver.LegalHold,
+	})
+}
+
+// getModeration returns the moderation state and the advisories of an
+// application.
+func getModeration(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	app, err := registry.FindApp(nil, s, c.Param("app"), registry.Stable)
+	if err != nil {
+		return err
+	}
+	moderation := app.Moderation
+	if moderation == nil {
+		moderation = &registry.Moderation{}
+	}
+	advisories := app.Advisories
+	if advisories == nil {
+		advisories = []*registry.Advisory{}
+	}
+	return writeJSON(c, echo.Map{
+		"slug":       app.Slug,
+		"moderation": moderation,
+		"advisories": advisories,
+	})
+}
+
+// setModeration sets (PUT) or lifts (DELETE) a moderation action (flag,
+// unlist or takedown) on an application.
+func setModeration(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+
+	var action *registry.ModerationAction
+	if c.Request().Method == http.MethodPut {
+		var body struct {
+			Reason    string `json:"reason"`
+			Reference string `json:"reference"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return err
+		}
+		if body.Reason == "" {
+			return errshttp.NewError(http.StatusBadRequest, "Missing reason field")
+		}
+		action = &registry.ModerationAction{
+			Reason:    body.Reason,
+			Reference: body.Reference,
+			By:        adminEditor,
+			At:        time.Now().UTC(),
+		}
+	}
+
+	app, err := registry.SetAppModeration(s, c.Param("app"), c.Param("action"), action, adminEditor)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"slug": app.Slug, "moderation": app.Moderation})
+}
+
+// publishAdvisory publishes an advisory on an application, or updates the
+// advisory with the same id.
+func publishAdvisory(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	var advisory registry.Advisory
+	if err := c.Bind(&advisory); err != nil {
+		return err
+	}
+	app, err := registry.PublishAdvisory(s, c.Param("app"), &advisory, adminEditor)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{"slug": app.Slug, "advisories": app.Advisories})
+}
+
+// getPendingReviews lists the versions of a space that wait for a review.
+func getPendingReviews(c echo.Context) error {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return err
+	}
+	versions, err := registry.GetPendingReviews(s)
+	if err != nil {
+		return err
+	}
+	for _, ver := range versions {
+		cleanVersion(ver)
+	}
+	return writeJSON(c, versions)
+}
+
+// getReviewedVersion returns a version that waits for a review, with the
+// changes of its manifest since the latest stable version, if any.
+func getReviewedVersion(c echo.Context) error {
+	s, _, pending, err := getPendingReview(c)
+	if err != nil {
+		return err
+	}
+	var diff *manifest.Diff
+	var latestVersion string
+	latest, err := registry.FindLatestVersion(s, pending.Slug, registry.Stable)
+	if err == nil {
+		latestVersion = latest.Version
+		if diff, err = manifest.Compare(latest.Manifest, pending.Manifest); err != nil {
+			return errshttp.NewError(http.StatusInternalServerError, "Cannot compare the manifests: %s", err)
+		}
+	} else if err != registry.ErrVersionNotFound {
+		return err
+	}
+	cleanVersion(pending)
+	return writeJSON(c, echo.Map{
+		"version":        pending,
+		"latest_version": latestVersion,
+		"diff":           diff,
+	})
+}
+
+// approveReviewedVersion releases a version that was waiting for a review. A
+// comment can be given in the body.
+func approveReviewedVersion(c echo.Context) error {
+	s, app, pending, err := getPendingReview(c)
+	if err != nil {
+		return err
+	}
+	decision, err := bindReviewDecision(c)
+	if err != nil {
+		return err
+	}
+	ver, err := registry.ApproveReview(s, pending, app, decision)
+	if err != nil {
+		return err
+	}
+	cleanVersion(ver)
+	return c.JSON(http.StatusOK, echo.Map{"version": ver, "decision": decision})
+}
+
+// rejectReviewedVersion removes a version that was waiting for a review. The
+// comment in the body is mandatory, and is sent to the webhooks.
+func rejectReviewedVersion(c echo.Context) error {
+	s, _, pending, err := getPendingReview(c)
+	if err != nil {
+		return err
+	}
+	decision, err := bindReviewDecision(c)
+	if err != nil {
+		return err
+	}
+	if err := registry.RejectReview(s, pending, decision); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"slug":     pending.Slug,
+		"version":  pending.Version,
+		"decision": decision,
+	})
+}
+
+// getPendingReview returns the version of the URL, if it waits for a review.
+func getPendingReview(c echo.Context) (*space.Space, *registry.App, *registry.Version, error) {
+	s, err := getAdminSpace(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	app, err := registry.FindApp(nil, s, c.Param("app"), registry.Stable)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pending, err := registry.FindPendingVersion(s, app.Slug, stripVersion(c.Param("version")))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if pending.PendingReview == nil {
+		return nil, nil, nil, errshttp.NewError(http.StatusConflict,
+			"Version %s is not waiting for a review", pending.Version)
+	}
+	return s, app, pending, nil
+}
+
+func bindReviewDecision(c echo.Context) (*registry.ReviewDecision, error) {
+	var body struct {
+		Comment string `json:"comment"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return nil, err
+	}
+	return &registry.ReviewDecision{
+		Comment: body.Comment,
+		By:      adminEditor,
+		At:      time.Now().UTC(),
+	}, nil
+}
+
+// AdminRoutes sets the routing for the administration endpoints.
+func AdminRoutes(router *echo.Group) {
+	router.GET("/slow-queries", getSlowQueries, jsonEndpoint, middleware.Gzip())
+	router.GET("/slow-queries/metrics", getSlowQueriesMetrics)
+	router.GET("/spaces", getAdminSpaces, jsonEndpoint, middleware.Gzip())
+	router.POST("/spaces", createAdminSpace, jsonEndpoint)
+	router.DELETE("/spaces/:space", archiveAdminSpace)
+	router.GET("/indexes", getIndexes, jsonEndpoint, middleware.Gzip())
+	router.GET("/webhooks/dead-letters", getWebhooksDeadLetters, jsonEndpoint, middleware.Gzip())
+	router.GET("/runtimes/:space", getRuntimeReport, jsonEndpoint, middleware.Gzip())
+	router.GET("/consistency/:space", checkVersionsConsistency, jsonEndpoint, middleware.Gzip())
+	router.POST("/consistency/:space/repair", repairVersionsConsistency, jsonEndpoint)
+	router.GET("/clean/:space", getCleanReport, jsonEndpoint, middleware.Gzip())
+	router.GET("/sandboxes", getAdminSandboxes, jsonEndpoint, middleware.Gzip())
+	router.GET("/downloads", getDownloads, jsonEndpoint, middleware.Gzip())
+	router.GET("/cache", getCacheFailovers, jsonEndpoint)
+	router.GET("/robots", getRobotsPolicies, jsonEndpoint, middleware.Gzip())
+	router.PUT("/robots/:space", setRobotsPolicy, jsonEndpoint)
+	router.DELETE("/robots/:space", resetRobotsPolicy, jsonEndpoint)
+	router.GET("/incidents", getIncidentFlags, jsonEndpoint)
+	router.PUT("/incidents", setIncidentFlags, jsonEndpoint)
+	router.DELETE("/incidents", clearIncidentFlags, jsonEndpoint)
+	router.GET("/flags/:space", getSpaceFlags, jsonEndpoint)
+	router.PUT("/flags/:space", setSpaceFlags, jsonEndpoint)
+	router.DELETE("/flags/:space", setSpaceFlags, jsonEndpoint)
+	router.PUT("/flags/:space/:app", setAppFlags, jsonEndpoint)
+	router.DELETE("/flags/:space/:app", setAppFlags, jsonEndpoint)
+	router.PUT("/legal-holds/:space/:app", setLegalHold, jsonEndpoint)
+	router.DELETE("/legal-holds/:space/:app", setLegalHold, jsonEndpoint)
+	router.PUT("/legal-holds/:space/:app/:version", setLegalHold, jsonEndpoint)
+	router.DELETE("/legal-holds/:space/:app/:version", setLegalHold, jsonEndpoint)
+	router.GET("/moderation/:space/:app", getModeration, jsonEndpoint)
+	router.PUT("/moderation/:space/:app/:action", setModeration, jsonEndpoint)
+	router.DELETE("/moderation/:space/:app/:action", setModeration, jsonEndpoint)
+	router.POST("/moderation/:space/:app/advisories", publishAdvisory, jsonEndpoint)
+	router.GET("/reviews/:space", getPendingReviews, jsonEndpoint, middleware.Gzip())
+	router.GET("/reviews/:space/:app/:version", getReviewedVersion, jsonEndpoint, middleware.Gzip())
+	router.PUT("/reviews/:space/:app/:version/approval", approveReviewedVersion)
+	router.PUT("/reviews/:space/:app/:version/rejection", rejectReviewedVersion, jsonEndpoint)
+	router.GET("/virtual/:name/overridden", getOverriddenVersions, jsonEndpoint, middleware.Gzip())
+	router.GET("/virtual/:name/overridden/:slug/:version", getOverriddenVersion, jsonEndpoint, middleware.Gzip())
+}
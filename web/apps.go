@@ -1,13 +1,17 @@
 package web
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/errshttp"
 	"github.com/cozy/cozy-apps-registry/registry"
@@ -35,6 +39,9 @@ func createApp(c echo.Context) (err error) {
 	if err = validateAppRequest(c, opts); err != nil {
 		return err
 	}
+	if err = checkSandbox(c, opts.Editor, true); err != nil {
+		return err
+	}
 
 	app, err := registry.CreateApp(getSpace(c), opts, editor)
 	if err != nil {
@@ -43,7 +50,9 @@ func createApp(c echo.Context) (err error) {
 
 	cleanApp(app)
 
-	return c.JSON(http.StatusCreated, app)
+	res := newAppWithLinks(c, app)
+	c.Response().Header().Set(echo.HeaderLocation, res.Links.Self)
+	return c.JSON(http.StatusCreated, res)
 }
 
 func patchApp(c echo.Context) (err error) {
@@ -88,13 +97,92 @@ func getApp(c echo.Context) error {
 		return err
 	}
 
-	if cacheControl(c, app.Rev, fiveMinute) {
+	applyFlags(c, app)
+	if cacheControl(c, app.Rev+flagsDigest(app.Flags), fiveMinute) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
 	cleanApp(app)
+	if err = compatAppManifest(c, app); err != nil {
+		return err
+	}
+
+	return writeJSON(c, newAppWithLinks(c, app))
+}
+
+func deleteApp(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	s := getSpace(c)
+	appSlug := c.Param("app")
+	app, err := registry.FindApp(nil, s, appSlug, registry.Dev)
+	if err != nil {
+		return err
+	}
+
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	if err = registry.RemoveAppFromSpace(s, app.Slug); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// purgeAppCache removes the versions of an application from the caches, when
+// they look stale. It is reserved to the admins.
+func purgeAppCache(c echo.Context) error {
+	if err := checkAdmin(c); err != nil {
+		return err
+	}
 
-	return writeJSON(c, app)
+	virtualSpace, s, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	appSlug := c.Param("app")
+	if virtualSpace != nil {
+		err = registry.PurgeVirtualAppCaches(virtualSpace, appSlug)
+	} else {
+		err = registry.PurgeAppCaches(s, appSlug)
+	}
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// putAppExternalSource makes an application external: its versions are
+// fetched from another registry. It is reserved to the admins.
+func putAppExternalSource(c echo.Context) error {
+	if err := checkAdmin(c); err != nil {
+		return err
+	}
+	var source registry.ExternalSource
+	if err := c.Bind(&source); err != nil {
+		return err
+	}
+	app, err := registry.SetAppExternalSource(getSpace(c), c.Param("app"), &source)
+	if err != nil {
+		return err
+	}
+	cleanApp(app)
+	return c.JSON(http.StatusOK, app)
+}
+
+// deleteAppExternalSource makes an external application a normal one again.
+// It is reserved to the admins.
+func deleteAppExternalSource(c echo.Context) error {
+	if err := checkAdmin(c); err != nil {
+		return err
+	}
+	if _, err := registry.SetAppExternalSource(getSpace(c), c.Param("app"), nil); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
 }
 
 func getAppIcon(c echo.Context) error {
@@ -118,7 +206,17 @@ func getAppScreenshot(c echo.Context) error {
 
 func getAppAttachment(c echo.Context, filename string) error {
 	appSlug := c.Param("app")
-	channel := c.Param("channel")
+
+	// Without a channel, the attachment is looked up from the stable channel
+	// to the less stable ones. With a channel, only this channel is used.
+	channels := registry.Channels
+	if channel := c.Param("channel"); channel != "" {
+		ch, err := registry.StrToChannel(channel)
+		if err != nil {
+			return err
+		}
+		channels = []registry.Channel{ch}
+	}
 
 	virtual, _, err := getVirtualSpace(c)
 	if err != nil {
@@ -126,37 +224,13 @@ func getAppAttachment(c echo.Context, filename string) error {
 	}
 
 	var att *registry.Attachment
-	attFound := false
 	if virtual != nil {
-		if att, attFound, err = registry.FindAttachmentFromOverwrite(virtual, appSlug, filename); err != nil {
-			return err
-		}
+		att, err = registry.FindVirtualAppAttachment(virtual, getSpace(c), appSlug, filename, channels)
+	} else {
+		att, err = registry.FindAppAttachmentInChannels(getSpace(c), appSlug, filename, channels)
 	}
-	if !attFound {
-		if channel == "" {
-			var err error
-			for _, ch := range registry.Channels {
-				att, err = registry.FindAppAttachment(getSpace(c), appSlug, filename, ch)
-				if err == nil {
-					break
-				}
-				if err != registry.ErrVersionNotFound {
-					return err
-				}
-			}
-			if att == nil {
-				return echo.NewHTTPError(http.StatusNotFound)
-			}
-		} else {
-			ch, err := registry.StrToChannel(channel)
-			if err != nil {
-				ch = registry.Stable
-			}
-			att, err = registry.FindAppAttachment(getSpace(c), appSlug, filename, ch)
-			if err != nil {
-				return err
-			}
-		}
+	if err != nil {
+		return err
 	}
 
 	return sendAttachment(c, att, filename)
@@ -170,6 +244,36 @@ func getMaintenanceApps(c echo.Context) error {
 	return writeJSON(c, apps)
 }
 
+// getKonnectorsMaintenance returns the maintenance status of several
+// konnectors in one request, for the stack that displays the maintenance
+// banners.
+func getKonnectorsMaintenance(c echo.Context) error {
+	var slugs []string
+	for _, slug := range strings.Split(c.QueryParam("slugs"), ",") {
+		if slug = strings.TrimSpace(slug); slug != "" {
+			slugs = append(slugs, slug)
+		}
+	}
+	if len(slugs) == 0 {
+		return errshttp.NewError(http.StatusBadRequest, "Missing slugs parameter")
+	}
+	if len(slugs) > registry.MaxMaintenanceSlugs {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Too many slugs, the maximum is %d", registry.MaxMaintenanceSlugs)
+	}
+
+	vs, s, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	statuses, err := registry.GetKonnectorsMaintenance(vs, s, slugs)
+	if err != nil {
+		return err
+	}
+	cacheControl(c, "", time.Minute)
+	return writeJSON(c, statuses)
+}
+
 func getVirtualSpace(c echo.Context) (*base.VirtualSpace, *space.Space, error) {
 	var s *space.Space
 	var virtualSpace *base.VirtualSpace = nil
@@ -193,6 +297,25 @@ func getVirtualSpace(c echo.Context) (*base.VirtualSpace, *space.Space, error) {
 }
 
 func activateMaintenanceApp(c echo.Context) error {
+	return changeMaintenanceApp(c, true, true /* = master */)
+}
+
+func deactivateMaintenanceApp(c echo.Context) error {
+	return changeMaintenanceApp(c, false, true /* = master */)
+}
+
+// putMaintenanceApp and deleteMaintenanceApp are the same as
+// activateMaintenanceApp and deactivateMaintenanceApp, but the token of the
+// editor of the app can also be used.
+func putMaintenanceApp(c echo.Context) error {
+	return changeMaintenanceApp(c, true, false /* = not master */)
+}
+
+func deleteMaintenanceApp(c echo.Context) error {
+	return changeMaintenanceApp(c, false, false /* = not master */)
+}
+
+func changeMaintenanceApp(c echo.Context, activate, master bool) error {
 	if err := checkAuthorized(c); err != nil {
 		return err
 	}
@@ -208,20 +331,27 @@ func activateMaintenanceApp(c echo.Context) error {
 		return err
 	}
 
-	_, err = checkPermissions(c, app.Editor, app.Slug, true /* = master */)
+	_, err = checkPermissionsOrRole(c, app.Editor, app.Slug, master, auth.RoleMaintenance)
 	if err != nil {
 		return errshttp.NewError(http.StatusUnauthorized, err.Error())
 	}
 
-	var opts registry.MaintenanceOptions
-	if err := c.Bind(&opts); err != nil {
-		return err
-	}
-
-	if vs != nil {
-		err = registry.ActivateMaintenanceVirtualSpace(vs.Name, appSlug, opts)
+	if activate {
+		var opts registry.MaintenanceOptions
+		if err := c.Bind(&opts); err != nil {
+			return err
+		}
+		if vs != nil {
+			err = registry.ActivateMaintenanceVirtualSpace(vs.Name, appSlug, opts)
+		} else {
+			err = registry.ActivateMaintenanceApp(s, appSlug, opts)
+		}
 	} else {
-		err = registry.ActivateMaintenanceApp(s, appSlug, opts)
+		if vs != nil {
+			err = registry.DeactivateMaintenanceVirtualSpace(vs.Name, appSlug)
+		} else {
+			err = registry.DeactivateMaintenanceApp(s, appSlug)
+		}
 	}
 	if err != nil {
 		return err
@@ -230,45 +360,93 @@ func activateMaintenanceApp(c echo.Context) error {
 	return c.JSON(http.StatusOK, echo.Map{"ok": true})
 }
 
-func deactivateMaintenanceApp(c echo.Context) (err error) {
-	if err = checkAuthorized(c); err != nil {
-		return
+// applyFlags replaces the flags of the applications by their effective flags:
+// the flags of the space, then of the virtual space, and then of the
+// application.
+func applyFlags(c echo.Context, apps ...*registry.App) {
+	names := []string{getSpace(c).Name}
+	if name, ok := c.Get("virtual_name").(string); ok && name != "" {
+		names = append(names, name)
 	}
-
-	vs, s, err := getVirtualSpace(c)
-	if err != nil {
-		return err
+	for _, app := range apps {
+		app.Flags = registry.EffectiveFlags(app, names...)
 	}
+}
 
-	appSlug := c.Param("app")
-	app, err := registry.FindApp(vs, s, appSlug, registry.Stable)
+// flagsDigest returns a suffix for the ETags of the responses with the given
+// flags, or an empty string if there are no flags.
+func flagsDigest(flags registry.Flags) string {
+	if len(flags) == 0 {
+		return ""
+	}
+	// The keys of a map are sorted by json.Marshal
+	b, err := json.Marshal(flags)
 	if err != nil {
-		return
+		return ""
 	}
+	return fmt.Sprintf("-f%x", sha256.Sum256(b))[:18]
+}
 
-	_, err = checkPermissions(c, app.Editor, app.Slug, true /* = master */)
-	if err != nil {
-		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+// appsListValidators returns a weak ETag for a page of the list of the
+// applications, computed from the revisions of the applications and of their
+// latest versions, and the date of the most recent application or version.
+func appsListValidators(c echo.Context, nextCursor string, apps []*registry.App) (string, time.Time) {
+	var lastModified time.Time
+	h := sha256.New()
+	separator, _ := c.Get(csvSeparatorKey).(rune)
+	fmt.Fprintf(h, "%d:%q:%s\n", getManifestRevision(c), separator, nextCursor)
+	for _, app := range apps {
+		fmt.Fprintf(h, "%s:%s", app.ID, app.Rev)
+		if app.CreatedAt.After(lastModified) {
+			lastModified = app.CreatedAt
+		}
+		if v := app.LatestVersion; v != nil {
+			fmt.Fprintf(h, ":%s:%s:%s", v.ID, v.Rev, v.Version)
+			if v.CreatedAt.After(lastModified) {
+				lastModified = v.CreatedAt
+			}
+		}
+		if v := app.Versions; v != nil {
+			fmt.Fprintf(h, ":%s|%s|%s", strings.Join(v.Stable, ","),
+				strings.Join(v.Beta, ","), strings.Join(v.Dev, ","))
+		}
+		fmt.Fprint(h, flagsDigest(app.Flags))
+		fmt.Fprintln(h)
 	}
+	return fmt.Sprintf(`W/"%x"`, h.Sum(nil)[:16]), lastModified
+}
 
-	if vs != nil {
-		err = registry.DeactivateMaintenanceVirtualSpace(vs.Name, appSlug)
-	} else {
-		err = registry.DeactivateMaintenanceApp(s, appSlug)
+// restrictFilter adds the select and reject lists of a virtual space to the
+// filter of the list of the applications: the applications selected by the
+// request must also be selected by the virtual space, and the applications
+// rejected by both are rejected.
+func restrictFilter(filter map[string]string, v *base.VirtualSpace) {
+	if selected := v.SelectedSlugs(); len(selected) > 0 {
+		if asked, ok := filter["select"]; ok {
+			both := []string{}
+			for _, slug := range strings.Split(asked, ",") {
+				if slug = strings.TrimSpace(slug); slug != "" && v.AcceptApp(slug) {
+					both = append(both, slug)
+				}
+			}
+			// An empty intersection gives an empty select that matches no
+			// application
+			selected = both
+		}
+		filter["select"] = strings.Join(selected, ",")
 	}
-	if err != nil {
-		return err
+	if rejected := v.RejectedSlugs(); len(rejected) > 0 {
+		if asked, ok := filter["reject"]; ok && asked != "" {
+			rejected = append(append([]string{}, rejected...), strings.Split(asked, ",")...)
+		}
+		filter["reject"] = strings.Join(rejected, ",")
 	}
-
-	return c.JSON(http.StatusOK, echo.Map{"ok": true})
 }
 
-// TODO: to improve the performances of pagination, we should use bookmarks for
-// the find with mango request instead of skip.
 func getAppsList(c echo.Context) error {
 	var filter map[string]string
-	var limit, cursor int
-	var sort string
+	var limit int
+	var cursor, sort string
 	var err error
 	latestVersionChannel := registry.Stable
 	versionsChannel := registry.Dev
@@ -282,11 +460,7 @@ func getAppsList(c echo.Context) error {
 					`Query param "limit" is invalid: %s`, err)
 			}
 		case "cursor":
-			cursor, err = strconv.Atoi(val)
-			if err != nil {
-				return errshttp.NewError(http.StatusBadRequest,
-					`Query param "cursor" is invalid: %s`, err)
-			}
+			cursor = val
 		case "sort":
 			sort = val
 		case "latestChannelVersion":
@@ -314,6 +488,11 @@ func getAppsList(c echo.Context) error {
 		}
 	}
 
+	// The exports are for the catalog, with the latest stable versions
+	if wantsCSV(c) {
+		latestVersionChannel = registry.Stable
+	}
+
 	virtual, space, err := getVirtualSpace(c)
 	if err != nil {
 		return err
@@ -324,8 +503,7 @@ func getAppsList(c echo.Context) error {
 		if filter == nil {
 			filter = make(map[string]string)
 		}
-		v := virtual.(*base.VirtualSpace)
-		filter[v.Filter] = strings.Join(v.Slugs, ",")
+		restrictFilter(filter, virtual.(*base.VirtualSpace))
 
 		// Artificially altering the space prefix to force the cache to use a
 		// different key
@@ -333,20 +511,35 @@ func getAppsList(c echo.Context) error {
 		space = &clone
 	}
 
-	next, apps, err := registry.GetAppsList(virtual, space, &registry.AppsListOptions{
+	nextCursor, apps, err := registry.GetAppsList(virtual, space, &registry.AppsListOptions{
 		Filters:              filter,
 		Limit:                limit,
 		Cursor:               cursor,
 		Sort:                 sort,
 		LatestVersionChannel: latestVersionChannel,
 		VersionsChannel:      versionsChannel,
+		ExcludeUnlisted:      true,
 	})
 	if err != nil {
 		return err
 	}
 
+	applyFlags(c, apps...)
+	etag, lastModified := appsListValidators(c, nextCursor, apps)
+	headers := c.Response().Header()
+	headers.Set("etag", etag)
+	if !lastModified.IsZero() {
+		headers.Set("last-modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	for _, app := range apps {
 		cleanApp(app)
+		if err = compatAppManifest(c, app); err != nil {
+			return err
+		}
 	}
 
 	type pageInfo struct {
@@ -354,9 +547,11 @@ func getAppsList(c echo.Context) error {
 		NextCursor string `json:"next_cursor,omitempty"`
 	}
 
-	var nextCursor string
-	if next >= 0 {
-		nextCursor = strconv.Itoa(next)
+	if wantsCSV(c) {
+		if nextCursor != "" {
+			c.Response().Header().Set("X-Next-Cursor", nextCursor)
+		}
+		return writeAppsCSV(c, apps)
 	}
 
 	j := struct {
@@ -372,3 +567,327 @@ func getAppsList(c echo.Context) error {
 
 	return writeJSON(c, j)
 }
+
+func getPublishRequirements(c echo.Context) error {
+	requirements := registry.GetPublishRequirements(getSpace(c))
+	if cacheControl(c, "", fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return writeJSON(c, requirements)
+}
+
+func writeAppsCSV(c echo.Context, apps []*registry.App) error {
+	header := []string{"slug", "editor", "type", "latest_version", "published_at"}
+	records := make([][]string, 0, len(apps))
+	for _, app := range apps {
+		var latest, publishedAt string
+		if app.LatestVersion != nil {
+			latest = app.LatestVersion.Version
+			publishedAt = app.LatestVersion.CreatedAt.Format(time.RFC3339)
+		}
+		records = append(records, []string{app.Slug, app.Editor, app.Type, latest, publishedAt})
+	}
+	return writeCSV(c, header, records)
+}
+
+// parseDiffDate parses a date given in the query parameters, as a day
+// (2006-01-02) or as a full RFC 3339 timestamp.
+func parseDiffDate(c echo.Context, param string, defaultDate time.Time) (time.Time, error) {
+	val := c.QueryParam(param)
+	if val == "" {
+		if defaultDate.IsZero() {
+			return defaultDate, errshttp.NewError(http.StatusBadRequest,
+				`Query param %q is missing`, param)
+		}
+		return defaultDate, nil
+	}
+	if date, err := time.Parse("2006-01-02", val); err == nil {
+		return date.UTC(), nil
+	}
+	date, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return date, errshttp.NewError(http.StatusBadRequest,
+			`Query param %q is invalid: %s`, param, err)
+	}
+	return date.UTC(), nil
+}
+
+func getListingDiff(c echo.Context) error {
+	from, err := parseDiffDate(c, "from", time.Time{})
+	if err != nil {
+		return err
+	}
+	to, err := parseDiffDate(c, "to", time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !from.Before(to) {
+		return errshttp.NewError(http.StatusBadRequest,
+			`Query param "from" should be before "to"`)
+	}
+
+	diff, err := registry.GetListingDiff(getSpace(c), from, to)
+	if err != nil {
+		return err
+	}
+
+	if cacheControl(c, "", fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return writeJSON(c, diff)
+}
+
+func searchApps(c echo.Context) error {
+	query := c.QueryParam("q")
+	if strings.TrimSpace(query) == "" {
+		return errshttp.NewError(http.StatusBadRequest, `Query param "q" is missing`)
+	}
+	limit, cursor := 20, 0
+	var err error
+	if val := c.QueryParam("limit"); val != "" {
+		if limit, err = strconv.Atoi(val); err != nil || limit <= 0 {
+			return errshttp.NewError(http.StatusBadRequest, `Query param "limit" is invalid`)
+		}
+		if limit > 100 {
+			limit = 100
+		}
+	}
+	if val := c.QueryParam("cursor"); val != "" {
+		if cursor, err = strconv.Atoi(val); err != nil || cursor < 0 {
+			return errshttp.NewError(http.StatusBadRequest, `Query param "cursor" is invalid`)
+		}
+	}
+
+	virtual, space, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	results, err := registry.SearchApps(space, query)
+	if err != nil {
+		return err
+	}
+	if virtual != nil {
+		filtered := results[:0]
+		for _, result := range results {
+			if virtual.AcceptApp(result.ID) {
+				filtered = append(filtered, result)
+			}
+		}
+		results = filtered
+	}
+
+	total := len(results)
+	if cursor > total {
+		cursor = total
+	}
+	end := cursor + limit
+	if end > total {
+		end = total
+	}
+	apps := make([]*registry.App, 0, end-cursor)
+	for _, result := range results[cursor:end] {
+		app, err := registry.FindApp(virtual, space, result.ID, getVersionsChannel(c, registry.Dev))
+		if err == registry.ErrAppNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cleanApp(app)
+		if err = compatAppManifest(c, app); err != nil {
+			return err
+		}
+		apps = append(apps, app)
+	}
+
+	type pageInfo struct {
+		Count      int    `json:"count"`
+		Total      int    `json:"total"`
+		NextCursor string `json:"next_cursor,omitempty"`
+	}
+	var nextCursor string
+	if end < total {
+		nextCursor = strconv.Itoa(end)
+	}
+
+	if cacheControl(c, "", fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return writeJSON(c, struct {
+		List     []*registry.App `json:"data"`
+		PageInfo pageInfo        `json:"meta"`
+	}{
+		List: apps,
+		PageInfo: pageInfo{
+			Count:      len(apps),
+			Total:      total,
+			NextCursor: nextCursor,
+		},
+	})
+}
+
+func getCategories(c echo.Context) error {
+	return writeFacets(c, registry.GetCategories)
+}
+
+func getKonnectorsDataTypes(c echo.Context) error {
+	return writeFacets(c, registry.GetKonnectorsDataTypes)
+}
+
+// writeFacets responds with the values aggregated from the manifests of the
+// applications, for the filters of the stores.
+func writeFacets(c echo.Context, get func(*base.VirtualSpace, *space.Space) ([]registry.Facet, error)) error {
+	virtual, space, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	facets, err := get(virtual, space)
+	if err != nil {
+		return err
+	}
+	if cacheControl(c, "", fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return writeJSON(c, facets)
+}
+
+// pushAppStats adds the statistics of an application (installs and ratings)
+// pushed by a cozy stack, with a master token of the cozy editor.
+func pushAppStats(c echo.Context) error {
+	if err := checkAdmin(c); err != nil {
+		return err
+	}
+
+	opts := &registry.StatsOptions{}
+	if err := c.Bind(opts); err != nil {
+		return err
+	}
+	s := getSpace(c)
+	app, err := registry.FindApp(nil, s, c.Param("app"), registry.Dev)
+	if err != nil {
+		return err
+	}
+	stats, err := registry.AddAppStats(s, app, opts)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+// statsPeriod returns the period asked for the statistics, with the from and
+// to parameters (YYYY-MM-DD), or the number of days until today. It is the
+// last 30 days by default.
+func statsPeriod(c echo.Context) (time.Time, time.Time, error) {
+	const maxDays = 366
+	to := time.Now().UTC()
+	if val := c.QueryParam("to"); val != "" {
+		var err error
+		if to, err = time.Parse("2006-01-02", val); err != nil {
+			return to, to, errshttp.NewError(http.StatusBadRequest,
+				`Query param "to" is invalid: the format is YYYY-MM-DD`)
+		}
+	}
+	days := 30
+	if val := c.QueryParam("days"); val != "" {
+		var err error
+		days, err = strconv.Atoi(val)
+		if err != nil || days <= 0 || days > maxDays {
+			return to, to, errshttp.NewError(http.StatusBadRequest,
+				`Query param "days" must be between 1 and %d`, maxDays)
+		}
+	}
+	from := to.AddDate(0, 0, -days+1)
+	if val := c.QueryParam("from"); val != "" {
+		var err error
+		if from, err = time.Parse("2006-01-02", val); err != nil {
+			return from, to, errshttp.NewError(http.StatusBadRequest,
+				`Query param "from" is invalid: the format is YYYY-MM-DD`)
+		}
+	}
+	if from.After(to) {
+		return from, to, errshttp.NewError(http.StatusBadRequest,
+			`Query param "from" must be before "to"`)
+	}
+	if to.Sub(from) >= maxDays*24*time.Hour {
+		return from, to, errshttp.NewError(http.StatusBadRequest,
+			"The period can't be longer than %d days", maxDays)
+	}
+	return from, to, nil
+}
+
+// getAppStats returns the daily statistics of an application (installs,
+// ratings and downloads) on a period, for its editor and the operators.
+func getAppStats(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+	from, to, err := statsPeriod(c)
+	if err != nil {
+		return err
+	}
+	s := getSpace(c)
+	app, err := registry.FindApp(nil, s, c.Param("app"), registry.Dev)
+	if err != nil {
+		return err
+	}
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	list, err := registry.GetAppStats(s, app.Slug, from, to)
+	if err != nil {
+		return err
+	}
+	total := registry.AppStats{Slug: app.Slug}
+	for _, stats := range list {
+		total.Installs += stats.Installs
+		total.Uninstalls += stats.Uninstalls
+		total.RatingsCount += stats.RatingsCount
+		total.RatingsSum += stats.RatingsSum
+		total.Downloads += stats.Downloads
+		total.LatestFetches += stats.LatestFetches
+	}
+	return writeJSON(c, echo.Map{
+		"from":       from.Format("2006-01-02"),
+		"to":         to.Format("2006-01-02"),
+		"popularity": app.Popularity,
+		"total":      total,
+		"days":       list,
+	})
+}
+
+// getStatsLeaderboard returns the applications of the space with the most
+// downloads (or installs, etc. with the sort parameter) on a period.
+func getStatsLeaderboard(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+	from, to, err := statsPeriod(c)
+	if err != nil {
+		return err
+	}
+	limit := 20
+	if val := c.QueryParam("limit"); val != "" {
+		limit, err = strconv.Atoi(val)
+		if err != nil || limit <= 0 {
+			return errshttp.NewError(http.StatusBadRequest,
+				`Query param "limit" is invalid`)
+		}
+	}
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = "downloads"
+	}
+	list, err := registry.GetStatsLeaderboard(getSpace(c), from, to, sortBy, limit)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, echo.Map{
+		"from": from.Format("2006-01-02"),
+		"to":   to.Format("2006-01-02"),
+		"sort": sortBy,
+		"apps": list,
+	})
+}
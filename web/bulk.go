@@ -0,0 +1,147 @@
+package web
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// maxBulkVersions is the maximal number of versions that can be published in
+// a single bulk request.
+const maxBulkVersions = 50
+
+// bulkVersion is a version to publish in a bulk request, with the slug of its
+// application.
+type bulkVersion struct {
+	Slug string `json:"slug"`
+	registry.VersionOptions
+}
+
+// bulkResult is the result of the publication of a version in a bulk request.
+type bulkResult struct {
+	Slug    string            `json:"slug"`
+	Version string            `json:"version"`
+	Status  int               `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Data    *versionWithLinks `json:"data,omitempty"`
+}
+
+// bulkConcurrency is the number of versions of a bulk request that are
+// downloaded and published in parallel.
+const bulkConcurrency = 4
+
+// bulkTask is a version of a bulk request whose permissions have been
+// checked, ready to be published.
+type bulkTask struct {
+	index  int
+	item   *bulkVersion
+	app    *registry.App
+	editor *auth.Editor
+}
+
+// bulkPublish publishes several versions, of several applications, in a
+// single request. Each version is published like with POST /registry/:app,
+// independently of the others: the response has a result for each version,
+// in the same order as in the request. The versions are published in
+// parallel, except the ones of the same application that are published one
+// after the other, in the order of the request.
+func bulkPublish(c echo.Context) (err error) {
+	if err = checkAuthorized(c); err != nil {
+		return err
+	}
+	var body struct {
+		Versions []*bulkVersion `json:"versions"`
+	}
+	if err = c.Bind(&body); err != nil {
+		return err
+	}
+	if len(body.Versions) == 0 {
+		return errshttp.NewError(http.StatusBadRequest, "Missing versions")
+	}
+	if len(body.Versions) > maxBulkVersions {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Too many versions, the limit is %d", maxBulkVersions)
+	}
+
+	results := make([]*bulkResult, len(body.Versions))
+	var groups [][]*bulkTask
+	groupOf := make(map[string]int)
+	for i, item := range body.Versions {
+		task, result := prepareBulkVersion(c, i, item)
+		if result != nil {
+			results[i] = result
+			continue
+		}
+		g, ok := groupOf[task.app.Slug]
+		if !ok {
+			g = len(groups)
+			groupOf[task.app.Slug] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], task)
+	}
+
+	// The workers must not use the echo context
+	pub := newPublication(c)
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, bulkConcurrency)
+	for _, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(group []*bulkTask) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, task := range group {
+				results[task.index] = publishBulkVersion(pub, task)
+			}
+		}(group)
+	}
+	wg.Wait()
+	return c.JSON(http.StatusMultiStatus, echo.Map{"results": results})
+}
+
+// prepareBulkVersion checks the permissions for a version of a bulk request.
+// It returns the task to publish it, or the result of the failure.
+func prepareBulkVersion(c echo.Context, index int, item *bulkVersion) (*bulkTask, *bulkResult) {
+	opts := &item.VersionOptions
+	opts.Version = stripVersion(opts.Version)
+	opts.SpacePrefix = getSpace(c).GetPrefix()
+
+	task, err := func() (*bulkTask, error) {
+		app, err := registry.FindApp(nil, getSpace(c), item.Slug, registry.Stable)
+		if err != nil {
+			return nil, err
+		}
+		editor, err := checkPermissionsOrRole(c, app.Editor, app.Slug, false /* = not master */, auth.RolePublishAny)
+		if err != nil {
+			return nil, errshttp.NewError(http.StatusUnauthorized, err.Error())
+		}
+		opts.Provenance = newProvenance(c, registry.PublishMethodBulk)
+		return &bulkTask{index: index, item: item, app: app, editor: editor}, nil
+	}()
+	if err != nil {
+		result := &bulkResult{Slug: item.Slug, Version: opts.Version}
+		result.Status, result.Error = errorStatus(err)
+		return nil, result
+	}
+	return task, nil
+}
+
+func publishBulkVersion(pub *publication, task *bulkTask) *bulkResult {
+	opts := &task.item.VersionOptions
+	result := &bulkResult{Slug: task.item.Slug, Version: opts.Version}
+	ver, err := pub.add(task.app, task.editor, opts)
+	if err != nil {
+		result.Status, result.Error = errorStatus(err)
+		return result
+	}
+	result.Status = http.StatusCreated
+	result.Data = ver
+	return result
+}
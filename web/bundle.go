@@ -0,0 +1,34 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// getBundle returns the catalog of the space in a single signed document.
+// The document is written as is, and not reformatted, as the signature is
+// made on the bytes of its catalog.
+func getBundle(c echo.Context) error {
+	virtual, space, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	bundle, err := registry.BuildBundle(virtual, space)
+	if err != nil {
+		return err
+	}
+	signed, err := registry.SignBundle(bundle, base.Config.BundleSigningKey)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(signed)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSONBlob(http.StatusOK, doc)
+}
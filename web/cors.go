@@ -0,0 +1,59 @@
+package web
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/base"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// corsSpaces middleware adds the CORS headers to the responses of the spaces
+// configured in the cors section, and answers to their preflight requests. It
+// must be run before the routing, as the preflight requests don't match the
+// routes of the spaces.
+func corsSpaces() echo.MiddlewareFunc {
+	handlers := make(map[string]echo.MiddlewareFunc)
+	for name, params := range base.Config.CORS {
+		handlers[name] = middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins: params.AllowedOrigins,
+			AllowMethods: params.AllowedMethods,
+			MaxAge:       int(params.MaxAge.Seconds()),
+		})
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if len(handlers) == 0 {
+				return next(c)
+			}
+			name, ok := spaceNameFromPath(c.Request().URL.Path)
+			if !ok {
+				return next(c)
+			}
+			if h, ok := handlers[name]; ok {
+				return h(next)(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// spaceNameFromPath returns the name of the space (__default__ for the default
+// space) of a path of the API, like /registry/drive or /foo/registry/drive.
+func spaceNameFromPath(p string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 3)
+	if parts[0] == "registry" {
+		return base.DefaultSpacePrefix.String(), true
+	}
+	if len(parts) < 2 || parts[1] != "registry" {
+		return "", false
+	}
+	name, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return name, true
+}
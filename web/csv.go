@@ -0,0 +1,81 @@
+package web
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	mimeTextCSV = "text/csv"
+	mimeTextTSV = "text/tab-separated-values"
+)
+
+// csvSeparatorKey is the key used in the echo context to store the separator
+// to use when the client has asked for a CSV or TSV export.
+const csvSeparatorKey = "csv_separator"
+
+// csvEndpoint is a middleware for the endpoints that can send their response
+// in CSV or TSV, for spreadsheets, in addition to JSON. The format is chosen
+// with the format query parameter (csv or tsv) or with the Accept header.
+func csvEndpoint(next echo.HandlerFunc) echo.HandlerFunc {
+	json := jsonEndpoint(next)
+	return func(c echo.Context) error {
+		var separator rune
+		switch c.QueryParam("format") {
+		case "csv":
+			separator = ','
+		case "tsv":
+			separator = '\t'
+		case "", "json":
+			accept := c.Request().Header.Get(echo.HeaderAccept)
+			if strings.Contains(accept, mimeTextCSV) {
+				separator = ','
+			} else if strings.Contains(accept, mimeTextTSV) {
+				separator = '\t'
+			}
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest,
+				`Query param "format" should be "json", "csv" or "tsv"`)
+		}
+		if separator == 0 {
+			return json(c)
+		}
+		c.Set(csvSeparatorKey, separator)
+		return next(c)
+	}
+}
+
+// wantsCSV returns true if the response should be sent in CSV or TSV.
+func wantsCSV(c echo.Context) bool {
+	_, ok := c.Get(csvSeparatorKey).(rune)
+	return ok
+}
+
+// writeCSV sends the given header and records in CSV or TSV, depending on what
+// the client has asked.
+func writeCSV(c echo.Context, header []string, records [][]string) error {
+	separator, _ := c.Get(csvSeparatorKey).(rune)
+	contentType := mimeTextCSV
+	if separator == '\t' {
+		contentType = mimeTextTSV
+	}
+	resp := c.Response()
+	resp.Header().Set(echo.HeaderContentType, contentType+"; charset=utf-8")
+	resp.WriteHeader(http.StatusOK)
+	if c.Request().Method == http.MethodHead {
+		return nil
+	}
+
+	w := csv.NewWriter(resp)
+	w.Comma = separator
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := w.WriteAll(records); err != nil {
+		return err
+	}
+	return w.Error()
+}
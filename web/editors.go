@@ -2,8 +2,14 @@ package web
 
 import (
 	"net/http"
+	"sort"
+	"time"
 
 	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/labstack/echo/v4"
 )
 
@@ -28,3 +34,146 @@ func getEditorsList(c echo.Context) error {
 	}
 	return writeJSON(c, editors)
 }
+
+// authenticatedEditor returns the editor of the token of the request. The
+// token is found in the register of the issued tokens, or else it must be a
+// master token.
+func authenticatedEditor(c echo.Context) (*auth.Editor, error) {
+	token, err := extractAuthHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNotRevoked(token); err != nil {
+		return nil, err
+	}
+
+	issued, err := auth.IssuedTokens.Find(token)
+	if err != nil {
+		return nil, err
+	}
+	if issued != nil {
+		editor, err := auth.Editors.GetEditor(issued.Editor)
+		if err != nil {
+			return nil, errshttp.NewError(http.StatusUnauthorized, "Could not find editor: %s", issued.Editor)
+		}
+		var ok bool
+		switch {
+		case issued.Kind == auth.MasterToken:
+			ok = editor.VerifyMasterToken(base.SessionSecret, token)
+		case issued.App != "":
+			ok = editor.VerifyEditorToken(base.SessionSecret, token, issued.App)
+		default:
+			ok = editor.VerifyScopedEditorToken(base.SessionSecret, token)
+		}
+		if !ok {
+			return nil, errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
+		}
+		return editor, nil
+	}
+
+	editors, err := auth.Editors.AllEditors()
+	if err != nil {
+		return nil, err
+	}
+	for _, editor := range editors {
+		if editor.VerifyMasterToken(base.SessionSecret, token) {
+			return editor, nil
+		}
+	}
+	return nil, errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
+}
+
+// editorApp is an application of the authenticated editor, in a space.
+type editorApp struct {
+	Space                string    `json:"space"`
+	Slug                 string    `json:"slug"`
+	Type                 string    `json:"type"`
+	Name                 string    `json:"name"`
+	CreatedAt            time.Time `json:"created_at"`
+	MaintenanceActivated bool      `json:"maintenance_activated"`
+	External             bool      `json:"external,omitempty"`
+}
+
+// getMyApps returns the applications of the authenticated editor in all the
+// spaces.
+func getMyApps(c echo.Context) error {
+	editor, err := authenticatedEditor(c)
+	if err != nil {
+		return err
+	}
+	names := space.GetSpacesNames()
+	sort.Strings(names)
+	list := []editorApp{}
+	for _, name := range names {
+		s, ok := space.GetSpace(name)
+		if !ok {
+			continue
+		}
+		apps, err := registry.FindEditorApps(s, editor.Name())
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			name = base.DefaultSpacePrefix.String()
+		}
+		for _, app := range apps {
+			list = append(list, editorApp{
+				Space:                name,
+				Slug:                 app.Slug,
+				Type:                 app.Type,
+				Name:                 app.Name,
+				CreatedAt:            app.CreatedAt,
+				MaintenanceActivated: app.MaintenanceActivated,
+				External:             app.External != nil,
+			})
+		}
+	}
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	return writeJSON(c, echo.Map{"editor": editor.Name(), "apps": list})
+}
+
+// editorToken is the metadata of a token issued for the authenticated editor.
+type editorToken struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	App       string     `json:"app,omitempty"`
+	Scope     string     `json:"scope,omitempty"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Status    string     `json:"status"`
+}
+
+// getMyTokens returns the metadata of the tokens issued for the
+// authenticated editor.
+func getMyTokens(c echo.Context) error {
+	editor, err := authenticatedEditor(c)
+	if err != nil {
+		return err
+	}
+	issued, err := auth.IssuedTokens.ListByEditor(editor.Name())
+	if err != nil {
+		return err
+	}
+	rotations, err := auth.Revocations.LastRotations(editor)
+	if err != nil {
+		return err
+	}
+	list := make([]editorToken, 0, len(issued))
+	for _, token := range issued {
+		revoked, err := auth.Revocations.IsHashRevoked(token.ID)
+		if err != nil {
+			return err
+		}
+		list = append(list, editorToken{
+			ID:        token.ID,
+			Kind:      token.Kind,
+			App:       token.App,
+			Scope:     token.Scope,
+			IssuedAt:  token.IssuedAt,
+			ExpiresAt: token.ExpiresAt,
+			Status:    token.Status(revoked, rotations),
+		})
+	}
+	c.Response().Header().Set("Cache-Control", "private, no-cache")
+	return writeJSON(c, echo.Map{"editor": editor.Name(), "tokens": list})
+}
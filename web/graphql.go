@@ -0,0 +1,543 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/graphql"
+	"github.com/cozy/cozy-apps-registry/manifest"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/labstack/echo/v4"
+)
+
+type graphqlContextKey int
+
+// revisionContextKey is the key in the context of the resolvers of the
+// revision of the schema of the manifests asked by the client.
+const revisionContextKey graphqlContextKey = iota
+
+// gqlApp is an application in the GraphQL API, with its space for the
+// resolvers of its versions. The applications of a list share a batch.
+type gqlApp struct {
+	space *space.Space
+	app   *registry.App
+	batch *gqlBatch
+	index int
+}
+
+// gqlEditor is an editor in the GraphQL API. The editors of a list share a
+// batch.
+type gqlEditor struct {
+	editor *auth.Editor
+	batch  *gqlBatch
+	index  int
+}
+
+// The sizes of the lists for the cost of the queries: the maximal limit of
+// a page of applications, and the number of editors expected.
+const (
+	gqlMaxLimit   = 200
+	gqlMaxEditors = 100
+)
+
+// gqlBatch loads a field for all the nodes of a list at once, when it is
+// resolved for the first of them, instead of making the requests to CouchDB
+// node by node (N+1). The keys are the slugs or the names of the nodes, and
+// the results are kept by field and arguments.
+type gqlBatch struct {
+	keys    []string
+	mu      sync.Mutex
+	results map[string][]gqlResult
+}
+
+type gqlResult struct {
+	value interface{}
+	err   error
+}
+
+func newGQLBatch(keys []string) *gqlBatch {
+	return &gqlBatch{keys: keys, results: make(map[string][]gqlResult)}
+}
+
+// load returns the result of the node at the index, and calls fetch with the
+// keys of all the nodes the first time a field is asked.
+func (b *gqlBatch) load(field string, index int, fetch func(keys []string) []gqlResult) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	results, ok := b.results[field]
+	if !ok {
+		results = fetch(b.keys)
+		b.results[field] = results
+	}
+	return results[index].value, results[index].err
+}
+
+// gqlParallel calls fn for each key, with a few calls in parallel.
+func gqlParallel(keys []string, fn func(key string) gqlResult) []gqlResult {
+	const parallel = 8
+	results := make([]gqlResult, len(keys))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = fn(keys[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// gqlBatchKey returns the key of a field with its arguments in a batch.
+func gqlBatchKey(field string, args map[string]interface{}) string {
+	b, _ := json.Marshal(args)
+	return field + string(b)
+}
+
+var gqlAppVersionsType = &graphql.Object{
+	Name:        "AppVersions",
+	Description: "The versions of an application, by channel",
+	Fields: map[string]*graphql.FieldDef{
+		"stable": {Type: &graphql.List{Of: graphql.String}, Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*registry.AppVersions).Stable, nil
+		}},
+		"beta": {Type: &graphql.List{Of: graphql.String}, Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*registry.AppVersions).Beta, nil
+		}},
+		"dev": {Type: &graphql.List{Of: graphql.String}, Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*registry.AppVersions).Dev, nil
+		}},
+	},
+}
+
+var gqlVersionType = &graphql.Object{
+	Name:        "Version",
+	Description: "A version of an application",
+	Fields: map[string]*graphql.FieldDef{
+		"slug":      versionField(graphql.String, func(v *registry.Version) interface{} { return v.Slug }),
+		"editor":    versionField(graphql.String, func(v *registry.Version) interface{} { return v.Editor }),
+		"type":      versionField(graphql.String, func(v *registry.Version) interface{} { return v.Type }),
+		"version":   versionField(graphql.String, func(v *registry.Version) interface{} { return v.Version }),
+		"url":       versionField(graphql.String, func(v *registry.Version) interface{} { return v.URL }),
+		"sha256":    versionField(graphql.String, func(v *registry.Version) interface{} { return v.Sha256 }),
+		"size":      versionField(graphql.Int, func(v *registry.Version) interface{} { return v.Size }),
+		"createdAt": versionField(graphql.String, func(v *registry.Version) interface{} { return v.CreatedAt }),
+		"signed":    versionField(graphql.Boolean, func(v *registry.Version) interface{} { return v.Signed }),
+		"changelog": versionField(graphql.String, func(v *registry.Version) interface{} { return v.Changelog }),
+		"channel": versionField(graphql.String, func(v *registry.Version) interface{} {
+			return registry.ChannelToStr(registry.GetVersionChannel(v.Version))
+		}),
+		"manifest": {
+			Type:        graphql.JSON,
+			Description: "The manifest of the version, or only the given top-level fields of it",
+			Args: map[string]*graphql.Argument{
+				"fields": {Type: graphql.JSON, Description: "The list of the fields to return"},
+			},
+			Resolve: graphqlManifest,
+		},
+	},
+}
+
+var gqlAppType = &graphql.Object{
+	Name:        "App",
+	Description: "An application or a konnector of a space",
+	Fields: map[string]*graphql.FieldDef{
+		"slug":                 appField(graphql.String, func(a *registry.App) interface{} { return a.Slug }),
+		"type":                 appField(graphql.String, func(a *registry.App) interface{} { return a.Type }),
+		"editor":               appField(graphql.String, func(a *registry.App) interface{} { return a.Editor }),
+		"name":                 appField(graphql.String, func(a *registry.App) interface{} { return a.Name }),
+		"createdAt":            appField(graphql.String, func(a *registry.App) interface{} { return a.CreatedAt }),
+		"popularity":           appField(graphql.Int, func(a *registry.App) interface{} { return a.Popularity }),
+		"label":                appField(graphql.String, func(a *registry.App) interface{} { return a.Label }),
+		"maintenanceActivated": appField(graphql.Boolean, func(a *registry.App) interface{} { return a.MaintenanceActivated }),
+		"maintenanceOptions":   appField(graphql.JSON, func(a *registry.App) interface{} { return a.MaintenanceOptions }),
+		"dataUsageCommitment":  appField(graphql.String, func(a *registry.App) interface{} { return a.DataUsageCommitment }),
+		"versions":             appField(gqlAppVersionsType, func(a *registry.App) interface{} { return a.Versions }),
+		"latestVersion": {
+			Type:        gqlVersionType,
+			Description: "The latest version of the application for the channel (stable by default)",
+			Args: map[string]*graphql.Argument{
+				"channel": {Type: graphql.String},
+			},
+			Resolve: graphqlLatestVersion,
+		},
+	},
+}
+
+var gqlAppsPageType = &graphql.Object{
+	Name:        "AppsPage",
+	Description: "A page of the list of the applications",
+	Fields: map[string]*graphql.FieldDef{
+		"apps":       {Type: &graphql.List{Of: gqlAppType}},
+		"nextCursor": {Type: graphql.String},
+	},
+}
+
+var gqlEditorType = &graphql.Object{
+	Name:        "Editor",
+	Description: "An editor of applications",
+	Fields: map[string]*graphql.FieldDef{
+		"name": {Type: graphql.String, Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return p.Source.(*gqlEditor).editor.Name(), nil
+		}},
+		"apps": {
+			Type:        gqlAppsPageType,
+			Description: "The applications of the editor in a space",
+			Args: map[string]*graphql.Argument{
+				"space":  {Type: graphql.String},
+				"limit":  {Type: graphql.Int},
+				"cursor": {Type: graphql.String},
+				"sort":   {Type: graphql.String},
+			},
+			Size:    gqlMaxLimit,
+			Resolve: graphqlEditorApps,
+		},
+	},
+}
+
+// graphqlSchema is the schema of the /graphql endpoint. It gives a read-only
+// access to the same data as the REST API, but a store can fetch the
+// applications with the fields of their latest versions in one request.
+var graphqlSchema = &graphql.Schema{
+	Query: &graphql.Object{
+		Name: "Query",
+		Fields: map[string]*graphql.FieldDef{
+			"apps": {
+				Type:        gqlAppsPageType,
+				Description: "The list of the applications of a space, with the filters and the sort of the REST API",
+				Args: map[string]*graphql.Argument{
+					"space":  {Type: graphql.String},
+					"type":   {Type: graphql.String},
+					"editor": {Type: graphql.String},
+					"limit":  {Type: graphql.Int},
+					"cursor": {Type: graphql.String},
+					"sort":   {Type: graphql.String},
+				},
+				Size:    gqlMaxLimit,
+				Resolve: graphqlApps,
+			},
+			"app": {
+				Type: gqlAppType,
+				Args: map[string]*graphql.Argument{
+					"space": {Type: graphql.String},
+					"slug":  {Type: graphql.String, Required: true},
+				},
+				Resolve: graphqlApp,
+			},
+			"version": {
+				Type: gqlVersionType,
+				Args: map[string]*graphql.Argument{
+					"space":   {Type: graphql.String},
+					"slug":    {Type: graphql.String, Required: true},
+					"version": {Type: graphql.String, Required: true},
+				},
+				Resolve: graphqlVersion,
+			},
+			"maintenance": {
+				Type:        &graphql.List{Of: gqlAppType},
+				Description: "The applications in maintenance in a space",
+				Args: map[string]*graphql.Argument{
+					"space": {Type: graphql.String},
+				},
+				Size:    gqlMaxLimit,
+				Resolve: graphqlMaintenance,
+			},
+			"editors": {
+				Type:    &graphql.List{Of: gqlEditorType},
+				Size:    gqlMaxEditors,
+				Resolve: graphqlEditors,
+			},
+			"editor": {
+				Type: gqlEditorType,
+				Args: map[string]*graphql.Argument{
+					"name": {Type: graphql.String, Required: true},
+				},
+				Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+					editor, err := auth.Editors.GetEditor(p.Args["name"].(string))
+					if err != nil {
+						return nil, err
+					}
+					return &gqlEditor{editor: editor}, nil
+				},
+			},
+		},
+	},
+}
+
+func appField(t graphql.Type, get func(a *registry.App) interface{}) *graphql.FieldDef {
+	return &graphql.FieldDef{
+		Type: t,
+		Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*gqlApp).app), nil
+		},
+	}
+}
+
+func versionField(t graphql.Type, get func(v *registry.Version) interface{}) *graphql.FieldDef {
+	return &graphql.FieldDef{
+		Type: t,
+		Resolve: func(p *graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(*registry.Version)), nil
+		},
+	}
+}
+
+// graphqlSpace returns the space of the space argument, or the default
+// space.
+func graphqlSpace(args map[string]interface{}) (*space.Space, error) {
+	name, _ := args["space"].(string)
+	if name == base.DefaultSpacePrefix.String() {
+		name = ""
+	}
+	s, ok := space.GetSpace(name)
+	if !ok {
+		return nil, errSpaceNotFound
+	}
+	return s, nil
+}
+
+func graphqlApps(p *graphql.ResolveParams) (interface{}, error) {
+	s, err := graphqlSpace(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	opts := &registry.AppsListOptions{
+		Filters:              make(map[string]string),
+		LatestVersionChannel: registry.Stable,
+		VersionsChannel:      registry.Dev,
+		ExcludeUnlisted:      true,
+	}
+	opts.Limit, _ = p.Args["limit"].(int)
+	opts.Cursor, _ = p.Args["cursor"].(string)
+	opts.Sort, _ = p.Args["sort"].(string)
+	for _, filter := range []string{"type", "editor"} {
+		if val, ok := p.Args[filter].(string); ok {
+			opts.Filters[filter] = val
+		}
+	}
+	next, apps, err := registry.GetAppsList(nil, s, opts)
+	if err != nil {
+		return nil, err
+	}
+	page := map[string]interface{}{"apps": newGQLApps(s, apps)}
+	if next != "" {
+		page["nextCursor"] = next
+	}
+	return page, nil
+}
+
+func graphqlApp(p *graphql.ResolveParams) (interface{}, error) {
+	s, err := graphqlSpace(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	app, err := registry.FindApp(nil, s, p.Args["slug"].(string), registry.Dev)
+	if err == registry.ErrAppNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gqlApp{space: s, app: app}, nil
+}
+
+func graphqlVersion(p *graphql.ResolveParams) (interface{}, error) {
+	s, err := graphqlSpace(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	// The pending versions are only visible to the editors and the
+	// moderators, via the authenticated routes
+	version, err := registry.FindPublishedVersion(s, p.Args["slug"].(string), p.Args["version"].(string))
+	if err == registry.ErrVersionNotFound {
+		return nil, nil
+	}
+	return version, err
+}
+
+func graphqlMaintenance(p *graphql.ResolveParams) (interface{}, error) {
+	s, err := graphqlSpace(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	apps, err := registry.GetMaintainanceApps(s)
+	if err != nil {
+		return nil, err
+	}
+	return newGQLApps(s, apps), nil
+}
+
+// newGQLApps returns the nodes of a list of applications, with a batch for
+// their versions.
+func newGQLApps(s *space.Space, apps []*registry.App) []*gqlApp {
+	slugs := make([]string, len(apps))
+	for i, app := range apps {
+		slugs[i] = app.Slug
+	}
+	batch := newGQLBatch(slugs)
+	nodes := make([]*gqlApp, len(apps))
+	for i, app := range apps {
+		nodes[i] = &gqlApp{space: s, app: app, batch: batch, index: i}
+	}
+	return nodes
+}
+
+func graphqlEditors(p *graphql.ResolveParams) (interface{}, error) {
+	editors, err := auth.Editors.AllEditors()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(editors))
+	for i, editor := range editors {
+		names[i] = editor.Name()
+	}
+	batch := newGQLBatch(names)
+	nodes := make([]*gqlEditor, len(editors))
+	for i, editor := range editors {
+		nodes[i] = &gqlEditor{editor: editor, batch: batch, index: i}
+	}
+	return nodes, nil
+}
+
+// graphqlEditorApps returns the applications of an editor. For a list of
+// editors, the applications of all the editors are fetched at once.
+func graphqlEditorApps(p *graphql.ResolveParams) (interface{}, error) {
+	node := p.Source.(*gqlEditor)
+	if node.batch == nil {
+		p.Args["editor"] = node.editor.Name()
+		return graphqlApps(p)
+	}
+	return node.batch.load(gqlBatchKey("apps", p.Args), node.index, func(names []string) []gqlResult {
+		return gqlParallel(names, func(name string) gqlResult {
+			args := make(map[string]interface{}, len(p.Args)+1)
+			for k, v := range p.Args {
+				args[k] = v
+			}
+			args["editor"] = name
+			page, err := graphqlApps(&graphql.ResolveParams{Context: p.Context, Args: args, Field: p.Field})
+			return gqlResult{page, err}
+		})
+	})
+}
+
+func graphqlLatestVersion(p *graphql.ResolveParams) (interface{}, error) {
+	node := p.Source.(*gqlApp)
+	channel := registry.Stable
+	if val, ok := p.Args["channel"].(string); ok {
+		var err error
+		if channel, err = registry.StrToChannel(val); err != nil {
+			return nil, err
+		}
+	}
+	// The latest stable version is already known for the lists
+	if channel == registry.Stable && node.app.LatestVersion != nil {
+		return node.app.LatestVersion, nil
+	}
+	if node.batch == nil {
+		version, err := registry.FindLatestVersion(node.space, node.app.Slug, channel)
+		if err == registry.ErrVersionNotFound {
+			return nil, nil
+		}
+		return version, err
+	}
+	key := "latestVersion:" + registry.ChannelToStr(channel)
+	return node.batch.load(key, node.index, func(slugs []string) []gqlResult {
+		queries := make([]registry.LatestVersionQuery, len(slugs))
+		for i, slug := range slugs {
+			queries[i] = registry.LatestVersionQuery{Slug: slug, Channel: registry.ChannelToStr(channel)}
+		}
+		results := make([]gqlResult, len(slugs))
+		for i, res := range registry.FindLatestVersions(nil, node.space, queries) {
+			if res.Err == registry.ErrVersionNotFound {
+				continue
+			}
+			results[i] = gqlResult{res.Version, res.Err}
+		}
+		return results
+	})
+}
+
+// graphqlManifest returns the manifest in the revision of the schema asked
+// by the client, with only the fields asked when the fields argument is
+// given.
+func graphqlManifest(p *graphql.ResolveParams) (interface{}, error) {
+	version := p.Source.(*registry.Version)
+	revision, ok := p.Context.Value(revisionContextKey).(int)
+	if !ok {
+		revision = manifest.CurrentRevision
+	}
+	content, err := manifest.Downgrade(version.Manifest, revision)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := p.Args["fields"]
+	if !ok {
+		return content, nil
+	}
+	list, ok := fields.([]interface{})
+	if !ok {
+		return nil, errshttp.NewError(http.StatusBadRequest, "The fields must be a list of strings")
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	filtered := make(map[string]json.RawMessage, len(list))
+	for _, field := range list {
+		name, ok := field.(string)
+		if !ok {
+			return nil, errshttp.NewError(http.StatusBadRequest, "The fields must be a list of strings")
+		}
+		if val, ok := doc[name]; ok {
+			filtered[name] = val
+		}
+	}
+	return filtered, nil
+}
+
+// handleGraphQL executes a GraphQL query, sent as JSON in the body of a POST
+// request, or in the query parameters of a GET request.
+func handleGraphQL(c echo.Context) error {
+	var req graphql.Request
+	if c.Request().Method == http.MethodGet {
+		req.Query = c.QueryParam("query")
+		req.OperationName = c.QueryParam("operationName")
+		if vars := c.QueryParam("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				return errshttp.NewError(http.StatusBadRequest, "Invalid variables: %s", err)
+			}
+		}
+	} else {
+		if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid JSON body: %s", err)
+		}
+	}
+	if strings.TrimSpace(req.Query) == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing query")
+	}
+
+	ctx := context.WithValue(c.Request().Context(), revisionContextKey, getManifestRevision(c))
+	res := graphqlSchema.Execute(ctx, &req)
+	if res.Data == nil {
+		return c.JSON(http.StatusBadRequest, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// getGraphQLSchema returns the schema of the GraphQL API, as the introspection
+// is not supported.
+func getGraphQLSchema(c echo.Context) error {
+	return c.String(http.StatusOK, graphqlSchema.Describe())
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/imaging"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// negotiateIcon returns the icon resized to the size given in the query
+// string, and converted to a format accepted by the client if the original
+// format is not. The SVG icons are always sent as they are.
+func negotiateIcon(c echo.Context, icon *registry.Attachment) (*registry.Attachment, error) {
+	size := 0
+	if param := c.QueryParam("size"); param != "" {
+		var err error
+		if size, err = strconv.Atoi(param); err != nil || imaging.CheckSize(size) != nil {
+			return nil, errshttp.NewError(http.StatusBadRequest,
+				"Invalid size %q: it must be between %d and %d pixels",
+				param, imaging.MinSize, imaging.MaxSize)
+		}
+	}
+	if !imaging.CanDecode(icon.ContentType) {
+		return icon, nil
+	}
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+
+	candidates := imaging.Formats
+	if size == 0 {
+		candidates = append([]string{icon.ContentType}, imaging.Formats...)
+	}
+	format := imaging.Negotiate(c.Request().Header.Get(echo.HeaderAccept), candidates)
+	if format == "" {
+		format = candidates[0]
+	}
+	if size == 0 && format == icon.ContentType {
+		return icon, nil
+	}
+
+	rendition, err := registry.IconRendition(icon, size, format)
+	switch err {
+	case nil:
+		return rendition, nil
+	case imaging.ErrUnsupportedFormat, imaging.ErrImageTooLarge:
+		return nil, errshttp.NewError(http.StatusUnprocessableEntity, "Cannot resize the icon: %s", err)
+	default:
+		return nil, err
+	}
+}
@@ -0,0 +1,53 @@
+package web
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// publishJobKind is the kind of the jobs for the publication of a version.
+const publishJobKind = "publish"
+
+type jobResponse struct {
+	ID string `json:"id"`
+	*jobs.Job
+	Links struct {
+		Self string `json:"self"`
+	} `json:"links"`
+}
+
+// newJobResponse returns the job for the response, without the internal
+// identifier and revision.
+func newJobResponse(job *jobs.Job, self string) *jobResponse {
+	res := &jobResponse{ID: job.ID, Job: job}
+	res.Links.Self = self
+	job.ID = ""
+	job.Rev = ""
+	return res
+}
+
+func getJob(c echo.Context) error {
+	job, err := jobs.Get(c.Param("id"))
+	if err == jobs.ErrJobNotFound || (err == nil && job.Space != getSpace(c).Name) {
+		return errshttp.NewError(http.StatusNotFound, "Job not found")
+	}
+	if err != nil {
+		return err
+	}
+	if job.State == jobs.Running {
+		// The progress saved on the job is throttled, the download is more
+		// recent if it runs on this instance
+		if p, ok := registry.GetJobDownload(job.ID); ok {
+			job.Progress = &jobs.Progress{Done: p.Read, Total: p.Total}
+		}
+	}
+	if job.State == jobs.Pending || job.State == jobs.Running {
+		c.Response().Header().Set("Retry-After", "5")
+		c.Response().Header().Set("Cache-Control", "no-cache")
+	}
+	return c.JSON(http.StatusOK, newJobResponse(job, registryURL(c, "jobs", job.ID)))
+}
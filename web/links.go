@@ -0,0 +1,104 @@
+package web
+
+import (
+	"net/url"
+	"path"
+
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/labstack/echo/v4"
+)
+
+// links are the canonical URLs of the resources related to an application or
+// a version, so that the tools can navigate the API without building the
+// URLs themselves.
+type links struct {
+	Self     string `json:"self"`
+	App      string `json:"app,omitempty"`
+	Versions string `json:"versions"`
+	Latest   string `json:"latest"`
+	Icon     string `json:"icon"`
+	// Screenshots is the gallery of the screenshots, only for a version
+	Screenshots string `json:"screenshots,omitempty"`
+}
+
+type appWithLinks struct {
+	*registry.App
+	Links links `json:"links"`
+}
+
+type versionWithLinks struct {
+	*registry.Version
+	Links links `json:"links"`
+}
+
+// registryPath returns the path of the registry API for the space (or the
+// virtual space, or the sandbox) of the request.
+func registryPath(c echo.Context) string {
+	if sandbox, ok := c.Get(sandboxKey).(*registry.Sandbox); ok {
+		return "/sandboxes/" + url.PathEscape(sandbox.Editor) + "/registry"
+	}
+	spaceName := getSpace(c).Name
+	if name, ok := c.Get("virtual_name").(string); ok {
+		spaceName = name
+	}
+	if spaceName == "" {
+		return "/registry"
+	}
+	return "/" + url.PathEscape(spaceName) + "/registry"
+}
+
+// registryURL returns the absolute URL of a resource of the registry API, for
+// the space of the request.
+func registryURL(c echo.Context, parts ...string) string {
+	return joinURL(registryRoot(c), parts...)
+}
+
+// registryRoot returns the absolute URL of the registry API for the space of
+// the request.
+func registryRoot(c echo.Context) *url.URL {
+	return &url.URL{
+		Scheme: c.Scheme(),
+		Host:   c.Request().Host,
+		Path:   registryPath(c),
+	}
+}
+
+// joinURL returns the URL of a resource under the given root URL.
+func joinURL(root *url.URL, parts ...string) string {
+	u := *root
+	u.Path = path.Join(append([]string{root.Path}, parts...)...)
+	return u.String()
+}
+
+func newAppWithLinks(c echo.Context, app *registry.App) *appWithLinks {
+	return &appWithLinks{
+		App: app,
+		Links: links{
+			Self:     registryURL(c, app.Slug),
+			Versions: registryURL(c, app.Slug, "versions"),
+			Latest:   registryURL(c, app.Slug, registry.ChannelToStr(registry.Stable), "latest"),
+			Icon:     registryURL(c, app.Slug, "icon"),
+		},
+	}
+}
+
+func newVersionWithLinks(c echo.Context, ver *registry.Version) *versionWithLinks {
+	return versionWithRootLinks(registryRoot(c), ver)
+}
+
+// versionWithRootLinks returns the version with its links under the given
+// root URL of the registry API, for when the echo context can't be used.
+func versionWithRootLinks(root *url.URL, ver *registry.Version) *versionWithLinks {
+	channel := registry.GetVersionChannel(ver.Version)
+	return &versionWithLinks{
+		Version: ver,
+		Links: links{
+			Self:        joinURL(root, ver.Slug, ver.Version),
+			App:         joinURL(root, ver.Slug),
+			Versions:    joinURL(root, ver.Slug, "versions"),
+			Latest:      joinURL(root, ver.Slug, registry.ChannelToStr(channel), "latest"),
+			Icon:        joinURL(root, ver.Slug, ver.Version, "icon"),
+			Screenshots: joinURL(root, ver.Slug, ver.Version, "screenshots.json"),
+		},
+	}
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/ratelimit"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Keys in the echo context of the editor of a failed authentication, and of
+// the remaining duration of its lockout.
+const (
+	failedEditorKey = "failed_editor"
+	lockedEditorKey = "locked_editor"
+)
+
+// authLockout middleware counts the failed authentications with a token, and
+// rejects the requests of the clients that are locked out after too many
+// failures. The failures are also logged, for the audit.
+func authLockout(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
+		if !strings.HasPrefix(authHeader, authTokenScheme) {
+			return next(c)
+		}
+
+		ip := c.RealIP()
+		locked, err := ratelimit.Locked(ratelimit.LockoutIP, ip)
+		if err != nil {
+			// The registry should still work if Redis is not available
+			requestLogger(c).WithFields(logrus.Fields{
+				"nspace":    "auth",
+				"error_msg": err,
+			}).Warn("Cannot check the lockout")
+		} else if locked > 0 {
+			return lockedOut(c, locked)
+		}
+
+		err = next(c)
+		if e, ok := err.(*errshttp.Error); !ok || e.StatusCode() != http.StatusUnauthorized {
+			return err
+		}
+		if locked, ok := c.Get(lockedEditorKey).(time.Duration); ok {
+			return lockedOut(c, locked)
+		}
+		recordAuthFailure(c, ip, err)
+		return err
+	}
+}
+
+// editorLockoutClient returns the client for the lockouts of an editor: the
+// failures are counted by IP address and editor, so that a client can't lock
+// out the editor for the other clients.
+func editorLockoutClient(ip, editorName string) string {
+	return ip + "|" + editorName
+}
+
+// checkEditorLockout returns an error if the client is locked out after too
+// many failed authentications with tokens for the applications of the editor.
+// It is only checked for the tokens that can't be verified.
+func checkEditorLockout(c echo.Context, editorName string) error {
+	client := editorLockoutClient(c.RealIP(), editorName)
+	locked, err := ratelimit.Locked(ratelimit.LockoutEditor, client)
+	if err != nil || locked <= 0 {
+		return nil
+	}
+	c.Set(lockedEditorKey, locked)
+	return errshttp.NewError(http.StatusUnauthorized,
+		"Too many failed authentications for editor %s", editorName)
+}
+
+func recordAuthFailure(c echo.Context, ip string, cause error) {
+	log := requestLogger(c).WithFields(logrus.Fields{
+		"nspace":    "audit",
+		"ip":        ip,
+		"method":    c.Request().Method,
+		"path":      c.Request().URL.Path,
+		"error_msg": cause,
+	})
+	if token, err := extractAuthHeader(c); err == nil {
+		log = log.WithField("token_id", auth.TokenHash(token))
+	}
+	editorName, _ := c.Get(failedEditorKey).(string)
+	if editorName != "" {
+		log = log.WithField("editor", editorName)
+	}
+	log.Warn("Authentication failed")
+
+	clients := map[string]string{ratelimit.LockoutIP: ip}
+	if editorName != "" {
+		clients[ratelimit.LockoutEditor] = editorLockoutClient(ip, editorName)
+	}
+	for kind, client := range clients {
+		d, err := ratelimit.Failure(kind, client)
+		if err != nil {
+			log.WithField("lockout_error", err).Warn("Cannot count the failed authentication")
+			continue
+		}
+		if d > 0 {
+			log.WithFields(logrus.Fields{
+				"lockout_kind":     kind,
+				"lockout_client":   client,
+				"lockout_duration": d.String(),
+			}).Warn("Client locked out after too many failed authentications")
+		}
+	}
+}
+
+func lockedOut(c echo.Context, locked time.Duration) error {
+	seconds := int(math.Ceil(locked.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	return errshttp.NewError(http.StatusTooManyRequests,
+		"Too many failed authentications, retry in %d seconds", seconds)
+}
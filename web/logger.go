@@ -0,0 +1,48 @@
+package web
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/cozy/cozy-apps-registry/base"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// validRequestIDReg is the format of the request IDs accepted from the
+// clients (or from the reverse proxy) in the X-Request-Id header.
+var validRequestIDReg = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID middleware gives an ID to the request, or keeps the one sent in
+// the X-Request-Id header, and sends it back in the response. The logs made
+// for the request are tagged with this ID, via the logger of the context of
+// the request.
+func requestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := req.Header.Get(echo.HeaderXRequestID)
+		if !validRequestIDReg.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+		log := logrus.WithField("request_id", id)
+		c.SetRequest(req.WithContext(base.WithLogger(req.Context(), log)))
+		return next(c)
+	}
+}
+
+// requestLogger returns the logger of the request, tagged with its ID.
+func requestLogger(c echo.Context) *logrus.Entry {
+	return base.Logger(c.Request().Context())
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,258 @@
+package web
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultLoginScope is the scope of the tokens given to the CLI when no scope
+// has been asked: all the applications of the editor.
+const defaultLoginScope = "*"
+
+// proxySecretHeader is the HTTP header with the secret shared with the
+// authenticating proxy.
+const proxySecretHeader = "X-Registry-Proxy-Secret"
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Cozy apps registry - Login</title>
+</head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Form}}
+<p>Logged in as <strong>{{.Identity}}</strong>. Enter the code displayed by the command line:</p>
+<form method="post" action="/login/device/verify">
+<input name="user_code" value="{{.UserCode}}" autocomplete="off" required>
+<button name="action" value="approve">Approve</button>
+<button name="action" value="deny">Deny</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type loginPageData struct {
+	Identity string
+	UserCode string
+	Message  string
+	Form     bool
+}
+
+// LoginRoutes sets the routes for the login of the editors from the CLI, with
+// the device-code flow.
+func LoginRoutes(g *echo.Group) {
+	g.POST("/device", startDeviceLogin, jsonEndpoint, ensureLoginEnabled)
+	g.POST("/token", pollDeviceLogin, jsonEndpoint, ensureLoginEnabled)
+	g.GET("/device", showDeviceLogin, ensureLoginEnabled)
+	g.POST("/device/verify", verifyDeviceLogin, ensureLoginEnabled)
+}
+
+func ensureLoginEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !base.Config.Login.Enabled {
+			return errshttp.NewError(http.StatusNotFound, "Login is not enabled on this registry")
+		}
+		return next(c)
+	}
+}
+
+func startDeviceLogin(c echo.Context) (err error) {
+	var opts struct {
+		Editor string `json:"editor"`
+		Scope  string `json:"scope"`
+	}
+	if err = c.Bind(&opts); err != nil {
+		return err
+	}
+	if opts.Editor == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing editor")
+	}
+	if opts.Scope == "" {
+		opts.Scope = defaultLoginScope
+	}
+	if _, err := path.Match(opts.Scope, ""); err != nil {
+		return errshttp.NewError(http.StatusBadRequest, "Invalid scope: %s", err)
+	}
+	editor, err := auth.Editors.GetEditor(opts.Editor)
+	if err != nil {
+		return err
+	}
+	conf := base.Config.Login
+	login, deviceCode, err := auth.DeviceLogins.Create(editor, opts.Scope, conf.CodeTTL)
+	if err != nil {
+		return err
+	}
+	verification := &url.URL{
+		Scheme: c.Scheme(),
+		Host:   c.Request().Host,
+		Path:   "/login/device",
+	}
+	complete := *verification
+	complete.RawQuery = url.Values{"user_code": {login.UserCode}}.Encode()
+	return c.JSON(http.StatusOK, echo.Map{
+		"device_code":               deviceCode,
+		"user_code":                 login.UserCode,
+		"verification_uri":          verification.String(),
+		"verification_uri_complete": complete.String(),
+		"expires_in":                int(conf.CodeTTL.Seconds()),
+		"interval":                  int(conf.Interval.Seconds()),
+	})
+}
+
+func pollDeviceLogin(c echo.Context) (err error) {
+	var opts struct {
+		DeviceCode string `json:"device_code"`
+	}
+	if err = c.Bind(&opts); err != nil {
+		return err
+	}
+	login, err := auth.DeviceLogins.Consume(opts.DeviceCode)
+	if err == auth.ErrDeviceLoginPending {
+		return c.JSON(http.StatusAccepted, echo.Map{"state": auth.DeviceLoginPending})
+	}
+	if err != nil {
+		return err
+	}
+	editor, err := auth.Editors.GetEditor(login.Editor)
+	if err != nil {
+		return err
+	}
+	maxAge := base.Config.Login.TokenTTL
+	token, err := editor.GenerateScopedEditorToken(base.SessionSecret, maxAge, login.Scope)
+	if err != nil {
+		return err
+	}
+	if err := auth.IssuedTokens.Record(editor, token, auth.EditorToken, "", login.Scope, maxAge); err != nil {
+		requestLogger(c).WithField("nspace", "login").
+			Warnf("Cannot record the token of %s: %s", editor.Name(), err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"token":      base64.StdEncoding.EncodeToString(token),
+		"editor":     editor.Name(),
+		"scope":      login.Scope,
+		"expires_at": time.Now().UTC().Add(maxAge),
+	})
+}
+
+// loginIdentity returns the identity of the user of the browser, as given by
+// the authenticating proxy in front of the registry. The identity header is
+// only trusted if the request comes from a trusted proxy, or has the secret
+// shared with the proxy: otherwise, anybody could send it.
+func loginIdentity(c echo.Context) (string, error) {
+	if !fromAuthenticatingProxy(c.Request()) {
+		return "", errshttp.NewError(http.StatusUnauthorized, "Untrusted identity")
+	}
+	identity := c.Request().Header.Get(base.Config.Login.IdentityHeader)
+	if identity == "" {
+		return "", errshttp.NewError(http.StatusUnauthorized, "Missing identity")
+	}
+	return identity, nil
+}
+
+func fromAuthenticatingProxy(req *http.Request) bool {
+	if secret := base.Config.Login.ProxySecret; secret != "" {
+		given := req.Header.Get(proxySecretHeader)
+		if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1 {
+			return true
+		}
+	}
+	// The IP address of the connection, not the one from X-Forwarded-For
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range base.Config.TrustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameOrigin returns true if the request has been sent by a page of the
+// registry. The Origin header is used, or the Referer if the browser has not
+// sent it, and the requests without both are rejected.
+func isSameOrigin(c echo.Context) bool {
+	origin := c.Request().Header.Get(echo.HeaderOrigin)
+	if origin == "" || origin == "null" {
+		origin = c.Request().Referer()
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == c.Request().Host
+}
+
+func showDeviceLogin(c echo.Context) error {
+	identity, err := loginIdentity(c)
+	if err != nil {
+		return err
+	}
+	return renderLoginPage(c, http.StatusOK, loginPageData{
+		Identity: identity,
+		UserCode: c.QueryParam("user_code"),
+		Form:     true,
+	})
+}
+
+func verifyDeviceLogin(c echo.Context) error {
+	identity, err := loginIdentity(c)
+	if err != nil {
+		return err
+	}
+	// The validation can't be made from a form on another site
+	if !isSameOrigin(c) {
+		return errshttp.NewError(http.StatusForbidden, "Invalid origin")
+	}
+	login, err := auth.DeviceLogins.FindByUserCode(c.FormValue("user_code"))
+	if err == auth.ErrDeviceLoginNotFound {
+		return renderLoginPage(c, http.StatusNotFound, loginPageData{
+			Identity: identity,
+			Message:  "This code is invalid or has expired.",
+			Form:     true,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if !base.Config.Login.IsApprovedIdentity(login.Editor, identity) {
+		return renderLoginPage(c, http.StatusForbidden, loginPageData{
+			Message: identity + " is not allowed to login as " + login.Editor + ".",
+		})
+	}
+	approved := c.FormValue("action") == "approve"
+	if err := auth.DeviceLogins.Validate(login, identity, approved); err != nil {
+		return err
+	}
+	msg := "The login has been denied."
+	if approved {
+		msg = "The login as " + login.Editor + " has been approved, you can go back to the command line."
+	}
+	return renderLoginPage(c, http.StatusOK, loginPageData{Message: msg})
+}
+
+func renderLoginPage(c echo.Context, code int, data loginPageData) error {
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	c.Response().Header().Set("X-Frame-Options", "DENY")
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().WriteHeader(code)
+	return loginPage.Execute(c.Response(), data)
+}
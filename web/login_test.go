@@ -0,0 +1,199 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	loginEditor      = "logineditor"
+	approvedIdentity = "alice@example.org"
+	loginSecret      = "a-long-random-string"
+)
+
+// setupLogin enables the login, and returns a function to restore the
+// configuration.
+func setupLogin(t *testing.T) func() {
+	conf, proxies, secret := base.Config.Login, base.Config.TrustedProxies, base.SessionSecret
+	restore := func() {
+		base.Config.Login = conf
+		base.Config.TrustedProxies = proxies
+		base.SessionSecret = secret
+	}
+	base.Config.Login = base.LoginParameters{
+		Enabled:        true,
+		IdentityHeader: "X-Forwarded-Email",
+		Identities:     map[string][]string{loginEditor: {approvedIdentity}},
+		CodeTTL:        10 * time.Minute,
+		TokenTTL:       time.Hour,
+		Interval:       5 * time.Second,
+		ProxySecret:    loginSecret,
+	}
+	base.Config.TrustedProxies = nil
+	if len(base.SessionSecret) == 0 {
+		base.SessionSecret = []byte("session-secret-for-the-tests")
+	}
+	if _, err := auth.Editors.GetEditor(loginEditor); err != nil {
+		_, err = auth.Editors.CreateEditorWithoutPublicKey(loginEditor, true)
+		require.NoError(t, err)
+	}
+	return restore
+}
+
+func startLogin(t *testing.T) (deviceCode, userCode string) {
+	body := bytes.NewBufferString(fmt.Sprintf(`{"editor": %q}`, loginEditor))
+	res, err := http.Post(server.URL+"/login/device", "application/json", body)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var data map[string]interface{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&data))
+	return data["device_code"].(string), data["user_code"].(string)
+}
+
+func pollLogin(t *testing.T, deviceCode string) (int, map[string]interface{}) {
+	body := bytes.NewBufferString(fmt.Sprintf(`{"device_code": %q}`, deviceCode))
+	res, err := http.Post(server.URL+"/login/token", "application/json", body)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var data map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&data)
+	return res.StatusCode, data
+}
+
+type verifyOptions struct {
+	secret   string
+	identity string
+	origin   string
+}
+
+func verifyLogin(t *testing.T, userCode, action string, opts verifyOptions) int {
+	form := url.Values{"user_code": {userCode}, "action": {action}}
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/login/device/verify",
+		strings.NewReader(form.Encode()))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if opts.secret != "" {
+		req.Header.Set(proxySecretHeader, opts.secret)
+	}
+	if opts.identity != "" {
+		req.Header.Set("X-Forwarded-Email", opts.identity)
+	}
+	if opts.origin != "" {
+		req.Header.Set("Origin", opts.origin)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func trustedVerify() verifyOptions {
+	return verifyOptions{secret: loginSecret, identity: approvedIdentity, origin: server.URL}
+}
+
+func TestLoginApprove(t *testing.T) {
+	defer setupLogin(t)()
+	deviceCode, userCode := startLogin(t)
+
+	code, data := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusAccepted, code)
+	assert.Equal(t, auth.DeviceLoginPending, data["state"])
+
+	// The user code is accepted in lower case and without the dash
+	typed := strings.ToLower(strings.Replace(userCode, "-", "", 1))
+	assert.Equal(t, http.StatusOK, verifyLogin(t, typed, "approve", trustedVerify()))
+
+	code, data = pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, loginEditor, data["editor"])
+	assert.Equal(t, defaultLoginScope, data["scope"])
+	assert.NotEmpty(t, data["token"])
+
+	// The device code can be exchanged only once
+	code, _ = pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLoginDeny(t *testing.T) {
+	defer setupLogin(t)()
+	deviceCode, userCode := startLogin(t)
+	assert.Equal(t, http.StatusOK, verifyLogin(t, userCode, "deny", trustedVerify()))
+
+	code, _ := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// The denied code can't be approved later
+	assert.Equal(t, http.StatusNotFound, verifyLogin(t, userCode, "approve", trustedVerify()))
+}
+
+func TestLoginNotApprovedIdentity(t *testing.T) {
+	defer setupLogin(t)()
+	deviceCode, userCode := startLogin(t)
+	opts := trustedVerify()
+	opts.identity = "mallory@example.org"
+	assert.Equal(t, http.StatusForbidden, verifyLogin(t, userCode, "approve", opts))
+
+	code, _ := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusAccepted, code)
+}
+
+func TestLoginExpired(t *testing.T) {
+	defer setupLogin(t)()
+	editor, err := auth.Editors.GetEditor(loginEditor)
+	require.NoError(t, err)
+	login, deviceCode, err := auth.DeviceLogins.Create(editor, defaultLoginScope, -time.Minute)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusNotFound, verifyLogin(t, login.UserCode, "approve", trustedVerify()))
+	code, _ := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestLoginSpoofedIdentity(t *testing.T) {
+	defer setupLogin(t)()
+	deviceCode, userCode := startLogin(t)
+
+	// Without the secret, from an untrusted address
+	opts := trustedVerify()
+	opts.secret = ""
+	assert.Equal(t, http.StatusUnauthorized, verifyLogin(t, userCode, "approve", opts))
+	opts.secret = "not-the-secret"
+	assert.Equal(t, http.StatusUnauthorized, verifyLogin(t, userCode, "approve", opts))
+	code, _ := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusAccepted, code)
+
+	// From a trusted proxy, the secret is not needed
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	base.Config.TrustedProxies = []*net.IPNet{loopback}
+	opts.secret = ""
+	assert.Equal(t, http.StatusOK, verifyLogin(t, userCode, "approve", opts))
+	code, _ = pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestLoginVerifyOrigin(t *testing.T) {
+	defer setupLogin(t)()
+	deviceCode, userCode := startLogin(t)
+
+	opts := trustedVerify()
+	opts.origin = ""
+	assert.Equal(t, http.StatusForbidden, verifyLogin(t, userCode, "approve", opts))
+	opts.origin = "https://evil.example.org"
+	assert.Equal(t, http.StatusForbidden, verifyLogin(t, userCode, "approve", opts))
+
+	code, _ := pollLogin(t, deviceCode)
+	assert.Equal(t, http.StatusAccepted, code)
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/ratelimit"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// rateLimit middleware rejects the requests with a 429 Too Many Requests when
+// the client has made too many requests for this class of endpoints.
+func rateLimit(class string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			retryAfter, err := ratelimit.Check(class, rateLimitClient(c))
+			if err != nil {
+				// The registry should still work if Redis is not available
+				requestLogger(c).WithFields(logrus.Fields{
+					"nspace":    "rate_limit",
+					"error_msg": err,
+				}).Warn("Cannot check the rate limit")
+				return next(c)
+			}
+			if retryAfter > 0 {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+				return errshttp.NewError(http.StatusTooManyRequests,
+					"Too many requests, retry in %d seconds", seconds)
+			}
+			return next(c)
+		}
+	}
+}
+
+// rateLimitClient returns the identifier of the client for the rate limits:
+// its token if the request has a valid one, or else its IP address. Only the
+// valid tokens are used, so that a client can't bypass the limit of its IP
+// address by sending random tokens.
+func rateLimitClient(c echo.Context) string {
+	if token, err := extractAuthHeader(c); err == nil {
+		if auth.VerifyTokenAuthentication(base.SessionSecret, token) {
+			return "token:" + auth.TokenHash(token)
+		}
+	}
+	return "ip:" + c.RealIP()
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -15,6 +16,8 @@ import (
 	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
 	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/manifest"
+	"github.com/cozy/cozy-apps-registry/ratelimit"
 	"github.com/cozy/cozy-apps-registry/registry"
 	"github.com/cozy/cozy-apps-registry/space"
 
@@ -26,6 +29,23 @@ import (
 const authTokenScheme = "Token "
 const spaceKey = "space"
 
+// tokenEditorKey is the key in the echo context of the name of the editor
+// whose token has been verified by checkPermissions.
+const tokenEditorKey = "token_editor"
+
+// manifestRevisionKey is the key in the echo context of the revision of the
+// schema of the manifests asked by the client.
+const manifestRevisionKey = "manifest_revision"
+
+// manifestVersionHeader is the header that the old stacks can send, instead
+// of the manifest_version parameter, to ask the manifests in the revision of
+// the schema that they know.
+const manifestVersionHeader = "X-Manifest-Version"
+
+// adminEditor is the editor whose master token gives access to the
+// administration endpoints.
+const adminEditor = "cozy"
+
 var errSpaceNotFound = base.Error{Code: 404, Wrapped: errors.New("Cannot find space")}
 
 var (
@@ -34,21 +54,77 @@ var (
 	oneYear    = 365 * 24 * time.Hour
 )
 
-// Do not show internal identifier and revision
+// Do not show internal identifier and revision, nor the legal hold and the
+// provenance. The changelog has its own endpoint.
 func cleanVersion(version *registry.Version) {
 	version.ID = ""
 	version.Rev = ""
+	version.LegalHold = nil
+	version.Provenance = nil
+	version.Changelog = ""
 }
 
-// Do not show internal identifier and revision
+// Do not show internal identifier and revision, nor the legal hold and the
+// moderation
 func cleanApp(app *registry.App) {
 	app.ID = ""
 	app.Rev = ""
+	app.LegalHold = nil
+	app.Moderation = nil
 	if app.LatestVersion != nil {
 		cleanVersion(app.LatestVersion)
 	}
 }
 
+// manifestRevision middleware reads the revision of the schema of the
+// manifests asked by the client, in the manifest_version parameter or in the
+// X-Manifest-Version header. The current revision is used by default.
+func manifestRevision(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Add(echo.HeaderVary, manifestVersionHeader)
+		value := c.QueryParam("manifest_version")
+		if value == "" {
+			value = c.Request().Header.Get(manifestVersionHeader)
+		}
+		revision := manifest.CurrentRevision
+		if value != "" {
+			var err error
+			if revision, err = manifest.ParseRevision(value); err != nil {
+				return errshttp.NewError(http.StatusBadRequest, err.Error())
+			}
+		}
+		c.Set(manifestRevisionKey, revision)
+		return next(c)
+	}
+}
+
+func getManifestRevision(c echo.Context) int {
+	if revision, ok := c.Get(manifestRevisionKey).(int); ok {
+		return revision
+	}
+	return manifest.CurrentRevision
+}
+
+// compatManifest rewrites the manifest of the version in the revision of the
+// schema asked by the client.
+func compatManifest(c echo.Context, version *registry.Version) error {
+	content, err := manifest.Downgrade(version.Manifest, getManifestRevision(c))
+	if err != nil {
+		return errshttp.NewError(http.StatusInternalServerError, "Cannot convert the manifest: %s", err)
+	}
+	version.Manifest = content
+	return nil
+}
+
+// compatAppManifest rewrites the manifest of the latest version of the
+// application in the revision of the schema asked by the client.
+func compatAppManifest(c echo.Context, app *registry.App) error {
+	if app.LatestVersion == nil {
+		return nil
+	}
+	return compatManifest(c, app.LatestVersion)
+}
+
 func checkAuthorized(c echo.Context) error {
 	token, err := extractAuthHeader(c)
 	if err != nil {
@@ -57,6 +133,21 @@ func checkAuthorized(c echo.Context) error {
 	if !auth.VerifyTokenAuthentication(base.SessionSecret, token) {
 		return errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
 	}
+	return checkNotRevoked(token)
+}
+
+// checkNotRevoked returns an error if the token is in the revocation list.
+func checkNotRevoked(token []byte) error {
+	if auth.Revocations == nil {
+		return nil
+	}
+	revoked, err := auth.Revocations.IsRevoked(token)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errshttp.NewError(http.StatusUnauthorized, "Token has been revoked")
+	}
 	return nil
 }
 
@@ -65,13 +156,18 @@ func checkPermissions(c echo.Context, editorName string, appName string, master
 	if err != nil {
 		return nil, err
 	}
+	if err := checkNotRevoked(token); err != nil {
+		return nil, err
+	}
 	editor, err := auth.Editors.GetEditor(editorName)
 	if err != nil {
 		return nil, errshttp.NewError(http.StatusUnauthorized, "Could not find editor: %s", editorName)
 	}
 	ok := false
 	if !master {
-		ok = editor.VerifyEditorToken(base.SessionSecret, token, appName)
+		if ok = editor.VerifyEditorToken(base.SessionSecret, token, appName); ok {
+			c.Set(tokenEditorKey, editor.Name())
+		}
 	}
 	if !ok {
 		editors, err := auth.Editors.AllEditors()
@@ -80,16 +176,110 @@ func checkPermissions(c echo.Context, editorName string, appName string, master
 		}
 		for _, e := range editors {
 			if ok = e.VerifyMasterToken(base.SessionSecret, token); ok {
+				c.Set(tokenEditorKey, e.Name())
 				break
 			}
 		}
 	}
 	if !ok {
+		// The valid tokens are accepted during a lockout, so that the
+		// failures of a client can't lock out the editor for the others
+		if err := checkEditorLockout(c, editor.Name()); err != nil {
+			return nil, err
+		}
+		c.Set(failedEditorKey, editor.Name())
 		return nil, errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
 	}
 	return editor, nil
 }
 
+// checkAdmin checks that the request has been made with the master token of
+// the cozy editor (see adminEditor), as the administration endpoints are
+// restricted to it, or by an operator authenticated by one of the admin
+// providers (OIDC). The master tokens of the other editors are refused.
+func checkAdmin(c echo.Context) error {
+	authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth.AdminProviders) == 0 || strings.HasPrefix(authHeader, authTokenScheme) {
+		return checkAdminToken(c)
+	}
+	for _, provider := range auth.AdminProviders {
+		_, err := provider.Authenticate(c.Request())
+		if err == auth.ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(*errshttp.Error); ok {
+				return err
+			}
+			return errshttp.NewError(http.StatusUnauthorized, err.Error())
+		}
+		return nil
+	}
+	return checkAdminToken(c)
+}
+
+// checkAdminToken checks that the request has been made with the master
+// token of the admin editor. Unlike checkPermissions, the master tokens of the
+// other editors are not accepted: a publisher must not be able to review its
+// own versions.
+func checkAdminToken(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+	token, err := extractAuthHeader(c)
+	if err != nil {
+		return err
+	}
+	editor, err := auth.Editors.GetEditor(adminEditor)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, "Could not find editor: %s", adminEditor)
+	}
+	if !editor.VerifyMasterToken(base.SessionSecret, token) {
+		if err := checkEditorLockout(c, editor.Name()); err != nil {
+			return err
+		}
+		c.Set(failedEditorKey, editor.Name())
+		return errshttp.NewError(http.StatusUnauthorized, "Token could not be verified")
+	}
+	c.Set(tokenEditorKey, editor.Name())
+	return nil
+}
+
+// checkRole returns true if the request has been made with a role token of
+// the admin editor for the given role.
+func checkRole(c echo.Context, role string) bool {
+	token, err := extractAuthHeader(c)
+	if err != nil {
+		return false
+	}
+	if checkNotRevoked(token) != nil {
+		return false
+	}
+	editor, err := auth.Editors.GetEditor(adminEditor)
+	if err != nil {
+		return false
+	}
+	if r, ok := editor.VerifyRoleToken(base.SessionSecret, token); !ok || r != role {
+		return false
+	}
+	c.Set(tokenEditorKey, editor.Name())
+	return true
+}
+
+// checkPermissionsOrRole is the same as checkPermissions, but a role token
+// with the given role is also accepted, for the applications of all the
+// editors.
+func checkPermissionsOrRole(c echo.Context, editorName, appName string, master bool, role string) (*auth.Editor, error) {
+	if checkRole(c, role) {
+		editor, err := auth.Editors.GetEditor(editorName)
+		if err != nil {
+			return nil, errshttp.NewError(http.StatusUnauthorized, "Could not find editor: %s", editorName)
+		}
+		return editor, nil
+	}
+	return checkPermissions(c, editorName, appName, master)
+}
+
 func extractAuthHeader(c echo.Context) ([]byte, error) {
 	authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
 	if !strings.HasPrefix(authHeader, authTokenScheme) {
@@ -108,17 +298,11 @@ func extractAuthHeader(c echo.Context) ([]byte, error) {
 
 func filterGetMaintenanceApps(virtual base.VirtualSpace) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		apps, err := registry.GetMaintainanceApps(getSpace(c))
+		apps, err := registry.GetMaintainanceAppsInVirtualSpace(&virtual, getSpace(c))
 		if err != nil {
 			return err
 		}
-		filtered := apps[:0]
-		for _, app := range apps {
-			if virtual.AcceptApp(app.Slug) {
-				filtered = append(filtered, app)
-			}
-		}
-		return writeJSON(c, filtered)
+		return writeJSON(c, apps)
 	}
 }
 
@@ -154,12 +338,30 @@ func ensureSpace(spaceName string) echo.MiddlewareFunc {
 			if !ok {
 				return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Space %q does not exist", spaceName))
 			}
+			method := c.Request().Method
+			if method != http.MethodGet && method != http.MethodHead && registry.IsSpaceReadOnly(spaceName) {
+				return errshttp.NewError(http.StatusServiceUnavailable,
+					"The space %q is in read-only mode", spaceName)
+			}
 			c.Set(spaceKey, space)
 			return next(c)
 		}
 	}
 }
 
+// robotsTag middleware adds a X-Robots-Tag header to the responses of a
+// space that must not be indexed by the search engines.
+func robotsTag(spaceName string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !registry.GetRobotsPolicy(spaceName).Index {
+				c.Response().Header().Set("X-Robots-Tag", "noindex, nofollow")
+			}
+			return next(c)
+		}
+	}
+}
+
 func getSpace(c echo.Context) *space.Space {
 	return c.Get(spaceKey).(*space.Space)
 }
@@ -179,6 +381,36 @@ func getSpaceFromHost(c echo.Context) (*space.Space, error) {
 	return nil, errSpaceNotFound
 }
 
+// robotsTxt tells the crawlers which spaces they can index. When the request
+// is made on a domain linked to a space, the policy of this space applies to
+// the whole domain.
+func robotsTxt(c echo.Context) error {
+	var sb strings.Builder
+	sb.WriteString("User-agent: *\n")
+
+	if s, err := getSpaceFromHost(c); err == nil {
+		if registry.GetRobotsPolicy(s.Name).Index {
+			sb.WriteString("Allow: /\n")
+		} else {
+			sb.WriteString("Disallow: /\n")
+		}
+		return c.String(http.StatusOK, sb.String())
+	}
+
+	for _, policy := range registry.ListRobotsPolicies() {
+		if !policy.Index {
+			continue
+		}
+		if policy.Space == base.DefaultSpacePrefix.String() {
+			sb.WriteString("Allow: /registry\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("Allow: /%s/registry\n", url.PathEscape(policy.Space)))
+		}
+	}
+	sb.WriteString("Disallow: /\n")
+	return c.String(http.StatusOK, sb.String())
+}
+
 func getVersionsChannel(c echo.Context, defaultChannel registry.Channel) registry.Channel {
 	queryParam := c.QueryParam("versionsChannel")
 	if queryParam == "" {
@@ -198,30 +430,41 @@ func validateAppRequest(c echo.Context, app *registry.AppOptions) error {
 	return nil
 }
 
-func validateVersionRequest(c echo.Context, ver *registry.VersionOptions) error {
+func validateVersionRequest(ver *registry.VersionOptions) error {
 	if err := registry.IsValidVersion(ver); err != nil {
 		return wrapErr(err, http.StatusBadRequest)
 	}
 	return nil
 }
 
-func httpErrorHandler(err error, c echo.Context) {
-	code := http.StatusInternalServerError
-	desc := err.Error()
-	msg := desc
-
-	isJSON, _ := c.Get("json").(bool)
-
+// errorStatus returns the HTTP status code and the description of an error.
+func errorStatus(err error) (code int, desc string) {
+	code = http.StatusInternalServerError
+	desc = err.Error()
 	if he, ok := err.(*errshttp.Error); ok {
 		code = he.StatusCode()
 	} else if be, ok := err.(base.Error); ok {
 		code = be.Code
-		msg = be.Message()
+	} else if ve, ok := err.(*manifest.ValidationError); ok {
+		code = ve.StatusCode()
 	} else if he, ok := err.(*echo.HTTPError); ok {
 		code = he.Code
 		desc = fmt.Sprintf("%s", he.Message)
-		msg = desc
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		// A request to CouchDB has taken longer than its timeout
+		code = http.StatusGatewayTimeout
 	}
+	return code, desc
+}
+
+func httpErrorHandler(err error, c echo.Context) {
+	code, desc := errorStatus(err)
+	msg := desc
+	if be, ok := err.(base.Error); ok {
+		msg = be.Message()
+	}
+
+	isJSON, _ := c.Get("json").(bool)
 
 	respHeaders := c.Response().Header()
 	switch err {
@@ -231,7 +474,7 @@ func httpErrorHandler(err error, c echo.Context) {
 		respHeaders.Set("cache-control", "no-cache")
 	}
 
-	log := logrus.WithFields(logrus.Fields{
+	log := requestLogger(c).WithFields(logrus.Fields{
 		"nspace":      "http_error",
 		"is_json":     isJSON,
 		"method":      c.Request().Method,
@@ -248,6 +491,11 @@ func httpErrorHandler(err error, c echo.Context) {
 		log.Info()
 	}
 
+	body := echo.Map{"error": desc}
+	if ve, ok := err.(*manifest.ValidationError); ok {
+		body["violations"] = ve.Violations
+	}
+
 	err = nil
 	if !c.Response().Committed {
 		if isJSON {
@@ -255,7 +503,7 @@ func httpErrorHandler(err error, c echo.Context) {
 				c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
 				err = c.NoContent(code)
 			} else {
-				err = c.JSON(code, echo.Map{"error": desc})
+				err = c.JSON(code, body)
 			}
 		} else {
 			if c.Request().Method == echo.HEAD {
@@ -268,7 +516,7 @@ func httpErrorHandler(err error, c echo.Context) {
 	}
 
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
+		requestLogger(c).WithFields(logrus.Fields{
 			"nspace": "http_error",
 		}).Debugf("Cannot send the error response: %s", err)
 	}
@@ -290,18 +538,30 @@ func cacheControl(c echo.Context, rev string, maxAge time.Duration) bool {
 	headers.Set("date", time.Now().UTC().Format(http.TimeFormat))
 
 	if rev != "" {
-		headers.Set("etag", rev)
-		revMatches := strings.Split(c.Request().Header.Get("if-none-match"), ",")
-		for _, revMatch := range revMatches {
-			if strings.TrimSpace(revMatch) == rev {
-				return true
-			}
+		// The same document is served differently for the old revisions of
+		// the manifests
+		if revision := getManifestRevision(c); revision != manifest.CurrentRevision {
+			rev = fmt.Sprintf("%s-m%d", rev, revision)
 		}
+		headers.Set("etag", rev)
+		return etagMatches(c, rev)
 	}
 
 	return false
 }
 
+// etagMatches returns true if the ETag is in the If-None-Match header of the
+// request.
+func etagMatches(c echo.Context, etag string) bool {
+	revMatches := strings.Split(c.Request().Header.Get("if-none-match"), ",")
+	for _, revMatch := range revMatches {
+		if strings.TrimSpace(revMatch) == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // stripVersion removes the 'v' prefix if any.
 // ex: v1.3.2 -> 1.3.2
 func stripVersion(v string) string {
@@ -336,6 +596,26 @@ func filterAppInVirtualSpace(handler echo.HandlerFunc, virtual base.VirtualSpace
 	}
 }
 
+// ipExtractor returns how to find the IP address of a client, for the rate
+// limits, the lockouts and the logs. With trusted proxies, the X-Forwarded-For
+// header is only read when the request comes from one of them, as it can be
+// forged by the clients. Without them, the default extraction of echo is kept
+// (X-Forwarded-For, X-Real-IP, then the address of the connection).
+func ipExtractor() echo.IPExtractor {
+	if len(base.Config.TrustedProxies) == 0 {
+		return nil
+	}
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipRange := range base.Config.TrustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
 // Router sets up the HTTP routes.
 func Router() *echo.Echo {
 	err := initAssets()
@@ -347,10 +627,14 @@ func Router() *echo.Echo {
 	e.HideBanner = true
 	e.HidePort = true
 	e.HTTPErrorHandler = httpErrorHandler
+	e.IPExtractor = ipExtractor()
 
 	e.Pre(middleware.RemoveTrailingSlash())
+	e.Pre(requestID)
+	e.Pre(corsSpaces())
 	e.Use(middleware.BodyLimit("100K"))
 	e.Use(middleware.Recover())
+	e.Use(authLockout)
 
 	for _, c := range space.GetSpacesNames() {
 		var groupName string
@@ -359,50 +643,15 @@ func Router() *echo.Echo {
 		} else {
 			groupName = fmt.Sprintf("/%s/registry", url.PathEscape(c))
 		}
-		g := e.Group(groupName, ensureSpace(c))
-
-		g.POST("", createApp, jsonEndpoint, middleware.Gzip())
-		g.PATCH("/:app", patchApp, jsonEndpoint, middleware.Gzip())
-		g.POST("/:app", createVersion, jsonEndpoint, middleware.Gzip())
-
-		g.GET("", getAppsList, jsonEndpoint, middleware.Gzip())
-
-		g.HEAD("/pending", getPendingVersions, jsonEndpoint, middleware.Gzip())
-		g.GET("/pending", getPendingVersions, jsonEndpoint, middleware.Gzip())
-		g.PUT("/pending/:app/:version/approval", approvePendingVersion, middleware.Gzip())
-
-		g.GET("/maintenance", getMaintenanceApps, jsonEndpoint, middleware.Gzip())
-		g.PUT("/maintenance/:app/activate", activateMaintenanceApp, jsonEndpoint, middleware.Gzip())
-		g.PUT("/maintenance/:app/deactivate", deactivateMaintenanceApp, jsonEndpoint, middleware.Gzip())
-
-		g.HEAD("/:app", getApp, jsonEndpoint, middleware.Gzip())
-		g.GET("/:app", getApp, jsonEndpoint, middleware.Gzip())
-		g.GET("/:app/versions", getAppVersions, jsonEndpoint, middleware.Gzip())
-		g.HEAD("/:app/:version", getVersion, jsonEndpoint, middleware.Gzip())
-		g.GET("/:app/:version", getVersion, jsonEndpoint, middleware.Gzip())
-		g.HEAD("/:app/:channel/latest", getLatestVersion, jsonEndpoint, middleware.Gzip())
-		g.GET("/:app/:channel/latest", getLatestVersion, jsonEndpoint, middleware.Gzip())
-
-		g.GET("/:app/icon", getAppIcon)
-		g.HEAD("/:app/icon", getAppIcon)
-		g.GET("/:app/partnership_icon", getAppPartnershipIcon)
-		g.HEAD("/:app/partnership_icon", getAppPartnershipIcon)
-		g.GET("/:app/screenshots/*", getAppScreenshot)
-		g.HEAD("/:app/screenshots/*", getAppScreenshot)
-		g.GET("/:app/:channel/latest/icon", getAppIcon)
-		g.HEAD("/:app/:channel/latest/icon", getAppIcon)
-		g.HEAD("/:app/:channel/latest/screenshots/*", getAppScreenshot)
-		g.GET("/:app/:channel/latest/screenshots/*", getAppScreenshot)
-		g.HEAD("/:app/:version/icon", getVersionIcon)
-		g.GET("/:app/:version/icon", getVersionIcon)
-		g.HEAD("/:app/:version/partnership_icon", getVersionPartnershipIcon)
-		g.GET("/:app/:version/partnership_icon", getVersionPartnershipIcon)
-		g.HEAD("/:app/:version/screenshots/*", getVersionScreenshot)
-		g.GET("/:app/:version/screenshots/*", getVersionScreenshot)
-		g.HEAD("/:app/:version/tarball/:tarball", getVersionTarball)
-		g.GET("/:app/:version/tarball/:tarball", getVersionTarball)
+		g := e.Group(groupName, ensureSpace(c), robotsTag(c), manifestRevision)
+		spaceRoutes(g)
+		e.GET(groupName+".json", getBundle, ensureSpace(c), robotsTag(c), rateLimit(ratelimit.List), middleware.Gzip())
 	}
 
+	// The spaces created with the admin API
+	spaceRoutes(e.Group("/:space/registry", ensureCreatedSpace, manifestRevision))
+	e.GET("/:space/registry.json", getBundle, ensureCreatedSpace, rateLimit(ratelimit.List), middleware.Gzip())
+
 	for name, v := range base.Config.VirtualSpaces {
 		groupName := fmt.Sprintf("/%s/registry", url.PathEscape(name))
 
@@ -410,13 +659,20 @@ func Router() *echo.Echo {
 		if source == base.DefaultSpacePrefix.String() {
 			source = ""
 		}
-		g := e.Group(groupName, ensureSpace(source))
+		g := e.Group(groupName, ensureSpace(source), robotsTag(name), manifestRevision)
+		e.GET(groupName+".json", applyVirtualSpace(getBundle, v, name), ensureSpace(source), robotsTag(name), rateLimit(ratelimit.List), middleware.Gzip())
 
 		virtualGetAppsList := applyVirtualSpace(getAppsList, v, name)
-		g.GET("", virtualGetAppsList, jsonEndpoint, middleware.Gzip())
+		g.GET("", virtualGetAppsList, csvEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+		g.GET("/search", applyVirtualSpace(searchApps, v, name), jsonEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+		g.GET("/categories", applyVirtualSpace(getCategories, v, name), jsonEndpoint, middleware.Gzip())
+		g.GET("/konnectors/datatypes", applyVirtualSpace(getKonnectorsDataTypes, v, name), jsonEndpoint, middleware.Gzip())
+		g.POST("/_latest", applyVirtualSpace(getLatestVersions, v, name), jsonEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
 
 		filteredGetMaintenanceApps := filterGetMaintenanceApps(v)
 		g.GET("/maintenance", filteredGetMaintenanceApps, jsonEndpoint, middleware.Gzip())
+		filteredGetKonnectorsMaintenance := applyVirtualSpace(getKonnectorsMaintenance, v, name)
+		g.GET("/maintenance/konnectors", filteredGetKonnectorsMaintenance, jsonEndpoint, middleware.Gzip())
 		filteredActivateMaintenanceApp := applyVirtualSpace(activateMaintenanceApp, v, name)
 		g.PUT("/maintenance/:app/activate", filteredActivateMaintenanceApp, jsonEndpoint, middleware.Gzip())
 		filteredDeactivateMaintenanceApp := applyVirtualSpace(deactivateMaintenanceApp, v, name)
@@ -425,8 +681,12 @@ func Router() *echo.Echo {
 		filteredGetApp := applyVirtualSpace(filterAppInVirtualSpace(getApp, v), v, name)
 		g.HEAD("/:app", filteredGetApp, jsonEndpoint, middleware.Gzip())
 		g.GET("/:app", filteredGetApp, jsonEndpoint, middleware.Gzip())
+		g.DELETE("/:app/cache", applyVirtualSpace(purgeAppCache, v, name))
 		filteredGetAppVersions := applyVirtualSpace(filterAppInVirtualSpace(getAppVersions, v), v, name)
-		g.GET("/:app/versions", filteredGetAppVersions, jsonEndpoint, middleware.Gzip())
+		g.GET("/:app/versions", filteredGetAppVersions, csvEndpoint, middleware.Gzip())
+		filteredResolveVersion := applyVirtualSpace(filterAppInVirtualSpace(resolveVersion, v), v, name)
+		g.HEAD("/:app/resolve", filteredResolveVersion, jsonEndpoint, middleware.Gzip())
+		g.GET("/:app/resolve", filteredResolveVersion, jsonEndpoint, middleware.Gzip())
 		filteredGetVersion := applyVirtualSpace(filterAppInVirtualSpace(getVersion, v), v, name)
 		g.HEAD("/:app/:version", filteredGetVersion, jsonEndpoint, middleware.Gzip())
 		g.GET("/:app/:version", filteredGetVersion, jsonEndpoint, middleware.Gzip())
@@ -437,10 +697,10 @@ func Router() *echo.Echo {
 		filteredGetAppIcon := applyVirtualSpace(filterAppInVirtualSpace(getAppIcon, v), v, name)
 		g.GET("/:app/icon", filteredGetAppIcon)
 		g.HEAD("/:app/icon", filteredGetAppIcon)
-		filteredGetAppPartnershipIcon := filterAppInVirtualSpace(getAppPartnershipIcon, v)
+		filteredGetAppPartnershipIcon := applyVirtualSpace(filterAppInVirtualSpace(getAppPartnershipIcon, v), v, name)
 		g.GET("/:app/partnership_icon", filteredGetAppPartnershipIcon)
 		g.HEAD("/:app/partnership_icon", filteredGetAppPartnershipIcon)
-		filteredGetAppScreenshot := filterAppInVirtualSpace(getAppScreenshot, v)
+		filteredGetAppScreenshot := applyVirtualSpace(filterAppInVirtualSpace(getAppScreenshot, v), v, name)
 		g.GET("/:app/screenshots/*", filteredGetAppScreenshot)
 		g.HEAD("/:app/screenshots/*", filteredGetAppScreenshot)
 		g.GET("/:app/:channel/latest/icon", filteredGetAppIcon)
@@ -453,6 +713,11 @@ func Router() *echo.Echo {
 		filteredGetVersionPartnershipIcon := filterAppInVirtualSpace(getVersionPartnershipIcon, v)
 		g.HEAD("/:app/:version/partnership_icon", filteredGetVersionPartnershipIcon)
 		g.GET("/:app/:version/partnership_icon", filteredGetVersionPartnershipIcon)
+		filteredGetVersionScreenshots := filterAppInVirtualSpace(getVersionScreenshots, v)
+		g.HEAD("/:app/:version/screenshots", filteredGetVersionScreenshots, jsonEndpoint, middleware.Gzip())
+		g.GET("/:app/:version/screenshots", filteredGetVersionScreenshots, jsonEndpoint, middleware.Gzip())
+		g.HEAD("/:app/:version/screenshots.json", filteredGetVersionScreenshots, jsonEndpoint, middleware.Gzip())
+		g.GET("/:app/:version/screenshots.json", filteredGetVersionScreenshots, jsonEndpoint, middleware.Gzip())
 		filteredGetVersionScreenshot := filterAppInVirtualSpace(getVersionScreenshot, v)
 		g.HEAD("/:app/:version/screenshots/*", filteredGetVersionScreenshot)
 		g.GET("/:app/:version/screenshots/*", filteredGetVersionScreenshot)
@@ -462,9 +727,19 @@ func Router() *echo.Echo {
 	}
 
 	e.GET("/editors", getEditorsList, jsonEndpoint, middleware.Gzip())
+	e.GET("/editors/me/apps", getMyApps, jsonEndpoint, middleware.Gzip())
+	e.GET("/editors/me/tokens", getMyTokens, jsonEndpoint, middleware.Gzip())
 	e.HEAD("/editors/:editor", getEditor, jsonEndpoint, middleware.Gzip())
 	e.GET("/editors/:editor", getEditor, jsonEndpoint, middleware.Gzip())
 
+	// The GraphQL routes are only registered when enabled, to not hide the
+	// universal links of an application with the graphql slug.
+	if base.Config.GraphQL.Enabled {
+		e.GET("/graphql", handleGraphQL, manifestRevision, rateLimit(ratelimit.List), middleware.Gzip())
+		e.POST("/graphql", handleGraphQL, manifestRevision, rateLimit(ratelimit.List), middleware.Gzip())
+		e.GET("/graphql/schema", getGraphQLSchema)
+	}
+
 	e.GET("/.well-known/:filename", universalLink, middleware.Gzip())
 	e.GET("/biwebauth", webAuthRedirect)
 	e.GET("/:slug", universalLinkRedirect)
@@ -473,17 +748,105 @@ func Router() *echo.Echo {
 	e.GET("/favicon.ico", func(c echo.Context) error {
 		return c.Blob(http.StatusOK, "image/png", faviconBytes)
 	})
-	e.GET("/robots.txt", func(c echo.Context) error {
-		return c.String(http.StatusOK, "User-agent: *\n"+
-			"Disallow: /")
-	}, middleware.Gzip())
+	e.GET("/robots.txt", robotsTxt, middleware.Gzip())
+
+	// Sandboxes routes
+	SandboxesRoutes(e.Group("/sandboxes"))
+
+	// Login routes
+	LoginRoutes(e.Group("/login"))
 
 	// Status routes
 	StatusRoutes(e.Group("/status"))
 
+	// Admin routes
+	AdminRoutes(e.Group("/admin", adminEndpoint))
+
 	return e
 }
 
+// spaceRoutes sets up the routes of the registry API for a space.
+func spaceRoutes(g *echo.Group) {
+	g.POST("", createApp, jsonEndpoint, rateLimit(ratelimit.Publish), middleware.Gzip())
+	g.POST("/_bulk", bulkPublish, jsonEndpoint, rateLimit(ratelimit.Publish), middleware.Gzip())
+	g.PATCH("/:app", patchApp, jsonEndpoint, middleware.Gzip())
+	g.POST("/:app", createVersion, jsonEndpoint, rateLimit(ratelimit.Publish), middleware.Gzip())
+	g.POST("/:app/publish-urls", createPublishURL, jsonEndpoint, middleware.Gzip())
+	g.POST("/:app/publish/:token", createVersionFromPublishURL, jsonEndpoint, rateLimit(ratelimit.Publish), middleware.Gzip())
+
+	g.GET("", getAppsList, csvEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+	g.GET("/_requirements", getPublishRequirements, jsonEndpoint, middleware.Gzip())
+	g.GET("/_diff", getListingDiff, jsonEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+	g.GET("/_leaderboard", getStatsLeaderboard, jsonEndpoint, middleware.Gzip())
+	g.POST("/_latest", getLatestVersions, jsonEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+	g.GET("/jobs/:id", getJob, jsonEndpoint)
+	g.GET("/search", searchApps, jsonEndpoint, rateLimit(ratelimit.List), middleware.Gzip())
+	g.GET("/categories", getCategories, jsonEndpoint, middleware.Gzip())
+	g.GET("/konnectors/datatypes", getKonnectorsDataTypes, jsonEndpoint, middleware.Gzip())
+
+	g.HEAD("/pending", getPendingVersions, jsonEndpoint, middleware.Gzip())
+	g.GET("/pending", getPendingVersions, jsonEndpoint, middleware.Gzip())
+	g.PUT("/pending/:app/:version/approval", approvePendingVersion, middleware.Gzip())
+
+	g.GET("/maintenance", getMaintenanceApps, jsonEndpoint, middleware.Gzip())
+	g.GET("/maintenance/konnectors", getKonnectorsMaintenance, jsonEndpoint, middleware.Gzip())
+	g.PUT("/maintenance/:app/activate", activateMaintenanceApp, jsonEndpoint, middleware.Gzip())
+	g.PUT("/maintenance/:app/deactivate", deactivateMaintenanceApp, jsonEndpoint, middleware.Gzip())
+	g.PUT("/maintenance/:app", putMaintenanceApp, jsonEndpoint, middleware.Gzip())
+	g.DELETE("/maintenance/:app", deleteMaintenanceApp, jsonEndpoint, middleware.Gzip())
+
+	g.HEAD("/:app", getApp, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app", getApp, jsonEndpoint, middleware.Gzip())
+	g.DELETE("/:app", deleteApp)
+	g.DELETE("/:app/cache", purgeAppCache)
+	g.PUT("/:app/external", putAppExternalSource, jsonEndpoint)
+	g.DELETE("/:app/external", deleteAppExternalSource)
+	g.GET("/:app/versions", getAppVersions, csvEndpoint, middleware.Gzip())
+	g.HEAD("/:app/resolve", resolveVersion, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/resolve", resolveVersion, jsonEndpoint, middleware.Gzip())
+	g.HEAD("/:app/changelog", getAppChangelog, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/changelog", getAppChangelog, jsonEndpoint, middleware.Gzip())
+	g.HEAD("/:app/diff", getVersionsDiff, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/diff", getVersionsDiff, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/trash", getAppTrash, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/stats", getAppStats, jsonEndpoint, middleware.Gzip())
+	g.POST("/:app/stats", pushAppStats, jsonEndpoint)
+	g.HEAD("/:app/:version", getVersion, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/:version", getVersion, jsonEndpoint, middleware.Gzip())
+	g.DELETE("/:app/:version", deleteVersion)
+	g.POST("/:app/:version/restore", restoreVersion, jsonEndpoint)
+	g.PUT("/:app/:version/keep-forever", setVersionKeepForever, jsonEndpoint)
+	g.GET("/:app/:version/provenance", getVersionProvenance, jsonEndpoint)
+	g.HEAD("/:app/:version/changelog", getVersionChangelog, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/:version/changelog", getVersionChangelog, jsonEndpoint, middleware.Gzip())
+	g.HEAD("/:app/:channel/latest", getLatestVersion, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/:channel/latest", getLatestVersion, jsonEndpoint, middleware.Gzip())
+
+	g.GET("/:app/icon", getAppIcon)
+	g.HEAD("/:app/icon", getAppIcon)
+	g.GET("/:app/partnership_icon", getAppPartnershipIcon)
+	g.HEAD("/:app/partnership_icon", getAppPartnershipIcon)
+	g.GET("/:app/screenshots/*", getAppScreenshot)
+	g.HEAD("/:app/screenshots/*", getAppScreenshot)
+	g.GET("/:app/:channel/latest/icon", getAppIcon)
+	g.HEAD("/:app/:channel/latest/icon", getAppIcon)
+	g.HEAD("/:app/:channel/latest/screenshots/*", getAppScreenshot)
+	g.GET("/:app/:channel/latest/screenshots/*", getAppScreenshot)
+	g.HEAD("/:app/:version/icon", getVersionIcon)
+	g.GET("/:app/:version/icon", getVersionIcon)
+	g.HEAD("/:app/:version/partnership_icon", getVersionPartnershipIcon)
+	g.GET("/:app/:version/partnership_icon", getVersionPartnershipIcon)
+	g.HEAD("/:app/:version/screenshots", getVersionScreenshots, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/:version/screenshots", getVersionScreenshots, jsonEndpoint, middleware.Gzip())
+	g.HEAD("/:app/:version/screenshots.json", getVersionScreenshots, jsonEndpoint, middleware.Gzip())
+	g.GET("/:app/:version/screenshots.json", getVersionScreenshots, jsonEndpoint, middleware.Gzip())
+	g.HEAD("/:app/:version/screenshots/*", getVersionScreenshot)
+	g.GET("/:app/:version/screenshots/*", getVersionScreenshot)
+	g.HEAD("/:app/:version/tarball/:tarball", getVersionTarball)
+	g.GET("/:app/:version/tarball/:tarball", getVersionTarball)
+	g.POST("/:app/:version/attachments/extract", extractVersionAttachments)
+}
+
 // ASSETS
 
 var faviconBytes []byte
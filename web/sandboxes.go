@@ -0,0 +1,154 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/labstack/echo/v4"
+)
+
+const sandboxKey = "sandbox"
+
+// SandboxesRoutes sets the routes for the sandboxes of the editors. The
+// registry API of a sandbox is served on /sandboxes/:editor/registry.
+func SandboxesRoutes(g *echo.Group) {
+	g.POST("", createSandbox, jsonEndpoint)
+	g.GET("/:editor", getSandbox, jsonEndpoint)
+	g.DELETE("/:editor", deleteSandbox)
+
+	spaceRoutes(g.Group("/:editor/registry", ensureSandbox))
+}
+
+// checkSandboxOwner checks that the request has been made with a master token
+// for the editor of the sandbox.
+func checkSandboxOwner(c echo.Context, editorName string) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+	if _, err := checkPermissions(c, editorName, "", true /* = master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+	return nil
+}
+
+func createSandbox(c echo.Context) (err error) {
+	var opts struct {
+		Editor string `json:"editor"`
+	}
+	if err = c.Bind(&opts); err != nil {
+		return err
+	}
+	if opts.Editor == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing editor")
+	}
+	if err = checkSandboxOwner(c, opts.Editor); err != nil {
+		return err
+	}
+	sandbox, err := registry.CreateSandbox(opts.Editor)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, newSandboxResponse(c, sandbox))
+}
+
+func getSandbox(c echo.Context) error {
+	editorName := c.Param("editor")
+	if err := checkSandboxOwner(c, editorName); err != nil {
+		return err
+	}
+	sandbox, err := registry.GetSandbox(editorName)
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, newSandboxResponse(c, sandbox))
+}
+
+func deleteSandbox(c echo.Context) error {
+	editorName := c.Param("editor")
+	if err := checkSandboxOwner(c, editorName); err != nil {
+		return err
+	}
+	sandbox, err := registry.GetSandbox(editorName)
+	if err != nil {
+		return err
+	}
+	if err = registry.DeleteSandbox(sandbox); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func newSandboxResponse(c echo.Context, sandbox *registry.Sandbox) echo.Map {
+	u := &url.URL{
+		Scheme: c.Scheme(),
+		Host:   c.Request().Host,
+		Path:   "/sandboxes/" + url.PathEscape(sandbox.Editor) + "/registry",
+	}
+	return echo.Map{
+		"editor":       sandbox.Editor,
+		"url":          u.String(),
+		"max_apps":     sandbox.MaxApps,
+		"max_versions": sandbox.MaxVersions,
+		"created_at":   sandbox.CreatedAt,
+		"last_used_at": sandbox.LastUsedAt,
+		"expires_at":   sandbox.ExpiresAt,
+	}
+}
+
+// ensureSandbox middleware uses the sandbox of the editor as the space of the
+// request. The sandboxes are never indexed by the search engines, and their
+// expiration is postponed when they are modified.
+func ensureSandbox(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sandbox, err := registry.GetSandbox(c.Param("editor"))
+		if err != nil {
+			return err
+		}
+		s, err := registry.SandboxSpace(sandbox)
+		if err != nil {
+			return err
+		}
+		method := c.Request().Method
+		if method != http.MethodGet && method != http.MethodHead {
+			if err := registry.TouchSandbox(sandbox); err != nil {
+				return err
+			}
+		}
+		c.Set(spaceKey, s)
+		c.Set(sandboxKey, sandbox)
+		c.Response().Header().Set("X-Robots-Tag", "noindex, nofollow")
+		return next(c)
+	}
+}
+
+// checkSandbox controls that an application of the given editor can be added
+// (newApp) or a new version published in the sandbox of the request, if any.
+func checkSandbox(c echo.Context, editorName string, newApp bool) error {
+	sandbox, _ := c.Get(sandboxKey).(*registry.Sandbox)
+	return checkInSandbox(sandbox, getSpace(c), editorName, newApp)
+}
+
+// checkInSandbox is checkSandbox for a sandbox that has already been read from
+// the request, nil if the request is not made in a sandbox.
+func checkInSandbox(sandbox *registry.Sandbox, s *space.Space, editorName string, newApp bool) error {
+	if sandbox == nil {
+		return nil
+	}
+	if !strings.EqualFold(editorName, sandbox.Editor) {
+		return errshttp.NewError(http.StatusForbidden,
+			"Only the applications of %s can be published in this sandbox", sandbox.Editor)
+	}
+	return registry.CheckSandboxQuota(sandbox, s, newApp)
+}
+
+func getAdminSandboxes(c echo.Context) error {
+	sandboxes, err := registry.ListSandboxes()
+	if err != nil {
+		return err
+	}
+	return writeJSON(c, sandboxes)
+}
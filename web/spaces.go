@@ -0,0 +1,196 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/cache"
+	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/space"
+	"github.com/go-kivik/kivik/v3"
+	"github.com/labstack/echo/v4"
+)
+
+// reservedSpaceNames are the names that can't be used for the spaces created
+// with the admin API, as their routes would be hidden by the other routes of
+// the registry.
+var reservedSpaceNames = map[string]bool{
+	"registry":  true,
+	"editors":   true,
+	"sandboxes": true,
+	"login":     true,
+	"status":    true,
+	"admin":     true,
+	"graphql":   true,
+	"biwebauth": true,
+}
+
+// missingSpaceTTL is the duration during which a name that is not the name of
+// a space is remembered, to avoid a request to CouchDB for each request on it.
+// The name is forgotten earlier when a space with this name is created by
+// any instance of the registry (see ForgetMissingSpace).
+const missingSpaceTTL = time.Minute
+
+// missingSpaces are the names of the unknown and archived spaces recently
+// looked up.
+var missingSpaces = cache.NewLRUCache(1024, missingSpaceTTL)
+
+// ForgetMissingSpace removes a name from the unknown spaces recently looked
+// up, so that a space just created with this name, maybe by another instance
+// of the registry, is served right away. It is called by the server for each
+// change of the created spaces.
+func ForgetMissingSpace(name string) {
+	missingSpaces.Remove(base.Key(name))
+}
+
+// ensureCreatedSpace middleware is used for the routes of the spaces created
+// with the admin API, that are not known when the router is built. A space
+// created by another instance of the registry is registered on the fly.
+func ensureCreatedSpace(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name := c.Param("space")
+		if _, ok := space.GetSpace(name); !ok {
+			notFound := echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("Space %q does not exist", name))
+			if _, missing := missingSpaces.Get(base.Key(name)); missing {
+				return notFound
+			}
+			created, err := space.FindCreated(name)
+			if err != nil && kivik.StatusCode(err) != http.StatusNotFound {
+				return err
+			}
+			if err != nil || created.Archived() {
+				missingSpaces.Add(base.Key(name), base.Value{})
+				return notFound
+			}
+			if err := space.Register(name); err != nil {
+				if _, ok := space.GetSpace(name); !ok {
+					return err
+				}
+			}
+		}
+		return ensureSpace(name)(robotsTag(name)(next))(c)
+	}
+}
+
+// spaceInfo describes a space for the admin API.
+type spaceInfo struct {
+	Name       string       `json:"name"`
+	Origin     string       `json:"origin"`
+	CreatedAt  *time.Time   `json:"created_at,omitempty"`
+	ArchivedAt *time.Time   `json:"archived_at,omitempty"`
+	Usage      *space.Usage `json:"usage,omitempty"`
+}
+
+func newSpaceInfo(s *space.Space, created *space.Created) (*spaceInfo, error) {
+	info := &spaceInfo{Name: s.Name, Origin: "config"}
+	if info.Name == "" {
+		info.Name = base.DefaultSpacePrefix.String()
+	}
+	if created != nil {
+		info.Origin = "api"
+		info.CreatedAt = &created.CreatedAt
+	}
+	usage, err := s.Usage()
+	if err != nil {
+		return nil, errshttp.NewError(http.StatusInternalServerError,
+			"Cannot compute the usage of space %q: %s", info.Name, err)
+	}
+	info.Usage = usage
+	return info, nil
+}
+
+func getAdminSpaces(c echo.Context) error {
+	records, err := space.ListCreated()
+	if err != nil {
+		return err
+	}
+	created := make(map[string]*space.Created, len(records))
+	for _, record := range records {
+		created[record.Name] = record
+	}
+
+	names := space.GetSpacesNames()
+	sort.Strings(names)
+	list := make([]*spaceInfo, 0, len(names))
+	for _, name := range names {
+		s, ok := space.GetSpace(name)
+		if !ok {
+			continue
+		}
+		info, err := newSpaceInfo(s, created[name])
+		if err != nil {
+			return err
+		}
+		list = append(list, info)
+	}
+	// The archived spaces are listed without their usage, as their databases
+	// are no longer opened.
+	for _, record := range records {
+		if record.Archived() {
+			list = append(list, &spaceInfo{
+				Name:       record.Name,
+				Origin:     "api",
+				CreatedAt:  &record.CreatedAt,
+				ArchivedAt: record.ArchivedAt,
+			})
+		}
+	}
+	return writeJSON(c, list)
+}
+
+func createAdminSpace(c echo.Context) error {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	name := body.Name
+	if name == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing name field")
+	}
+	if reservedSpaceNames[name] || name == base.DefaultSpacePrefix.String() {
+		return errshttp.NewError(http.StatusBadRequest, "The name %q is reserved", name)
+	}
+	if _, ok := base.Config.VirtualSpaces[name]; ok {
+		return errshttp.NewError(http.StatusConflict, "%q is a virtual space", name)
+	}
+	s, err := space.Create(name)
+	switch err {
+	case nil:
+	case space.ErrSpaceNameInvalid:
+		return errshttp.NewError(http.StatusBadRequest, "Space named %q contains invalid characters", name)
+	case space.ErrSpaceExists:
+		return errshttp.NewError(http.StatusConflict, "Space %q already exists", name)
+	default:
+		return err
+	}
+	created, err := space.FindCreated(name)
+	if err != nil {
+		return err
+	}
+	info, err := newSpaceInfo(s, created)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, info)
+}
+
+func archiveAdminSpace(c echo.Context) error {
+	name := c.Param("space")
+	if _, ok := space.GetSpace(name); !ok {
+		return errshttp.NewError(http.StatusNotFound, "Space %q not found", name)
+	}
+	err := space.Archive(name)
+	if err == space.ErrNotCreatedSpace {
+		return errshttp.NewError(http.StatusConflict,
+			"Space %q is defined in the configuration file", name)
+	}
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,58 +1,151 @@
 package web
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/cozy/cozy-apps-registry/registry"
 	"github.com/labstack/echo/v4"
 )
 
+// readinessTimeout is the maximal duration of the check of a dependency for
+// the readiness probe.
+const readinessTimeout = 3 * time.Second
+
 type entry struct {
-	Status string `json:"status"`
-	Reason string `json:"reason,omitempty"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Reason  string  `json:"reason,omitempty"`
 }
 
-// Status responds with the status of the cache, couch and storage services.
+// Status responds if the process is up, without checking its dependencies,
+// for the liveness probes.
 func Status(c echo.Context) error {
-	var global string
-	check := map[string]interface{}{}
-	global = "ok"
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.JSON(http.StatusOK, echo.Map{"status": "ok"})
+}
 
-	// Swift
-	swift := entry{Status: "ok"}
-	if err := base.Storage.Status(); err != nil {
-		swift.Status = "failed"
-		swift.Reason = err.Error()
-		global = "failed"
+// Ready responds with the status of the cache, couch and storage services,
+// checked in parallel, for the readiness probes. The response has the 503
+// Service Unavailable status code if the registry can't be used.
+func Ready(c echo.Context) error {
+	ctx := c.Request().Context()
+	checks := map[string]func(context.Context) error{
+		"swift": func(context.Context) error { return base.Storage.Status() },
+		"couchDB": func(ctx context.Context) error {
+			if ok, err := base.DBClient.Ping(ctx); !ok {
+				if err == nil {
+					err = errors.New("CouchDB is not available")
+				}
+				return err
+			}
+			return nil
+		},
+		"redis": func(context.Context) error { return base.LatestVersionsCache.Status() },
 	}
-	check["swift"] = swift
 
-	// CouchDB
-	couchDB := entry{Status: "ok"}
-	ctx := c.Request().Context()
-	ok, err := base.DBClient.Ping(ctx)
-	if !ok {
-		couchDB.Status = "failed"
-		couchDB.Reason = err.Error()
-		global = "failed"
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]entry, len(checks))
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func(context.Context) error) {
+			defer wg.Done()
+			e := checkDependency(ctx, fn)
+			mu.Lock()
+			results[name] = e
+			mu.Unlock()
+		}(name, fn)
 	}
-	check["couchDB"] = couchDB
+	wg.Wait()
 
-	// Redis
-	r := entry{Status: "ok"}
-	if err := base.LatestVersionsCache.Status(); err != nil {
-		r.Status = "failed"
-		r.Reason = err.Error()
-		global = "failed"
+	// The registry still works when the caches have failed over to memory
+	if r := results["redis"]; r.Status == "failed" {
+		if f, ok := base.LatestVersionsCache.(interface{ FailedOver() bool }); ok && f.FailedOver() {
+			r.Status = "degraded"
+			results["redis"] = r
+		}
 	}
-	check["redis"] = r
 
+	global := "ok"
+	check := map[string]interface{}{}
+	for name, e := range results {
+		if e.Status == "failed" {
+			global = "failed"
+		}
+		check[name] = e
+	}
 	check["status"] = global
-	return c.JSON(http.StatusOK, check)
+
+	code := http.StatusOK
+	if global != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.JSON(code, check)
+}
+
+// checkDependency runs the check of a dependency with a timeout, and measures
+// its latency. The check is abandoned, but not interrupted, if it takes longer
+// than the timeout.
+func checkDependency(ctx context.Context, fn func(context.Context) error) entry {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = errors.New("Timeout after " + readinessTimeout.String())
+	}
+	e := entry{
+		Status:  "ok",
+		Latency: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		e.Status = "failed"
+		e.Reason = err.Error()
+	}
+	return e
+}
+
+// Incidents responds with the incident flags set by the administrators, for
+// the status pages of the editors.
+func Incidents(c echo.Context) error {
+	flags, err := registry.GetIncidentFlags()
+	if err != nil {
+		return err
+	}
+	// The depth of the queue of this instance is known without the admins
+	if depth := jobs.Depth(); depth > flags.PublishQueueDepth {
+		flags.PublishQueueDepth = depth
+	}
+	status := "ok"
+	if flags.Degraded() {
+		status = "degraded"
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=60")
+	return c.JSON(http.StatusOK, struct {
+		Status string `json:"status"`
+		registry.IncidentFlags
+	}{status, flags})
 }
 
 // StatusRoutes sets the routing for the status service.
 func StatusRoutes(router *echo.Group) {
 	router.GET("", Status)
 	router.HEAD("", Status)
+	router.GET("/ready", Ready)
+	router.HEAD("/ready", Ready)
+	router.GET("/incidents", Incidents)
+	router.HEAD("/incidents", Incidents)
 }
@@ -19,6 +19,9 @@ func universalLink(c echo.Context) error {
 		return err
 	}
 	spacePrefix := space.GetPrefix()
+	if content, ok := base.Config.WellKnownFiles[spacePrefix.String()][c.Param("filename")]; ok {
+		return c.Blob(http.StatusOK, echo.MIMEApplicationJSON, content)
+	}
 	filename := filepath.Join(universalLinkFolder, c.Param("filename"))
 
 	content, hdrs, err := base.Storage.Get(spacePrefix, filename)
@@ -1,15 +1,23 @@
 package web
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"path"
 	"path/filepath"
+	"time"
 
+	"github.com/cozy/cozy-apps-registry/auth"
 	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/counters"
 	"github.com/cozy/cozy-apps-registry/errshttp"
+	"github.com/cozy/cozy-apps-registry/jobs"
+	"github.com/cozy/cozy-apps-registry/manifest"
 	"github.com/cozy/cozy-apps-registry/registry"
+	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -34,41 +42,220 @@ func createVersion(c echo.Context) (err error) {
 	opts.Version = stripVersion(opts.Version)
 	opts.SpacePrefix = prefix
 
-	editor, err := checkPermissions(c, app.Editor, app.Slug, false /* = not master */)
+	editor, err := checkPermissionsOrRole(c, app.Editor, app.Slug, false /* = not master */, auth.RolePublishAny)
 	if err != nil {
 		return errshttp.NewError(http.StatusUnauthorized, err.Error())
 	}
+	opts.Provenance = newProvenance(c, registry.PublishMethodAPI)
+
+	return publishVersion(c, app, editor, opts)
+}
+
+// newProvenance returns the provenance of a version published by the current
+// request. The token, if any, must have been checked before.
+func newProvenance(c echo.Context, method string) *registry.Provenance {
+	provenance := &registry.Provenance{
+		Method:    method,
+		SourceIP:  c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+	}
+	if token, err := extractAuthHeader(c); err == nil {
+		provenance.TokenID = auth.TokenHash(token)
+	}
+	provenance.Editor, _ = c.Get(tokenEditorKey).(string)
+	return provenance
+}
 
-	if err = validateVersionRequest(c, opts); err != nil {
+// publishVersion downloads the version described by opts and adds it to the
+// space, as a release or a pending version depending on the editor. When the
+// jobs are enabled, the download is made by a worker, and the response is a
+// 202 Accepted with the job.
+func publishVersion(c echo.Context, app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) error {
+	if jobs.Enabled() {
+		return enqueueVersion(c, app, editor, opts)
+	}
+	res, err := addVersion(c, app, editor, opts)
+	if err != nil {
 		return err
 	}
+	// The pending versions can't be fetched before their approval
+	if editor.AutoPublication() && res.PendingReview == nil {
+		c.Response().Header().Set(echo.HeaderLocation, res.Links.Self)
+	}
+	return c.JSON(http.StatusCreated, res)
+}
+
+// publication is the state of a request that publishes versions. It is read
+// once from the echo context, which can't be used by several goroutines, so
+// that the versions of a bulk request can be published in parallel.
+type publication struct {
+	ctx     context.Context
+	space   *space.Space
+	sandbox *registry.Sandbox
+	root    *url.URL
+	// force is true if the publication has been forced, and forceErr is the
+	// error if it is not allowed
+	force    bool
+	forceErr error
+}
+
+func newPublication(c echo.Context) *publication {
+	p := &publication{
+		// The download is aborted if the publisher disconnects
+		ctx:   c.Request().Context(),
+		space: getSpace(c),
+		root:  registryRoot(c),
+	}
+	p.sandbox, _ = c.Get(sandboxKey).(*registry.Sandbox)
+	p.force, p.forceErr = forcePublication(c)
+	return p
+}
+
+// addVersion downloads the version described by opts and adds it to the
+// space, and returns it with its links.
+func addVersion(c echo.Context, app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) (*versionWithLinks, error) {
+	return newPublication(c).add(app, editor, opts)
+}
+
+// add is addVersion for a publication.
+func (p *publication) add(app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) (*versionWithLinks, error) {
+	if err := p.prepare(app, editor, opts); err != nil {
+		return nil, err
+	}
+	opts.Context = p.ctx
 
-	_, err = registry.FindVersion(getSpace(c), appSlug, opts.Version)
+	ver, err := storeVersion(p.space, app, editor, opts)
+	if err != nil {
+		return nil, err
+	}
+	return versionWithRootLinks(p.root, ver), nil
+}
+
+// enqueueVersion makes the checks of the publication of a version, and
+// queues a job for the download of the tarball.
+func enqueueVersion(c echo.Context, app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) error {
+	p := newPublication(c)
+	if err := p.prepare(app, editor, opts); err != nil {
+		return err
+	}
+	space := p.space
+	// The links are computed now, as the request is gone when the job runs
+	links := versionWithRootLinks(p.root, &registry.Version{Slug: app.Slug, Version: opts.Version}).Links
+	log := requestLogger(c)
+
+	job, err := jobs.Enqueue(publishJobKind, space.Name, func(ctx context.Context) (interface{}, error) {
+		opts.Context = base.WithLogger(ctx, log)
+		ver, err := storeVersion(space, app, editor, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &versionWithLinks{Version: ver, Links: links}, nil
+	})
+	if err == jobs.ErrQueueFull || err == jobs.ErrQueueClosed {
+		c.Response().Header().Set("Retry-After", "60")
+		return errshttp.NewError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	location := registryURL(c, "jobs", job.ID)
+	c.Response().Header().Set(echo.HeaderLocation, location)
+	return c.JSON(http.StatusAccepted, newJobResponse(job, location))
+}
+
+// prepare checks that the version described by opts can be published, with a
+// valid signature of the editor if any, and sets the URL of its tarball in the
+// registry.
+func (p *publication) prepare(app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) error {
+	appSlug := app.Slug
+	if err := validateVersionRequest(opts); err != nil {
+		return err
+	}
+	if err := registry.CheckVersionSignature(editor, opts); err != nil {
+		return err
+	}
+	if err := checkInSandbox(p.sandbox, p.space, app.Editor, false); err != nil {
+		return err
+	}
+
+	_, err := registry.FindVersion(p.space, appSlug, opts.Version)
 	if err == nil {
 		return registry.ErrVersionAlreadyExists
 	}
 	if err != registry.ErrVersionNotFound {
 		return err
 	}
+	_, err = registry.FindTrashedVersion(p.space, appSlug, opts.Version)
+	if err == nil {
+		return registry.ErrVersionInTrash
+	}
+	if err != registry.ErrVersionNotFound {
+		return err
+	}
+	_, err = registry.FindPendingVersion(p.space, appSlug, opts.Version)
+	if err == nil {
+		return registry.ErrVersionPending
+	}
+	if err != registry.ErrVersionNotFound {
+		return err
+	}
+	if p.forceErr != nil {
+		return p.forceErr
+	}
+	if err := registry.CheckPublication(p.space, appSlug, opts, p.force); err != nil {
+		return err
+	}
 
 	// Generate the registryURL which contains the registryURL where to download
 	// the file
 	filename := filepath.Base(opts.URL)
-	buildedURL := &url.URL{
-		Scheme: c.Scheme(),
-		Host:   c.Request().Host,
-		Path:   fmt.Sprintf("%s/registry/%s/%s/tarball/%s", space.Name, appSlug, opts.Version, filename),
+	opts.RegistryURL = &url.URL{
+		Scheme: p.root.Scheme,
+		Host:   p.root.Host,
+		Path:   fmt.Sprintf("%s/%s/%s/tarball/%s", p.root.Path, appSlug, opts.Version, filename),
 	}
+	return nil
+}
 
-	opts.RegistryURL = buildedURL
+// forcePublication returns true if the publication has been forced with
+// ?force=true, to publish a stable version lower than the latest one. It is
+// only allowed with an admin token.
+func forcePublication(c echo.Context) (bool, error) {
+	if c.QueryParam("force") != "true" {
+		return false, nil
+	}
+	if err := checkAdmin(c); err != nil {
+		return false, errshttp.NewError(http.StatusForbidden,
+			"An admin token is required to force the publication: %s", err)
+	}
+	return true, nil
+}
 
+// storeVersion downloads the tarball of the version, and adds the version to
+// the space.
+func storeVersion(space *space.Space, app *registry.App, editor *auth.Editor, opts *registry.VersionOptions) (*registry.Version, error) {
+	log := base.Logger(opts.Context).WithFields(logrus.Fields{
+		"nspace":  "publication",
+		"space":   space.Name,
+		"slug":    app.Slug,
+		"version": opts.Version,
+	})
 	ver, attachments, err := registry.DownloadVersion(opts)
 	if err != nil {
-		return err
+		log.WithField("error_msg", err).Warn("Cannot download the version")
+		return nil, err
 	}
 
-	if editor.AutoPublication() {
-		space := getSpace(c)
+	// The version may have to be reviewed, in the moderated spaces or for
+	// its new permissions
+	ver.PendingReview, err = registry.CheckReview(space, ver)
+	if err != nil {
+		log.WithField("error_msg", err).Error("Cannot check if the version must be reviewed")
+		return nil, err
+	}
+	release := editor.AutoPublication() && ver.PendingReview == nil
+
+	if release {
 		err = registry.CreateReleaseVersion(space, ver, attachments, app, true)
 
 		// Cleaning old versions when adding a new one
@@ -76,32 +263,110 @@ func createVersion(c echo.Context) (err error) {
 
 		// Cleaning the old versions
 		channelString := registry.ChannelToStr(channel)
-		if base.Config.CleanEnabled {
-			go func() {
-				err := registry.CleanOldVersions(space, ver.Slug, channelString,
-					base.Config.CleanParameters, registry.RealRun)
+		if base.Config.IsCleanEnabled(space.GetPrefix()) {
+			registry.Background(func() {
+				_, err := registry.CleanOldVersions(space, ver.Slug, channelString,
+					base.Config.GetCleanParameters(space.GetPrefix()), registry.RealRun)
 				if err != nil {
-					log := logrus.WithFields(logrus.Fields{
+					log.WithFields(logrus.Fields{
 						"nspace":    "clean_version",
-						"space":     space.Name,
-						"slug":      ver.Slug,
-						"version":   ver.Version,
 						"channel":   channelString,
 						"error_msg": err,
-					})
-					log.Error()
+					}).Error()
 				}
-			}()
+			})
 		}
 	} else {
-		err = registry.CreatePendingVersion(getSpace(c), ver, attachments, app)
+		err = registry.CreatePendingVersion(space, ver, attachments, app)
 	}
 	if err != nil {
-		return err
+		log.WithField("error_msg", err).Error("Cannot create the version")
+		return nil, err
 	}
+	log.WithFields(logrus.Fields{
+		"pending":        !release,
+		"pending_review": ver.PendingReview != nil,
+	}).Info("Version published")
 
 	cleanVersion(ver)
-	return c.JSON(http.StatusCreated, ver)
+	return ver, nil
+}
+
+func createPublishURL(c echo.Context) (err error) {
+	if err = checkAuthorized(c); err != nil {
+		return err
+	}
+
+	app, err := registry.FindApp(nil, getSpace(c), c.Param("app"), registry.Stable)
+	if err != nil {
+		return err
+	}
+
+	_, err = checkPermissionsOrRole(c, app.Editor, app.Slug, false /* = not master */, auth.RolePublishAny)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	var opts struct {
+		Version string `json:"version"`
+		MaxAge  string `json:"max_age"`
+	}
+	if err = c.Bind(&opts); err != nil {
+		return err
+	}
+	var maxAge time.Duration
+	if opts.MaxAge != "" {
+		if maxAge, err = time.ParseDuration(opts.MaxAge); err != nil {
+			return errshttp.NewError(http.StatusBadRequest, "Invalid max_age: %s", err)
+		}
+	}
+
+	publishURL, err := registry.CreatePublishURL(getSpace(c), app, stripVersion(opts.Version), maxAge)
+	if err != nil {
+		return err
+	}
+
+	u := &url.URL{
+		Scheme: c.Scheme(),
+		Host:   c.Request().Host,
+		Path:   fmt.Sprintf("%s/%s/publish/%s", registryPath(c), app.Slug, publishURL.ID),
+	}
+	return c.JSON(http.StatusCreated, echo.Map{
+		"url":        u.String(),
+		"version":    publishURL.Version,
+		"expires_at": publishURL.ExpiresAt,
+	})
+}
+
+func createVersionFromPublishURL(c echo.Context) (err error) {
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, c.Param("app"), registry.Stable)
+	if err != nil {
+		return err
+	}
+
+	// The request is checked before consuming the token, so that a mistake
+	// in the body does not burn the publish URL
+	opts := &registry.VersionOptions{}
+	if err = c.Bind(opts); err != nil {
+		return err
+	}
+	opts.Version = stripVersion(opts.Version)
+	opts.SpacePrefix = space.GetPrefix()
+	if err = validateVersionRequest(opts); err != nil {
+		return err
+	}
+	if _, err = registry.ConsumePublishURL(space, app.Slug, opts.Version, c.Param("token")); err != nil {
+		return err
+	}
+
+	editor, err := auth.Editors.GetEditor(app.Editor)
+	if err != nil {
+		return err
+	}
+	opts.Provenance = newProvenance(c, registry.PublishMethodPublishURL)
+
+	return publishVersion(c, app, editor, opts)
 }
 
 func getPendingVersions(c echo.Context) (err error) {
@@ -162,13 +427,48 @@ func approvePendingVersion(c echo.Context) (err error) {
 		return err
 	}
 
-	if version, err = registry.ApprovePendingVersion(getSpace(c), version, app); err != nil {
+	if version.PendingReview != nil {
+		decision := &registry.ReviewDecision{By: adminEditor, At: time.Now().UTC()}
+		version, err = registry.ApproveReview(getSpace(c), version, app, decision)
+	} else {
+		version, err = registry.ApprovePendingVersion(getSpace(c), version, app)
+	}
+	if err != nil {
+		return err
+	}
+
+	cleanVersion(version)
+
+	res := newVersionWithLinks(c, version)
+	c.Response().Header().Set(echo.HeaderLocation, res.Links.Self)
+	return c.JSON(http.StatusCreated, res)
+}
+
+func extractVersionAttachments(c echo.Context) (err error) {
+	if err = checkAdmin(c); err != nil {
+		return err
+	}
+
+	opts := &registry.VersionOptions{}
+	if c.Request().ContentLength > 0 {
+		if err = c.Bind(opts); err != nil {
+			return err
+		}
+	}
+
+	appSlug := c.Param("app")
+	version, err := registry.FindPublishedVersion(getSpace(c), appSlug, stripVersion(c.Param("version")))
+	if err != nil {
+		return err
+	}
+
+	if version, err = registry.ExtractVersionAttachments(getSpace(c), version, opts); err != nil {
 		return err
 	}
 
 	cleanVersion(version)
 
-	return c.JSON(http.StatusCreated, version)
+	return c.JSON(http.StatusOK, version)
 }
 
 func getVersionIcon(c echo.Context) error {
@@ -190,6 +490,44 @@ func getVersionScreenshot(c echo.Context) error {
 	return err
 }
 
+// screenshotWithURL is an entry of the screenshots.json of a version.
+type screenshotWithURL struct {
+	registry.VersionScreenshot
+	URL string `json:"url"`
+}
+
+// getVersionScreenshots returns the gallery of the screenshots of a version,
+// in the order of the manifest, with their captions, dimensions, content types
+// and URLs, and the screenshots to display for each locale.
+func getVersionScreenshots(c echo.Context) error {
+	appSlug := c.Param("app")
+	version := stripVersion(c.Param("version"))
+	_, space, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	ver, err := registry.FindPublishedVersion(space, appSlug, version)
+	if err != nil {
+		return err
+	}
+	if cacheControl(c, ver.Rev, oneYear) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	shots := registry.VersionScreenshots(ver)
+	screenshots := make([]screenshotWithURL, len(shots))
+	for i, shot := range shots {
+		screenshots[i] = screenshotWithURL{
+			VersionScreenshot: shot,
+			URL:               registryURL(c, ver.Slug, ver.Version, "screenshots", shot.Path),
+		}
+	}
+	return writeJSON(c, echo.Map{
+		"screenshots": screenshots,
+		"locales":     registry.ScreenshotsByLocale(ver, shots),
+	})
+}
+
 func getVersionTarball(c echo.Context) error {
 	virtualSpace, space, err := getVirtualSpace(c)
 	if err != nil {
@@ -211,20 +549,42 @@ func getVersionTarball(c echo.Context) error {
 		}
 	}
 	if !attFound {
-		if att, err = registry.FindVersionAttachment(space, ver, filename); err != nil {
+		// The tarball can be downloaded with its original filename, or with
+		// its checksum, and is streamed from the storage.
+		if filename == path.Base(ver.URL) || (ver.Sha256 != "" && filename == ver.Sha256+".tar.gz") {
+			att, err = registry.OpenVersionTarball(space, ver)
+		} else {
+			att, err = registry.FindVersionAttachment(space, ver, filename)
+		}
+		if err != nil {
 			return err
 		}
 	}
 
+	if c.Request().Method == http.MethodGet {
+		counters.Hit(space.Name, slug, counters.Tarball)
+	}
 	return sendAttachment(c, att, filename)
 }
 
 func sendAttachment(c echo.Context, att *registry.Attachment, filename string) error {
+	if closer, ok := att.Content.(io.Closer); ok {
+		defer closer.Close()
+	}
+
 	contentType := att.ContentType
 	// force image/svg content-type for svg assets that start with <?xml
 	if (filename == "icon" || filename == "partnership_icon") && contentType == "text/xml" {
 		contentType = "image/svg+xml"
 	}
+	if filename == "icon" || filename == "partnership_icon" {
+		att.ContentType = contentType
+		rendition, err := negotiateIcon(c, att)
+		if err != nil {
+			return err
+		}
+		att, contentType = rendition, rendition.ContentType
+	}
 
 	c.Response().Header().Set(echo.HeaderContentType, contentType)
 	if cacheControl(c, att.Etag, oneHour) {
@@ -282,6 +642,28 @@ func getAppVersions(c echo.Context) error {
 		return c.NoContent(http.StatusNotModified)
 	}
 
+	if wantsCSV(c) {
+		header := []string{"slug", "version", "channel"}
+		records := [][]string{}
+		for _, channel := range registry.Channels {
+			var list []string
+			switch channel {
+			case registry.Stable:
+				list = versions.Stable
+			case registry.Beta:
+				list = versions.Beta
+			case registry.Dev:
+				list = versions.Dev
+			}
+			for _, v := range list {
+				if registry.GetVersionChannel(v) == channel {
+					records = append(records, []string{appSlug, v, registry.ChannelToStr(channel)})
+				}
+			}
+		}
+		return writeCSV(c, header, records)
+	}
+
 	return writeJSON(c, versions)
 }
 
@@ -290,12 +672,19 @@ func getVersion(c echo.Context) error {
 	version := stripVersion(c.Param("version"))
 
 	space := getSpace(c)
-	_, err := registry.FindApp(nil, space, appSlug, registry.Stable)
+	app, err := registry.FindApp(nil, space, appSlug, registry.Stable)
 	if err != nil {
 		return err
 	}
 
+	maxAge := oneYear
 	doc, err := registry.FindPublishedVersion(getSpace(c), appSlug, version)
+	if err == registry.ErrVersionNotFound && app.External != nil {
+		// The versions of the external applications can change on the other
+		// registry
+		maxAge = fiveMinute
+		doc, err = registry.FindExternalVersion(space, app, version)
+	}
 	if err != nil {
 		return err
 	}
@@ -303,17 +692,302 @@ func getVersion(c echo.Context) error {
 	if doc, err = override(c, doc); err != nil {
 		return err
 	}
-	if cacheControl(c, doc.Rev, oneYear) {
+	if cacheControl(c, doc.Rev, maxAge) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
-	// Do not show internal identifier and revision
-	doc.ID = ""
-	doc.Rev = ""
+	cleanVersion(doc)
+	if err = compatManifest(c, doc); err != nil {
+		return err
+	}
 
+	return writeJSON(c, newVersionWithLinks(c, doc))
+}
+
+func resolveVersion(c echo.Context) error {
+	appSlug := c.Param("app")
+	constraint := c.QueryParam("constraint")
+	if constraint == "" {
+		return errshttp.NewError(http.StatusBadRequest, "Missing constraint parameter")
+	}
+	channel := registry.Stable
+	if ch := c.QueryParam("channel"); ch != "" {
+		var err error
+		if channel, err = registry.StrToChannel(ch); err != nil {
+			return err
+		}
+	}
+
+	space := getSpace(c)
+	if _, err := registry.FindApp(nil, space, appSlug, registry.Stable); err != nil {
+		return err
+	}
+
+	doc, err := registry.ResolveVersion(space, appSlug, constraint, channel)
+	if err != nil {
+		return err
+	}
+
+	if doc, err = override(c, doc); err != nil {
+		return err
+	}
+	if cacheControl(c, doc.Rev, fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	cleanVersion(doc)
+	if err = compatManifest(c, doc); err != nil {
+		return err
+	}
+
+	return writeJSON(c, doc)
+}
+
+func deleteVersion(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	appSlug := c.Param("app")
+	version := stripVersion(c.Param("version"))
+
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, appSlug, registry.Dev)
+	if err != nil {
+		return err
+	}
+
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	doc, err := registry.FindPublishedVersion(space, app.Slug, version)
+	if err != nil {
+		return err
+	}
+	by, _ := c.Get(tokenEditorKey).(string)
+	if err = doc.Unpublish(space, by); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getAppTrash returns the versions of an application in the trash, to the
+// editor of the application and to the admins.
+func getAppTrash(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, c.Param("app"), registry.Dev)
+	if err != nil {
+		return err
+	}
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	versions, err := registry.GetTrashedVersions(space, app.Slug)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		cleanVersion(v)
+	}
+	return writeJSON(c, echo.Map{
+		"versions":  versions,
+		"retention": base.Config.TrashRetention.String(),
+	})
+}
+
+// restoreVersion moves a version of an application from the trash back to
+// its published versions.
+func restoreVersion(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, c.Param("app"), registry.Dev)
+	if err != nil {
+		return err
+	}
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	doc, err := registry.RestoreVersion(space, app.Slug, stripVersion(c.Param("version")))
+	if err != nil {
+		return err
+	}
+	cleanVersion(doc)
+	return c.JSON(http.StatusOK, doc)
+}
+
+func setVersionKeepForever(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	appSlug := c.Param("app")
+	version := stripVersion(c.Param("version"))
+
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, appSlug, registry.Dev)
+	if err != nil {
+		return err
+	}
+
+	editor, err := checkPermissions(c, app.Editor, app.Slug, false /* = not master */)
+	if err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	var body struct {
+		KeepForever *bool `json:"keep_forever"`
+	}
+	if err = c.Bind(&body); err != nil || body.KeepForever == nil {
+		return errshttp.NewError(http.StatusBadRequest, "Expected a keep_forever boolean in the body")
+	}
+
+	doc, err := registry.FindPublishedVersion(space, app.Slug, version)
+	if err != nil {
+		return err
+	}
+	if err = doc.SetKeepForever(space, *body.KeepForever, editor.Name()); err != nil {
+		return err
+	}
+
+	cleanVersion(doc)
 	return writeJSON(c, doc)
 }
 
+// getVersionProvenance returns the provenance of a version, published or
+// pending, to the editor of the application and to the admins.
+func getVersionProvenance(c echo.Context) error {
+	if err := checkAuthorized(c); err != nil {
+		return err
+	}
+
+	space := getSpace(c)
+	app, err := registry.FindApp(nil, space, c.Param("app"), registry.Dev)
+	if err != nil {
+		return err
+	}
+	if _, err = checkPermissions(c, app.Editor, app.Slug, false /* = not master */); err != nil {
+		return errshttp.NewError(http.StatusUnauthorized, err.Error())
+	}
+
+	doc, err := registry.FindVersion(space, app.Slug, stripVersion(c.Param("version")))
+	if err != nil {
+		return err
+	}
+	if doc.Provenance == nil {
+		return errshttp.NewError(http.StatusNotFound,
+			"The provenance of this version has not been recorded")
+	}
+	return writeJSON(c, doc.Provenance)
+}
+
+// getVersionChangelog returns the "what's new" of a published version.
+func getVersionChangelog(c echo.Context) error {
+	appSlug := c.Param("app")
+	space := getSpace(c)
+	if _, err := registry.FindApp(nil, space, appSlug, registry.Stable); err != nil {
+		return err
+	}
+
+	doc, err := registry.FindPublishedVersion(space, appSlug, stripVersion(c.Param("version")))
+	if err != nil {
+		return err
+	}
+	if doc.Changelog == "" {
+		return errshttp.NewError(http.StatusNotFound, "This version has no changelog")
+	}
+	if cacheControl(c, doc.Rev, oneHour) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return writeJSON(c, &registry.ChangelogEntry{
+		Version:   doc.Version,
+		CreatedAt: doc.CreatedAt,
+		Changelog: doc.Changelog,
+	})
+}
+
+// getVersionsDiff returns the changes between the manifests of two versions
+// of an application, so that the stacks can show to the users the new
+// permissions before an upgrade.
+func getVersionsDiff(c echo.Context) error {
+	appSlug := c.Param("app")
+	space := getSpace(c)
+	from, to := stripVersion(c.QueryParam("from")), stripVersion(c.QueryParam("to"))
+	if from == "" || to == "" {
+		return errshttp.NewError(http.StatusBadRequest,
+			`Query params "from" and "to" are mandatory`)
+	}
+	if _, err := registry.FindApp(nil, space, appSlug, registry.Stable); err != nil {
+		return err
+	}
+
+	fromVersion, err := registry.FindPublishedVersion(space, appSlug, from)
+	if err != nil {
+		return err
+	}
+	toVersion, err := registry.FindPublishedVersion(space, appSlug, to)
+	if err != nil {
+		return err
+	}
+	if cacheControl(c, fromVersion.Rev+"-"+toVersion.Rev, oneHour) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	diff, err := manifest.Compare(fromVersion.Manifest, toVersion.Manifest)
+	if err != nil {
+		return errshttp.NewError(http.StatusInternalServerError, "Cannot compare the manifests: %s", err)
+	}
+	return writeJSON(c, echo.Map{
+		"slug":        appSlug,
+		"from":        fromVersion.Version,
+		"to":          toVersion.Version,
+		"permissions": diff.Permissions,
+		"locales":     diff.Locales,
+		"routes":      diff.Routes,
+		"intents":     diff.Intents,
+	})
+}
+
+// getAppChangelog returns the changelogs of the versions of an application
+// published after the version given in the since parameter, the most recent
+// first.
+func getAppChangelog(c echo.Context) error {
+	appSlug := c.Param("app")
+	channel := registry.Stable
+	if ch := c.QueryParam("channel"); ch != "" {
+		var err error
+		if channel, err = registry.StrToChannel(ch); err != nil {
+			return err
+		}
+	}
+
+	space := getSpace(c)
+	if _, err := registry.FindApp(nil, space, appSlug, registry.Stable); err != nil {
+		return err
+	}
+
+	entries, err := registry.GetChangelog(space, appSlug, stripVersion(c.QueryParam("since")), channel)
+	if err != nil {
+		return err
+	}
+
+	if cacheControl(c, "", fiveMinute) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return writeJSON(c, echo.Map{"versions": entries})
+}
+
 func override(c echo.Context, version *registry.Version) (*registry.Version, error) {
 	if version == nil {
 		return nil, nil
@@ -341,7 +1015,7 @@ func override(c echo.Context, version *registry.Version) (*registry.Version, err
 func getLatestVersion(c echo.Context) error {
 	appSlug := c.Param("app")
 	channel := c.Param("channel")
-	_, err := registry.FindApp(nil, getSpace(c), appSlug, registry.Stable)
+	app, err := registry.FindApp(nil, getSpace(c), appSlug, registry.Stable)
 	if err != nil {
 		return err
 	}
@@ -352,18 +1026,78 @@ func getLatestVersion(c echo.Context) error {
 	}
 	space := getSpace(c)
 	version, err := registry.FindLatestVersion(space, appSlug, ch)
+	if err == registry.ErrVersionNotFound && app.External != nil {
+		version, err = registry.FindExternalLatestVersion(space, app, ch)
+	}
 	if err != nil {
 		return err
 	}
 	if version, err = override(c, version); err != nil {
 		return err
 	}
+	if c.Request().Method == http.MethodGet {
+		counters.Hit(space.Name, appSlug, counters.Latest)
+	}
 
 	if cacheControl(c, version.Rev, fiveMinute) {
 		return c.NoContent(http.StatusNotModified)
 	}
 
 	cleanVersion(version)
+	if err = compatManifest(c, version); err != nil {
+		return err
+	}
 
-	return writeJSON(c, version)
+	return writeJSON(c, newVersionWithLinks(c, version))
+}
+
+// latestVersionEntry is an entry of the response of getLatestVersions: the
+// latest version of an application, or the error.
+type latestVersionEntry struct {
+	Slug    string            `json:"slug"`
+	Channel string            `json:"channel"`
+	Version *versionWithLinks `json:"version,omitempty"`
+	Error   string            `json:"error,omitempty"`
+	Status  int               `json:"status,omitempty"`
+}
+
+// getLatestVersions returns the latest versions of several applications in a
+// single request, for the stack that checks the updates of all the installed
+// applications.
+func getLatestVersions(c echo.Context) error {
+	var body struct {
+		Apps []registry.LatestVersionQuery `json:"apps"`
+	}
+	if err := c.Bind(&body); err != nil {
+		return err
+	}
+	if len(body.Apps) == 0 {
+		return errshttp.NewError(http.StatusBadRequest, "Missing apps")
+	}
+	if len(body.Apps) > registry.MaxLatestVersions {
+		return errshttp.NewError(http.StatusBadRequest,
+			"Too many apps, the maximum is %d", registry.MaxLatestVersions)
+	}
+
+	vs, s, err := getVirtualSpace(c)
+	if err != nil {
+		return err
+	}
+	results := registry.FindLatestVersions(vs, s, body.Apps)
+	entries := make([]*latestVersionEntry, len(results))
+	for i, result := range results {
+		entry := &latestVersionEntry{Slug: result.Slug, Channel: result.Channel}
+		entries[i] = entry
+		if result.Err != nil {
+			entry.Status, entry.Error = errorStatus(result.Err)
+			continue
+		}
+		counters.Hit(s.Name, result.Slug, counters.Latest)
+		cleanVersion(result.Version)
+		if err := compatManifest(c, result.Version); err != nil {
+			return err
+		}
+		entry.Version = newVersionWithLinks(c, result.Version)
+	}
+	return writeJSON(c, echo.Map{"apps": entries})
 }
@@ -1,18 +1,33 @@
 package web
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-kivik/kivik/v3"
 
 	"github.com/cozy/cozy-apps-registry/auth"
+	"github.com/cozy/cozy-apps-registry/base"
+	"github.com/cozy/cozy-apps-registry/cache"
 	"github.com/cozy/cozy-apps-registry/config"
+	"github.com/cozy/cozy-apps-registry/graphql"
 	"github.com/cozy/cozy-apps-registry/registry"
 	"github.com/cozy/cozy-apps-registry/space"
 	"github.com/spf13/viper"
@@ -25,6 +40,7 @@ const (
 	keptApp        = "kept"
 	rejectedApp    = "rejected"
 	overwrittenApp = "overwritten" // its name and icon are overwritten
+	otherAppsSpace = "other-apps"  // all the apps, except the rejected one
 )
 
 const (
@@ -38,8 +54,18 @@ const (
 	courgeKonn         = "courge" // courge is in maintenance
 )
 
+// publisherEditor is an editor that is not an admin.
+const publisherEditor = "publisher"
+
 var server *httptest.Server
 
+// tarballs serves the tarballs of the versions published by the tests.
+var (
+	tarballs     *httptest.Server
+	tarballsMu   sync.Mutex
+	tarballFiles = make(map[string][]byte)
+)
+
 func TestListAppsFromVirtualSpace(t *testing.T) {
 	u := fmt.Sprintf("%s/%s/registry/", server.URL, myAppsSpace)
 	res, err := http.Get(u)
@@ -142,6 +168,497 @@ func TestVersionIconFromVirtualSpace(t *testing.T) {
 	assert.Equal(t, expected, body)
 }
 
+func TestAppIconChannels(t *testing.T) {
+	const slug = "beta-only"
+	createTestApp(t, slug, publisherEditor)
+	u, sum := makeTarball(t, slug, publisherEditor, "1.0.0-beta.1")
+	code, _ := sendVersion(t, slug, "1.0.0-beta.1", u, sum, masterToken(t, publisherEditor), "")
+	assert.Equal(t, http.StatusCreated, code)
+
+	for _, name := range []string{allAppsSpace, otherAppsSpace} {
+		prefix := fmt.Sprintf("%s/%s/registry/%s", server.URL, name, slug)
+		// Without a channel, the icon is found in the beta channel
+		assert.Equal(t, http.StatusOK, getStatus(t, prefix+"/icon"), name)
+		assert.Equal(t, http.StatusOK, getStatus(t, prefix+"/beta/latest/icon"), name)
+		assert.Equal(t, http.StatusOK, getStatus(t, prefix+"/dev/latest/icon"), name)
+		// With an explicit channel, there is no fallback
+		assert.Equal(t, http.StatusNotFound, getStatus(t, prefix+"/stable/latest/icon"), name)
+		assert.Equal(t, http.StatusBadRequest, getStatus(t, prefix+"/nightly/latest/icon"), name)
+	}
+
+	// The icons are still served during a maintenance
+	s, _ := space.GetSpace(allAppsSpace)
+	assert.NoError(t, registry.ActivateMaintenanceApp(s, slug, registry.MaintenanceOptions{}))
+	assert.NoError(t, registry.ActivateMaintenanceVirtualSpace(otherAppsSpace, slug, registry.MaintenanceOptions{}))
+	for _, name := range []string{allAppsSpace, otherAppsSpace} {
+		u := fmt.Sprintf("%s/%s/registry/%s/icon", server.URL, name, slug)
+		assert.Equal(t, http.StatusOK, getStatus(t, u), name)
+	}
+	assert.NoError(t, registry.DeactivateMaintenanceVirtualSpace(otherAppsSpace, slug))
+	assert.NoError(t, registry.DeactivateMaintenanceApp(s, slug))
+}
+
+func TestGraphQLVersion(t *testing.T) {
+	query := `query ($slug: String!, $version: String!) {
+		version(space: "%s", slug: $slug, version: $version) { slug version }
+	}`
+	req := &graphql.Request{
+		Query:     fmt.Sprintf(query, allAppsSpace),
+		Variables: map[string]interface{}{"slug": overwrittenApp, "version": "1.2.3"},
+	}
+	res := graphqlSchema.Execute(context.Background(), req)
+	assert.Empty(t, res.Errors)
+	data, err := json.Marshal(res.Data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version":{"slug":"overwritten","version":"1.2.3"}}`, string(data))
+
+	// The pending versions are not exposed
+	req.Variables = map[string]interface{}{"slug": keptApp, "version": "2.0.0"}
+	res = graphqlSchema.Execute(context.Background(), req)
+	assert.Empty(t, res.Errors)
+	data, err = json.Marshal(res.Data)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"version":null}`, string(data))
+}
+
+func TestPublicationDowngrade(t *testing.T) {
+	const slug = "downgraded"
+	createTestApp(t, slug, publisherEditor)
+	token := masterToken(t, publisherEditor)
+
+	u, sum := makeTarball(t, slug, publisherEditor, "2.0.0")
+	code, _ := sendVersion(t, slug, "2.0.0", u, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+
+	u, sum = makeTarball(t, slug, publisherEditor, "1.0.0")
+	code, body := sendVersion(t, slug, "1.0.0", u, sum, token, "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, body["error"], "downgrades are refused")
+
+	// The dev versions are not concerned by the downgrade check
+	u, sum = makeTarball(t, slug, publisherEditor, "1.0.0-dev.1")
+	code, _ = sendVersion(t, slug, "1.0.0-dev.1", u, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestPublicationForce(t *testing.T) {
+	const slug = "forced"
+	createTestApp(t, slug, publisherEditor)
+	token := masterToken(t, publisherEditor)
+
+	u, sum := makeTarball(t, slug, publisherEditor, "2.0.0")
+	code, _ := sendVersion(t, slug, "2.0.0", u, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Only an admin can force the publication
+	u, sum = makeTarball(t, slug, publisherEditor, "1.0.0")
+	code, _ = sendVersion(t, slug, "1.0.0", u, sum, token, "?force=true")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = sendVersion(t, slug, "1.0.0", u, sum, masterToken(t, adminEditor), "?force=true")
+	assert.Equal(t, http.StatusCreated, code)
+}
+
+func TestExtractAttachmentsAdminOnly(t *testing.T) {
+	const slug = "reextracted"
+	publishTestVersions(t, slug, "1.0.0")
+	u := fmt.Sprintf("%s/%s/registry/%s/1.0.0/attachments/extract", server.URL, allAppsSpace, slug)
+
+	// The master token of the publisher is not an admin token
+	code, _ := doRequest(t, http.MethodPost, u, masterToken(t, publisherEditor), nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = doRequest(t, http.MethodPost, u, masterToken(t, adminEditor), nil)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestCatalogExports(t *testing.T) {
+	const slug = "exported"
+	publishTestVersions(t, slug, "1.0.0", "1.1.0-beta.1")
+	u := fmt.Sprintf("%s/%s/registry", server.URL, allAppsSpace)
+
+	get := func(u, accept string) (*http.Response, [][]string) {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Cannot send request: %s", err)
+		}
+		defer res.Body.Close()
+		r := csv.NewReader(res.Body)
+		if strings.HasPrefix(res.Header.Get("Content-Type"), "text/tab-separated-values") {
+			r.Comma = '\t'
+		}
+		records, _ := r.ReadAll()
+		return res, records
+	}
+
+	// The latest version is the stable one, whatever the asked channel
+	res, records := get(u+"?format=csv&filter[select]="+slug+"&latestChannelVersion=beta", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/csv; charset=utf-8", res.Header.Get("Content-Type"))
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, []string{"slug", "editor", "type", "latest_version", "published_at"}, records[0])
+		assert.Equal(t, []string{slug, publisherEditor, "webapp", "1.0.0"}, records[1][:4])
+		_, err := time.Parse(time.RFC3339, records[1][4])
+		assert.NoError(t, err)
+	}
+
+	// The format can be negotiated with the Accept header
+	res, records = get(u+"?filter[select]="+slug, "text/tab-separated-values")
+	assert.Equal(t, "text/tab-separated-values; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Len(t, records, 2)
+
+	// The next cursor is in a header
+	res, records = get(u+"?format=csv&limit=1", "")
+	assert.Len(t, records, 2)
+	assert.NotEmpty(t, res.Header.Get("X-Next-Cursor"))
+
+	res, _ = get(u+"?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	// The versions are listed with their channels
+	res, records = get(u+"/"+slug+"/versions", "text/csv")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, [][]string{
+		{"slug", "version", "channel"},
+		{slug, "1.0.0", "stable"},
+		{slug, "1.1.0-beta.1", "beta"},
+	}, records)
+}
+
+func TestPublicationDuplicateTarball(t *testing.T) {
+	const slug = "duplicated"
+	createTestApp(t, slug, publisherEditor)
+	token := masterToken(t, publisherEditor)
+
+	u, sum := makeTarball(t, slug, publisherEditor, "1.0.0")
+	code, _ := sendVersion(t, slug, "1.0.0", u, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+
+	// The check is made before the download, and is case insensitive
+	code, body := sendVersion(t, slug, "1.1.0", u, strings.ToUpper(sum), token, "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, body["error"], "already been published as the version 1.0.0")
+
+	// The same tarball can be used by another app
+	const other = "duplicated-other"
+	createTestApp(t, other, publisherEditor)
+	code, body = sendVersion(t, other, "1.0.0", u, sum, token, "")
+	assert.NotEqual(t, http.StatusConflict, code, body)
+}
+
+// publishTestVersions creates an app, and publishes the given versions of it.
+func publishTestVersions(t *testing.T, slug string, versions ...string) {
+	createTestApp(t, slug, publisherEditor)
+	token := masterToken(t, publisherEditor)
+	for _, version := range versions {
+		u, sum := makeTarball(t, slug, publisherEditor, version)
+		code, body := sendVersion(t, slug, version, u, sum, token, "")
+		if code != http.StatusCreated {
+			t.Fatalf("Cannot publish %s/%s: %d %v", slug, version, code, body)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	defer func(retention time.Duration) { base.Config.TrashRetention = retention }(base.Config.TrashRetention)
+	base.Config.TrashRetention = time.Hour
+
+	const slug = "trashed"
+	publishTestVersions(t, slug, "1.0.0", "1.1.0")
+	token := masterToken(t, publisherEditor)
+	u := fmt.Sprintf("%s/%s/registry/%s", server.URL, allAppsSpace, slug)
+
+	// The unpublished version goes to the trash
+	code, _ := doRequest(t, http.MethodDelete, u+"/1.0.0", token, nil)
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u+"/1.0.0"))
+	assert.Equal(t, http.StatusOK, getStatus(t, u+"/1.1.0"))
+
+	code, _ = doRequest(t, http.MethodGet, u+"/trash", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, body := doRequest(t, http.MethodGet, u+"/trash", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1h0m0s", body["retention"])
+	trashed, _ := body["versions"].([]interface{})
+	if assert.Len(t, trashed, 1) {
+		version := trashed[0].(map[string]interface{})
+		assert.Equal(t, "1.0.0", version["version"])
+		assert.Equal(t, publisherEditor, version["trashed_by"])
+		assert.NotEmpty(t, version["trashed_at"])
+	}
+
+	// It can't be published again while it is in the trash
+	tarball, sum := makeTarball(t, slug, publisherEditor, "1.0.0")
+	code, body = sendVersion(t, slug, "1.0.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Contains(t, body["error"], "Version is in the trash")
+
+	// But it can be restored
+	code, body = doRequest(t, http.MethodPost, u+"/1.0.0/restore", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1.0.0", body["version"])
+	assert.Nil(t, body["trashed_at"])
+	assert.Equal(t, http.StatusOK, getStatus(t, u+"/1.0.0"))
+	code, _ = doRequest(t, http.MethodPost, u+"/1.0.0/restore", token, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, body = doRequest(t, http.MethodGet, u+"/trash", token, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, body["versions"])
+}
+
+func TestTrashPurge(t *testing.T) {
+	defer func(retention time.Duration) { base.Config.TrashRetention = retention }(base.Config.TrashRetention)
+	base.Config.TrashRetention = time.Hour
+
+	s, _ := space.GetSpace(allAppsSpace)
+	token := masterToken(t, publisherEditor)
+	for _, slug := range []string{"purged", "held"} {
+		publishTestVersions(t, slug, "1.0.0")
+		u := fmt.Sprintf("%s/%s/registry/%s/1.0.0", server.URL, allAppsSpace, slug)
+		code, _ := doRequest(t, http.MethodDelete, u, token, nil)
+		assert.Equal(t, http.StatusNoContent, code)
+	}
+	u := fmt.Sprintf("%s/admin/legal-holds/%s/held", server.URL, allAppsSpace)
+	code, _ := doRequest(t, http.MethodPut, u, masterToken(t, adminEditor), strings.NewReader(`{"reason": "investigation"}`))
+	assert.Equal(t, http.StatusOK, code)
+
+	purgedBySlug := func(purged []*registry.CleanedVersion) map[string]*registry.CleanedVersion {
+		bySlug := make(map[string]*registry.CleanedVersion)
+		for _, v := range purged {
+			bySlug[v.Slug] = v
+		}
+		return bySlug
+	}
+	trashedCount := func(slug string) int {
+		versions, err := registry.GetTrashedVersions(s, slug)
+		assert.NoError(t, err)
+		return len(versions)
+	}
+
+	// The versions trashed after the date are not purged
+	purged, err := registry.PurgeTrash(s, time.Now().Add(-time.Minute), registry.RealRun)
+	assert.NoError(t, err)
+	assert.NotContains(t, purgedBySlug(purged), "purged")
+	assert.Equal(t, 1, trashedCount("purged"))
+
+	// A dry run tells what would be purged, without deleting anything
+	purged, err = registry.PurgeTrash(s, time.Now().Add(time.Minute), registry.DryRun)
+	assert.NoError(t, err)
+	bySlug := purgedBySlug(purged)
+	if assert.Contains(t, bySlug, "purged") {
+		assert.Equal(t, "", bySlug["purged"].KeptBy)
+		assert.NotEmpty(t, bySlug["purged"].Objects)
+	}
+	if assert.Contains(t, bySlug, "held") {
+		assert.Equal(t, "legal_hold", bySlug["held"].KeptBy)
+	}
+	assert.Equal(t, 1, trashedCount("purged"))
+
+	// The versions under a legal hold are kept by the purge
+	purged, err = registry.PurgeTrash(s, time.Now().Add(time.Minute), registry.RealRun)
+	assert.NoError(t, err)
+	bySlug = purgedBySlug(purged)
+	assert.Contains(t, bySlug, "purged")
+	if assert.Contains(t, bySlug, "held") {
+		assert.Equal(t, "legal_hold", bySlug["held"].KeptBy)
+	}
+	assert.Equal(t, 0, trashedCount("purged"))
+	assert.Equal(t, 1, trashedCount("held"))
+}
+
+func TestRoleTokens(t *testing.T) {
+	const slug = "role-app"
+	publishTestVersions(t, slug, "1.0.0")
+	publishAny := roleToken(t, auth.RolePublishAny)
+	maintenance := roleToken(t, auth.RoleMaintenance)
+	readAudit := roleToken(t, auth.RoleReadAudit)
+	u := fmt.Sprintf("%s/%s/registry/%s", server.URL, allAppsSpace, slug)
+
+	// A role token gives the rights of its role on the apps of all the editors
+	tarball, sum := makeTarball(t, slug, publisherEditor, "1.1.0")
+	code, _ := sendVersion(t, slug, "1.1.0", tarball, sum, maintenance, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = sendVersion(t, slug, "1.1.0", tarball, sum, publishAny, "")
+	assert.Equal(t, http.StatusCreated, code)
+	maintenanceURL := fmt.Sprintf("%s/%s/registry/maintenance/%s", server.URL, allAppsSpace, slug)
+	code, _ = doRequest(t, http.MethodPut, maintenanceURL+"/activate", publishAny, strings.NewReader(`{}`))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodPut, maintenanceURL+"/activate", maintenance, strings.NewReader(`{}`))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, http.MethodPut, maintenanceURL+"/deactivate", maintenance, nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	// But it can't act as an editor token or a master token
+	code, _ = doRequest(t, http.MethodDelete, u+"/1.1.0", publishAny, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodGet, u+"/trash", publishAny, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodGet, server.URL+"/admin/spaces", publishAny, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodGet, server.URL+"/admin/spaces", readAudit, nil)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = doRequest(t, http.MethodPost, server.URL+"/admin/spaces", readAudit, strings.NewReader(`{"name": "audited"}`))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	tarball, sum = makeTarball(t, slug, publisherEditor, "0.9.0")
+	code, _ = sendVersion(t, slug, "0.9.0", tarball, sum, publishAny, "?force=true")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// And the reverse: the editor tokens don't have the rights of the roles
+	// on the apps of the other editors, and the master tokens of the editors
+	// are not admin tokens
+	const other = "role-other-app"
+	createTestApp(t, other, adminEditor)
+	tarball, sum = makeTarball(t, other, adminEditor, "1.0.0")
+	code, _ = sendVersion(t, other, "1.0.0", tarball, sum, appToken(t, publisherEditor, other), "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodPut, maintenanceURL+"/activate", appToken(t, publisherEditor, slug), strings.NewReader(`{}`))
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodGet, server.URL+"/admin/spaces", masterToken(t, publisherEditor), nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestModerationReviews(t *testing.T) {
+	defer func(spaces []string) { base.Config.ModeratedSpaces = spaces }(base.Config.ModeratedSpaces)
+	const slug = "moderated"
+	publishTestVersions(t, slug, "1.0.0")
+	base.Config.ModeratedSpaces = []string{allAppsSpace}
+
+	token := masterToken(t, publisherEditor)
+	admin := masterToken(t, adminEditor)
+	u := fmt.Sprintf("%s/%s/registry/%s", server.URL, allAppsSpace, slug)
+	reviews := fmt.Sprintf("%s/admin/reviews/%s", server.URL, allAppsSpace)
+
+	// In a moderated space, all the versions wait for a review
+	for _, version := range []string{"1.1.0", "1.2.0-beta.1"} {
+		tarball, sum := makeTarball(t, slug, publisherEditor, version)
+		code, body := sendVersion(t, slug, version, tarball, sum, token, "")
+		assert.Equal(t, http.StatusCreated, code)
+		review, _ := body["pending_review"].(map[string]interface{})
+		assert.Equal(t, registry.ReviewModeration, review["reason"])
+		assert.Equal(t, http.StatusNotFound, getStatus(t, u+"/"+version))
+	}
+	_, body := doRequest(t, http.MethodGet, u+"/stable/latest", "", nil)
+	assert.Equal(t, "1.0.0", body["version"])
+
+	// The same version can't be published while it waits for a review
+	tarball, sum := makeTarball(t, slug, publisherEditor, "1.1.0")
+	code, body := sendVersion(t, slug, "1.1.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusConflict, code)
+	assert.Equal(t, registry.ErrVersionPending.Error(), body["error"])
+
+	// Only the admins can review the versions
+	code, _ = doRequest(t, http.MethodGet, reviews, token, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = doRequest(t, http.MethodPut, reviews+"/"+slug+"/1.1.0/approval", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	req, _ := http.NewRequest(http.MethodGet, reviews, nil)
+	req.Header.Set("Authorization", "Token "+admin)
+	res, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		var pending []map[string]interface{}
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&pending))
+		res.Body.Close()
+		versions := []string{}
+		for _, v := range pending {
+			if v["slug"] == slug {
+				versions = append(versions, v["version"].(string))
+			}
+		}
+		assert.ElementsMatch(t, []string{"1.1.0", "1.2.0-beta.1"}, versions)
+	}
+
+	// A rejection needs a comment, and removes the version
+	code, _ = doRequest(t, http.MethodPut, reviews+"/"+slug+"/1.2.0-beta.1/rejection", admin, strings.NewReader(`{}`))
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, body = doRequest(t, http.MethodPut, reviews+"/"+slug+"/1.2.0-beta.1/rejection", admin,
+		strings.NewReader(`{"comment": "The description is misleading"}`))
+	assert.Equal(t, http.StatusOK, code)
+	decision, _ := body["decision"].(map[string]interface{})
+	assert.Equal(t, registry.ReviewRejected, decision["status"])
+	assert.Equal(t, "The description is misleading", decision["comment"])
+	code, _ = doRequest(t, http.MethodGet, reviews+"/"+slug+"/1.2.0-beta.1", admin, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u+"/1.2.0-beta.1"))
+
+	// An approval releases the version
+	code, body = doRequest(t, http.MethodGet, reviews+"/"+slug+"/1.1.0", admin, nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "1.0.0", body["latest_version"])
+	code, body = doRequest(t, http.MethodPut, reviews+"/"+slug+"/1.1.0/approval", admin,
+		strings.NewReader(`{"comment": "Looks good"}`))
+	assert.Equal(t, http.StatusOK, code)
+	decision, _ = body["decision"].(map[string]interface{})
+	assert.Equal(t, registry.ReviewApproved, decision["status"])
+	assert.Equal(t, http.StatusOK, getStatus(t, u+"/1.1.0"))
+	_, body = doRequest(t, http.MethodGet, u+"/stable/latest", "", nil)
+	assert.Equal(t, "1.1.0", body["version"])
+	code, _ = doRequest(t, http.MethodPut, reviews+"/"+slug+"/1.1.0/approval", admin, nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// And the released version can't be published again
+	code, _ = sendVersion(t, slug, "1.1.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusConflict, code)
+}
+
+func TestPermissionsReviews(t *testing.T) {
+	defer func(spaces []string) { base.Config.ReviewedSpaces = spaces }(base.Config.ReviewedSpaces)
+	base.Config.ReviewedSpaces = []string{allAppsSpace}
+
+	const slug = "reviewed-permissions"
+	createTestApp(t, slug, publisherEditor)
+	token := masterToken(t, publisherEditor)
+	u := fmt.Sprintf("%s/%s/registry/%s", server.URL, allAppsSpace, slug)
+	files := map[string]interface{}{"files": map[string]interface{}{"type": "io.cozy.files"}}
+	settings := map[string]interface{}{
+		"files":    map[string]interface{}{"type": "io.cozy.files"},
+		"settings": map[string]interface{}{"type": "io.cozy.settings"},
+	}
+
+	// The first stable version has nothing to be compared with
+	tarball, sum := makeTarballWithPermissions(t, slug, publisherEditor, "1.0.0", files)
+	code, body := sendVersion(t, slug, "1.0.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Nil(t, body["pending_review"])
+
+	// Neither do the versions with the same permissions
+	tarball, sum = makeTarballWithPermissions(t, slug, publisherEditor, "1.1.0", files)
+	code, body = sendVersion(t, slug, "1.1.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Nil(t, body["pending_review"])
+
+	// But a new permission must be reviewed, on the stable channel only
+	tarball, sum = makeTarballWithPermissions(t, slug, publisherEditor, "1.2.0-beta.1", settings)
+	code, body = sendVersion(t, slug, "1.2.0-beta.1", tarball, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Nil(t, body["pending_review"])
+	tarball, sum = makeTarballWithPermissions(t, slug, publisherEditor, "1.2.0", settings)
+	code, body = sendVersion(t, slug, "1.2.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusCreated, code)
+	review, _ := body["pending_review"].(map[string]interface{})
+	assert.Equal(t, registry.ReviewPermissions, review["reason"])
+	assert.Equal(t, "1.1.0", review["previous_version"])
+	assert.Equal(t, []interface{}{"settings"}, review["permissions"])
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u+"/1.2.0"))
+
+	// It can't be published again while it waits for the review
+	code, _ = sendVersion(t, slug, "1.2.0", tarball, sum, token, "")
+	assert.Equal(t, http.StatusConflict, code)
+
+	// The publisher can't approve its own version
+	approval := fmt.Sprintf("%s/admin/reviews/%s/%s/1.2.0/approval", server.URL, allAppsSpace, slug)
+	code, _ = doRequest(t, http.MethodPut, approval, masterToken(t, publisherEditor), nil)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u+"/1.2.0"))
+
+	code, _ = doRequest(t, http.MethodPut, approval, masterToken(t, adminEditor), nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, http.StatusOK, getStatus(t, u+"/1.2.0"))
+}
+
 func TestMain(m *testing.M) {
 	config.SetDefaults()
 	viper.Set("spaces", []string{"__default__", allAppsSpace, allKonnectorsSpace})
@@ -151,6 +668,11 @@ func TestMain(m *testing.M) {
 			"filter": "select",
 			"slugs":  []interface{}{overwrittenApp, keptApp},
 		},
+		otherAppsSpace: map[string]interface{}{
+			"source": allAppsSpace,
+			"filter": "reject",
+			"slugs":  []interface{}{rejectedApp},
+		},
 		myKonnectorsSpace: map[string]interface{}{
 			"source": allKonnectorsSpace,
 			"filter": "reject",
@@ -172,6 +694,14 @@ func TestMain(m *testing.M) {
 		os.Exit(1)
 	}
 
+	base.SessionSecret = []byte("session-secret-for-the-tests")
+	for _, name := range []string{adminEditor, publisherEditor} {
+		if _, err := auth.Editors.CreateEditorWithoutPublicKey(name, true); err != nil {
+			fmt.Println("Cannot create editor:", err)
+			os.Exit(1)
+		}
+	}
+
 	if err := createApps(); err != nil {
 		fmt.Println("Cannot create apps:", err)
 		os.Exit(1)
@@ -179,9 +709,11 @@ func TestMain(m *testing.M) {
 
 	router := Router()
 	server = httptest.NewServer(router)
+	tarballs = httptest.NewServer(http.HandlerFunc(serveTarball))
 
 	out := m.Run()
 
+	tarballs.Close()
 	server.Close()
 
 	if err := config.CleanupTests(); err != nil {
@@ -239,6 +771,20 @@ func createApps() error {
 		return err
 	}
 
+	kept, err := registry.FindApp(nil, s, keptApp, registry.Dev)
+	if err != nil {
+		return err
+	}
+	pending := &registry.Version{
+		ID:      keptApp + "-2.0.0",
+		Slug:    keptApp,
+		Version: "2.0.0",
+		URL:     "http://example.org/registry/dummy.tar.gz",
+	}
+	if err = registry.CreatePendingVersion(s, pending, nil, kept); err != nil {
+		return err
+	}
+
 	if err := registry.OverwriteAppName(myAppsSpace, overwrittenApp, "my new name"); err != nil {
 		return err
 	}
@@ -292,3 +838,359 @@ func createApps() error {
 
 	return registry.DeactivateMaintenanceVirtualSpace(myKonnectorsSpace, quuxKonn)
 }
+
+func TestRevokedToken(t *testing.T) {
+	editor, err := auth.Editors.CreateEditorWithoutPublicKey("revoked", true)
+	assert.NoError(t, err)
+	token, err := editor.GenerateMasterToken(base.SessionSecret, time.Hour)
+	assert.NoError(t, err)
+	encoded := base64.StdEncoding.EncodeToString(token)
+	other, err := editor.GenerateMasterToken(base.SessionSecret, time.Hour)
+	assert.NoError(t, err)
+
+	u := fmt.Sprintf("%s/%s/registry", server.URL, allAppsSpace)
+	create := func(slug, token string) (int, map[string]interface{}) {
+		body, _ := json.Marshal(map[string]string{"slug": slug, "editor": "revoked", "type": "webapp"})
+		return doRequest(t, http.MethodPost, u, token, bytes.NewReader(body))
+	}
+	code, _ := create("revoked-before", encoded)
+	assert.Equal(t, http.StatusCreated, code)
+
+	assert.NoError(t, auth.Revocations.RevokeToken(editor, token))
+	code, body := create("revoked-after", encoded)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Contains(t, body["error"], "revoked")
+
+	// The other tokens of the editor are still accepted
+	code, _ = create("revoked-other", base64.StdEncoding.EncodeToString(other))
+	assert.Equal(t, http.StatusCreated, code)
+
+	// Another instance of the registry reads the revocation from the database
+	db := base.DBClient.DB(context.Background(), base.DBName("revoked_tokens"))
+	list := auth.NewRevocationList(db)
+	revoked, err := list.IsRevoked(token)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+	revoked, err = list.IsRevoked(other)
+	assert.NoError(t, err)
+	assert.False(t, revoked)
+}
+
+func TestGraphQLBatches(t *testing.T) {
+	query := `{
+		editors {
+			name
+			apps(space: "%s", limit: 10) { apps { slug editor latestVersion(channel: "dev") { version } } }
+		}
+	}`
+	req := &graphql.Request{Query: fmt.Sprintf(query, allAppsSpace)}
+	res := graphqlSchema.Execute(context.Background(), req)
+	assert.Empty(t, res.Errors)
+	data, err := json.Marshal(res.Data)
+	assert.NoError(t, err)
+	var body struct {
+		Editors []struct {
+			Name string `json:"name"`
+			Apps struct {
+				Apps []struct {
+					Slug          string `json:"slug"`
+					Editor        string `json:"editor"`
+					LatestVersion *struct {
+						Version string `json:"version"`
+					} `json:"latestVersion"`
+				} `json:"apps"`
+			} `json:"apps"`
+		} `json:"editors"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &body))
+	found := false
+	for _, editor := range body.Editors {
+		for _, app := range editor.Apps.Apps {
+			assert.Equal(t, editor.Name, app.Editor, app.Slug)
+			if app.Slug == overwrittenApp {
+				found = true
+				assert.Equal(t, "1.2.3", app.LatestVersion.Version)
+			}
+			if app.Slug == keptApp {
+				// The pending versions are not exposed
+				assert.Nil(t, app.LatestVersion)
+			}
+		}
+	}
+	assert.True(t, found)
+
+	// Without the limit, the query is too expensive
+	req = &graphql.Request{Query: `{ editors { apps { apps { slug latestVersion { version } } } } }`}
+	res = graphqlSchema.Execute(context.Background(), req)
+	assert.Nil(t, res.Data)
+	assert.Len(t, res.Errors, 1)
+}
+
+// Helpers
+//
+
+// masterToken returns a master token for the editor. The master tokens of the
+// cozy editor are the admin tokens.
+func TestAdminSpaces(t *testing.T) {
+	token := masterToken(t, adminEditor)
+	u := server.URL + "/admin/spaces"
+	body := `{"name": "created-space"}`
+
+	status, data := doRequest(t, "POST", u, token, strings.NewReader(body))
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "api", data["origin"])
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL+"/created-space/registry"))
+	status, _ = doRequest(t, "POST", u, token, strings.NewReader(body))
+	assert.Equal(t, http.StatusConflict, status)
+
+	// An archived space is no longer served
+	status, _ = doRequest(t, "DELETE", u+"/created-space", token, nil)
+	assert.Equal(t, http.StatusNoContent, status)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL+"/created-space/registry"))
+	status, _ = doRequest(t, "DELETE", u+"/created-space", token, nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	record, err := space.FindCreated("created-space")
+	assert.NoError(t, err)
+	assert.True(t, record.Archived())
+
+	// Creating it again restores it, even if its name is in the negative cache
+	status, _ = doRequest(t, "POST", u, token, strings.NewReader(body))
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL+"/created-space/registry"))
+	record, err = space.FindCreated("created-space")
+	assert.NoError(t, err)
+	assert.False(t, record.Archived())
+
+	// The spaces of the configuration can't be archived
+	status, _ = doRequest(t, "DELETE", u+"/"+allAppsSpace, token, nil)
+	assert.Equal(t, http.StatusConflict, status)
+}
+
+// recordSpace records a space as if it was created by another instance of
+// the registry: it is not registered in this one.
+func recordSpace(t *testing.T, name string, archived bool) {
+	created := space.Created{Name: name, CreatedAt: time.Now().UTC()}
+	if archived {
+		created.ArchivedAt = &created.CreatedAt
+	}
+	if _, err := space.CreatedDB.Put(context.Background(), name, created); err != nil {
+		t.Fatalf("Cannot record space %s: %s", name, err)
+	}
+}
+
+func TestSpaceCreatedByAnotherInstance(t *testing.T) {
+	u := server.URL + "/remote-space/registry"
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u))
+
+	// The name is in the negative cache, until a change of the created
+	// spaces makes the registry forget it
+	recordSpace(t, "remote-space", false)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u))
+	ForgetMissingSpace("remote-space")
+	assert.Equal(t, http.StatusOK, getStatus(t, u))
+	_, ok := space.GetSpace("remote-space")
+	assert.True(t, ok)
+
+	// An archived space is not registered
+	recordSpace(t, "archived-space", true)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL+"/archived-space/registry"))
+	_, ok = space.GetSpace("archived-space")
+	assert.False(t, ok)
+}
+
+func TestCreatedSpacesWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go space.RunCreatedSpacesWatcher(ctx, ForgetMissingSpace)
+
+	u := server.URL + "/watched-space/registry"
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u))
+	// Let the watcher start to follow the changes
+	time.Sleep(200 * time.Millisecond)
+	recordSpace(t, "watched-space", false)
+	status := http.StatusNotFound
+	for i := 0; i < 50 && status == http.StatusNotFound; i++ {
+		time.Sleep(20 * time.Millisecond)
+		status = getStatus(t, u)
+	}
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestMissingSpacesCache(t *testing.T) {
+	defer func(previous base.Cache) { missingSpaces = previous }(missingSpaces)
+
+	// The names are forgotten after the TTL
+	missingSpaces = cache.NewLRUCache(1024, 50*time.Millisecond)
+	u := server.URL + "/expired-space/registry"
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u))
+	recordSpace(t, "expired-space", false)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, u))
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, getStatus(t, u))
+
+	// And the oldest names are evicted when the cache is full
+	missingSpaces = cache.NewLRUCache(2, time.Minute)
+	for _, name := range []string{"evicted-space", "unknown-a", "unknown-b"} {
+		assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL+"/"+name+"/registry"))
+	}
+	recordSpace(t, "evicted-space", false)
+	assert.Equal(t, http.StatusOK, getStatus(t, server.URL+"/evicted-space/registry"))
+	recordSpace(t, "unknown-b", false)
+	assert.Equal(t, http.StatusNotFound, getStatus(t, server.URL+"/unknown-b/registry"))
+}
+
+func masterToken(t *testing.T, editorName string) string {
+	editor, err := auth.Editors.GetEditor(editorName)
+	if err != nil {
+		t.Fatalf("Cannot find editor %s: %s", editorName, err)
+	}
+	token, err := editor.GenerateMasterToken(base.SessionSecret, time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot generate token: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// roleToken returns a role token of the admin editor, encoded in base64.
+func roleToken(t *testing.T, role string) string {
+	editor, err := auth.Editors.GetEditor(adminEditor)
+	if err != nil {
+		t.Fatalf("Cannot find editor %s: %s", adminEditor, err)
+	}
+	token, err := editor.GenerateRoleToken(base.SessionSecret, time.Hour, role)
+	if err != nil {
+		t.Fatalf("Cannot generate token: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// appToken returns an editor token for an app, encoded in base64.
+func appToken(t *testing.T, editorName, slug string) string {
+	editor, err := auth.Editors.GetEditor(editorName)
+	if err != nil {
+		t.Fatalf("Cannot find editor %s: %s", editorName, err)
+	}
+	token, err := editor.GenerateEditorToken(base.SessionSecret, time.Hour, slug)
+	if err != nil {
+		t.Fatalf("Cannot generate token: %s", err)
+	}
+	return base64.StdEncoding.EncodeToString(token)
+}
+
+// createTestApp creates a webapp for the editor in the all-apps space.
+func createTestApp(t *testing.T, slug, editorName string) {
+	s, _ := space.GetSpace(allAppsSpace)
+	editor, err := auth.Editors.GetEditor(editorName)
+	if err != nil {
+		t.Fatalf("Cannot find editor %s: %s", editorName, err)
+	}
+	opts := &registry.AppOptions{Editor: editorName, Slug: slug, Type: "webapp"}
+	if _, err := registry.CreateApp(s, opts, editor); err != nil {
+		t.Fatalf("Cannot create app %s: %s", slug, err)
+	}
+}
+
+// makeTarball generates the tarball of a version of a webapp, and serves it
+// on the tarballs server. It returns its URL and its sha256.
+func makeTarball(t *testing.T, slug, editorName, version string) (string, string) {
+	return makeTarballWithPermissions(t, slug, editorName, version, nil)
+}
+
+// makeTarballWithPermissions is the same as makeTarball, with the given
+// permissions in the manifest.
+func makeTarballWithPermissions(t *testing.T, slug, editorName, version string, permissions map[string]interface{}) (string, string) {
+	fields := map[string]interface{}{
+		"name":    slug,
+		"slug":    slug,
+		"editor":  editorName,
+		"version": version,
+		"icon":    "icon.svg",
+	}
+	if permissions != nil {
+		fields["permissions"] = permissions
+	}
+	manifest, _ := json.Marshal(fields)
+	pkg, _ := json.Marshal(map[string]interface{}{"version": version})
+	icon := []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg"><title>%s</title></svg>`, slug))
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, content := range map[string][]byte{"manifest.webapp": manifest, "package.json": pkg, "icon.svg": icon} {
+		hdr := &tar.Header{Name: name, Size: int64(len(content)), Mode: 0644}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Cannot write tarball: %s", err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatalf("Cannot write tarball: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Cannot write tarball: %s", err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatalf("Cannot write tarball: %s", err)
+	}
+
+	path := fmt.Sprintf("/%s-%s.tar.gz", slug, version)
+	tarballsMu.Lock()
+	tarballFiles[path] = buf.Bytes()
+	tarballsMu.Unlock()
+	sum := sha256.Sum256(buf.Bytes())
+	return tarballs.URL + path, hex.EncodeToString(sum[:])
+}
+
+func serveTarball(w http.ResponseWriter, r *http.Request) {
+	tarballsMu.Lock()
+	content, ok := tarballFiles[r.URL.Path]
+	tarballsMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	_, _ = w.Write(content)
+}
+
+// sendVersion sends a version to the registry with the token, and returns
+// the status code and the body of the response.
+func sendVersion(t *testing.T, slug, version, tarballURL, sum, token, query string) (int, map[string]interface{}) {
+	body, _ := json.Marshal(map[string]string{
+		"version": version,
+		"url":     tarballURL,
+		"sha256":  sum,
+	})
+	u := fmt.Sprintf("%s/%s/registry/%s%s", server.URL, allAppsSpace, slug, query)
+	return doRequest(t, http.MethodPost, u, token, bytes.NewReader(body))
+}
+
+// doRequest sends a request with a JSON body and the token, and returns the
+// status code and the decoded body of the response.
+func doRequest(t *testing.T, method, u, token string, body io.Reader) (int, map[string]interface{}) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		t.Fatalf("Cannot make request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot send request: %s", err)
+	}
+	defer res.Body.Close()
+	var data map[string]interface{}
+	_ = json.NewDecoder(res.Body).Decode(&data)
+	return res.StatusCode, data
+}
+
+// getStatus sends a GET request, and returns the status code of the response.
+func getStatus(t *testing.T, u string) int {
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("Cannot send request: %s", err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
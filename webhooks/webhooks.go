@@ -0,0 +1,314 @@
+// Package webhooks sends notifications to the downstream systems (store
+// front, CI, chat, trust and safety tools, etc.) when an app or a version is
+// created or deleted, when an app goes in maintenance, or when it is
+// moderated. The payloads are signed with a secret shared with the receiver,
+// and the deliveries are retried with an exponential backoff. The
+// notifications that can't be delivered are kept in a dead-letter log.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Events that can be sent to the webhooks.
+const (
+	AppCreated           = "app.created"
+	VersionCreated       = "version.created"
+	VersionDeleted       = "version.deleted"
+	VersionTrashed       = "version.trashed"
+	VersionRestored      = "version.restored"
+	MaintenanceActivated = "maintenance.activated"
+	VersionPendingReview = "version.pending_review"
+	VersionApproved      = "version.approved"
+	VersionRejected      = "version.rejected"
+)
+
+// Moderation events, sent with a ModerationData.
+const (
+	ModerationFlagged  = "moderation.flagged"
+	ModerationUnlisted = "moderation.unlisted"
+	ModerationTakedown = "moderation.takedown"
+	ModerationAdvisory = "moderation.advisory"
+)
+
+// Events is the list of all the events.
+var Events = []string{AppCreated, VersionCreated, VersionDeleted, VersionTrashed, VersionRestored, MaintenanceActivated,
+	VersionPendingReview, VersionApproved, VersionRejected,
+	ModerationFlagged, ModerationUnlisted, ModerationTakedown, ModerationAdvisory}
+
+// ModerationData is the data of the moderation events. Unlike the release
+// events, whose data is an application or a version, it describes the
+// moderation action, so that the trust and safety tools can follow the state
+// of the applications.
+type ModerationData struct {
+	Slug string `json:"slug"`
+	// Active is false when the action is lifted (an application is no longer
+	// flagged, or listed again, or the takedown is withdrawn). It is always
+	// true for an advisory.
+	Active    bool        `json:"active"`
+	Reason    string      `json:"reason,omitempty"`
+	Reference string      `json:"reference,omitempty"`
+	By        string      `json:"by"`
+	At        time.Time   `json:"at"`
+	Advisory  interface{} `json:"advisory,omitempty"`
+}
+
+// SignatureHeader is the HTTP header with the HMAC-SHA256 signature of the
+// body, computed with the secret of the webhook.
+const SignatureHeader = "X-Cozy-Registry-Signature"
+
+// maxDeadLetters is the number of failed deliveries kept in memory.
+const maxDeadLetters = 100
+
+// Webhook is an endpoint that receives the events of a space.
+type Webhook struct {
+	URL    string
+	Secret string
+	// Events is the list of the events sent to this webhook (all if empty).
+	Events []string
+}
+
+// Payload is the JSON body sent to the webhooks.
+type Payload struct {
+	Event  string      `json:"event"`
+	Space  string      `json:"space"`
+	SentAt time.Time   `json:"sent_at"`
+	Data   interface{} `json:"data"`
+}
+
+// DeadLetter is a notification that has not been delivered.
+type DeadLetter struct {
+	URL      string          `json:"url"`
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// Dispatcher sends the events to the webhooks configured for each space.
+type Dispatcher struct {
+	hooks    map[string][]Webhook
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+	mu       sync.Mutex
+	dead     []DeadLetter
+	inFlight sync.WaitGroup
+	// stopping is closed when the server is stopped, to give up the retries
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+var dispatcher *Dispatcher
+
+// NewDispatcher returns a dispatcher for the given webhooks, by space name
+// (__default__ for the default space).
+func NewDispatcher(hooks map[string][]Webhook, timeout time.Duration, retries int, backoff time.Duration) *Dispatcher {
+	return &Dispatcher{
+		hooks:    hooks,
+		client:   &http.Client{Timeout: timeout},
+		retries:  retries,
+		backoff:  backoff,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Configure sets the dispatcher used by Send.
+func Configure(d *Dispatcher) {
+	dispatcher = d
+}
+
+// Send notifies the webhooks of the space of an event, if any. The delivery
+// is asynchronous.
+func Send(spaceName, event string, data interface{}) {
+	if dispatcher != nil {
+		dispatcher.Send(spaceName, event, data)
+	}
+}
+
+// GetDeadLetters returns the last notifications that have not been delivered.
+func GetDeadLetters() []DeadLetter {
+	if dispatcher == nil {
+		return []DeadLetter{}
+	}
+	return dispatcher.DeadLetters()
+}
+
+// Send notifies the webhooks of the space of an event. The delivery is
+// asynchronous.
+func (d *Dispatcher) Send(spaceName, event string, data interface{}) {
+	if spaceName == "" {
+		spaceName = "__default__"
+	}
+	hooks := d.hooks[spaceName]
+	if len(hooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(Payload{
+		Event:  event,
+		Space:  spaceName,
+		SentAt: time.Now().UTC(),
+		Data:   data,
+	})
+	if err != nil {
+		logrus.WithField("nspace", "webhooks").Errorf("Cannot serialize the payload: %s", err)
+		return
+	}
+	for _, hook := range hooks {
+		if !hook.accepts(event) {
+			continue
+		}
+		d.inFlight.Add(1)
+		go func(hook Webhook) {
+			defer d.inFlight.Done()
+			d.deliver(hook, body)
+		}(hook)
+	}
+}
+
+// Wait blocks until the deliveries in progress are finished.
+func (d *Dispatcher) Wait() {
+	d.inFlight.Wait()
+}
+
+// Stop gives up the retries of the deliveries in progress: they are not
+// retried anymore, and go to the dead letters after their current attempt.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() { close(d.stopping) })
+}
+
+// Shutdown waits until the deliveries of the configured dispatcher are
+// finished, or the context is done. The deliveries waiting for a retry are
+// not retried again: with the default backoff, the retries can take more
+// than the grace period. They are logged and kept in the dead letters.
+func Shutdown(ctx context.Context) error {
+	if dispatcher == nil {
+		return nil
+	}
+	dispatcher.Stop()
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeadLetters returns the last notifications that have not been delivered.
+func (d *Dispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]DeadLetter, len(d.dead))
+	copy(list, d.dead)
+	return list
+}
+
+func (h Webhook) accepts(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature of a body for the given secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) deliver(hook Webhook, body []byte) {
+	var err error
+	attempts := 0
+	delay := d.backoff
+	for {
+		attempts++
+		if err = d.post(hook, body); err == nil {
+			return
+		}
+		if attempts > d.retries {
+			break
+		}
+		if !d.wait(delay) {
+			err = fmt.Errorf("%s (not retried, the server is stopping)", err)
+			break
+		}
+		delay *= 2
+	}
+
+	letter := DeadLetter{
+		URL:      hook.URL,
+		Payload:  body,
+		Error:    err.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	logrus.WithFields(logrus.Fields{
+		"nspace":   "webhooks",
+		"url":      hook.URL,
+		"attempts": attempts,
+		"payload":  string(body),
+	}).Errorf("Webhook not delivered: %s", err)
+
+	d.mu.Lock()
+	d.dead = append(d.dead, letter)
+	if len(d.dead) > maxDeadLetters {
+		d.dead = d.dead[len(d.dead)-maxDeadLetters:]
+	}
+	d.mu.Unlock()
+}
+
+// wait sleeps before a retry, and returns false if the server is stopped in
+// the meantime.
+func (d *Dispatcher) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-d.stopping:
+		return false
+	}
+}
+
+func (d *Dispatcher) post(hook Webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cozy-apps-registry")
+	if hook.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(hook.Secret, body))
+	}
+	res, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return nil
+}
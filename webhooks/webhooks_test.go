@@ -0,0 +1,161 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendSigned(t *testing.T) {
+	received := make(chan Payload, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, Sign("s3cret", body), r.Header.Get(SignatureHeader))
+		var payload Payload
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		received <- payload
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(map[string][]Webhook{
+		"__default__": {{URL: ts.URL, Secret: "s3cret"}},
+	}, time.Second, 0, time.Millisecond)
+	d.Send("", VersionCreated, map[string]string{"slug": "drive"})
+	d.Send("other", VersionCreated, map[string]string{"slug": "drive"})
+	d.Wait()
+
+	payload := <-received
+	assert.Equal(t, VersionCreated, payload.Event)
+	assert.Equal(t, "__default__", payload.Space)
+	assert.Equal(t, map[string]interface{}{"slug": "drive"}, payload.Data)
+	assert.Len(t, received, 0)
+	assert.Len(t, d.DeadLetters(), 0)
+}
+
+func TestSendFiltered(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(map[string][]Webhook{
+		"myspace": {{URL: ts.URL, Events: []string{AppCreated}}},
+	}, time.Second, 0, time.Millisecond)
+	d.Send("myspace", VersionDeleted, nil)
+	d.Send("myspace", AppCreated, nil)
+	d.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestSendRetryAndDeadLetter(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(map[string][]Webhook{
+		"__default__": {{URL: ts.URL}},
+	}, time.Second, 2, time.Millisecond)
+	d.Send("", MaintenanceActivated, nil)
+	d.Wait()
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+	assert.Len(t, d.DeadLetters(), 0)
+
+	d = NewDispatcher(map[string][]Webhook{
+		"__default__": {{URL: ts.URL + "/404"}},
+	}, time.Second, 1, time.Millisecond)
+	atomic.StoreInt32(&calls, 0)
+	d.Send("", MaintenanceActivated, nil)
+	d.Wait()
+	dead := d.DeadLetters()
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, 2, dead[0].Attempts)
+		assert.Contains(t, dead[0].Error, "503")
+	}
+}
+
+func TestSendModeration(t *testing.T) {
+	received := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Event string                 `json:"event"`
+			Data  map[string]interface{} `json:"data"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		assert.Equal(t, ModerationTakedown, payload.Event)
+		received <- payload.Data
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(map[string][]Webhook{
+		"__default__": {{URL: ts.URL, Events: []string{ModerationTakedown}}},
+	}, time.Second, 0, time.Millisecond)
+	at := time.Date(2021, 3, 12, 10, 21, 46, 0, time.UTC)
+	d.Send("", VersionCreated, map[string]string{"slug": "drive"})
+	d.Send("", ModerationTakedown, ModerationData{
+		Slug:      "drive",
+		Active:    true,
+		Reason:    "Copyright infringement",
+		Reference: "DMCA-42",
+		By:        "cozy",
+		At:        at,
+	})
+	d.Wait()
+	d.Send("", ModerationTakedown, ModerationData{Slug: "drive", By: "cozy", At: at})
+	d.Wait()
+
+	assert.Equal(t, map[string]interface{}{
+		"slug":      "drive",
+		"active":    true,
+		"reason":    "Copyright infringement",
+		"reference": "DMCA-42",
+		"by":        "cozy",
+		"at":        "2021-03-12T10:21:46Z",
+	}, <-received)
+	assert.Equal(t, map[string]interface{}{
+		"slug":   "drive",
+		"active": false,
+		"by":     "cozy",
+		"at":     "2021-03-12T10:21:46Z",
+	}, <-received)
+	assert.Len(t, received, 0)
+}
+
+func TestStopRetries(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	d := NewDispatcher(map[string][]Webhook{
+		"__default__": {{URL: ts.URL}},
+	}, time.Second, 5, time.Minute)
+	d.Send("", MaintenanceActivated, nil)
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The delivery waits a minute before its retry, but it is given up
+	start := time.Now()
+	d.Stop()
+	d.Wait()
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+	dead := d.DeadLetters()
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, 1, dead[0].Attempts)
+		assert.Contains(t, dead[0].Error, "the server is stopping")
+	}
+}